@@ -1,43 +1,38 @@
 package main
 
 import (
-	"codegate-proxy/internal/auth"
 	"codegate-proxy/internal/db"
-	"codegate-proxy/internal/guardrails"
-	"codegate-proxy/internal/limits"
 	"codegate-proxy/internal/proxy"
+	"codegate-proxy/internal/redact"
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 )
 
 func main() {
 	proxyPort := getEnv("PROXY_PORT", "9212")
 
 	log.SetFlags(log.Ltime | log.Lmicroseconds)
+	// Scrub API keys and JWTs from log output unless log_scrubbing=false
+	log.SetOutput(redact.NewWriter(os.Stderr, logScrubbingEnabled))
 
-	// Open the shared SQLite database (read-only for queries, write connections opened per-write)
-	if err := db.Open(); err != nil {
-		log.Fatalf("Failed to open database: %v", err)
-	}
-	defer db.Close()
-
-	// Initialize guardrails (anonymize/deanonymize pipeline)
-	guardrails.InitGuardrails()
-	if guardrails.IsGuardrailsEnabled() {
-		log.Println("Guardrails enabled")
-	} else {
-		log.Println("Guardrails disabled (no guardrail key found)")
-	}
-
-	// Start OAuth token refresh background loop
-	auth.StartTokenRefreshLoop()
+	// The root context is cancelled on SIGINT or SIGTERM, which stops the
+	// background loops and starts the graceful shutdown below
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	// Initialize model limits (per-model output token caps)
-	limits.InitModelLimitsTable()
+	// Database, guardrails, model limits, and background loops, in order
+	app, err := bootstrap(ctx)
+	if err != nil {
+		log.Fatalf("Startup failed: %v", err)
+	}
+	defer app.shutdown()
 
 	handler := proxy.Handler()
 
@@ -46,13 +41,19 @@ func main() {
 		Handler: handler,
 	}
 
-	// Graceful shutdown
+	// Graceful shutdown: in-flight requests get shutdownTimeout to finish,
+	// then the background loops get loopStopTimeout and the database is
+	// closed
+	drained := make(chan struct{})
 	go func() {
-		sigCh := make(chan os.Signal, 1)
-		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-		<-sigCh
+		defer close(drained)
+		<-ctx.Done()
 		log.Println("Shutting down proxy...")
-		server.Close()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			server.Close()
+		}
 	}()
 
 	fmt.Printf("CodeGate Go Proxy starting on :%s\n", proxyPort)
@@ -62,13 +63,37 @@ func main() {
 	if err := server.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatalf("Server error: %v", err)
 	}
+	<-drained
 
 	log.Println("Proxy stopped.")
 }
 
+// shutdownTimeout bounds how long shutdown waits for in-flight requests.
+const shutdownTimeout = 10 * time.Second
+
 func getEnv(key, fallback string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
 	}
 	return fallback
 }
+
+// logScrubbingInterval bounds how often the log_scrubbing setting is read,
+// since it is checked for every log line.
+const logScrubbingInterval = 30 * time.Second
+
+var logScrubbing struct {
+	sync.Mutex
+	enabled bool
+	checked time.Time
+}
+
+func logScrubbingEnabled() bool {
+	logScrubbing.Lock()
+	defer logScrubbing.Unlock()
+	if time.Since(logScrubbing.checked) > logScrubbingInterval {
+		logScrubbing.enabled = db.GetSetting("log_scrubbing") != "false"
+		logScrubbing.checked = time.Now()
+	}
+	return logScrubbing.enabled
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"codegate-proxy/internal/auth"
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/guardrails"
+	"codegate-proxy/internal/limits"
+	"codegate-proxy/internal/provider"
+	"codegate-proxy/internal/proxy"
+	"codegate-proxy/internal/run"
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// loopStopTimeout bounds how long shutdown waits for background loops.
+const loopStopTimeout = 5 * time.Second
+
+// startup is what bootstrap brought up: each subsystem's outcome, and the
+// hooks that stop the ones it started.
+type startup struct {
+	// status maps each subsystem to the error it failed with, or nil.
+	status map[string]error
+	stops  []func()
+	loops  run.Manager
+}
+
+// bootstrap runs the startup sequence in order. The database and guardrails
+// are required and fail it: without the guardrail key, privacy_enabled
+// would send exact values upstream. Optional subsystems that fail are
+// logged and left out. Background loops run until ctx is cancelled or
+// shutdown is called.
+func bootstrap(ctx context.Context) (*startup, error) {
+	s := &startup{status: make(map[string]error)}
+
+	// Open the shared SQLite database (read-only for queries, write connections opened per-write)
+	if err := db.Open(); err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+	s.onStop(db.Close)
+
+	// Read-only containers: keep serving, with writes disabled (logged once)
+	db.CheckWritable()
+
+	// Add proxy-written columns missing from older dashboard databases
+	db.EnsureProxyColumns()
+
+	// Report schema gaps from older dashboards and disable the features they
+	// break; auto_migrate=true adds missing nullable columns and indexes
+	db.CheckSchema(db.GetSetting("auto_migrate") == "true")
+
+	// Reset unrecognized account statuses and clear error/rate_limited ones
+	// older than stale_status_minutes (default 60)
+	db.NormalizeAccountStatuses(db.StaleStatusAge())
+
+	// Stored credentials are unusable without the account key (logged)
+	db.CheckAccountKey()
+	s.status["database"] = nil
+
+	// Initialize guardrails (anonymize/deanonymize pipeline)
+	if err := guardrails.InitGuardrails(); err != nil {
+		s.shutdown()
+		return nil, fmt.Errorf("initialize guardrails: %w", err)
+	}
+	if guardrails.IsGuardrailsEnabled() {
+		log.Println("Guardrails enabled")
+	} else {
+		log.Println("Guardrails disabled (no guardrail key found)")
+	}
+	s.status["guardrails"] = nil
+
+	// Initialize model limits (per-model output token caps)
+	s.optional("model_limits", limits.InitModelLimitsTable)
+
+	// Failed attempts of requests that failed over, kept next to usage
+	s.optional("request_attempts", db.InitRequestAttemptsTable)
+
+	// Idle upstream connections kept per provider host, for deployments
+	// that hold many concurrent requests to one provider (default 16)
+	if n, err := strconv.Atoi(db.GetSetting("provider_max_idle_conns_per_host")); err == nil {
+		provider.SetMaxIdleConnsPerHost(n)
+	}
+
+	// Background loops: OAuth token refresh, pre-opening upstream
+	// connections when warm_connections=true, and SLO alert webhooks
+	s.loops.Register("token_refresh", auth.TokenRefreshLoop)
+	s.loops.Register("connection_warmer", provider.ConnectionWarmer)
+	s.loops.Register("slo_alert_webhooks", proxy.SLOAlertWebhooks)
+	s.loops.Start(ctx)
+	s.onStop(func() {
+		if err := s.loops.Stop(loopStopTimeout); err != nil {
+			log.Printf("WARNING: background loops: %v", err)
+		}
+	})
+	s.status["token_refresh"] = nil
+	s.status["connection_warmer"] = nil
+	s.status["slo_alert_webhooks"] = nil
+
+	return s, nil
+}
+
+// optional runs an optional subsystem's init, logging a failure instead of
+// stopping startup.
+func (s *startup) optional(name string, init func() error) {
+	err := init()
+	if err != nil {
+		log.Printf("WARNING: %s failed to initialize; continuing without it: %v", name, err)
+	}
+	s.status[name] = err
+}
+
+func (s *startup) onStop(stop func()) {
+	s.stops = append(s.stops, stop)
+}
+
+// shutdown stops what bootstrap started, in reverse order.
+func (s *startup) shutdown() {
+	for i := len(s.stops) - 1; i >= 0; i-- {
+		s.stops[i]()
+	}
+	s.stops = nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"codegate-proxy/internal/auth"
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/provider"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBootstrap(t *testing.T) {
+	tdb := dbtest.Open(t)
+	db.Close() // bootstrap opens it
+
+	app, err := bootstrap(context.Background())
+	if err != nil {
+		t.Fatalf("bootstrap: %v", err)
+	}
+	defer app.shutdown()
+
+	for _, name := range []string{"database", "guardrails", "model_limits", "request_attempts", "token_refresh", "connection_warmer", "slo_alert_webhooks"} {
+		if err, ok := app.status[name]; !ok || err != nil {
+			t.Errorf("%s: initialized = %v, err = %v", name, ok, err)
+		}
+	}
+	if db.Ping() != nil {
+		t.Error("database not open")
+	}
+	var n int
+	if err := tdb.QueryRow("SELECT COUNT(*) FROM model_limits").Scan(&n); err != nil {
+		t.Errorf("model_limits table: %v", err)
+	}
+	if err := tdb.QueryRow("SELECT COUNT(*) FROM request_attempts").Scan(&n); err != nil {
+		t.Errorf("request_attempts table: %v", err)
+	}
+	if !auth.RefreshLoopRunning() {
+		t.Error("token refresh loop not running")
+	}
+
+	app.shutdown()
+	if auth.RefreshLoopRunning() {
+		t.Error("token refresh loop still running after shutdown")
+	}
+	if provider.ConnectionWarmer.Running() {
+		t.Error("connection warmer still running after shutdown")
+	}
+}
+
+func TestBootstrap_CancelStopsLoops(t *testing.T) {
+	dbtest.Open(t)
+	db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	app, err := bootstrap(ctx)
+	if err != nil {
+		t.Fatalf("bootstrap: %v", err)
+	}
+	defer app.shutdown()
+
+	cancel()
+	deadline := time.Now().Add(2 * time.Second)
+	for (auth.RefreshLoopRunning() || provider.ConnectionWarmer.Running()) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if auth.RefreshLoopRunning() || provider.ConnectionWarmer.Running() {
+		t.Error("background loops still running after the root context was cancelled")
+	}
+}
@@ -4,4 +4,4 @@ go 1.24.0
 
 require github.com/mattn/go-sqlite3 v1.14.24
 
-require golang.org/x/crypto v0.48.0 // indirect
+require golang.org/x/crypto v0.48.0
@@ -2,6 +2,9 @@ package auth
 
 import (
 	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/events"
+	"codegate-proxy/internal/run"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -119,6 +122,11 @@ func EnsureValidToken(account *db.Account) error {
 	refreshMu.Unlock()
 
 	err := doRefresh(account)
+	if err != nil {
+		events.Publish(events.TokenRefreshFailed, account.ID)
+	} else {
+		events.Publish(events.TokenRefreshed, account.ID)
+	}
 
 	refreshMu.Lock()
 	delete(refreshInFlight, account.ID)
@@ -153,7 +161,9 @@ func doFileRefresh(account *db.Account) error {
 
 	if creds.AccessToken != account.APIKey {
 		log.Printf("[auth-refresh] Syncing fresh token from credential file for %q", account.Name)
-		db.UpdateAccountTokens(account.ID, creds.AccessToken, creds.RefreshToken, creds.ExpiresAt)
+		if err := db.UpdateAccountTokens(account.ID, creds.AccessToken, creds.RefreshToken, creds.ExpiresAt); err != nil {
+			log.Printf("[auth-refresh] Could not store synced token for %q: %v", account.Name, err)
+		}
 		if updated := db.GetAccount(account.ID); updated != nil {
 			*account = *updated
 		}
@@ -186,7 +196,7 @@ func RefreshTokenDirectly(account *db.Account) error {
 
 	if resp.StatusCode != 200 {
 		if resp.StatusCode == 401 || resp.StatusCode == 400 {
-			db.UpdateAccountStatus(account.ID, "expired", fmt.Sprintf("Refresh token rejected: %d", resp.StatusCode))
+			db.SetStatus(account.ID, db.StatusExpired, fmt.Sprintf("Refresh token rejected: %d", resp.StatusCode))
 		}
 		return fmt.Errorf("token refresh failed (%d)", resp.StatusCode)
 	}
@@ -210,7 +220,11 @@ func RefreshTokenDirectly(account *db.Account) error {
 		refreshToken = account.RefreshToken
 	}
 
-	db.UpdateAccountTokens(account.ID, data.AccessToken, refreshToken, expiresAt)
+	if err := db.UpdateAccountTokens(account.ID, data.AccessToken, refreshToken, expiresAt); err != nil {
+		// The new tokens are still used in memory; the refresh token may
+		// have been rotated, so the stored one could now be stale
+		log.Printf("[auth-refresh] Could not store refreshed token for %q: %v", account.Name, err)
+	}
 
 	if updated := db.GetAccount(account.ID); updated != nil {
 		*account = *updated
@@ -233,33 +247,34 @@ func ForceSyncFromFile(account *db.Account) *db.Account {
 
 	if creds.AccessToken != account.APIKey {
 		log.Printf("[auth-refresh] Force-syncing fresh token for %q", account.Name)
-		db.UpdateAccountTokens(account.ID, creds.AccessToken, creds.RefreshToken, creds.ExpiresAt)
+		if err := db.UpdateAccountTokens(account.ID, creds.AccessToken, creds.RefreshToken, creds.ExpiresAt); err != nil {
+			log.Printf("[auth-refresh] Could not store synced token for %q: %v", account.Name, err)
+		}
 		return db.GetAccount(account.ID)
 	}
 	return nil
 }
 
-// StartTokenRefreshLoop starts a background goroutine that periodically
-// checks all OAuth accounts and refreshes tokens nearing expiry.
-func StartTokenRefreshLoop() {
-	go func() {
-		refreshAll()
-		ticker := time.NewTicker(refreshLoopInterval)
-		defer ticker.Stop()
-		for range ticker.C {
-			refreshAll()
-		}
-	}()
-	log.Printf("[auth-refresh] Token refresh loop started (interval: %s)", refreshLoopInterval)
+// TokenRefreshLoop periodically checks all OAuth accounts and refreshes
+// tokens nearing expiry. Stopping it waits for a refresh in progress to
+// finish; accounts not yet reached are left for the next start.
+var TokenRefreshLoop = run.Every(refreshLoopInterval, refreshAll)
+
+// RefreshLoopRunning reports whether the token refresh loop is running.
+func RefreshLoopRunning() bool {
+	return TokenRefreshLoop.Running()
 }
 
-func refreshAll() {
+func refreshAll(ctx context.Context) {
 	accounts, err := db.GetOAuthAccounts()
 	if err != nil {
 		log.Printf("[auth-refresh] Failed to get OAuth accounts: %v", err)
 		return
 	}
 	for i := range accounts {
+		if ctx.Err() != nil {
+			return
+		}
 		if NeedsRefresh(accounts[i]) {
 			if err := EnsureValidToken(&accounts[i]); err != nil {
 				log.Printf("[auth-refresh] Background refresh failed for %q: %v", accounts[i].Name, err)
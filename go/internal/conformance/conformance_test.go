@@ -0,0 +1,296 @@
+//go:build integration
+
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	anthropicoption "github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/openai/openai-go/v2"
+	openaioption "github.com/openai/openai-go/v2/option"
+	"github.com/openai/openai-go/v2/shared"
+)
+
+// The fixtures for both formats answer with the same text, tool call and
+// token counts, so every combination is checked against the same values.
+const (
+	wantText        = "The tests pass."
+	wantErrorText   = "conformance fixture error"
+	weatherResult   = "18C and sunny"
+	textInputTokens = 21
+	textOutTokens   = 6
+)
+
+// targets are the account formats each SDK is run against.
+var targets = []string{"anthropic", "openai"}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// ─── Anthropic SDK ──────────────────────────────────────────────────────────
+
+func anthropicClient(t *testing.T, target string) (anthropic.Client, *mockProvider) {
+	url, hc, mock := startProxy(t, target)
+	return anthropic.NewClient(
+		anthropicoption.WithBaseURL(url),
+		anthropicoption.WithAPIKey("sk-ant-conformance"),
+		anthropicoption.WithHTTPClient(hc),
+		anthropicoption.WithMaxRetries(0),
+	), mock
+}
+
+var weatherToolAnthropic = anthropic.ToolUnionParam{OfTool: &anthropic.ToolParam{
+	Name:        "get_weather",
+	Description: anthropic.String("Current weather for a city"),
+	InputSchema: anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{"location": map[string]any{"type": "string"}},
+		Required:   []string{"location"},
+	},
+}}
+
+func anthropicParams(tools ...anthropic.ToolUnionParam) anthropic.MessageNewParams {
+	return anthropic.MessageNewParams{
+		Model:     conformanceModel,
+		MaxTokens: 256,
+		Messages:  []anthropic.MessageParam{anthropic.NewUserMessage(anthropic.NewTextBlock("What's the weather in Paris?"))},
+		Tools:     tools,
+	}
+}
+
+// anthropicSend sends params and returns the message, accumulated from the
+// events when stream is set.
+func anthropicSend(t *testing.T, client anthropic.Client, params anthropic.MessageNewParams, stream bool) (*anthropic.Message, error) {
+	t.Helper()
+	if !stream {
+		return client.Messages.New(testContext(t), params)
+	}
+	events := client.Messages.NewStreaming(testContext(t), params)
+	defer events.Close()
+	var msg anthropic.Message
+	for events.Next() {
+		if err := msg.Accumulate(events.Current()); err != nil {
+			t.Fatalf("accumulate %s event: %v", events.Current().Type, err)
+		}
+	}
+	return &msg, events.Err()
+}
+
+func anthropicText(msg *anthropic.Message) string {
+	var text strings.Builder
+	for _, block := range msg.Content {
+		if block.Type == "text" {
+			text.WriteString(block.AsText().Text)
+		}
+	}
+	return text.String()
+}
+
+func TestAnthropicSDK(t *testing.T) {
+	for _, target := range targets {
+		t.Run(target, func(t *testing.T) {
+			for _, stream := range []bool{false, true} {
+				name := map[bool]string{false: "message", true: "stream"}[stream]
+
+				t.Run(name, func(t *testing.T) {
+					client, _ := anthropicClient(t, target)
+					msg, err := anthropicSend(t, client, anthropicParams(), stream)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got := anthropicText(msg); got != wantText {
+						t.Errorf("text = %q, want %q", got, wantText)
+					}
+					if msg.StopReason != anthropic.StopReasonEndTurn {
+						t.Errorf("stop_reason = %q, want end_turn", msg.StopReason)
+					}
+					if msg.Usage.InputTokens != textInputTokens || msg.Usage.OutputTokens != textOutTokens {
+						t.Errorf("usage = %d in, %d out; want %d, %d", msg.Usage.InputTokens, msg.Usage.OutputTokens, textInputTokens, textOutTokens)
+					}
+				})
+
+				t.Run(name+"_tool_round_trip", func(t *testing.T) {
+					client, mock := anthropicClient(t, target)
+					params := anthropicParams(weatherToolAnthropic)
+					msg, err := anthropicSend(t, client, params, stream)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if msg.StopReason != anthropic.StopReasonToolUse {
+						t.Errorf("stop_reason = %q, want tool_use", msg.StopReason)
+					}
+					var call anthropic.ToolUseBlock
+					for _, block := range msg.Content {
+						if block.Type == "tool_use" {
+							call = block.AsToolUse()
+						}
+					}
+					var input struct{ Location string }
+					json.Unmarshal(call.Input, &input)
+					if call.ID == "" || call.Name != "get_weather" || input.Location != "Paris" {
+						t.Fatalf("tool call = %s %q %s, want get_weather for Paris", call.ID, call.Name, call.Input)
+					}
+
+					params.Messages = append(params.Messages, msg.ToParam(),
+						anthropic.NewUserMessage(anthropic.NewToolResultBlock(call.ID, weatherResult, false)))
+					final, err := anthropicSend(t, client, params, stream)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got := anthropicText(final); got != wantText {
+						t.Errorf("final text = %q, want %q", got, wantText)
+					}
+					if sent := mock.lastRequest(); !strings.Contains(sent, weatherResult) {
+						t.Errorf("the tool result didn't reach the provider")
+					}
+				})
+			}
+
+			t.Run("error", func(t *testing.T) {
+				client, mock := anthropicClient(t, target)
+				mock.failStatus = http.StatusBadRequest
+				_, err := client.Messages.New(testContext(t), anthropicParams())
+				var apiErr *anthropic.Error
+				if !errors.As(err, &apiErr) {
+					t.Fatalf("err = %v, want an API error", err)
+				}
+				if apiErr.StatusCode != http.StatusBadRequest || apiErr.Type() != "invalid_request_error" || !strings.Contains(apiErr.Error(), wantErrorText) {
+					t.Errorf("error = %d %s %v", apiErr.StatusCode, apiErr.Type(), apiErr)
+				}
+			})
+		})
+	}
+}
+
+// ─── OpenAI SDK ─────────────────────────────────────────────────────────────
+
+func openAIClient(t *testing.T, target string) (openai.Client, *mockProvider) {
+	url, hc, mock := startProxy(t, target)
+	return openai.NewClient(
+		openaioption.WithBaseURL(url+"/v1/"),
+		openaioption.WithAPIKey("sk-conformance"),
+		openaioption.WithHTTPClient(hc),
+		openaioption.WithMaxRetries(0),
+	), mock
+}
+
+var weatherToolOpenAI = openai.ChatCompletionFunctionTool(shared.FunctionDefinitionParam{
+	Name:        "get_weather",
+	Description: openai.String("Current weather for a city"),
+	Parameters: shared.FunctionParameters{
+		"type":       "object",
+		"properties": map[string]any{"location": map[string]any{"type": "string"}},
+		"required":   []string{"location"},
+	},
+})
+
+func openAIParams(tools ...openai.ChatCompletionToolUnionParam) openai.ChatCompletionNewParams {
+	return openai.ChatCompletionNewParams{
+		Model:     conformanceModel,
+		MaxTokens: openai.Int(256),
+		Messages:  []openai.ChatCompletionMessageParamUnion{openai.UserMessage("What's the weather in Paris?")},
+		Tools:     tools,
+	}
+}
+
+// openAISend sends params and returns the completion, accumulated from the
+// chunks when stream is set.
+func openAISend(t *testing.T, client openai.Client, params openai.ChatCompletionNewParams, stream bool) (*openai.ChatCompletion, error) {
+	t.Helper()
+	if !stream {
+		return client.Chat.Completions.New(testContext(t), params)
+	}
+	params.StreamOptions = openai.ChatCompletionStreamOptionsParam{IncludeUsage: openai.Bool(true)}
+	chunks := client.Chat.Completions.NewStreaming(testContext(t), params)
+	defer chunks.Close()
+	var acc openai.ChatCompletionAccumulator
+	for chunks.Next() {
+		if !acc.AddChunk(chunks.Current()) {
+			t.Fatalf("chunk doesn't continue the completion: %s", chunks.Current().RawJSON())
+		}
+	}
+	return &acc.ChatCompletion, chunks.Err()
+}
+
+func TestOpenAISDK(t *testing.T) {
+	for _, target := range targets {
+		t.Run(target, func(t *testing.T) {
+			for _, stream := range []bool{false, true} {
+				name := map[bool]string{false: "message", true: "stream"}[stream]
+
+				t.Run(name, func(t *testing.T) {
+					client, _ := openAIClient(t, target)
+					completion, err := openAISend(t, client, openAIParams(), stream)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(completion.Choices) != 1 {
+						t.Fatalf("choices = %d, want 1", len(completion.Choices))
+					}
+					choice := completion.Choices[0]
+					if choice.Message.Content != wantText || choice.FinishReason != "stop" {
+						t.Errorf("message = %q, finish_reason %q; want %q, stop", choice.Message.Content, choice.FinishReason, wantText)
+					}
+					if completion.Usage.PromptTokens != textInputTokens || completion.Usage.CompletionTokens != textOutTokens {
+						t.Errorf("usage = %d prompt, %d completion; want %d, %d", completion.Usage.PromptTokens, completion.Usage.CompletionTokens, textInputTokens, textOutTokens)
+					}
+				})
+
+				t.Run(name+"_tool_round_trip", func(t *testing.T) {
+					client, mock := openAIClient(t, target)
+					params := openAIParams(weatherToolOpenAI)
+					completion, err := openAISend(t, client, params, stream)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(completion.Choices) != 1 {
+						t.Fatalf("choices = %d, want 1", len(completion.Choices))
+					}
+					choice := completion.Choices[0]
+					if choice.FinishReason != "tool_calls" || len(choice.Message.ToolCalls) != 1 {
+						t.Fatalf("finish_reason = %q with %d tool calls, want one tool call", choice.FinishReason, len(choice.Message.ToolCalls))
+					}
+					call := choice.Message.ToolCalls[0]
+					var input struct{ Location string }
+					if err := json.Unmarshal([]byte(call.Function.Arguments), &input); err != nil || call.ID == "" || call.Function.Name != "get_weather" || input.Location != "Paris" {
+						t.Fatalf("tool call = %s %q %s, want get_weather for Paris", call.ID, call.Function.Name, call.Function.Arguments)
+					}
+
+					params.Messages = append(params.Messages, choice.Message.ToParam(), openai.ToolMessage(weatherResult, call.ID))
+					final, err := openAISend(t, client, params, stream)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(final.Choices) != 1 || final.Choices[0].Message.Content != wantText {
+						t.Errorf("final choices = %+v, want %q", final.Choices, wantText)
+					}
+					if sent := mock.lastRequest(); !strings.Contains(sent, weatherResult) {
+						t.Errorf("the tool result didn't reach the provider")
+					}
+				})
+			}
+
+			t.Run("error", func(t *testing.T) {
+				client, mock := openAIClient(t, target)
+				mock.failStatus = http.StatusBadRequest
+				_, err := client.Chat.Completions.New(testContext(t), openAIParams())
+				var apiErr *openai.Error
+				if !errors.As(err, &apiErr) {
+					t.Fatalf("err = %v, want an API error", err)
+				}
+				if apiErr.StatusCode != http.StatusBadRequest || apiErr.Type != "invalid_request_error" || !strings.Contains(apiErr.Message, wantErrorText) {
+					t.Errorf("error = %d %q %q", apiErr.StatusCode, apiErr.Type, apiErr.Message)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,17 @@
+// Package conformance runs the official Anthropic and OpenAI Go SDKs against
+// the proxy, with a mock provider replaying recorded responses from
+// testdata. Protocol-shape regressions (field nullability, SSE framing,
+// header casing) tend to show up only in real clients, so each SDK is run
+// against an account of each format: non-streaming and streaming chat, a
+// tool call round trip, and an upstream error.
+//
+// The suite is its own module, so the SDKs stay out of the proxy's go.mod.
+// The tests need network access to fetch them and are built only with the
+// integration tag. go test ./... from the proxy module doesn't reach them;
+// make test and make conformance in go/ run them, or from this directory:
+//
+//	go test -tags=integration ./...
+//
+// A failing test logs the raw traffic between the SDK, the proxy and the
+// mock provider.
+package conformance
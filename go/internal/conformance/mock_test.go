@@ -0,0 +1,224 @@
+//go:build integration
+
+package conformance
+
+import (
+	"bytes"
+	"codegate-proxy/internal/cooldown"
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/health"
+	"codegate-proxy/internal/proxy"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// wireLog keeps the raw HTTP traffic of a test, in the order it was sent,
+// and logs it if the test fails.
+type wireLog struct {
+	mu      sync.Mutex
+	entries []*bytes.Buffer
+}
+
+func newWireLog(t *testing.T) *wireLog {
+	l := &wireLog{}
+	t.Cleanup(func() {
+		if !t.Failed() {
+			return
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		var out strings.Builder
+		for _, e := range l.entries {
+			out.WriteString(e.String())
+			out.WriteString("\n\n")
+		}
+		t.Logf("wire traffic:\n%s", out.String())
+	})
+	return l
+}
+
+// entry starts a log entry headed by title.
+func (l *wireLog) entry(title string) *bytes.Buffer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := bytes.NewBufferString("=== " + title + "\n")
+	l.entries = append(l.entries, e)
+	return e
+}
+
+// recordingTransport logs each request an SDK sends to the proxy and the
+// response it gets, including streamed bodies as the SDK reads them.
+type recordingTransport struct {
+	log *wireLog
+}
+
+func (rt recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	e := rt.log.entry("SDK -> proxy")
+	dump, _ := httputil.DumpRequestOut(req, true)
+	e.Write(dump)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		fmt.Fprintf(e, "\n--- transport error: %v", err)
+		return nil, err
+	}
+	e = rt.log.entry("proxy -> SDK")
+	dump, _ = httputil.DumpResponse(resp, false)
+	e.Write(dump)
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(resp.Body, e), resp.Body}
+	return resp, nil
+}
+
+// mockProvider answers as an Anthropic or OpenAI upstream with the
+// fixtures in testdata/<format>. A request with tools gets tool_use until
+// its last message carries a tool result; any other gets message. Streaming
+// requests get the .sse fixture, written one event at a time.
+type mockProvider struct {
+	t      *testing.T
+	format string // "anthropic" or "openai"
+	log    *wireLog
+
+	// failStatus, when set, makes every reply the error fixture with this
+	// status.
+	failStatus int
+
+	mu       sync.Mutex
+	requests [][]byte // bodies received, in order
+}
+
+func (m *mockProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	dump, _ := httputil.DumpRequest(r, true)
+	m.log.entry("proxy -> " + m.format + " provider").Write(dump)
+	m.mu.Lock()
+	m.requests = append(m.requests, body)
+	m.mu.Unlock()
+
+	var req struct {
+		Stream   bool              `json:"stream"`
+		Tools    []json.RawMessage `json:"tools"`
+		Messages []json.RawMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		m.t.Errorf("provider got an invalid body: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name, status := "message", http.StatusOK
+	switch {
+	case m.failStatus != 0:
+		name, status = "error", m.failStatus
+	case len(req.Tools) > 0 && !m.endsWithToolResult(req.Messages):
+		name = "tool_use"
+	}
+	ext, contentType := ".json", "application/json"
+	if req.Stream && status == http.StatusOK {
+		ext, contentType = ".sse", "text/event-stream"
+	}
+	fixture, err := os.ReadFile(filepath.Join("testdata", m.format, name+ext))
+	if err != nil {
+		m.t.Errorf("provider fixture: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	e := m.log.entry(m.format + " provider -> proxy")
+	fmt.Fprintf(e, "HTTP %d (testdata/%s/%s%s)\n\n", status, m.format, name, ext)
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	if ext != ".sse" {
+		w.Write(fixture)
+		e.Write(fixture)
+		return
+	}
+	for _, event := range strings.SplitAfter(string(fixture), "\n\n") {
+		io.WriteString(w, event)
+		e.WriteString(event)
+		w.(http.Flusher).Flush()
+	}
+}
+
+// endsWithToolResult reports whether the last message of a request hands
+// a tool result back.
+func (m *mockProvider) endsWithToolResult(messages []json.RawMessage) bool {
+	if len(messages) == 0 {
+		return false
+	}
+	var last struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	}
+	json.Unmarshal(messages[len(messages)-1], &last)
+	if m.format == "openai" {
+		return last.Role == "tool"
+	}
+	var blocks []struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(last.Content, &blocks)
+	for _, b := range blocks {
+		if b.Type == "tool_result" {
+			return true
+		}
+	}
+	return false
+}
+
+// lastRequest returns the body of the last request the provider got.
+func (m *mockProvider) lastRequest() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.requests) == 0 {
+		return ""
+	}
+	return string(m.requests[len(m.requests)-1])
+}
+
+// conformanceModel is what the SDKs ask for; the sonnet tier routes it.
+const conformanceModel = "claude-sonnet-4-20250514"
+
+// startProxy serves the proxy from a fresh database whose active config
+// routes the sonnet tier to a single account of the given format, backed by
+// a mock provider. It returns the proxy's URL, an HTTP client that logs
+// its traffic, and the provider.
+func startProxy(t *testing.T, format string) (string, *http.Client, *mockProvider) {
+	t.Helper()
+	log := newWireLog(t)
+	mock := &mockProvider{t: t, format: format, log: log}
+	upstream := httptest.NewServer(mock)
+	t.Cleanup(upstream.Close)
+
+	tdb := dbtest.Open(t)
+	accountID := "acct-" + format
+	tdb.AddAccount(accountID, format+" mock", format, upstream.URL)
+	targetModel := ""
+	if format == "openai" {
+		targetModel = "gpt-4.1"
+	}
+	tdb.AddActiveConfig("cfg-conformance", "conformance")
+	tdb.AddTier("cfg-conformance", "sonnet", accountID, 10, targetModel)
+
+	reset := func() {
+		cooldown.Clear(accountID)
+		health.Reset()
+	}
+	reset()
+	t.Cleanup(reset)
+
+	srv := httptest.NewServer(proxy.Handler())
+	t.Cleanup(srv.Close)
+	return srv.URL, &http.Client{Transport: recordingTransport{log: log}}, mock
+}
@@ -0,0 +1,197 @@
+package convert
+
+import (
+	"sort"
+	"strings"
+)
+
+// streamBlocks tracks the content blocks of an Anthropic stream converted to
+// OpenAI chunks. Canonical streams start each block, send its deltas, and
+// stop it, with a new index per block. Some Anthropic-compatible gateways
+// reuse index 0 for every block, repeat a start, or send deltas before the
+// start. Blocks are keyed by index while open and tool calls are numbered in
+// the order they start, so OpenAI tool indices stay dense and non-negative.
+type streamBlocks struct {
+	open     map[int]*streamBlock
+	tools    map[string]*streamBlock // tool_use blocks by id
+	pending  map[int][]string        // input_json_delta fragments seen before their block's start
+	nextTool int
+}
+
+type streamBlock struct {
+	kind string // content block type
+	id   string // tool_use id
+	tool int    // OpenAI tool_calls index, for tool_use blocks
+}
+
+func newStreamBlocks() *streamBlocks {
+	return &streamBlocks{
+		open:    make(map[int]*streamBlock),
+		tools:   make(map[string]*streamBlock),
+		pending: make(map[int][]string),
+	}
+}
+
+// start opens the block a content_block_start describes and reports whether
+// it is new. A repeated start for the open block at index, or for a tool_use
+// id already started, is a duplicate; a start of a different block at an
+// open index replaces the one there.
+func (s *streamBlocks) start(index int, cb map[string]any) (*streamBlock, bool) {
+	kind, id := getStr(cb, "type"), getStr(cb, "id")
+	if b := s.open[index]; b != nil && b.kind == kind && b.id == id {
+		return b, false
+	}
+	if b := s.tools[id]; kind == "tool_use" && id != "" && b != nil {
+		s.open[index] = b
+		return b, false
+	}
+	b := &streamBlock{kind: kind, id: id}
+	if kind == "tool_use" {
+		b.tool = s.nextTool
+		s.nextTool++
+		if id != "" {
+			s.tools[id] = b
+		}
+	}
+	s.open[index] = b
+	return b, true
+}
+
+// delta returns the open block at index for a content_block_delta. A text
+// or thinking delta with no block started gets one synthesized. A tool
+// argument delta can't be placed without its start's id and name, so it is
+// held in pending and nil returned.
+func (s *streamBlocks) delta(index int, deltaType, partialJSON string) *streamBlock {
+	if b := s.open[index]; b != nil {
+		return b
+	}
+	switch deltaType {
+	case "text_delta":
+		s.open[index] = &streamBlock{kind: "text"}
+	case "thinking_delta", "signature_delta":
+		s.open[index] = &streamBlock{kind: "thinking"}
+	case "input_json_delta":
+		s.pending[index] = append(s.pending[index], partialJSON)
+	}
+	return s.open[index]
+}
+
+// takePending removes and returns the argument fragments held for index.
+func (s *streamBlocks) takePending(index int) string {
+	fragments := s.pending[index]
+	delete(s.pending, index)
+	return strings.Join(fragments, "")
+}
+
+// stop closes the block at index. Argument fragments that never got a
+// tool_use start are returned so they can be passed through as text.
+func (s *streamBlocks) stop(index int) string {
+	delete(s.open, index)
+	return s.takePending(index)
+}
+
+// drain returns every held argument fragment, in index order, for the end
+// of the message.
+func (s *streamBlocks) drain() string {
+	indices := make([]int, 0, len(s.pending))
+	for index := range s.pending {
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+	var out strings.Builder
+	for _, index := range indices {
+		out.WriteString(s.takePending(index))
+	}
+	return out.String()
+}
+
+// blockIndex returns a content block event's index, 0 when it has none.
+func blockIndex(event map[string]any) int {
+	index, _ := getFloat(event, "index")
+	return int(index)
+}
+
+// streamToolCalls tracks the tool calls of an OpenAI stream converted to
+// Anthropic content blocks. OpenAI numbers each call with an index and sends
+// its id and name once, then argument fragments. Some providers send the
+// name again in later chunks, leave index off argument-only chunks, or send
+// arguments before the chunk that names the call. A call gets one block,
+// chunks without an index continue the last call, and early arguments are
+// held until the call starts.
+type streamToolCalls struct {
+	blocks  map[int]int      // OpenAI tool_calls index -> Anthropic content block index
+	ids     map[int]string   // tool call id per OpenAI index, as the provider sent it
+	byID    map[string]int   // OpenAI index per tool call id
+	pending map[int][]string // argument fragments seen before their call's name
+	last    int              // OpenAI index of the last tool_calls entry
+	next    int              // one past the highest OpenAI index seen
+}
+
+func newStreamToolCalls() *streamToolCalls {
+	return &streamToolCalls{
+		blocks:  make(map[int]int),
+		ids:     make(map[int]string),
+		byID:    make(map[string]int),
+		pending: make(map[int][]string),
+	}
+}
+
+// index returns the OpenAI index a tool_calls entry belongs to. An entry
+// without one continues the last call, unless it carries the id of another
+// call, or a new id while the last call already has one, which starts the
+// next call.
+func (s *streamToolCalls) index(tc map[string]any) int {
+	if idx, ok := getFloat(tc, "index"); ok {
+		s.last = int(idx)
+	} else if id := getStr(tc, "id"); id != "" && id != s.ids[s.last] {
+		if known, ok := s.byID[id]; ok {
+			s.last = known
+		} else if s.ids[s.last] != "" {
+			s.last = s.next
+		}
+	}
+	if s.last >= s.next {
+		s.next = s.last + 1
+	}
+	if id := getStr(tc, "id"); id != "" && s.ids[s.last] == "" {
+		s.ids[s.last] = id
+		s.byID[id] = s.last
+	}
+	return s.last
+}
+
+// block returns the content block started for the call at index.
+func (s *streamToolCalls) block(index int) (int, bool) {
+	blockIdx, ok := s.blocks[index]
+	return blockIdx, ok
+}
+
+// start records the content block a call was given, and returns its id
+// and any argument fragments held for it.
+func (s *streamToolCalls) start(index, blockIdx int) (id, args string) {
+	s.blocks[index] = blockIdx
+	args = strings.Join(s.pending[index], "")
+	delete(s.pending, index)
+	return s.ids[index], args
+}
+
+// hold keeps an argument fragment for a call that hasn't started yet.
+func (s *streamToolCalls) hold(index int, fragment string) {
+	s.pending[index] = append(s.pending[index], fragment)
+}
+
+// drain returns the argument fragments of calls that never got a name, in
+// index order, for the end of the message.
+func (s *streamToolCalls) drain() string {
+	indices := make([]int, 0, len(s.pending))
+	for index := range s.pending {
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+	var out strings.Builder
+	for _, index := range indices {
+		out.WriteString(strings.Join(s.pending[index], ""))
+		delete(s.pending, index)
+	}
+	return out.String()
+}
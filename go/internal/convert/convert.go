@@ -5,11 +5,14 @@ package convert
 
 import (
 	"bufio"
+	"codegate-proxy/internal/streamutil"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"math/rand"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
 	"time"
@@ -21,8 +24,9 @@ var deepSeekReasonerRe = regexp.MustCompile(`(?i)deepseek-reasoner|deepseek-r1`)
 // dataURIRe parses a base64 data URI into media type and data components.
 var dataURIRe = regexp.MustCompile(`^data:([^;]+);base64,(.+)$`)
 
-// generateID produces a random alphanumeric suffix suitable for IDs.
-func generateID() string {
+// generateID produces a random alphanumeric suffix suitable for IDs. It and
+// the clock functions below are variables so golden tests can pin them.
+var generateID = func() string {
 	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
 	b := make([]byte, 6)
 	for i := range b {
@@ -32,12 +36,12 @@ func generateID() string {
 }
 
 // nowMillis returns the current time in milliseconds since epoch.
-func nowMillis() int64 {
+var nowMillis = func() int64 {
 	return time.Now().UnixMilli()
 }
 
 // nowUnix returns the current time as a Unix timestamp (seconds).
-func nowUnix() int64 {
+var nowUnix = func() int64 {
 	return time.Now().Unix()
 }
 
@@ -108,6 +112,26 @@ func toMap(v any) map[string]any {
 	return map[string]any{}
 }
 
+// hasToolBlocks reports whether any Anthropic message holds a tool_use or
+// tool_result block.
+func hasToolBlocks(messages []any) bool {
+	for _, m := range messages {
+		blocks, _ := toMap(m)["content"].([]any)
+		for _, b := range blocks {
+			if t := getStr(toMap(b), "type"); t == "tool_use" || t == "tool_result" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// choiceIndex returns an OpenAI choice's index; choices without one are 0.
+func choiceIndex(choice map[string]any) int {
+	idx, _ := getFloat(choice, "index")
+	return int(idx)
+}
+
 // toSlice converts any value to []any.
 func toSlice(v any) []any {
 	if s, ok := v.([]any); ok {
@@ -123,37 +147,93 @@ func toSlice(v any) []any {
 // AnthropicToOpenAI converts an Anthropic Messages API request body to an
 // OpenAI Chat Completions API request body.
 func AnthropicToOpenAI(body map[string]any, targetModel string) map[string]any {
+	result, _, _ := AnthropicToOpenAIWithWarnings(body, targetModel)
+	return result
+}
+
+// AnthropicToOpenAIWithWarnings is AnthropicToOpenAI that also reports
+// content the OpenAI format can't carry. Content blocks of types the
+// converter doesn't know are replaced by a text placeholder naming the type,
+// and listed once per type in the returned warnings, as is a tool_choice
+// naming an undeclared tool, which is sent as auto. Tool names OpenAI
+// rejects are rewritten; the returned ToolNames maps them back for the
+// response.
+func AnthropicToOpenAIWithWarnings(body map[string]any, targetModel string) (map[string]any, []string, ToolNames) {
+	return AnthropicToOpenAIWithOptions(body, targetModel, Options{})
+}
+
+// Options adjusts request conversion.
+type Options struct {
+	// SplitSystem sends each Anthropic system block as its own OpenAI system
+	// message instead of joining them, so converting back yields the same
+	// blocks.
+	SplitSystem bool
+
+	// Stop caps stop_sequences for the target provider.
+	Stop StopLimits
+
+	// Reasoning says whether the target model takes reasoning_effort,
+	// overriding SupportsReasoningEffort when set.
+	Reasoning *bool
+
+	// FileParts says the target takes OpenAI file content parts. Without
+	// it, inline document blocks are replaced by a text note.
+	FileParts bool
+}
+
+// AnthropicToOpenAIWithOptions is AnthropicToOpenAIWithWarnings with
+// conversion options. System blocks joined into one message and their
+// cache_control markers, which OpenAI has no equivalent for, are also
+// reported as warnings, as are stop sequences dropped to fit opts.Stop. A
+// thinking config becomes reasoning_effort for models that take it, and is
+// dropped with a warning for others.
+func AnthropicToOpenAIWithOptions(body map[string]any, targetModel string, opts Options) (map[string]any, []string, ToolNames) {
+	return anthropicRequestFrom(body).ToOpenAI(targetModel, opts)
+}
+
+// ToOpenAI converts the request as AnthropicToOpenAIWithOptions does. The
+// converted request is a map, which the proxy edits before sending it.
+func (r AnthropicRequest) ToOpenAI(targetModel string, opts Options) (map[string]any, []string, ToolNames) {
+	body := r.Body
+	var warnings []string
+	toolNames := ToolNames{}
 	isDeepSeekReasoner := deepSeekReasonerRe.MatchString(targetModel)
 	messages := []any{}
 
 	// Extract system messages from body.system
-	if sys, ok := body["system"]; ok {
-		switch s := sys.(type) {
-		case string:
+	if sys := r.System; sys != nil {
+		if s, ok := sys.Text(); ok {
 			messages = append(messages, map[string]any{"role": "system", "content": s})
-		case []any:
+		} else if sys.IsList() {
 			var parts []string
-			for _, block := range s {
-				switch b := block.(type) {
-				case string:
-					parts = append(parts, b)
-				case map[string]any:
-					parts = append(parts, getStr(b, "text"))
-				default:
-					parts = append(parts, "")
+			cacheControl := false
+			for _, block := range sys.Blocks {
+				parts = append(parts, block.Text)
+				if block.CacheControl {
+					cacheControl = true
+				}
+			}
+			if opts.SplitSystem {
+				for _, p := range parts {
+					messages = append(messages, map[string]any{"role": "system", "content": p})
+				}
+			} else {
+				messages = append(messages, map[string]any{"role": "system", "content": strings.Join(parts, "\n")})
+				if len(parts) > 1 {
+					warnings = append(warnings, fmt.Sprintf("merged %d system blocks into one message", len(parts)))
 				}
 			}
-			messages = append(messages, map[string]any{"role": "system", "content": strings.Join(parts, "\n")})
+			if cacheControl {
+				warnings = append(warnings, "dropped cache_control from system blocks")
+			}
 		}
 	}
 
 	// Convert messages
-	if msgs, ok := getSlice(body, "messages"); ok {
-		for _, rawMsg := range msgs {
-			msg := toMap(rawMsg)
-			converted := convertAnthropicMessage(msg, isDeepSeekReasoner)
-			messages = append(messages, converted)
-		}
+	for _, msg := range r.Messages {
+		converted := convertAnthropicMessage(msg, isDeepSeekReasoner, opts.FileParts, &warnings, toolNames)
+		liftSpeakerName(converted)
+		messages = append(messages, converted)
 	}
 
 	result := map[string]any{
@@ -175,29 +255,32 @@ func AnthropicToOpenAI(body map[string]any, targetModel string) map[string]any {
 		result["stream"] = v
 	}
 	if v, ok := body["stop_sequences"]; ok {
-		result["stop"] = v
+		if stop := stopSequences(v, opts.Stop, &warnings); len(stop) > 0 {
+			result["stop"] = stop
+		}
+	}
+	if effort := reasoningEffort(body["thinking"], targetModel, opts, &warnings); effort != "" {
+		result["reasoning_effort"] = effort
 	}
 
 	// Stream options for providers that need usage in streaming
-	if stream, ok := getBool(body, "stream"); ok && stream {
+	if r.Stream {
 		result["stream_options"] = map[string]any{"include_usage": true}
 	}
 
 	// Convert tools
-	if tools, ok := getSlice(body, "tools"); ok && len(tools) > 0 {
+	if len(r.Tools) > 0 {
 		var oaiTools []any
-		for _, rawTool := range tools {
-			tool := toMap(rawTool)
-			inputSchema := tool["input_schema"]
+		for _, tool := range r.Tools {
+			inputSchema := tool.Schema
 			if inputSchema == nil {
 				inputSchema = map[string]any{}
 			}
-			desc := getStr(tool, "description")
 			oaiTools = append(oaiTools, map[string]any{
 				"type": "function",
 				"function": map[string]any{
-					"name":        getStr(tool, "name"),
-					"description": desc,
+					"name":        toolNames.sanitize(tool.Name),
+					"description": tool.Description,
 					"parameters":  inputSchema,
 				},
 			})
@@ -206,40 +289,55 @@ func AnthropicToOpenAI(body map[string]any, targetModel string) map[string]any {
 	}
 
 	// Convert tool_choice
-	if tc, ok := getMap(body, "tool_choice"); ok {
-		tcType := getStr(tc, "type")
-		switch tcType {
+	if tc := r.ToolChoice; tc != nil {
+		switch tc.Mode {
 		case "auto":
 			result["tool_choice"] = "auto"
 		case "any":
 			result["tool_choice"] = "required"
+		case "none":
+			result["tool_choice"] = "none"
 		case "tool":
+			if missing := MissingForcedTool(body, "anthropic"); missing != "" {
+				result["tool_choice"] = "auto"
+				warnings = append(warnings, missingToolWarning(missing))
+				break
+			}
 			result["tool_choice"] = map[string]any{
 				"type":     "function",
-				"function": map[string]any{"name": getStr(tc, "name")},
+				"function": map[string]any{"name": toolNames.sanitize(tc.Name)},
 			}
 		}
 	}
 
-	// NOTE: Anthropic-specific fields (thinking, metadata, context_management, etc.)
+	// metadata.user_id identifies the end user; OpenAI calls it "user"
+	if r.UserID != "" {
+		result["user"] = r.UserID
+	}
+
+	openAIResponseFormat(body, result)
+
+	// NOTE: Other Anthropic-specific fields (thinking, context_management, etc.)
 	// are intentionally NOT copied -- they are not part of the OpenAI format.
 
-	return result
+	if len(toolNames) == 0 {
+		toolNames = nil
+	}
+	return result, warnings, toolNames
 }
 
 // convertAnthropicMessage converts a single Anthropic message to OpenAI format.
-func convertAnthropicMessage(msg map[string]any, isDeepSeekReasoner bool) map[string]any {
-	role := getStr(msg, "role")
+func convertAnthropicMessage(msg Message, isDeepSeekReasoner, fileParts bool, warnings *[]string, toolNames ToolNames) map[string]any {
+	role := msg.Role
 
 	// String content
-	if content, ok := msg["content"].(string); ok {
+	if content, ok := msg.Content.Text(); ok {
 		return map[string]any{"role": role, "content": content}
 	}
 
 	// Non-array content
-	contentSlice, ok := msg["content"].([]any)
-	if !ok {
-		content := msg["content"]
+	if !msg.Content.IsList() {
+		content := msg.Content.Value
 		if content == nil {
 			content = ""
 		}
@@ -248,38 +346,38 @@ func convertAnthropicMessage(msg map[string]any, isDeepSeekReasoner bool) map[st
 
 	var parts []any
 	var toolCalls []any
+	var reasoning []string
 
-	for _, rawBlock := range contentSlice {
-		block := toMap(rawBlock)
-		blockType := getStr(block, "type")
-
-		switch blockType {
+	for _, block := range msg.Content.Blocks {
+		switch block.Type {
 		case "text":
-			parts = append(parts, map[string]any{"type": "text", "text": getStr(block, "text")})
+			parts = append(parts, map[string]any{"type": "text", "text": block.Text})
 
 		case "image":
-			source := toMap(block["source"])
 			var imageURL string
-			if getStr(source, "type") == "base64" {
-				imageURL = fmt.Sprintf("data:%s;base64,%s", getStr(source, "media_type"), getStr(source, "data"))
+			if block.Source.Type == "base64" {
+				imageURL = fmt.Sprintf("data:%s;base64,%s", block.Source.MediaType, block.Source.Data)
 			} else {
-				imageURL = getStr(source, "url")
+				imageURL = block.Source.URL
 			}
 			parts = append(parts, map[string]any{
 				"type":      "image_url",
 				"image_url": map[string]any{"url": imageURL},
 			})
 
+		case "document":
+			parts = append(parts, openAIDocumentPart(block.fields(), fileParts, warnings))
+
 		case "tool_use":
-			input := block["input"]
+			input := block.Input
 			if input == nil {
 				input = map[string]any{}
 			}
 			toolCalls = append(toolCalls, map[string]any{
-				"id":   getStr(block, "id"),
+				"id":   block.ID,
 				"type": "function",
 				"function": map[string]any{
-					"name":      getStr(block, "name"),
+					"name":      toolNames.sanitize(block.Name),
 					"arguments": toJSONString(input),
 				},
 			})
@@ -287,40 +385,47 @@ func convertAnthropicMessage(msg map[string]any, isDeepSeekReasoner bool) map[st
 		case "tool_result":
 			// tool_result returns immediately as a tool message
 			var contentStr string
-			switch c := block["content"].(type) {
-			case string:
-				contentStr = c
-			case []any:
+			if s, ok := block.Content.Text(); ok {
+				contentStr = s
+			} else if block.Content.IsList() {
 				var resultParts []string
-				for _, item := range c {
-					itemMap := toMap(item)
-					if getStr(itemMap, "type") == "text" {
-						resultParts = append(resultParts, getStr(itemMap, "text"))
+				for _, item := range block.Content.Blocks {
+					if item.Type == "text" {
+						resultParts = append(resultParts, item.Text)
 					} else {
-						resultParts = append(resultParts, toJSONString(item))
+						resultParts = append(resultParts, toJSONString(item.Raw))
 					}
 				}
 				contentStr = strings.Join(resultParts, "\n")
-			default:
-				if c == nil {
-					contentStr = ""
-				} else {
-					contentStr = toJSONString(c)
-				}
+			} else if block.Content.Value != nil {
+				contentStr = toJSONString(block.Content.Value)
+			}
+			if block.IsError {
+				contentStr = markToolError(contentStr)
 			}
 			return map[string]any{
 				"role":         "tool",
-				"tool_call_id": getStr(block, "tool_use_id"),
+				"tool_call_id": block.ToolUseID,
 				"content":      contentStr,
 			}
 
-		case "thinking":
-			// Skip Anthropic thinking blocks -- not part of OpenAI format
+		case "thinking", "redacted_thinking":
+			// Not part of OpenAI format, but DeepSeek reasoner takes the
+			// assistant's prior reasoning back as reasoning_content.
+			// Redacted thinking is encrypted and can't be passed on
+			if isDeepSeekReasoner && role == "assistant" && block.Type == "thinking" {
+				if block.Thinking != "" {
+					reasoning = append(reasoning, block.Thinking)
+				}
+			}
 
 		default:
-			// Skip unknown block types rather than serializing them
-			if text := getStr(block, "text"); text != "" {
-				parts = append(parts, map[string]any{"type": "text", "text": text})
+			// Unknown block types can't be represented; leave a visible
+			// placeholder so the model (and the caller) know content was dropped
+			parts = append(parts, map[string]any{"type": "text", "text": fmt.Sprintf("[%s block omitted]", block.Type)})
+			warning := fmt.Sprintf("dropped unsupported content block type %q", block.Type)
+			if !slices.Contains(*warnings, warning) {
+				*warnings = append(*warnings, warning)
 			}
 		}
 	}
@@ -341,7 +446,7 @@ func convertAnthropicMessage(msg map[string]any, isDeepSeekReasoner bool) map[st
 		result["tool_calls"] = toolCalls
 		// DeepSeek reasoner requires reasoning_content on assistant messages with tool calls
 		if isDeepSeekReasoner && role == "assistant" {
-			result["reasoning_content"] = ""
+			result["reasoning_content"] = strings.Join(reasoning, "\n\n")
 		}
 	} else if len(parts) == 1 && getStr(toMap(parts[0]), "type") == "text" {
 		result["content"] = getStr(toMap(parts[0]), "text")
@@ -350,6 +455,9 @@ func convertAnthropicMessage(msg map[string]any, isDeepSeekReasoner bool) map[st
 	} else {
 		result["content"] = parts
 	}
+	if len(reasoning) > 0 && result["reasoning_content"] == nil {
+		result["reasoning_content"] = strings.Join(reasoning, "\n\n")
+	}
 
 	return result
 }
@@ -359,8 +467,10 @@ func convertAnthropicMessage(msg map[string]any, isDeepSeekReasoner bool) map[st
 // --------------------------------------------------------------------------
 
 // OpenAIToAnthropic converts an OpenAI Chat Completions response to an
-// Anthropic Messages API response.
-func OpenAIToAnthropic(response map[string]any, originalModel string) map[string]any {
+// Anthropic Messages API response. Tool names are mapped back through
+// toolNames, which may be nil. An Anthropic response holds one message, so
+// only choice 0 of a response with several (n > 1) is kept.
+func OpenAIToAnthropic(response map[string]any, originalModel string, toolNames ToolNames) map[string]any {
 	choices, _ := getSlice(response, "choices")
 
 	if len(choices) == 0 {
@@ -377,9 +487,24 @@ func OpenAIToAnthropic(response map[string]any, originalModel string) map[string
 	}
 
 	choice := toMap(choices[0])
+	for _, c := range choices {
+		if m := toMap(c); choiceIndex(m) == 0 {
+			choice = m
+			break
+		}
+	}
+	if len(choices) > 1 {
+		log.Printf("[convert] Response has %d choices; kept choice 0 only", len(choices))
+	}
 	message := toMap(choice["message"])
 	var content []any
 
+	// Reasoner models (DeepSeek and others) return their reasoning beside
+	// the content; it goes first, as a thinking block, like in streams
+	if rc := getStr(message, "reasoning_content"); rc != "" {
+		content = append(content, map[string]any{"type": "thinking", "thinking": rc})
+	}
+
 	if msgContent := message["content"]; msgContent != nil {
 		if s, ok := msgContent.(string); ok && s != "" {
 			content = append(content, map[string]any{"type": "text", "text": s})
@@ -408,23 +533,13 @@ func OpenAIToAnthropic(response map[string]any, originalModel string) map[string
 			content = append(content, map[string]any{
 				"type":  "tool_use",
 				"id":    tcID,
-				"name":  getStr(fn, "name"),
+				"name":  toolNames.Original(getStr(fn, "name")),
 				"input": parsedArgs,
 			})
 		}
 	}
 
-	var stopReason string
-	switch getStr(choice, "finish_reason") {
-	case "stop":
-		stopReason = "end_turn"
-	case "length":
-		stopReason = "max_tokens"
-	case "tool_calls":
-		stopReason = "tool_use"
-	default:
-		stopReason = "end_turn"
-	}
+	stopReason := stopReasonFor(choice)
 
 	usage := toMap(response["usage"])
 	promptTokens, _ := getFloat(usage, "prompt_tokens")
@@ -442,8 +557,8 @@ func OpenAIToAnthropic(response map[string]any, originalModel string) map[string
 		"usage": map[string]any{
 			"input_tokens":                promptTokens,
 			"output_tokens":               completionTokens,
-			"cache_creation_input_tokens":  float64(0),
-			"cache_read_input_tokens":      float64(0),
+			"cache_creation_input_tokens": float64(0),
+			"cache_read_input_tokens":     float64(0),
 		},
 	}
 }
@@ -455,152 +570,140 @@ func OpenAIToAnthropic(response map[string]any, originalModel string) map[string
 // OpenAIToAnthropicRequest converts an OpenAI Chat Completions request body
 // to an Anthropic Messages API request body.
 func OpenAIToAnthropicRequest(body map[string]any) map[string]any {
+	result, _ := OpenAIToAnthropicRequestWithWarnings(body)
+	return result
+}
+
+// OpenAIToAnthropicRequestWithWarnings is OpenAIToAnthropicRequest that also
+// reports a tool_choice naming an undeclared tool, which Anthropic rejects
+// and is sent as auto instead, empty stop sequences, which are dropped,
+// a reasoning_effort that can't become a thinking config, a tool_choice
+// a json_schema response_format replaced, and the store, prediction and
+// metadata fields Anthropic has no place for.
+func OpenAIToAnthropicRequestWithWarnings(body map[string]any) (map[string]any, []string) {
+	return openAIRequestFrom(body).ToAnthropic()
+}
+
+// ToAnthropic converts the request as OpenAIToAnthropicRequestWithWarnings
+// does. The converted request is a map, which the proxy edits before
+// sending it.
+func (r OpenAIRequest) ToAnthropic() (map[string]any, []string) {
+	body := r.Body
+	var warnings []string
 	result := map[string]any{}
 	var messages []any
 
-	if msgs, ok := getSlice(body, "messages"); ok {
-		for _, rawMsg := range msgs {
-			msg := toMap(rawMsg)
-			msgRole := getStr(msg, "role")
+	for msgIndex, msg := range r.Messages {
+		if msg.Role == "system" {
+			// Collect system messages into Anthropic system field
+			sysSlice, ok := result["system"].([]any)
+			if !ok {
+				sysSlice = []any{}
+			}
+			result["system"] = append(sysSlice, systemBlocks(msg.Content.Value)...)
+			if msg.Name != "" {
+				addWarning(&warnings, "dropped name from system messages")
+			}
 
-			if msgRole == "system" {
-				// Collect system messages into Anthropic system field
-				if result["system"] == nil {
-					result["system"] = []any{}
+		} else if msg.Role == "tool" {
+			// OpenAI tool message -> Anthropic tool_result in user message
+			toolResult := map[string]any{
+				"type":        "tool_result",
+				"tool_use_id": msg.ToolCallID,
+				"content":     msg.Content.Value,
+			}
+			if content, isErr := toolResultError(msg.Content.Value); isErr {
+				toolResult["content"] = content
+				toolResult["is_error"] = true
+			}
+			messages = append(messages, map[string]any{
+				"role":    "user",
+				"content": []any{toolResult},
+			})
+
+		} else {
+			// user or assistant message
+			converted := map[string]any{"role": msg.Role}
+
+			if len(msg.ToolCalls) > 0 {
+				// Assistant message with tool calls
+				var contentBlocks []any
+				if msgContent, ok := msg.Content.Text(); ok && msgContent != "" {
+					contentBlocks = append(contentBlocks, map[string]any{"type": "text", "text": msgContent})
 				}
-				// Ensure system is a slice
-				sysSlice, ok := result["system"].([]any)
-				if !ok {
-					// If somehow it's a string, wrap it
-					if s, ok2 := result["system"].(string); ok2 {
-						sysSlice = []any{map[string]any{"type": "text", "text": s}}
-					} else {
-						sysSlice = []any{}
+				for callIndex, tc := range msg.ToolCalls {
+					tcID := tc.ID
+					if tcID == "" {
+						tcID = stableToolCallID(msgIndex, callIndex, tc.Function.raw)
 					}
-				}
-				var text string
-				if s, ok := msg["content"].(string); ok {
-					text = s
-				} else {
-					text = toJSONString(msg["content"])
-				}
-				sysSlice = append(sysSlice, map[string]any{"type": "text", "text": text})
-				result["system"] = sysSlice
-
-			} else if msgRole == "tool" {
-				// OpenAI tool message -> Anthropic tool_result in user message
-				messages = append(messages, map[string]any{
-					"role": "user",
-					"content": []any{
-						map[string]any{
-							"type":        "tool_result",
-							"tool_use_id": getStr(msg, "tool_call_id"),
-							"content":     msg["content"],
-						},
-					},
-				})
 
-			} else {
-				// user or assistant message
-				converted := map[string]any{"role": msgRole}
-
-				if tcs, ok := getSlice(msg, "tool_calls"); ok && len(tcs) > 0 {
-					// Assistant message with tool calls
-					var contentBlocks []any
-					if msgContent, ok := msg["content"].(string); ok && msgContent != "" {
-						contentBlocks = append(contentBlocks, map[string]any{"type": "text", "text": msgContent})
+					// Determine function name
+					name := tc.Function.Name
+					if name == "" {
+						name = tc.Name
 					}
-					for _, rawTC := range tcs {
-						tc := toMap(rawTC)
-						fn := toMap(tc["function"])
 
-						tcID := getStr(tc, "id")
-						if tcID == "" {
-							tcID = fmt.Sprintf("toolu_%d_%s", nowMillis(), generateID())
-						}
-
-						// Determine function name
-						name := getStr(fn, "name")
-						if name == "" {
-							name = getStr(tc, "name")
+					// Parse arguments
+					var input any = map[string]any{}
+					if args := tc.Function.Arguments; args != "" {
+						if err := json.Unmarshal([]byte(args), &input); err != nil {
+							input = map[string]any{}
 						}
+					}
 
-						// Parse arguments
-						var input any
-						argsStr := getStr(fn, "arguments")
-						if argsStr != "" {
-							if err := json.Unmarshal([]byte(argsStr), &input); err != nil {
-								input = map[string]any{}
-							}
+					contentBlocks = append(contentBlocks, map[string]any{
+						"type":  "tool_use",
+						"id":    tcID,
+						"name":  name,
+						"input": input,
+					})
+				}
+				converted["content"] = contentBlocks
+
+			} else if msg.Content.IsList() {
+				// Multi-part content (images, etc.)
+				var convertedParts []any
+				for _, part := range msg.Content.Blocks {
+					switch part.Type {
+					case "text":
+						convertedParts = append(convertedParts, map[string]any{"type": "text", "text": part.Text})
+					case "image_url":
+						url := part.ImageURL
+						if match := dataURIRe.FindStringSubmatch(url); strings.HasPrefix(url, "data:") && match != nil {
+							convertedParts = append(convertedParts, map[string]any{
+								"type": "image",
+								"source": map[string]any{
+									"type":       "base64",
+									"media_type": match[1],
+									"data":       match[2],
+								},
+							})
 						} else {
-							fnArgs := fn["arguments"]
-							if fnArgs != nil {
-								input = fnArgs
-							} else {
-								input = map[string]any{}
-							}
-						}
-
-						contentBlocks = append(contentBlocks, map[string]any{
-							"type":  "tool_use",
-							"id":    tcID,
-							"name":  name,
-							"input": input,
-						})
-					}
-					converted["content"] = contentBlocks
-
-				} else if contentSlice, ok := msg["content"].([]any); ok {
-					// Multi-part content (images, etc.)
-					var convertedParts []any
-					for _, rawPart := range contentSlice {
-						part := toMap(rawPart)
-						partType := getStr(part, "type")
-						switch partType {
-						case "text":
-							convertedParts = append(convertedParts, map[string]any{"type": "text", "text": getStr(part, "text")})
-						case "image_url":
-							imageURL := toMap(part["image_url"])
-							url := getStr(imageURL, "url")
-							if strings.HasPrefix(url, "data:") {
-								match := dataURIRe.FindStringSubmatch(url)
-								if match != nil {
-									convertedParts = append(convertedParts, map[string]any{
-										"type": "image",
-										"source": map[string]any{
-											"type":       "base64",
-											"media_type": match[1],
-											"data":       match[2],
-										},
-									})
-								} else {
-									convertedParts = append(convertedParts, map[string]any{
-										"type":   "image",
-										"source": map[string]any{"type": "url", "url": url},
-									})
-								}
-							} else {
-								convertedParts = append(convertedParts, map[string]any{
-									"type":   "image",
-									"source": map[string]any{"type": "url", "url": url},
-								})
-							}
-						default:
-							convertedParts = append(convertedParts, map[string]any{"type": "text", "text": toJSONString(part)})
+							convertedParts = append(convertedParts, map[string]any{
+								"type":   "image",
+								"source": map[string]any{"type": "url", "url": url},
+							})
 						}
+					case "file":
+						convertedParts = append(convertedParts, anthropicDocumentBlock(part.fields(), &warnings))
+					default:
+						convertedParts = append(convertedParts, map[string]any{"type": "text", "text": toJSONString(part.fields())})
 					}
-					converted["content"] = convertedParts
-
-				} else {
-					content := msg["content"]
-					if content == nil {
-						content = ""
-					}
-					converted["content"] = content
 				}
+				converted["content"] = convertedParts
 
-				messages = append(messages, converted)
+			} else {
+				content := msg.Content.Value
+				if content == nil {
+					content = ""
+				}
+				converted["content"] = content
 			}
+			if msg.Name != "" {
+				converted["content"] = withSpeakerName(converted["content"], msg.Name)
+			}
+
+			messages = append(messages, converted)
 		}
 	}
 
@@ -623,39 +726,22 @@ func OpenAIToAnthropicRequest(body map[string]any) map[string]any {
 		result["stream"] = v
 	}
 	if stopVal, ok := body["stop"]; ok {
-		if stopSlice, ok := stopVal.([]any); ok {
-			result["stop_sequences"] = stopSlice
-		} else {
-			result["stop_sequences"] = []any{stopVal}
+		if stop := stopSequences(stopVal, StopLimits{}, &warnings); len(stop) > 0 {
+			result["stop_sequences"] = stop
 		}
 	}
 
 	// Convert tools
-	if tools, ok := getSlice(body, "tools"); ok && len(tools) > 0 {
+	if len(r.Tools) > 0 {
 		var anthropicTools []any
-		for _, rawTool := range tools {
-			tool := toMap(rawTool)
-			fn := toMap(tool["function"])
-
-			name := getStr(fn, "name")
-			if name == "" {
-				name = getStr(tool, "name")
-			}
-			desc := getStr(fn, "description")
-			if desc == "" {
-				desc = getStr(tool, "description")
-			}
-			params := fn["parameters"]
-			if params == nil {
-				params = tool["parameters"]
-			}
+		for _, tool := range r.Tools {
+			params := tool.Schema
 			if params == nil {
 				params = map[string]any{}
 			}
-
 			anthropicTools = append(anthropicTools, map[string]any{
-				"name":         name,
-				"description":  desc,
+				"name":         tool.Name,
+				"description":  tool.Description,
 				"input_schema": params,
 			})
 		}
@@ -663,31 +749,87 @@ func OpenAIToAnthropicRequest(body map[string]any) map[string]any {
 	}
 
 	// Convert tool_choice
-	if tc, ok := body["tool_choice"]; ok {
-		switch tcVal := tc.(type) {
-		case string:
-			switch tcVal {
-			case "auto":
-				result["tool_choice"] = map[string]any{"type": "auto"}
-			case "required":
-				result["tool_choice"] = map[string]any{"type": "any"}
-			case "none":
-				// no tool_choice in Anthropic
+	if tc := r.ToolChoice; tc != nil {
+		switch tc.Mode {
+		case "auto":
+			result["tool_choice"] = map[string]any{"type": "auto"}
+		case "required":
+			result["tool_choice"] = map[string]any{"type": "any"}
+		case "none":
+			// The model mustn't call tools, so they are left out.
+			// Anthropic rejects tool_use and tool_result blocks
+			// without tools, so a conversation that has them keeps
+			// its tools with tool_choice none instead.
+			if hasToolBlocks(messages) {
+				result["tool_choice"] = map[string]any{"type": "none"}
+			} else {
+				delete(result, "tools")
 			}
-		case map[string]any:
-			fn := toMap(tcVal["function"])
-			if name := getStr(fn, "name"); name != "" {
-				result["tool_choice"] = map[string]any{"type": "tool", "name": name}
+		case "function":
+			if missing := MissingForcedTool(body, "openai"); missing != "" {
+				result["tool_choice"] = map[string]any{"type": "auto"}
+				warnings = append(warnings, missingToolWarning(missing))
+			} else if tc.Name != "" {
+				result["tool_choice"] = map[string]any{"type": "tool", "name": tc.Name}
 			}
 		}
 	}
 
+	if metadata := anthropicMetadata(r, &warnings); metadata != nil {
+		result["metadata"] = metadata
+	}
+	if r.Store {
+		addWarning(&warnings, "dropped store: Anthropic doesn't store completions")
+	}
+	if r.Prediction {
+		addWarning(&warnings, "dropped prediction: Anthropic doesn't take predicted outputs")
+	}
+
+	// n is left out: Anthropic returns a single message per request. The
+	// proxy refuses n > 1 for Anthropic targets before converting.
+
 	// Default max_tokens if not provided (Anthropic requires it)
 	if result["max_tokens"] == nil {
 		result["max_tokens"] = float64(4096)
 	}
 
-	return result
+	if effort, ok := body["reasoning_effort"]; ok {
+		maxTokens, _ := result["max_tokens"].(float64)
+		if thinking := thinkingConfig(effort, maxTokens, result["temperature"], &warnings); thinking != nil {
+			result["thinking"] = thinking
+		}
+	}
+
+	// After thinking, which decides how the JSON tool is forced
+	anthropicResponseFormat(body, result, &warnings)
+
+	return result, warnings
+}
+
+// systemBlocks converts an OpenAI system message's content to Anthropic
+// system blocks. A content array of text parts gives one block per part,
+// keeping any cache_control a client set on it.
+func systemBlocks(content any) []any {
+	if s, ok := content.(string); ok {
+		return []any{map[string]any{"type": "text", "text": s}}
+	}
+	parts, ok := content.([]any)
+	if !ok {
+		return []any{map[string]any{"type": "text", "text": toJSONString(content)}}
+	}
+	var blocks []any
+	for _, p := range parts {
+		part, ok := p.(map[string]any)
+		if !ok || getStr(part, "type") != "text" {
+			return []any{map[string]any{"type": "text", "text": toJSONString(content)}}
+		}
+		block := map[string]any{"type": "text", "text": getStr(part, "text")}
+		if cc := part["cache_control"]; cc != nil {
+			block["cache_control"] = cc
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
 }
 
 // --------------------------------------------------------------------------
@@ -695,7 +837,8 @@ func OpenAIToAnthropicRequest(body map[string]any) map[string]any {
 // --------------------------------------------------------------------------
 
 // AnthropicToOpenAIResponse converts an Anthropic Messages API response to an
-// OpenAI Chat Completions response.
+// OpenAI Chat Completions response. A call to the tool a json_schema
+// response_format became is returned as message content.
 func AnthropicToOpenAIResponse(body map[string]any, model string) map[string]any {
 	var contentTexts []string
 	var toolCalls []any
@@ -707,6 +850,10 @@ func AnthropicToOpenAIResponse(body map[string]any, model string) map[string]any
 			case "text":
 				contentTexts = append(contentTexts, getStr(block, "text"))
 			case "tool_use":
+				if isJSONResponseBlock(block) {
+					contentTexts = append(contentTexts, toJSONString(block["input"]))
+					break
+				}
 				input := block["input"]
 				if input == nil {
 					input = map[string]any{}
@@ -723,18 +870,6 @@ func AnthropicToOpenAIResponse(body map[string]any, model string) map[string]any
 		}
 	}
 
-	var finishReason string
-	switch getStr(body, "stop_reason") {
-	case "end_turn":
-		finishReason = "stop"
-	case "max_tokens":
-		finishReason = "length"
-	case "tool_use":
-		finishReason = "tool_calls"
-	default:
-		finishReason = "stop"
-	}
-
 	joined := strings.Join(contentTexts, "")
 	var contentVal any
 	if joined != "" {
@@ -754,27 +889,22 @@ func AnthropicToOpenAIResponse(body map[string]any, model string) map[string]any
 		bodyID = fmt.Sprintf("%d", nowMillis())
 	}
 
-	usage := toMap(body["usage"])
-	inputTokens, _ := getFloat(usage, "input_tokens")
-	outputTokens, _ := getFloat(usage, "output_tokens")
+	var usage anthropicUsage
+	usage.update(toMap(body["usage"]))
+
+	choice := map[string]any{
+		"index":   float64(0),
+		"message": message,
+	}
+	setFinishReason(choice, getStr(body, "stop_reason"), len(toolCalls) > 0)
 
 	return map[string]any{
 		"id":      fmt.Sprintf("chatcmpl-%s", bodyID),
 		"object":  "chat.completion",
 		"created": nowUnix(),
 		"model":   model,
-		"choices": []any{
-			map[string]any{
-				"index":         float64(0),
-				"message":       message,
-				"finish_reason": finishReason,
-			},
-		},
-		"usage": map[string]any{
-			"prompt_tokens":     inputTokens,
-			"completion_tokens": outputTokens,
-			"total_tokens":      inputTokens + outputTokens,
-		},
+		"choices": []any{choice},
+		"usage":   usage.openAI(),
 	}
 }
 
@@ -784,12 +914,28 @@ func AnthropicToOpenAIResponse(body map[string]any, model string) map[string]any
 
 // ConvertSSEStream converts an OpenAI SSE stream (io.Reader) to an Anthropic
 // SSE stream. It returns an io.ReadCloser that produces the Anthropic-format
-// SSE events.
-func ConvertSSEStream(reader io.Reader, originalModel string) io.ReadCloser {
+// SSE events. Tool names are mapped back through toolNames, which may be nil.
+func ConvertSSEStream(reader io.Reader, originalModel string, toolNames ToolNames) io.ReadCloser {
+	return ConvertSSEStreamWithPing(reader, originalModel, toolNames, DefaultPingInterval)
+}
+
+// ConvertSSEStreamWithPing is ConvertSSEStream with ping events sent after
+// pingInterval without output; zero sends none. Upstream comment lines
+// (": keep-alive") are passed through.
+func ConvertSSEStreamWithPing(reader io.Reader, originalModel string, toolNames ToolNames, pingInterval time.Duration) io.ReadCloser {
 	pr, pw := io.Pipe()
+	stream := streamutil.NewPipe(pr, reader)
 
 	go func() {
 		defer pw.Close()
+		defer streamutil.Recover(pw, "convert", "ConvertSSEStream")
+
+		out := newPingWriter(pw)
+		if pingInterval > 0 {
+			done := make(chan struct{})
+			defer close(done)
+			go out.run(pingInterval, done)
+		}
 
 		scanner := bufio.NewScanner(reader)
 		// Increase buffer size for large SSE messages
@@ -803,20 +949,99 @@ func ConvertSSEStream(reader io.Reader, originalModel string) io.ReadCloser {
 		startedBlocks := map[int]bool{}
 		// Counter for assigning Anthropic content block indices
 		nextContentBlockIndex := 0
-		// Map from OpenAI tool_call index to our Anthropic content block index
-		toolIndexMap := map[int]int{}
-		// Track the last finish_reason to determine stop_reason
-		lastFinishReason := ""
-		// Whether we've started a text content block
+		// OpenAI tool calls and the content blocks they were given
+		toolCalls := newStreamToolCalls()
+		// The stop_reason the last finish_reason maps to
+		stopReason := "end_turn"
+		// Whether we've started a text content block, and the index it got
 		textBlockStarted := false
+		textBlockIndex := -1
 		// Track thinking/reasoning block for DeepSeek reasoner
 		thinkingBlockStarted := false
 		thinkingBlockIndex := -1
+		// Set once chunks for choices other than 0 (n > 1) have been dropped
+		droppedChoices := false
+
+		startTextBlock := func() {
+			if textBlockStarted {
+				return
+			}
+			textBlockStarted = true
+			textBlockIndex = nextContentBlockIndex
+			nextContentBlockIndex++
+			startedBlocks[textBlockIndex] = true
+			writeSSE(out, "content_block_start", map[string]any{
+				"type":  "content_block_start",
+				"index": textBlockIndex,
+				"content_block": map[string]any{
+					"type": "text",
+					"text": "",
+				},
+			})
+		}
+		writeText := func(text string) {
+			startTextBlock()
+			writeSSE(out, "content_block_delta", map[string]any{
+				"type":  "content_block_delta",
+				"index": textBlockIndex,
+				"delta": map[string]any{
+					"type": "text_delta",
+					"text": text,
+				},
+			})
+		}
+		writeArgs := func(blockIdx int, args string) {
+			writeSSE(out, "content_block_delta", map[string]any{
+				"type":  "content_block_delta",
+				"index": blockIdx,
+				"delta": map[string]any{
+					"type":         "input_json_delta",
+					"partial_json": args,
+				},
+			})
+		}
+
+		// finish closes the message: on [DONE], or at the end of a stream
+		// the provider cut short without one
+		finished := false
+		finish := func() {
+			finished = true
+			// Arguments for a call that was never named can't become a
+			// tool_use block; pass them through rather than drop them
+			if args := toolCalls.drain(); args != "" {
+				writeText(args)
+			}
+
+			// Close ALL started content blocks
+			var indices []int
+			for idx := range startedBlocks {
+				indices = append(indices, idx)
+			}
+			sort.Ints(indices)
+
+			for _, idx := range indices {
+				writeSSE(out, "content_block_stop", map[string]any{
+					"type":  "content_block_stop",
+					"index": idx,
+				})
+			}
+
+			writeSSE(out, "message_delta", map[string]any{
+				"type":  "message_delta",
+				"delta": map[string]any{"stop_reason": stopReason, "stop_sequence": nil},
+				"usage": map[string]any{"input_tokens": inputTokens, "output_tokens": outputTokens},
+			})
+
+			writeSSE(out, "message_stop", map[string]any{"type": "message_stop"})
+		}
 
 		// Buffer for incomplete lines
 		var lineBuffer string
 
 		for scanner.Scan() {
+			if stream.Closed() {
+				return
+			}
 			rawLine := scanner.Text()
 
 			// Handle line buffering - SSE lines end with \n
@@ -824,6 +1049,10 @@ func ConvertSSEStream(reader io.Reader, originalModel string) io.ReadCloser {
 			line := strings.TrimSpace(lineBuffer)
 			lineBuffer = ""
 
+			if strings.HasPrefix(line, ":") {
+				fmt.Fprintf(out, "%s\n\n", line)
+				continue
+			}
 			if line == "" || !strings.HasPrefix(line, "data: ") {
 				continue
 			}
@@ -831,35 +1060,9 @@ func ConvertSSEStream(reader io.Reader, originalModel string) io.ReadCloser {
 			dataStr := line[6:]
 
 			if dataStr == "[DONE]" {
-				// Close ALL started content blocks
-				var indices []int
-				for idx := range startedBlocks {
-					indices = append(indices, idx)
+				if !finished {
+					finish()
 				}
-				sort.Ints(indices)
-
-				for _, idx := range indices {
-					writeSSE(pw, "content_block_stop", map[string]any{
-						"type":  "content_block_stop",
-						"index": idx,
-					})
-				}
-
-				// Determine stop_reason from last finish_reason
-				stopReason := "end_turn"
-				if lastFinishReason == "tool_calls" {
-					stopReason = "tool_use"
-				} else if lastFinishReason == "length" {
-					stopReason = "max_tokens"
-				}
-
-				writeSSE(pw, "message_delta", map[string]any{
-					"type":  "message_delta",
-					"delta": map[string]any{"stop_reason": stopReason, "stop_sequence": nil},
-					"usage": map[string]any{"input_tokens": inputTokens, "output_tokens": outputTokens},
-				})
-
-				writeSSE(pw, "message_stop", map[string]any{"type": "message_stop"})
 				continue
 			}
 
@@ -868,13 +1071,19 @@ func ConvertSSEStream(reader io.Reader, originalModel string) io.ReadCloser {
 				continue
 			}
 
+			// A provider error ends the stream
+			if streamErr := openAIStreamError(parsed); streamErr != nil {
+				writeSSE(out, "error", map[string]any{"type": "error", "error": streamErr})
+				return
+			}
+
 			if !sentMessageStart {
 				sentMessageStart = true
 				msgID := getStr(parsed, "id")
 				if msgID == "" {
 					msgID = fmt.Sprintf("msg_%d", nowMillis())
 				}
-				writeSSE(pw, "message_start", map[string]any{
+				writeSSE(out, "message_start", map[string]any{
 					"type": "message_start",
 					"message": map[string]any{
 						"id": msgID, "type": "message", "role": "assistant",
@@ -895,11 +1104,20 @@ func ConvertSSEStream(reader io.Reader, originalModel string) io.ReadCloser {
 				}
 			}
 
+			// Only choice 0 is streamed, as in OpenAIToAnthropic
 			choices, _ := getSlice(parsed, "choices")
-			if len(choices) == 0 {
+			var choice map[string]any
+			for _, c := range choices {
+				if m := toMap(c); choiceIndex(m) == 0 {
+					choice = m
+				} else if !droppedChoices {
+					droppedChoices = true
+					log.Printf("[convert] Stream has several choices; kept choice 0 only")
+				}
+			}
+			if choice == nil {
 				continue
 			}
-			choice := toMap(choices[0])
 			delta, ok := getMap(choice, "delta")
 			if !ok {
 				continue
@@ -912,7 +1130,7 @@ func ConvertSSEStream(reader io.Reader, originalModel string) io.ReadCloser {
 					thinkingBlockIndex = nextContentBlockIndex
 					nextContentBlockIndex++
 					startedBlocks[thinkingBlockIndex] = true
-					writeSSE(pw, "content_block_start", map[string]any{
+					writeSSE(out, "content_block_start", map[string]any{
 						"type":  "content_block_start",
 						"index": thinkingBlockIndex,
 						"content_block": map[string]any{
@@ -921,7 +1139,7 @@ func ConvertSSEStream(reader io.Reader, originalModel string) io.ReadCloser {
 						},
 					})
 				}
-				writeSSE(pw, "content_block_delta", map[string]any{
+				writeSSE(out, "content_block_delta", map[string]any{
 					"type":  "content_block_delta",
 					"index": thinkingBlockIndex,
 					"delta": map[string]any{
@@ -933,109 +1151,69 @@ func ConvertSSEStream(reader io.Reader, originalModel string) io.ReadCloser {
 
 			// Handle text content
 			if content := getStr(delta, "content"); content != "" {
-				if !textBlockStarted {
-					textBlockStarted = true
-					blockIdx := nextContentBlockIndex
-					nextContentBlockIndex++
-					startedBlocks[blockIdx] = true
-					writeSSE(pw, "content_block_start", map[string]any{
-						"type":  "content_block_start",
-						"index": blockIdx,
-						"content_block": map[string]any{
-							"type": "text",
-							"text": "",
-						},
-					})
-				}
-				// Use the correct index for text block (after thinking block if present)
-				textIdx := 0
-				if thinkingBlockStarted {
-					textIdx = thinkingBlockIndex + 1
-				}
-				writeSSE(pw, "content_block_delta", map[string]any{
-					"type":  "content_block_delta",
-					"index": textIdx,
-					"delta": map[string]any{
-						"type": "text_delta",
-						"text": content,
-					},
-				})
+				writeText(content)
 			}
 
 			// Handle tool calls
 			if tcs, ok := getSlice(delta, "tool_calls"); ok {
 				for _, rawTC := range tcs {
 					tc := toMap(rawTC)
-					openaiIndex := 0
-					if idx, ok := getFloat(tc, "index"); ok {
-						openaiIndex = int(idx)
-					}
+					openaiIndex := toolCalls.index(tc)
 
 					fn := toMap(tc["function"])
 
-					if fnName := getStr(fn, "name"); fnName != "" {
-						// New tool call starting -- assign a content block index
-						if !textBlockStarted {
-							// Ensure text block is at index 0 even if empty
-							textBlockStarted = true
-							textIdx := nextContentBlockIndex
-							nextContentBlockIndex++
-							startedBlocks[textIdx] = true
-							writeSSE(pw, "content_block_start", map[string]any{
-								"type":  "content_block_start",
-								"index": textIdx,
-								"content_block": map[string]any{
-									"type": "text",
-									"text": "",
-								},
-							})
-						}
+					_, started := toolCalls.block(openaiIndex)
+					if fnName := getStr(fn, "name"); fnName != "" && !started {
+						// New tool call starting -- assign a content block index.
+						// Ensure text block is at index 0 even if empty
+						startTextBlock()
 
 						blockIdx := nextContentBlockIndex
 						nextContentBlockIndex++
-						toolIndexMap[openaiIndex] = blockIdx
 						startedBlocks[blockIdx] = true
+						toolID, held := toolCalls.start(openaiIndex, blockIdx)
 
 						// Generate a tool ID if the provider omits one (DeepSeek does this)
-						toolID := getStr(tc, "id")
 						if toolID == "" {
 							toolID = fmt.Sprintf("toolu_%d_%s", nowMillis(), generateID())
 						}
 
-						writeSSE(pw, "content_block_start", map[string]any{
+						writeSSE(out, "content_block_start", map[string]any{
 							"type":  "content_block_start",
 							"index": blockIdx,
 							"content_block": map[string]any{
 								"type":  "tool_use",
 								"id":    toolID,
-								"name":  fnName,
+								"name":  toolNames.Original(fnName),
 								"input": map[string]any{},
 							},
 						})
+						if held != "" {
+							writeArgs(blockIdx, held)
+						}
 					}
 
 					if fnArgs := getStr(fn, "arguments"); fnArgs != "" {
-						if blockIdx, exists := toolIndexMap[openaiIndex]; exists {
-							writeSSE(pw, "content_block_delta", map[string]any{
-								"type":  "content_block_delta",
-								"index": blockIdx,
-								"delta": map[string]any{
-									"type":         "input_json_delta",
-									"partial_json": fnArgs,
-								},
-							})
+						if blockIdx, exists := toolCalls.block(openaiIndex); exists {
+							writeArgs(blockIdx, fnArgs)
+						} else {
+							toolCalls.hold(openaiIndex, fnArgs)
 						}
 					}
 				}
 			}
 
-			if fr := getStr(choice, "finish_reason"); fr != "" {
-				lastFinishReason = fr
+			if getStr(choice, "finish_reason") != "" || getStr(choice, stopReasonField) != "" {
+				stopReason = stopReasonFor(choice)
 			}
 		}
+		if sentMessageStart && !finished && !stream.Closed() {
+			log.Printf("[convert] Stream ended without [DONE]; closed the message")
+			finish()
+		}
 	}()
 
-	return pr
+	return stream
 }
 
 // --------------------------------------------------------------------------
@@ -1046,17 +1224,81 @@ func ConvertSSEStream(reader io.Reader, originalModel string) io.ReadCloser {
 // an OpenAI SSE stream. It returns an io.ReadCloser that produces the
 // OpenAI-format SSE events.
 func ConvertAnthropicSSEToOpenAI(reader io.Reader, model string) io.ReadCloser {
+	return ConvertAnthropicSSEToOpenAIWithUsage(reader, model, false)
+}
+
+// ConvertAnthropicSSEToOpenAIWithUsage is ConvertAnthropicSSEToOpenAI for a
+// client that set stream_options.include_usage: like OpenAI, the stream ends
+// with a chunk carrying the usage and no choices.
+func ConvertAnthropicSSEToOpenAIWithUsage(reader io.Reader, model string, includeUsage bool) io.ReadCloser {
 	pr, pw := io.Pipe()
+	stream := streamutil.NewPipe(pr, reader)
 
 	go func() {
 		defer pw.Close()
+		defer streamutil.Recover(pw, "convert", "ConvertAnthropicSSEToOpenAI")
 
 		scanner := bufio.NewScanner(reader)
 		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
 
 		messageID := fmt.Sprintf("chatcmpl-%d", nowMillis())
+		blocks := newStreamBlocks()
+		var usage anthropicUsage
+		// What was sent, so a stream cut short can still be finished
+		started, finishSent, doneSent := false, false, false
+
+		writeText := func(text string) {
+			if text == "" {
+				return
+			}
+			writeDataLine(pw, map[string]any{
+				"id": messageID, "object": "chat.completion.chunk",
+				"created": nowUnix(), "model": model,
+				"choices": []any{
+					map[string]any{
+						"index":         float64(0),
+						"delta":         map[string]any{"content": text},
+						"finish_reason": nil,
+					},
+				},
+			})
+		}
+		writeUsage := func() {
+			if !includeUsage {
+				return
+			}
+			writeDataLine(pw, map[string]any{
+				"id": messageID, "object": "chat.completion.chunk",
+				"created": nowUnix(), "model": model,
+				"choices": []any{},
+				"usage":   usage.openAI(),
+			})
+		}
+		writeArguments := func(tool int, partialJSON string) {
+			writeDataLine(pw, map[string]any{
+				"id": messageID, "object": "chat.completion.chunk",
+				"created": nowUnix(), "model": model,
+				"choices": []any{
+					map[string]any{
+						"index": float64(0),
+						"delta": map[string]any{
+							"tool_calls": []any{
+								map[string]any{
+									"index":    float64(tool),
+									"function": map[string]any{"arguments": partialJSON},
+								},
+							},
+						},
+						"finish_reason": nil,
+					},
+				},
+			})
+		}
 
 		for scanner.Scan() {
+			if stream.Closed() {
+				return
+			}
 			line := strings.TrimSpace(scanner.Text())
 
 			// Skip event lines, we parse data lines
@@ -1086,6 +1328,12 @@ func ConvertAnthropicSSEToOpenAI(reader io.Reader, model string) io.ReadCloser {
 				if msgID != "" {
 					messageID = fmt.Sprintf("chatcmpl-%s", msgID)
 				}
+				// Input and cache tokens are reported here; message_delta
+				// carries output
+				if usageMap, ok := getMap(msgObj, "usage"); ok {
+					usage.update(usageMap)
+				}
+				started = true
 				// Emit first chunk with role
 				writeDataLine(pw, map[string]any{
 					"id": messageID, "object": "chat.completion.chunk",
@@ -1102,131 +1350,136 @@ func ConvertAnthropicSSEToOpenAI(reader io.Reader, model string) io.ReadCloser {
 			case "content_block_delta":
 				delta := toMap(parsed["delta"])
 				deltaType := getStr(delta, "type")
+				index := blockIndex(parsed)
 
 				if deltaType == "text_delta" {
-					text := getStr(delta, "text")
-					if text != "" {
-						writeDataLine(pw, map[string]any{
-							"id": messageID, "object": "chat.completion.chunk",
-							"created": nowUnix(), "model": model,
-							"choices": []any{
-								map[string]any{
-									"index":         float64(0),
-									"delta":         map[string]any{"content": text},
-									"finish_reason": nil,
-								},
-							},
-						})
-					}
+					blocks.delta(index, deltaType, "")
+					writeText(getStr(delta, "text"))
 				} else if deltaType == "input_json_delta" {
 					partialJSON := getStr(delta, "partial_json")
-					if partialJSON != "" {
-						// Tool call argument streaming
-						parsedIndex := float64(0)
-						if idx, ok := getFloat(parsed, "index"); ok {
-							parsedIndex = idx
-						}
-						writeDataLine(pw, map[string]any{
-							"id": messageID, "object": "chat.completion.chunk",
-							"created": nowUnix(), "model": model,
-							"choices": []any{
-								map[string]any{
-									"index": float64(0),
-									"delta": map[string]any{
-										"tool_calls": []any{
-											map[string]any{
-												"index":    parsedIndex,
-												"function": map[string]any{"arguments": partialJSON},
-											},
-										},
-									},
-									"finish_reason": nil,
-								},
-							},
-						})
+					b := blocks.delta(index, deltaType, partialJSON)
+					if b == nil || partialJSON == "" {
+						break
 					}
+					if b.kind != "tool_use" {
+						// Arguments for a block that isn't a tool call
+						writeText(partialJSON)
+						break
+					}
+					writeArguments(b.tool, partialJSON)
+				} else {
+					blocks.delta(index, deltaType, "")
 				}
 
 			case "content_block_start":
 				cb := toMap(parsed["content_block"])
-				if getStr(cb, "type") == "tool_use" {
-					// Calculate tool call index: (parsed.index ?? 1) - 1
-					toolIdx := float64(0)
-					if idx, ok := getFloat(parsed, "index"); ok {
-						toolIdx = idx - 1
-					} else {
-						toolIdx = 0 // (1) - 1 = 0
-					}
-
-					writeDataLine(pw, map[string]any{
-						"id": messageID, "object": "chat.completion.chunk",
-						"created": nowUnix(), "model": model,
-						"choices": []any{
-							map[string]any{
-								"index": float64(0),
-								"delta": map[string]any{
-									"tool_calls": []any{
-										map[string]any{
-											"index":    toolIdx,
-											"id":       getStr(cb, "id"),
-											"type":     "function",
-											"function": map[string]any{"name": getStr(cb, "name"), "arguments": ""},
-										},
+				if isJSONResponseBlock(cb) {
+					// Its arguments stream as content, like any block
+					// that isn't a tool call
+					cb = map[string]any{"type": "text"}
+				}
+				index := blockIndex(parsed)
+				b, isNew := blocks.start(index, cb)
+				if !isNew {
+					break
+				}
+				if b.kind != "tool_use" {
+					writeText(blocks.takePending(index))
+					break
+				}
+				writeDataLine(pw, map[string]any{
+					"id": messageID, "object": "chat.completion.chunk",
+					"created": nowUnix(), "model": model,
+					"choices": []any{
+						map[string]any{
+							"index": float64(0),
+							"delta": map[string]any{
+								"tool_calls": []any{
+									map[string]any{
+										"index":    float64(b.tool),
+										"id":       b.id,
+										"type":     "function",
+										"function": map[string]any{"name": getStr(cb, "name"), "arguments": ""},
 									},
 								},
-								"finish_reason": nil,
 							},
+							"finish_reason": nil,
 						},
-					})
+					},
+				})
+				if pending := blocks.takePending(index); pending != "" {
+					writeArguments(b.tool, pending)
 				}
 
+			case "content_block_stop":
+				writeText(blocks.stop(blockIndex(parsed)))
+
 			case "message_delta":
+				writeText(blocks.drain())
 				delta := toMap(parsed["delta"])
 				stopReason := getStr(delta, "stop_reason")
 				if stopReason != "" {
-					var finishReason string
-					switch stopReason {
-					case "end_turn":
-						finishReason = "stop"
-					case "max_tokens":
-						finishReason = "length"
-					case "tool_use":
-						finishReason = "tool_calls"
-					default:
-						finishReason = "stop"
+					choice := map[string]any{
+						"index": float64(0),
+						"delta": map[string]any{},
 					}
-
+					setFinishReason(choice, stopReason, blocks.nextTool > 0)
 					chunk := map[string]any{
 						"id": messageID, "object": "chat.completion.chunk",
 						"created": nowUnix(), "model": model,
-						"choices": []any{
-							map[string]any{
-								"index":         float64(0),
-								"delta":         map[string]any{},
-								"finish_reason": finishReason,
-							},
-						},
+						"choices": []any{choice},
 					}
 
+					// With include_usage the totals come once, in the
+					// usage-only chunk; clients add up every usage they see
 					if usageMap, ok := getMap(parsed, "usage"); ok {
-						outTokens, _ := getFloat(usageMap, "output_tokens")
-						chunk["usage"] = map[string]any{
-							"prompt_tokens":     float64(0),
-							"completion_tokens": outTokens,
-							"total_tokens":      outTokens,
+						usage.update(usageMap)
+						if !includeUsage {
+							chunk["usage"] = usage.openAI()
 						}
 					}
 
 					writeDataLine(pw, chunk)
+					finishSent = true
 				}
 
 			case "message_stop":
+				writeText(blocks.drain())
+				writeUsage()
 				fmt.Fprint(pw, "data: [DONE]\n\n")
+				doneSent = true
+
+			case "error":
+				// A provider error ends the stream
+				writeText(blocks.drain())
+				writeDataLine(pw, anthropicStreamError(parsed))
+				fmt.Fprint(pw, "data: [DONE]\n\n")
+				return
 			}
 		}
+		writeText(blocks.drain())
+		if !started || doneSent || stream.Closed() {
+			return
+		}
+		log.Printf("[convert] Stream ended without message_stop; closed the message")
+		if !finishSent {
+			writeDataLine(pw, map[string]any{
+				"id": messageID, "object": "chat.completion.chunk",
+				"created": nowUnix(), "model": model,
+				"choices": []any{
+					map[string]any{
+						"index":         float64(0),
+						"delta":         map[string]any{},
+						"finish_reason": "stop",
+					},
+				},
+			})
+		}
+		writeUsage()
+		fmt.Fprint(pw, "data: [DONE]\n\n")
 	}()
 
-	return pr
+	return stream
 }
 
 // --------------------------------------------------------------------------
@@ -1,10 +1,18 @@
 package convert
 
 import (
+	"bytes"
 	"encoding/json"
 	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestAnthropicToOpenAI_BasicMessage(t *testing.T) {
@@ -67,6 +75,79 @@ func TestAnthropicToOpenAI_SystemArray(t *testing.T) {
 	}
 }
 
+func TestAnthropicToOpenAI_SystemArrayWarnings(t *testing.T) {
+	body := map[string]any{
+		"system": []any{
+			map[string]any{"type": "text", "text": "Static prefix", "cache_control": map[string]any{"type": "ephemeral"}},
+			map[string]any{"type": "text", "text": "Dynamic part"},
+		},
+		"messages": []any{map[string]any{"role": "user", "content": "Hi"}},
+	}
+	_, warnings, _ := AnthropicToOpenAIWithWarnings(body, "gpt-4o")
+	want := []string{"merged 2 system blocks into one message", "dropped cache_control from system blocks"}
+	if !slices.Equal(warnings, want) {
+		t.Errorf("warnings = %q, want %q", warnings, want)
+	}
+
+	_, warnings, _ = AnthropicToOpenAIWithOptions(body, "gpt-4o", Options{SplitSystem: true})
+	if want := []string{"dropped cache_control from system blocks"}; !slices.Equal(warnings, want) {
+		t.Errorf("split: warnings = %q, want %q", warnings, want)
+	}
+}
+
+func TestSystemBlocks_RoundTrip(t *testing.T) {
+	system := []any{
+		map[string]any{"type": "text", "text": "You are Claude Code."},
+		map[string]any{"type": "text", "text": "Large static instructions", "cache_control": map[string]any{"type": "ephemeral"}},
+		map[string]any{"type": "text", "text": "Environment details"},
+	}
+	body := map[string]any{
+		"system":   system,
+		"messages": []any{map[string]any{"role": "user", "content": "Hi"}},
+	}
+
+	openai, _, _ := AnthropicToOpenAIWithOptions(body, "gpt-4o", Options{SplitSystem: true})
+	back := OpenAIToAnthropicRequest(openai)
+	blocks, _ := back["system"].([]any)
+	if len(blocks) != len(system) {
+		t.Fatalf("round trip gave %d system blocks, want %d", len(blocks), len(system))
+	}
+	for i, b := range blocks {
+		if got, want := b.(map[string]any)["text"], system[i].(map[string]any)["text"]; got != want {
+			t.Errorf("block %d text = %q, want %q", i, got, want)
+		}
+	}
+	if msgs := back["messages"].([]any); len(msgs) != 1 {
+		t.Errorf("messages = %v, want only the user turn", msgs)
+	}
+
+	// Without the option the blocks are joined, and come back as one
+	openai, _, _ = AnthropicToOpenAIWithWarnings(body, "gpt-4o")
+	if blocks, _ := OpenAIToAnthropicRequest(openai)["system"].([]any); len(blocks) != 1 {
+		t.Errorf("joined round trip gave %d system blocks, want 1", len(blocks))
+	}
+}
+
+func TestOpenAIToAnthropicRequest_SystemContentParts(t *testing.T) {
+	body := map[string]any{
+		"messages": []any{
+			map[string]any{"role": "system", "content": []any{
+				map[string]any{"type": "text", "text": "Prefix", "cache_control": map[string]any{"type": "ephemeral"}},
+				map[string]any{"type": "text", "text": "Suffix"},
+			}},
+			map[string]any{"role": "user", "content": "Hi"},
+		},
+	}
+	blocks := OpenAIToAnthropicRequest(body)["system"].([]any)
+	if len(blocks) != 2 {
+		t.Fatalf("system blocks = %v, want 2", blocks)
+	}
+	first, second := blocks[0].(map[string]any), blocks[1].(map[string]any)
+	if first["text"] != "Prefix" || first["cache_control"] == nil || second["text"] != "Suffix" || second["cache_control"] != nil {
+		t.Errorf("system blocks = %v", blocks)
+	}
+}
+
 func TestAnthropicToOpenAI_ToolUse(t *testing.T) {
 	body := map[string]any{
 		"model": "test",
@@ -161,6 +242,7 @@ func TestAnthropicToOpenAI_ToolChoice(t *testing.T) {
 	}{
 		{map[string]any{"type": "auto"}, "auto"},
 		{map[string]any{"type": "any"}, "required"},
+		{map[string]any{"type": "none"}, "none"},
 	}
 	for _, tt := range tests {
 		body := map[string]any{
@@ -185,6 +267,25 @@ func TestAnthropicToOpenAI_StopSequences(t *testing.T) {
 	}
 }
 
+func TestAnthropicToOpenAI_UserID(t *testing.T) {
+	body := map[string]any{
+		"model": "test", "messages": []any{}, "max_tokens": float64(100),
+		"metadata": map[string]any{"user_id": "user-42"},
+	}
+	result := AnthropicToOpenAI(body, "gpt-4o")
+	if result["user"] != "user-42" {
+		t.Errorf("metadata.user_id should map to user, got %v", result["user"])
+	}
+	if _, ok := result["metadata"]; ok {
+		t.Error("metadata should not be copied")
+	}
+
+	delete(body, "metadata")
+	if _, ok := AnthropicToOpenAI(body, "gpt-4o")["user"]; ok {
+		t.Error("user should be absent without metadata.user_id")
+	}
+}
+
 func TestAnthropicToOpenAI_ThinkingBlocks(t *testing.T) {
 	body := map[string]any{
 		"model": "test",
@@ -209,6 +310,66 @@ func TestAnthropicToOpenAI_ThinkingBlocks(t *testing.T) {
 	}
 }
 
+func TestAnthropicToOpenAI_ThinkingToDeepSeekReasoningContent(t *testing.T) {
+	body := map[string]any{
+		"model": "test",
+		"messages": []any{
+			map[string]any{"role": "user", "content": "What's in main.go?"},
+			map[string]any{
+				"role": "assistant",
+				"content": []any{
+					map[string]any{"type": "thinking", "thinking": "I should read the file.", "signature": "sig1"},
+					map[string]any{"type": "redacted_thinking", "data": "EmwKAhgB"},
+					map[string]any{"type": "text", "text": "Reading it."},
+					map[string]any{"type": "thinking", "thinking": "Then summarize.", "signature": "sig2"},
+					map[string]any{"type": "tool_use", "id": "toolu_1", "name": "Read", "input": map[string]any{"path": "main.go"}},
+				},
+			},
+		},
+		"max_tokens": float64(100),
+	}
+
+	msg := AnthropicToOpenAI(body, "deepseek-reasoner")["messages"].([]any)[1].(map[string]any)
+	if msg["reasoning_content"] != "I should read the file.\n\nThen summarize." {
+		t.Errorf("reasoning_content = %q", msg["reasoning_content"])
+	}
+	if msg["content"] != "Reading it." || len(msg["tool_calls"].([]any)) != 1 {
+		t.Errorf("content = %q, tool_calls = %v", msg["content"], msg["tool_calls"])
+	}
+
+	// Other targets don't take reasoning back
+	msg = AnthropicToOpenAI(body, "gpt-4o")["messages"].([]any)[1].(map[string]any)
+	if _, ok := msg["reasoning_content"]; ok || msg["content"] != "Reading it." {
+		t.Errorf("gpt-4o message = %v", msg)
+	}
+}
+
+func TestAnthropicToOpenAI_UnknownBlockPlaceholder(t *testing.T) {
+	body := map[string]any{
+		"model": "claude-sonnet-4-20250514",
+		"messages": []any{
+			map[string]any{"role": "user", "content": []any{
+				map[string]any{"type": "text", "text": "Look at this: "},
+				map[string]any{"type": "mystery_block", "text": "hidden", "payload": map[string]any{"a": 1}},
+				map[string]any{"type": "mystery_block", "text": "again"},
+				map[string]any{"type": "redacted_thinking", "data": "opaque"},
+			}},
+		},
+	}
+	result, warnings, _ := AnthropicToOpenAIWithWarnings(body, "gpt-4o")
+	msg := result["messages"].([]any)[0].(map[string]any)
+	parts, ok := msg["content"].([]any)
+	if !ok || len(parts) != 3 {
+		t.Fatalf("content = %v, want the text and two placeholders", msg["content"])
+	}
+	if got := parts[1].(map[string]any)["text"]; got != "[mystery_block block omitted]" {
+		t.Errorf("placeholder = %v", got)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], `"mystery_block"`) {
+		t.Errorf("warnings = %v, want one naming mystery_block", warnings)
+	}
+}
+
 func TestOpenAIToAnthropic_BasicResponse(t *testing.T) {
 	response := map[string]any{
 		"id": "chatcmpl-123",
@@ -221,7 +382,7 @@ func TestOpenAIToAnthropic_BasicResponse(t *testing.T) {
 		},
 		"usage": map[string]any{"prompt_tokens": float64(10), "completion_tokens": float64(5)},
 	}
-	result := OpenAIToAnthropic(response, "claude-sonnet-4-20250514")
+	result := OpenAIToAnthropic(response, "claude-sonnet-4-20250514", nil)
 	if result["type"] != "message" {
 		t.Error("type should be message")
 	}
@@ -263,7 +424,7 @@ func TestOpenAIToAnthropic_ToolCalls(t *testing.T) {
 		},
 		"usage": map[string]any{"prompt_tokens": float64(10), "completion_tokens": float64(5)},
 	}
-	result := OpenAIToAnthropic(response, "claude-sonnet-4-20250514")
+	result := OpenAIToAnthropic(response, "claude-sonnet-4-20250514", nil)
 	content := result["content"].([]any)
 	found := false
 	for _, block := range content {
@@ -283,6 +444,58 @@ func TestOpenAIToAnthropic_ToolCalls(t *testing.T) {
 	}
 }
 
+func TestOpenAIToAnthropic_ReasoningContent(t *testing.T) {
+	response := func(content any) map[string]any {
+		return map[string]any{
+			"id": "chatcmpl-r1",
+			"choices": []any{
+				map[string]any{
+					"index": float64(0),
+					"message": map[string]any{
+						"role": "assistant", "content": content,
+						"reasoning_content": "The user greets me.",
+					},
+					"finish_reason": "stop",
+				},
+			},
+		}
+	}
+
+	content := OpenAIToAnthropic(response("Hello!"), "claude-sonnet-4-20250514", nil)["content"].([]any)
+	if len(content) != 2 {
+		t.Fatalf("content = %v, want thinking then text", content)
+	}
+	if b := content[0].(map[string]any); b["type"] != "thinking" || b["thinking"] != "The user greets me." {
+		t.Errorf("first block = %v", b)
+	}
+	if b := content[1].(map[string]any); b["type"] != "text" || b["text"] != "Hello!" {
+		t.Errorf("second block = %v", b)
+	}
+
+	// Reasoning that used up the output tokens leaves no content
+	for _, c := range []any{"", nil} {
+		content := OpenAIToAnthropic(response(c), "claude-sonnet-4-20250514", nil)["content"].([]any)
+		if len(content) != 1 || content[0].(map[string]any)["type"] != "thinking" {
+			t.Errorf("content %v: blocks = %v, want the thinking block only", c, content)
+		}
+	}
+}
+
+func TestOpenAIToAnthropic_MultipleChoices(t *testing.T) {
+	response := map[string]any{
+		"id": "chatcmpl-n2",
+		"choices": []any{
+			map[string]any{"index": float64(1), "message": map[string]any{"role": "assistant", "content": "second"}, "finish_reason": "length"},
+			map[string]any{"index": float64(0), "message": map[string]any{"role": "assistant", "content": "first"}, "finish_reason": "stop"},
+		},
+	}
+	result := OpenAIToAnthropic(response, "claude-sonnet-4-20250514", nil)
+	content := result["content"].([]any)
+	if len(content) != 1 || content[0].(map[string]any)["text"] != "first" || result["stop_reason"] != "end_turn" {
+		t.Errorf("content = %v, stop_reason = %v; want choice 0 only", content, result["stop_reason"])
+	}
+}
+
 func TestOpenAIToAnthropic_LengthFinish(t *testing.T) {
 	response := map[string]any{
 		"id": "chatcmpl-123",
@@ -295,7 +508,7 @@ func TestOpenAIToAnthropic_LengthFinish(t *testing.T) {
 		},
 		"usage": map[string]any{"prompt_tokens": float64(10), "completion_tokens": float64(5)},
 	}
-	result := OpenAIToAnthropic(response, "test")
+	result := OpenAIToAnthropic(response, "test", nil)
 	if result["stop_reason"] != "max_tokens" {
 		t.Errorf("length -> max_tokens, got %v", result["stop_reason"])
 	}
@@ -306,7 +519,7 @@ func TestOpenAIToAnthropic_EmptyChoices(t *testing.T) {
 		"id":      "chatcmpl-123",
 		"choices": []any{},
 	}
-	result := OpenAIToAnthropic(response, "test")
+	result := OpenAIToAnthropic(response, "test", nil)
 	if result["type"] != "message" {
 		t.Error("should return valid message even with empty choices")
 	}
@@ -336,7 +549,7 @@ func TestOpenAIToAnthropic_MalformedArgs(t *testing.T) {
 		},
 		"usage": map[string]any{"prompt_tokens": float64(0), "completion_tokens": float64(0)},
 	}
-	result := OpenAIToAnthropic(response, "test")
+	result := OpenAIToAnthropic(response, "test", nil)
 	content := result["content"].([]any)
 	for _, block := range content {
 		b := block.(map[string]any)
@@ -391,6 +604,57 @@ func TestOpenAIToAnthropicRequest_Stop(t *testing.T) {
 	}
 }
 
+func TestOpenAIToAnthropicRequest_DropsN(t *testing.T) {
+	body := map[string]any{
+		"model":    "gpt-4o",
+		"n":        float64(2),
+		"messages": []any{map[string]any{"role": "user", "content": "hi"}},
+	}
+	if result := OpenAIToAnthropicRequest(body); result["n"] != nil {
+		t.Errorf("n forwarded to Anthropic: %v", result["n"])
+	}
+}
+
+func TestOpenAIToAnthropicRequest_ToolChoiceNone(t *testing.T) {
+	tools := []any{map[string]any{"type": "function", "function": map[string]any{"name": "lookup", "parameters": map[string]any{"type": "object"}}}}
+	body := map[string]any{
+		"model": "gpt-4o", "tools": tools, "tool_choice": "none",
+		"messages": []any{map[string]any{"role": "user", "content": "hi"}},
+	}
+	result := OpenAIToAnthropicRequest(body)
+	if result["tools"] != nil || result["tool_choice"] != nil {
+		t.Errorf("tools = %v, tool_choice = %v; want neither forwarded", result["tools"], result["tool_choice"])
+	}
+
+	// Tool calls in the history need their tools declared
+	body["messages"] = []any{
+		map[string]any{"role": "user", "content": "look it up"},
+		map[string]any{"role": "assistant", "tool_calls": []any{map[string]any{
+			"id": "call_1", "type": "function", "function": map[string]any{"name": "lookup", "arguments": "{}"}}}},
+		map[string]any{"role": "tool", "tool_call_id": "call_1", "content": "42"},
+	}
+	result = OpenAIToAnthropicRequest(body)
+	if result["tools"] == nil || !reflect.DeepEqual(result["tool_choice"], map[string]any{"type": "none"}) {
+		t.Errorf("with tool history: tools = %v, tool_choice = %v", result["tools"], result["tool_choice"])
+	}
+}
+
+func TestOpenAIToAnthropicRequest_User(t *testing.T) {
+	body := map[string]any{
+		"model":    "gpt-4o",
+		"messages": []any{},
+		"user":     "user-42",
+	}
+	result := OpenAIToAnthropicRequest(body)
+	md, _ := result["metadata"].(map[string]any)
+	if md["user_id"] != "user-42" {
+		t.Errorf("user should map to metadata.user_id, got %v", result["metadata"])
+	}
+	if _, ok := result["user"]; ok {
+		t.Error("user should not be copied as-is")
+	}
+}
+
 func TestAnthropicToOpenAIResponse_Text(t *testing.T) {
 	body := map[string]any{
 		"id":   "msg_123",
@@ -451,7 +715,7 @@ func TestConvertSSEStream(t *testing.T) {
 	}
 	input := strings.Join(events, "\n") + "\n"
 
-	stream := ConvertSSEStream(strings.NewReader(input), "claude-sonnet-4-20250514")
+	stream := ConvertSSEStream(strings.NewReader(input), "claude-sonnet-4-20250514", nil)
 	output, _ := io.ReadAll(stream)
 	stream.Close()
 	result := string(output)
@@ -470,6 +734,103 @@ func TestConvertSSEStream(t *testing.T) {
 	}
 }
 
+func TestConvertSSEStream_MultipleChoices(t *testing.T) {
+	events := []string{
+		`data: {"id":"chatcmpl-1","choices":[{"index":0,"delta":{"role":"assistant","content":""}},{"index":1,"delta":{"role":"assistant","content":""}}]}`,
+		`data: {"id":"chatcmpl-1","choices":[{"index":1,"delta":{"content":"Other"}}]}`,
+		`data: {"id":"chatcmpl-1","choices":[{"index":0,"delta":{"content":"Hello"}}]}`,
+		`data: {"id":"chatcmpl-1","choices":[{"index":1,"delta":{},"finish_reason":"length"}]}`,
+		`data: {"id":"chatcmpl-1","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+		`data: [DONE]`,
+	}
+	stream := ConvertSSEStream(strings.NewReader(strings.Join(events, "\n")+"\n"), "claude-sonnet-4-20250514", nil)
+	output, _ := io.ReadAll(stream)
+	stream.Close()
+	result := string(output)
+
+	if !strings.Contains(result, "Hello") || strings.Contains(result, "Other") {
+		t.Errorf("want choice 0's text only:\n%s", result)
+	}
+	if !strings.Contains(result, `"stop_reason":"end_turn"`) {
+		t.Errorf("stop reason not taken from choice 0:\n%s", result)
+	}
+}
+
+// DeepSeek and some OpenRouter models stream tool calls before any text.
+// Text (and reasoning that starts late) must land in blocks of their own,
+// never in the tool_use block, and every block must be closed.
+func TestConvertSSEStream_ToolCallsBeforeText(t *testing.T) {
+	events := []string{
+		`data: {"id":"chatcmpl-2","choices":[{"index":0,"delta":{"role":"assistant","tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"Read","arguments":""}}]}}]}`,
+		`data: {"id":"chatcmpl-2","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"path\":\"a.go\"}"}}]}}]}`,
+		`data: {"id":"chatcmpl-2","choices":[{"index":0,"delta":{"reasoning_content":"Then explain."}}]}`,
+		`data: {"id":"chatcmpl-2","choices":[{"index":0,"delta":{"content":"Reading a.go."}}]}`,
+		`data: {"id":"chatcmpl-2","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+		`data: [DONE]`,
+	}
+	stream := ConvertSSEStream(strings.NewReader(strings.Join(events, "\n")+"\n"), "claude-sonnet-4-20250514", nil)
+	output, _ := io.ReadAll(stream)
+	stream.Close()
+
+	blockTypes := map[int]string{}
+	stopped := map[int]bool{}
+	for _, line := range strings.Split(string(output), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var ev struct {
+			Type         string         `json:"type"`
+			Index        int            `json:"index"`
+			ContentBlock map[string]any `json:"content_block"`
+			Delta        map[string]any `json:"delta"`
+		}
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			t.Fatalf("invalid event: %s", data)
+		}
+		switch ev.Type {
+		case "content_block_start":
+			blockTypes[ev.Index] = ev.ContentBlock["type"].(string)
+		case "content_block_delta":
+			want := map[string]string{"text_delta": "text", "input_json_delta": "tool_use", "thinking_delta": "thinking"}[ev.Delta["type"].(string)]
+			if blockTypes[ev.Index] != want || stopped[ev.Index] {
+				t.Errorf("%s sent to block %d (%s, stopped %v)", ev.Delta["type"], ev.Index, blockTypes[ev.Index], stopped[ev.Index])
+			}
+		case "content_block_stop":
+			stopped[ev.Index] = true
+		}
+	}
+	want := map[int]string{0: "text", 1: "tool_use", 2: "thinking"}
+	if !reflect.DeepEqual(blockTypes, want) {
+		t.Errorf("blocks = %v, want %v", blockTypes, want)
+	}
+	for index := range blockTypes {
+		if !stopped[index] {
+			t.Errorf("block %d not closed on [DONE]", index)
+		}
+	}
+}
+
+// Arguments for a call the provider never names can't become a tool_use
+// block, so they are passed through as text rather than dropped.
+func TestConvertSSEStream_UnnamedToolArguments(t *testing.T) {
+	events := []string{
+		`data: {"id":"chatcmpl-3","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"x\":1}"}}]}}]}`,
+		`data: {"id":"chatcmpl-3","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+		`data: [DONE]`,
+	}
+	stream := ConvertSSEStream(strings.NewReader(strings.Join(events, "\n")+"\n"), "claude-sonnet-4-20250514", nil)
+	output, _ := io.ReadAll(stream)
+	stream.Close()
+	result := string(output)
+	if strings.Contains(result, "tool_use") || !strings.Contains(result, `"text":"{\"x\":1}"`) {
+		t.Errorf("unnamed arguments not passed through as text:\n%s", result)
+	}
+	if strings.Index(result, "text_delta") > strings.Index(result, "content_block_stop") {
+		t.Error("text sent after its block was closed")
+	}
+}
+
 func TestConvertAnthropicSSEToOpenAI(t *testing.T) {
 	events := []string{
 		`event: message_start`,
@@ -523,3 +884,251 @@ func TestConvertAnthropicSSEToOpenAI(t *testing.T) {
 		}
 	}
 }
+
+// Tool calls are numbered by the order they start, not by content block
+// index, whatever blocks come before them. Anthropic-compatible gateways
+// don't all send canonical streams either. Each fixture must convert to
+// well-formed chunks: tool calls numbered from 0 and started with an id and
+// name before their arguments, and anything that can't be placed kept as
+// text.
+func TestConvertAnthropicSSEToOpenAI_MalformedStreams(t *testing.T) {
+	type toolCall struct{ id, name, args string }
+	for _, tc := range []struct {
+		fixture string
+		text    string
+		tools   []toolCall
+	}{
+		// two tool calls and no text
+		{"anthropic_stream_parallel_tools", "", []toolCall{
+			{"toolu_par_a", "Read", `{"file_path":"a.go"}`},
+			{"toolu_par_b", "Grep", `{"pattern":"TODO"}`},
+		}},
+		// thinking, then text, then a tool call at block index 2
+		{"anthropic_stream_thinking", "Reading it now.", []toolCall{
+			{"toolu_s", "Read", `{"file_path":"/app/main.go"}`},
+		}},
+		// index 0 reused for every block, second tool started without a stop
+		{"glm_stream_reused_index", "Checking both files.", []toolCall{
+			{"call_glm_a", "Read", `{"file_path":"a.go"}`},
+			{"call_glm_b", "Read", `{"file_path":"b.go"}`},
+		}},
+		// deltas before their starts, and a repeated tool start
+		{"shim_stream_out_of_order", "Running it.", []toolCall{
+			{"toolu_shim", "Bash", `{"command":"go test"}`},
+		}},
+		// arguments for a block never started, and for a text block
+		{"shim_stream_orphan_arguments", `{"orphan":true}{"misplaced":1}`, []toolCall{
+			{"toolu_first", "Glob", `{"pattern":"*.go"}`},
+		}},
+	} {
+		t.Run(tc.fixture, func(t *testing.T) {
+			in, err := os.ReadFile(filepath.Join("testdata", tc.fixture+".sse"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream := ConvertAnthropicSSEToOpenAI(bytes.NewReader(in), "gpt-4o")
+			out, _ := io.ReadAll(stream)
+			stream.Close()
+
+			var text strings.Builder
+			var tools []toolCall
+			for _, line := range strings.Split(string(out), "\n") {
+				data, ok := strings.CutPrefix(line, "data: ")
+				if !ok || data == "[DONE]" {
+					continue
+				}
+				var chunk struct {
+					Object  string `json:"object"`
+					Choices []struct {
+						Delta struct {
+							Content   string `json:"content"`
+							ToolCalls []struct {
+								Index    int    `json:"index"`
+								ID       string `json:"id"`
+								Function struct {
+									Name      string `json:"name"`
+									Arguments string `json:"arguments"`
+								} `json:"function"`
+							} `json:"tool_calls"`
+						} `json:"delta"`
+					} `json:"choices"`
+				}
+				if err := json.Unmarshal([]byte(data), &chunk); err != nil || chunk.Object != "chat.completion.chunk" || len(chunk.Choices) != 1 {
+					t.Fatalf("malformed chunk: %s", data)
+				}
+				delta := chunk.Choices[0].Delta
+				text.WriteString(delta.Content)
+				for _, call := range delta.ToolCalls {
+					switch {
+					case call.Index == len(tools) && call.ID != "" && call.Function.Name != "":
+						tools = append(tools, toolCall{call.ID, call.Function.Name, ""})
+					case call.Index >= 0 && call.Index < len(tools) && call.ID == "":
+						tools[call.Index].args += call.Function.Arguments
+					default:
+						t.Fatalf("tool call out of sequence: %s", data)
+					}
+				}
+			}
+			if text.String() != tc.text {
+				t.Errorf("text = %q, want %q", text.String(), tc.text)
+			}
+			if !reflect.DeepEqual(tools, tc.tools) {
+				t.Errorf("tool calls = %+v, want %+v", tools, tc.tools)
+			}
+		})
+	}
+}
+
+// Providers that drop the connection, or just leave out the final event,
+// still get a closed message in the client's format.
+func TestConvertSSEStreams_Truncated(t *testing.T) {
+	t.Run("openai to anthropic", func(t *testing.T) {
+		for _, tc := range []struct {
+			name, last, stopReason string
+			blocks                 int
+		}{
+			{"mid text", `data: {"id":"c1","choices":[{"index":0,"delta":{"content":" world"}}]}`, "end_turn", 1},
+			{"after tool call", `data: {"id":"c1","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","function":{"name":"ls","arguments":"{}"}}]},"finish_reason":"tool_calls"}],"usage":{"prompt_tokens":7,"completion_tokens":3}}`, "tool_use", 2},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				in := `data: {"id":"c1","choices":[{"index":0,"delta":{"content":"hello"}}]}` + "\n\n" + tc.last + "\n\n"
+				stream := ConvertSSEStream(strings.NewReader(in), "claude-sonnet-4-20250514", nil)
+				output, _ := io.ReadAll(stream)
+				stream.Close()
+				result := string(output)
+
+				if n := strings.Count(result, "event: content_block_stop"); n != tc.blocks {
+					t.Errorf("content_block_stop events = %d, want %d:\n%s", n, tc.blocks, result)
+				}
+				if !strings.Contains(result, `"stop_reason":"`+tc.stopReason+`"`) {
+					t.Errorf("stop_reason isn't %s:\n%s", tc.stopReason, result)
+				}
+				if !strings.HasSuffix(result, "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n") {
+					t.Errorf("stream doesn't end with message_stop:\n%s", result)
+				}
+				if tc.blocks == 2 && !strings.Contains(result, `"usage":{"input_tokens":7,"output_tokens":3}`) {
+					t.Errorf("usage read before the cut is missing:\n%s", result)
+				}
+			})
+		}
+	})
+
+	t.Run("anthropic to openai", func(t *testing.T) {
+		start := "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"usage\":{\"input_tokens\":3}}}\n\n" +
+			"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"text\",\"text\":\"\"}}\n\n" +
+			"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Hi\"}}\n\n"
+		for _, tc := range []struct {
+			name, in, finishReason string
+		}{
+			{"mid text", start, "stop"},
+			{"after message_delta", start + "event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"max_tokens\"},\"usage\":{\"output_tokens\":1}}\n\n", "length"},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				stream := ConvertAnthropicSSEToOpenAI(strings.NewReader(tc.in), "gpt-4o")
+				output, _ := io.ReadAll(stream)
+				stream.Close()
+				result := string(output)
+
+				if !strings.Contains(result, `"content":"Hi"`) || !strings.HasSuffix(result, "data: [DONE]\n\n") {
+					t.Errorf("stream doesn't end with [DONE]:\n%s", result)
+				}
+				if n := strings.Count(result, `"finish_reason":"`); n != 1 || !strings.Contains(result, `"finish_reason":"`+tc.finishReason+`"`) {
+					t.Errorf("want one finish_reason %s:\n%s", tc.finishReason, result)
+				}
+			})
+		}
+	})
+}
+
+// endlessReader repeats line forever. With block set it instead blocks
+// until closed, like an upstream that stalls mid-stream.
+type endlessReader struct {
+	line   []byte
+	block  bool
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newEndlessReader(line string, block bool) *endlessReader {
+	return &endlessReader{line: []byte(line), block: block, closed: make(chan struct{})}
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	if r.block {
+		<-r.closed
+	}
+	select {
+	case <-r.closed:
+		return 0, io.ErrClosedPipe
+	default:
+		return copy(p, r.line), nil
+	}
+}
+
+func (r *endlessReader) Close() error {
+	r.once.Do(func() { close(r.closed) })
+	return nil
+}
+
+// waitGoroutines waits for the goroutine count to drop back to n.
+func waitGoroutines(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines = %d, want %d: stream goroutine leaked", runtime.NumGoroutine(), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSSEStreams_CloseStopsGoroutine(t *testing.T) {
+	openaiLine := "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"x\"}}]}\n\n"
+	anthropicLine := "data: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"x\"}}\n\n"
+	cases := []struct {
+		name string
+		wrap func(io.Reader) io.ReadCloser
+		line string
+	}{
+		{"openai to anthropic", func(r io.Reader) io.ReadCloser { return ConvertSSEStream(r, "claude", nil) }, openaiLine},
+		{"anthropic to openai", func(r io.Reader) io.ReadCloser { return ConvertAnthropicSSEToOpenAI(r, "gpt-4o") }, anthropicLine},
+	}
+	for _, c := range cases {
+		for _, block := range []bool{false, true} {
+			before := runtime.NumGoroutine()
+			src := newEndlessReader(c.line, block)
+			stream := c.wrap(src)
+			if !block {
+				// The converter is producing output, then the reader walks away
+				if _, err := stream.Read(make([]byte, 16)); err != nil {
+					t.Fatalf("%s: read: %v", c.name, err)
+				}
+			}
+			stream.Close()
+			waitGoroutines(t, before)
+			select {
+			case <-src.closed:
+			default:
+				t.Errorf("%s (block=%v): source not closed", c.name, block)
+			}
+		}
+	}
+}
+
+// panicReader panics on the first read.
+type panicReader struct{}
+
+func (panicReader) Read([]byte) (int, error) { panic("bad input") }
+
+func TestSSEStreams_PanicFailsStream(t *testing.T) {
+	for name, stream := range map[string]io.ReadCloser{
+		"openai to anthropic": ConvertSSEStream(panicReader{}, "claude", nil),
+		"anthropic to openai": ConvertAnthropicSSEToOpenAI(panicReader{}, "gpt-4o"),
+	} {
+		_, err := io.ReadAll(stream)
+		if err == nil || !strings.Contains(err.Error(), "bad input") {
+			t.Errorf("%s: err = %v, want the panic", name, err)
+		}
+		stream.Close()
+	}
+}
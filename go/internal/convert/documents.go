@@ -0,0 +1,110 @@
+package convert
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// openAIDocumentPart converts an Anthropic document block to an OpenAI
+// content part. Base64 documents (PDFs) become file parts when the target
+// takes them (fileParts), and a text note naming the document otherwise.
+// URL documents are passed as a note with the URL, since OpenAI file parts
+// only take inline data, and plain-text documents as their text.
+func openAIDocumentPart(block map[string]any, fileParts bool, warnings *[]string) map[string]any {
+	source := toMap(block["source"])
+	name := documentName(block, getStr(source, "media_type"))
+
+	switch getStr(source, "type") {
+	case "base64":
+		if fileParts {
+			return map[string]any{
+				"type": "file",
+				"file": map[string]any{
+					"filename":  name,
+					"file_data": fmt.Sprintf("data:%s;base64,%s", getStr(source, "media_type"), getStr(source, "data")),
+				},
+			}
+		}
+		addWarning(warnings, "dropped document attachments the provider doesn't accept")
+		return textPart(fmt.Sprintf("[attached document omitted: %s]", name))
+
+	case "url":
+		addWarning(warnings, "sent document URLs as text")
+		return textPart(fmt.Sprintf("[attached document %s: %s]", name, getStr(source, "url")))
+
+	case "text":
+		return textPart(fmt.Sprintf("[attached document %s]\n%s", name, getStr(source, "data")))
+
+	case "content":
+		var texts []string
+		if blocks, ok := source["content"].([]any); ok {
+			for _, b := range blocks {
+				if bm := toMap(b); getStr(bm, "type") == "text" {
+					texts = append(texts, getStr(bm, "text"))
+				}
+			}
+		}
+		return textPart(fmt.Sprintf("[attached document %s]\n%s", name, strings.Join(texts, "\n")))
+	}
+
+	addWarning(warnings, "dropped document attachments the provider doesn't accept")
+	return textPart(fmt.Sprintf("[attached document omitted: %s]", name))
+}
+
+// anthropicDocumentBlock converts an OpenAI file part to an Anthropic
+// document block. Files uploaded to OpenAI and referenced by file_id can't be
+// sent on, so they become a text note.
+func anthropicDocumentBlock(part map[string]any, warnings *[]string) map[string]any {
+	file := toMap(part["file"])
+	name := getStr(file, "filename")
+	data := getStr(file, "file_data")
+	if match := dataURIRe.FindStringSubmatch(data); match != nil {
+		block := map[string]any{
+			"type":   "document",
+			"source": map[string]any{"type": "base64", "media_type": match[1], "data": match[2]},
+		}
+		if name != "" {
+			block["title"] = name
+		}
+		return block
+	}
+	if strings.HasPrefix(data, "https://") || strings.HasPrefix(data, "http://") {
+		block := map[string]any{
+			"type":   "document",
+			"source": map[string]any{"type": "url", "url": data},
+		}
+		if name != "" {
+			block["title"] = name
+		}
+		return block
+	}
+	if name == "" {
+		name = getStr(file, "file_id")
+	}
+	addWarning(warnings, "dropped file parts that reference uploaded files")
+	return textPart(fmt.Sprintf("[attached document omitted: %s]", name))
+}
+
+// documentName is the file name a document is shown under: its title, or a
+// generic name.
+func documentName(block map[string]any, mediaType string) string {
+	if title := getStr(block, "title"); title != "" {
+		return title
+	}
+	if mediaType == "application/pdf" {
+		return "document.pdf"
+	}
+	return "document"
+}
+
+func textPart(text string) map[string]any {
+	return map[string]any{"type": "text", "text": text}
+}
+
+// addWarning appends warning unless it is already listed.
+func addWarning(warnings *[]string, warning string) {
+	if !slices.Contains(*warnings, warning) {
+		*warnings = append(*warnings, warning)
+	}
+}
@@ -0,0 +1,73 @@
+package convert
+
+import (
+	"reflect"
+	"testing"
+)
+
+func documentRequest(source map[string]any) map[string]any {
+	return map[string]any{
+		"model":      "claude-sonnet-4-6",
+		"max_tokens": float64(100),
+		"messages": []any{map[string]any{"role": "user", "content": []any{
+			map[string]any{"type": "document", "title": "report.pdf", "source": source},
+			map[string]any{"type": "text", "text": "summarize this"},
+		}}},
+	}
+}
+
+func firstPart(t *testing.T, body map[string]any) map[string]any {
+	t.Helper()
+	content, ok := body["messages"].([]any)[0].(map[string]any)["content"].([]any)
+	if !ok || len(content) != 2 {
+		t.Fatalf("content = %v", body["messages"].([]any)[0].(map[string]any)["content"])
+	}
+	return content[0].(map[string]any)
+}
+
+func TestAnthropicToOpenAI_DocumentBase64(t *testing.T) {
+	body := documentRequest(map[string]any{"type": "base64", "media_type": "application/pdf", "data": "JVBERi0xLjQ="})
+
+	result, warnings, _ := AnthropicToOpenAIWithOptions(body, "gpt-4o", Options{FileParts: true})
+	want := map[string]any{"type": "file", "file": map[string]any{
+		"filename": "report.pdf", "file_data": "data:application/pdf;base64,JVBERi0xLjQ="}}
+	if got := firstPart(t, result); !reflect.DeepEqual(got, want) || len(warnings) != 0 {
+		t.Errorf("part = %v, warnings = %v", got, warnings)
+	}
+
+	// Providers without file parts get a note instead
+	result, warnings, _ = AnthropicToOpenAIWithOptions(body, "deepseek-chat", Options{})
+	if got := firstPart(t, result); got["text"] != "[attached document omitted: report.pdf]" || len(warnings) != 1 {
+		t.Errorf("part = %v, warnings = %v", got, warnings)
+	}
+}
+
+func TestAnthropicToOpenAI_DocumentURL(t *testing.T) {
+	body := documentRequest(map[string]any{"type": "url", "url": "https://example.com/report.pdf"})
+
+	result, warnings, _ := AnthropicToOpenAIWithOptions(body, "gpt-4o", Options{FileParts: true})
+	if got := firstPart(t, result); got["text"] != "[attached document report.pdf: https://example.com/report.pdf]" || len(warnings) != 1 {
+		t.Errorf("part = %v, warnings = %v", got, warnings)
+	}
+}
+
+func TestOpenAIToAnthropicRequest_FilePart(t *testing.T) {
+	body := map[string]any{
+		"model": "gpt-4o",
+		"messages": []any{map[string]any{"role": "user", "content": []any{
+			map[string]any{"type": "file", "file": map[string]any{
+				"filename": "report.pdf", "file_data": "data:application/pdf;base64,JVBERi0xLjQ="}},
+			map[string]any{"type": "file", "file": map[string]any{"file_id": "file-abc123"}},
+		}}},
+	}
+	result, warnings := OpenAIToAnthropicRequestWithWarnings(body)
+	content := result["messages"].([]any)[0].(map[string]any)["content"].([]any)
+	want := map[string]any{"type": "document", "title": "report.pdf",
+		"source": map[string]any{"type": "base64", "media_type": "application/pdf", "data": "JVBERi0xLjQ="}}
+	if !reflect.DeepEqual(content[0], want) {
+		t.Errorf("document = %v", content[0])
+	}
+	if note := content[1].(map[string]any)["text"]; note != "[attached document omitted: file-abc123]" || len(warnings) != 1 {
+		t.Errorf("file_id part = %v, warnings = %v", content[1], warnings)
+	}
+}
@@ -0,0 +1,159 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Seeds mirror the fixtures of the unit tests in convert_test.go.
+var anthropicRequestSeeds = []string{
+	`{"model":"claude-sonnet-4-20250514","max_tokens":100,"messages":[{"role":"user","content":"Hello"}]}`,
+	`{"system":"You are helpful","messages":[{"role":"user","content":"Hi"}]}`,
+	`{"system":[{"type":"text","text":"Part 1","cache_control":{"type":"ephemeral"}},{"type":"text","text":"Part 2"}],"messages":[]}`,
+	`{"messages":[{"role":"assistant","content":[{"type":"text","text":"Let me check"},{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"SF"}}]}]}`,
+	`{"messages":[{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":"72F"},{"type":"image","source":{"type":"base64","media_type":"image/png","data":"AAAA"}}]}]}]}`,
+	`{"tools":[{"name":"github.create_issue","description":"d","input_schema":{"type":"object"}}],"tool_choice":{"type":"tool","name":"fetch_url"},"messages":[]}`,
+	`{"stop_sequences":["END"],"metadata":{"user_id":"u1"},"messages":[{"role":"assistant","content":[{"type":"thinking","thinking":"hmm","signature":"s"},{"type":"text","text":"ok"}]}]}`,
+	`{"messages":[{"role":"user","content":[{"type":"document","source":{}},{"type":"image","source":{"type":"url","url":"https://x"}}]}]}`,
+}
+
+var openAIRequestSeeds = []string{
+	`{"model":"gpt-4o","messages":[{"role":"system","content":"Be helpful"},{"role":"user","content":"Hello"}]}`,
+	`{"messages":[{"role":"system","content":[{"type":"text","text":"Prefix","cache_control":{"type":"ephemeral"}}]}],"stop":"END","user":"u1"}`,
+	`{"messages":[{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"f","arguments":"{\"a\":1}"}}]},{"role":"tool","tool_call_id":"call_1","content":"ok"}]}`,
+	`{"messages":[{"role":"user","content":[{"type":"text","text":"see"},{"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA"}}]}],"tools":[{"type":"function","function":{"name":"f","parameters":{}}}],"tool_choice":{"type":"function","function":{"name":"g"}}}`,
+	`{"max_tokens":10,"max_completion_tokens":20,"stop":["a","b"],"reasoning_effort":"high"}`,
+}
+
+var openAIResponseSeeds = []string{
+	`{"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":5,"completion_tokens":2}}`,
+	`{"choices":[{"message":{"tool_calls":[{"id":"call_1","type":"function","function":{"name":"f","arguments":"{bad"}}]},"finish_reason":"tool_calls"}]}`,
+	`{"choices":[{"message":{"content":"x","reasoning_content":"why"},"finish_reason":"length"}]}`,
+	`{"choices":[]}`,
+}
+
+var anthropicResponseSeeds = []string{
+	`{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"Hi"}],"stop_reason":"end_turn","usage":{"input_tokens":10,"output_tokens":1}}`,
+	`{"content":[{"type":"tool_use","id":"toolu_1","name":"f","input":{"a":1}},{"type":"thinking","thinking":"t"}],"stop_reason":"tool_use"}`,
+}
+
+var openAISSESeeds = []string{
+	"data: {\"id\":\"chatcmpl-1\",\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"content\":\"\"},\"finish_reason\":null}]}\n" +
+		"data: {\"id\":\"chatcmpl-1\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hello\"},\"finish_reason\":null}]}\n" +
+		"data: {\"id\":\"chatcmpl-1\",\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}],\"usage\":{\"prompt_tokens\":5,\"completion_tokens\":2}}\n" +
+		"data: [DONE]\n",
+	"data: {\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"id\":\"call_1\",\"function\":{\"name\":\"f\",\"arguments\":\"{\\\"a\\\"\"}}]}}]}\n" +
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\":1}\"}}]},\"finish_reason\":\"tool_calls\"}]}\n",
+	"data: {\"choices\":[{\"delta\":{\"reasoning_content\":\"think\"}}]}\ndata: {\"choices\":[{\"delta\":{\"content\":\"ok\"}}]}\n",
+}
+
+var anthropicSSESeeds = []string{
+	"event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"model\":\"claude-sonnet-4-20250514\",\"usage\":{\"input_tokens\":10,\"output_tokens\":0}}}\n\n" +
+		"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"text\",\"text\":\"\"}}\n\n" +
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Hi\"}}\n\n" +
+		"event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":0}\n\n" +
+		"event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"},\"usage\":{\"output_tokens\":1}}\n\n" +
+		"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n",
+	"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":1,\"content_block\":{\"type\":\"tool_use\",\"id\":\"toolu_1\",\"name\":\"f\"}}\n\n" +
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":1,\"delta\":{\"type\":\"input_json_delta\",\"partial_json\":\"{\\\"a\\\":1}\"}}\n\n",
+}
+
+// decodeObject unmarshals fuzz input as a JSON object, skipping anything else.
+func decodeObject(t *testing.T, data string) map[string]any {
+	var body map[string]any
+	if json.Unmarshal([]byte(data), &body) != nil || body == nil {
+		t.Skip()
+	}
+	return body
+}
+
+func FuzzAnthropicToOpenAI(f *testing.F) {
+	for _, s := range anthropicRequestSeeds {
+		f.Add(s, "gpt-4o")
+	}
+	f.Add(anthropicRequestSeeds[0], "deepseek-reasoner")
+	f.Fuzz(func(t *testing.T, data, targetModel string) {
+		out, _, _ := AnthropicToOpenAIWithWarnings(decodeObject(t, data), targetModel)
+		if _, err := json.Marshal(out); err != nil {
+			t.Fatalf("result doesn't marshal: %v", err)
+		}
+		AnthropicToOpenAIWithOptions(decodeObject(t, data), targetModel, Options{SplitSystem: true})
+	})
+}
+
+func FuzzOpenAIToAnthropicRequest(f *testing.F) {
+	for _, s := range openAIRequestSeeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, data string) {
+		out, _ := OpenAIToAnthropicRequestWithWarnings(decodeObject(t, data))
+		if _, err := json.Marshal(out); err != nil {
+			t.Fatalf("result doesn't marshal: %v", err)
+		}
+	})
+}
+
+func FuzzOpenAIToAnthropic(f *testing.F) {
+	for _, s := range openAIResponseSeeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, data string) {
+		OpenAIToAnthropic(decodeObject(t, data), "claude-sonnet-4-20250514", ToolNames{"f_1a2b": "f.x"})
+	})
+}
+
+func FuzzAnthropicToOpenAIResponse(f *testing.F) {
+	for _, s := range anthropicResponseSeeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, data string) {
+		AnthropicToOpenAIResponse(decodeObject(t, data), "gpt-4o")
+	})
+}
+
+func FuzzConvertSSEStream(f *testing.F) {
+	for _, s := range openAISSESeeds {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		stream := ConvertSSEStream(bytes.NewReader(data), "claude-sonnet-4-20250514", ToolNames{"f_1a2b": "f.x"})
+		defer stream.Close()
+		out, err := io.ReadAll(stream)
+		if err != nil {
+			t.Fatalf("stream error: %v", err)
+		}
+		checkSSEData(t, out)
+	})
+}
+
+func FuzzConvertAnthropicSSEToOpenAI(f *testing.F) {
+	for _, s := range anthropicSSESeeds {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		stream := ConvertAnthropicSSEToOpenAI(bytes.NewReader(data), "gpt-4o")
+		defer stream.Close()
+		out, err := io.ReadAll(stream)
+		if err != nil {
+			t.Fatalf("stream error: %v", err)
+		}
+		checkSSEData(t, out)
+	})
+}
+
+// checkSSEData fails if a converted stream has a data line that isn't JSON.
+func checkSSEData(t *testing.T, out []byte) {
+	t.Helper()
+	for _, line := range strings.Split(string(out), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		if !json.Valid([]byte(data)) {
+			t.Fatalf("invalid JSON in converted stream: %s", data)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// Golden cases convert testdata/<name>.json or .sse and compare the result
+// with testdata/<name>.golden.json or .golden.sse. JSON output is compared in
+// canonical form (sorted keys, indented), so only a change in fields or
+// values fails, null and absent included. Stream output is compared as the
+// full SSE transcript. Run `go test ./internal/convert -run Golden -update`
+// to accept a change.
+var goldenCases = []struct {
+	name    string
+	convert func(t *testing.T, in []byte) any
+}{
+	{"claude_code_turn", func(t *testing.T, in []byte) any {
+		body, warnings, toolNames := AnthropicToOpenAIWithWarnings(decodeFixture(t, in), "gpt-4.1")
+		return map[string]any{"body": body, "warnings": warnings, "tool_names": toolNames}
+	}},
+	{"multimodal_message", func(t *testing.T, in []byte) any {
+		body, warnings, _ := AnthropicToOpenAIWithWarnings(decodeFixture(t, in), "gpt-4o")
+		return map[string]any{"body": body, "warnings": warnings}
+	}},
+	{"thinking_conversation", func(t *testing.T, in []byte) any {
+		body, warnings, _ := AnthropicToOpenAIWithWarnings(decodeFixture(t, in), "deepseek-reasoner")
+		return map[string]any{"body": body, "warnings": warnings}
+	}},
+	{"openai_tools_request", func(t *testing.T, in []byte) any {
+		body, warnings := OpenAIToAnthropicRequestWithWarnings(decodeFixture(t, in))
+		return map[string]any{"body": body, "warnings": warnings}
+	}},
+	{"openai_tool_response", func(t *testing.T, in []byte) any {
+		return OpenAIToAnthropic(decodeFixture(t, in), "claude-sonnet-4-20250514", nil)
+	}},
+	{"anthropic_thinking_response", func(t *testing.T, in []byte) any {
+		return AnthropicToOpenAIResponse(decodeFixture(t, in), "claude-sonnet-4")
+	}},
+	{"openai_stream_tools", func(t *testing.T, in []byte) any {
+		return readStream(t, ConvertSSEStream(bytes.NewReader(in), "claude-sonnet-4-20250514", nil))
+	}},
+	{"deepseek_stream_reasoning", func(t *testing.T, in []byte) any {
+		return readStream(t, ConvertSSEStream(bytes.NewReader(in), "claude-opus-4-20250514", nil))
+	}},
+	{"openai_stream_interleaved_tools", func(t *testing.T, in []byte) any {
+		return readStream(t, ConvertSSEStream(bytes.NewReader(in), "claude-sonnet-4-20250514", nil))
+	}},
+	{"openai_stream_missing_index", func(t *testing.T, in []byte) any {
+		return readStream(t, ConvertSSEStream(bytes.NewReader(in), "claude-sonnet-4-20250514", nil))
+	}},
+	{"anthropic_stream_thinking", func(t *testing.T, in []byte) any {
+		return readStream(t, ConvertAnthropicSSEToOpenAI(bytes.NewReader(in), "claude-sonnet-4"))
+	}},
+	{"anthropic_stream_parallel_tools", func(t *testing.T, in []byte) any {
+		return readStream(t, ConvertAnthropicSSEToOpenAI(bytes.NewReader(in), "gpt-4o"))
+	}},
+	{"glm_stream_reused_index", func(t *testing.T, in []byte) any {
+		return readStream(t, ConvertAnthropicSSEToOpenAI(bytes.NewReader(in), "gpt-4o"))
+	}},
+	{"shim_stream_out_of_order", func(t *testing.T, in []byte) any {
+		return readStream(t, ConvertAnthropicSSEToOpenAI(bytes.NewReader(in), "gpt-4o"))
+	}},
+	{"shim_stream_orphan_arguments", func(t *testing.T, in []byte) any {
+		return readStream(t, ConvertAnthropicSSEToOpenAI(bytes.NewReader(in), "gpt-4o"))
+	}},
+}
+
+func TestGolden(t *testing.T) {
+	pinIDs(t)
+	for _, tc := range goldenCases {
+		t.Run(tc.name, func(t *testing.T) {
+			inPath := filepath.Join("testdata", tc.name+".json")
+			goldenPath := filepath.Join("testdata", tc.name+".golden.json")
+			if _, err := os.Stat(inPath); err != nil {
+				inPath = filepath.Join("testdata", tc.name+".sse")
+				goldenPath = filepath.Join("testdata", tc.name+".golden.sse")
+			}
+			in, err := os.ReadFile(inPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []byte
+			switch out := tc.convert(t, in).(type) {
+			case []byte:
+				got = out
+			default:
+				got = canonicalJSON(t, out)
+			}
+
+			if *update {
+				if err := os.WriteFile(goldenPath, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("output differs from %s; run with -update if the change is intended\n%s", goldenPath, firstDiff(want, got))
+			}
+		})
+	}
+}
+
+// pinIDs makes generated IDs and timestamps deterministic for the test.
+func pinIDs(t *testing.T) {
+	id, millis, unix := generateID, nowMillis, nowUnix
+	t.Cleanup(func() { generateID, nowMillis, nowUnix = id, millis, unix })
+	n := 0
+	generateID = func() string {
+		n++
+		return fmt.Sprintf("id%04d", n)
+	}
+	nowMillis = func() int64 { return 1700000000000 }
+	nowUnix = func() int64 { return 1700000000 }
+}
+
+func decodeFixture(t *testing.T, in []byte) map[string]any {
+	t.Helper()
+	var body map[string]any
+	if err := json.Unmarshal(in, &body); err != nil {
+		t.Fatalf("fixture: %v", err)
+	}
+	return body
+}
+
+func readStream(t *testing.T, stream io.ReadCloser) []byte {
+	t.Helper()
+	defer stream.Close()
+	out, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	return out
+}
+
+// canonicalJSON renders v with sorted keys and two-space indentation. It
+// round-trips through a generic value so typed maps and slices sort too,
+// and numbers keep their original text.
+func canonicalJSON(t *testing.T, v any) []byte {
+	t.Helper()
+	raw, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var generic any
+	if err := dec.Decode(&generic); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(generic); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// firstDiff describes the first line where got departs from want.
+func firstDiff(want, got []byte) string {
+	wantLines := strings.Split(string(want), "\n")
+	gotLines := strings.Split(string(got), "\n")
+	for i := 0; i < max(len(wantLines), len(gotLines)); i++ {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if w != g {
+			return fmt.Sprintf("line %d:\n  want: %s\n  got:  %s", i+1, w, g)
+		}
+	}
+	return ""
+}
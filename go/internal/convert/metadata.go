@@ -0,0 +1,32 @@
+package convert
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// anthropicMetadata returns the Anthropic metadata for an OpenAI request:
+// the end user, from user or failing that metadata.user_id, or nil if it
+// names none. Anthropic metadata takes nothing else, so other metadata
+// keys are dropped with a warning.
+func anthropicMetadata(r OpenAIRequest, warnings *[]string) map[string]any {
+	userID := r.User
+	if userID == "" {
+		userID, _ = r.Metadata["user_id"].(string)
+	}
+	var dropped []string
+	for key := range r.Metadata {
+		if key != "user_id" {
+			dropped = append(dropped, key)
+		}
+	}
+	if len(dropped) > 0 {
+		sort.Strings(dropped)
+		addWarning(warnings, fmt.Sprintf("dropped metadata %s: Anthropic metadata only takes user_id", strings.Join(dropped, ", ")))
+	}
+	if userID == "" {
+		return nil
+	}
+	return map[string]any{"user_id": userID}
+}
@@ -0,0 +1,42 @@
+package convert
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestOpenAIToAnthropicRequest_OptionalFields(t *testing.T) {
+	cases := []struct {
+		name     string
+		body     map[string]any
+		metadata any
+		warning  string
+	}{
+		{"store", map[string]any{"store": true}, nil, "dropped store: Anthropic doesn't store completions"},
+		{"store off", map[string]any{"store": false}, nil, ""},
+		{"prediction", map[string]any{"prediction": map[string]any{"type": "content", "content": "x"}}, nil,
+			"dropped prediction: Anthropic doesn't take predicted outputs"},
+		{"metadata user_id", map[string]any{"metadata": map[string]any{"user_id": "u1"}}, map[string]any{"user_id": "u1"}, ""},
+		{"metadata other keys", map[string]any{"metadata": map[string]any{"user_id": "u1", "team": "search", "env": "prod"}},
+			map[string]any{"user_id": "u1"}, "dropped metadata env, team: Anthropic metadata only takes user_id"},
+		{"user wins", map[string]any{"user": "u2", "metadata": map[string]any{"user_id": "u1"}}, map[string]any{"user_id": "u2"}, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.body["messages"] = []any{map[string]any{"role": "user", "content": "hi"}}
+			result, warnings := OpenAIToAnthropicRequestWithWarnings(tc.body)
+			for _, field := range []string{"store", "prediction"} {
+				if _, ok := result[field]; ok {
+					t.Errorf("%s was forwarded", field)
+				}
+			}
+			if !reflect.DeepEqual(result["metadata"], tc.metadata) {
+				t.Errorf("metadata = %v, want %v", result["metadata"], tc.metadata)
+			}
+			if tc.warning == "" && len(warnings) > 0 || tc.warning != "" && !slices.Contains(warnings, tc.warning) {
+				t.Errorf("warnings = %q, want %q", warnings, tc.warning)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package convert
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Anthropic messages have no speaker name, so the name of an OpenAI user or
+// assistant message travels as a "[name: alice] " prefix on its first text,
+// and is lifted back into name when converting the other way.
+var speakerPrefixRe = regexp.MustCompile(`^\[name: ([a-zA-Z0-9_-]{1,64})\] ?`)
+
+// withSpeakerName prefixes converted Anthropic content with name.
+func withSpeakerName(content any, name string) any {
+	prefix := fmt.Sprintf("[name: %s] ", name)
+	switch c := content.(type) {
+	case string:
+		return prefix + c
+	case []any:
+		if len(c) > 0 {
+			if first := toMap(c[0]); getStr(first, "type") == "text" {
+				first["text"] = prefix + getStr(first, "text")
+				return c
+			}
+		}
+		return append([]any{textPart(prefix[:len(prefix)-1])}, c...)
+	}
+	return content
+}
+
+// liftSpeakerName moves a speaker prefix on a converted OpenAI message's
+// first text into its name field.
+func liftSpeakerName(msg map[string]any) {
+	role := getStr(msg, "role")
+	if role != "user" && role != "assistant" {
+		return
+	}
+	switch c := msg["content"].(type) {
+	case string:
+		if m := speakerPrefixRe.FindStringSubmatch(c); m != nil {
+			msg["name"], msg["content"] = m[1], c[len(m[0]):]
+		}
+	case []any:
+		if len(c) == 0 {
+			return
+		}
+		first := toMap(c[0])
+		if getStr(first, "type") != "text" {
+			return
+		}
+		text := getStr(first, "text")
+		if m := speakerPrefixRe.FindStringSubmatch(text); m != nil {
+			msg["name"] = m[1]
+			if rest := text[len(m[0]):]; rest != "" {
+				first["text"] = rest
+			} else {
+				msg["content"] = c[1:]
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package convert
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSpeakerNameRoundTrip(t *testing.T) {
+	openAI := map[string]any{
+		"model": "gpt-4o",
+		"user":  "user-42",
+		"messages": []any{
+			map[string]any{"role": "system", "content": "Be brief.", "name": "ops"},
+			map[string]any{"role": "user", "name": "alice", "content": "Hi, I'm Alice."},
+			map[string]any{"role": "user", "name": "bob", "content": []any{
+				map[string]any{"type": "image_url", "image_url": map[string]any{"url": "data:image/png;base64,iVBORw0KGgo="}},
+				map[string]any{"type": "text", "text": "And I'm Bob."},
+			}},
+			map[string]any{"role": "assistant", "name": "helper", "content": "Hello both."},
+		},
+	}
+
+	anthropic, warnings := OpenAIToAnthropicRequestWithWarnings(openAI)
+	msgs := anthropic["messages"].([]any)
+	if got := msgs[0].(map[string]any)["content"]; got != "[name: alice] Hi, I'm Alice." {
+		t.Errorf("alice's content = %v", got)
+	}
+	if first := msgs[1].(map[string]any)["content"].([]any)[0]; !reflect.DeepEqual(first, map[string]any{"type": "text", "text": "[name: bob]"}) {
+		t.Errorf("bob's first block = %v", first)
+	}
+	if md := anthropic["metadata"].(map[string]any); md["user_id"] != "user-42" {
+		t.Errorf("metadata = %v", md)
+	}
+	if len(warnings) != 1 || warnings[0] != "dropped name from system messages" {
+		t.Errorf("warnings = %v", warnings)
+	}
+
+	back := AnthropicToOpenAI(anthropic, "gpt-4o")
+	if back["user"] != "user-42" {
+		t.Errorf("user = %v", back["user"])
+	}
+	backMsgs := back["messages"].([]any)
+	for i, want := range []struct{ name, content string }{{"alice", "Hi, I'm Alice."}, {"helper", "Hello both."}} {
+		m := backMsgs[[]int{1, 3}[i]].(map[string]any)
+		if m["name"] != want.name || m["content"] != want.content {
+			t.Errorf("message = %v, want name %q and content %q", m, want.name, want.content)
+		}
+	}
+	bob := backMsgs[2].(map[string]any)
+	if parts, _ := bob["content"].([]any); bob["name"] != "bob" || len(parts) != 2 || toMap(parts[0])["type"] != "image_url" {
+		t.Errorf("bob's message = %v", bob)
+	}
+}
+
+func TestAnthropicMetadataRoundTrip(t *testing.T) {
+	body := map[string]any{
+		"model":      "claude-sonnet-4-6",
+		"max_tokens": float64(100),
+		"metadata":   map[string]any{"user_id": "user-42"},
+		"messages":   []any{map[string]any{"role": "user", "content": "[name: carol] Hi"}},
+	}
+
+	openAI := AnthropicToOpenAI(body, "gpt-4o")
+	if openAI["user"] != "user-42" {
+		t.Errorf("user = %v", openAI["user"])
+	}
+	if msg := openAI["messages"].([]any)[0].(map[string]any); msg["name"] != "carol" || msg["content"] != "Hi" {
+		t.Errorf("message = %v", msg)
+	}
+
+	back := OpenAIToAnthropicRequest(openAI)
+	if !reflect.DeepEqual(back["metadata"], body["metadata"]) {
+		t.Errorf("metadata = %v", back["metadata"])
+	}
+	if !reflect.DeepEqual(back["messages"], body["messages"]) {
+		t.Errorf("messages = %v", back["messages"])
+	}
+}
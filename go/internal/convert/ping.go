@@ -0,0 +1,52 @@
+package convert
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultPingInterval is how long a converted Anthropic stream may go
+// without output before a ping event is sent.
+const DefaultPingInterval = 15 * time.Second
+
+// pingWriter writes an Anthropic stream and sends ping events while it is
+// idle, like Anthropic's own streams, so clients don't take a slow provider
+// for a stalled connection.
+type pingWriter struct {
+	w io.Writer
+	// last is when the stream was last written to, in Unix nanoseconds.
+	last atomic.Int64
+}
+
+func newPingWriter(w io.Writer) *pingWriter {
+	p := &pingWriter{w: w}
+	p.last.Store(time.Now().UnixNano())
+	return p
+}
+
+func (p *pingWriter) Write(b []byte) (int, error) {
+	p.last.Store(time.Now().UnixNano())
+	return p.w.Write(b)
+}
+
+// run sends a ping whenever the stream has been idle for interval, until
+// done is closed. Pipe writes are atomic, so pings never split an event.
+func (p *pingWriter) run(interval time.Duration, done <-chan struct{}) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+		idle := time.Since(time.Unix(0, p.last.Load()))
+		if idle < interval {
+			timer.Reset(interval - idle)
+			continue
+		}
+		writeSSE(p, "ping", map[string]any{"type": "ping"})
+		timer.Reset(interval)
+	}
+}
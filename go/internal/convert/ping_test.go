@@ -0,0 +1,73 @@
+package convert
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer collects a stream's output for polling while it is written.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func waitForOutput(t *testing.T, out *syncBuffer, want string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(out.String(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("output never contained %q:\n%s", want, out.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConvertSSEStream_PingsWhileStalled(t *testing.T) {
+	src, upstream := io.Pipe()
+	stream := ConvertSSEStreamWithPing(src, "claude-sonnet-4-6", nil, 20*time.Millisecond)
+	defer stream.Close()
+	out := &syncBuffer{}
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(out, stream)
+		close(copied)
+	}()
+
+	io.WriteString(upstream, `data: {"id":"c1","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"hi"}}]}`+"\n\n")
+	waitForOutput(t, out, "text_delta")
+
+	// The provider stalls; pings keep the client's connection alive
+	waitForOutput(t, out, "event: ping\ndata: {\"type\":\"ping\"}\n\n")
+
+	io.WriteString(upstream, ": keep-alive\n\n")
+	waitForOutput(t, out, ": keep-alive\n\n")
+	io.WriteString(upstream, `data: {"id":"c1","model":"gpt-4o","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`+"\n\ndata: [DONE]\n\n")
+	upstream.Close()
+	<-copied
+
+	got := out.String()
+	if !strings.HasSuffix(got, "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n") {
+		t.Errorf("stream doesn't end with message_stop:\n%s", got)
+	}
+	pings := strings.Count(got, "event: ping")
+	time.Sleep(60 * time.Millisecond)
+	if n := strings.Count(out.String(), "event: ping"); n != pings {
+		t.Errorf("pings sent after the stream closed: %d, then %d", pings, n)
+	}
+}
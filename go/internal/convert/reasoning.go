@@ -0,0 +1,92 @@
+package convert
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// reasoningModelRe matches models that take OpenAI's reasoning_effort: the
+// o-series and GPT-5, optionally behind a provider prefix such as
+// OpenRouter's "openai/", and DeepSeek's reasoners.
+var reasoningModelRe = regexp.MustCompile(`(?i)(^|/)(o\d+($|-)|gpt-5)|deepseek-reasoner|deepseek-r1`)
+
+// SupportsReasoningEffort reports whether a model is known to accept
+// reasoning_effort. Options.Reasoning overrides it per model.
+func SupportsReasoningEffort(model string) bool {
+	return reasoningModelRe.MatchString(model)
+}
+
+// MinThinkingBudget is the smallest budget_tokens Anthropic accepts.
+const MinThinkingBudget = 1024
+
+// effortForBudget maps an Anthropic thinking budget to a reasoning_effort.
+func effortForBudget(budget int) string {
+	switch {
+	case budget < 4096:
+		return "low"
+	case budget < 16384:
+		return "medium"
+	default:
+		return "high"
+	}
+}
+
+// budgetForEffort maps a reasoning_effort to an Anthropic thinking budget,
+// one inside the range effortForBudget maps back to the same effort. It
+// returns 0 for "none" and efforts it doesn't know.
+func budgetForEffort(effort string) int {
+	switch effort {
+	case "minimal":
+		return MinThinkingBudget
+	case "low":
+		return 2048
+	case "medium":
+		return 8192
+	case "high":
+		return 24576
+	}
+	return 0
+}
+
+// reasoningEffort returns the reasoning_effort for an Anthropic thinking
+// config sent to model, or "" when the config doesn't enable thinking or
+// the model doesn't take reasoning_effort, which is reported in warnings.
+func reasoningEffort(thinking any, model string, opts Options, warnings *[]string) string {
+	cfg, _ := thinking.(map[string]any)
+	budget, _ := cfg["budget_tokens"].(float64)
+	if getStr(cfg, "type") != "enabled" || budget <= 0 {
+		return ""
+	}
+	supported := SupportsReasoningEffort(model)
+	if opts.Reasoning != nil {
+		supported = *opts.Reasoning
+	}
+	if !supported {
+		*warnings = append(*warnings, fmt.Sprintf("dropped thinking: %s doesn't take reasoning_effort", model))
+		return ""
+	}
+	return effortForBudget(int(budget))
+}
+
+// thinkingConfig returns the Anthropic thinking config for an OpenAI
+// reasoning_effort, with a budget that leaves MinThinkingBudget tokens of
+// maxTokens for the answer. It returns nil, reporting why in warnings, when
+// that leaves less than the minimum budget or a temperature other than 1
+// is set, which Anthropic doesn't allow with thinking.
+func thinkingConfig(effort any, maxTokens float64, temperature any, warnings *[]string) map[string]any {
+	e, _ := effort.(string)
+	budget := budgetForEffort(e)
+	if budget == 0 {
+		return nil
+	}
+	if t, ok := temperature.(float64); ok && t != 1 {
+		*warnings = append(*warnings, fmt.Sprintf("dropped reasoning_effort %q: Anthropic thinking requires temperature 1", e))
+		return nil
+	}
+	budget = min(budget, int(maxTokens)-MinThinkingBudget)
+	if budget < MinThinkingBudget {
+		*warnings = append(*warnings, fmt.Sprintf("dropped reasoning_effort %q: max_tokens %d leaves no room for a thinking budget", e, int(maxTokens)))
+		return nil
+	}
+	return map[string]any{"type": "enabled", "budget_tokens": float64(budget)}
+}
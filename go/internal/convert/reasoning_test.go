@@ -0,0 +1,115 @@
+package convert
+
+import (
+	"testing"
+)
+
+func thinkingBody(budget float64) map[string]any {
+	return map[string]any{
+		"max_tokens": float64(32000),
+		"messages":   []any{map[string]any{"role": "user", "content": "Hi"}},
+		"thinking":   map[string]any{"type": "enabled", "budget_tokens": budget},
+	}
+}
+
+func TestAnthropicToOpenAI_ThinkingToReasoningEffort(t *testing.T) {
+	for _, tc := range []struct {
+		model  string
+		budget float64
+		want   string
+	}{
+		{"o3-mini", 1024, "low"},
+		{"o3", 4096, "medium"},
+		{"o4-mini-2025-04-16", 16383, "medium"},
+		{"openai/o1", 16384, "high"},
+		{"gpt-5", 32000, "high"},
+		{"deepseek-reasoner", 2048, "low"},
+	} {
+		openai, warnings, _ := AnthropicToOpenAIWithWarnings(thinkingBody(tc.budget), tc.model)
+		if openai["reasoning_effort"] != tc.want || len(warnings) != 0 {
+			t.Errorf("%s, budget %v: reasoning_effort = %v, warnings = %q; want %s", tc.model, tc.budget, openai["reasoning_effort"], warnings, tc.want)
+		}
+	}
+}
+
+func TestAnthropicToOpenAI_ThinkingOmittedWithoutReasoning(t *testing.T) {
+	for _, model := range []string{"gpt-4o", "gpt-4.1", "deepseek-chat", "llama-3.3-70b", "gpt-4o3"} {
+		openai, warnings, _ := AnthropicToOpenAIWithWarnings(thinkingBody(8192), model)
+		if _, ok := openai["reasoning_effort"]; ok {
+			t.Errorf("%s: reasoning_effort = %v, want it omitted", model, openai["reasoning_effort"])
+		}
+		if _, ok := openai["thinking"]; ok {
+			t.Errorf("%s: thinking passed through", model)
+		}
+		if len(warnings) != 1 {
+			t.Errorf("%s: warnings = %q, want the dropped thinking", model, warnings)
+		}
+	}
+
+	// A model limit overrides the name
+	yes, no := true, false
+	openai, _, _ := AnthropicToOpenAIWithOptions(thinkingBody(8192), "my-reasoner", Options{Reasoning: &yes})
+	if openai["reasoning_effort"] != "medium" {
+		t.Errorf("Reasoning=true: reasoning_effort = %v, want medium", openai["reasoning_effort"])
+	}
+	openai, _, _ = AnthropicToOpenAIWithOptions(thinkingBody(8192), "o3", Options{Reasoning: &no})
+	if _, ok := openai["reasoning_effort"]; ok {
+		t.Errorf("Reasoning=false: reasoning_effort = %v, want it omitted", openai["reasoning_effort"])
+	}
+
+	// Disabled thinking is no request for reasoning
+	body := thinkingBody(0)
+	body["thinking"] = map[string]any{"type": "disabled"}
+	openai, warnings, _ := AnthropicToOpenAIWithWarnings(body, "gpt-4o")
+	if _, ok := openai["reasoning_effort"]; ok || len(warnings) != 0 {
+		t.Errorf("disabled: reasoning_effort = %v, warnings = %q", openai["reasoning_effort"], warnings)
+	}
+}
+
+func TestOpenAIToAnthropic_ReasoningEffortToThinking(t *testing.T) {
+	for _, tc := range []struct {
+		effort     string
+		maxTokens  any
+		wantBudget float64 // 0 for no thinking
+		warnings   int
+	}{
+		{"minimal", nil, 1024, 0},
+		{"low", nil, 2048, 0},
+		{"medium", nil, 3072, 0}, // the default max_tokens of 4096 caps it
+		{"medium", float64(32000), 8192, 0},
+		{"high", float64(32000), 24576, 0},
+		{"high", float64(10000), 8976, 0},
+		{"low", float64(1500), 0, 1},
+		{"none", nil, 0, 0},
+	} {
+		body := map[string]any{
+			"messages":         []any{map[string]any{"role": "user", "content": "Hi"}},
+			"reasoning_effort": tc.effort,
+		}
+		if tc.maxTokens != nil {
+			body["max_completion_tokens"] = tc.maxTokens
+		}
+		result, warnings := OpenAIToAnthropicRequestWithWarnings(body)
+		thinking, _ := result["thinking"].(map[string]any)
+		budget, _ := thinking["budget_tokens"].(float64)
+		if budget != tc.wantBudget || len(warnings) != tc.warnings {
+			t.Errorf("%s, max_tokens %v: thinking = %v, warnings = %q; want budget %v", tc.effort, tc.maxTokens, result["thinking"], warnings, tc.wantBudget)
+		}
+	}
+
+	for _, effort := range []string{"low", "medium", "high"} {
+		if back := effortForBudget(budgetForEffort(effort)); back != effort {
+			t.Errorf("%s round trips to %s", effort, back)
+		}
+	}
+
+	body := map[string]any{
+		"messages":         []any{map[string]any{"role": "user", "content": "Hi"}},
+		"reasoning_effort": "high",
+		"temperature":      0.2,
+	}
+	result, warnings := OpenAIToAnthropicRequestWithWarnings(body)
+	if _, ok := result["thinking"]; ok || len(warnings) != 1 {
+		t.Errorf("temperature 0.2: thinking = %v, warnings = %q; want it dropped", result["thinking"], warnings)
+	}
+}
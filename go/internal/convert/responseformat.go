@@ -0,0 +1,92 @@
+package convert
+
+// jsonResponseTool is the tool an OpenAI json_schema response_format becomes
+// for Anthropic targets. Anthropic has no JSON mode, but a forced tool call's
+// input follows the tool's schema; responses that call it are turned back
+// into a plain assistant message holding that input as JSON.
+const jsonResponseTool = "codegate_json_response"
+
+// jsonObjectInstruction is the system instruction a json_object
+// response_format becomes for Anthropic targets.
+const jsonObjectInstruction = "Respond with a single valid JSON object and nothing else: no prose and no code fences."
+
+// anthropicResponseFormat maps an OpenAI response_format onto a converted
+// Anthropic request. json_object becomes a system instruction. json_schema
+// becomes jsonResponseTool with the schema as its input_schema, forced with
+// tool_choice; with thinking on, which can't be combined with a forced tool,
+// the model is told to call it instead.
+func anthropicResponseFormat(body, result map[string]any, warnings *[]string) {
+	rf, ok := getMap(body, "response_format")
+	if !ok {
+		return
+	}
+	switch getStr(rf, "type") {
+	case "json_object":
+		appendSystemText(result, jsonObjectInstruction)
+
+	case "json_schema":
+		js := toMap(rf["json_schema"])
+		schema := js["schema"]
+		if schema == nil {
+			schema = map[string]any{"type": "object"}
+		}
+		desc := "Give your final answer by calling this tool; its input is the response."
+		if d := getStr(js, "description"); d != "" {
+			desc += " " + d
+		}
+		tools, _ := result["tools"].([]any)
+		result["tools"] = append(tools, map[string]any{
+			"name":         jsonResponseTool,
+			"description":  desc,
+			"input_schema": schema,
+		})
+		if result["tool_choice"] != nil {
+			*warnings = append(*warnings, "tool_choice replaced by response_format json_schema")
+		}
+		if result["thinking"] != nil {
+			result["tool_choice"] = map[string]any{"type": "auto"}
+			appendSystemText(result, "Give your final answer by calling the "+jsonResponseTool+" tool.")
+		} else {
+			result["tool_choice"] = map[string]any{"type": "tool", "name": jsonResponseTool}
+		}
+	}
+}
+
+// appendSystemText adds a text block to an Anthropic request's system prompt.
+func appendSystemText(result map[string]any, text string) {
+	block := map[string]any{"type": "text", "text": text}
+	switch sys := result["system"].(type) {
+	case []any:
+		result["system"] = append(sys, block)
+	case string:
+		result["system"] = []any{map[string]any{"type": "text", "text": sys}, block}
+	default:
+		result["system"] = []any{block}
+	}
+}
+
+// isJSONResponseBlock reports whether an Anthropic content block is a call
+// to jsonResponseTool.
+func isJSONResponseBlock(block map[string]any) bool {
+	return getStr(block, "type") == "tool_use" && getStr(block, "name") == jsonResponseTool
+}
+
+// openAIResponseFormat maps Anthropic structured output (output_format with
+// a JSON schema) onto an OpenAI json_schema response_format.
+func openAIResponseFormat(body, result map[string]any) {
+	of, ok := getMap(body, "output_format")
+	if !ok || getStr(of, "type") != "json_schema" {
+		return
+	}
+	schema := of["schema"]
+	if schema == nil {
+		schema = map[string]any{"type": "object"}
+	}
+	result["response_format"] = map[string]any{
+		"type": "json_schema",
+		"json_schema": map[string]any{
+			"name":   "response",
+			"schema": schema,
+		},
+	}
+}
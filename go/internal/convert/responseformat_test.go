@@ -0,0 +1,153 @@
+package convert
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOpenAIToAnthropicRequest_ResponseFormatJSONObject(t *testing.T) {
+	body := map[string]any{
+		"model":           "gpt-4o",
+		"response_format": map[string]any{"type": "json_object"},
+		"messages": []any{
+			map[string]any{"role": "system", "content": "You list fruit."},
+			map[string]any{"role": "user", "content": "three fruit"},
+		},
+	}
+	result := OpenAIToAnthropicRequest(body)
+	system := result["system"].([]any)
+	if len(system) != 2 || system[1].(map[string]any)["text"] != jsonObjectInstruction {
+		t.Errorf("system = %v, want the client's prompt then the JSON instruction", system)
+	}
+	if result["tools"] != nil || result["response_format"] != nil {
+		t.Errorf("tools = %v, response_format = %v", result["tools"], result["response_format"])
+	}
+}
+
+func TestOpenAIToAnthropicRequest_ResponseFormatJSONSchema(t *testing.T) {
+	schema := map[string]any{
+		"type":       "object",
+		"properties": map[string]any{"fruit": map[string]any{"type": "array"}},
+	}
+	body := func() map[string]any {
+		return map[string]any{
+			"model": "gpt-4o",
+			"response_format": map[string]any{
+				"type":        "json_schema",
+				"json_schema": map[string]any{"name": "fruit_list", "schema": schema},
+			},
+			"messages": []any{map[string]any{"role": "user", "content": "three fruit"}},
+		}
+	}
+
+	result, warnings := OpenAIToAnthropicRequestWithWarnings(body())
+	tools := result["tools"].([]any)
+	tool := tools[len(tools)-1].(map[string]any)
+	if tool["name"] != jsonResponseTool || !reflect.DeepEqual(tool["input_schema"], schema) {
+		t.Errorf("tool = %v", tool)
+	}
+	want := map[string]any{"type": "tool", "name": jsonResponseTool}
+	if !reflect.DeepEqual(result["tool_choice"], want) || len(warnings) != 0 {
+		t.Errorf("tool_choice = %v, warnings = %v", result["tool_choice"], warnings)
+	}
+
+	// A client tool_choice gives way, with a warning
+	b := body()
+	b["tools"] = []any{map[string]any{"type": "function", "function": map[string]any{"name": "lookup"}}}
+	b["tool_choice"] = "required"
+	result, warnings = OpenAIToAnthropicRequestWithWarnings(b)
+	if len(result["tools"].([]any)) != 2 || !reflect.DeepEqual(result["tool_choice"], want) {
+		t.Errorf("tools = %v, tool_choice = %v", result["tools"], result["tool_choice"])
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "tool_choice replaced") {
+		t.Errorf("warnings = %v", warnings)
+	}
+
+	// Thinking can't be combined with a forced tool
+	b = body()
+	b["reasoning_effort"] = "low"
+	b["max_tokens"] = float64(8000)
+	result = OpenAIToAnthropicRequest(b)
+	if result["thinking"] == nil || !reflect.DeepEqual(result["tool_choice"], map[string]any{"type": "auto"}) {
+		t.Errorf("thinking = %v, tool_choice = %v", result["thinking"], result["tool_choice"])
+	}
+}
+
+func TestAnthropicToOpenAIResponse_JSONResponseTool(t *testing.T) {
+	body := map[string]any{
+		"id": "msg_1",
+		"content": []any{
+			map[string]any{"type": "tool_use", "id": "toolu_1", "name": jsonResponseTool,
+				"input": map[string]any{"fruit": []any{"apple", "pear", "plum"}}},
+		},
+		"stop_reason": "tool_use",
+	}
+	result := AnthropicToOpenAIResponse(body, "claude-sonnet-4-20250514")
+	choice := result["choices"].([]any)[0].(map[string]any)
+	message := choice["message"].(map[string]any)
+	if message["content"] != `{"fruit":["apple","pear","plum"]}` || message["tool_calls"] != nil {
+		t.Errorf("message = %v", message)
+	}
+	if choice["finish_reason"] != "stop" {
+		t.Errorf("finish_reason = %v, want stop", choice["finish_reason"])
+	}
+}
+
+func TestConvertAnthropicSSEToOpenAI_JSONResponseTool(t *testing.T) {
+	events := []string{
+		`data: {"type":"message_start","message":{"id":"msg_1","usage":{"input_tokens":5}}}`,
+		`data: {"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"toolu_1","name":"` + jsonResponseTool + `","input":{}}}`,
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{\"fruit\":"}}`,
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"[\"apple\"]}"}}`,
+		`data: {"type":"content_block_stop","index":0}`,
+		`data: {"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":9}}`,
+		`data: {"type":"message_stop"}`,
+	}
+	stream := ConvertAnthropicSSEToOpenAI(strings.NewReader(strings.Join(events, "\n")+"\n"), "gpt-4o")
+	output, _ := io.ReadAll(stream)
+	stream.Close()
+
+	var content strings.Builder
+	finish := ""
+	for _, line := range strings.Split(string(output), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk map[string]any
+		json.Unmarshal([]byte(data), &chunk)
+		choice := chunk["choices"].([]any)[0].(map[string]any)
+		delta := choice["delta"].(map[string]any)
+		if delta["tool_calls"] != nil {
+			t.Errorf("JSON response streamed as a tool call: %s", data)
+		}
+		if s, ok := delta["content"].(string); ok {
+			content.WriteString(s)
+		}
+		if f, ok := choice["finish_reason"].(string); ok {
+			finish = f
+		}
+	}
+	if content.String() != `{"fruit":["apple"]}` || finish != "stop" {
+		t.Errorf("content = %q, finish_reason = %q", content.String(), finish)
+	}
+}
+
+func TestAnthropicToOpenAI_OutputFormat(t *testing.T) {
+	schema := map[string]any{"type": "object", "properties": map[string]any{"ok": map[string]any{"type": "boolean"}}}
+	body := map[string]any{
+		"model":         "claude-sonnet-4-20250514",
+		"max_tokens":    float64(100),
+		"output_format": map[string]any{"type": "json_schema", "schema": schema},
+		"messages":      []any{map[string]any{"role": "user", "content": "ok?"}},
+	}
+	result := AnthropicToOpenAI(body, "gpt-4o")
+	rf, _ := result["response_format"].(map[string]any)
+	js, _ := rf["json_schema"].(map[string]any)
+	if rf["type"] != "json_schema" || !reflect.DeepEqual(js["schema"], schema) || js["name"] == "" {
+		t.Errorf("response_format = %v", rf)
+	}
+}
@@ -0,0 +1,61 @@
+package convert
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// StopLimits caps the stop sequences a request sends. Zero fields don't
+// limit.
+type StopLimits struct {
+	// MaxCount is how many sequences are kept; the first ones are.
+	MaxCount int
+	// MaxLength is the longest sequence, in characters, that is kept.
+	MaxLength int
+}
+
+// stopSequences returns the sequences of an Anthropic stop_sequences or
+// OpenAI stop value that a provider with caps accepts. Non-string, empty and
+// whitespace-only sequences, which some providers reject, are dropped, then
+// over-long ones, then any past MaxCount. Each kind of drop is reported in
+// warnings.
+func stopSequences(v any, caps StopLimits, warnings *[]string) []any {
+	var values []any
+	switch s := v.(type) {
+	case []any:
+		values = s
+	case string:
+		values = []any{s}
+	case nil:
+		return nil
+	default:
+		values = []any{s}
+	}
+
+	var kept []any
+	blank, long := 0, 0
+	for _, value := range values {
+		seq, ok := value.(string)
+		switch {
+		case !ok || strings.TrimSpace(seq) == "":
+			blank++
+		case caps.MaxLength > 0 && utf8.RuneCountInString(seq) > caps.MaxLength:
+			long++
+		default:
+			kept = append(kept, seq)
+		}
+	}
+
+	if blank > 0 {
+		*warnings = append(*warnings, fmt.Sprintf("dropped %d empty or non-string stop sequence(s)", blank))
+	}
+	if long > 0 {
+		*warnings = append(*warnings, fmt.Sprintf("dropped %d stop sequence(s) longer than %d characters", long, caps.MaxLength))
+	}
+	if caps.MaxCount > 0 && len(kept) > caps.MaxCount {
+		*warnings = append(*warnings, fmt.Sprintf("kept the first %d of %d stop sequences", caps.MaxCount, len(kept)))
+		kept = kept[:caps.MaxCount]
+	}
+	return kept
+}
@@ -0,0 +1,79 @@
+package convert
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestAnthropicToOpenAI_StopSequencesCapped(t *testing.T) {
+	var stops []any
+	for i := range 10 {
+		stops = append(stops, fmt.Sprintf("STOP%d", i))
+	}
+	body := map[string]any{
+		"messages":       []any{map[string]any{"role": "user", "content": "Hi"}},
+		"stop_sequences": stops,
+	}
+
+	openai, warnings, _ := AnthropicToOpenAIWithOptions(body, "gpt-4o", Options{Stop: StopLimits{MaxCount: 4}})
+	if want := []any{"STOP0", "STOP1", "STOP2", "STOP3"}; !slices.Equal(openai["stop"].([]any), want) {
+		t.Errorf("stop = %v, want %v", openai["stop"], want)
+	}
+	if want := []string{"kept the first 4 of 10 stop sequences"}; !slices.Equal(warnings, want) {
+		t.Errorf("warnings = %q, want %q", warnings, want)
+	}
+
+	openai, warnings, _ = AnthropicToOpenAIWithOptions(body, "gpt-4o", Options{})
+	if len(openai["stop"].([]any)) != 10 || len(warnings) != 0 {
+		t.Errorf("uncapped: stop = %v, warnings = %q", openai["stop"], warnings)
+	}
+}
+
+func TestAnthropicToOpenAI_StopSequencesFiltered(t *testing.T) {
+	body := map[string]any{
+		"messages":       []any{map[string]any{"role": "user", "content": "Hi"}},
+		"stop_sequences": []any{"", "  \n", "END", "a much longer stop sequence", 42.0, "###", "\n\nHuman:"},
+	}
+	openai, warnings, _ := AnthropicToOpenAIWithOptions(body, "gpt-4o", Options{Stop: StopLimits{MaxCount: 2, MaxLength: 10}})
+	if want := []any{"END", "###"}; !slices.Equal(openai["stop"].([]any), want) {
+		t.Errorf("stop = %v, want %v", openai["stop"], want)
+	}
+	want := []string{
+		"dropped 3 empty or non-string stop sequence(s)",
+		"dropped 1 stop sequence(s) longer than 10 characters",
+		"kept the first 2 of 3 stop sequences",
+	}
+	if !slices.Equal(warnings, want) {
+		t.Errorf("warnings = %q, want %q", warnings, want)
+	}
+
+	body["stop_sequences"] = []any{" ", ""}
+	openai, _, _ = AnthropicToOpenAIWithOptions(body, "gpt-4o", Options{})
+	if _, ok := openai["stop"]; ok {
+		t.Errorf("stop = %v, want it omitted when every sequence is dropped", openai["stop"])
+	}
+}
+
+func TestOpenAIToAnthropic_StopValidated(t *testing.T) {
+	for _, tc := range []struct {
+		stop     any
+		want     []any
+		warnings int
+	}{
+		{"END", []any{"END"}, 0},
+		{[]any{"END", "", "###"}, []any{"END", "###"}, 1},
+		{"   ", nil, 1},
+		{nil, nil, 0},
+	} {
+		body := map[string]any{
+			"messages": []any{map[string]any{"role": "user", "content": "Hi"}},
+			"stop":     tc.stop,
+		}
+		result, warnings := OpenAIToAnthropicRequestWithWarnings(body)
+		got, _ := result["stop_sequences"].([]any)
+		if !slices.Equal(got, tc.want) || len(warnings) != tc.warnings {
+			t.Errorf("stop %q: stop_sequences = %v, warnings = %q", tc.stop, result["stop_sequences"], warnings)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package convert
+
+// stopReasonField carries an Anthropic stop_reason on an OpenAI choice when
+// its finish_reason alone doesn't say it, such as stop_sequence or
+// pause_turn. OpenAI clients ignore it; a converter reading the response
+// back into Anthropic format restores the reason from it.
+const stopReasonField = "anthropic_stop_reason"
+
+// finishReasons maps Anthropic stop reasons to OpenAI finish reasons.
+// pause_turn (a server tool is still running and the client should send
+// the conversation back to continue) has no OpenAI equivalent: "stop" would
+// end an agent loop, and "tool_calls" promises calls that aren't there, so
+// it maps to a null finish_reason. Reasons missing here map to "stop".
+var finishReasons = map[string]any{
+	"end_turn":                      "stop",
+	"stop_sequence":                 "stop",
+	"max_tokens":                    "length",
+	"model_context_window_exceeded": "length",
+	"tool_use":                      "tool_calls",
+	"refusal":                       "content_filter",
+	"pause_turn":                    nil,
+}
+
+// stopReasons maps OpenAI finish reasons back to Anthropic stop reasons.
+// Reasons missing here map to end_turn.
+var stopReasons = map[string]string{
+	"stop":           "end_turn",
+	"length":         "max_tokens",
+	"tool_calls":     "tool_use",
+	"function_call":  "tool_use",
+	"content_filter": "refusal",
+}
+
+// setFinishReason sets the finish_reason of an OpenAI choice for an
+// Anthropic stop_reason, with the stop reason itself in stopReasonField
+// when the finish_reason wouldn't map back to it. A tool_use stop with no
+// tool calls left (only the JSON response tool was called) is a plain stop,
+// as is a missing stop_reason.
+func setFinishReason(choice map[string]any, stopReason string, toolCalls bool) {
+	if stopReason == "" || stopReason == "tool_use" && !toolCalls {
+		stopReason = "end_turn"
+	}
+	finish, ok := finishReasons[stopReason]
+	if !ok {
+		finish = "stop"
+	}
+	choice["finish_reason"] = finish
+	if fr, _ := finish.(string); stopReasons[fr] != stopReason {
+		choice[stopReasonField] = stopReason
+	}
+}
+
+// stopReasonFor returns the Anthropic stop_reason for an OpenAI choice: the
+// one carried in stopReasonField, or the finish_reason mapped back. A
+// finish_reason that is already an Anthropic stop reason, as some gateways
+// in front of Anthropic send, is kept as it is.
+func stopReasonFor(choice map[string]any) string {
+	if reason := getStr(choice, stopReasonField); reason != "" {
+		return reason
+	}
+	finish := getStr(choice, "finish_reason")
+	if reason, ok := stopReasons[finish]; ok {
+		return reason
+	}
+	if _, ok := finishReasons[finish]; ok {
+		return finish
+	}
+	return "end_turn"
+}
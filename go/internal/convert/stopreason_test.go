@@ -0,0 +1,156 @@
+package convert
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// sseData returns the JSON payloads of a converted stream's data lines.
+func sseData(t *testing.T, stream io.ReadCloser) []map[string]any {
+	t.Helper()
+	out, _ := io.ReadAll(stream)
+	stream.Close()
+	var events []map[string]any
+	for _, line := range strings.Split(string(out), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var event map[string]any
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("invalid JSON in SSE: %s", data)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// Each Anthropic stop reason converts to the same finish_reason, and the
+// same anthropic_stop_reason, in responses and streams, and comes back as
+// itself going the other way.
+func TestStopReasons(t *testing.T) {
+	cases := []struct {
+		stopReason string
+		finish     any // nil for a null finish_reason
+		field      string
+	}{
+		{"end_turn", "stop", ""},
+		{"stop_sequence", "stop", "stop_sequence"},
+		{"max_tokens", "length", ""},
+		{"model_context_window_exceeded", "length", "model_context_window_exceeded"},
+		{"tool_use", "tool_calls", ""},
+		{"refusal", "content_filter", ""},
+		{"pause_turn", nil, "pause_turn"},
+		{"some_future_reason", "stop", "some_future_reason"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.stopReason, func(t *testing.T) {
+			check := func(site string, choice map[string]any) {
+				t.Helper()
+				if finish, ok := choice["finish_reason"]; !ok || finish != tc.finish {
+					t.Errorf("%s: finish_reason = %v (set: %v), want %v", site, finish, ok, tc.finish)
+				}
+				if got := getStr(choice, stopReasonField); got != tc.field {
+					t.Errorf("%s: %s = %q, want %q", site, stopReasonField, got, tc.field)
+				}
+			}
+
+			content := []any{map[string]any{"type": "text", "text": "Hi"}}
+			toolBlock := ""
+			if tc.stopReason == "tool_use" {
+				content = append(content, map[string]any{"type": "tool_use", "id": "toolu_1", "name": "lookup", "input": map[string]any{}})
+				toolBlock = "event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":1,\"content_block\":{\"type\":\"tool_use\",\"id\":\"toolu_1\",\"name\":\"lookup\",\"input\":{}}}\n\n" +
+					"event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":1}\n\n"
+			}
+			resp := AnthropicToOpenAIResponse(map[string]any{
+				"id": "msg_1", "type": "message", "role": "assistant", "content": content,
+				"stop_reason": tc.stopReason, "usage": map[string]any{"input_tokens": float64(1), "output_tokens": float64(1)},
+			}, "gpt-4o")
+			choice := resp["choices"].([]any)[0].(map[string]any)
+			check("response", choice)
+
+			sse := "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"type\":\"message\",\"role\":\"assistant\",\"content\":[],\"model\":\"claude-sonnet-4-20250514\",\"usage\":{\"input_tokens\":1,\"output_tokens\":0}}}\n\n" +
+				"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"text\",\"text\":\"\"}}\n\n" +
+				"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Hi\"}}\n\n" +
+				"event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":0}\n\n" + toolBlock +
+				fmt.Sprintf("event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":%q},\"usage\":{\"output_tokens\":1}}\n\n", tc.stopReason) +
+				"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n"
+			var final map[string]any
+			for _, chunk := range sseData(t, ConvertAnthropicSSEToOpenAI(strings.NewReader(sse), "gpt-4o")) {
+				choices, _ := chunk["choices"].([]any)
+				if len(choices) == 0 {
+					continue
+				}
+				c := choices[0].(map[string]any)
+				if c["finish_reason"] != nil || getStr(c, stopReasonField) != "" {
+					if final != nil {
+						t.Fatalf("stream: more than one final chunk")
+					}
+					final = c
+				}
+			}
+			if final == nil {
+				t.Fatal("stream: no chunk ends the message")
+			}
+			check("stream", final)
+
+			// Back to Anthropic format, from the converted response and a
+			// stream chunk ending the same way
+			back := OpenAIToAnthropic(resp, "claude-sonnet-4-20250514", nil)
+			if back["stop_reason"] != tc.stopReason {
+				t.Errorf("reverse response: stop_reason = %v, want %s", back["stop_reason"], tc.stopReason)
+			}
+			end := map[string]any{"index": 0, "delta": map[string]any{"content": "Hi"}, "finish_reason": choice["finish_reason"]}
+			if tc.field != "" {
+				end[stopReasonField] = tc.field
+			}
+			chunk, _ := json.Marshal(map[string]any{"id": "chatcmpl-1", "object": "chat.completion.chunk", "model": "gpt-4o", "choices": []any{end}})
+			if got := streamedStopReason(t, string(chunk)); got != tc.stopReason {
+				t.Errorf("reverse stream: stop_reason = %q, want %s", got, tc.stopReason)
+			}
+		})
+	}
+}
+
+// streamedStopReason converts an OpenAI stream of one chunk and returns
+// the stop_reason of its message_delta.
+func streamedStopReason(t *testing.T, chunk string) string {
+	t.Helper()
+	sse := "data: " + chunk + "\n\ndata: [DONE]\n\n"
+	for _, event := range sseData(t, ConvertSSEStream(strings.NewReader(sse), "claude-sonnet-4-20250514", nil)) {
+		if event["type"] == "message_delta" {
+			return getStr(toMap(event["delta"]), "stop_reason")
+		}
+	}
+	t.Fatal("no message_delta")
+	return ""
+}
+
+// Finish reasons from OpenAI-compatible providers map to Anthropic stop
+// reasons. Gateways in front of Anthropic that pass its stop reasons
+// through keep them.
+func TestStopReasonFor(t *testing.T) {
+	cases := map[string]string{
+		"stop":           "end_turn",
+		"length":         "max_tokens",
+		"tool_calls":     "tool_use",
+		"function_call":  "tool_use",
+		"content_filter": "refusal",
+		"pause_turn":     "pause_turn",
+		"refusal":        "refusal",
+		"eos":            "end_turn",
+		"":               "end_turn",
+	}
+	for finish, want := range cases {
+		if got := stopReasonFor(map[string]any{"finish_reason": finish}); got != want {
+			t.Errorf("finish_reason %q: stop_reason = %q, want %q", finish, got, want)
+		}
+		chunk := fmt.Sprintf(`{"id":"chatcmpl-1","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"content":"Hi"},"finish_reason":%q}]}`, finish)
+		if got := streamedStopReason(t, chunk); got != want {
+			t.Errorf("streamed finish_reason %q: stop_reason = %q, want %q", finish, got, want)
+		}
+	}
+}
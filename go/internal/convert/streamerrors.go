@@ -0,0 +1,59 @@
+package convert
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Providers that fail mid-stream send an error payload instead of the rest
+// of the stream: OpenAI-compatible ones a data line with an "error" field,
+// Anthropic an error event. Both converters end the converted stream with
+// the client format's equivalent, so the client sees the error instead of
+// waiting for a message_stop or [DONE] that never comes.
+
+// openAIStreamError returns the Anthropic error object for an OpenAI stream
+// chunk that carries an error, or nil.
+func openAIStreamError(chunk map[string]any) map[string]any {
+	var message, kind string
+	switch e := chunk["error"].(type) {
+	case string:
+		message = e
+	case map[string]any:
+		message = getStr(e, "message")
+		kind = strings.ToLower(fmt.Sprint(e["type"], " ", e["code"]))
+	default:
+		return nil
+	}
+	if message == "" {
+		message = "Provider stream failed"
+	}
+	errType := "api_error"
+	if strings.Contains(kind, "overload") || strings.Contains(kind, "503") || strings.Contains(kind, "529") ||
+		strings.Contains(strings.ToLower(message), "overloaded") {
+		errType = "overloaded_error"
+	}
+	return map[string]any{"type": errType, "message": message}
+}
+
+// anthropicStreamError returns the OpenAI error chunk for an Anthropic error
+// event. The Anthropic error type is kept as the code.
+func anthropicStreamError(event map[string]any) map[string]any {
+	e := toMap(event["error"])
+	anthropicType := getStr(e, "type")
+	errType := "server_error"
+	switch anthropicType {
+	case "authentication_error", "rate_limit_error", "invalid_request_error":
+		errType = anthropicType
+	}
+	message := getStr(e, "message")
+	if message == "" {
+		message = "Provider stream failed"
+	}
+	code := any(nil)
+	if anthropicType != "" {
+		code = anthropicType
+	}
+	return map[string]any{
+		"error": map[string]any{"message": message, "type": errType, "param": nil, "code": code},
+	}
+}
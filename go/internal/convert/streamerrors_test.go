@@ -0,0 +1,82 @@
+package convert
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// convertMidStreamError feeds a stream that fails after its first chunk to
+// convert, without ever closing it, and returns the converted stream.
+func convertMidStreamError(t *testing.T, convert func(io.Reader) io.ReadCloser, chunks string) string {
+	t.Helper()
+	src, upstream := io.Pipe()
+	defer upstream.Close()
+	stream := convert(src)
+	defer stream.Close()
+	go io.WriteString(upstream, chunks)
+
+	out := make(chan string, 1)
+	go func() {
+		b, _ := io.ReadAll(stream)
+		out <- string(b)
+	}()
+	select {
+	case got := <-out:
+		return got
+	case <-time.After(2 * time.Second):
+		t.Fatal("converted stream didn't end after the provider's error")
+		return ""
+	}
+}
+
+func TestConvertSSEStream_MidStreamError(t *testing.T) {
+	cases := []struct {
+		name, chunk, want string
+	}{
+		{"overloaded", `{"error":{"message":"The server is overloaded","type":"server_error","code":503}}`,
+			`{"error":{"message":"The server is overloaded","type":"overloaded_error"},"type":"error"}`},
+		{"other", `{"error":{"message":"Upstream connection reset","type":"server_error","code":null}}`,
+			`{"error":{"message":"Upstream connection reset","type":"api_error"},"type":"error"}`},
+		{"string", `{"error":"timeout"}`,
+			`{"error":{"message":"timeout","type":"api_error"},"type":"error"}`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := convertMidStreamError(t, func(r io.Reader) io.ReadCloser {
+				return ConvertSSEStreamWithPing(r, "claude-sonnet-4-6", nil, 0)
+			}, `data: {"id":"c1","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"hi"}}]}`+"\n\ndata: "+tc.chunk+"\n\n")
+
+			if !strings.Contains(got, "text_delta") {
+				t.Errorf("text before the error is missing:\n%s", got)
+			}
+			if want := "event: error\ndata: " + tc.want + "\n\n"; !strings.HasSuffix(got, want) {
+				t.Errorf("stream doesn't end with %q:\n%s", want, got)
+			}
+			if strings.Contains(got, "message_stop") {
+				t.Errorf("failed stream reports message_stop:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestConvertAnthropicSSEToOpenAI_MidStreamError(t *testing.T) {
+	got := convertMidStreamError(t, func(r io.Reader) io.ReadCloser {
+		return ConvertAnthropicSSEToOpenAI(r, "claude-sonnet-4-6")
+	}, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"usage\":{\"input_tokens\":3}}}\n\n"+
+		"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"text\",\"text\":\"\"}}\n\n"+
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"hi\"}}\n\n"+
+		"event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\n")
+
+	if !strings.Contains(got, `"content":"hi"`) {
+		t.Errorf("text before the error is missing:\n%s", got)
+	}
+	want := `data: {"error":{"code":"overloaded_error","message":"Overloaded","param":null,"type":"server_error"}}` + "\n\ndata: [DONE]\n\n"
+	if !strings.HasSuffix(got, want) {
+		t.Errorf("stream doesn't end with %q:\n%s", want, got)
+	}
+	if strings.Contains(got, "finish_reason\":\"stop") {
+		t.Errorf("failed stream reports a finish_reason:\n%s", got)
+	}
+}
@@ -0,0 +1,36 @@
+package convert
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// OpenAI tool messages have no error flag, so an Anthropic tool_result with
+// is_error travels as content starting with this marker, and the flag is
+// set again when converting the other way.
+const toolErrorMarker = "[tool error] "
+
+// markToolError prefixes the content of a failed tool result for OpenAI.
+func markToolError(content string) string {
+	return toolErrorMarker + content
+}
+
+// toolResultError reports whether an OpenAI tool message's content signals
+// a failed call: it carries the marker, or is a JSON object with an "error"
+// key. The marker is removed from the returned content.
+func toolResultError(content any) (any, bool) {
+	s, ok := content.(string)
+	if !ok {
+		return content, false
+	}
+	if rest, found := strings.CutPrefix(s, toolErrorMarker); found {
+		return rest, true
+	}
+	var obj map[string]any
+	if err := json.Unmarshal([]byte(s), &obj); err == nil {
+		if _, ok := obj["error"]; ok {
+			return s, true
+		}
+	}
+	return s, false
+}
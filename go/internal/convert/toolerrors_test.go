@@ -0,0 +1,80 @@
+package convert
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestToolResultErrorRoundTrip(t *testing.T) {
+	for _, isError := range []bool{true, false} {
+		result := map[string]any{"type": "tool_result", "tool_use_id": "toolu_1", "content": "exit status 1"}
+		if isError {
+			result["is_error"] = true
+		}
+		body := map[string]any{
+			"model":      "claude-sonnet-4-6",
+			"max_tokens": float64(100),
+			"messages": []any{
+				map[string]any{"role": "assistant", "content": []any{
+					map[string]any{"type": "tool_use", "id": "toolu_1", "name": "bash", "input": map[string]any{"cmd": "make"}},
+				}},
+				map[string]any{"role": "user", "content": []any{result}},
+			},
+		}
+
+		openAI := AnthropicToOpenAI(body, "gpt-4o")
+		tool := openAI["messages"].([]any)[1].(map[string]any)
+		want := "exit status 1"
+		if isError {
+			want = "[tool error] exit status 1"
+		}
+		if tool["content"] != want {
+			t.Errorf("is_error=%v: tool content = %q, want %q", isError, tool["content"], want)
+		}
+
+		back := OpenAIToAnthropicRequest(openAI)
+		got := back["messages"].([]any)[1].(map[string]any)["content"].([]any)[0]
+		if !reflect.DeepEqual(got, result) {
+			t.Errorf("is_error=%v: round trip = %v, want %v", isError, got, result)
+		}
+	}
+}
+
+func TestOpenAIToolErrorPayload(t *testing.T) {
+	cases := []struct {
+		content any
+		isError bool
+	}{
+		{`{"error":"file not found"}`, true},
+		{`{"error":{"code":404}}`, true},
+		{`{"result":"ok","errors":[]}`, false},
+		{`["error"]`, false},
+		{"error: not JSON", false},
+		{[]any{map[string]any{"type": "text", "text": "[tool error] in a part"}}, false},
+	}
+	for _, tc := range cases {
+		body := map[string]any{
+			"model": "gpt-4o",
+			"messages": []any{
+				map[string]any{"role": "assistant", "tool_calls": []any{map[string]any{
+					"id": "call_1", "type": "function", "function": map[string]any{"name": "read", "arguments": "{}"},
+				}}},
+				map[string]any{"role": "tool", "tool_call_id": "call_1", "content": tc.content},
+			},
+		}
+		anthropic := OpenAIToAnthropicRequest(body)
+		result := anthropic["messages"].([]any)[1].(map[string]any)["content"].([]any)[0].(map[string]any)
+		if isErr, _ := result["is_error"].(bool); isErr != tc.isError {
+			t.Errorf("content %v: is_error = %v, want %v", tc.content, isErr, tc.isError)
+		}
+		if !reflect.DeepEqual(result["content"], tc.content) {
+			t.Errorf("content %v changed to %v", tc.content, result["content"])
+		}
+
+		// Converted back, the flag becomes the marker
+		openAI := AnthropicToOpenAI(anthropic, "gpt-4o")
+		if got := openAI["messages"].([]any)[1].(map[string]any)["content"]; tc.isError && got != "[tool error] "+tc.content.(string) {
+			t.Errorf("content %v back in OpenAI format = %v", tc.content, got)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package convert
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+)
+
+// OpenAI function names must match this; Anthropic clients can send names
+// that don't (dots, colons, or longer than 64 characters).
+var openaiToolNameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+var invalidToolNameCharRe = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// ToolNames maps tool names rewritten for an OpenAI target back to the names
+// the client declared.
+type ToolNames map[string]string
+
+// Original returns the client's name for a tool name seen upstream.
+func (n ToolNames) Original(name string) string {
+	if orig, ok := n[name]; ok {
+		return orig
+	}
+	return name
+}
+
+// sanitize returns name as OpenAI accepts it and records the rewrite. Names
+// that need changes get invalid characters replaced by underscores, are
+// truncated, and end in a hash of the original, so different names never
+// collide and the same name always maps the same way.
+func (n ToolNames) sanitize(name string) string {
+	if name == "" || openaiToolNameRe.MatchString(name) {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	suffix := "_" + hex.EncodeToString(sum[:])[:8]
+	safe := invalidToolNameCharRe.ReplaceAllString(name, "_")
+	if max := 64 - len(suffix); len(safe) > max {
+		safe = safe[:max]
+	}
+	safe += suffix
+	n[safe] = name
+	return safe
+}
+
+// MissingForcedTool returns the name a request's tool_choice forces when no
+// tool of that name is declared in tools, or "" otherwise. format is the
+// request's format, "anthropic" or "openai".
+func MissingForcedTool(body map[string]any, format string) string {
+	forced := forcedToolName(body, format)
+	if forced == "" {
+		return ""
+	}
+	tools, _ := getSlice(body, "tools")
+	for _, rawTool := range tools {
+		tool := toMap(rawTool)
+		name := getStr(tool, "name")
+		if format == "openai" {
+			if fn := toMap(tool["function"]); getStr(fn, "name") != "" {
+				name = getStr(fn, "name")
+			}
+		}
+		if name == forced {
+			return ""
+		}
+	}
+	return forced
+}
+
+func forcedToolName(body map[string]any, format string) string {
+	tc, _ := getMap(body, "tool_choice")
+	if format == "openai" {
+		return getStr(toMap(tc["function"]), "name")
+	}
+	if getStr(tc, "type") != "tool" {
+		return ""
+	}
+	return getStr(tc, "name")
+}
+
+// missingToolWarning is the conversion warning for a tool_choice downgraded
+// to auto.
+func missingToolWarning(name string) string {
+	return fmt.Sprintf("tool_choice named undeclared tool %q; sent as auto", name)
+}
+
+// stableToolCallID names a tool call a client sent without an ID by its
+// position and function, so a conversation converts to the same bytes on
+// every turn and provider prompt caches keep matching.
+func stableToolCallID(message, call int, fn map[string]any) string {
+	sum := sha256.Sum256(fmt.Appendf(nil, "%d/%d/%s", message, call, toJSONString(fn)))
+	return "toolu_" + hex.EncodeToString(sum[:])[:24]
+}
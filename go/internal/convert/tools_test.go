@@ -0,0 +1,190 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAnthropicToOpenAI_UndeclaredForcedTool(t *testing.T) {
+	body := map[string]any{
+		"messages":    []any{map[string]any{"role": "user", "content": "hi"}},
+		"tools":       []any{map[string]any{"name": "search", "input_schema": map[string]any{}}},
+		"tool_choice": map[string]any{"type": "tool", "name": "fetch"},
+	}
+	result, warnings, _ := AnthropicToOpenAIWithWarnings(body, "gpt-4o")
+	if result["tool_choice"] != "auto" {
+		t.Errorf("tool_choice = %v, want auto", result["tool_choice"])
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], `"fetch"`) {
+		t.Errorf("warnings = %v", warnings)
+	}
+
+	body["tool_choice"] = map[string]any{"type": "tool", "name": "search"}
+	result, warnings, _ = AnthropicToOpenAIWithWarnings(body, "gpt-4o")
+	if fn := toMap(toMap(result["tool_choice"])["function"]); fn["name"] != "search" || warnings != nil {
+		t.Errorf("declared tool: tool_choice = %v, warnings = %v", result["tool_choice"], warnings)
+	}
+}
+
+func TestOpenAIToAnthropicRequest_UndeclaredForcedTool(t *testing.T) {
+	body := map[string]any{
+		"messages":    []any{map[string]any{"role": "user", "content": "hi"}},
+		"tools":       []any{map[string]any{"type": "function", "function": map[string]any{"name": "search"}}},
+		"tool_choice": map[string]any{"type": "function", "function": map[string]any{"name": "fetch"}},
+	}
+	result, warnings := OpenAIToAnthropicRequestWithWarnings(body)
+	if tc := toMap(result["tool_choice"]); tc["type"] != "auto" {
+		t.Errorf("tool_choice = %v, want auto", result["tool_choice"])
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], `"fetch"`) {
+		t.Errorf("warnings = %v", warnings)
+	}
+}
+
+func TestMissingForcedTool(t *testing.T) {
+	cases := []struct {
+		format, body, want string
+	}{
+		{"anthropic", `{"tools":[{"name":"a"}],"tool_choice":{"type":"tool","name":"b"}}`, "b"},
+		{"anthropic", `{"tools":[{"name":"a"}],"tool_choice":{"type":"tool","name":"a"}}`, ""},
+		{"anthropic", `{"tool_choice":{"type":"any"}}`, ""},
+		{"openai", `{"tools":[{"type":"function","function":{"name":"a"}}],"tool_choice":{"type":"function","function":{"name":"b"}}}`, "b"},
+		{"openai", `{"tools":[{"type":"function","function":{"name":"a"}}],"tool_choice":"required"}`, ""},
+		{"openai", `{"tool_choice":{"type":"function","function":{"name":"a"}}}`, "a"},
+	}
+	for _, c := range cases {
+		var body map[string]any
+		json.Unmarshal([]byte(c.body), &body)
+		if got := MissingForcedTool(body, c.format); got != c.want {
+			t.Errorf("MissingForcedTool(%s, %s) = %q, want %q", c.body, c.format, got, c.want)
+		}
+	}
+}
+
+func TestToolNames_SanitizeRoundTrip(t *testing.T) {
+	long := strings.Repeat("very_long_tool_name_", 5)
+	dotted := "github.create_issue"
+	body := map[string]any{
+		"messages": []any{
+			map[string]any{"role": "user", "content": "file it"},
+			map[string]any{"role": "assistant", "content": []any{
+				map[string]any{"type": "tool_use", "id": "toolu_1", "name": dotted, "input": map[string]any{}},
+			}},
+			map[string]any{"role": "user", "content": []any{
+				map[string]any{"type": "tool_result", "tool_use_id": "toolu_1", "content": "done"},
+			}},
+		},
+		"tools": []any{
+			map[string]any{"name": dotted},
+			map[string]any{"name": long},
+			map[string]any{"name": "github_create_issue"},
+		},
+		"tool_choice": map[string]any{"type": "tool", "name": dotted},
+	}
+	result, warnings, names := AnthropicToOpenAIWithWarnings(body, "gpt-4o")
+	if warnings != nil || len(names) != 2 {
+		t.Fatalf("warnings = %v, names = %v", warnings, names)
+	}
+
+	var sent []string
+	for _, tool := range result["tools"].([]any) {
+		name := getStr(toMap(toMap(tool)["function"]), "name")
+		if !openaiToolNameRe.MatchString(name) {
+			t.Errorf("tool name %q breaks OpenAI's rules", name)
+		}
+		sent = append(sent, name)
+	}
+	if sent[0] == sent[2] || sent[2] != "github_create_issue" || len(sent[1]) != 64 {
+		t.Errorf("sanitized names = %v", sent)
+	}
+	if names.Original(sent[0]) != dotted || names.Original(sent[1]) != long {
+		t.Errorf("names = %v", names)
+	}
+	history := toMap(result["messages"].([]any)[1])["tool_calls"].([]any)
+	if got := getStr(toMap(toMap(history[0])["function"]), "name"); got != sent[0] {
+		t.Errorf("history tool call = %q, want %q", got, sent[0])
+	}
+	if got := getStr(toMap(toMap(result["tool_choice"])["function"]), "name"); got != sent[0] {
+		t.Errorf("tool_choice = %q, want %q", got, sent[0])
+	}
+	if again, _, _ := AnthropicToOpenAIWithWarnings(body, "gpt-4o"); toJSONString(again["tools"]) != toJSONString(result["tools"]) {
+		t.Error("sanitized names are not deterministic")
+	}
+
+	// Responses name the client's tool again
+	resp := map[string]any{"choices": []any{map[string]any{
+		"message": map[string]any{"tool_calls": []any{map[string]any{
+			"id": "call_1", "function": map[string]any{"name": sent[0], "arguments": "{}"},
+		}}},
+		"finish_reason": "tool_calls",
+	}}}
+	block := toMap(OpenAIToAnthropic(resp, "claude", names)["content"].([]any)[0])
+	if block["name"] != dotted {
+		t.Errorf("response tool name = %v, want %q", block["name"], dotted)
+	}
+
+	chunk := `data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","function":{"name":"` + sent[1] + `","arguments":"{}"}}]}}]}` + "\n\ndata: [DONE]\n\n"
+	out, _ := io.ReadAll(ConvertSSEStream(strings.NewReader(chunk), "claude", names))
+	if !strings.Contains(string(out), `"name":"`+long+`"`) || strings.Contains(string(out), sent[1]) {
+		t.Errorf("stream tool name not restored: %s", out)
+	}
+}
+
+// Prompt caches need byte-identical prefixes across turns, so converting the
+// same body again must produce the same bytes on every path.
+func TestConversionIsByteStable(t *testing.T) {
+	pinIDs(t)
+	missingIDs := []byte(`{"model":"gpt-4o","messages":[
+		{"role":"user","content":"list files"},
+		{"role":"assistant","content":null,"tool_calls":[
+			{"type":"function","function":{"name":"ls","arguments":"{\"path\":\".\",\"all\":true}"}},
+			{"type":"function","function":{"name":"ls","arguments":"{\"path\":\"..\"}"}}]}],
+		"tools":[{"type":"function","function":{"name":"ls","parameters":{"type":"object","properties":{"path":{"type":"string"},"all":{"type":"boolean"}}}}}]}`)
+	paths := []struct {
+		name, fixture string
+		in            []byte
+		convert       func(map[string]any) any
+	}{
+		{"anthropic request", "claude_code_turn.json", nil, func(b map[string]any) any { return AnthropicToOpenAI(b, "gpt-4.1") }},
+		{"openai request", "openai_tools_request.json", nil, func(b map[string]any) any { return OpenAIToAnthropicRequest(b) }},
+		{"openai request without tool call IDs", "", missingIDs, func(b map[string]any) any { return OpenAIToAnthropicRequest(b) }},
+		{"openai response", "openai_tool_response.json", nil, func(b map[string]any) any {
+			return OpenAIToAnthropic(b, "claude-sonnet-4-20250514", nil)
+		}},
+		{"anthropic response", "anthropic_thinking_response.json", nil, func(b map[string]any) any {
+			return AnthropicToOpenAIResponse(b, "claude-sonnet-4")
+		}},
+	}
+	for _, p := range paths {
+		in := p.in
+		if p.fixture != "" {
+			var err error
+			if in, err = os.ReadFile(filepath.Join("testdata", p.fixture)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var first []byte
+		for i := 0; i < 20; i++ {
+			out, err := json.Marshal(p.convert(decodeFixture(t, in)))
+			if err != nil {
+				t.Fatalf("%s: %v", p.name, err)
+			}
+			if first == nil {
+				first = out
+			} else if !bytes.Equal(out, first) {
+				t.Fatalf("%s: conversion %d differs\n%s", p.name, i, firstDiff(first, out))
+			}
+		}
+	}
+
+	blocks := OpenAIToAnthropicRequest(decodeFixture(t, missingIDs))["messages"].([]any)[1].(map[string]any)["content"].([]any)
+	first, second := getStr(toMap(blocks[0]), "id"), getStr(toMap(blocks[1]), "id")
+	if first == second || !strings.HasPrefix(first, "toolu_") {
+		t.Errorf("generated tool call IDs = %q, %q", first, second)
+	}
+}
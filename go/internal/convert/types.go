@@ -0,0 +1,318 @@
+package convert
+
+import "encoding/json"
+
+// The types below are the parts of Anthropic and OpenAI requests the
+// converters read. Clients send loosely typed JSON: content that is a
+// string or a list, tool arguments that are a string or an object, fields
+// of the wrong type. Each type is built from the decoded value with the
+// same tolerance as the map helpers, so a field of an unexpected type reads
+// as its zero value instead of failing the request.
+//
+// Values the converters copy without reading stay decoded JSON: sampling
+// parameters, read from Body; content that is neither a string nor a list
+// (Content.Value); and blocks passed on whole (ContentBlock.Raw).
+
+// AnthropicRequest is a Messages API request.
+type AnthropicRequest struct {
+	Model string
+	// System is the system prompt, a string or a list of text blocks; nil
+	// when the request has none
+	System     *Content
+	Messages   []Message
+	Tools      []Tool
+	ToolChoice *ToolChoice
+	Stream     bool
+	// UserID is metadata.user_id
+	UserID string
+
+	// Body is the request as decoded, for the parameters copied as sent
+	Body map[string]any
+}
+
+// OpenAIRequest is a Chat Completions request.
+type OpenAIRequest struct {
+	Model      string
+	Messages   []Message
+	Tools      []Tool
+	ToolChoice *ToolChoice
+	User       string
+	Metadata   map[string]any
+	// Store asks OpenAI to keep the completion
+	Store bool
+	// Prediction is set when the request has a predicted output, which
+	// OpenAI uses to speed up responses that mostly repeat it
+	Prediction bool
+
+	// Body is the request as decoded, for the parameters copied as sent
+	Body map[string]any
+}
+
+// Message is a chat message in either format.
+type Message struct {
+	Role    string
+	Content Content
+	// Name is an OpenAI message's speaker name
+	Name string
+	// ToolCalls are an OpenAI assistant message's tool calls
+	ToolCalls []ToolCall
+	// ToolCallID is the call an OpenAI tool message answers
+	ToolCallID string
+}
+
+// Content is a message's content: a string, a list of blocks (Anthropic)
+// or parts (OpenAI), or whatever else a client sent.
+type Content struct {
+	// Value is the content as decoded: a string, []any, nil, or another
+	// JSON value, which is passed on as it is
+	Value any
+	// Blocks are the elements of a list
+	Blocks []ContentBlock
+}
+
+// ContentBlock is an Anthropic content block or an OpenAI content part. A
+// bare string in a list reads as a block with only Text set.
+type ContentBlock struct {
+	Type string
+	Text string
+
+	// ID, Name and Input are a tool_use block's; Input is nil unless it
+	// is an object
+	ID, Name string
+	Input    map[string]any
+
+	// ToolUseID, Content and IsError are a tool_result block's
+	ToolUseID string
+	Content   Content
+	IsError   bool
+
+	// Source is an image block's
+	Source ImageSource
+	// Thinking is a thinking block's reasoning
+	Thinking string
+	// CacheControl is set when the block has a cache_control marker
+	CacheControl bool
+	// ImageURL is an OpenAI image_url part's URL
+	ImageURL string
+
+	// Raw is the block as decoded, for blocks passed on whole
+	Raw any
+}
+
+// ImageSource is where an Anthropic image block's data is: inline base64
+// data of MediaType, or a URL.
+type ImageSource struct {
+	Type, MediaType, Data, URL string
+}
+
+// ToolCall is a tool call on an OpenAI assistant message.
+type ToolCall struct {
+	ID string
+	// Name is the function name some clients send outside function
+	Name     string
+	Function FunctionCall
+}
+
+// FunctionCall is a tool call's function. Arguments is the JSON string
+// clients normally send; some send the arguments object itself, which is
+// encoded to one.
+type FunctionCall struct {
+	Name      string
+	Arguments string
+
+	// raw is function as decoded, which stable IDs are derived from
+	raw map[string]any
+}
+
+// Tool is a tool definition. Anthropic puts its fields at the top level;
+// OpenAI nests them under function, though some clients send them flat.
+type Tool struct {
+	Name, Description string
+	// Schema is Anthropic's input_schema or OpenAI's parameters, nil
+	// unless it is an object
+	Schema map[string]any
+}
+
+// ToolChoice is a request's tool_choice. Mode is the format's own word:
+// Anthropic's auto, any, none or tool, or OpenAI's auto, required or none,
+// with "function" for a forced OpenAI tool. Name is the forced tool.
+type ToolChoice struct {
+	Mode, Name string
+}
+
+// Text returns content sent as a string.
+func (c Content) Text() (string, bool) {
+	s, ok := c.Value.(string)
+	return s, ok
+}
+
+// IsList reports whether content was sent as a list.
+func (c Content) IsList() bool {
+	_, ok := c.Value.([]any)
+	return ok
+}
+
+// fields returns the block's fields, or an empty map for a bare value.
+func (b ContentBlock) fields() map[string]any {
+	return toMap(b.Raw)
+}
+
+func anthropicRequestFrom(body map[string]any) AnthropicRequest {
+	r := AnthropicRequest{Model: getStr(body, "model"), Body: body}
+	if sys, ok := body["system"]; ok {
+		c := contentFrom(sys)
+		r.System = &c
+	}
+	r.Messages = messagesFrom(body)
+	for _, t := range toSlice(body["tools"]) {
+		tool := toMap(t)
+		schema, _ := getMap(tool, "input_schema")
+		r.Tools = append(r.Tools, Tool{
+			Name:        getStr(tool, "name"),
+			Description: getStr(tool, "description"),
+			Schema:      schema,
+		})
+	}
+	if tc, ok := getMap(body, "tool_choice"); ok {
+		r.ToolChoice = &ToolChoice{Mode: getStr(tc, "type"), Name: getStr(tc, "name")}
+	}
+	r.Stream, _ = getBool(body, "stream")
+	md, _ := getMap(body, "metadata")
+	r.UserID = getStr(md, "user_id")
+	return r
+}
+
+func openAIRequestFrom(body map[string]any) OpenAIRequest {
+	r := OpenAIRequest{Model: getStr(body, "model"), User: getStr(body, "user"), Prediction: body["prediction"] != nil, Body: body}
+	r.Metadata, _ = getMap(body, "metadata")
+	r.Store, _ = getBool(body, "store")
+	r.Messages = messagesFrom(body)
+	for _, t := range toSlice(body["tools"]) {
+		tool := toMap(t)
+		fn := toMap(tool["function"])
+		def := Tool{Name: getStr(fn, "name"), Description: getStr(fn, "description")}
+		def.Schema, _ = getMap(fn, "parameters")
+		if def.Name == "" {
+			def.Name = getStr(tool, "name")
+		}
+		if def.Description == "" {
+			def.Description = getStr(tool, "description")
+		}
+		if def.Schema == nil {
+			def.Schema, _ = getMap(tool, "parameters")
+		}
+		r.Tools = append(r.Tools, def)
+	}
+	switch tc := body["tool_choice"].(type) {
+	case string:
+		r.ToolChoice = &ToolChoice{Mode: tc}
+	case map[string]any:
+		r.ToolChoice = &ToolChoice{Mode: "function", Name: getStr(toMap(tc["function"]), "name")}
+	}
+	return r
+}
+
+func messagesFrom(body map[string]any) []Message {
+	var messages []Message
+	for _, m := range toSlice(body["messages"]) {
+		msg := toMap(m)
+		converted := Message{
+			Role:       getStr(msg, "role"),
+			Content:    contentFrom(msg["content"]),
+			Name:       getStr(msg, "name"),
+			ToolCallID: getStr(msg, "tool_call_id"),
+		}
+		for _, c := range toSlice(msg["tool_calls"]) {
+			tc := toMap(c)
+			fn := toMap(tc["function"])
+			converted.ToolCalls = append(converted.ToolCalls, ToolCall{
+				ID:       getStr(tc, "id"),
+				Name:     getStr(tc, "name"),
+				Function: FunctionCall{Name: getStr(fn, "name"), Arguments: argumentsFrom(fn["arguments"]), raw: fn},
+			})
+		}
+		messages = append(messages, converted)
+	}
+	return messages
+}
+
+// argumentsFrom reads a tool call's arguments, encoding any value other
+// than a string.
+func argumentsFrom(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return toJSONString(v)
+	}
+}
+
+func contentFrom(v any) Content {
+	c := Content{Value: v}
+	for _, b := range toSlice(v) {
+		c.Blocks = append(c.Blocks, contentBlockFrom(b))
+	}
+	return c
+}
+
+func contentBlockFrom(v any) ContentBlock {
+	if s, ok := v.(string); ok {
+		return ContentBlock{Text: s, Raw: v}
+	}
+	block := toMap(v)
+	source := toMap(block["source"])
+	isError, _ := getBool(block, "is_error")
+	input, _ := getMap(block, "input")
+	return ContentBlock{
+		Type:      getStr(block, "type"),
+		Text:      getStr(block, "text"),
+		ID:        getStr(block, "id"),
+		Name:      getStr(block, "name"),
+		Input:     input,
+		ToolUseID: getStr(block, "tool_use_id"),
+		Content:   contentFrom(block["content"]),
+		IsError:   isError,
+		Source: ImageSource{
+			Type:      getStr(source, "type"),
+			MediaType: getStr(source, "media_type"),
+			Data:      getStr(source, "data"),
+			URL:       getStr(source, "url"),
+		},
+		Thinking:     getStr(block, "thinking"),
+		CacheControl: block["cache_control"] != nil,
+		ImageURL:     getStr(toMap(block["image_url"]), "url"),
+		Raw:          v,
+	}
+}
+
+// UnmarshalJSON decodes a Messages API request body.
+func (r *AnthropicRequest) UnmarshalJSON(data []byte) error {
+	var body map[string]any
+	if err := json.Unmarshal(data, &body); err != nil {
+		return err
+	}
+	*r = anthropicRequestFrom(body)
+	return nil
+}
+
+// UnmarshalJSON decodes a Chat Completions request body.
+func (r *OpenAIRequest) UnmarshalJSON(data []byte) error {
+	var body map[string]any
+	if err := json.Unmarshal(data, &body); err != nil {
+		return err
+	}
+	*r = openAIRequestFrom(body)
+	return nil
+}
+
+// UnmarshalJSON decodes content of any shape.
+func (c *Content) UnmarshalJSON(data []byte) error {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*c = contentFrom(v)
+	return nil
+}
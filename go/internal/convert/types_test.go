@@ -0,0 +1,127 @@
+package convert
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAnthropicRequest_UnmarshalJSON(t *testing.T) {
+	const body = `{"model":"claude-sonnet-4-20250514","system":[{"type":"text","text":"Be brief","cache_control":{"type":"ephemeral"}}],
+		"messages":[
+			{"role":"user","content":"Hi"},
+			{"role":"assistant","content":[{"type":"text","text":"Checking"},{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"SF"}}]},
+			{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","is_error":true,"content":[{"type":"text","text":"timeout"}]}]},
+			{"role":"user","content":42},
+			"not a message"
+		],
+		"tools":[{"name":"get_weather","input_schema":{"type":"object"}}],"tool_choice":{"type":"tool","name":"get_weather"},
+		"stream":true,"metadata":{"user_id":"u1"},"max_tokens":"wrong type"}`
+	var req AnthropicRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatal(err)
+	}
+
+	if req.System == nil || len(req.System.Blocks) != 1 || req.System.Blocks[0].Text != "Be brief" || !req.System.Blocks[0].CacheControl {
+		t.Errorf("system = %+v", req.System)
+	}
+	if len(req.Messages) != 5 {
+		t.Fatalf("got %d messages, want 5", len(req.Messages))
+	}
+	if s, ok := req.Messages[0].Content.Text(); !ok || s != "Hi" {
+		t.Errorf("string content = %q, %v", s, ok)
+	}
+	if use := req.Messages[1].Content.Blocks[1]; use.Type != "tool_use" || use.ID != "toolu_1" || !reflect.DeepEqual(use.Input, map[string]any{"city": "SF"}) {
+		t.Errorf("tool_use block = %+v", use)
+	}
+	result := req.Messages[2].Content.Blocks[0]
+	if !result.IsError || result.ToolUseID != "toolu_1" || result.Content.Blocks[0].Text != "timeout" {
+		t.Errorf("tool_result block = %+v", result)
+	}
+	if c := req.Messages[3].Content; c.Value != float64(42) || c.IsList() {
+		t.Errorf("number content = %+v", c)
+	}
+	if m := req.Messages[4]; m.Role != "" || m.Content.Value != nil {
+		t.Errorf("non-object message = %+v", m)
+	}
+	wantTools := []Tool{{Name: "get_weather", Schema: map[string]any{"type": "object"}}}
+	if !reflect.DeepEqual(req.Tools, wantTools) || *req.ToolChoice != (ToolChoice{Mode: "tool", Name: "get_weather"}) {
+		t.Errorf("tools = %+v, tool_choice = %+v", req.Tools, req.ToolChoice)
+	}
+	if !req.Stream || req.UserID != "u1" {
+		t.Errorf("stream = %v, user = %q", req.Stream, req.UserID)
+	}
+
+	// The typed request converts like the map it came from
+	got, gotWarnings, _ := req.ToOpenAI("gpt-4o", Options{})
+	want, wantWarnings, _ := AnthropicToOpenAIWithOptions(req.Body, "gpt-4o", Options{})
+	if !reflect.DeepEqual(got, want) || !reflect.DeepEqual(gotWarnings, wantWarnings) {
+		t.Errorf("ToOpenAI = %v, %v\nwant %v, %v", got, gotWarnings, want, wantWarnings)
+	}
+}
+
+func TestOpenAIRequest_UnmarshalJSON(t *testing.T) {
+	const body = `{"model":"gpt-4o","messages":[
+			{"role":"user","name":"ana","content":[{"type":"text","text":"see"},{"type":"image_url","image_url":{"url":"https://x/cat.png"}}]},
+			{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"f","arguments":"{\"a\":1}"}},{"function":{"name":"g","arguments":{"b":2}}}]},
+			{"role":"tool","tool_call_id":"call_1","content":"ok"}
+		],
+		"tools":[{"type":"function","function":{"name":"f","parameters":{"type":"object"}}},{"name":"g","description":"flat"}],
+		"tool_choice":"required","user":"u1"}`
+	var req OpenAIRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatal(err)
+	}
+
+	user := req.Messages[0]
+	if user.Name != "ana" || len(user.Content.Blocks) != 2 || user.Content.Blocks[1].ImageURL != "https://x/cat.png" {
+		t.Errorf("user message = %+v", user)
+	}
+	calls := req.Messages[1].ToolCalls
+	if len(calls) != 2 || calls[0].Function.Arguments != `{"a":1}` || calls[1].Function.Arguments != `{"b":2}` {
+		t.Errorf("tool calls = %+v", calls)
+	}
+	if tool := req.Messages[2]; tool.ToolCallID != "call_1" || tool.Content.Value != "ok" {
+		t.Errorf("tool message = %+v", tool)
+	}
+	wantTools := []Tool{{Name: "f", Schema: map[string]any{"type": "object"}}, {Name: "g", Description: "flat"}}
+	if !reflect.DeepEqual(req.Tools, wantTools) || *req.ToolChoice != (ToolChoice{Mode: "required"}) || req.User != "u1" {
+		t.Errorf("tools = %+v, tool_choice = %+v, user = %q", req.Tools, req.ToolChoice, req.User)
+	}
+
+	got, gotWarnings := req.ToAnthropic()
+	want, wantWarnings := OpenAIToAnthropicRequestWithWarnings(req.Body)
+	if !reflect.DeepEqual(got, want) || !reflect.DeepEqual(gotWarnings, wantWarnings) {
+		t.Errorf("ToAnthropic = %v, %v\nwant %v, %v", got, gotWarnings, want, wantWarnings)
+	}
+
+	if err := json.Unmarshal([]byte(`["not","a","request"]`), &req); err == nil {
+		t.Error("a JSON array decoded as a request")
+	}
+}
+
+func TestConvertedRequest_IntegersStayIntegers(t *testing.T) {
+	cases := []struct{ body, want string }{
+		{`{"messages":[{"role":"user","content":"hi"}]}`, `"max_tokens":4096`},
+		{`{"max_completion_tokens":8192,"messages":[{"role":"user","content":"hi"}]}`, `"max_tokens":8192`},
+	}
+	for _, tc := range cases {
+		var req OpenAIRequest
+		if err := json.Unmarshal([]byte(tc.body), &req); err != nil {
+			t.Fatal(err)
+		}
+		converted, _ := req.ToAnthropic()
+		out, _ := json.Marshal(converted)
+		if !strings.Contains(string(out), tc.want) {
+			t.Errorf("forwarded body %s doesn't have %s", out, tc.want)
+		}
+	}
+
+	var req AnthropicRequest
+	json.Unmarshal([]byte(`{"max_tokens":1024,"messages":[]}`), &req)
+	converted, _, _ := req.ToOpenAI("gpt-4o", Options{})
+	if out, _ := json.Marshal(converted); !strings.Contains(string(out), `"max_tokens":1024`) {
+		t.Errorf("forwarded body %s doesn't have max_tokens 1024", out)
+	}
+}
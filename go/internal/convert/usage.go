@@ -0,0 +1,37 @@
+package convert
+
+// anthropicUsage accumulates the token counts of an Anthropic response.
+// Streams report input and cache tokens in message_start and output tokens
+// in message_delta; later counts replace earlier ones.
+type anthropicUsage struct {
+	input, output, cacheRead, cacheWrite float64
+}
+
+// update reads the counts present in an Anthropic usage object.
+func (u *anthropicUsage) update(usage map[string]any) {
+	if v, ok := getFloat(usage, "input_tokens"); ok && v > 0 {
+		u.input = v
+	}
+	if v, ok := getFloat(usage, "output_tokens"); ok {
+		u.output = v
+	}
+	if v, ok := getFloat(usage, "cache_read_input_tokens"); ok && v > 0 {
+		u.cacheRead = v
+	}
+	if v, ok := getFloat(usage, "cache_creation_input_tokens"); ok && v > 0 {
+		u.cacheWrite = v
+	}
+}
+
+// openAI returns the usage in OpenAI's form. OpenAI's prompt_tokens counts
+// cached input too, which Anthropic reports apart from input_tokens; cache
+// reads are also given as prompt_tokens_details.cached_tokens.
+func (u anthropicUsage) openAI() map[string]any {
+	prompt := u.input + u.cacheRead + u.cacheWrite
+	return map[string]any{
+		"prompt_tokens":         prompt,
+		"completion_tokens":     u.output,
+		"total_tokens":          prompt + u.output,
+		"prompt_tokens_details": map[string]any{"cached_tokens": u.cacheRead},
+	}
+}
@@ -0,0 +1,69 @@
+package convert
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConvertAnthropicSSEToOpenAI_Usage(t *testing.T) {
+	// As Anthropic sends it: input and cache counts up front, the final
+	// output count with the stop reason
+	in := "event: message_start\ndata: " + `{"type":"message_start","message":{"id":"msg_u1","type":"message","role":"assistant","content":[],"model":"claude-sonnet-4-20250514","stop_reason":null,"usage":{"input_tokens":12,"cache_creation_input_tokens":300,"cache_read_input_tokens":4000,"output_tokens":1}}}` + "\n\n" +
+		"event: content_block_start\ndata: " + `{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}` + "\n\n" +
+		"event: content_block_delta\ndata: " + `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}` + "\n\n" +
+		"event: content_block_stop\ndata: " + `{"type":"content_block_stop","index":0}` + "\n\n" +
+		"event: message_delta\ndata: " + `{"type":"message_delta","delta":{"stop_reason":"end_turn","stop_sequence":null},"usage":{"output_tokens":25}}` + "\n\n" +
+		"event: message_stop\ndata: " + `{"type":"message_stop"}` + "\n\n"
+	want := map[string]any{
+		"prompt_tokens": float64(4312), "completion_tokens": float64(25), "total_tokens": float64(4337),
+		"prompt_tokens_details": map[string]any{"cached_tokens": float64(4000)},
+	}
+
+	for _, includeUsage := range []bool{false, true} {
+		stream := ConvertAnthropicSSEToOpenAIWithUsage(strings.NewReader(in), "gpt-4o", includeUsage)
+		out, _ := io.ReadAll(stream)
+		stream.Close()
+
+		var chunks []map[string]any
+		for _, line := range strings.Split(string(out), "\n") {
+			data, ok := strings.CutPrefix(line, "data: ")
+			if !ok || data == "[DONE]" {
+				continue
+			}
+			var chunk map[string]any
+			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+				t.Fatalf("invalid chunk %s", data)
+			}
+			chunks = append(chunks, chunk)
+		}
+		if !strings.HasSuffix(string(out), "data: [DONE]\n\n") {
+			t.Errorf("include_usage=%v: stream doesn't end with [DONE]:\n%s", includeUsage, out)
+		}
+
+		finish := chunks[len(chunks)-1]
+		if includeUsage {
+			last := chunks[len(chunks)-1]
+			if choices, _ := last["choices"].([]any); choices == nil || len(choices) != 0 {
+				t.Errorf("usage chunk choices = %v, want []", last["choices"])
+			}
+			if !reflect.DeepEqual(last["usage"], want) {
+				t.Errorf("usage chunk usage = %v, want %v", last["usage"], want)
+			}
+			finish = chunks[len(chunks)-2]
+		}
+		if reason := finish["choices"].([]any)[0].(map[string]any)["finish_reason"]; reason != "stop" {
+			t.Fatalf("include_usage=%v: chunk before the end = %v, want the finish_reason chunk", includeUsage, finish)
+		}
+		// Clients sum every usage they see, so include_usage sends it once
+		wantFinish := any(want)
+		if includeUsage {
+			wantFinish = nil
+		}
+		if !reflect.DeepEqual(finish["usage"], wantFinish) {
+			t.Errorf("include_usage=%v: finish chunk usage = %v, want %v", includeUsage, finish["usage"], wantFinish)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package cooldown
 
 import (
+	"codegate-proxy/internal/events"
+	"codegate-proxy/internal/metrics"
 	"log"
 	"math"
 	"strconv"
@@ -20,17 +22,40 @@ type entry struct {
 	consecutiveFailures int
 }
 
+// key identifies a cooldown: a whole account, or with model set, one model
+// on it.
+type key struct {
+	accountID, model string
+}
+
 var (
 	mu        sync.RWMutex
-	cooldowns = make(map[string]*entry)
+	cooldowns = make(map[key]*entry)
 )
 
 // Set sets a cooldown for an account.
 func Set(accountID, reason string, retryAfterSec int) {
+	durationSec, failures := set(key{accountID: accountID}, reason, retryAfterSec)
+	log.Printf("[cooldown] Account %s cooled down for %ds (%s, failures=%d)", accountID, durationSec, reason, failures)
+	metrics.Inc("codegate_cooldowns_total", "scope", "account", "reason", reason)
+	events.Publish(events.CooldownSet, accountID)
+}
+
+// SetModel sets a cooldown for one model on an account, for errors such as
+// overload that leave the account's other models usable.
+func SetModel(accountID, model, reason string, retryAfterSec int) {
+	durationSec, failures := set(key{accountID, model}, reason, retryAfterSec)
+	log.Printf("[cooldown] Model %s on account %s cooled down for %ds (%s, failures=%d)", model, accountID, durationSec, reason, failures)
+	metrics.Inc("codegate_cooldowns_total", "scope", "model", "reason", reason)
+}
+
+// set records a cooldown under k and returns its length and the number of
+// consecutive failures.
+func set(k key, reason string, retryAfterSec int) (int, int) {
 	mu.Lock()
 	defer mu.Unlock()
 
-	existing := cooldowns[accountID]
+	existing := cooldowns[k]
 	failures := 1
 	if existing != nil {
 		failures = existing.consecutiveFailures + 1
@@ -46,19 +71,28 @@ func Set(accountID, reason string, retryAfterSec int) {
 		))
 	}
 
-	cooldowns[accountID] = &entry{
+	cooldowns[k] = &entry{
 		until:               time.Now().Add(time.Duration(durationSec) * time.Second),
 		reason:              reason,
 		consecutiveFailures: failures,
 	}
-
-	log.Printf("[cooldown] Account %s cooled down for %ds (%s, failures=%d)", accountID, durationSec, reason, failures)
+	return durationSec, failures
 }
 
 // IsOnCooldown checks if an account is currently cooled down.
 func IsOnCooldown(accountID string) bool {
+	return isOnCooldown(key{accountID: accountID})
+}
+
+// IsModelOnCooldown checks if a model on an account is currently cooled
+// down by SetModel.
+func IsModelOnCooldown(accountID, model string) bool {
+	return isOnCooldown(key{accountID, model})
+}
+
+func isOnCooldown(k key) bool {
 	mu.RLock()
-	e := cooldowns[accountID]
+	e := cooldowns[k]
 	mu.RUnlock()
 
 	if e == nil {
@@ -66,8 +100,14 @@ func IsOnCooldown(accountID string) bool {
 	}
 	if time.Now().After(e.until) {
 		mu.Lock()
-		delete(cooldowns, accountID)
+		expired := cooldowns[k] == e
+		if expired {
+			delete(cooldowns, k)
+		}
 		mu.Unlock()
+		if expired && k.model == "" {
+			events.Publish(events.CooldownCleared, k.accountID)
+		}
 		return false
 	}
 	return true
@@ -76,21 +116,57 @@ func IsOnCooldown(accountID string) bool {
 // Clear clears cooldown for an account on success.
 func Clear(accountID string) {
 	mu.Lock()
-	defer mu.Unlock()
-	delete(cooldowns, accountID)
+	_, ok := cooldowns[key{accountID: accountID}]
+	delete(cooldowns, key{accountID: accountID})
+	mu.Unlock()
+	if ok {
+		events.Publish(events.CooldownCleared, accountID)
+	}
+}
+
+// ClearModel clears the cooldown of a model on an account on success.
+func ClearModel(accountID, model string) {
+	mu.Lock()
+	delete(cooldowns, key{accountID, model})
+	mu.Unlock()
 }
 
 // CooldownUntil returns the cooldown expiry for sorting. Zero time if not on cooldown.
 func CooldownUntil(accountID string) time.Time {
 	mu.RLock()
 	defer mu.RUnlock()
-	e := cooldowns[accountID]
+	e := cooldowns[key{accountID: accountID}]
 	if e == nil || time.Now().After(e.until) {
 		return time.Time{}
 	}
 	return e.until
 }
 
+// RemainingSeconds returns the seconds left on an account's cooldown,
+// rounded up, or 0 if it isn't cooled down.
+func RemainingSeconds(accountID string) int {
+	until := CooldownUntil(accountID)
+	if until.IsZero() {
+		return 0
+	}
+	return int(math.Ceil(time.Until(until).Seconds()))
+}
+
+// Snapshot returns the remaining cooldown for every account currently cooled
+// down. Model cooldowns aren't included.
+func Snapshot() map[string]time.Duration {
+	mu.RLock()
+	defer mu.RUnlock()
+	now := time.Now()
+	out := make(map[string]time.Duration, len(cooldowns))
+	for k, e := range cooldowns {
+		if remaining := e.until.Sub(now); remaining > 0 && k.model == "" {
+			out[k.accountID] = remaining
+		}
+	}
+	return out
+}
+
 // ParseRetryAfter parses a Retry-After header value to seconds.
 func ParseRetryAfter(headerValue string) int {
 	if headerValue == "" {
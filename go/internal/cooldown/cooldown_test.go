@@ -77,6 +77,18 @@ func TestCooldownUntil(t *testing.T) {
 	}
 }
 
+func TestRemainingSeconds(t *testing.T) {
+	Clear("test-remaining")
+	if s := RemainingSeconds("test-remaining"); s != 0 {
+		t.Errorf("no cooldown: %ds", s)
+	}
+	Set("test-remaining", "rate_limit", 30)
+	if s := RemainingSeconds("test-remaining"); s != 30 {
+		t.Errorf("remaining = %ds, want 30", s)
+	}
+	Clear("test-remaining")
+}
+
 func TestRetryAfterOverride(t *testing.T) {
 	Clear("test-retry")
 
@@ -88,3 +100,38 @@ func TestRetryAfterOverride(t *testing.T) {
 		t.Errorf("retry-after should override to ~120s, got %v", time.Until(until))
 	}
 }
+
+func TestSnapshot(t *testing.T) {
+	Clear("test-snap")
+	if _, ok := Snapshot()["test-snap"]; ok {
+		t.Fatal("snapshot should not include accounts without a cooldown")
+	}
+
+	Set("test-snap", "test", 10)
+	remaining, ok := Snapshot()["test-snap"]
+	if !ok || remaining > 10*time.Second || remaining < 8*time.Second {
+		t.Errorf("remaining = %v, ok = %v, want ~10s", remaining, ok)
+	}
+	Clear("test-snap")
+}
+
+func TestModelCooldown(t *testing.T) {
+	Clear("test-model")
+	ClearModel("test-model", "claude-opus-4-6")
+
+	SetModel("test-model", "claude-opus-4-6", "overloaded", 10)
+	if !IsModelOnCooldown("test-model", "claude-opus-4-6") {
+		t.Error("model should be on cooldown")
+	}
+	if IsOnCooldown("test-model") || IsModelOnCooldown("test-model", "claude-sonnet-4-6") {
+		t.Error("account and its other models should not be on cooldown")
+	}
+	if _, ok := Snapshot()["test-model"]; ok {
+		t.Error("snapshot should not include model cooldowns")
+	}
+
+	ClearModel("test-model", "claude-opus-4-6")
+	if IsModelOnCooldown("test-model", "claude-opus-4-6") {
+		t.Error("model should not be on cooldown after clear")
+	}
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// accountKeyFiles are the key files tried, in order: .account-key is the
+// dashboard's current name, the others are legacy.
+var accountKeyFiles = []string{".account-key", ".master-key", "encryption.key"}
+
+var errNoAccountKey = errors.New("no account encryption key")
+
+// getEncryptionKey reads the account encryption key from the data directory.
+// Compatible with Node.js which stores the key at DATA_DIR/.account-key
+// (hex-encoded 32-byte key). Falls back to legacy .master-key.
+func getEncryptionKey() []byte {
+	for _, name := range accountKeyFiles {
+		data, err := os.ReadFile(filepath.Join(dataDir(), name))
+		if err != nil {
+			continue
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			continue
+		}
+		if len(key) == 32 {
+			return key
+		}
+	}
+	return nil
+}
+
+// ensureEncryptionKey returns the account encryption key, creating
+// DATA_DIR/.account-key when none of the key files exist, e.g. on a fresh
+// install where the dashboard hasn't started yet. The key is written the
+// way the dashboard writes it: 64 hex characters, mode 0600. No key is
+// generated while accounts hold encrypted credentials: they were encrypted
+// with a key that is missing, and a new one would leave them undecryptable
+// for good once the original is restored over it.
+func ensureEncryptionKey() ([]byte, error) {
+	if key := getEncryptionKey(); key != nil {
+		return key, nil
+	}
+	for _, name := range accountKeyFiles {
+		if _, err := os.Stat(filepath.Join(dataDir(), name)); !os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s is not a hex-encoded 32-byte key", errNoAccountKey, name)
+		}
+	}
+	// The dashboard derives its key from these instead of the key file, so a
+	// generated file would not match what it reads
+	for _, env := range []string{"ACCOUNT_KEY", "MASTER_KEY"} {
+		if v := os.Getenv(env); v != "" && v != "auto" {
+			return nil, fmt.Errorf("%w: %s is set and the proxy only reads key files", errNoAccountKey, env)
+		}
+	}
+	if n, err := encryptedAccountCount(); err != nil || n > 0 {
+		if err != nil {
+			return nil, fmt.Errorf("%w: can't check for encrypted credentials: %v", errNoAccountKey, err)
+		}
+		return nil, fmt.Errorf("%w: %d account(s) have credentials encrypted with a missing key", errNoAccountKey, n)
+	}
+
+	key := make([]byte, 32)
+	if _, err := cryptoRandRead(key); err != nil {
+		return nil, fmt.Errorf("generate account key: %w", err)
+	}
+	path := filepath.Join(dataDir(), ".account-key")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		// The dashboard wrote one first
+		if key := getEncryptionKey(); key != nil {
+			return key, nil
+		}
+		return nil, fmt.Errorf("%w: .account-key is not a hex-encoded 32-byte key", errNoAccountKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create account key: %w", err)
+	}
+	_, err = f.WriteString(hex.EncodeToString(key))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("write account key: %w", err)
+	}
+	log.Printf("[db] Generated account encryption key at %s", path)
+	return key, nil
+}
+
+// CheckAccountKey reports accounts whose stored credentials can't be
+// decrypted because no account key can be loaded. Those accounts fail
+// upstream until the key is restored or their credentials are re-entered.
+func CheckAccountKey() error {
+	if getEncryptionKey() != nil {
+		return nil
+	}
+	n, err := encryptedAccountCount()
+	if err != nil || n == 0 {
+		return nil
+	}
+	err = fmt.Errorf("%w: %d account(s) have encrypted credentials but no key could be loaded from %s", errNoAccountKey, n, dataDir())
+	log.Printf("[db] ERROR: %v", err)
+	return err
+}
+
+// encryptedAccountCount counts accounts with encrypted credentials stored.
+func encryptedAccountCount() (int, error) {
+	if conn == nil {
+		return 0, errors.New("db not open")
+	}
+	var n int
+	err := conn.QueryRow(`SELECT COUNT(*) FROM accounts
+		WHERE COALESCE(api_key_enc, '') != '' OR COALESCE(refresh_token_enc, '') != ''`).Scan(&n)
+	return n, err
+}
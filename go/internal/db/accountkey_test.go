@@ -0,0 +1,145 @@
+package db_test
+
+import (
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/dbtest"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// addOAuthAccount adds an OAuth account. Tests use distinct IDs since
+// in-memory tokens outlive the test database.
+func addOAuthAccount(tdb *dbtest.DB, id, enc string) {
+	tdb.AddAccount(id, "oauth", "anthropic", "")
+	tdb.Exec("UPDATE accounts SET auth_type = 'oauth', api_key_enc = ?, token_expires_at = 1000 WHERE id = ?", enc, id)
+}
+
+func TestUpdateAccountTokens_GeneratesKey(t *testing.T) {
+	tdb := dbtest.Open(t)
+	addOAuthAccount(tdb, "acct-genkey", "")
+
+	if err := db.UpdateAccountTokens("acct-genkey", "fresh-access", "fresh-refresh", 5000); err != nil {
+		t.Fatalf("UpdateAccountTokens: %v", err)
+	}
+
+	path := filepath.Join(tdb.Dir, ".account-key")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("no key file written: %v", err)
+	}
+	if key, err := hex.DecodeString(string(data)); err != nil || len(key) != 32 {
+		t.Errorf(".account-key = %q, want 64 hex characters", data)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o600 {
+		t.Errorf(".account-key mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	a := db.GetAccount("acct-genkey")
+	if a == nil || a.APIKey != "fresh-access" || a.RefreshToken != "fresh-refresh" {
+		t.Fatalf("tokens don't decrypt with the generated key: %+v", a)
+	}
+	var enc string
+	tdb.QueryRow("SELECT api_key_enc FROM accounts WHERE id = 'acct-genkey'").Scan(&enc)
+	if enc == "" || enc == "fresh-access" {
+		t.Errorf("api_key_enc = %q, want ciphertext", enc)
+	}
+}
+
+func TestUpdateAccountTokens_UnusableKeyKeepsStoredTokens(t *testing.T) {
+	tdb := dbtest.Open(t)
+	addOAuthAccount(tdb, "acct-badkey", "old-ciphertext")
+	if err := os.WriteFile(filepath.Join(tdb.Dir, ".account-key"), []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.UpdateAccountTokens("acct-badkey", "fresh-access", "fresh-refresh", 5000); err == nil {
+		t.Fatal("UpdateAccountTokens should fail without a usable key")
+	}
+
+	var enc sql.NullString
+	var expires int64
+	tdb.QueryRow("SELECT api_key_enc, token_expires_at FROM accounts WHERE id = 'acct-badkey'").Scan(&enc, &expires)
+	if enc.String != "old-ciphertext" || expires != 1000 {
+		t.Errorf("stored tokens overwritten: api_key_enc=%q expires=%d", enc.String, expires)
+	}
+	if data, _ := os.ReadFile(filepath.Join(tdb.Dir, ".account-key")); string(data) != "not a key" {
+		t.Errorf("existing key file replaced: %q", data)
+	}
+	// The refreshed tokens stay usable in this process
+	if a := db.GetAccount("acct-badkey"); a == nil || a.APIKey != "fresh-access" {
+		t.Errorf("GetAccount = %+v, want in-memory tokens", a)
+	}
+}
+
+func TestUpdateAccountTokens_EnvKeyNotGenerated(t *testing.T) {
+	tdb := dbtest.Open(t)
+	addOAuthAccount(tdb, "acct-envkey", "")
+	t.Setenv("ACCOUNT_KEY", "from-the-environment")
+
+	if err := db.UpdateAccountTokens("acct-envkey", "fresh-access", "", 5000); err == nil {
+		t.Fatal("UpdateAccountTokens should fail when the dashboard's key comes from ACCOUNT_KEY")
+	}
+	if _, err := os.Stat(filepath.Join(tdb.Dir, ".account-key")); !os.IsNotExist(err) {
+		t.Errorf("key file generated despite ACCOUNT_KEY: %v", err)
+	}
+}
+
+func TestAccountKey_ReadsDashboardCiphertext(t *testing.T) {
+	tdb := dbtest.Open(t)
+	key := make([]byte, 32)
+	rand.Read(key)
+	os.WriteFile(filepath.Join(tdb.Dir, ".account-key"), []byte(hex.EncodeToString(key)+"\n"), 0o600)
+
+	// The dashboard's format: base64(iv[16] + ciphertext + tag)
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCMWithNonceSize(block, 16)
+	iv := make([]byte, 16)
+	rand.Read(iv)
+	addOAuthAccount(tdb, "acct-nodekey", base64.StdEncoding.EncodeToString(gcm.Seal(iv, iv, []byte("sk-dashboard"), nil)))
+
+	if a := db.GetAccount("acct-nodekey"); a == nil || a.APIKey != "sk-dashboard" {
+		t.Fatalf("GetAccount = %+v, want the dashboard's key decrypted", a)
+	}
+	if err := db.CheckAccountKey(); err != nil {
+		t.Errorf("CheckAccountKey with a key: %v", err)
+	}
+}
+
+func TestCheckAccountKey(t *testing.T) {
+	tdb := dbtest.Open(t)
+	if err := db.CheckAccountKey(); err != nil {
+		t.Errorf("no encrypted accounts: %v", err)
+	}
+	addOAuthAccount(tdb, "acct-nokey", "ciphertext")
+	if err := db.CheckAccountKey(); err == nil {
+		t.Error("CheckAccountKey should fail with encrypted accounts and no key")
+	}
+}
+
+func TestUpdateAccountTokens_NoKeyGeneratedOverEncryptedAccounts(t *testing.T) {
+	tdb := dbtest.Open(t)
+	addOAuthAccount(tdb, "acct-lostkey", "")
+	addOAuthAccount(tdb, "acct-encrypted", "ciphertext-from-a-missing-key")
+
+	if err := db.UpdateAccountTokens("acct-lostkey", "fresh-access", "fresh-refresh", 5000); err == nil {
+		t.Fatal("UpdateAccountTokens should fail while other accounts hold ciphertext")
+	}
+	if _, err := os.Stat(filepath.Join(tdb.Dir, ".account-key")); !os.IsNotExist(err) {
+		t.Errorf("key file generated over encrypted accounts: %v", err)
+	}
+	var enc string
+	tdb.QueryRow("SELECT api_key_enc FROM accounts WHERE id = 'acct-encrypted'").Scan(&enc)
+	if enc != "ciphertext-from-a-missing-key" {
+		t.Errorf("api_key_enc = %q, want it untouched", enc)
+	}
+	if a := db.GetAccount("acct-lostkey"); a == nil || a.APIKey != "fresh-access" {
+		t.Errorf("GetAccount = %+v, want in-memory tokens", a)
+	}
+}
@@ -0,0 +1,190 @@
+package db
+
+import (
+	"codegate-proxy/internal/redact"
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Attempt is a request_attempts row: a candidate account that failed
+// before the request failed over from it. Rows share the request ID of the
+// usage row the request ends with, so an account's failed calls, and the
+// time they took, can be counted next to what it served.
+type Attempt struct {
+	AccountID   string
+	RoutedModel string
+	StatusCode  int // 0 when no response came back
+	LatencyMs   int
+	// Reason is why the attempt failed: connection_error, timeout,
+	// rate_limit, server_error, overloaded or stream_error
+	Reason string
+	Error  string
+	// Retry is set on attempts retried on the same account
+	Retry bool
+}
+
+// InitRequestAttemptsTable creates the request_attempts table if needed.
+// The proxy owns it; the dashboard only reads it.
+func InitRequestAttemptsTable() error {
+	if !Writable() {
+		return nil
+	}
+	wConn, err := sql.Open("sqlite3", dbPath()+"?_journal_mode=WAL&_foreign_keys=on")
+	if err != nil {
+		return fmt.Errorf("open database: %w", err)
+	}
+	defer wConn.Close()
+
+	_, err = wConn.Exec(`CREATE TABLE IF NOT EXISTS request_attempts (
+		id TEXT PRIMARY KEY,
+		request_id TEXT NOT NULL,
+		account_id TEXT,
+		routed_model TEXT,
+		status_code INTEGER DEFAULT 0,
+		latency_ms INTEGER DEFAULT 0,
+		reason TEXT,
+		error TEXT,
+		retry INTEGER DEFAULT 0,
+		tenant_id TEXT,
+		end_user TEXT,
+		tags TEXT,
+		created_at TEXT DEFAULT (datetime('now'))
+	);
+	CREATE INDEX IF NOT EXISTS idx_request_attempts_request ON request_attempts(request_id);
+	CREATE INDEX IF NOT EXISTS idx_request_attempts_account_created ON request_attempts(account_id, created_at)`)
+	if err != nil {
+		return fmt.Errorf("create request_attempts: %w", err)
+	}
+	return nil
+}
+
+// RecordAttempts inserts the failed attempts of a request that recorded no
+// usage, such as one every candidate failed. Requests that do record usage
+// pass their attempts to RecordUsage, which writes both at once.
+func RecordAttempts(dims UsageDimensions, attempts ...Attempt) error {
+	if !Writable() || len(attempts) == 0 {
+		return nil
+	}
+	wConn, err := sql.Open("sqlite3", dbPath()+"?_journal_mode=WAL&_foreign_keys=on")
+	if err != nil {
+		return err
+	}
+	defer wConn.Close()
+
+	tx, err := wConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := insertAttempts(tx, dims, attempts); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertAttempts writes attempt rows in tx, attributed like the request's
+// usage. Upstream error bodies can echo the credential that was rejected,
+// so errors are redacted.
+func insertAttempts(tx *sql.Tx, dims UsageDimensions, attempts []Attempt) error {
+	for _, a := range attempts {
+		retry := 0
+		if a.Retry {
+			retry = 1
+		}
+		errMsg := redact.String(a.Error)
+		if len(errMsg) > 500 {
+			errMsg = errMsg[:500]
+		}
+		if _, err := tx.Exec(`INSERT INTO request_attempts (id, request_id, account_id, routed_model, status_code, latency_ms, reason, error, retry, tenant_id, end_user, tags) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			generateID(), dims.RequestID, nullStr(a.AccountID), nullStr(a.RoutedModel), a.StatusCode, a.LatencyMs,
+			nullStr(a.Reason), nullStr(errMsg), retry, nullStr(dims.TenantID), nullStr(dims.EndUser), nullStr(dims.Tags)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AttemptRecord is one request_attempts row joined with its account and
+// tenant names.
+type AttemptRecord struct {
+	CreatedAt   string `json:"created_at"`
+	RequestID   string `json:"request_id"`
+	AccountID   string `json:"account_id"`
+	AccountName string `json:"account_name"`
+	TenantID    string `json:"tenant_id"`
+	TenantName  string `json:"tenant_name"`
+	RoutedModel string `json:"routed_model"`
+	StatusCode  int    `json:"status_code"`
+	LatencyMs   int    `json:"latency_ms"`
+	Reason      string `json:"reason"`
+	Retry       bool   `json:"retry"`
+	Error       string `json:"error"`
+}
+
+// AttemptGroup is failed attempts aggregated by one of UsageGroupings.
+type AttemptGroup struct {
+	Key       string `json:"key"`
+	Name      string `json:"name"`
+	Attempts  int    `json:"attempts"`
+	LatencyMs int    `json:"latency_ms"`
+}
+
+// StreamAttempts calls fn for each failed attempt matching f, oldest
+// first, like StreamUsage.
+func StreamAttempts(ctx context.Context, f UsageFilter, fn func(AttemptRecord) error) error {
+	if conn == nil {
+		return fmt.Errorf("db not open")
+	}
+	from, args := filterFrom("request_attempts", f)
+	rows, err := conn.QueryContext(ctx, `SELECT u.created_at, u.request_id, COALESCE(u.account_id, ''), COALESCE(a.name, ''),
+		COALESCE(u.tenant_id, ''), COALESCE(t.name, ''), COALESCE(u.routed_model, ''),
+		COALESCE(u.status_code, 0), COALESCE(u.latency_ms, 0), COALESCE(u.reason, ''),
+		COALESCE(u.retry, 0), COALESCE(u.error, '')`+
+		from+` ORDER BY u.created_at, u.rowid`+limitClause(f), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r AttemptRecord
+		if err := rows.Scan(&r.CreatedAt, &r.RequestID, &r.AccountID, &r.AccountName, &r.TenantID, &r.TenantName,
+			&r.RoutedModel, &r.StatusCode, &r.LatencyMs, &r.Reason, &r.Retry, &r.Error); err != nil {
+			return err
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// StreamAttemptGroups is StreamAttempts aggregated by a UsageGrouping.
+func StreamAttemptGroups(ctx context.Context, f UsageFilter, group string, fn func(AttemptGroup) error) error {
+	if conn == nil {
+		return fmt.Errorf("db not open")
+	}
+	cols, ok := UsageGrouping(group)
+	if !ok {
+		return fmt.Errorf("unknown grouping %q", group)
+	}
+	from, args := filterFrom("request_attempts", f)
+	rows, err := conn.QueryContext(ctx, `SELECT `+cols[0]+` AS k, `+cols[1]+`, COUNT(*), COALESCE(SUM(u.latency_ms), 0)`+
+		from+` GROUP BY k ORDER BY k`+limitClause(f), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var g AttemptGroup
+		if err := rows.Scan(&g.Key, &g.Name, &g.Attempts, &g.LatencyMs); err != nil {
+			return err
+		}
+		if err := fn(g); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
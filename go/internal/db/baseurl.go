@@ -0,0 +1,166 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// ValidateBaseURL checks that a non-empty base_url is an absolute http(s) URL.
+func ValidateBaseURL(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid base_url %q: %v", raw, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid base_url %q: scheme must be http or https", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid base_url %q: missing host", raw)
+	}
+	return nil
+}
+
+// flaggedBaseURLs remembers which account/base_url pairs have been reported,
+// so a bad account is logged and marked once rather than on every load.
+var flaggedBaseURLs sync.Map // accountID+"\x00"+baseURL -> struct{}
+
+func markMisconfigured(a Account, err error) {
+	if _, seen := flaggedBaseURLs.LoadOrStore(a.ID+"\x00"+a.BaseURL, struct{}{}); seen {
+		return
+	}
+	log.Printf("[db] Account %q skipped: %v", a.Name, err)
+	SetStatus(a.ID, StatusMisconfigured, err.Error())
+}
+
+// selfCheckTTL is how long a base_url's self check holds before its host is
+// resolved again, so DNS changes are picked up.
+const selfCheckTTL = 10 * time.Minute
+
+// selfChecks records when each account's base_url was last checked against
+// this proxy's addresses.
+var selfChecks struct {
+	mu      sync.Mutex
+	checked map[string]time.Time // accountID+"\x00"+baseURL -> check time
+}
+
+// warnIfSelf logs once when an account's base_url points at this proxy's own
+// listen port on a local address. Requests through it would loop until the
+// hop limit rejects them. The host may need a DNS lookup, so it is resolved
+// in the background rather than on the request path.
+func warnIfSelf(a Account) {
+	u, err := url.Parse(a.BaseURL)
+	if a.BaseURL == "" || err != nil || urlPort(u) != proxyPort() {
+		return
+	}
+	key := a.ID + "\x00" + a.BaseURL
+	selfChecks.mu.Lock()
+	if time.Since(selfChecks.checked[key]) < selfCheckTTL {
+		selfChecks.mu.Unlock()
+		return
+	}
+	if selfChecks.checked == nil {
+		selfChecks.checked = make(map[string]time.Time)
+	}
+	selfChecks.checked[key] = time.Now()
+	selfChecks.mu.Unlock()
+
+	go func() {
+		if !resolvesToLocalHost(u.Hostname()) {
+			return
+		}
+		if _, seen := flaggedBaseURLs.LoadOrStore("self\x00"+key, struct{}{}); seen {
+			return
+		}
+		log.Printf("[db] WARNING: account %q base_url %s points at this proxy; requests through it will loop", a.Name, a.BaseURL)
+	}()
+}
+
+// codeGateURLs remembers base URLs that have answered as a CodeGate proxy.
+var codeGateURLs sync.Map // baseURL -> struct{}
+
+// MarkCodeGateURL records that a base_url answered with a CodeGate proxy's
+// response headers.
+func MarkCodeGateURL(raw string) {
+	if raw != "" {
+		codeGateURLs.Store(raw, struct{}{})
+	}
+}
+
+// IsCodeGateURL reports whether a base_url is a CodeGate proxy: it is served
+// on the proxy port, or it has answered as one before. Loop-detection
+// headers only go to these, not to third-party providers.
+func IsCodeGateURL(raw string) bool {
+	if raw == "" {
+		return false
+	}
+	if _, ok := codeGateURLs.Load(raw); ok {
+		return true
+	}
+	u, err := url.Parse(raw)
+	return err == nil && urlPort(u) == proxyPort()
+}
+
+// proxyPort is the port this proxy listens on, PROXY_PORT or the default.
+func proxyPort() string {
+	if port := os.Getenv("PROXY_PORT"); port != "" {
+		return port
+	}
+	return "9212"
+}
+
+// urlPort returns a URL's port, or its scheme's default.
+func urlPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if u.Scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// resolvesToLocalHost reports whether host names this machine.
+func resolvesToLocalHost(host string) bool {
+	if hostname, _ := os.Hostname(); host == "localhost" || host == hostname {
+		return true
+	}
+	ips := []string{host}
+	if net.ParseIP(host) == nil {
+		var err error
+		if ips, err = net.LookupHost(host); err != nil {
+			return false
+		}
+	}
+	for _, s := range ips {
+		if ip := net.ParseIP(s); ip != nil && isLocalIP(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalIP reports whether ip is loopback, unspecified, or assigned to one
+// of this host's interfaces.
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package db_test
+
+import (
+	"bytes"
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/dbtest"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidateBaseURL(t *testing.T) {
+	valid := []string{
+		"",
+		"https://api.openai.com/v1",
+		"http://localhost:8080",
+		"https://gateway.internal/llm/openai/v1?api-version=1",
+	}
+	for _, s := range valid {
+		if err := db.ValidateBaseURL(s); err != nil {
+			t.Errorf("ValidateBaseURL(%q) = %v, want nil", s, err)
+		}
+	}
+
+	invalid := []string{
+		"api.openai.com/v1",
+		"localhost:8080",
+		"ftp://example.com",
+		"https://",
+		"http://[::1",
+	}
+	for _, s := range invalid {
+		if err := db.ValidateBaseURL(s); err == nil {
+			t.Errorf("ValidateBaseURL(%q) = nil, want error", s)
+		}
+	}
+}
+
+func TestGetEnabledAccounts_SkipsBadBaseURL(t *testing.T) {
+	d := dbtest.Open(t)
+	d.AddAccount("good", "Good", "openai", "https://api.openai.com/v1")
+	d.AddAccount("bad", "Bad", "openai", "api.openai.com/v1")
+
+	accounts, err := db.GetEnabledAccounts()
+	if err != nil {
+		t.Fatalf("GetEnabledAccounts: %v", err)
+	}
+	if len(accounts) != 1 || accounts[0].ID != "good" {
+		t.Fatalf("accounts = %+v, want only the valid one", accounts)
+	}
+
+	var status db.Status
+	var lastError string
+	d.QueryRow("SELECT status, last_error FROM accounts WHERE id = 'bad'").Scan(&status, &lastError)
+	if status != db.StatusMisconfigured || lastError == "" {
+		t.Errorf("status = %q, last_error = %q", status, lastError)
+	}
+}
+
+func TestGetEnabledAccounts_WarnsOnSelfBaseURL(t *testing.T) {
+	d := dbtest.Open(t)
+	t.Setenv("PROXY_PORT", "19212")
+	d.AddAccount("self", "Self", "anthropic", "http://127.0.0.1:19212")
+	d.AddAccount("other-port", "Other port", "anthropic", "http://127.0.0.1:19213")
+	d.AddAccount("remote", "Remote", "openai", "https://api.openai.com/v1")
+
+	buf := &lockedBuffer{}
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	for range 2 {
+		accounts, err := db.GetEnabledAccounts()
+		if err != nil {
+			t.Fatalf("GetEnabledAccounts: %v", err)
+		}
+		if len(accounts) != 3 {
+			t.Fatalf("got %d accounts, want all 3 (self-pointing accounts are only warned about)", len(accounts))
+		}
+	}
+
+	// The hosts are resolved in the background
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(buf.String(), "points at this proxy") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	out := buf.String()
+	if strings.Count(out, "points at this proxy") != 1 || !strings.Contains(out, `"Self"`) {
+		t.Errorf("want one warning naming Self, log:\n%s", out)
+	}
+}
+
+func TestIsCodeGateURL(t *testing.T) {
+	t.Setenv("PROXY_PORT", "19214")
+	for raw, want := range map[string]bool{
+		"http://127.0.0.1:19214":           true,
+		"https://team-proxy.example:19214": true,
+		"https://api.openai.com/v1":        false,
+		"http://127.0.0.1:19215":           false,
+		"":                                 false,
+	} {
+		if got := db.IsCodeGateURL(raw); got != want {
+			t.Errorf("IsCodeGateURL(%q) = %v, want %v", raw, got, want)
+		}
+	}
+
+	db.MarkCodeGateURL("http://127.0.0.1:19215")
+	if !db.IsCodeGateURL("http://127.0.0.1:19215") {
+		t.Error("a base URL that answered as a proxy is not recognized")
+	}
+}
+
+// lockedBuffer is a log output safe to read while the background self
+// checks write to it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -1,17 +1,23 @@
 package db
 
 import (
+	"codegate-proxy/internal/events"
+	"codegate-proxy/internal/redact"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"log"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -19,6 +25,9 @@ import (
 var (
 	conn   *sql.DB
 	connMu sync.Mutex
+
+	// pending counts the writes started with Go, so Close can wait for them
+	pending sync.WaitGroup
 )
 
 // Account represents a decrypted account row.
@@ -34,12 +43,57 @@ type Account struct {
 	Priority          int
 	RateLimit         int
 	MonthlyBudget     sql.NullFloat64
+	DailyBudget       sql.NullFloat64
 	Enabled           bool
 	SubscriptionType  string
 	AccountEmail      string
 	ExternalAccountID string
-	Status            string
+	Status            Status
 	ErrorCount        int
+	APIFlavor         string // "openai", "anthropic", or "" for the provider's default
+	AllowedBetas      string // comma-separated anthropic-beta values the account accepts; "" allows any
+	AnthropicVersion  string // anthropic-version sent instead of the client's; "" forwards the client's
+	OpenRouterPrefs   string // JSON provider preferences merged into OpenRouter requests
+	// NoFailover (failover_enabled = 0) keeps requests routed to this
+	// account on it, whatever the failover_enabled setting says.
+	NoFailover bool
+	// MaxFailoverCandidates caps the fallbacks tried after this account;
+	// the setting's cap still applies when it is lower.
+	MaxFailoverCandidates sql.NullInt64
+	// SystemPromptPrefix is injected ahead of the system prompt of requests
+	// sent to this account, after the system_prompt_prefix setting's text
+	SystemPromptPrefix string
+	// Upstream timeouts in milliseconds, replacing the provider_*_timeout_ms
+	// settings for this account; 0 leaves the setting's value
+	ConnectTimeoutMs  int
+	HeaderTimeoutMs   int
+	ResponseTimeoutMs int
+	// SimulatorSettings is the JSON behaviour of a "simulator" account,
+	// which answers locally instead of calling a provider
+	SimulatorSettings string
+}
+
+// SpeaksAnthropic reports whether the account's endpoint takes Anthropic
+// Messages requests. api_flavor overrides the provider default, so e.g. a GLM
+// account pointed at its Anthropic-compatible base URL is treated as Anthropic.
+func (a Account) SpeaksAnthropic() bool {
+	switch a.APIFlavor {
+	case "anthropic":
+		return true
+	case "openai":
+		return false
+	}
+	return a.Provider == "anthropic"
+}
+
+// IsOpenRouter reports whether the account's requests go to OpenRouter,
+// by provider or because its base URL points there.
+func (a Account) IsOpenRouter() bool {
+	if a.Provider == "openrouter" {
+		return true
+	}
+	u, err := url.Parse(a.BaseURL)
+	return err == nil && (u.Hostname() == "openrouter.ai" || strings.HasSuffix(u.Hostname(), ".openrouter.ai"))
 }
 
 // Config represents a routing config row.
@@ -59,6 +113,10 @@ type ConfigTier struct {
 	AccountID   string
 	Priority    int
 	TargetModel string
+	Condition   string // request trait the row applies to (e.g. "thinking"); "" for all requests
+	// FallbackModels are tried in order on the same account when the
+	// target model is overloaded (stored as a JSON array)
+	FallbackModels []string
 }
 
 // Setting represents a key-value setting.
@@ -76,14 +134,8 @@ func Open() error {
 		return nil
 	}
 
-	dataDir := os.Getenv("DATA_DIR")
-	if dataDir == "" {
-		dataDir = "./data"
-	}
-	dbPath := filepath.Join(dataDir, "codegate.db")
-
 	var err error
-	conn, err = sql.Open("sqlite3", dbPath+"?_journal_mode=WAL&_foreign_keys=on&mode=ro")
+	conn, err = sql.Open("sqlite3", dbPath()+"?_journal_mode=WAL&_foreign_keys=on&mode=ro")
 	if err != nil {
 		return fmt.Errorf("open db: %w", err)
 	}
@@ -97,8 +149,20 @@ func DB() *sql.DB {
 	return conn
 }
 
-// Close closes the database connection.
+// Go runs fn, a write the request doesn't wait for, in the background.
+// Close waits for it to finish.
+func Go(fn func()) {
+	pending.Add(1)
+	go func() {
+		defer pending.Done()
+		fn()
+	}()
+}
+
+// Close waits for writes started with Go, then closes the database
+// connection.
 func Close() {
+	pending.Wait()
 	connMu.Lock()
 	defer connMu.Unlock()
 	if conn != nil {
@@ -107,12 +171,28 @@ func Close() {
 	}
 }
 
+// Ping checks that the database is open and readable.
+func Ping() error {
+	connMu.Lock()
+	c := conn
+	connMu.Unlock()
+	if c == nil {
+		return fmt.Errorf("database not open")
+	}
+	var n int
+	return c.QueryRow("SELECT COUNT(*) FROM sqlite_master").Scan(&n)
+}
+
 // GetEnabledAccounts returns all enabled accounts with decrypted keys.
+// Accounts with an invalid base_url are skipped and marked misconfigured.
 func GetEnabledAccounts() ([]Account, error) {
 	rows, err := conn.Query(`SELECT id, name, provider, auth_type, api_key_enc, refresh_token_enc,
 		token_expires_at, base_url, priority, rate_limit, monthly_budget, enabled,
 		COALESCE(subscription_type, ''), COALESCE(account_email, ''),
-		COALESCE(external_account_id, ''), COALESCE(status, 'unknown'), COALESCE(error_count, 0)
+		COALESCE(external_account_id, ''), COALESCE(status, 'unknown'), COALESCE(error_count, 0),
+		COALESCE(api_flavor, ''), COALESCE(allowed_betas, ''), daily_budget, COALESCE(anthropic_version, ''), COALESCE(openrouter_prefs, ''),
+		COALESCE(failover_enabled, 1) = 0, max_failover_candidates, COALESCE(system_prompt_prefix, ''),
+		COALESCE(connect_timeout_ms, 0), COALESCE(header_timeout_ms, 0), COALESCE(response_timeout_ms, 0), COALESCE(simulator_settings, '')
 		FROM accounts WHERE enabled = 1 ORDER BY priority DESC, name ASC`)
 	if err != nil {
 		return nil, err
@@ -131,7 +211,9 @@ func GetEnabledAccounts() ([]Account, error) {
 			&apiKeyEnc, &refreshTokenEnc, &a.TokenExpiresAt,
 			&baseURL, &a.Priority, &a.RateLimit, &a.MonthlyBudget,
 			&enabledInt, &a.SubscriptionType, &a.AccountEmail,
-			&a.ExternalAccountID, &a.Status, &a.ErrorCount)
+			&a.ExternalAccountID, &a.Status, &a.ErrorCount, &a.APIFlavor, &a.AllowedBetas, &a.DailyBudget, &a.AnthropicVersion, &a.OpenRouterPrefs,
+			&a.NoFailover, &a.MaxFailoverCandidates, &a.SystemPromptPrefix,
+			&a.ConnectTimeoutMs, &a.HeaderTimeoutMs, &a.ResponseTimeoutMs, &a.SimulatorSettings)
 		if err != nil {
 			return nil, fmt.Errorf("scan account: %w", err)
 		}
@@ -140,12 +222,18 @@ func GetEnabledAccounts() ([]Account, error) {
 		if baseURL.Valid {
 			a.BaseURL = baseURL.String
 		}
+		if err := ValidateBaseURL(a.BaseURL); err != nil {
+			markMisconfigured(a, err)
+			continue
+		}
+		warnIfSelf(a)
 		if apiKeyEnc.Valid && apiKeyEnc.String != "" {
 			a.APIKey = decryptValue(apiKeyEnc.String, encKey)
 		}
 		if refreshTokenEnc.Valid && refreshTokenEnc.String != "" {
 			a.RefreshToken = decryptValue(refreshTokenEnc.String, encKey)
 		}
+		applyTokenOverlay(&a)
 
 		accounts = append(accounts, a)
 	}
@@ -171,7 +259,7 @@ func GetActiveConfig() (*Config, error) {
 
 // GetConfigTiers returns all tier assignments for a config.
 func GetConfigTiers(configID string) ([]ConfigTier, error) {
-	rows, err := conn.Query("SELECT id, config_id, tier, account_id, priority, COALESCE(target_model, '') FROM config_tiers WHERE config_id = ? ORDER BY tier, priority DESC", configID)
+	rows, err := conn.Query("SELECT id, config_id, tier, account_id, priority, COALESCE(target_model, ''), COALESCE(condition, ''), COALESCE(fallback_models, '') FROM config_tiers WHERE config_id = ? ORDER BY tier, priority DESC", configID)
 	if err != nil {
 		return nil, err
 	}
@@ -180,9 +268,15 @@ func GetConfigTiers(configID string) ([]ConfigTier, error) {
 	var tiers []ConfigTier
 	for rows.Next() {
 		var t ConfigTier
-		if err := rows.Scan(&t.ID, &t.ConfigID, &t.Tier, &t.AccountID, &t.Priority, &t.TargetModel); err != nil {
+		var fallbackModels string
+		if err := rows.Scan(&t.ID, &t.ConfigID, &t.Tier, &t.AccountID, &t.Priority, &t.TargetModel, &t.Condition, &fallbackModels); err != nil {
 			return nil, err
 		}
+		if fallbackModels != "" {
+			if err := json.Unmarshal([]byte(fallbackModels), &t.FallbackModels); err != nil {
+				log.Printf("[db] Ignoring invalid fallback_models on tier row %s: %v", t.ID, err)
+			}
+		}
 		tiers = append(tiers, t)
 	}
 	return tiers, rows.Err()
@@ -201,6 +295,16 @@ func GetSetting(key string) string {
 	return val.String
 }
 
+// InitSetting stores a setting unless it already has a value.
+func InitSetting(key, value string) {
+	writeExec(`INSERT OR IGNORE INTO settings (key, value) VALUES (?, ?)`, key, value)
+}
+
+// SetSetting stores a setting, replacing any value it already has.
+func SetSetting(key, value string) {
+	writeExec(`INSERT OR REPLACE INTO settings (key, value) VALUES (?, ?)`, key, value)
+}
+
 // GetMonthlySpend returns the current month's spend for an account.
 func GetMonthlySpend(accountID string) float64 {
 	// Use a simple query for the first of the current month
@@ -212,96 +316,201 @@ func GetMonthlySpend(accountID string) float64 {
 	return total.Float64
 }
 
-// RecordUsage inserts a usage record into the database.
-// This opens a separate write connection since the main one is read-only.
-func RecordUsage(accountID, configID, tier, originalModel, routedModel string, inputTokens, outputTokens, cacheRead, cacheWrite int, costUSD float64, tenantID ...string) error {
-	dataDir := os.Getenv("DATA_DIR")
-	if dataDir == "" {
-		dataDir = "./data"
+// Now is the clock daily spend is measured against. Tests replace it.
+var Now = time.Now
+
+// GetDailySpend returns an account's spend since midnight UTC, the same
+// clock usage rows are stamped with.
+func GetDailySpend(accountID string) float64 {
+	today := Now().UTC()
+	var total sql.NullFloat64
+	err := conn.QueryRow(`SELECT COALESCE(SUM(cost_usd), 0) FROM usage WHERE account_id = ? AND created_at >= ? AND created_at < ?`,
+		accountID, today.Format("2006-01-02"), today.AddDate(0, 0, 1).Format("2006-01-02")).Scan(&total)
+	if err != nil || !total.Valid {
+		return 0
 	}
-	dbPath := filepath.Join(dataDir, "codegate.db")
+	return total.Float64
+}
 
-	wConn, err := sql.Open("sqlite3", dbPath+"?_journal_mode=WAL&_foreign_keys=on")
+// RecordUsage inserts a usage record into the database, with the attempts
+// that failed over before it, in one transaction.
+// This opens a separate write connection since the main one is read-only.
+func RecordUsage(accountID, configID, tier, originalModel, routedModel string, inputTokens, outputTokens, cacheRead, cacheWrite, reasoning, serverToolRequests int, costUSD float64, dims UsageDimensions, attempts ...Attempt) error {
+	usage := FeatureAvailable(FeatureUsage)
+	if !Writable() || !usage && len(attempts) == 0 {
+		return nil
+	}
+	wConn, err := sql.Open("sqlite3", dbPath()+"?_journal_mode=WAL&_foreign_keys=on")
 	if err != nil {
 		return err
 	}
 	defer wConn.Close()
 
-	tid := ""
-	if len(tenantID) > 0 {
-		tid = tenantID[0]
+	tx, err := wConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if usage {
+		id := generateID()
+		_, err = tx.Exec(`INSERT INTO usage (id, account_id, config_id, tier, original_model, routed_model, input_tokens, output_tokens, cache_read_tokens, cache_write_tokens, reasoning_tokens, server_tool_requests, cost_usd, tenant_id, end_user, tags, request_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			id, nullStr(accountID), nullStr(configID), nullStr(tier), nullStr(originalModel), nullStr(routedModel),
+			inputTokens, outputTokens, cacheRead, cacheWrite, reasoning, serverToolRequests, costUSD,
+			nullStr(dims.TenantID), nullStr(dims.EndUser), nullStr(dims.Tags), nullStr(dims.RequestID))
+		if err != nil {
+			return err
+		}
+	}
+	if err := insertAttempts(tx, dims, attempts); err != nil {
+		// SQLite undoes only the failed statement; the usage row is
+		// worth keeping without the attempts
+		log.Printf("[db] Failed to record failed attempts of request %s: %v", dims.RequestID, err)
 	}
+	return tx.Commit()
+}
 
-	id := generateID()
-	_, err = wConn.Exec(`INSERT INTO usage (id, account_id, config_id, tier, original_model, routed_model, input_tokens, output_tokens, cache_read_tokens, cache_write_tokens, cost_usd, tenant_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		id, nullStr(accountID), nullStr(configID), nullStr(tier), nullStr(originalModel), nullStr(routedModel),
-		inputTokens, outputTokens, cacheRead, cacheWrite, costUSD, nullStr(tid))
-	return err
+// UsageDimensions attribute a request's usage for chargeback: the tenant,
+// the end user the request named (metadata.user_id or OpenAI user), and
+// the tags its caller sent, as a JSON object. RequestID links the usage row
+// to the request's failed attempts.
+type UsageDimensions struct {
+	TenantID  string
+	EndUser   string
+	Tags      string
+	RequestID string
 }
 
-// RecordAccountSuccess updates an account's status to active on success.
+// RecordAccountSuccess updates an account's status to active on success,
+// unless CanTransition keeps it where it is.
 func RecordAccountSuccess(accountID string) {
-	writeExec(`UPDATE accounts SET status = 'active', last_used_at = datetime('now'), error_count = 0, updated_at = datetime('now') WHERE id = ?`, accountID)
+	cond, condArgs := notBlockedFrom(StatusActive)
+	var status string
+	err := writeQueryRow(`UPDATE accounts SET status = CASE WHEN `+cond+` THEN 'active' ELSE status END,
+		last_used_at = datetime('now'), error_count = 0, updated_at = datetime('now') WHERE id = ? RETURNING status`,
+		append(condArgs, accountID), &status)
+	if err == nil {
+		noteStatus(accountID, Status(status))
+	}
 }
 
 // RecordAccountError records an error for an account.
 func RecordAccountError(accountID, errMsg string) {
+	errMsg = redact.String(errMsg)
 	if len(errMsg) > 500 {
 		errMsg = errMsg[:500]
 	}
 	writeExec(`UPDATE accounts SET last_error = ?, last_error_at = datetime('now'), error_count = error_count + 1, updated_at = datetime('now') WHERE id = ?`, errMsg, accountID)
 }
 
-// UpdateAccountStatus updates an account's status.
-func UpdateAccountStatus(accountID, status, errMsg string) {
-	if errMsg != "" {
-		if len(errMsg) > 500 {
-			errMsg = errMsg[:500]
-		}
-		writeExec(`UPDATE accounts SET status = ?, last_error = ?, last_error_at = datetime('now'), updated_at = datetime('now') WHERE id = ?`, status, errMsg, accountID)
-	} else {
-		writeExec(`UPDATE accounts SET status = ?, updated_at = datetime('now') WHERE id = ?`, status, accountID)
+// lastStatus is the status this process last wrote for each account.
+var lastStatus sync.Map
+
+// noteStatus publishes an account status change. Writes that repeat the
+// status this process last wrote aren't changes, so the per-request
+// "active" updates stay quiet.
+func noteStatus(accountID string, status Status) {
+	if !Writable() {
+		return
 	}
+	if prev, loaded := lastStatus.Swap(accountID, status); !loaded || prev != status {
+		events.Publish(events.AccountStatusChanged, accountID)
+	}
+}
+
+// RequestLog is a request_logs row written by the proxy.
+type RequestLog struct {
+	Method        string
+	Path          string
+	InboundFormat string
+	AccountID     string
+	AccountName   string
+	Provider      string
+	OriginalModel string
+	RoutedModel   string
+	// RoutedModelActual is the model the provider reported serving, which may
+	// differ from RoutedModel when the upstream substitutes a snapshot or fallback.
+	RoutedModelActual string
+	StatusCode        int
+	InputTokens       int
+	OutputTokens      int
+	LatencyMs         int
+	IsStream          bool
+	IsFailover        bool
+	ErrorMessage      string
+	RequestBody       string
+	ResponseBody      string
+	TenantID          string
+	TenantKeyLabel    string
+	UpstreamRequestID string
+	// FailoverAttempts is a JSON array of the attempts that failed over before
+	// this one, each with its own upstream request ID.
+	FailoverAttempts string
+	// AnthropicVersion is the anthropic-version header the client sent.
+	AnthropicVersion string
+	// GuardrailsBypassed records a trusted caller's X-CodeGate-Guardrails: off.
+	GuardrailsBypassed bool
+	// EndUser and Tags are the request's UsageDimensions.
+	EndUser string
+	Tags    string
+	// Retries counts the transient failures retried on the same account
+	// before this attempt; they are listed in FailoverAttempts too.
+	Retries int
+	// RequestID is the proxy's ID for the client request, also sent back in
+	// X-Proxy-Request-Id and recorded on its usage row.
+	RequestID string
+	// ClientRequestID is the X-Request-Id the client sent, if any. Unlike
+	// RequestID it isn't unique.
+	ClientRequestID string
 }
 
 // InsertRequestLog inserts a request log entry.
-func InsertRequestLog(method, path, inboundFormat, accountID, accountName, provider, originalModel, routedModel string, statusCode, inputTokens, outputTokens, latencyMs int, isStream, isFailover bool, errorMessage, requestBody, responseBody string, tenantID ...string) {
-	streamInt, failoverInt := 0, 0
-	if isStream {
+func InsertRequestLog(l RequestLog) {
+	if !FeatureAvailable(FeatureRequestLogs) {
+		return
+	}
+	streamInt, failoverInt, bypassedInt := 0, 0, 0
+	if l.IsStream {
 		streamInt = 1
 	}
-	if isFailover {
+	if l.IsFailover {
 		failoverInt = 1
 	}
-	tid := ""
-	if len(tenantID) > 0 {
-		tid = tenantID[0]
+	if l.GuardrailsBypassed {
+		bypassedInt = 1
 	}
-	writeExec(`INSERT INTO request_logs (id, method, path, inbound_format, account_id, account_name, provider, original_model, routed_model, status_code, input_tokens, output_tokens, latency_ms, is_stream, is_failover, error_message, request_body, response_body, tenant_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		generateID(), method, path, inboundFormat, accountID, accountName, provider, originalModel, routedModel, statusCode, inputTokens, outputTokens, latencyMs, streamInt, failoverInt, nullStr(errorMessage), nullStr(requestBody), nullStr(responseBody), nullStr(tid))
+	// Upstream error bodies can echo the credential that was rejected
+	l.ErrorMessage = redact.String(l.ErrorMessage)
+	l.FailoverAttempts = redact.String(l.FailoverAttempts)
+	writeExec(`INSERT INTO request_logs (id, method, path, inbound_format, account_id, account_name, provider, original_model, routed_model, routed_model_actual, status_code, input_tokens, output_tokens, latency_ms, is_stream, is_failover, error_message, request_body, response_body, tenant_id, tenant_key_label, upstream_request_id, failover_attempts, anthropic_version, guardrails_bypassed, end_user, tags, retries, request_id, client_request_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		generateID(), l.Method, l.Path, l.InboundFormat, l.AccountID, l.AccountName, l.Provider, l.OriginalModel, l.RoutedModel, nullStr(l.RoutedModelActual),
+		l.StatusCode, l.InputTokens, l.OutputTokens, l.LatencyMs, streamInt, failoverInt,
+		nullStr(l.ErrorMessage), nullStr(l.RequestBody), nullStr(l.ResponseBody), nullStr(l.TenantID), nullStr(l.TenantKeyLabel),
+		nullStr(l.UpstreamRequestID), nullStr(l.FailoverAttempts), nullStr(l.AnthropicVersion), bypassedInt,
+		nullStr(l.EndUser), nullStr(l.Tags), l.Retries, nullStr(l.RequestID), nullStr(l.ClientRequestID))
 }
 
 // TenantRow represents a tenant from the database.
 type TenantRow struct {
-	ID        string
-	Name      string
-	ConfigID  string
-	RateLimit int
-	Enabled   bool
+	ID                  string
+	Name                string
+	ConfigID            string
+	RateLimit           int
+	RateLimitBackground int
+	Enabled             bool
 }
 
 // GetTenantByKeyHash looks up a tenant by API key hash.
 func GetTenantByKeyHash(hash string) *TenantRow {
-	if conn == nil {
+	if conn == nil || !FeatureAvailable(FeatureTenants) {
 		return nil
 	}
 	row := conn.QueryRow(
-		"SELECT id, name, COALESCE(config_id, ''), rate_limit, enabled FROM tenants WHERE api_key_hash = ? AND enabled = 1",
+		"SELECT id, name, COALESCE(config_id, ''), rate_limit, COALESCE(rate_limit_background, 0), enabled FROM tenants WHERE api_key_hash = ? AND enabled = 1",
 		hash,
 	)
 	var t TenantRow
 	var enabledInt int
-	err := row.Scan(&t.ID, &t.Name, &t.ConfigID, &t.RateLimit, &enabledInt)
+	err := row.Scan(&t.ID, &t.Name, &t.ConfigID, &t.RateLimit, &t.RateLimitBackground, &enabledInt)
 	if err != nil {
 		return nil
 	}
@@ -309,9 +518,43 @@ func GetTenantByKeyHash(hash string) *TenantRow {
 	return &t
 }
 
+// TenantKeyRow is an additional tenant API key joined with its tenant.
+type TenantKeyRow struct {
+	KeyID  string
+	Label  string
+	Tenant TenantRow
+}
+
+// GetTenantKeyByHash looks up an enabled, unexpired tenant_keys entry by hash.
+// Returns nil if no key matches or the table doesn't exist.
+func GetTenantKeyByHash(hash string) *TenantKeyRow {
+	if conn == nil || !FeatureAvailable(FeatureTenants) {
+		return nil
+	}
+	row := conn.QueryRow(`SELECT k.id, COALESCE(k.label, ''), t.id, t.name, COALESCE(t.config_id, ''), t.rate_limit,
+		COALESCE(t.rate_limit_background, 0), t.enabled
+		FROM tenant_keys k JOIN tenants t ON t.id = k.tenant_id
+		WHERE k.key_hash = ? AND k.enabled = 1 AND t.enabled = 1
+		AND (k.expires_at IS NULL OR k.expires_at > datetime('now'))`, hash)
+	var k TenantKeyRow
+	var enabledInt int
+	err := row.Scan(&k.KeyID, &k.Label, &k.Tenant.ID, &k.Tenant.Name, &k.Tenant.ConfigID, &k.Tenant.RateLimit,
+		&k.Tenant.RateLimitBackground, &enabledInt)
+	if err != nil {
+		return nil
+	}
+	k.Tenant.Enabled = enabledInt == 1
+	return &k
+}
+
+// TouchTenantKey records that a tenant key was just used.
+func TouchTenantKey(keyID string) {
+	writeExec(`UPDATE tenant_keys SET last_used_at = datetime('now') WHERE id = ?`, keyID)
+}
+
 // GetTenantSettings returns all settings for a tenant.
 func GetTenantSettings(tenantID string) map[string]string {
-	if conn == nil {
+	if conn == nil || !FeatureAvailable(FeatureTenants) {
 		return nil
 	}
 	rows, err := conn.Query("SELECT key, value FROM tenant_settings WHERE tenant_id = ?", tenantID)
@@ -329,14 +572,44 @@ func GetTenantSettings(tenantID string) map[string]string {
 	return settings
 }
 
-// HasTenants checks if any tenants exist. Returns false if table doesn't exist.
+// TenantSettingValues returns the values tenants have set for a setting.
+func TenantSettingValues(key string) []string {
+	if conn == nil || !FeatureAvailable(FeatureTenants) {
+		return nil
+	}
+	rows, err := conn.Query("SELECT value FROM tenant_settings WHERE key = ? AND value != ''", key)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err == nil {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// HasTenants checks if any tenants exist. Returns false if the table doesn't
+// exist. It looks even when CheckSchema disabled tenants, and counts any
+// other error as tenants existing, so a schema problem can't turn tenant
+// authentication off.
 func HasTenants() bool {
 	if conn == nil {
 		return false
 	}
 	var dummy int
 	err := conn.QueryRow("SELECT 1 FROM tenants LIMIT 1").Scan(&dummy)
-	return err == nil
+	switch {
+	case err == nil:
+		return true
+	case err == sql.ErrNoRows, strings.Contains(err.Error(), "no such table"):
+		return false
+	}
+	log.Printf("[db] Failed to check for tenants, assuming they exist: %v", err)
+	return true
 }
 
 // GetConfigByID returns a config by its specific ID.
@@ -358,15 +631,25 @@ func GetConfigByID(id string) (*Config, error) {
 	return &c, nil
 }
 
+// dbPath returns the shared database path under DATA_DIR.
+func dbPath() string {
+	return filepath.Join(dataDir(), "codegate.db")
+}
+
+func dataDir() string {
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		return dir
+	}
+	return "./data"
+}
+
 // writeExec opens a write connection and executes a statement.
+// Skipped when the database is read-only (see CheckWritable).
 func writeExec(query string, args ...any) {
-	dataDir := os.Getenv("DATA_DIR")
-	if dataDir == "" {
-		dataDir = "./data"
+	if !Writable() {
+		return
 	}
-	dbPath := filepath.Join(dataDir, "codegate.db")
-
-	wConn, err := sql.Open("sqlite3", dbPath+"?_journal_mode=WAL&_foreign_keys=on")
+	wConn, err := sql.Open("sqlite3", dbPath()+"?_journal_mode=WAL&_foreign_keys=on")
 	if err != nil {
 		return
 	}
@@ -399,57 +682,34 @@ var cryptoRandRead = func(b []byte) (int, error) {
 	return randRead(b)
 }
 
-// getEncryptionKey reads the account encryption key from the data directory.
-// Compatible with Node.js which stores the key at DATA_DIR/.account-key
-// (hex-encoded 32-byte key). Falls back to legacy .master-key.
-func getEncryptionKey() []byte {
-	dataDir := os.Getenv("DATA_DIR")
-	if dataDir == "" {
-		dataDir = "./data"
-	}
-
-	// Try .account-key first (current Node.js format), then legacy .master-key
-	for _, name := range []string{".account-key", ".master-key", "encryption.key"} {
-		keyPath := filepath.Join(dataDir, name)
-		data, err := os.ReadFile(keyPath)
-		if err != nil {
-			continue
-		}
-		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
-		if err != nil {
-			continue
-		}
-		if len(key) == 32 {
-			return key
-		}
-	}
-	return nil
-}
-
 // encryptValue encrypts a value with AES-256-GCM using 16-byte IV.
 // Output format: base64(iv[16] + ciphertext + authTag[16]) — compatible with Node.js.
-func encryptValue(value string, key []byte) string {
-	if key == nil || value == "" {
-		return ""
+// Empty values encrypt to "".
+func encryptValue(value string, key []byte) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if key == nil {
+		return "", errNoAccountKey
 	}
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return ""
+		return "", err
 	}
 	aesGCM, err := cipher.NewGCMWithNonceSize(block, 16)
 	if err != nil {
-		return ""
+		return "", err
 	}
 	iv := make([]byte, 16)
 	if _, err := rand.Read(iv); err != nil {
-		return ""
+		return "", err
 	}
 	ciphertext := aesGCM.Seal(nil, iv, []byte(value), nil)
 	// Combine iv + ciphertext+tag, base64 encode
 	combined := make([]byte, 0, len(iv)+len(ciphertext))
 	combined = append(combined, iv...)
 	combined = append(combined, ciphertext...)
-	return base64.StdEncoding.EncodeToString(combined)
+	return base64.StdEncoding.EncodeToString(combined), nil
 }
 
 // decryptValue decrypts an AES-256-GCM encrypted value.
@@ -508,12 +768,41 @@ func decryptValue(encrypted string, key []byte) string {
 }
 
 // UpdateAccountTokens updates an account's access/refresh tokens and expiry.
-func UpdateAccountTokens(id, accessToken, refreshToken string, expiresAt int64) {
-	encKey := getEncryptionKey()
-	encAccess := encryptValue(accessToken, encKey)
-	encRefresh := encryptValue(refreshToken, encKey)
+// When the database is read-only the tokens are kept in memory instead.
+//
+// If the tokens can't be encrypted (no account key can be loaded or
+// created), the stored tokens are left alone, the new ones are kept in
+// memory, and the error is returned.
+func UpdateAccountTokens(id, accessToken, refreshToken string, expiresAt int64) error {
+	if !Writable() {
+		setTokenOverlay(id, accessToken, refreshToken, expiresAt)
+		return nil
+	}
+	encAccess, encRefresh, err := encryptTokens(accessToken, refreshToken)
+	if err != nil {
+		setTokenOverlay(id, accessToken, refreshToken, expiresAt)
+		return fmt.Errorf("encrypt tokens for account %s: %w", id, err)
+	}
 	writeExec(`UPDATE accounts SET api_key_enc = ?, refresh_token_enc = ?, token_expires_at = ?, status = 'active', updated_at = datetime('now') WHERE id = ?`,
 		encAccess, encRefresh, expiresAt, id)
+	noteStatus(id, StatusActive)
+	return nil
+}
+
+func encryptTokens(accessToken, refreshToken string) (string, string, error) {
+	encKey, err := ensureEncryptionKey()
+	if err != nil {
+		return "", "", err
+	}
+	encAccess, err := encryptValue(accessToken, encKey)
+	if err != nil {
+		return "", "", err
+	}
+	encRefresh, err := encryptValue(refreshToken, encKey)
+	if err != nil {
+		return "", "", err
+	}
+	return encAccess, encRefresh, nil
 }
 
 // GetOAuthAccounts returns all enabled OAuth accounts with decrypted keys.
@@ -521,7 +810,10 @@ func GetOAuthAccounts() ([]Account, error) {
 	rows, err := conn.Query(`SELECT id, name, provider, auth_type, api_key_enc, refresh_token_enc,
 		token_expires_at, base_url, priority, rate_limit, monthly_budget, enabled,
 		COALESCE(subscription_type, ''), COALESCE(account_email, ''),
-		COALESCE(external_account_id, ''), COALESCE(status, 'unknown'), COALESCE(error_count, 0)
+		COALESCE(external_account_id, ''), COALESCE(status, 'unknown'), COALESCE(error_count, 0),
+		COALESCE(api_flavor, ''), COALESCE(allowed_betas, ''), daily_budget, COALESCE(anthropic_version, ''), COALESCE(openrouter_prefs, ''),
+		COALESCE(failover_enabled, 1) = 0, max_failover_candidates, COALESCE(system_prompt_prefix, ''),
+		COALESCE(connect_timeout_ms, 0), COALESCE(header_timeout_ms, 0), COALESCE(response_timeout_ms, 0), COALESCE(simulator_settings, '')
 		FROM accounts WHERE auth_type = 'oauth' AND enabled = 1`)
 	if err != nil {
 		return nil, err
@@ -540,7 +832,9 @@ func GetOAuthAccounts() ([]Account, error) {
 			&apiKeyEnc, &refreshTokenEnc, &a.TokenExpiresAt,
 			&baseURL, &a.Priority, &a.RateLimit, &a.MonthlyBudget,
 			&enabledInt, &a.SubscriptionType, &a.AccountEmail,
-			&a.ExternalAccountID, &a.Status, &a.ErrorCount)
+			&a.ExternalAccountID, &a.Status, &a.ErrorCount, &a.APIFlavor, &a.AllowedBetas, &a.DailyBudget, &a.AnthropicVersion, &a.OpenRouterPrefs,
+			&a.NoFailover, &a.MaxFailoverCandidates, &a.SystemPromptPrefix,
+			&a.ConnectTimeoutMs, &a.HeaderTimeoutMs, &a.ResponseTimeoutMs, &a.SimulatorSettings)
 		if err != nil {
 			return nil, fmt.Errorf("scan account: %w", err)
 		}
@@ -554,6 +848,7 @@ func GetOAuthAccounts() ([]Account, error) {
 		if refreshTokenEnc.Valid && refreshTokenEnc.String != "" {
 			a.RefreshToken = decryptValue(refreshTokenEnc.String, encKey)
 		}
+		applyTokenOverlay(&a)
 		accounts = append(accounts, a)
 	}
 	return accounts, rows.Err()
@@ -564,7 +859,10 @@ func GetAccount(id string) *Account {
 	row := conn.QueryRow(`SELECT id, name, provider, auth_type, api_key_enc, refresh_token_enc,
 		token_expires_at, base_url, priority, rate_limit, monthly_budget, enabled,
 		COALESCE(subscription_type, ''), COALESCE(account_email, ''),
-		COALESCE(external_account_id, ''), COALESCE(status, 'unknown'), COALESCE(error_count, 0)
+		COALESCE(external_account_id, ''), COALESCE(status, 'unknown'), COALESCE(error_count, 0),
+		COALESCE(api_flavor, ''), COALESCE(allowed_betas, ''), daily_budget, COALESCE(anthropic_version, ''), COALESCE(openrouter_prefs, ''),
+		COALESCE(failover_enabled, 1) = 0, max_failover_candidates, COALESCE(system_prompt_prefix, ''),
+		COALESCE(connect_timeout_ms, 0), COALESCE(header_timeout_ms, 0), COALESCE(response_timeout_ms, 0), COALESCE(simulator_settings, '')
 		FROM accounts WHERE id = ?`, id)
 
 	var a Account
@@ -576,7 +874,9 @@ func GetAccount(id string) *Account {
 		&apiKeyEnc, &refreshTokenEnc, &a.TokenExpiresAt,
 		&baseURL, &a.Priority, &a.RateLimit, &a.MonthlyBudget,
 		&enabledInt, &a.SubscriptionType, &a.AccountEmail,
-		&a.ExternalAccountID, &a.Status, &a.ErrorCount)
+		&a.ExternalAccountID, &a.Status, &a.ErrorCount, &a.APIFlavor, &a.AllowedBetas, &a.DailyBudget, &a.AnthropicVersion, &a.OpenRouterPrefs,
+		&a.NoFailover, &a.MaxFailoverCandidates, &a.SystemPromptPrefix,
+		&a.ConnectTimeoutMs, &a.HeaderTimeoutMs, &a.ResponseTimeoutMs, &a.SimulatorSettings)
 	if err != nil {
 		return nil
 	}
@@ -591,5 +891,6 @@ func GetAccount(id string) *Account {
 	if refreshTokenEnc.Valid && refreshTokenEnc.String != "" {
 		a.RefreshToken = decryptValue(refreshTokenEnc.String, encKey)
 	}
+	applyTokenOverlay(&a)
 	return &a
 }
@@ -0,0 +1,227 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// UsageFilter selects usage rows for export. From and To are inclusive
+// YYYY-MM-DD dates; Limit caps the rows returned (0 = no cap). Rows must
+// carry every one of Tags.
+type UsageFilter struct {
+	From     string
+	To       string
+	TenantID string
+	EndUser  string
+	Tags     map[string]string
+	Limit    int
+}
+
+// UsageRecord is one usage row joined with its account and tenant names.
+type UsageRecord struct {
+	CreatedAt          string            `json:"created_at"`
+	AccountID          string            `json:"account_id"`
+	AccountName        string            `json:"account_name"`
+	TenantID           string            `json:"tenant_id"`
+	TenantName         string            `json:"tenant_name"`
+	ConfigID           string            `json:"config_id"`
+	Tier               string            `json:"tier"`
+	OriginalModel      string            `json:"original_model"`
+	RoutedModel        string            `json:"routed_model"`
+	InputTokens        int               `json:"input_tokens"`
+	OutputTokens       int               `json:"output_tokens"`
+	CacheReadTokens    int               `json:"cache_read_tokens"`
+	CacheWriteTokens   int               `json:"cache_write_tokens"`
+	ServerToolRequests int               `json:"server_tool_requests"`
+	CostUSD            float64           `json:"cost_usd"`
+	EndUser            string            `json:"end_user"`
+	Tags               map[string]string `json:"tags,omitempty"`
+}
+
+// UsageGroup is usage aggregated by one of UsageGroupings.
+type UsageGroup struct {
+	Key              string  `json:"key"`
+	Name             string  `json:"name"`
+	Requests         int     `json:"requests"`
+	InputTokens      int     `json:"input_tokens"`
+	OutputTokens     int     `json:"output_tokens"`
+	CacheReadTokens  int     `json:"cache_read_tokens"`
+	CacheWriteTokens int     `json:"cache_write_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+// UsageGroupings maps each supported grouping to its key and name columns.
+var UsageGroupings = map[string][2]string{
+	"day":      {"date(u.created_at)", "''"},
+	"account":  {"COALESCE(u.account_id, '')", "COALESCE(MAX(a.name), '')"},
+	"tenant":   {"COALESCE(u.tenant_id, '')", "COALESCE(MAX(t.name), '')"},
+	"model":    {"COALESCE(u.routed_model, '')", "''"},
+	"end_user": {"COALESCE(u.end_user, '')", "''"},
+}
+
+// tagGroupPrefix groups by the value of one tag: "tag:team".
+const tagGroupPrefix = "tag:"
+
+var tagKeyPattern = regexp.MustCompile(`^[a-z0-9_.-]{1,32}$`)
+
+// ValidTagKey reports whether key can name a usage tag: lowercase letters,
+// digits, and _.- up to 32 characters.
+func ValidTagKey(key string) bool {
+	return tagKeyPattern.MatchString(key)
+}
+
+// UsageGrouping returns the key and name columns for group: one of
+// UsageGroupings, or "tag:<key>".
+func UsageGrouping(group string) ([2]string, bool) {
+	if key, ok := strings.CutPrefix(group, tagGroupPrefix); ok {
+		if !ValidTagKey(key) {
+			return [2]string{}, false
+		}
+		return [2]string{"COALESCE(json_extract(u.tags, '" + tagPath(key) + "'), '')", "''"}, true
+	}
+	cols, ok := UsageGroupings[group]
+	return cols, ok
+}
+
+// tagPath is the JSON path of a tag in the tags column. Keys are checked
+// with ValidTagKey, so they never need escaping.
+func tagPath(key string) string {
+	return `$."` + key + `"`
+}
+
+// ParseStoredTags decodes a tags column value; "" has no tags.
+func ParseStoredTags(s string) map[string]string {
+	if s == "" {
+		return nil
+	}
+	var tags map[string]string
+	json.Unmarshal([]byte(s), &tags)
+	return tags
+}
+
+// filterFrom builds the FROM and WHERE clauses shared by the export
+// queries, over usage or request_attempts, which have the same
+// attribution columns. Tenant names are left empty when CheckSchema
+// disabled tenants.
+func filterFrom(table string, f UsageFilter) (string, []any) {
+	from := ` FROM ` + table + ` u LEFT JOIN accounts a ON a.id = u.account_id`
+	if FeatureAvailable(FeatureTenants) {
+		from += ` LEFT JOIN tenants t ON t.id = u.tenant_id`
+	} else {
+		from += ` LEFT JOIN (SELECT NULL AS id, NULL AS name) t ON 0`
+	}
+
+	var where []string
+	var args []any
+	if f.From != "" {
+		where = append(where, "u.created_at >= ?")
+		args = append(args, f.From)
+	}
+	if f.To != "" {
+		where = append(where, "u.created_at < date(?, '+1 day')")
+		args = append(args, f.To)
+	}
+	if f.TenantID != "" {
+		where = append(where, "u.tenant_id = ?")
+		args = append(args, f.TenantID)
+	}
+	if f.EndUser != "" {
+		where = append(where, "u.end_user = ?")
+		args = append(args, f.EndUser)
+	}
+	keys := make([]string, 0, len(f.Tags))
+	for k := range f.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		where = append(where, "json_extract(u.tags, ?) = ?")
+		args = append(args, tagPath(k), f.Tags[k])
+	}
+	if len(where) > 0 {
+		from += " WHERE " + strings.Join(where, " AND ")
+	}
+	return from, args
+}
+
+func limitClause(f UsageFilter) string {
+	if f.Limit > 0 {
+		return fmt.Sprintf(" LIMIT %d", f.Limit)
+	}
+	return ""
+}
+
+// StreamUsage calls fn for each matching usage row, oldest first, reading
+// from a cursor so large exports aren't held in memory. It stops at the
+// first error from fn or when ctx is cancelled.
+func StreamUsage(ctx context.Context, f UsageFilter, fn func(UsageRecord) error) error {
+	if conn == nil {
+		return fmt.Errorf("db not open")
+	}
+	from, args := filterFrom("usage", f)
+	rows, err := conn.QueryContext(ctx, `SELECT u.created_at, COALESCE(u.account_id, ''), COALESCE(a.name, ''),
+		COALESCE(u.tenant_id, ''), COALESCE(t.name, ''), COALESCE(u.config_id, ''), COALESCE(u.tier, ''),
+		COALESCE(u.original_model, ''), COALESCE(u.routed_model, ''),
+		COALESCE(u.input_tokens, 0), COALESCE(u.output_tokens, 0),
+		COALESCE(u.cache_read_tokens, 0), COALESCE(u.cache_write_tokens, 0),
+		COALESCE(u.server_tool_requests, 0), COALESCE(u.cost_usd, 0),
+		COALESCE(u.end_user, ''), COALESCE(u.tags, '')`+
+		from+` ORDER BY u.created_at, u.rowid`+limitClause(f), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r UsageRecord
+		var tags string
+		if err := rows.Scan(&r.CreatedAt, &r.AccountID, &r.AccountName, &r.TenantID, &r.TenantName,
+			&r.ConfigID, &r.Tier, &r.OriginalModel, &r.RoutedModel, &r.InputTokens, &r.OutputTokens,
+			&r.CacheReadTokens, &r.CacheWriteTokens, &r.ServerToolRequests, &r.CostUSD,
+			&r.EndUser, &tags); err != nil {
+			return err
+		}
+		r.Tags = ParseStoredTags(tags)
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// StreamUsageGroups is StreamUsage aggregated by a UsageGrouping.
+func StreamUsageGroups(ctx context.Context, f UsageFilter, group string, fn func(UsageGroup) error) error {
+	if conn == nil {
+		return fmt.Errorf("db not open")
+	}
+	cols, ok := UsageGrouping(group)
+	if !ok {
+		return fmt.Errorf("unknown grouping %q", group)
+	}
+	from, args := filterFrom("usage", f)
+	rows, err := conn.QueryContext(ctx, `SELECT `+cols[0]+` AS k, `+cols[1]+`, COUNT(*),
+		COALESCE(SUM(u.input_tokens), 0), COALESCE(SUM(u.output_tokens), 0),
+		COALESCE(SUM(u.cache_read_tokens), 0), COALESCE(SUM(u.cache_write_tokens), 0),
+		COALESCE(SUM(u.cost_usd), 0)`+
+		from+` GROUP BY k ORDER BY k`+limitClause(f), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var g UsageGroup
+		if err := rows.Scan(&g.Key, &g.Name, &g.Requests, &g.InputTokens, &g.OutputTokens,
+			&g.CacheReadTokens, &g.CacheWriteTokens, &g.CostUSD); err != nil {
+			return err
+		}
+		if err := fn(g); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,178 @@
+package db
+
+import (
+	"codegate-proxy/internal/redact"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status is an account's state as stored in accounts.status and shown on
+// the dashboard.
+type Status string
+
+const (
+	StatusUnknown     Status = "unknown"      // not used yet, or a stale status was cleared
+	StatusActive      Status = "active"       // the last request succeeded
+	StatusError       Status = "error"        // the last request failed upstream
+	StatusRateLimited Status = "rate_limited" // the last request was answered with a 429
+	StatusExpired     Status = "expired"      // the account's credentials were rejected
+
+	// StatusMisconfigured marks an account whose settings can't produce a
+	// working upstream request, such as a base_url without a scheme.
+	StatusMisconfigured Status = "misconfigured"
+)
+
+var statuses = []Status{StatusUnknown, StatusActive, StatusError, StatusRateLimited, StatusExpired, StatusMisconfigured}
+
+// Valid reports whether s is a status the proxy and dashboard know.
+func (s Status) Valid() bool {
+	return slices.Contains(statuses, s)
+}
+
+// Transient reports whether s describes one failed request rather than the
+// account itself, so it goes stale once nothing has updated it for a while.
+func (s Status) Transient() bool {
+	return s == StatusError || s == StatusRateLimited
+}
+
+// CanTransition reports whether the proxy may move an account from one
+// status to another. Expired credentials stay expired until a token refresh
+// (UpdateAccountTokens) or until the dashboard re-enables the account or
+// replaces its credentials: a 429 or a success on some other path says
+// nothing about them. A status the proxy doesn't know can be replaced.
+func CanTransition(from, to Status) bool {
+	if from == StatusExpired {
+		return to == StatusExpired || to == StatusMisconfigured
+	}
+	return true
+}
+
+// blockedFrom returns the statuses an account can't move to status from.
+func blockedFrom(status Status) []any {
+	var blocked []any
+	for _, from := range statuses {
+		if !CanTransition(from, status) {
+			blocked = append(blocked, string(from))
+		}
+	}
+	return blocked
+}
+
+// notBlockedFrom returns an SQL condition on accounts.status, and its
+// arguments, that holds when the account may move to status.
+func notBlockedFrom(status Status) (string, []any) {
+	blocked := blockedFrom(status)
+	if len(blocked) == 0 {
+		return "1", nil
+	}
+	return "COALESCE(status, 'unknown') NOT IN (?" + strings.Repeat(", ?", len(blocked)-1) + ")", blocked
+}
+
+// SetStatus moves an account to status, recording errMsg as its last error
+// when it is not empty. It reports whether the status was written; a
+// transition CanTransition refuses leaves the account as it was.
+func SetStatus(accountID string, status Status, errMsg string) bool {
+	cond, condArgs := notBlockedFrom(status)
+	query := `UPDATE accounts SET status = ?, updated_at = datetime('now')`
+	args := []any{string(status)}
+	if errMsg != "" {
+		errMsg = redact.String(errMsg)
+		if len(errMsg) > 500 {
+			errMsg = errMsg[:500]
+		}
+		query += `, last_error = ?, last_error_at = datetime('now')`
+		args = append(args, errMsg)
+	}
+	query += ` WHERE id = ? AND ` + cond + ` RETURNING status`
+	args = append(append(args, accountID), condArgs...)
+
+	var written Status
+	if err := writeQueryRow(query, args, &written); err != nil {
+		return false
+	}
+	noteStatus(accountID, status)
+	return true
+}
+
+// writeQueryRow runs a write statement with a RETURNING clause and scans
+// its row into dest. sql.ErrNoRows means the statement matched no row.
+func writeQueryRow(query string, args []any, dest ...any) error {
+	if !Writable() {
+		return errors.New("database is read-only")
+	}
+	wConn, err := sql.Open("sqlite3", dbPath()+"?_journal_mode=WAL&_foreign_keys=on")
+	if err != nil {
+		return err
+	}
+	defer wConn.Close()
+	return wConn.QueryRow(query, args...).Scan(dest...)
+}
+
+// defaultStaleStatusAge is how long an error or rate_limited status is kept
+// across a restart when stale_status_minutes is unset.
+const defaultStaleStatusAge = time.Hour
+
+// StaleStatusAge reads stale_status_minutes, the age past which a transient
+// status is cleared at startup. 0 keeps them.
+func StaleStatusAge() time.Duration {
+	if m, err := strconv.Atoi(GetSetting("stale_status_minutes")); err == nil && m >= 0 {
+		return time.Duration(m) * time.Minute
+	}
+	return defaultStaleStatusAge
+}
+
+// NormalizeAccountStatuses is run once at startup. It resets statuses the
+// proxy doesn't know to unknown, and clears error and rate_limited statuses
+// that nothing has updated for maxAge, since they describe requests made
+// before the restart. A maxAge of 0 keeps transient statuses.
+func NormalizeAccountStatuses(maxAge time.Duration) {
+	if !Writable() {
+		return
+	}
+	wConn, err := sql.Open("sqlite3", dbPath()+"?_journal_mode=WAL&_foreign_keys=on")
+	if err != nil {
+		log.Printf("[db] Failed to open DB to normalize account statuses: %v", err)
+		return
+	}
+	defer wConn.Close()
+
+	known := make([]any, len(statuses))
+	for i, s := range statuses {
+		known[i] = string(s)
+	}
+	res, err := wConn.Exec(`UPDATE accounts SET status = 'unknown', updated_at = datetime('now')
+		WHERE status IS NULL OR status NOT IN (?`+strings.Repeat(", ?", len(known)-1)+`)`, known...)
+	if err != nil {
+		log.Printf("[db] Failed to normalize account statuses: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("[db] Reset %d account(s) with an unrecognized status to unknown", n)
+	}
+
+	if maxAge <= 0 {
+		return
+	}
+	var transient []any
+	for _, s := range statuses {
+		if s.Transient() {
+			transient = append(transient, string(s))
+		}
+	}
+	res, err = wConn.Exec(`UPDATE accounts SET status = 'unknown', updated_at = datetime('now')
+		WHERE status IN (?`+strings.Repeat(", ?", len(transient)-1)+`) AND updated_at < datetime('now', ?)`,
+		append(transient, fmt.Sprintf("-%d seconds", int64(maxAge.Seconds())))...)
+	if err != nil {
+		log.Printf("[db] Failed to clear stale account statuses: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("[db] Cleared %d stale error/rate_limited account status(es) older than %v", n, maxAge)
+	}
+}
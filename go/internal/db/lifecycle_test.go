@@ -0,0 +1,112 @@
+package db_test
+
+import (
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/dbtest"
+	"testing"
+	"time"
+)
+
+func accountStatus(t *testing.T, tdb *dbtest.DB, id string) db.Status {
+	t.Helper()
+	var status db.Status
+	if err := tdb.QueryRow("SELECT status FROM accounts WHERE id = ?", id).Scan(&status); err != nil {
+		t.Fatalf("status of %s: %v", id, err)
+	}
+	return status
+}
+
+func TestSetStatus_Transitions(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.AddAccount("acct-life", "life", "anthropic", "")
+
+	if !db.SetStatus("acct-life", db.StatusRateLimited, "Rate limited (429)") {
+		t.Fatal("unknown -> rate_limited refused")
+	}
+	db.RecordAccountSuccess("acct-life")
+	if got := accountStatus(t, tdb, "acct-life"); got != db.StatusActive {
+		t.Fatalf("after a success status = %q, want active", got)
+	}
+
+	if !db.SetStatus("acct-life", db.StatusExpired, "Authentication failed (401)") {
+		t.Fatal("active -> expired refused")
+	}
+	if db.SetStatus("acct-life", db.StatusRateLimited, "Rate limited (429)") {
+		t.Error("expired -> rate_limited allowed")
+	}
+	db.RecordAccountSuccess("acct-life")
+	var lastError string
+	tdb.QueryRow("SELECT last_error FROM accounts WHERE id = 'acct-life'").Scan(&lastError)
+	if got := accountStatus(t, tdb, "acct-life"); got != db.StatusExpired || lastError != "Authentication failed (401)" {
+		t.Errorf("status = %q, last_error = %q; want expired kept with its error", got, lastError)
+	}
+
+	// A token refresh is what clears it
+	if err := db.UpdateAccountTokens("acct-life", "fresh-access", "fresh-refresh", 5000); err != nil {
+		t.Fatalf("UpdateAccountTokens: %v", err)
+	}
+	if got := accountStatus(t, tdb, "acct-life"); got != db.StatusActive {
+		t.Errorf("after a token refresh status = %q, want active", got)
+	}
+}
+
+func TestCanTransition(t *testing.T) {
+	for _, tc := range []struct {
+		from, to db.Status
+		want     bool
+	}{
+		{db.StatusActive, db.StatusRateLimited, true},
+		{db.StatusRateLimited, db.StatusActive, true},
+		{db.StatusMisconfigured, db.StatusActive, true},
+		{db.StatusExpired, db.StatusActive, false},
+		{db.StatusExpired, db.StatusError, false},
+		{db.StatusExpired, db.StatusMisconfigured, true},
+		{"typo", db.StatusActive, true},
+	} {
+		if got := db.CanTransition(tc.from, tc.to); got != tc.want {
+			t.Errorf("CanTransition(%s, %s) = %v", tc.from, tc.to, got)
+		}
+	}
+}
+
+func TestNormalizeAccountStatuses(t *testing.T) {
+	tdb := dbtest.Open(t)
+	for id, row := range map[string]struct{ status, updatedAt string }{
+		"acct-typo":         {"'rate-limited'", "datetime('now')"},
+		"acct-null":         {"NULL", "datetime('now')"},
+		"acct-stale-429":    {"'rate_limited'", "datetime('now', '-2 hours')"},
+		"acct-stale-error":  {"'error'", "datetime('now', '-2 hours')"},
+		"acct-recent-error": {"'error'", "datetime('now', '-5 minutes')"},
+		"acct-old-expired":  {"'expired'", "datetime('now', '-2 days')"},
+		"acct-old-active":   {"'active'", "datetime('now', '-2 days')"},
+	} {
+		tdb.AddAccount(id, id, "anthropic", "")
+		tdb.Exec("UPDATE accounts SET status = " + row.status + ", updated_at = " + row.updatedAt + " WHERE id = '" + id + "'")
+	}
+
+	db.NormalizeAccountStatuses(time.Hour)
+	for id, want := range map[string]db.Status{
+		"acct-typo":         db.StatusUnknown,
+		"acct-null":         db.StatusUnknown,
+		"acct-stale-429":    db.StatusUnknown,
+		"acct-stale-error":  db.StatusUnknown,
+		"acct-recent-error": db.StatusError,
+		"acct-old-expired":  db.StatusExpired,
+		"acct-old-active":   db.StatusActive,
+	} {
+		if got := accountStatus(t, tdb, id); got != want {
+			t.Errorf("%s: status = %q, want %q", id, got, want)
+		}
+	}
+}
+
+func TestStaleStatusAge(t *testing.T) {
+	tdb := dbtest.Open(t)
+	if got := db.StaleStatusAge(); got != time.Hour {
+		t.Errorf("default = %v, want 1h", got)
+	}
+	tdb.SetSetting("stale_status_minutes", "0")
+	if got := db.StaleStatusAge(); got != 0 {
+		t.Errorf("stale_status_minutes=0: %v, want 0", got)
+	}
+}
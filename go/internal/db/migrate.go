@@ -0,0 +1,88 @@
+package db
+
+import (
+	"database/sql"
+	"log"
+)
+
+// proxyColumns lists columns the Go proxy reads or writes that were added after
+// the original schema. The dashboard adds the same columns in its initDB
+// migrations; the proxy adds them too so it can run against a database created
+// by an older dashboard.
+var proxyColumns = []struct {
+	table, column, ddl string
+}{
+	{"accounts", "api_flavor", "TEXT"},
+	{"accounts", "allowed_betas", "TEXT"},
+	{"accounts", "daily_budget", "REAL"},
+	{"accounts", "anthropic_version", "TEXT"},
+	{"accounts", "openrouter_prefs", "TEXT"},
+	{"accounts", "failover_enabled", "INTEGER"},
+	{"accounts", "max_failover_candidates", "INTEGER"},
+	{"accounts", "system_prompt_prefix", "TEXT"},
+	{"accounts", "connect_timeout_ms", "INTEGER"},
+	{"accounts", "header_timeout_ms", "INTEGER"},
+	{"accounts", "response_timeout_ms", "INTEGER"},
+	{"accounts", "simulator_settings", "TEXT"},
+	{"config_tiers", "condition", "TEXT"},
+	{"config_tiers", "fallback_models", "TEXT"},
+	{"tenants", "rate_limit_background", "INTEGER DEFAULT 0"},
+	{"usage", "server_tool_requests", "INTEGER DEFAULT 0"},
+	{"usage", "reasoning_tokens", "INTEGER DEFAULT 0"},
+	{"usage", "end_user", "TEXT"},
+	{"usage", "tags", "TEXT"},
+	{"usage", "request_id", "TEXT"},
+	{"request_logs", "routed_model_actual", "TEXT"},
+	{"request_logs", "tenant_key_label", "TEXT"},
+	{"request_logs", "upstream_request_id", "TEXT"},
+	{"request_logs", "failover_attempts", "TEXT"},
+	{"request_logs", "anthropic_version", "TEXT"},
+	{"request_logs", "guardrails_bypassed", "INTEGER DEFAULT 0"},
+	{"request_logs", "end_user", "TEXT"},
+	{"request_logs", "tags", "TEXT"},
+	{"request_logs", "retries", "INTEGER DEFAULT 0"},
+	{"request_logs", "request_id", "TEXT"},
+	{"request_logs", "client_request_id", "TEXT"},
+}
+
+// EnsureProxyColumns adds any missing proxy-owned columns to existing tables.
+// Tables that do not exist yet are left for the dashboard to create.
+func EnsureProxyColumns() {
+	if !Writable() {
+		return
+	}
+	wConn, err := sql.Open("sqlite3", dbPath()+"?_journal_mode=WAL&_foreign_keys=on")
+	if err != nil {
+		log.Printf("[db] Failed to open DB for migrations: %v", err)
+		return
+	}
+	defer wConn.Close()
+
+	for _, c := range proxyColumns {
+		cols, err := tableColumns(wConn, c.table)
+		if err != nil || len(cols) == 0 || cols[c.column] {
+			continue
+		}
+		if _, err := wConn.Exec("ALTER TABLE " + c.table + " ADD COLUMN " + c.column + " " + c.ddl); err != nil {
+			log.Printf("[db] Failed to add %s.%s: %v", c.table, c.column, err)
+		}
+	}
+}
+
+func tableColumns(conn *sql.DB, table string) (map[string]bool, error) {
+	rows, err := conn.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		cols[name] = true
+	}
+	return cols, rows.Err()
+}
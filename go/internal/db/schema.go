@@ -0,0 +1,243 @@
+package db
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Features that CheckSchema can disable when the dashboard's schema is too
+// old to support them.
+const (
+	FeatureTenants     = "tenants"
+	FeatureRequestLogs = "request logs"
+	FeatureUsage       = "usage recording"
+)
+
+// expectedColumn is a column the proxy's queries rely on. ddl is used by
+// auto-migration to add the column; columns with no ddl are part of the
+// table's original definition and can only come from the dashboard.
+type expectedColumn struct {
+	table, column, ddl string
+}
+
+// schemaFeatures maps each feature to the columns its queries use. Accounts
+// and config tiers are checked too, but routing can't be disabled, so
+// missing routing columns are only reported.
+var schemaFeatures = []struct {
+	feature string
+	columns []expectedColumn
+}{
+	{"accounts", []expectedColumn{
+		{"accounts", "id", ""},
+		{"accounts", "subscription_type", "TEXT"},
+		{"accounts", "account_email", "TEXT"},
+		{"accounts", "external_account_id", "TEXT"},
+		{"accounts", "status", "TEXT DEFAULT 'unknown'"},
+		{"accounts", "error_count", "INTEGER DEFAULT 0"},
+		{"accounts", "last_error", "TEXT"},
+		{"accounts", "last_error_at", "TEXT"},
+		{"accounts", "last_used_at", "TEXT"},
+		{"accounts", "api_flavor", "TEXT"},
+		{"accounts", "allowed_betas", "TEXT"},
+		{"accounts", "daily_budget", "REAL"},
+		{"accounts", "anthropic_version", "TEXT"},
+		{"accounts", "openrouter_prefs", "TEXT"},
+		{"accounts", "failover_enabled", "INTEGER"},
+		{"accounts", "max_failover_candidates", "INTEGER"},
+		{"accounts", "system_prompt_prefix", "TEXT"},
+		{"accounts", "connect_timeout_ms", "INTEGER"},
+		{"accounts", "header_timeout_ms", "INTEGER"},
+		{"accounts", "response_timeout_ms", "INTEGER"},
+		{"accounts", "simulator_settings", "TEXT"},
+		{"config_tiers", "condition", "TEXT"},
+		{"config_tiers", "fallback_models", "TEXT"},
+	}},
+	{FeatureTenants, []expectedColumn{
+		{"tenants", "id", ""},
+		{"tenants", "api_key_hash", ""},
+		{"tenants", "config_id", "TEXT"},
+		{"tenants", "rate_limit", "INTEGER DEFAULT 0"},
+		{"tenants", "rate_limit_background", "INTEGER DEFAULT 0"},
+		{"tenants", "enabled", "INTEGER DEFAULT 1"},
+		{"tenant_settings", "tenant_id", ""},
+		{"tenant_settings", "key", ""},
+		{"tenant_settings", "value", "TEXT"},
+	}},
+	{FeatureRequestLogs, []expectedColumn{
+		{"request_logs", "id", ""},
+		{"request_logs", "inbound_format", "TEXT"},
+		{"request_logs", "is_failover", "INTEGER DEFAULT 0"},
+		{"request_logs", "tenant_id", "TEXT"},
+		{"request_logs", "routed_model_actual", "TEXT"},
+		{"request_logs", "tenant_key_label", "TEXT"},
+		{"request_logs", "upstream_request_id", "TEXT"},
+		{"request_logs", "failover_attempts", "TEXT"},
+		{"request_logs", "anthropic_version", "TEXT"},
+		{"request_logs", "guardrails_bypassed", "INTEGER DEFAULT 0"},
+		{"request_logs", "end_user", "TEXT"},
+		{"request_logs", "tags", "TEXT"},
+		{"request_logs", "retries", "INTEGER DEFAULT 0"},
+		{"request_logs", "request_id", "TEXT"},
+		{"request_logs", "client_request_id", "TEXT"},
+	}},
+	{FeatureUsage, []expectedColumn{
+		{"usage", "id", ""},
+		{"usage", "cache_read_tokens", "INTEGER DEFAULT 0"},
+		{"usage", "cache_write_tokens", "INTEGER DEFAULT 0"},
+		{"usage", "server_tool_requests", "INTEGER DEFAULT 0"},
+		{"usage", "reasoning_tokens", "INTEGER DEFAULT 0"},
+		{"usage", "tenant_id", "TEXT"},
+		{"usage", "end_user", "TEXT"},
+		{"usage", "tags", "TEXT"},
+		{"usage", "request_id", "TEXT"},
+	}},
+}
+
+// schemaIndexes are indexes the proxy's heavier queries (GetMonthlySpend,
+// tenant key lookups, log pruning) depend on.
+var schemaIndexes = []struct {
+	name, table, columns string
+}{
+	{"idx_usage_account_created", "usage", "account_id, created_at"},
+	{"idx_request_logs_timestamp", "request_logs", "timestamp"},
+	{"idx_tenants_hash", "tenants", "api_key_hash"},
+}
+
+var (
+	disabledMu       sync.RWMutex
+	disabledFeatures = map[string]bool{}
+)
+
+// FeatureAvailable reports whether CheckSchema found the columns a feature
+// needs. Features are available until CheckSchema says otherwise.
+func FeatureAvailable(feature string) bool {
+	disabledMu.RLock()
+	defer disabledMu.RUnlock()
+	return !disabledFeatures[feature]
+}
+
+// CheckSchema compares the database against the columns and indexes the
+// proxy expects, logs what is missing, and disables features whose queries
+// would fail. With autoMigrate (the auto_migrate setting) it first adds the
+// missing nullable columns and indexes; missing tables are left to the
+// dashboard. Returns the missing items as "table", "table.column", or
+// "index name".
+func CheckSchema(autoMigrate bool) []string {
+	if conn == nil {
+		return nil
+	}
+	if autoMigrate {
+		if Writable() {
+			migrateSchema()
+		} else {
+			log.Printf("[db] auto_migrate skipped: database is read-only")
+		}
+	}
+
+	tables := make(map[string]map[string]bool)
+	columnsOf := func(table string) map[string]bool {
+		if cols, ok := tables[table]; ok {
+			return cols
+		}
+		cols, err := tableColumns(conn, table)
+		if err != nil {
+			cols = nil
+		}
+		tables[table] = cols
+		return cols
+	}
+
+	var missing []string
+	disabled := make(map[string]bool)
+	for _, f := range schemaFeatures {
+		var gaps []string
+		for _, c := range f.columns {
+			cols := columnsOf(c.table)
+			switch {
+			case len(cols) == 0:
+				if !containsStr(gaps, c.table) {
+					gaps = append(gaps, c.table)
+				}
+			case !cols[c.column]:
+				gaps = append(gaps, c.table+"."+c.column)
+			}
+		}
+		if len(gaps) == 0 {
+			continue
+		}
+		missing = append(missing, gaps...)
+		if f.feature == "accounts" {
+			log.Printf("[db] WARNING: schema is missing %s; account queries will fail until the dashboard is upgraded or auto_migrate is enabled", strings.Join(gaps, ", "))
+			continue
+		}
+		disabled[f.feature] = true
+		log.Printf("[db] WARNING: schema is missing %s; %s disabled", strings.Join(gaps, ", "), f.feature)
+	}
+
+	for _, idx := range schemaIndexes {
+		if len(columnsOf(idx.table)) > 0 && !indexExists(conn, idx.name) {
+			missing = append(missing, idx.name)
+			log.Printf("[db] Index %s on %s(%s) is missing; set auto_migrate=true to create it", idx.name, idx.table, idx.columns)
+		}
+	}
+
+	disabledMu.Lock()
+	disabledFeatures = disabled
+	disabledMu.Unlock()
+	return missing
+}
+
+// migrateSchema adds missing nullable columns and indexes to existing tables.
+func migrateSchema() {
+	wConn, err := sql.Open("sqlite3", dbPath()+"?_journal_mode=WAL&_foreign_keys=on")
+	if err != nil {
+		log.Printf("[db] Failed to open DB for auto_migrate: %v", err)
+		return
+	}
+	defer wConn.Close()
+
+	for _, f := range schemaFeatures {
+		for _, c := range f.columns {
+			if c.ddl == "" {
+				continue
+			}
+			cols, err := tableColumns(wConn, c.table)
+			if err != nil || len(cols) == 0 || cols[c.column] {
+				continue
+			}
+			if _, err := wConn.Exec("ALTER TABLE " + c.table + " ADD COLUMN " + c.column + " " + c.ddl); err != nil {
+				log.Printf("[db] auto_migrate: failed to add %s.%s: %v", c.table, c.column, err)
+				continue
+			}
+			log.Printf("[db] auto_migrate: added %s.%s", c.table, c.column)
+		}
+	}
+
+	for _, idx := range schemaIndexes {
+		if cols, err := tableColumns(wConn, idx.table); err != nil || len(cols) == 0 || indexExists(wConn, idx.name) {
+			continue
+		}
+		if _, err := wConn.Exec("CREATE INDEX IF NOT EXISTS " + idx.name + " ON " + idx.table + "(" + idx.columns + ")"); err != nil {
+			log.Printf("[db] auto_migrate: failed to create %s: %v", idx.name, err)
+			continue
+		}
+		log.Printf("[db] auto_migrate: created index %s", idx.name)
+	}
+}
+
+func indexExists(c *sql.DB, name string) bool {
+	var n int
+	err := c.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = ?", name).Scan(&n)
+	return err == nil && n > 0
+}
+
+func containsStr(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
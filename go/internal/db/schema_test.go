@@ -0,0 +1,112 @@
+package db_test
+
+import (
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/dbtest"
+	"slices"
+	"testing"
+)
+
+// stripSchema turns the test database into one from an older dashboard.
+func stripSchema(d *dbtest.DB) {
+	d.Exec("DROP INDEX idx_usage_account_created")
+	d.Exec("ALTER TABLE usage DROP COLUMN tenant_id")
+	d.Exec("ALTER TABLE request_logs DROP COLUMN tenant_id")
+	d.Exec("ALTER TABLE accounts DROP COLUMN external_account_id")
+}
+
+func TestCheckSchema_Complete(t *testing.T) {
+	dbtest.Open(t)
+	if missing := db.CheckSchema(false); len(missing) != 0 {
+		t.Errorf("missing = %v, want none", missing)
+	}
+	for _, f := range []string{db.FeatureTenants, db.FeatureRequestLogs, db.FeatureUsage} {
+		if !db.FeatureAvailable(f) {
+			t.Errorf("%s disabled on a complete schema", f)
+		}
+	}
+}
+
+func TestCheckSchema_DegradesOnOldSchema(t *testing.T) {
+	d := dbtest.Open(t)
+	d.Exec("INSERT INTO tenants (id, name, api_key_hash, api_key_prefix) VALUES ('t1', 'T1', 'hash', 'cg-')")
+	stripSchema(d)
+	d.Exec("DROP TABLE tenant_settings")
+
+	missing := db.CheckSchema(false)
+	for _, want := range []string{"tenant_settings", "usage.tenant_id", "request_logs.tenant_id", "accounts.external_account_id", "idx_usage_account_created"} {
+		if !slices.Contains(missing, want) {
+			t.Errorf("missing = %v, want it to include %q", missing, want)
+		}
+	}
+	for _, f := range []string{db.FeatureTenants, db.FeatureRequestLogs, db.FeatureUsage} {
+		if db.FeatureAvailable(f) {
+			t.Errorf("%s should be disabled", f)
+		}
+	}
+
+	// Disabled features become no-ops instead of failing per request
+	if db.GetTenantByKeyHash("hash") != nil {
+		t.Error("tenant lookups should be disabled")
+	}
+	if !db.HasTenants() {
+		t.Error("HasTenants should still see the tenant, so auth stays on")
+	}
+	if err := db.RecordUsage("", "", "", "m", "m", 1, 1, 0, 0, 0, 0, 0.01, db.UsageDimensions{TenantID: "t1"}); err != nil {
+		t.Errorf("RecordUsage with usage disabled: %v", err)
+	}
+	db.InsertRequestLog(db.RequestLog{Method: "POST", Path: "/v1/messages"})
+	var n int
+	d.QueryRow("SELECT COUNT(*) FROM request_logs").Scan(&n)
+	if n != 0 {
+		t.Errorf("request_logs rows = %d, want 0", n)
+	}
+
+	// Nothing is changed without auto_migrate
+	var cols int
+	d.QueryRow("SELECT COUNT(*) FROM pragma_table_info('usage') WHERE name = 'tenant_id'").Scan(&cols)
+	if cols != 0 {
+		t.Error("usage.tenant_id was added without auto_migrate")
+	}
+}
+
+func TestCheckSchema_AutoMigrate(t *testing.T) {
+	d := dbtest.Open(t)
+	stripSchema(d)
+
+	if missing := db.CheckSchema(true); len(missing) != 0 {
+		t.Fatalf("missing after auto_migrate = %v, want none", missing)
+	}
+	for _, f := range []string{db.FeatureTenants, db.FeatureRequestLogs, db.FeatureUsage} {
+		if !db.FeatureAvailable(f) {
+			t.Errorf("%s disabled after auto_migrate", f)
+		}
+	}
+
+	var n int
+	d.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'idx_usage_account_created'").Scan(&n)
+	if n != 1 {
+		t.Error("idx_usage_account_created was not created")
+	}
+	if err := db.RecordUsage("", "", "", "m", "m", 1, 1, 0, 0, 0, 0, 0.01, db.UsageDimensions{TenantID: "t1"}); err != nil {
+		t.Fatalf("RecordUsage after auto_migrate: %v", err)
+	}
+	var tid string
+	d.QueryRow("SELECT tenant_id FROM usage").Scan(&tid)
+	if tid != "t1" {
+		t.Errorf("usage.tenant_id = %q, want t1", tid)
+	}
+}
+
+func TestCheckSchema_AutoMigrateLeavesTablesToDashboard(t *testing.T) {
+	d := dbtest.Open(t)
+	d.Exec("DROP TABLE tenant_settings")
+
+	missing := db.CheckSchema(true)
+	if !slices.Equal(missing, []string{"tenant_settings"}) {
+		t.Errorf("missing = %v, want [tenant_settings]", missing)
+	}
+	if db.FeatureAvailable(db.FeatureTenants) {
+		t.Error("tenants should stay disabled without tenant_settings")
+	}
+}
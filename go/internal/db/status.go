@@ -0,0 +1,58 @@
+package db
+
+// AccountStatus is one account's health and today's traffic, for the
+// proxy's status page.
+type AccountStatus struct {
+	ID            string
+	Name          string
+	Provider      string
+	Enabled       bool
+	Status        Status
+	ErrorCount    int
+	LastError     string
+	RequestsToday int
+	CostToday     float64
+}
+
+// GetAccountStatuses returns every account with today's request count and
+// cost, aggregated from usage in a single query.
+func GetAccountStatuses() ([]AccountStatus, error) {
+	rows, err := conn.Query(`SELECT a.id, a.name, a.provider, a.enabled,
+		COALESCE(a.status, 'unknown'), COALESCE(a.error_count, 0), COALESCE(a.last_error, ''),
+		COALESCE(u.requests, 0), COALESCE(u.cost, 0)
+		FROM accounts a
+		LEFT JOIN (
+			SELECT account_id, COUNT(*) AS requests, SUM(cost_usd) AS cost
+			FROM usage WHERE created_at >= date('now') GROUP BY account_id
+		) u ON u.account_id = a.id
+		ORDER BY a.priority DESC, a.name ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var statuses []AccountStatus
+	for rows.Next() {
+		var s AccountStatus
+		var enabledInt int
+		if err := rows.Scan(&s.ID, &s.Name, &s.Provider, &enabledInt,
+			&s.Status, &s.ErrorCount, &s.LastError, &s.RequestsToday, &s.CostToday); err != nil {
+			return nil, err
+		}
+		s.Enabled = enabledInt == 1
+		statuses = append(statuses, s)
+	}
+	return statuses, rows.Err()
+}
+
+// CountTenants returns the number of tenants, or 0 if the table is missing.
+func CountTenants() int {
+	if conn == nil || !FeatureAvailable(FeatureTenants) {
+		return 0
+	}
+	var n int
+	if err := conn.QueryRow("SELECT COUNT(*) FROM tenants").Scan(&n); err != nil {
+		return 0
+	}
+	return n
+}
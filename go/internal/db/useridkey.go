@@ -0,0 +1,78 @@
+package db
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// endUserKeyFile holds the per-install secret end-user IDs are hashed with.
+const endUserKeyFile = ".user-id-key"
+
+var (
+	endUserKeyMu  sync.Mutex
+	endUserKey    []byte
+	endUserKeyDir string
+)
+
+// EndUserIDKey returns the per-install secret used to hash end-user IDs
+// (hash_end_user_ids), creating DATA_DIR/.user-id-key on first use. If the
+// file can neither be read nor created, a random key is kept in memory
+// instead: hashes then change on restart but still can't be reversed. It
+// fails only if no key can be generated at all.
+func EndUserIDKey() ([]byte, error) {
+	endUserKeyMu.Lock()
+	defer endUserKeyMu.Unlock()
+	dir := dataDir()
+	if endUserKey != nil && endUserKeyDir == dir {
+		return endUserKey, nil
+	}
+	key, err := loadEndUserKey(filepath.Join(dir, endUserKeyFile))
+	if err != nil {
+		log.Printf("[db] WARNING: %v; end-user ID hashes won't be stable across restarts", err)
+		key = make([]byte, 32)
+		if _, err := cryptoRandRead(key); err != nil {
+			return nil, fmt.Errorf("generate end-user ID key: %w", err)
+		}
+	}
+	endUserKey, endUserKeyDir = key, dir
+	return key, nil
+}
+
+// loadEndUserKey reads the key file at path, or writes a new key there when
+// it doesn't exist.
+func loadEndUserKey(path string) ([]byte, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != 32 {
+			return nil, errors.New(endUserKeyFile + " is not a hex-encoded 32-byte key")
+		}
+		return key, nil
+	}
+	key := make([]byte, 32)
+	if _, err := cryptoRandRead(key); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		// Another process wrote one first
+		return loadEndUserKey(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.WriteString(hex.EncodeToString(key))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// ReadOnlyFeatures lists what stops working when DATA_DIR can't be written.
+var ReadOnlyFeatures = []string{
+	"usage recording",
+	"request logs",
+	"account status updates",
+	"OAuth token persistence (refreshed tokens are kept in memory)",
+	"guardrail key generation",
+	"model limit edits",
+}
+
+var (
+	// readOnly is set by CheckWritable; writes are skipped while it holds.
+	readOnly       atomic.Bool
+	readOnlyReason atomic.Value // string
+)
+
+// CheckWritable probes DATA_DIR and the database for write access and
+// switches the package to read-only mode if either fails, logging the
+// features that are disabled. Setting DB_READONLY=true forces read-only mode.
+func CheckWritable() error {
+	err := probeWritable()
+	if err == nil {
+		readOnly.Store(false)
+		readOnlyReason.Store("")
+		return nil
+	}
+
+	readOnly.Store(true)
+	readOnlyReason.Store(err.Error())
+	log.Printf("[db] WARNING: data directory is read-only (%v); running degraded", err)
+	for _, f := range ReadOnlyFeatures {
+		log.Printf("[db]   disabled: %s", f)
+	}
+	return err
+}
+
+func probeWritable() error {
+	if os.Getenv("DB_READONLY") == "true" {
+		return fmt.Errorf("DB_READONLY is set")
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(dbPath()), ".write-probe-*")
+	if err != nil {
+		return fmt.Errorf("create file in data dir: %w", err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	wConn, err := sql.Open("sqlite3", dbPath()+"?_journal_mode=WAL&_foreign_keys=on")
+	if err != nil {
+		return fmt.Errorf("open db for writing: %w", err)
+	}
+	defer wConn.Close()
+
+	// BEGIN IMMEDIATE takes the write lock without changing anything
+	ctx := context.Background()
+	c, err := wConn.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("open db for writing: %w", err)
+	}
+	defer c.Close()
+	if _, err := c.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return fmt.Errorf("db write transaction: %w", err)
+	}
+	c.ExecContext(ctx, "ROLLBACK")
+	return nil
+}
+
+// Writable reports whether writes to the database are enabled.
+func Writable() bool {
+	return !readOnly.Load()
+}
+
+// ReadOnlyReason returns why the database is read-only, or "" if it isn't.
+func ReadOnlyReason() string {
+	s, _ := readOnlyReason.Load().(string)
+	return s
+}
+
+// ─── In-memory token overlay ────────────────────────────────────────────────
+
+// overlayTokens holds OAuth tokens refreshed while the database is read-only,
+// so refreshed accounts keep working for the life of the process.
+type overlayTokens struct {
+	accessToken, refreshToken string
+	expiresAt                 int64
+}
+
+var (
+	tokenOverlay   = make(map[string]overlayTokens)
+	tokenOverlayMu sync.RWMutex
+)
+
+func setTokenOverlay(id, accessToken, refreshToken string, expiresAt int64) {
+	tokenOverlayMu.Lock()
+	tokenOverlay[id] = overlayTokens{accessToken, refreshToken, expiresAt}
+	tokenOverlayMu.Unlock()
+}
+
+// applyTokenOverlay replaces an account's tokens with in-memory ones unless
+// the database has since been given newer tokens (e.g. by the dashboard).
+func applyTokenOverlay(a *Account) {
+	tokenOverlayMu.RLock()
+	t, ok := tokenOverlay[a.ID]
+	tokenOverlayMu.RUnlock()
+	if !ok || (a.TokenExpiresAt.Valid && a.TokenExpiresAt.Int64 >= t.expiresAt) {
+		return
+	}
+	a.APIKey = t.accessToken
+	a.RefreshToken = t.refreshToken
+	a.TokenExpiresAt = sql.NullInt64{Int64: t.expiresAt, Valid: true}
+}
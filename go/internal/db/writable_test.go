@@ -0,0 +1,103 @@
+package db_test
+
+import (
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/dbtest"
+	"database/sql"
+	"os"
+	"testing"
+)
+
+// readOnly switches the db package to read-only mode for the rest of the test.
+func readOnly(t *testing.T) {
+	t.Helper()
+	// Registered before Setenv so it runs after DB_READONLY is restored
+	t.Cleanup(func() { db.CheckWritable() })
+	t.Setenv("DB_READONLY", "true")
+	if err := db.CheckWritable(); err == nil {
+		t.Fatal("CheckWritable should fail with DB_READONLY set")
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	dbtest.Open(t)
+	if err := db.CheckWritable(); err != nil {
+		t.Fatalf("CheckWritable on a writable dir: %v", err)
+	}
+	if !db.Writable() || db.ReadOnlyReason() != "" {
+		t.Errorf("Writable = %v, reason = %q", db.Writable(), db.ReadOnlyReason())
+	}
+
+	readOnly(t)
+	if db.Writable() || db.ReadOnlyReason() == "" {
+		t.Errorf("Writable = %v, reason = %q", db.Writable(), db.ReadOnlyReason())
+	}
+}
+
+func TestCheckWritable_ReadOnlyDir(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root ignores directory permissions")
+	}
+	tdb := dbtest.Open(t)
+	if err := os.Chmod(tdb.Dir, 0o555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chmod(tdb.Dir, 0o755)
+		db.CheckWritable()
+	})
+
+	if err := db.CheckWritable(); err == nil {
+		t.Fatal("CheckWritable should fail on a read-only data dir")
+	}
+}
+
+func TestReadOnly_TokenOverlay(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.AddAccount("acct-oauth", "oauth", "anthropic", "")
+	tdb.Exec("UPDATE accounts SET auth_type = 'oauth', token_expires_at = 1000 WHERE id = 'acct-oauth'")
+	readOnly(t)
+
+	db.UpdateAccountTokens("acct-oauth", "fresh-access", "fresh-refresh", 5000)
+
+	a := db.GetAccount("acct-oauth")
+	if a == nil || a.APIKey != "fresh-access" || a.RefreshToken != "fresh-refresh" || a.TokenExpiresAt.Int64 != 5000 {
+		t.Fatalf("GetAccount did not apply the overlay: %+v", a)
+	}
+	accounts, _ := db.GetOAuthAccounts()
+	if len(accounts) != 1 || accounts[0].APIKey != "fresh-access" {
+		t.Errorf("GetOAuthAccounts did not apply the overlay: %+v", accounts)
+	}
+
+	// Nothing was written
+	var enc sql.NullString
+	var expires int64
+	tdb.QueryRow("SELECT api_key_enc, token_expires_at FROM accounts WHERE id = 'acct-oauth'").Scan(&enc, &expires)
+	if enc.Valid || expires != 1000 {
+		t.Errorf("row changed in read-only mode: api_key_enc=%v expires=%d", enc, expires)
+	}
+
+	// Newer tokens from the dashboard win over the overlay
+	tdb.Exec("UPDATE accounts SET token_expires_at = 9000 WHERE id = 'acct-oauth'")
+	if a := db.GetAccount("acct-oauth"); a.APIKey == "fresh-access" || a.TokenExpiresAt.Int64 != 9000 {
+		t.Errorf("overlay should yield to newer DB tokens: %+v", a)
+	}
+}
+
+func TestReadOnly_SkipsWrites(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.AddAccount("acct-1", "one", "openai", "")
+	readOnly(t)
+
+	if err := db.RecordUsage("acct-1", "", "", "gpt-4o", "gpt-4o", 10, 5, 0, 0, 0, 0, 0.01, db.UsageDimensions{}); err != nil {
+		t.Errorf("RecordUsage: %v", err)
+	}
+	db.RecordAccountError("acct-1", "boom")
+
+	var n, errs int
+	tdb.QueryRow("SELECT COUNT(*) FROM usage").Scan(&n)
+	tdb.QueryRow("SELECT error_count FROM accounts WHERE id = 'acct-1'").Scan(&errs)
+	if n != 0 || errs != 0 {
+		t.Errorf("writes went through in read-only mode: usage rows=%d error_count=%d", n, errs)
+	}
+}
@@ -0,0 +1,232 @@
+// Package dbtest provides throwaway SQLite databases for tests that exercise
+// code reading from or writing to the shared dashboard database.
+package dbtest
+
+import (
+	"codegate-proxy/internal/db"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// schema mirrors the tables created by initDB in src/server/db.ts, including
+// the columns the dashboard adds through migrations. Columns owned by the Go
+// proxy are left to db.EnsureProxyColumns.
+const schema = `
+CREATE TABLE accounts (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	provider TEXT NOT NULL,
+	auth_type TEXT NOT NULL DEFAULT 'api_key',
+	api_key_enc TEXT,
+	refresh_token_enc TEXT,
+	token_expires_at INTEGER,
+	base_url TEXT,
+	priority INTEGER DEFAULT 0,
+	rate_limit INTEGER DEFAULT 60,
+	monthly_budget REAL,
+	enabled INTEGER DEFAULT 1,
+	subscription_type TEXT,
+	account_email TEXT,
+	last_used_at TEXT,
+	last_error TEXT,
+	last_error_at TEXT,
+	error_count INTEGER DEFAULT 0,
+	status TEXT DEFAULT 'unknown',
+	external_account_id TEXT,
+	created_at TEXT DEFAULT (datetime('now')),
+	updated_at TEXT DEFAULT (datetime('now'))
+);
+
+CREATE TABLE configs (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	description TEXT,
+	is_active INTEGER DEFAULT 0,
+	routing_strategy TEXT DEFAULT 'priority',
+	created_at TEXT DEFAULT (datetime('now'))
+);
+
+CREATE TABLE config_tiers (
+	id TEXT PRIMARY KEY,
+	config_id TEXT NOT NULL REFERENCES configs(id) ON DELETE CASCADE,
+	tier TEXT NOT NULL,
+	account_id TEXT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+	priority INTEGER DEFAULT 0,
+	target_model TEXT,
+	condition TEXT,
+	fallback_models TEXT
+);
+
+CREATE TABLE usage (
+	id TEXT PRIMARY KEY,
+	account_id TEXT REFERENCES accounts(id),
+	config_id TEXT,
+	tier TEXT,
+	original_model TEXT,
+	routed_model TEXT,
+	input_tokens INTEGER DEFAULT 0,
+	output_tokens INTEGER DEFAULT 0,
+	cache_read_tokens INTEGER DEFAULT 0,
+	cache_write_tokens INTEGER DEFAULT 0,
+	cost_usd REAL DEFAULT 0,
+	tenant_id TEXT,
+	created_at TEXT DEFAULT (datetime('now'))
+);
+
+CREATE TABLE settings (
+	key TEXT PRIMARY KEY,
+	value TEXT
+);
+
+CREATE TABLE request_logs (
+	id TEXT PRIMARY KEY,
+	timestamp TEXT NOT NULL DEFAULT (datetime('now')),
+	method TEXT,
+	path TEXT,
+	inbound_format TEXT,
+	account_id TEXT,
+	account_name TEXT,
+	provider TEXT,
+	original_model TEXT,
+	routed_model TEXT,
+	status_code INTEGER,
+	input_tokens INTEGER,
+	output_tokens INTEGER,
+	latency_ms INTEGER,
+	is_stream INTEGER DEFAULT 0,
+	is_failover INTEGER DEFAULT 0,
+	error_message TEXT,
+	request_body TEXT,
+	response_body TEXT,
+	tenant_id TEXT
+);
+
+CREATE TABLE tenants (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	api_key_hash TEXT NOT NULL UNIQUE,
+	api_key_prefix TEXT NOT NULL,
+	config_id TEXT REFERENCES configs(id),
+	rate_limit INTEGER DEFAULT 0,
+	enabled INTEGER DEFAULT 1,
+	api_key_raw TEXT,
+	created_at TEXT DEFAULT (datetime('now')),
+	updated_at TEXT DEFAULT (datetime('now'))
+);
+
+CREATE TABLE tenant_keys (
+	id TEXT PRIMARY KEY,
+	tenant_id TEXT NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+	key_hash TEXT NOT NULL UNIQUE,
+	key_prefix TEXT NOT NULL,
+	label TEXT,
+	enabled INTEGER DEFAULT 1,
+	last_used_at TEXT,
+	expires_at TEXT,
+	created_at TEXT DEFAULT (datetime('now'))
+);
+
+CREATE TABLE tenant_settings (
+	tenant_id TEXT NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+	key TEXT NOT NULL,
+	value TEXT,
+	PRIMARY KEY (tenant_id, key)
+);
+
+CREATE INDEX idx_usage_account_created ON usage(account_id, created_at);
+CREATE INDEX idx_request_logs_timestamp ON request_logs(timestamp);
+CREATE INDEX idx_tenants_hash ON tenants(api_key_hash);
+`
+
+// DB is a temporary database opened as the shared db connection.
+type DB struct {
+	t    testing.TB
+	conn *sql.DB
+	Dir  string
+}
+
+// Open creates a fresh database under a temp DATA_DIR, points the db package
+// at it, and closes everything when the test ends.
+func Open(t testing.TB) *DB {
+	t.Helper()
+
+	dir := t.TempDir()
+	t.Setenv("DATA_DIR", dir)
+
+	conn, err := sql.Open("sqlite3", filepath.Join(dir, "codegate.db")+"?_journal_mode=WAL&_foreign_keys=on")
+	if err != nil {
+		t.Fatalf("open test db: %v", err)
+	}
+	if _, err := conn.Exec(schema); err != nil {
+		conn.Close()
+		t.Fatalf("create schema: %v", err)
+	}
+
+	// Close waits for the last test's background writes before the
+	// connection is swapped
+	db.Close()
+	if err := db.Open(); err != nil {
+		conn.Close()
+		t.Fatalf("db.Open: %v", err)
+	}
+	db.EnsureProxyColumns()
+	db.InitRequestAttemptsTable()
+	db.CheckSchema(false)
+
+	t.Cleanup(func() {
+		db.Close()
+		conn.Close()
+	})
+	return &DB{t: t, conn: conn, Dir: dir}
+}
+
+// Exec runs a statement against the test database, failing the test on error.
+func (d *DB) Exec(query string, args ...any) {
+	d.t.Helper()
+	if _, err := d.conn.Exec(query, args...); err != nil {
+		d.t.Fatalf("exec %q: %v", query, err)
+	}
+}
+
+// QueryRow runs a single-row query against the test database.
+func (d *DB) QueryRow(query string, args ...any) *sql.Row {
+	return d.conn.QueryRow(query, args...)
+}
+
+// SetSetting stores a global setting.
+func (d *DB) SetSetting(key, value string) {
+	d.t.Helper()
+	d.Exec("INSERT OR REPLACE INTO settings (key, value) VALUES (?, ?)", key, value)
+}
+
+// AddAccount inserts an enabled account with no stored credentials.
+func (d *DB) AddAccount(id, name, provider, baseURL string) {
+	d.t.Helper()
+	d.Exec("INSERT INTO accounts (id, name, provider, base_url, rate_limit) VALUES (?, ?, ?, ?, 0)",
+		id, name, provider, baseURL)
+}
+
+// AddActiveConfig inserts a config and makes it the active one.
+func (d *DB) AddActiveConfig(id, name string) {
+	d.t.Helper()
+	d.Exec("UPDATE configs SET is_active = 0")
+	d.Exec("INSERT INTO configs (id, name, is_active) VALUES (?, ?, 1)", id, name)
+}
+
+// AddTier routes a config's tier to an account. targetModel, when not
+// empty, replaces the requested model.
+func (d *DB) AddTier(configID, tier, accountID string, priority int, targetModel string) {
+	d.t.Helper()
+	d.Exec("INSERT INTO config_tiers (id, config_id, tier, account_id, priority, target_model) VALUES (?, ?, ?, ?, ?, ?)",
+		configID+":"+tier+":"+accountID, configID, tier, accountID, priority, nullIfEmpty(targetModel))
+}
+
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,73 @@
+// Package events is an in-process bus for proxy state changes that live in
+// memory (cooldowns, token refreshes, cache invalidations) or that the
+// dashboard would otherwise have to poll for. Its only proxy import is
+// metrics, which imports nothing from the proxy itself, so any package can
+// publish to it without an import cycle.
+package events
+
+import (
+	"codegate-proxy/internal/metrics"
+	"sync"
+	"time"
+)
+
+// Event types.
+const (
+	AccountStatusChanged = "account.status_changed"
+	CooldownSet          = "cooldown.set"
+	CooldownCleared      = "cooldown.cleared"
+	TokenRefreshed       = "token.refreshed"
+	TokenRefreshFailed   = "token.refresh_failed"
+	CacheInvalidated     = "cache.invalidated"
+)
+
+// subscriberBuffer is how many events a subscriber can fall behind by
+// before further events are dropped for it.
+const subscriberBuffer = 64
+
+// Event is a state change. It names what changed, not the new state, so it
+// never carries credentials or request content.
+type Event struct {
+	Type     string    `json:"type"`
+	EntityID string    `json:"entity_id,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+var (
+	mu          sync.Mutex
+	subscribers = make(map[chan Event]struct{})
+)
+
+// Publish sends an event to every subscriber without blocking. A subscriber
+// whose buffer is full misses the event.
+func Publish(eventType, entityID string) {
+	ev := Event{Type: eventType, EntityID: entityID, Time: time.Now().UTC()}
+	mu.Lock()
+	defer mu.Unlock()
+	for ch := range subscribers {
+		select {
+		case ch <- ev:
+		default:
+			metrics.Inc("codegate_events_dropped_total", "type", eventType)
+		}
+	}
+}
+
+// Subscribe returns a channel of events published from now on, in order,
+// and a function that unsubscribes and closes the channel.
+func Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+	mu.Lock()
+	subscribers[ch] = struct{}{}
+	mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			mu.Lock()
+			delete(subscribers, ch)
+			mu.Unlock()
+			close(ch)
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package events
+
+import (
+	"codegate-proxy/internal/metrics"
+	"testing"
+)
+
+func TestPublish_DeliversInOrder(t *testing.T) {
+	ch, cancel := Subscribe()
+	defer cancel()
+
+	Publish(CooldownSet, "acct-1")
+	Publish(CooldownCleared, "acct-1")
+
+	for _, want := range []string{CooldownSet, CooldownCleared} {
+		ev := <-ch
+		if ev.Type != want || ev.EntityID != "acct-1" || ev.Time.IsZero() {
+			t.Errorf("event = %+v, want %s for acct-1", ev, want)
+		}
+	}
+}
+
+func TestPublish_SlowSubscriberDropsEvents(t *testing.T) {
+	metrics.Reset()
+	ch, cancel := Subscribe()
+	defer cancel()
+
+	for i := 0; i < subscriberBuffer+3; i++ {
+		Publish(TokenRefreshed, "acct-1")
+	}
+	if len(ch) != subscriberBuffer {
+		t.Errorf("buffered = %d, want %d", len(ch), subscriberBuffer)
+	}
+	if n := metrics.Counter("codegate_events_dropped_total", "type", TokenRefreshed); n != 3 {
+		t.Errorf("dropped = %d, want 3", n)
+	}
+}
+
+func TestSubscribe_Cancel(t *testing.T) {
+	ch, cancel := Subscribe()
+	cancel()
+	cancel()
+
+	Publish(CacheInvalidated, "tenants")
+	if _, ok := <-ch; ok {
+		t.Error("channel should be closed after cancel")
+	}
+}
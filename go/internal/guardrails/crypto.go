@@ -12,37 +12,43 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"log"
 	"math"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
-	"sync"
 	"unicode"
 
 	"golang.org/x/crypto/scrypt"
 )
 
-// guardrailKey is the cached 32-byte key used for deterministic encryption.
-var (
-	guardrailKey   []byte
-	guardrailKeyMu sync.Mutex
-)
+// getKey returns the engine's 32-byte encryption key, loading it on first
+// use when none was given to NewEngine.
+func (e *Engine) getKey() []byte {
+	e.keyMu.Lock()
+	defer e.keyMu.Unlock()
+
+	if e.key == nil {
+		key, source, err := loadGuardrailKey()
+		if err != nil {
+			// InitGuardrails fails startup on this for the default engine
+			panic(err)
+		}
+		e.key, e.keySource = key, source
+	}
+	return e.key
+}
 
-// getGuardrailKey returns the 32-byte guardrail encryption key.
+// loadGuardrailKey returns the 32-byte guardrail encryption key and where it
+// came from. A GUARDRAIL_KEY that can't be derived is an error rather than a
+// fall-through to the key file, which the dashboard wouldn't be using.
 //
 // Priority:
 //  1. GUARDRAIL_KEY env var (derived via scrypt with salt "claude-proxy-guardrail-key-salt")
 //  2. {DATA_DIR}/.guardrail-key file (hex-encoded 32 bytes)
 //  3. Generate random 32 bytes and persist to file
-func getGuardrailKey() []byte {
-	guardrailKeyMu.Lock()
-	defer guardrailKeyMu.Unlock()
-
-	if guardrailKey != nil {
-		return guardrailKey
-	}
-
+func loadGuardrailKey() ([]byte, string, error) {
 	// 1. Check GUARDRAIL_KEY env var
 	if envKey := os.Getenv("GUARDRAIL_KEY"); envKey != "" && envKey != "auto" {
 		derived, err := scrypt.Key(
@@ -50,10 +56,10 @@ func getGuardrailKey() []byte {
 			[]byte("claude-proxy-guardrail-key-salt"),
 			16384, 8, 1, 32, // N=16384, r=8, p=1, keyLen=32 (matches Node.js scryptSync defaults)
 		)
-		if err == nil {
-			guardrailKey = derived
-			return guardrailKey
+		if err != nil {
+			return nil, "", fmt.Errorf("guardrails: derive key from GUARDRAIL_KEY: %w", err)
 		}
+		return derived, KeySourceEnv, nil
 	}
 
 	// 2. Try reading from file
@@ -66,8 +72,7 @@ func getGuardrailKey() []byte {
 	if data, err := os.ReadFile(keyFile); err == nil {
 		hexStr := strings.TrimSpace(string(data))
 		if key, err := hex.DecodeString(hexStr); err == nil && len(key) == 32 {
-			guardrailKey = key
-			return guardrailKey
+			return key, KeySourceFile, nil
 		}
 	}
 
@@ -76,16 +81,22 @@ func getGuardrailKey() []byte {
 	if _, err := rand.Read(key); err != nil {
 		panic(fmt.Sprintf("guardrails: failed to generate key: %v", err))
 	}
-	_ = os.MkdirAll(dataDir, 0o755)
-	_ = os.WriteFile(keyFile, []byte(hex.EncodeToString(key)), 0o600)
-	guardrailKey = key
-	return guardrailKey
+	err := os.MkdirAll(dataDir, 0o755)
+	if err == nil {
+		err = os.WriteFile(keyFile, []byte(hex.EncodeToString(key)), 0o600)
+	}
+	if err != nil {
+		// Read-only data dir: the key only lives for this process, so tokens
+		// issued now can't be reversed after a restart
+		log.Printf("[guardrails] WARNING: could not save generated key to %s (%v); set GUARDRAIL_KEY for a stable key", keyFile, err)
+	}
+	return key, KeySourceGenerated, nil
 }
 
 // deriveIV derives a deterministic IV from the value and a domain-specific salt.
 // This ensures the same value always produces the same ciphertext.
-func deriveIV(value, domain string) []byte {
-	key := getGuardrailKey()
+func (e *Engine) deriveIV(value, domain string) []byte {
+	key := e.getKey()
 
 	// salt = HMAC-SHA256(key, domain)
 	mac := hmac.New(sha256.New, key)
@@ -102,9 +113,9 @@ func deriveIV(value, domain string) []byte {
 // Deterministic: same input always produces the same token.
 // Format: base64url(IV(16) + ciphertext + checksum(4))
 // The IV is included so decryption does not need the plaintext.
-func encryptForToken(value, domain string) string {
-	key := getGuardrailKey()
-	iv := deriveIV(value, domain)
+func (e *Engine) encryptForToken(value, domain string) string {
+	key := e.getKey()
+	iv := e.deriveIV(value, domain)
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -135,8 +146,8 @@ func encryptForToken(value, domain string) string {
 // decryptToken reverses encryptForToken.
 // Extracts the IV from the first 16 bytes of the token.
 // Returns "" if decryption fails or checksum does not match.
-func decryptToken(token, domain string) string {
-	key := getGuardrailKey()
+func (e *Engine) decryptToken(token, domain string) string {
+	key := e.getKey()
 
 	// Handle missing padding: base64url decode (RawURLEncoding handles no padding)
 	data, err := base64.RawURLEncoding.DecodeString(token)
@@ -184,17 +195,17 @@ func decryptToken(token, domain string) string {
 	return plaintextStr
 }
 
-// hmacHash computes HMAC-SHA256(guardrailKey, value) and returns the hex string.
-func hmacHash(value string) string {
-	key := getGuardrailKey()
+// hmacHash computes HMAC-SHA256(key, value) and returns the hex string.
+func (e *Engine) hmacHash(value string) string {
+	key := e.getKey()
 	mac := hmac.New(sha256.New, key)
 	mac.Write([]byte(value))
 	return hex.EncodeToString(mac.Sum(nil))
 }
 
 // shortHash returns the first length characters of hmacHash(value).
-func shortHash(value string, length int) string {
-	h := hmacHash(value)
+func (e *Engine) shortHash(value string, length int) string {
+	h := e.hmacHash(value)
 	if length > len(h) {
 		return h
 	}
@@ -8,12 +8,12 @@ func TestEncryptDecryptRoundTrip(t *testing.T) {
 	original := "hello-world-secret-value"
 	domain := "test"
 
-	token := encryptForToken(original, domain)
+	token := defaultEngine.encryptForToken(original, domain)
 	if token == "" {
 		t.Fatal("encryptForToken returned empty string")
 	}
 
-	decrypted := decryptToken(token, domain)
+	decrypted := defaultEngine.decryptToken(token, domain)
 	if decrypted != original {
 		t.Errorf("round-trip failed: got %q, want %q", decrypted, original)
 	}
@@ -23,8 +23,8 @@ func TestDeterministicEncryption(t *testing.T) {
 	original := "test-value-123"
 	domain := "test"
 
-	token1 := encryptForToken(original, domain)
-	token2 := encryptForToken(original, domain)
+	token1 := defaultEngine.encryptForToken(original, domain)
+	token2 := defaultEngine.encryptForToken(original, domain)
 
 	if token1 != token2 {
 		t.Errorf("encryption is not deterministic: %q != %q", token1, token2)
@@ -34,22 +34,22 @@ func TestDeterministicEncryption(t *testing.T) {
 func TestDifferentDomains(t *testing.T) {
 	original := "same-value"
 
-	token1 := encryptForToken(original, "domain1")
-	token2 := encryptForToken(original, "domain2")
+	token1 := defaultEngine.encryptForToken(original, "domain1")
+	token2 := defaultEngine.encryptForToken(original, "domain2")
 
 	if token1 == token2 {
 		t.Error("different domains should produce different tokens")
 	}
 
 	// Each should decrypt correctly with its own domain
-	if decryptToken(token1, "domain1") != original {
+	if defaultEngine.decryptToken(token1, "domain1") != original {
 		t.Error("failed to decrypt domain1 token")
 	}
-	if decryptToken(token2, "domain2") != original {
+	if defaultEngine.decryptToken(token2, "domain2") != original {
 		t.Error("failed to decrypt domain2 token")
 	}
 	// Cross-domain should fail
-	if decryptToken(token1, "domain2") == original {
+	if defaultEngine.decryptToken(token1, "domain2") == original {
 		t.Error("cross-domain decryption should fail")
 	}
 }
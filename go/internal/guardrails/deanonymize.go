@@ -3,11 +3,17 @@ package guardrails
 import (
 	"bufio"
 	"bytes"
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/streamutil"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 // ─── Deanonymization patterns ────────────────────────────────────────────────
@@ -79,6 +85,61 @@ var bracketCategoryMap = map[string]string{
 // decryption and reverse-map lookups. The pattern matching order is important
 // and matches the TypeScript version exactly.
 func Deanonymize(text string) string {
+	return DeanonymizeForTenant(text, "")
+}
+
+// DeanonymizeForTenant is Deanonymize for a response to a tenant's request.
+// Only tokens and replacements produced for that tenant are restored.
+func DeanonymizeForTenant(text, tenantID string) string {
+	return defaultEngine.Deanonymize(text, tenantID)
+}
+
+// DeanonymizeForTenantWithUnresolved is DeanonymizeForTenant that also
+// counts the tokens it could not restore.
+func DeanonymizeForTenantWithUnresolved(text, tenantID string) (string, Unresolved) {
+	unresolved := Unresolved{}
+	return defaultEngine.deanonymize(text, tenantID, unresolved), unresolved
+}
+
+// Deanonymize is DeanonymizeForTenant on the engine.
+func (e *Engine) Deanonymize(text, tenantID string) string {
+	return e.deanonymize(text, tenantID, nil)
+}
+
+// Unresolved counts, per category, anonymised tokens in a response that
+// neither decrypt nor have a reverse-map entry, such as tokens issued under
+// another guardrail key or truncated by the model. They reach the client
+// as-is.
+type Unresolved map[string]int
+
+func (u Unresolved) add(category string) {
+	if u != nil {
+		u[category]++
+	}
+}
+
+// Total is the number of unresolved tokens across categories.
+func (u Unresolved) Total() int {
+	n := 0
+	for _, c := range u {
+		n += c
+	}
+	return n
+}
+
+// String lists the counts as "category=n" pairs sorted by category.
+func (u Unresolved) String() string {
+	parts := make([]string, 0, len(u))
+	for category, n := range u {
+		parts = append(parts, fmt.Sprintf("%s=%d", category, n))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// deanonymize is Deanonymize, counting unrestored tokens into unresolved
+// when it isn't nil.
+func (e *Engine) deanonymize(text, tenantID string, unresolved Unresolved) string {
 	if text == "" {
 		return text
 	}
@@ -93,15 +154,19 @@ func Deanonymize(text string) string {
 		}
 		token := subs[2]
 
-		if decrypted := decryptToken(token, "api_key"); decrypted != "" {
+		if decrypted := e.decryptScoped(token, "api_key", tenantID); decrypted != "" {
 			return decrypted
 		}
-		if decrypted := decryptToken(token, "secret"); decrypted != "" {
+		if decrypted := e.decryptScoped(token, "secret", tenantID); decrypted != "" {
 			return decrypted
 		}
-		if orig := reverseLookup(fullMatch); orig != "" {
+		if orig := e.reverseLookup(fullMatch, tenantID); orig != "" {
 			return orig
 		}
+		// Bare [word] brackets are left to the steps below
+		if subs[1] != "" {
+			unresolved.add("api_key")
+		}
 		return fullMatch
 	})
 
@@ -113,12 +178,13 @@ func Deanonymize(text string) string {
 		}
 		token := subs[2]
 
-		if decrypted := decryptToken(token, "secret"); decrypted != "" {
+		if decrypted := e.decryptScoped(token, "secret", tenantID); decrypted != "" {
 			return decrypted
 		}
-		if orig := reverseLookup(fullMatch); orig != "" {
+		if orig := e.reverseLookup(fullMatch, tenantID); orig != "" {
 			return orig
 		}
+		unresolved.add("secret")
 		return fullMatch
 	})
 
@@ -136,33 +202,38 @@ func Deanonymize(text string) string {
 			category = mapped
 		}
 
-		if decrypted := decryptToken(token, category); decrypted != "" {
+		if decrypted := e.decryptScoped(token, category, tenantID); decrypted != "" {
 			return decrypted
 		}
-		if orig := reverseLookup(fullMatch); orig != "" {
+		if orig := e.reverseLookup(fullMatch, tenantID); orig != "" {
 			return orig
 		}
+		// Only prefixes the anonymizer emits count; [TODO-item] is just text
+		if _, ok := bracketCategoryMap[prefix]; ok || prefix == "AWS" || prefix == "PRIVATE" {
+			unresolved.add(category)
+		}
 		return fullMatch
 	})
 
 	// 4. Handle email format: <anything>@anon.com (reverse-map lookup)
 	result = emailTokenDeanonRe.ReplaceAllStringFunc(result, func(fullMatch string) string {
-		if orig := reverseLookup(fullMatch); orig != "" {
+		if orig := e.reverseLookup(fullMatch, tenantID); orig != "" {
 			return orig
 		}
+		unresolved.add("email")
 		return fullMatch
 	})
 
 	// 4.5. Handle plain IPs and phone numbers registered in reverse-map
 	// (The model extracts these from bracket tokens and writes them plain)
 	result = plainIPDeanonRe.ReplaceAllStringFunc(result, func(fullMatch string) string {
-		if orig := reverseLookup(fullMatch); orig != "" {
+		if orig := e.reverseLookup(fullMatch, tenantID); orig != "" {
 			return orig
 		}
 		return fullMatch
 	})
 	result = plainPhoneDeanonRe.ReplaceAllStringFunc(result, func(fullMatch string) string {
-		if orig := reverseLookup(fullMatch); orig != "" {
+		if orig := e.reverseLookup(fullMatch, tenantID); orig != "" {
 			return orig
 		}
 		return fullMatch
@@ -170,9 +241,13 @@ func Deanonymize(text string) string {
 
 	// 5. Handle name replacements via reverse-map lookup.
 	// Names are plain fake names (no tokens), so we do whole-word reverse lookups.
-	reverseMap.Range(func(key, value any) bool {
-		replacement := key.(string)
-		original := value.(string)
+	scope := reverseKey(tenantID, "")
+	e.reverseMap.Range(func(key, value any) bool {
+		replacement, ok := strings.CutPrefix(key.(string), scope)
+		if !ok {
+			return true
+		}
+		original := value.(mapping).original
 
 		// Only process name-category replacements (skip emails, IPs, phones, etc.)
 		if strings.Contains(replacement, "@") || strings.HasPrefix(replacement, "[") {
@@ -202,14 +277,18 @@ func Deanonymize(text string) string {
 		}
 		token := subs[1]
 
-		if decrypted := decryptToken(token, "url"); decrypted != "" {
+		if decrypted := e.decryptScoped(token, "url", tenantID); decrypted != "" {
 			if m := credExtractRe.FindStringSubmatch(decrypted); m != nil {
 				return fmt.Sprintf("//[%s:[REDACTED]]@", m[1])
 			}
 		}
-		if orig := reverseLookup(fullMatch); orig != "" {
+		if orig := e.reverseLookup(fullMatch, tenantID); orig != "" {
 			return orig
 		}
+		// [REDACTED-token] passwords were counted in step 3
+		if strings.HasPrefix(fullMatch, "[redacted-") {
+			unresolved.add("url")
+		}
 		return fullMatch
 	})
 
@@ -221,12 +300,13 @@ func Deanonymize(text string) string {
 		}
 		token := subs[2]
 
-		if decrypted := decryptToken(token, "phone"); decrypted != "" {
+		if decrypted := e.decryptScoped(token, "phone", tenantID); decrypted != "" {
 			return decrypted
 		}
-		if orig := reverseLookup(fullMatch); orig != "" {
+		if orig := e.reverseLookup(fullMatch, tenantID); orig != "" {
 			return orig
 		}
+		unresolved.add("phone")
 		return fullMatch
 	})
 
@@ -246,12 +326,42 @@ var (
 // Tokens can be split across multiple SSE events (each event carries a small
 // text delta). We buffer text_delta content per content block and only flush
 // text that cannot be part of an in-progress token. On content_block_stop
-// (or stream end) we flush everything remaining.
+// (or stream end) we flush everything remaining. A block's buffer never
+// holds more than the stream buffer cap (see streamBufferLimit): past it the
+// oldest text is flushed without waiting for a safe point.
 func CreateDeanonymizeStream(r io.Reader) io.ReadCloser {
+	return CreateDeanonymizeStreamForTenant(r, "")
+}
+
+// CreateDeanonymizeStreamForTenant is CreateDeanonymizeStream for a response
+// to a tenant's request; see DeanonymizeForTenant.
+func CreateDeanonymizeStreamForTenant(r io.Reader, tenantID string) io.ReadCloser {
+	return defaultEngine.DeanonymizeStream(r, tenantID)
+}
+
+// CreateDeanonymizeStreamForTenantWithUnresolved is
+// CreateDeanonymizeStreamForTenant that passes the tokens it could not
+// restore to done once the stream ends, before the reader sees EOF.
+func CreateDeanonymizeStreamForTenantWithUnresolved(r io.Reader, tenantID string, done func(Unresolved)) io.ReadCloser {
+	return defaultEngine.deanonymizeStream(r, tenantID, done)
+}
+
+// DeanonymizeStream is CreateDeanonymizeStreamForTenant on the engine.
+func (e *Engine) DeanonymizeStream(r io.Reader, tenantID string) io.ReadCloser {
+	return e.deanonymizeStream(r, tenantID, nil)
+}
+
+func (e *Engine) deanonymizeStream(r io.Reader, tenantID string, done func(Unresolved)) io.ReadCloser {
 	pr, pw := io.Pipe()
+	stream := streamutil.NewPipe(pr, r)
 
 	go func() {
 		defer pw.Close()
+		defer streamutil.Recover(pw, "guardrails", "DeanonymizeStream")
+		unresolved := Unresolved{}
+		if done != nil {
+			defer func() { done(unresolved) }()
+		}
 
 		scanner := bufio.NewScanner(r)
 		scanner.Buffer(make([]byte, 0, 256*1024), 256*1024)
@@ -259,15 +369,17 @@ func CreateDeanonymizeStream(r io.Reader) io.ReadCloser {
 		var sseBuffer bytes.Buffer
 		textBuffers := make(map[int]string)
 		jsonBuffers := make(map[int]string)
+		bufferCap := e.streamBufferLimit()
+		capLogged := false
 
 		flushBuffer := func(index int) {
 			if buf, ok := textBuffers[index]; ok && buf != "" {
-				deanon := Deanonymize(buf)
+				deanon := e.deanonymize(buf, tenantID, unresolved)
 				writeTextDelta(pw, index, deanon)
 				delete(textBuffers, index)
 			}
 			if buf, ok := jsonBuffers[index]; ok && buf != "" {
-				deanon := Deanonymize(buf)
+				deanon := e.deanonymize(buf, tenantID, unresolved)
 				writeJSONDelta(pw, index, deanon)
 				delete(jsonBuffers, index)
 			}
@@ -279,18 +391,44 @@ func CreateDeanonymizeStream(r io.Reader) io.ReadCloser {
 				return
 			}
 
-			safePoint := findSafeFlushPoint(buf)
+			safePoint := e.findSafeFlushPoint(buf, tenantID)
 			if safePoint > 0 {
 				safe := buf[:safePoint]
 				remaining := buf[safePoint:]
-				deanon := Deanonymize(safe)
+				deanon := e.deanonymize(safe, tenantID, unresolved)
 				writeTextDelta(pw, index, deanon)
 				textBuffers[index] = remaining
 			}
 		}
 
+		// forceFlush bounds a buffer that found no safe point: all but its
+		// last streamBufferKeep bytes are deanonymized and written. A token
+		// cut there can't be restored, so the cut counts as unresolved.
+		forceFlush := func(buffers map[int]string, index int, write func(io.Writer, int, string)) {
+			buf := buffers[index]
+			if len(buf) <= bufferCap {
+				return
+			}
+			cut := len(buf) - min(streamBufferKeep, bufferCap/2)
+			for cut > 0 && !utf8.RuneStart(buf[cut]) {
+				cut--
+			}
+			if !capLogged {
+				capLogged = true
+				log.Printf("[guardrails] WARN stream buffer for content block %d passed %d bytes; flushing it without waiting for a safe point", index, bufferCap)
+			}
+			if e.findSafeFlushPoint(buf[:cut], tenantID) < cut {
+				unresolved.add("split")
+			}
+			write(pw, index, e.deanonymize(buf[:cut], tenantID, unresolved))
+			buffers[index] = buf[cut:]
+		}
+
 		// Process line by line, accumulating SSE events
 		for scanner.Scan() {
+			if stream.Closed() {
+				return
+			}
 			line := scanner.Text()
 			sseBuffer.WriteString(line)
 			sseBuffer.WriteByte('\n')
@@ -312,13 +450,13 @@ func CreateDeanonymizeStream(r io.Reader) io.ReadCloser {
 			// Try to parse the SSE data line
 			dataLine := extractDataLine(event)
 			if dataLine == "" {
-				fmt.Fprint(pw, Deanonymize(event))
+				fmt.Fprint(pw, e.deanonymize(event, tenantID, unresolved))
 				continue
 			}
 
 			var parsed map[string]any
 			if err := json.Unmarshal([]byte(dataLine), &parsed); err != nil {
-				fmt.Fprint(pw, Deanonymize(event))
+				fmt.Fprint(pw, e.deanonymize(event, tenantID, unresolved))
 				continue
 			}
 
@@ -330,6 +468,7 @@ func CreateDeanonymizeStream(r io.Reader) io.ReadCloser {
 						idx := getIndex(parsed)
 						textBuffers[idx] += text
 						tryFlushSafe(idx)
+						forceFlush(textBuffers, idx, writeTextDelta)
 						continue
 					}
 				}
@@ -339,7 +478,9 @@ func CreateDeanonymizeStream(r io.Reader) io.ReadCloser {
 					if partialJSON, ok := delta["partial_json"].(string); ok {
 						idx := getIndex(parsed)
 						jsonBuffers[idx] += partialJSON
-						continue // Don't flush until content_block_stop
+						// Otherwise held until content_block_stop
+						forceFlush(jsonBuffers, idx, writeJSONDelta)
+						continue
 					}
 				}
 			}
@@ -353,7 +494,7 @@ func CreateDeanonymizeStream(r io.Reader) io.ReadCloser {
 			}
 
 			// Everything else passes through with basic per-event deanonymization
-			fmt.Fprint(pw, Deanonymize(event))
+			fmt.Fprint(pw, e.deanonymize(event, tenantID, unresolved))
 		}
 
 		// Flush all remaining buffers on stream end
@@ -366,17 +507,38 @@ func CreateDeanonymizeStream(r io.Reader) io.ReadCloser {
 		if sseBuffer.Len() > 0 {
 			remaining := strings.TrimSpace(sseBuffer.String())
 			if remaining != "" {
-				fmt.Fprint(pw, Deanonymize(remaining))
+				fmt.Fprint(pw, e.deanonymize(remaining, tenantID, unresolved))
 			}
 		}
 	}()
 
-	return pr
+	return stream
+}
+
+const (
+	// defaultStreamBufferCap is the per-block stream buffer cap when
+	// guardrail_stream_buffer_kb is unset.
+	defaultStreamBufferCap = 64 << 10
+	// streamBufferKeep is how much of a buffer a forced flush holds back,
+	// so a token arriving at its end can still be restored.
+	streamBufferKeep = 256
+)
+
+// streamBufferLimit returns the most text a stream holds per content block:
+// WithStreamBufferCap, the guardrail_stream_buffer_kb setting, or 64KB.
+func (e *Engine) streamBufferLimit() int {
+	if e.streamBufferCap > 0 {
+		return e.streamBufferCap
+	}
+	if kb, err := strconv.Atoi(db.GetSetting("guardrail_stream_buffer_kb")); err == nil && kb > 0 {
+		return kb << 10
+	}
+	return defaultStreamBufferCap
 }
 
 // findSafeFlushPoint finds the latest safe cut point in text. Everything
 // before this index cannot be part of a still-growing anonymised token.
-func findSafeFlushPoint(text string) int {
+func (e *Engine) findSafeFlushPoint(text, tenantID string) int {
 	if text == "" {
 		return 0
 	}
@@ -395,9 +557,10 @@ func findSafeFlushPoint(text string) int {
 
 	// 2. Check if the buffer tail is a prefix of any known anonymized value.
 	maxOverlap := 0
-	reverseMap.Range(func(key, value any) bool {
-		k := key.(string)
-		if strings.HasPrefix(k, "[") {
+	scope := reverseKey(tenantID, "")
+	e.reverseMap.Range(func(key, value any) bool {
+		k, ok := strings.CutPrefix(key.(string), scope)
+		if !ok || strings.HasPrefix(k, "[") {
 			return true // bracket tokens handled above
 		}
 		limit := len(k) - 1
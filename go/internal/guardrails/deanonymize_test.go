@@ -1,14 +1,26 @@
 package guardrails
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestDeanonymize_BracketTokens(t *testing.T) {
 	original := "123-45-6789"
-	replacement := getOrCreateMapping(original, "ssn", func(o string) string {
-		token := encryptForToken(o, "ssn")
+	replacement := defaultEngine.getOrCreateMapping(original, "ssn", "", func(e *Engine, o, tenantID string) string {
+		token := e.encryptForToken(o, "ssn")
 		return "[SSN-" + token[:12] + "]"
 	})
 
@@ -20,7 +32,7 @@ func TestDeanonymize_BracketTokens(t *testing.T) {
 
 func TestDeanonymize_EmailFormat(t *testing.T) {
 	original := "john.doe@example.com"
-	replacement := getOrCreateMapping(original, "email", emailPatternDef.ReplacementGenerator)
+	replacement := defaultEngine.getOrCreateMapping(original, "email", "", emailPatternDef.ReplacementGenerator)
 
 	if !strings.Contains(replacement, "@anon.com") {
 		t.Fatalf("email replacement should contain @anon.com, got %q", replacement)
@@ -34,7 +46,7 @@ func TestDeanonymize_EmailFormat(t *testing.T) {
 
 func TestDeanonymize_APIKeyTokens(t *testing.T) {
 	original := "sk-ant-REDACTED"
-	replacement := getOrCreateMapping(original, "api_key", generateAPIKeyReplacement)
+	replacement := defaultEngine.getOrCreateMapping(original, "api_key", "", generateAPIKeyReplacement)
 
 	result := Deanonymize(replacement)
 	if result != original {
@@ -44,7 +56,7 @@ func TestDeanonymize_APIKeyTokens(t *testing.T) {
 
 func TestDeanonymize_SecretTokens(t *testing.T) {
 	original := "MyVerySecretLongPassword123!"
-	replacement := getOrCreateMapping(original, "secret", generateAPIKeySecretReplacement)
+	replacement := defaultEngine.getOrCreateMapping(original, "secret", "", generateAPIKeySecretReplacement)
 
 	if !strings.Contains(replacement, "[SECRET-") {
 		t.Fatalf("secret replacement should contain [SECRET-, got %q", replacement)
@@ -84,7 +96,7 @@ func TestCreateDeanonymizeStream(t *testing.T) {
 
 	// Create a known mapping
 	original := "alice@example.com"
-	replacement := getOrCreateMapping(original, "email", emailPatternDef.ReplacementGenerator)
+	replacement := defaultEngine.getOrCreateMapping(original, "email", "", emailPatternDef.ReplacementGenerator)
 
 	// Create SSE stream with the replacement
 	sseData := "event: content_block_delta\ndata: " +
@@ -103,3 +115,193 @@ func TestCreateDeanonymizeStream(t *testing.T) {
 		t.Errorf("stream deanonymize should contain original %q, got: %s", original, result)
 	}
 }
+
+// stalledReader blocks until closed, like an upstream that stops sending
+// mid-stream.
+type stalledReader struct {
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (r *stalledReader) Read(p []byte) (int, error) {
+	<-r.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (r *stalledReader) Close() error {
+	r.once.Do(func() { close(r.closed) })
+	return nil
+}
+
+func TestCreateDeanonymizeStream_CloseStopsGoroutine(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	// Endless events: the goroutine keeps producing until told to stop
+	event := "data: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"hello \"}}\n\n"
+	pr, pw := io.Pipe()
+	go func() {
+		for {
+			if _, err := io.WriteString(pw, event); err != nil {
+				return
+			}
+		}
+	}()
+	stream := CreateDeanonymizeStream(pr)
+	if _, err := stream.Read(make([]byte, 16)); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	stream.Close()
+
+	stalled := &stalledReader{closed: make(chan struct{})}
+	CreateDeanonymizeStream(stalled).Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines = %d, want %d: stream goroutine leaked", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// panicReader panics on the first read.
+type panicReader struct{}
+
+func (panicReader) Read([]byte) (int, error) { panic("bad input") }
+
+func TestCreateDeanonymizeStream_PanicFailsStream(t *testing.T) {
+	stream := CreateDeanonymizeStream(panicReader{})
+	defer stream.Close()
+	if _, err := io.ReadAll(stream); err == nil || !strings.Contains(err.Error(), "bad input") {
+		t.Errorf("err = %v, want the panic", err)
+	}
+}
+
+func TestDeanonymize_CountsUnresolvedTokens(t *testing.T) {
+	ssn := defaultEngine.getOrCreateMapping("123-45-6789", "ssn", "", func(e *Engine, o, tenantID string) string {
+		return "[SSN-" + e.encryptForToken(o, "ssn")[:12] + "]"
+	})
+	// Tokens from another key, or cut short by the model, restore to nothing
+	text := "SSN " + ssn + ", then [SSN-AbC123xyz] and [VISA-0000deadbeef], sk-[notAKey], [TODO-later] and [draft]"
+
+	got, unresolved := DeanonymizeForTenantWithUnresolved(text, "")
+	if !strings.HasPrefix(got, "SSN 123-45-6789, then [SSN-AbC123xyz]") {
+		t.Errorf("deanonymized = %q", got)
+	}
+	if s := unresolved.String(); s != "api_key=1, card=1, ssn=1" || unresolved.Total() != 3 {
+		t.Errorf("unresolved = %q (total %d)", s, unresolved.Total())
+	}
+
+	sse := "event: content_block_delta\ndata: " +
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Your SSN is [SSN-AbC"}}` +
+		"\n\nevent: content_block_delta\ndata: " +
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"123xyz] and ` + ssn + `"}}` +
+		"\n\nevent: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":0}\n\n"
+	var streamed Unresolved
+	stream := CreateDeanonymizeStreamForTenantWithUnresolved(strings.NewReader(sse), "", func(u Unresolved) { streamed = u })
+	out, _ := io.ReadAll(stream)
+	stream.Close()
+	if !strings.Contains(string(out), "[SSN-AbC123xyz] and 123-45-6789") {
+		t.Errorf("stream = %s", out)
+	}
+	if streamed.String() != "ssn=1" {
+		t.Errorf("stream unresolved = %q", streamed.String())
+	}
+}
+
+func TestDeanonymizeStream_BufferCap(t *testing.T) {
+	const bufferCap = 1024
+	e := NewEngine(WithKey(bytes.Repeat([]byte{0xc}, 32)), WithStreamBufferCap(bufferCap))
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	// A replacement long enough that text matching its start never reaches
+	// a safe point
+	var long strings.Builder
+	for i := 0; long.Len() < 8<<10; i++ {
+		sum := sha256.Sum256([]byte{byte(i), byte(i >> 8)})
+		long.WriteString(hex.EncodeToString(sum[:]))
+	}
+	e.getOrCreateMapping("the original", "secret", "", func(*Engine, string, string) string { return long.String() })
+
+	src, upstream := io.Pipe()
+	unresolved := make(chan Unresolved, 1)
+	stream := e.deanonymizeStream(src, "", func(u Unresolved) { unresolved <- u })
+	defer stream.Close()
+
+	// What came out so far, by delta type
+	var mu sync.Mutex
+	out := map[string]*strings.Builder{"text": {}, "json": {}}
+	go func() {
+		sc := bufio.NewScanner(stream)
+		sc.Buffer(nil, 1<<20)
+		for sc.Scan() {
+			data, ok := strings.CutPrefix(sc.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var ev struct {
+				Delta struct{ Text, PartialJSON string } `json:"delta"`
+			}
+			json.Unmarshal([]byte(strings.ReplaceAll(data, "partial_json", "partialjson")), &ev)
+			mu.Lock()
+			out["text"].WriteString(ev.Delta.Text)
+			out["json"].WriteString(ev.Delta.PartialJSON)
+			mu.Unlock()
+		}
+	}()
+	received := func(kind string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		return out[kind].String()
+	}
+
+	// Tool arguments are otherwise held until the block stops
+	text := long.String()[:5000]
+	args := `{"content":"` + strings.Repeat("a", 20000) + `"}`
+	send := func(index int, deltaType, field, value string) {
+		v, _ := json.Marshal(value)
+		fmt.Fprintf(upstream, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":%d,\"delta\":{\"type\":%q,%q:%s}}\n\n",
+			index, deltaType, field, v)
+	}
+	for i := 0; i < len(text); i += 100 {
+		send(0, "text_delta", "text", text[i:min(i+100, len(text))])
+	}
+	for i := 0; i < len(args); i += 100 {
+		send(1, "input_json_delta", "partial_json", args[i:min(i+100, len(args))])
+	}
+
+	// With both blocks still open, all but the cap has been passed on
+	deadline := time.Now().Add(2 * time.Second)
+	for len(received("text")) < len(text)-bufferCap || len(received("json")) < len(args)-bufferCap {
+		if time.Now().After(deadline) {
+			t.Fatalf("stream held back %d bytes of text and %d of arguments, cap %d",
+				len(text)-len(received("text")), len(args)-len(received("json")), bufferCap)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	io.WriteString(upstream, "event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":0}\n\n"+
+		"event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":1}\n\n")
+	upstream.Close()
+	deadline = time.Now().Add(2 * time.Second)
+	for received("text") != text || received("json") != args {
+		if time.Now().After(deadline) {
+			t.Fatalf("stream lost content: got %d of %d text bytes, %d of %d argument bytes",
+				len(received("text")), len(text), len(received("json")), len(args))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := strings.Count(logs.String(), "stream buffer for content block"); n != 1 {
+		t.Errorf("cap logged %d times, want once per stream:\n%s", n, logs.String())
+	}
+	select {
+	case u := <-unresolved:
+		if u["split"] != 1 {
+			t.Errorf("unresolved = %q, want the cut through the replacement counted as split=1", u.String())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream didn't report unresolved tokens")
+	}
+}
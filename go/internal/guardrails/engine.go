@@ -0,0 +1,143 @@
+package guardrails
+
+import "sync"
+
+// Engine holds the state behind anonymization: the encryption key, the
+// guardrail registry, and the reverse map of replacements. Engines with
+// different keys issue tokens that don't decrypt in each other's responses.
+// The package-level functions use a default engine whose key comes from
+// GUARDRAIL_KEY or the data directory.
+type Engine struct {
+	keyMu     sync.Mutex
+	key       []byte
+	keySource string
+	// keyErr is the key canary mismatch found by InitGuardrails.
+	keyErr error
+
+	registryMu sync.RWMutex
+	factories  map[string]guardrailFactory
+	instances  map[string]Guardrail
+
+	// reverseMap stores replacement -> mapping entries populated during
+	// anonymization, keyed by reverseKey so one tenant's replacements never
+	// resolve in another tenant's responses.
+	reverseMap sync.Map
+
+	// streamBufferCap overrides the guardrail_stream_buffer_kb setting.
+	streamBufferCap int
+}
+
+// mapping is a reverse-map entry.
+type mapping struct {
+	original string
+	category string
+}
+
+// Key sources reported by Stats.
+const (
+	KeySourceEnv       = "env"
+	KeySourceFile      = "file"
+	KeySourceGenerated = "generated"
+	KeySourceExplicit  = "explicit"
+)
+
+// Option configures an Engine created by NewEngine.
+type Option func(*Engine)
+
+// WithKey sets the engine's 32-byte encryption key instead of loading one
+// from the environment or the data directory.
+func WithKey(key []byte) Option {
+	return func(e *Engine) {
+		e.key = append([]byte(nil), key...)
+		e.keySource = KeySourceExplicit
+	}
+}
+
+// WithStreamBufferCap caps the text held per content block while streaming
+// at n bytes, instead of the guardrail_stream_buffer_kb setting.
+func WithStreamBufferCap(n int) Option {
+	return func(e *Engine) {
+		e.streamBufferCap = n
+	}
+}
+
+// NewEngine returns an isolated engine with the built-in guardrails
+// registered at their default settings.
+func NewEngine(opts ...Option) *Engine {
+	e := newEngine()
+	for _, opt := range opts {
+		opt(e)
+	}
+	e.registerBuiltinGuardrails()
+	return e
+}
+
+func newEngine() *Engine {
+	return &Engine{
+		factories: make(map[string]guardrailFactory),
+		instances: make(map[string]Guardrail),
+	}
+}
+
+// defaultEngine backs the package-level functions. Its guardrails are
+// registered by InitGuardrails.
+var defaultEngine = newEngine()
+
+// Default returns the engine behind the package-level functions.
+func Default() *Engine {
+	return defaultEngine
+}
+
+// ResetForTest drops the default engine's reverse mappings and cached key
+// and returns its guardrails to their default settings, so tests in other
+// packages start from a clean state.
+func ResetForTest() {
+	e := defaultEngine
+	e.ClearReverseMappings()
+
+	e.keyMu.Lock()
+	e.key = nil
+	e.keySource = ""
+	e.keyErr = nil
+	e.keyMu.Unlock()
+
+	e.registryMu.Lock()
+	clear(e.instances)
+	e.registryMu.Unlock()
+}
+
+// EngineStats describes an engine's in-memory state.
+type EngineStats struct {
+	Mappings int `json:"mappings"`
+	// ApproxBytes estimates the reverse map's memory from its key and value
+	// lengths plus a fixed per-entry overhead.
+	ApproxBytes int            `json:"approx_bytes"`
+	ByCategory  map[string]int `json:"by_category"`
+	// KeySource is where the key came from, or "" before the first token
+	// was issued.
+	KeySource string `json:"key_source"`
+}
+
+// mappingOverhead approximates sync.Map's per-entry cost beyond the strings.
+const mappingOverhead = 96
+
+// Stats reports the engine's mapping count, size and key source.
+func (e *Engine) Stats() EngineStats {
+	s := EngineStats{ByCategory: make(map[string]int)}
+	e.reverseMap.Range(func(key, value any) bool {
+		m := value.(mapping)
+		s.Mappings++
+		s.ApproxBytes += len(key.(string)) + len(m.original) + len(m.category) + mappingOverhead
+		s.ByCategory[m.category]++
+		return true
+	})
+	e.keyMu.Lock()
+	s.KeySource = e.keySource
+	e.keyMu.Unlock()
+	return s
+}
+
+// Stats reports the default engine's state; see Engine.Stats.
+func Stats() EngineStats {
+	return defaultEngine.Stats()
+}
@@ -0,0 +1,90 @@
+package guardrails
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEngines_KeysNotInterchangeable(t *testing.T) {
+	keyA := bytes.Repeat([]byte{0xa}, 32)
+	a := NewEngine(WithKey(keyA))
+	b := NewEngine(WithKey(bytes.Repeat([]byte{0xb}, 32)))
+
+	text := "ssn 123-45-6789, key sk-ant-REDACTED"
+	anonA, anonB := a.Anonymize(text, ""), b.Anonymize(text, "")
+	if anonA == text || anonA == anonB {
+		t.Fatalf("engines produced the same output: %q", anonA)
+	}
+	if got := a.Deanonymize(anonA, ""); got != text {
+		t.Errorf("own tokens: got %q", got)
+	}
+	if got := b.Deanonymize(anonA, ""); got != anonA {
+		t.Errorf("other engine restored tokens: %q", got)
+	}
+	if got := Deanonymize(anonA); got != anonA {
+		t.Errorf("default engine restored tokens: %q", got)
+	}
+	// The same key issues the same tokens
+	if got := NewEngine(WithKey(keyA)).Anonymize(text, ""); got != anonA {
+		t.Errorf("same key: got %q, want %q", got, anonA)
+	}
+}
+
+func TestEngine_Stats(t *testing.T) {
+	e := NewEngine(WithKey(bytes.Repeat([]byte{1}, 32)))
+	e.Anonymize("mail jane.doe@example.com from 10.1.2.3", "t1")
+
+	s := e.Stats()
+	// The IP registers its plain inner address as well
+	if s.Mappings != 3 || s.ByCategory["email"] != 1 || s.ByCategory["ip_address"] != 2 {
+		t.Errorf("stats = %+v", s)
+	}
+	if s.ApproxBytes < 3*mappingOverhead || s.KeySource != KeySourceExplicit {
+		t.Errorf("stats = %+v", s)
+	}
+
+	e.ClearReverseMappings()
+	if s := e.Stats(); s.Mappings != 0 || s.ApproxBytes != 0 {
+		t.Errorf("after clear: %+v", s)
+	}
+}
+
+func TestEngine_KeySource(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	t.Setenv("GUARDRAIL_KEY", "")
+
+	for _, want := range []string{KeySourceGenerated, KeySourceFile} {
+		e := NewEngine()
+		if s := e.Stats(); s.KeySource != "" {
+			t.Errorf("key source before first use = %q", s.KeySource)
+		}
+		e.Anonymize("ssn 123-45-6789", "")
+		if s := e.Stats(); s.KeySource != want {
+			t.Errorf("key source = %q, want %q", s.KeySource, want)
+		}
+	}
+
+	t.Setenv("GUARDRAIL_KEY", "passphrase")
+	e := NewEngine()
+	e.Anonymize("ssn 123-45-6789", "")
+	if s := e.Stats(); s.KeySource != KeySourceEnv {
+		t.Errorf("key source = %q, want %q", s.KeySource, KeySourceEnv)
+	}
+}
+
+func TestResetForTest(t *testing.T) {
+	RunGuardrails("mail jane.doe@example.com")
+	defaultEngine.setGuardrailEnabled("email", false)
+	if Stats().Mappings == 0 {
+		t.Fatal("no mappings recorded")
+	}
+
+	ResetForTest()
+	if s := Stats(); s.Mappings != 0 || s.KeySource != "" {
+		t.Errorf("after reset: %+v", s)
+	}
+	if got := RunGuardrails("mail jane.doe@example.com"); strings.Contains(got, "jane.doe") {
+		t.Errorf("email guardrail not restored to its default: %q", got)
+	}
+}
@@ -0,0 +1,55 @@
+package guardrails
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func FuzzDeanonymize(f *testing.F) {
+	email := defaultEngine.getOrCreateMapping("alice@example.com", "email", "", emailPatternDef.ReplacementGenerator)
+	bracket := defaultEngine.getOrCreateMapping("123-45-6789", "ssn", "", func(e *Engine, o, tenantID string) string {
+		return "[SSN-" + e.encryptForToken(o, "ssn")[:12] + "]"
+	})
+
+	// Seeds mirror the fixtures of deanonymize_test.go
+	for _, s := range []string{
+		email,
+		bracket,
+		"Contact " + email + " or " + bracket + ".",
+		"[SSN-",
+		"[SECRET-med-abc",
+		email[:len(email)-3],
+		"no tokens here",
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, text string) {
+		Deanonymize(text)
+		DeanonymizeForTenant(text, "tenant-1")
+	})
+}
+
+func FuzzDeanonymizeStream(f *testing.F) {
+	email := defaultEngine.getOrCreateMapping("alice@example.com", "email", "", emailPatternDef.ReplacementGenerator)
+	for _, s := range []string{
+		"event: content_block_delta\ndata: " +
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"` + email + `"}}` +
+			"\n\nevent: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":0}\n\n",
+		"event: content_block_delta\ndata: " +
+			`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"to\":\"` + email[:5] + `"}}` +
+			"\n\nevent: content_block_delta\ndata: " +
+			`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"` + email[5:] + `\"}"}}` +
+			"\n\nevent: message_stop\ndata: {\"type\":\"message_stop\"}\n\n",
+		"data: {\"type\":\"content_block_delta\",\"index\":-1,\"delta\":{\"type\":\"text_delta\",\"text\":\"[SSN-\"}}\n\n",
+	} {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		stream := CreateDeanonymizeStream(bytes.NewReader(data))
+		defer stream.Close()
+		if _, err := io.ReadAll(stream); err != nil {
+			t.Fatalf("stream error: %v", err)
+		}
+	})
+}
@@ -1,15 +1,15 @@
 package guardrails
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
 	"regexp"
 	"sort"
 	"strings"
-	"sync"
 
 	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/metrics"
+	"codegate-proxy/internal/redact"
 )
 
 // ─── Guardrail interface ─────────────────────────────────────────────────────
@@ -42,62 +42,56 @@ type Guardrail interface {
 	// ShouldRun returns true if this guardrail should execute on the given text
 	// in the given lifecycle phase.
 	ShouldRun(text string, lifecycle string) bool
-	// Execute runs the guardrail on text, returning the modified text and
-	// the number of detections.
-	Execute(text string) (string, int)
+	// Execute runs the guardrail on text for a tenant ("" for global
+	// traffic), returning the modified text and the number of detections.
+	Execute(text, tenantID string) (string, int)
 }
 
 // ─── Registry ────────────────────────────────────────────────────────────────
 
-type guardrailFactory func() Guardrail
-
-var (
-	factories   = make(map[string]guardrailFactory)
-	instances   = make(map[string]Guardrail)
-	registryMu  sync.RWMutex
-)
+type guardrailFactory func(e *Engine) Guardrail
 
 // registerGuardrail registers a guardrail factory. The guardrail is not
 // instantiated until first use.
-func registerGuardrail(id string, factory guardrailFactory) {
-	registryMu.Lock()
-	defer registryMu.Unlock()
-	factories[id] = factory
-	delete(instances, id) // clear cached instance if re-registering
+func (e *Engine) registerGuardrail(id string, factory guardrailFactory) {
+	e.registryMu.Lock()
+	defer e.registryMu.Unlock()
+	e.factories[id] = factory
+	delete(e.instances, id) // clear cached instance if re-registering
 }
 
 // getGuardrailInstance returns a guardrail by ID (lazy instantiation).
-func getGuardrailInstance(id string) Guardrail {
-	registryMu.Lock()
-	defer registryMu.Unlock()
+func (e *Engine) getGuardrailInstance(id string) Guardrail {
+	e.registryMu.Lock()
+	defer e.registryMu.Unlock()
 
-	if inst, ok := instances[id]; ok {
+	if inst, ok := e.instances[id]; ok {
 		return inst
 	}
-	factory, ok := factories[id]
+	factory, ok := e.factories[id]
 	if !ok {
 		return nil
 	}
-	inst := factory()
-	instances[id] = inst
+	inst := factory(e)
+	e.instances[id] = inst
 	return inst
 }
 
 // getAllGuardrails returns all guardrails sorted by priority (lower = higher
 // priority = runs first).
-func getAllGuardrails() []Guardrail {
-	registryMu.Lock()
-	defer registryMu.Unlock()
+func (e *Engine) getAllGuardrails() []Guardrail {
+	e.registryMu.Lock()
+	defer e.registryMu.Unlock()
 
 	// Ensure all factories are instantiated
-	for id, factory := range factories {
-		if _, ok := instances[id]; !ok {
-			instances[id] = factory()
+	for id, factory := range e.factories {
+		if _, ok := e.instances[id]; !ok {
+			e.instances[id] = factory(e)
 		}
 	}
 
-	result := make([]Guardrail, 0, len(instances))
-	for _, inst := range instances {
+	result := make([]Guardrail, 0, len(e.instances))
+	for _, inst := range e.instances {
 		result = append(result, inst)
 	}
 
@@ -108,8 +102,8 @@ func getAllGuardrails() []Guardrail {
 }
 
 // setGuardrailEnabled updates a guardrail's enabled state.
-func setGuardrailEnabled(id string, enabled bool) bool {
-	g := getGuardrailInstance(id)
+func (e *Engine) setGuardrailEnabled(id string, enabled bool) bool {
+	g := e.getGuardrailInstance(id)
 	if g == nil {
 		return false
 	}
@@ -119,21 +113,19 @@ func setGuardrailEnabled(id string, enabled bool) bool {
 
 // ─── Reverse map (replacement -> original) ───────────────────────────────────
 
-// reverseMap stores replacement -> original mappings populated during anonymization.
-var reverseMap sync.Map
-
 // logReplacement records a replacement in the reverse map and registers
 // any sub-values that the model might extract from structured formats.
-func logReplacement(category, original, replacement string) {
-	reverseMap.Store(replacement, original)
+func (e *Engine) logReplacement(category, tenantID, original, replacement string) {
+	entry := mapping{original: original, category: category}
+	e.reverseMap.Store(reverseKey(tenantID, replacement), entry)
 
 	// Register inner sub-values that the model might extract from
 	// structured replacement formats.
 	if m := ipSubRe.FindStringSubmatch(replacement); m != nil {
-		reverseMap.Store(m[1], original)
+		e.reverseMap.Store(reverseKey(tenantID, m[1]), entry)
 	}
 	if m := phoneSubRe.FindStringSubmatch(replacement); m != nil {
-		reverseMap.Store(m[1], original)
+		e.reverseMap.Store(reverseKey(tenantID, m[1]), entry)
 	}
 }
 
@@ -142,36 +134,50 @@ var (
 	phoneSubRe = regexp.MustCompile(`^(\d{3}-\d{3}-\d{4})-[A-Za-z0-9_-]+$`)
 )
 
-// reverseLookup returns the original for a replacement, or "" if not found.
-func reverseLookup(replacement string) string {
-	if v, ok := reverseMap.Load(replacement); ok {
-		return v.(string)
+// reverseLookup returns the original for a tenant's replacement, or "" if
+// not found.
+func (e *Engine) reverseLookup(replacement, tenantID string) string {
+	if v, ok := e.reverseMap.Load(reverseKey(tenantID, replacement)); ok {
+		return v.(mapping).original
 	}
 	return ""
 }
 
-// ClearReverseMappings clears the in-memory reverse map.
+// ClearReverseMappings clears the engine's in-memory reverse map.
+func (e *Engine) ClearReverseMappings() {
+	e.reverseMap.Clear()
+}
+
+// ClearReverseMappings clears the default engine's in-memory reverse map.
 func ClearReverseMappings() {
-	reverseMap.Range(func(key, value any) bool {
-		reverseMap.Delete(key)
-		return true
-	})
+	defaultEngine.ClearReverseMappings()
 }
 
 // ─── Core mapping logic ──────────────────────────────────────────────────────
 
 // getOrCreateMapping generates a replacement for a matched value using the
 // provided generator function and logs it.
-func getOrCreateMapping(original, category string, generatorFn func(string) string) string {
-	replacement := generatorFn(original)
-	logReplacement(category, original, replacement)
+func (e *Engine) getOrCreateMapping(original, category, tenantID string, generatorFn replacementFunc) string {
+	// Values this tenant already received as replacements (including the
+	// plain IPs and phones registered from them) are left as they are
+	if e.reverseLookup(original, tenantID) != "" {
+		return original
+	}
+	replacement := generatorFn(e, original, tenantID)
+	if replacement == original {
+		return original
+	}
+	e.logReplacement(category, tenantID, original, replacement)
 	return replacement
 }
 
+// replacementFunc generates a replacement for original under e's key.
+type replacementFunc func(e *Engine, original, tenantID string) string
+
 // replacePatternMatches replaces all matches of a pattern with mapped replacements.
-func replacePatternMatches(text string, pattern *regexp.Regexp, category string, generatorFn func(string) string) string {
+func (e *Engine) replacePatternMatches(text string, pattern *regexp.Regexp, category, tenantID string, generatorFn replacementFunc) string {
 	return pattern.ReplaceAllStringFunc(text, func(match string) string {
-		return getOrCreateMapping(match, category, generatorFn)
+		return e.getOrCreateMapping(match, category, tenantID, generatorFn)
 	})
 }
 
@@ -179,6 +185,7 @@ func replacePatternMatches(text string, pattern *regexp.Regexp, category string,
 
 // patternGuardrail implements Guardrail for regex-based pattern detection.
 type patternGuardrail struct {
+	engine *Engine
 	def    PatternDef
 	config GuardrailConfig
 }
@@ -202,7 +209,7 @@ func (pg *patternGuardrail) ShouldRun(text string, lifecycle string) bool {
 	return true
 }
 
-func (pg *patternGuardrail) Execute(text string) (string, int) {
+func (pg *patternGuardrail) Execute(text, tenantID string) (string, int) {
 	result := text
 	count := 0
 
@@ -231,16 +238,17 @@ func (pg *patternGuardrail) Execute(text string) (string, int) {
 				return match
 			}
 			count++
-			return getOrCreateMapping(match, pg.def.ID, pg.def.ReplacementGenerator)
+			return pg.engine.getOrCreateMapping(match, pg.def.ID, tenantID, pg.def.ReplacementGenerator)
 		})
 	}
 
 	return result, count
 }
 
-func createPatternGuardrail(def PatternDef) Guardrail {
+func createPatternGuardrail(e *Engine, def PatternDef) Guardrail {
 	return &patternGuardrail{
-		def: def,
+		engine: e,
+		def:    def,
 		config: GuardrailConfig{
 			ID:          def.ID,
 			Name:        def.Name,
@@ -256,17 +264,10 @@ func createPatternGuardrail(def PatternDef) Guardrail {
 
 // ─── API Key guardrail ───────────────────────────────────────────────────────
 
-// vendorPrefixes lists 40+ known API key prefixes.
-var vendorPrefixes = []string{
-	"sk-ant-", "sk-proj-", "sk-", "ghp_", "gho_", "glpat-", "xoxb-",
-	"xoxp-", "xapp-", "xoxe-", "AKIA", "AIza", "hf_", "pk_live_", "sk_live_",
-	"rk_live_", "whsec_", "github_pat_", "pypi-", "npm_", "FLWSECK-",
-	"sq0atp-", "SG.", "key-", "sk-or-", "r8_", "sntrys_",
-	"op_", "Bearer ey",
-}
-
-var knownPrefixRe = regexp.MustCompile(
-	`(?:sk-ant-|sk-proj-|sk-|ghp_|gho_|glpat-|xoxb-|xoxp-|xapp-|xoxe-|AKIA|AIza|hf_|pk_live_|sk_live_|rk_live_|whsec_|github_pat_|pypi-|npm_|FLWSECK-|sq0atp-|SG\.|key-|sk-or-|r8_|sntrys_|op_|Bearer\s+ey)[A-Za-z0-9_\-/.+=]{10,}`,
+// vendorPrefixes and knownPrefixRe are shared with log redaction.
+var (
+	vendorPrefixes = redact.VendorPrefixes
+	knownPrefixRe  = redact.KnownPrefixRe
 )
 
 // standaloneTokenRe matches standalone high-entropy tokens for entropy fallback.
@@ -274,7 +275,10 @@ var standaloneTokenRe = regexp.MustCompile(
 	`(?:^|[^a-zA-Z0-9_/\\\-\.])([A-Za-z0-9+/=_\-]{20,})(?:[^a-zA-Z0-9_/\\\-\.]|$)`,
 )
 
-func generateAPIKeyReplacement(original string) string {
+func generateAPIKeyReplacement(e *Engine, original, tenantID string) string {
+	if isReplacement("api_key", original) {
+		return original
+	}
 	prefix := ""
 	for _, p := range vendorPrefixes {
 		if strings.HasPrefix(original, p) {
@@ -285,12 +289,15 @@ func generateAPIKeyReplacement(original string) string {
 	if prefix == "" {
 		prefix = "key-"
 	}
-	token := encryptForToken(original, "api_key")
+	token := e.encryptForToken(original, tokenDomain("api_key", tenantID))
 	return fmt.Sprintf("%s[%s]", prefix, token[:12])
 }
 
-func generateAPIKeySecretReplacement(original string) string {
-	token := encryptForToken(original, "secret")
+func generateAPIKeySecretReplacement(e *Engine, original, tenantID string) string {
+	if isReplacement("secret", original) {
+		return original
+	}
+	token := e.encryptForToken(original, tokenDomain("secret", tenantID))
 	lenBucket := "med"
 	if len(original) < 16 {
 		lenBucket = "short"
@@ -301,6 +308,7 @@ func generateAPIKeySecretReplacement(original string) string {
 }
 
 type apiKeyGuardrail struct {
+	engine *Engine
 	config GuardrailConfig
 }
 
@@ -314,14 +322,14 @@ func (g *apiKeyGuardrail) ShouldRun(text string, lifecycle string) bool {
 	return containsStr(g.config.Lifecycles, lifecycle)
 }
 
-func (g *apiKeyGuardrail) Execute(text string) (string, int) {
+func (g *apiKeyGuardrail) Execute(text, tenantID string) (string, int) {
 	result := text
 	count := 0
 
 	// Strategy 1: Known vendor prefixes
 	result = knownPrefixRe.ReplaceAllStringFunc(result, func(match string) string {
 		count++
-		return getOrCreateMapping(match, "api_key", generateAPIKeyReplacement)
+		return g.engine.getOrCreateMapping(match, "api_key", tenantID, generateAPIKeyReplacement)
 	})
 
 	// Strategy 2: Entropy-based fallback for unknown key formats
@@ -356,7 +364,7 @@ func (g *apiKeyGuardrail) Execute(text string) (string, int) {
 
 		if looksLikeSecret(token) {
 			count++
-			replacement := getOrCreateMapping(token, "secret", generateAPIKeySecretReplacement)
+			replacement := g.engine.getOrCreateMapping(token, "secret", tenantID, generateAPIKeySecretReplacement)
 			return strings.Replace(fullMatch, token, replacement, 1)
 		}
 		return fullMatch
@@ -365,8 +373,9 @@ func (g *apiKeyGuardrail) Execute(text string) (string, int) {
 	return result, count
 }
 
-func createAPIKeyGuardrail() Guardrail {
+func createAPIKeyGuardrail(e *Engine) Guardrail {
 	return &apiKeyGuardrail{
+		engine: e,
 		config: GuardrailConfig{
 			ID:          "api_key",
 			Name:        "API Keys & Tokens",
@@ -382,13 +391,19 @@ func createAPIKeyGuardrail() Guardrail {
 
 // ─── Password guardrail ─────────────────────────────────────────────────────
 
-func generatePasswordReplacement(original string) string {
-	token := encryptForToken(original, "password")
+func generatePasswordReplacement(e *Engine, original, tenantID string) string {
+	if isReplacement("password", original) {
+		return original
+	}
+	token := e.encryptForToken(original, tokenDomain("password", tenantID))
 	return fmt.Sprintf("[REDACTED-%s]", token[:12])
 }
 
-func generatePasswordSecretReplacement(original string) string {
-	token := encryptForToken(original, "secret")
+func generatePasswordSecretReplacement(e *Engine, original, tenantID string) string {
+	if isReplacement("secret", original) {
+		return original
+	}
+	token := e.encryptForToken(original, tokenDomain("secret", tenantID))
 	lenBucket := "med"
 	if len(original) < 16 {
 		lenBucket = "short"
@@ -423,6 +438,7 @@ var (
 )
 
 type passwordGuardrail struct {
+	engine *Engine
 	config GuardrailConfig
 }
 
@@ -436,7 +452,7 @@ func (g *passwordGuardrail) ShouldRun(text string, lifecycle string) bool {
 	return containsStr(g.config.Lifecycles, lifecycle)
 }
 
-func (g *passwordGuardrail) Execute(text string) (string, int) {
+func (g *passwordGuardrail) Execute(text, tenantID string) (string, int) {
 	result := text
 	count := 0
 
@@ -454,7 +470,7 @@ func (g *passwordGuardrail) Execute(text string) (string, int) {
 			return fullMatch
 		}
 		count++
-		replacement := getOrCreateMapping(value, "password", generatePasswordReplacement)
+		replacement := g.engine.getOrCreateMapping(value, "password", tenantID, generatePasswordReplacement)
 		return strings.Replace(fullMatch, value, replacement, 1)
 	})
 
@@ -488,7 +504,7 @@ func (g *passwordGuardrail) Execute(text string) (string, int) {
 
 		if looksLikeSecret(token) {
 			count++
-			replacement := getOrCreateMapping(token, "password", generatePasswordSecretReplacement)
+			replacement := g.engine.getOrCreateMapping(token, "password", tenantID, generatePasswordSecretReplacement)
 			return strings.Replace(fullMatch, token, replacement, 1)
 		}
 		return fullMatch
@@ -510,15 +526,16 @@ func (g *passwordGuardrail) Execute(text string) (string, int) {
 			return fullMatch
 		}
 		count++
-		replacement := getOrCreateMapping(value, "password", generatePasswordReplacement)
+		replacement := g.engine.getOrCreateMapping(value, "password", tenantID, generatePasswordReplacement)
 		return strings.Replace(fullMatch, value, replacement, 1)
 	})
 
 	return result, count
 }
 
-func createPasswordGuardrail() Guardrail {
+func createPasswordGuardrail(e *Engine) Guardrail {
 	return &passwordGuardrail{
+		engine: e,
 		config: GuardrailConfig{
 			ID:          "password",
 			Name:        "Passwords & Secrets",
@@ -550,8 +567,11 @@ var (
 )
 
 // generateNameReplacement produces a deterministic fake name replacement.
-func generateNameReplacement(original string) string {
-	h := hmacHash(original)
+func generateNameReplacement(e *Engine, original, tenantID string) string {
+	if isReplacement("name", original) {
+		return original
+	}
+	h := e.hmacHash(original)
 	firstIdx := hexToInt(h[0:8]) % uint64(len(FakeFirstNames))
 	lastIdx := hexToInt(h[8:16]) % uint64(len(FakeLastNames))
 
@@ -562,6 +582,7 @@ func generateNameReplacement(original string) string {
 }
 
 type nameGuardrail struct {
+	engine *Engine
 	config GuardrailConfig
 }
 
@@ -575,7 +596,7 @@ func (g *nameGuardrail) ShouldRun(text string, lifecycle string) bool {
 	return containsStr(g.config.Lifecycles, lifecycle)
 }
 
-func (g *nameGuardrail) Execute(text string) (string, int) {
+func (g *nameGuardrail) Execute(text, tenantID string) (string, int) {
 	result := text
 	count := 0
 
@@ -613,7 +634,7 @@ func (g *nameGuardrail) Execute(text string) (string, int) {
 		// Replace in reverse order to preserve indices
 		for i := len(validMatches) - 1; i >= 0; i-- {
 			m := validMatches[i]
-			replacement := getOrCreateMapping(m.full, "name", generateNameReplacement)
+			replacement := g.engine.getOrCreateMapping(m.full, "name", tenantID, generateNameReplacement)
 			result = result[:m.start] + replacement + result[m.end:]
 			count++
 		}
@@ -633,7 +654,7 @@ func (g *nameGuardrail) Execute(text string) (string, int) {
 		if len(nameValue) < 2 {
 			return fullMatch
 		}
-		replacement := getOrCreateMapping(nameValue, "name", generateNameReplacement)
+		replacement := g.engine.getOrCreateMapping(nameValue, "name", tenantID, generateNameReplacement)
 		count++
 		return strings.Replace(fullMatch, subs[1], replacement, 1)
 	})
@@ -652,7 +673,7 @@ func (g *nameGuardrail) Execute(text string) (string, int) {
 		if NameStopwords[nameLower] {
 			return fullMatch
 		}
-		replacement := getOrCreateMapping(name, "name", generateNameReplacement)
+		replacement := g.engine.getOrCreateMapping(name, "name", tenantID, generateNameReplacement)
 		count++
 		return strings.Replace(fullMatch, name, replacement, 1)
 	})
@@ -670,7 +691,7 @@ func (g *nameGuardrail) Execute(text string) (string, int) {
 		if fakeNamesLower[wordLower] {
 			return fullMatch
 		}
-		replacement := getOrCreateMapping(word, "name", generateNameReplacement)
+		replacement := g.engine.getOrCreateMapping(word, "name", tenantID, generateNameReplacement)
 		count++
 		return replacement
 	})
@@ -678,8 +699,9 @@ func (g *nameGuardrail) Execute(text string) (string, int) {
 	return result, count
 }
 
-func createNameGuardrail() Guardrail {
+func createNameGuardrail(e *Engine) Guardrail {
 	return &nameGuardrail{
+		engine: e,
 		config: GuardrailConfig{
 			ID:          "name",
 			Name:        "Person Names",
@@ -695,54 +717,62 @@ func createNameGuardrail() Guardrail {
 
 // ─── Initialization ──────────────────────────────────────────────────────────
 
-// InitGuardrails registers all built-in guardrails and loads config from DB.
+// InitGuardrails registers all built-in guardrails, loads config from DB and
+// loads the key, checking it against the key canary (see KeyError). It fails
+// only when GUARDRAIL_KEY is set but no key can be derived from it.
 // Call once at startup after db.Open().
-func InitGuardrails() {
-	registerBuiltinGuardrails()
-	syncConfigFromDB()
-	log.Println("[guardrails] Initialized with stateless deterministic encryption")
+func InitGuardrails() error {
+	defaultEngine.registerBuiltinGuardrails()
+	defaultEngine.syncConfigFromDB()
+	source, err := defaultEngine.loadKey()
+	if err != nil {
+		return err
+	}
+	defaultEngine.checkKeyCanary()
+	log.Printf("[guardrails] Initialized with stateless deterministic encryption (key from %s)", source)
+	return nil
 }
 
 // registerBuiltinGuardrails registers all built-in guardrail factories.
-func registerBuiltinGuardrails() {
+func (e *Engine) registerBuiltinGuardrails() {
 	// 12 pattern-based guardrails
 	for _, def := range AllPatternDefs {
 		d := def // capture
-		registerGuardrail(d.ID, func() Guardrail {
-			return createPatternGuardrail(d)
+		e.registerGuardrail(d.ID, func(e *Engine) Guardrail {
+			return createPatternGuardrail(e, d)
 		})
 	}
 
 	// 3 complex guardrails with custom detection logic
-	registerGuardrail("api_key", createAPIKeyGuardrail)
-	registerGuardrail("password", createPasswordGuardrail)
-	registerGuardrail("name", createNameGuardrail)
+	e.registerGuardrail("api_key", createAPIKeyGuardrail)
+	e.registerGuardrail("password", createPasswordGuardrail)
+	e.registerGuardrail("name", createNameGuardrail)
 }
 
 // syncConfigFromDB reads guardrail enabled states from DB settings.
-func syncConfigFromDB() {
-	all := getAllGuardrails()
-	categories := getEnabledCategories()
+func (e *Engine) syncConfigFromDB() {
+	all := e.getAllGuardrails()
+	categories := e.getEnabledCategories()
 
 	for _, g := range all {
 		// Check per-guardrail setting first
 		perSetting := db.GetSetting(fmt.Sprintf("guardrail_%s_enabled", g.ID()))
 		if perSetting != "" {
-			setGuardrailEnabled(g.ID(), perSetting == "true" || perSetting == "1")
+			e.setGuardrailEnabled(g.ID(), perSetting == "true" || perSetting == "1")
 			continue
 		}
 
 		// Fall back to category-based config (backward compat)
-		setGuardrailEnabled(g.ID(), containsStr(categories, g.ID()))
+		e.setGuardrailEnabled(g.ID(), containsStr(categories, g.ID()))
 	}
 }
 
 // getEnabledCategories returns enabled guardrail IDs from DB settings.
-func getEnabledCategories() []string {
+func (e *Engine) getEnabledCategories() []string {
 	val := db.GetSetting("privacy_categories")
 	if val == "" {
 		// Default: all guardrails with defaultOn=true
-		all := getAllGuardrails()
+		all := e.getAllGuardrails()
 		result := make([]string, 0, len(all))
 		for _, g := range all {
 			if g.Config().DefaultOn {
@@ -781,17 +811,43 @@ func IsGuardrailsEnabledWith(getSetting func(string) string) bool {
 // RunGuardrails runs all applicable guardrails on a text string.
 // Returns the modified text.
 func RunGuardrails(text string) string {
+	return RunGuardrailsForTenant(text, "")
+}
+
+// RunGuardrailsForTenant is RunGuardrails for a tenant's request: tokens are
+// encrypted under the tenant's domains and only Deanonymize calls for the
+// same tenant will restore them.
+func RunGuardrailsForTenant(text, tenantID string) string {
+	return defaultEngine.Anonymize(text, tenantID)
+}
+
+// Anonymize runs the engine's enabled guardrails on text for a tenant ("" for
+// global traffic); see RunGuardrailsForTenant.
+func (e *Engine) Anonymize(text, tenantID string) string {
+	return e.anonymizeCounting(text, tenantID, nil)
+}
+
+// anonymizeCounting is Anonymize, adding each guardrail's detections to
+// detections (keyed by guardrail ID) when it isn't nil. Detections are
+// also counted in codegate_guardrail_detections_total.
+func (e *Engine) anonymizeCounting(text, tenantID string, detections map[string]int) string {
 	if text == "" {
 		return text
 	}
 
 	currentText := text
-	for _, g := range getAllGuardrails() {
+	for _, g := range e.getAllGuardrails() {
 		if !g.ShouldRun(currentText, "pre_call") {
 			continue
 		}
-		modified, _ := g.Execute(currentText)
+		modified, count := g.Execute(currentText, tenantID)
 		currentText = modified
+		if count > 0 {
+			metrics.Add("codegate_guardrail_detections_total", int64(count), "guardrail", g.ID())
+		}
+		if detections != nil && count > 0 {
+			detections[g.ID()] += count
+		}
 	}
 
 	return currentText
@@ -802,18 +858,37 @@ func RunGuardrails(text string) string {
 // array), messages with text blocks, and tool_result content.
 // Thinking blocks are SKIPPED (they have cryptographic signatures).
 func RunGuardrailsOnRequestBody(body map[string]any) map[string]any {
-	// Deep clone via JSON round-trip
-	raw, err := json.Marshal(body)
-	if err != nil {
-		return body
-	}
-	var clone map[string]any
-	if err := json.Unmarshal(raw, &clone); err != nil {
+	return RunGuardrailsOnRequestBodyForTenant(body, "")
+}
+
+// RunGuardrailsOnRequestBodyForTenant is RunGuardrailsOnRequestBody scoped to
+// a tenant, as in RunGuardrailsForTenant.
+func RunGuardrailsOnRequestBodyForTenant(body map[string]any, tenantID string) map[string]any {
+	return defaultEngine.AnonymizeRequestBody(body, tenantID)
+}
+
+// RunGuardrailsOnRequestBodyCounting is RunGuardrailsOnRequestBodyForTenant,
+// also returning how many values each guardrail replaced, keyed by guardrail
+// ID.
+func RunGuardrailsOnRequestBodyCounting(body map[string]any, tenantID string) (map[string]any, map[string]int) {
+	detections := make(map[string]int)
+	return defaultEngine.anonymizeRequestBody(body, tenantID, detections), detections
+}
+
+// AnonymizeRequestBody is RunGuardrailsOnRequestBodyForTenant on the engine.
+func (e *Engine) AnonymizeRequestBody(body map[string]any, tenantID string) map[string]any {
+	return e.anonymizeRequestBody(body, tenantID, nil)
+}
+
+func (e *Engine) anonymizeRequestBody(body map[string]any, tenantID string, detections map[string]int) map[string]any {
+	// Deep clone the decoded JSON tree; the caller owns the returned clone.
+	clone, ok := cloneJSONValue(body).(map[string]any)
+	if !ok {
 		return body
 	}
 
 	anonymize := func(text string) string {
-		return RunGuardrails(text)
+		return e.anonymizeCounting(text, tenantID, detections)
 	}
 
 	// Anonymize system prompt
@@ -867,6 +942,14 @@ func RunGuardrailsOnRequestBody(body map[string]any) map[string]any {
 						}
 					}
 
+					// Blocks of types the walker doesn't know (newer Anthropic
+					// additions) get their text and content strings anonymized
+					// wherever they are nested
+					if blockType, _ := bm["type"].(string); !knownBlockTypes[blockType] {
+						anonymizeNestedText(bm, anonymize)
+						continue
+					}
+
 					if bm["type"] == "tool_result" {
 						switch inner := bm["content"].(type) {
 						case string:
@@ -895,8 +978,63 @@ func RunGuardrailsOnRequestBody(body map[string]any) map[string]any {
 	return clone
 }
 
+// knownBlockTypes are the content block types RunGuardrailsOnRequestBody
+// handles explicitly. Images and tool_use inputs are deliberately left alone.
+var knownBlockTypes = map[string]bool{
+	"text":              true,
+	"image":             true,
+	"tool_use":          true,
+	"tool_result":       true,
+	"thinking":          true,
+	"redacted_thinking": true,
+}
+
+// anonymizeNestedText anonymizes every string-valued "text" or "content"
+// field inside v.
+func anonymizeNestedText(v any, anonymize func(string) string) {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, val := range t {
+			if str, ok := val.(string); ok {
+				if k == "text" || k == "content" {
+					if result := anonymize(str); result != "" {
+						t[k] = result
+					}
+				}
+				continue
+			}
+			anonymizeNestedText(val, anonymize)
+		}
+	case []any:
+		for _, val := range t {
+			anonymizeNestedText(val, anonymize)
+		}
+	}
+}
+
 // ─── Helpers ─────────────────────────────────────────────────────────────────
 
+// cloneJSONValue deep-copies a value produced by encoding/json decoding into
+// any (maps, slices, and scalars) without a marshal/unmarshal round-trip.
+func cloneJSONValue(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(t))
+		for k, val := range t {
+			out[k] = cloneJSONValue(val)
+		}
+		return out
+	case []any:
+		out := make([]any, len(t))
+		for i, val := range t {
+			out[i] = cloneJSONValue(val)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
 func containsStr(slice []string, val string) bool {
 	for _, s := range slice {
 		if s == val {
@@ -1,14 +1,23 @@
 package guardrails
 
 import (
+	"codegate-proxy/internal/metrics"
 	"os"
 	"strings"
 	"testing"
 )
 
 func TestMain(m *testing.M) {
-	registerBuiltinGuardrails()
-	os.Exit(m.Run())
+	// Keys are created under DATA_DIR; keep them out of the source tree
+	dir, err := os.MkdirTemp("", "guardrails-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("DATA_DIR", dir)
+	defaultEngine.registerBuiltinGuardrails()
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
 }
 
 func TestRunGuardrails_EmailAnonymization(t *testing.T) {
@@ -76,6 +85,62 @@ func TestRunGuardrailsOnRequestBody(t *testing.T) {
 	}
 }
 
+func TestRunGuardrailsOnRequestBodyCounting(t *testing.T) {
+	body := map[string]any{
+		"system": "Escalate to ops@example.com",
+		"messages": []any{
+			map[string]any{"role": "user", "content": "Contact alice@example.com or bob@example.com"},
+		},
+	}
+
+	metrics.Reset()
+	_, detections := RunGuardrailsOnRequestBodyCounting(body, "")
+	if detections["email"] != 3 {
+		t.Errorf("detections = %v, want 3 emails", detections)
+	}
+	if n := metrics.Counter("codegate_guardrail_detections_total", "guardrail", "email"); n != 3 {
+		t.Errorf("codegate_guardrail_detections_total = %d, want 3", n)
+	}
+}
+
+func TestRunGuardrailsOnRequestBody_UnknownBlockAnonymized(t *testing.T) {
+	body := map[string]any{
+		"model": "claude-sonnet-4-20250514",
+		"messages": []any{
+			map[string]any{
+				"role": "user",
+				"content": []any{
+					map[string]any{
+						"type": "mystery_block",
+						"text": "Mail alice@example.com",
+						"id":   "alice@example.com",
+						"inner": []any{
+							map[string]any{"content": "bob@example.com"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	result := RunGuardrailsOnRequestBody(body)
+	block := result["messages"].([]any)[0].(map[string]any)["content"].([]any)[0].(map[string]any)
+
+	if block["type"] != "mystery_block" {
+		t.Errorf("type = %v, want mystery_block kept", block["type"])
+	}
+	if strings.Contains(block["text"].(string), "alice@example.com") {
+		t.Error("text field in unknown block should be anonymized")
+	}
+	inner := block["inner"].([]any)[0].(map[string]any)
+	if strings.Contains(inner["content"].(string), "bob@example.com") {
+		t.Error("nested content field in unknown block should be anonymized")
+	}
+	if block["id"] != "alice@example.com" {
+		t.Error("fields other than text and content should be left alone")
+	}
+}
+
 func TestRunGuardrailsOnRequestBody_ThinkingBlockSkipped(t *testing.T) {
 	body := map[string]any{
 		"model": "claude-sonnet-4-20250514",
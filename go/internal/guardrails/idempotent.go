@@ -0,0 +1,48 @@
+package guardrails
+
+import (
+	"regexp"
+	"strings"
+)
+
+// replacementShapes match the complete output of each category's generator.
+// Generators return values of their own shape unchanged, so text that is
+// anonymized twice (a retried request, a replayed conversation) keeps the
+// first pass's replacements instead of nesting new ones inside them.
+var replacementShapes = map[string]*regexp.Regexp{
+	"email":    regexp.MustCompile(`(?i)^[a-z0-9._%+-]+@anon\.com$`),
+	"phone":    regexp.MustCompile(`^\d{3}-\d{3}-\d{4}-[A-Za-z0-9_-]+$`),
+	"ssn":      regexp.MustCompile(`^\[SSN-[A-Za-z0-9_-]+\]$`),
+	"card":     regexp.MustCompile(`^\[(?:VISA|MC|AMEX|DISC|CARD)-[A-Za-z0-9_-]+\]$`),
+	"iban":     regexp.MustCompile(`^\[IBAN-[A-Za-z0-9_-]+\]$`),
+	"passport": regexp.MustCompile(`^\[PASSPORT-[A-Za-z0-9_-]+\]$`),
+	"ip":       regexp.MustCompile(`^\[(?:IP-\d{1,3}(?:\.\d{1,3}){3}|IPv6)-[A-Za-z0-9_-]+\]$`),
+	"address":  regexp.MustCompile(`^\[ADDR-[A-Za-z0-9_-]+\]$`),
+	"aws":      regexp.MustCompile(`^\[(?:AKIA|AWS-SECRET)-[A-Za-z0-9_-]+\]$`),
+	"jwt":      regexp.MustCompile(`^\[JWT-[A-Za-z0-9_-]+\]$`),
+	"key":      regexp.MustCompile(`^\[PRIVATE-KEY-[A-Za-z0-9_-]+\]$`),
+	"url":      regexp.MustCompile(`//\[redacted-[A-Za-z0-9_-]+\]@`),
+	"api_key":  regexp.MustCompile(`^[A-Za-z0-9_.\-]*\[[A-Za-z0-9_-]{12}\]$`),
+	"secret":   regexp.MustCompile(`^\[SECRET-(?:short|med|long)-[A-Za-z0-9_-]+\]$`),
+	"password": regexp.MustCompile(`^\[REDACTED-[A-Za-z0-9_-]+\]$`),
+}
+
+// isReplacement reports whether value already has the shape of a category's
+// replacement. Names have no token, so any name made only of the fake name
+// pools counts.
+func isReplacement(category, value string) bool {
+	if category == "name" {
+		words := strings.Fields(value)
+		if len(words) == 0 {
+			return false
+		}
+		for _, w := range words {
+			if !fakeNamesLower[strings.ToLower(w)] {
+				return false
+			}
+		}
+		return true
+	}
+	re, ok := replacementShapes[category]
+	return ok && re.MatchString(value)
+}
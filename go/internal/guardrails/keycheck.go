@@ -0,0 +1,83 @@
+package guardrails
+
+import (
+	"codegate-proxy/internal/db"
+	"fmt"
+	"log"
+	"os"
+)
+
+// The key canary is a token of a fixed value, stored in settings by whichever
+// of the dashboard and the proxy starts first. The other compares its own
+// token against it: both derive tokens from the guardrail key, so a mismatch
+// means tokens issued by one won't deanonymize in the other.
+const (
+	keyCanarySetting = "guardrail_key_canary"
+	keyCanaryValue   = "codegate-guardrail-key-canary"
+	keyCanaryDomain  = "canary"
+)
+
+// keyRotatedEnv, when "true", tells the proxy the guardrail key was changed on
+// purpose: a mismatched canary is rewritten with the new key's token instead of
+// being reported. Tokens issued with the old key stay unreadable either way.
+const keyRotatedEnv = "GUARDRAIL_KEY_ROTATED"
+
+// keyCanary returns the engine's token for the canary value.
+func (e *Engine) keyCanary() string {
+	return e.encryptForToken(keyCanaryValue, keyCanaryDomain)
+}
+
+// loadKey loads the engine's key if it hasn't been yet and returns its source.
+func (e *Engine) loadKey() (string, error) {
+	e.keyMu.Lock()
+	defer e.keyMu.Unlock()
+
+	if e.key == nil {
+		key, source, err := loadGuardrailKey()
+		if err != nil {
+			return "", err
+		}
+		e.key, e.keySource = key, source
+	}
+	return e.keySource, nil
+}
+
+// checkKeyCanary compares the engine's key against the stored canary,
+// storing it when there is none or the key was rotated, and records the
+// result for KeyError.
+func (e *Engine) checkKeyCanary() error {
+	token := e.keyCanary()
+	var err error
+	switch stored := db.GetSetting(keyCanarySetting); stored {
+	case "":
+		db.InitSetting(keyCanarySetting, token)
+	case token:
+	default:
+		if os.Getenv(keyRotatedEnv) == "true" {
+			db.SetSetting(keyCanarySetting, token)
+			log.Printf("[guardrails] WARN: %s is set; rewrote %s with the current guardrail key", keyRotatedEnv, keyCanarySetting)
+			break
+		}
+		e.keyMu.Lock()
+		source := e.keySource
+		e.keyMu.Unlock()
+		err = fmt.Errorf("guardrail key (from %s) doesn't match the key that wrote %s; "+
+			"tokens issued with the other key won't be deanonymized. Check that GUARDRAIL_KEY "+
+			"or .guardrail-key is the same for the dashboard and the proxy, or set %s=true "+
+			"after a deliberate rotation", source, keyCanarySetting, keyRotatedEnv)
+		log.Printf("[guardrails] ERROR: %v", err)
+	}
+
+	e.keyMu.Lock()
+	e.keyErr = err
+	e.keyMu.Unlock()
+	return err
+}
+
+// KeyError returns the key mismatch found by InitGuardrails, or nil.
+func KeyError() error {
+	e := defaultEngine
+	e.keyMu.Lock()
+	defer e.keyMu.Unlock()
+	return e.keyErr
+}
@@ -0,0 +1,63 @@
+package guardrails
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"testing"
+)
+
+func TestInitGuardrails_KeyCanary(t *testing.T) {
+	tdb := dbtest.Open(t)
+	t.Setenv("GUARDRAIL_KEY", "")
+	ResetForTest()
+	t.Cleanup(ResetForTest)
+
+	// The first to start stores the canary
+	if err := InitGuardrails(); err != nil {
+		t.Fatal(err)
+	}
+	var stored string
+	tdb.QueryRow("SELECT value FROM settings WHERE key = ?", keyCanarySetting).Scan(&stored)
+	if stored != defaultEngine.keyCanary() || KeyError() != nil {
+		t.Fatalf("canary = %q, key error = %v", stored, KeyError())
+	}
+
+	// A dashboard whose data directory holds a different key file
+	t.Setenv("DATA_DIR", t.TempDir())
+	dashboard := NewEngine()
+	tdb.SetSetting(keyCanarySetting, dashboard.keyCanary())
+	t.Setenv("DATA_DIR", tdb.Dir)
+
+	ResetForTest()
+	if err := InitGuardrails(); err != nil {
+		t.Fatal(err)
+	}
+	if KeyError() == nil {
+		t.Error("mismatched keys not reported")
+	}
+
+	// A deliberate rotation re-seeds the canary instead
+	t.Setenv(keyRotatedEnv, "true")
+	ResetForTest()
+	if err := InitGuardrails(); err != nil {
+		t.Fatal(err)
+	}
+	tdb.QueryRow("SELECT value FROM settings WHERE key = ?", keyCanarySetting).Scan(&stored)
+	if err := KeyError(); err != nil || stored != defaultEngine.keyCanary() {
+		t.Errorf("after rotation: canary rewritten = %v, key error = %v", stored == defaultEngine.keyCanary(), err)
+	}
+	t.Setenv(keyRotatedEnv, "")
+
+	// Both derive the key from the same GUARDRAIL_KEY
+	t.Setenv("GUARDRAIL_KEY", "shared passphrase")
+	tdb.SetSetting(keyCanarySetting, NewEngine().keyCanary())
+	ResetForTest()
+	if err := InitGuardrails(); err != nil {
+		t.Fatal(err)
+	}
+	if err := KeyError(); err != nil {
+		t.Errorf("matching keys reported: %v", err)
+	}
+	if s := Stats(); s.KeySource != KeySourceEnv {
+		t.Errorf("key source = %q, want %q", s.KeySource, KeySourceEnv)
+	}
+}
@@ -49,7 +49,7 @@ var CommonFirstNames = map[string]bool{
 	"diana": true, "natalie": true, "brittany": true, "charlotte": true, "marie": true,
 	"kayla": true, "alexis": true,
 	// Scandinavian
-	"nestor": true, "nestor": true, "lars": true, "erik": true, "olof": true,
+	"nestor": true, "lars": true, "erik": true, "olof": true,
 	"anders": true, "sven": true, "karl": true, "magnus": true, "nils": true,
 	"astrid": true, "ingrid": true, "sigrid": true, "freya": true, "linnea": true,
 	"björn": true, "gunnar": true, "leif": true, "axel": true, "oscar": true,
@@ -1,6 +1,7 @@
 package guardrails
 
 import (
+	"codegate-proxy/internal/redact"
 	"fmt"
 	"regexp"
 	"strconv"
@@ -16,8 +17,10 @@ type PatternDef struct {
 	Category    string // "pii", "credentials", "network", "financial"
 	Priority    int
 	Patterns    []*regexp.Regexp
-	// ReplacementGenerator creates a replacement string for the matched original.
-	ReplacementGenerator func(original string) string
+	// ReplacementGenerator creates a replacement string for the matched original
+	// under e's key, scoped to the tenant the request belongs to ("" for
+	// global traffic).
+	ReplacementGenerator func(e *Engine, original, tenantID string) string
 	// ContextPattern, if set, requires a match in the full text before running.
 	ContextPattern *regexp.Regexp
 	// Validator, if set, filters matches (return true to accept).
@@ -62,9 +65,12 @@ var emailPatternDef = PatternDef{
 		}
 		return true
 	},
-	ReplacementGenerator: func(original string) string {
+	ReplacementGenerator: func(e *Engine, original, tenantID string) string {
+		if isReplacement("email", original) {
+			return original
+		}
 		// Generate a realistic-looking fake email (reverse-map handles deanonymization)
-		h := hmacHash(original)
+		h := e.hmacHash(original)
 		first := emailFirst[hexToInt(h[0:4])%uint64(len(emailFirst))]
 		last := emailLast[hexToInt(h[4:8])%uint64(len(emailLast))]
 		num := hexToInt(h[8:10]) % 100
@@ -82,9 +88,12 @@ var phonePatternDef = PatternDef{
 		regexp.MustCompile(`(?:\+?1[-.\s]?)?\(?[0-9]{3}\)?[-.\s]?[0-9]{3}[-.\s]?[0-9]{4}`),
 		regexp.MustCompile(`\+\d{1,3}[-.\s]?\(?\d{1,4}\)?[-.\s]?\d{1,4}[-.\s]?\d{1,9}`),
 	},
-	ReplacementGenerator: func(original string) string {
-		token := encryptForToken(original, "phone")
-		h := hmacHash(original)
+	ReplacementGenerator: func(e *Engine, original, tenantID string) string {
+		if isReplacement("phone", original) {
+			return original
+		}
+		token := e.encryptForToken(original, tokenDomain("phone", tenantID))
+		h := e.hmacHash(original)
 		area := (hexToInt(h[0:2])%800 + 200)
 		exchange := (hexToInt(h[2:4])%800 + 100)
 		line := (hexToInt(h[4:8])%9000 + 1000)
@@ -121,8 +130,11 @@ var ssnPatternDef = PatternDef{
 		}
 		return true
 	},
-	ReplacementGenerator: func(original string) string {
-		token := encryptForToken(original, "ssn")
+	ReplacementGenerator: func(e *Engine, original, tenantID string) string {
+		if isReplacement("ssn", original) {
+			return original
+		}
+		token := e.encryptForToken(original, tokenDomain("ssn", tenantID))
 		return fmt.Sprintf("[SSN-%s]", token[:12])
 	},
 }
@@ -139,8 +151,11 @@ var creditCardPatternDef = PatternDef{
 		regexp.MustCompile(`\b3[47]\d{2}[\s-]?\d{6}[\s-]?\d{5}\b`),
 		regexp.MustCompile(`\b6(?:011|5\d{2})[\s-]?\d{4}[\s-]?\d{4}[\s-]?\d{4}\b`),
 	},
-	ReplacementGenerator: func(original string) string {
-		token := encryptForToken(original, "card")
+	ReplacementGenerator: func(e *Engine, original, tenantID string) string {
+		if isReplacement("card", original) {
+			return original
+		}
+		token := e.encryptForToken(original, tokenDomain("card", tenantID))
 		digits := strings.NewReplacer(" ", "", "-", "").Replace(original)
 		typ := "CARD"
 		if strings.HasPrefix(digits, "4") {
@@ -165,8 +180,11 @@ var ibanPatternDef = PatternDef{
 	Patterns: []*regexp.Regexp{
 		regexp.MustCompile(`\b[A-Z]{2}\d{2}[A-Z0-9]{11,30}\b`),
 	},
-	ReplacementGenerator: func(original string) string {
-		token := encryptForToken(original, "iban")
+	ReplacementGenerator: func(e *Engine, original, tenantID string) string {
+		if isReplacement("iban", original) {
+			return original
+		}
+		token := e.encryptForToken(original, tokenDomain("iban", tenantID))
 		return fmt.Sprintf("[IBAN-%s]", token[:12])
 	},
 }
@@ -185,8 +203,11 @@ var passportPatternDef = PatternDef{
 		regexp.MustCompile(`\b[A-Z]{2}\d{6}\b`),
 	},
 	ContextPattern: regexp.MustCompile(`(?i)(?:passport|travel\s+document|document\s+number|passport\s+no)`),
-	ReplacementGenerator: func(original string) string {
-		token := encryptForToken(original, "passport")
+	ReplacementGenerator: func(e *Engine, original, tenantID string) string {
+		if isReplacement("passport", original) {
+			return original
+		}
+		token := e.encryptForToken(original, tokenDomain("passport", tenantID))
 		return fmt.Sprintf("[PASSPORT-%s]", token[:12])
 	},
 }
@@ -203,13 +224,16 @@ var ipAddressPatternDef = PatternDef{
 		regexp.MustCompile(`\b(?:[0-9a-fA-F]{1,4}:){1,7}:\b`),
 		regexp.MustCompile(`\b::(?:[0-9a-fA-F]{1,4}:){0,5}[0-9a-fA-F]{1,4}\b`),
 	},
-	ReplacementGenerator: func(original string) string {
-		token := encryptForToken(original, "ip")
+	ReplacementGenerator: func(e *Engine, original, tenantID string) string {
+		if isReplacement("ip", original) {
+			return original
+		}
+		token := e.encryptForToken(original, tokenDomain("ip", tenantID))
 		if strings.Contains(original, ":") {
 			return fmt.Sprintf("[IPv6-%s]", token[:12])
 		}
 		// Generate a fake IP for display
-		h := hmacHash(original)
+		h := e.hmacHash(original)
 		o1 := (hexToInt(h[0:2])%223 + 1)
 		o2 := hexToInt(h[2:4]) % 256
 		o3 := hexToInt(h[4:6]) % 256
@@ -227,8 +251,11 @@ var streetAddressPatternDef = PatternDef{
 	Patterns: []*regexp.Regexp{
 		regexp.MustCompile(`(?i)\b\d{1,6}\s+[A-Za-z0-9][\w\s.'\-]*\s+(?:Street|St|Avenue|Ave|Road|Rd|Boulevard|Blvd|Drive|Dr|Lane|Ln|Court|Ct|Way|Place|Pl|Circle|Cir|Terrace|Ter|Highway|Hwy|Parkway|Pkwy|Trail|Trl)\b\.?`),
 	},
-	ReplacementGenerator: func(original string) string {
-		token := encryptForToken(original, "address")
+	ReplacementGenerator: func(e *Engine, original, tenantID string) string {
+		if isReplacement("address", original) {
+			return original
+		}
+		token := e.encryptForToken(original, tokenDomain("address", tenantID))
 		return fmt.Sprintf("[ADDR-%s]", token)
 	},
 }
@@ -242,11 +269,14 @@ var awsKeysPatternDef = PatternDef{
 	Category:    "credentials",
 	Priority:    3,
 	Patterns: []*regexp.Regexp{
-		regexp.MustCompile(`\b(AKIA[0-9A-Z]{16})\b`),
+		redact.AWSAccessKeyRe,
 		regexp.MustCompile(`(?:aws_secret_access_key|AWS_SECRET_ACCESS_KEY|secret_?key)\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})["']?`),
 	},
-	ReplacementGenerator: func(original string) string {
-		token := encryptForToken(original, "aws")
+	ReplacementGenerator: func(e *Engine, original, tenantID string) string {
+		if isReplacement("aws", original) {
+			return original
+		}
+		token := e.encryptForToken(original, tokenDomain("aws", tenantID))
 		if strings.HasPrefix(original, "AKIA") {
 			return fmt.Sprintf("[AKIA-%s]", token[:12])
 		}
@@ -261,10 +291,13 @@ var jwtPatternDef = PatternDef{
 	Category:    "credentials",
 	Priority:    8,
 	Patterns: []*regexp.Regexp{
-		regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\b`),
+		redact.JWTRe,
 	},
-	ReplacementGenerator: func(original string) string {
-		token := encryptForToken(original, "jwt")
+	ReplacementGenerator: func(e *Engine, original, tenantID string) string {
+		if isReplacement("jwt", original) {
+			return original
+		}
+		token := e.encryptForToken(original, tokenDomain("jwt", tenantID))
 		return fmt.Sprintf("[JWT-%s]", token[:12])
 	},
 }
@@ -278,8 +311,11 @@ var privateKeyPatternDef = PatternDef{
 	Patterns: []*regexp.Regexp{
 		regexp.MustCompile(`(?s)-----BEGIN\s+(?:RSA\s+|DSA\s+|EC\s+|OPENSSH\s+|PGP\s+)?PRIVATE KEY-----.*?-----END\s+(?:RSA\s+|DSA\s+|EC\s+|OPENSSH\s+|PGP\s+)?PRIVATE KEY-----`),
 	},
-	ReplacementGenerator: func(original string) string {
-		token := encryptForToken(original, "key")
+	ReplacementGenerator: func(e *Engine, original, tenantID string) string {
+		if isReplacement("key", original) {
+			return original
+		}
+		token := e.encryptForToken(original, tokenDomain("key", tenantID))
 		return fmt.Sprintf("[PRIVATE-KEY-%s]", token[:12])
 	},
 }
@@ -293,8 +329,11 @@ var urlAuthPatternDef = PatternDef{
 	Patterns: []*regexp.Regexp{
 		regexp.MustCompile(`https?://[^:\s]+:[^@\s]+@[^\s]+`),
 	},
-	ReplacementGenerator: func(original string) string {
-		token := encryptForToken(original, "url")
+	ReplacementGenerator: func(e *Engine, original, tenantID string) string {
+		if isReplacement("url", original) {
+			return original
+		}
+		token := e.encryptForToken(original, tokenDomain("url", tenantID))
 		re := regexp.MustCompile(`//([^:]+):([^@]+)@`)
 		return re.ReplaceAllString(original, fmt.Sprintf("//[redacted-%s]@", token[:8]))
 	},
@@ -0,0 +1,29 @@
+package guardrails
+
+// Tokens produced for a tenant's request are encrypted under the domain
+// category+":"+tenantID, so they only decrypt in that tenant's responses.
+// Traffic without a tenant keeps the bare category domains.
+
+// tokenDomain returns the encryption domain for a category and tenant.
+func tokenDomain(category, tenantID string) string {
+	if tenantID == "" {
+		return category
+	}
+	return category + ":" + tenantID
+}
+
+// decryptScoped decrypts a token for a tenant. Tokens issued before domains
+// were tenant-scoped used the bare category, so that is tried as well.
+func (e *Engine) decryptScoped(token, category, tenantID string) string {
+	if tenantID != "" {
+		if v := e.decryptToken(token, tokenDomain(category, tenantID)); v != "" {
+			return v
+		}
+	}
+	return e.decryptToken(token, category)
+}
+
+// reverseKey scopes a reverse-map entry to a tenant.
+func reverseKey(tenantID, replacement string) string {
+	return tenantID + "\x00" + replacement
+}
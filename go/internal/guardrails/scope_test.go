@@ -0,0 +1,66 @@
+package guardrails
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScopedTokens_SameTenantRoundTrip(t *testing.T) {
+	original := "sk-ant-REDACTED"
+	anon := RunGuardrailsForTenant("key: "+original, "tenant-a")
+	if strings.Contains(anon, original) {
+		t.Fatalf("key not anonymized: %q", anon)
+	}
+
+	if got := DeanonymizeForTenant(anon, "tenant-a"); got != "key: "+original {
+		t.Errorf("same-tenant deanonymize: got %q, want %q", got, "key: "+original)
+	}
+}
+
+func TestScopedTokens_CrossTenantFails(t *testing.T) {
+	original := "123-45-6789"
+	token := defaultEngine.encryptForToken(original, tokenDomain("ssn", "tenant-a"))
+
+	if got := defaultEngine.decryptScoped(token, "ssn", "tenant-b"); got != "" {
+		t.Errorf("tenant-b decrypted tenant-a token: %q", got)
+	}
+	if got := defaultEngine.decryptScoped(token, "ssn", ""); got != "" {
+		t.Errorf("global traffic decrypted tenant-a token: %q", got)
+	}
+	if got := defaultEngine.decryptScoped(token, "ssn", "tenant-a"); got != original {
+		t.Errorf("tenant-a decrypt: got %q, want %q", got, original)
+	}
+}
+
+func TestScopedTokens_CrossTenantResponseUnchanged(t *testing.T) {
+	defer ClearReverseMappings()
+
+	anon := RunGuardrailsForTenant("card 4111 1111 1111 1111, mail alice@example.com", "tenant-a")
+	if strings.Contains(anon, "alice@example.com") || strings.Contains(anon, "4111 1111 1111 1111") {
+		t.Fatalf("text not anonymized: %q", anon)
+	}
+	if got := DeanonymizeForTenant(anon, "tenant-b"); got != anon {
+		t.Errorf("tenant-b response was deanonymized: got %q, want %q", got, anon)
+	}
+}
+
+func TestScopedTokens_LegacyTokenStillDecrypts(t *testing.T) {
+	original := "123-45-6789"
+	legacy := defaultEngine.encryptForToken(original, "ssn")
+
+	if got := defaultEngine.decryptScoped(legacy, "ssn", "tenant-a"); got != original {
+		t.Errorf("legacy token for tenant: got %q, want %q", got, original)
+	}
+	if got := defaultEngine.decryptScoped(legacy, "ssn", ""); got != original {
+		t.Errorf("legacy token for global traffic: got %q, want %q", got, original)
+	}
+}
+
+func TestScopedTokens_GlobalDomainsUnchanged(t *testing.T) {
+	if got := tokenDomain("ssn", ""); got != "ssn" {
+		t.Errorf("global domain: got %q, want %q", got, "ssn")
+	}
+	if got := tokenDomain("ssn", "t1"); got != "ssn:t1" {
+		t.Errorf("tenant domain: got %q, want %q", got, "ssn:t1")
+	}
+}
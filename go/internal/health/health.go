@@ -0,0 +1,138 @@
+// Package health tracks recent request outcomes per account, so routing and
+// the status page can see an account's success rate over the last few
+// minutes rather than the cumulative error_count on the account row.
+package health
+
+import (
+	"codegate-proxy/internal/metrics"
+	"sync"
+	"time"
+)
+
+const (
+	// ringSize bounds the outcomes kept per account. Older outcomes are
+	// overwritten, so a busy account's window may cover less than the
+	// requested duration.
+	ringSize = 256
+
+	// DefaultWindow is the window used for the success-rate metric and the
+	// status page.
+	DefaultWindow = 10 * time.Minute
+
+	// MinSamples is the number of outcomes in a window below which a success
+	// rate isn't meaningful enough to demote an account.
+	MinSamples = 5
+)
+
+type outcome struct {
+	at int64 // unix millis
+	ok bool
+}
+
+// ring is a fixed-size buffer of an account's most recent outcomes.
+type ring struct {
+	mu   sync.Mutex
+	buf  [ringSize]outcome
+	next int
+	n    int
+}
+
+var (
+	mu       sync.RWMutex
+	accounts = make(map[string]*ring)
+)
+
+func getRing(accountID string) *ring {
+	mu.RLock()
+	r, ok := accounts[accountID]
+	mu.RUnlock()
+	if ok {
+		return r
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if r, ok = accounts[accountID]; !ok {
+		r = &ring{}
+		accounts[accountID] = r
+	}
+	return r
+}
+
+// RecordSuccess records a successful upstream request for an account.
+func RecordSuccess(accountID string) { record(accountID, true) }
+
+// RecordFailure records a failed upstream request (connection error, 401,
+// 429, or 5xx) for an account.
+func RecordFailure(accountID string) { record(accountID, false) }
+
+func record(accountID string, ok bool) {
+	r := getRing(accountID)
+	r.mu.Lock()
+	r.push(ok)
+	rate, samples := r.rate(DefaultWindow)
+	r.mu.Unlock()
+
+	if samples > 0 {
+		metrics.SetGauge("codegate_account_success_rate", rate, "account_id", accountID)
+	}
+}
+
+// SuccessRate returns the fraction of an account's requests within window
+// that succeeded, and how many requests that covers. With no samples the
+// rate is 1.
+func SuccessRate(accountID string, window time.Duration) (float64, int) {
+	mu.RLock()
+	r, ok := accounts[accountID]
+	mu.RUnlock()
+	if !ok {
+		return 1, 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rate(window)
+}
+
+// push adds an outcome, overwriting the oldest once the ring is full.
+// Callers hold r.mu.
+func (r *ring) push(ok bool) {
+	r.buf[r.next] = outcome{at: time.Now().UnixMilli(), ok: ok}
+	r.next = (r.next + 1) % ringSize
+	if r.n < ringSize {
+		r.n++
+	}
+}
+
+// rate scans the ring for outcomes newer than window. Callers hold r.mu.
+func (r *ring) rate(window time.Duration) (float64, int) {
+	cutoff := time.Now().Add(-window).UnixMilli()
+	total, okCount := 0, 0
+	for i := 0; i < r.n; i++ {
+		o := r.buf[i]
+		if o.at < cutoff {
+			continue
+		}
+		total++
+		if o.ok {
+			okCount++
+		}
+	}
+	if total == 0 {
+		return 1, 0
+	}
+	return float64(okCount) / float64(total), total
+}
+
+// Reset forgets all recorded outcomes, latencies, and alert state.
+func Reset() {
+	mu.Lock()
+	accounts = make(map[string]*ring)
+	latencies = make(map[string]*latencyRing)
+	tenantOutcomes = make(map[string]*ring)
+	mu.Unlock()
+
+	alertMu.Lock()
+	activeAlert = make(map[string]*Alert)
+	lastAlerted = make(map[string]time.Time)
+	alertMu.Unlock()
+}
@@ -0,0 +1,93 @@
+package health
+
+import (
+	"codegate-proxy/internal/metrics"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSuccessRate_MixedOutcomes(t *testing.T) {
+	Reset()
+	metrics.Reset()
+
+	if rate, n := SuccessRate("acct", DefaultWindow); rate != 1 || n != 0 {
+		t.Errorf("no samples: rate = %v, n = %d; want 1, 0", rate, n)
+	}
+
+	// S F S S F S F S S S → 7 of 10
+	for _, ok := range []bool{true, false, true, true, false, true, false, true, true, true} {
+		if ok {
+			RecordSuccess("acct")
+		} else {
+			RecordFailure("acct")
+		}
+	}
+	if rate, n := SuccessRate("acct", DefaultWindow); n != 10 || rate != 0.7 {
+		t.Errorf("rate = %v over %d, want 0.7 over 10", rate, n)
+	}
+	if v, ok := metrics.Gauge("codegate_account_success_rate", "account_id", "acct"); !ok || v != 0.7 {
+		t.Errorf("gauge = %v, %v; want 0.7", v, ok)
+	}
+	if _, n := SuccessRate("other", DefaultWindow); n != 0 {
+		t.Errorf("outcomes leaked to another account: n = %d", n)
+	}
+}
+
+func TestSuccessRate_Window(t *testing.T) {
+	Reset()
+	RecordFailure("acct")
+	RecordFailure("acct")
+
+	// Age the failures out of a short window
+	r := getRing("acct")
+	r.mu.Lock()
+	for i := 0; i < r.n; i++ {
+		r.buf[i].at -= time.Minute.Milliseconds()
+	}
+	r.mu.Unlock()
+	RecordSuccess("acct")
+
+	if rate, n := SuccessRate("acct", 30*time.Second); rate != 1 || n != 1 {
+		t.Errorf("30s window: rate = %v over %d, want 1 over 1", rate, n)
+	}
+	if rate, n := SuccessRate("acct", DefaultWindow); n != 3 || rate < 0.33 || rate > 0.34 {
+		t.Errorf("default window: rate = %v over %d, want 1/3 over 3", rate, n)
+	}
+}
+
+func TestRing_Bounded(t *testing.T) {
+	Reset()
+	for i := 0; i < ringSize; i++ {
+		RecordFailure("acct")
+	}
+	for i := 0; i < ringSize; i++ {
+		RecordSuccess("acct")
+	}
+	if rate, n := SuccessRate("acct", DefaultWindow); n != ringSize || rate != 1 {
+		t.Errorf("rate = %v over %d, want the last %d successes only", rate, n, ringSize)
+	}
+}
+
+func TestRecord_Concurrent(t *testing.T) {
+	Reset()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if g%2 == 0 {
+					RecordSuccess("acct")
+				} else {
+					RecordFailure("acct")
+				}
+				SuccessRate("acct", DefaultWindow)
+			}
+		}(g)
+	}
+	wg.Wait()
+	if _, n := SuccessRate("acct", DefaultWindow); n != ringSize {
+		t.Errorf("n = %d, want %d", n, ringSize)
+	}
+}
@@ -0,0 +1,270 @@
+package health
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyRingSize bounds the latency samples kept per (tenant, provider, model).
+// Like the outcome ring, a busy model's window may cover less than the
+// requested duration.
+const latencyRingSize = 512
+
+type latencySample struct {
+	at int64 // unix millis
+	ms int64
+}
+
+// latencyRing is a fixed-size reservoir of a model's most recent latencies
+// for one tenant ("" for requests without a tenant).
+type latencyRing struct {
+	tenant, provider, model string
+
+	mu   sync.Mutex
+	buf  [latencyRingSize]latencySample
+	next int
+	n    int
+}
+
+// LatencyStat is the p95 latency of one provider/model pair for one tenant.
+type LatencyStat struct {
+	Tenant   string `json:"tenant,omitempty"`
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	P95Ms    int64  `json:"p95_ms"`
+	Samples  int    `json:"samples"`
+}
+
+// Thresholds configure when CheckLatency and CheckErrorRate raise an alert.
+// A zero threshold disables that check.
+type Thresholds struct {
+	P95Latency time.Duration
+	ErrorRate  float64       // fraction of failed requests, 0-1
+	Cooloff    time.Duration // minimum time between alerts for the same subject
+}
+
+// Alert describes an SLO breach. Subject is "provider/model" for latency
+// alerts and the account ID for error-rate alerts; Tenant is set when the
+// breach is in one tenant's traffic.
+type Alert struct {
+	Kind      string    `json:"kind"` // "latency" or "error_rate"
+	Tenant    string    `json:"tenant,omitempty"`
+	Subject   string    `json:"subject"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Samples   int       `json:"samples"`
+	Since     time.Time `json:"since"`
+}
+
+var (
+	latencies      = make(map[string]*latencyRing)
+	tenantOutcomes = make(map[string]*ring)
+
+	alertMu     sync.Mutex
+	activeAlert = make(map[string]*Alert)
+	lastAlerted = make(map[string]time.Time)
+)
+
+func latencyKey(tenant, provider, model string) string {
+	return tenant + "\x00" + provider + "/" + model
+}
+
+func getLatencyRing(tenant, provider, model string) *latencyRing {
+	key := latencyKey(tenant, provider, model)
+	mu.RLock()
+	r, ok := latencies[key]
+	mu.RUnlock()
+	if ok {
+		return r
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if r, ok = latencies[key]; !ok {
+		r = &latencyRing{tenant: tenant, provider: provider, model: model}
+		latencies[key] = r
+	}
+	return r
+}
+
+// RecordLatency records how long an upstream took to respond for a
+// provider/model pair, in a tenant's window ("" for no tenant).
+func RecordLatency(tenant, provider, model string, d time.Duration) {
+	r := getLatencyRing(tenant, provider, model)
+	r.mu.Lock()
+	r.buf[r.next] = latencySample{at: time.Now().UnixMilli(), ms: d.Milliseconds()}
+	r.next = (r.next + 1) % latencyRingSize
+	if r.n < latencyRingSize {
+		r.n++
+	}
+	r.mu.Unlock()
+}
+
+// P95Latency returns the 95th percentile latency of a provider/model pair in
+// a tenant's window, and how many samples it covers.
+func P95Latency(tenant, provider, model string, window time.Duration) (time.Duration, int) {
+	mu.RLock()
+	r, ok := latencies[latencyKey(tenant, provider, model)]
+	mu.RUnlock()
+	if !ok {
+		return 0, 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.p95(window)
+}
+
+// p95 uses the nearest-rank method over samples newer than window. Callers
+// hold r.mu.
+func (r *latencyRing) p95(window time.Duration) (time.Duration, int) {
+	cutoff := time.Now().Add(-window).UnixMilli()
+	ms := make([]int64, 0, r.n)
+	for i := 0; i < r.n; i++ {
+		if r.buf[i].at >= cutoff {
+			ms = append(ms, r.buf[i].ms)
+		}
+	}
+	if len(ms) == 0 {
+		return 0, 0
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i] < ms[j] })
+	rank := int(math.Ceil(0.95*float64(len(ms)))) - 1
+	return time.Duration(ms[rank]) * time.Millisecond, len(ms)
+}
+
+// LatencySnapshot returns the p95 latency of every tenant's provider/model
+// pairs with samples in window, sorted by tenant, provider and model.
+func LatencySnapshot(window time.Duration) []LatencyStat {
+	mu.RLock()
+	rings := make([]*latencyRing, 0, len(latencies))
+	for _, r := range latencies {
+		rings = append(rings, r)
+	}
+	mu.RUnlock()
+
+	stats := make([]LatencyStat, 0, len(rings))
+	for _, r := range rings {
+		r.mu.Lock()
+		p95, n := r.p95(window)
+		r.mu.Unlock()
+		if n == 0 {
+			continue
+		}
+		stats = append(stats, LatencyStat{Tenant: r.tenant, Provider: r.provider, Model: r.model, P95Ms: p95.Milliseconds(), Samples: n})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Tenant != stats[j].Tenant {
+			return stats[i].Tenant < stats[j].Tenant
+		}
+		if stats[i].Provider != stats[j].Provider {
+			return stats[i].Provider < stats[j].Provider
+		}
+		return stats[i].Model < stats[j].Model
+	})
+	return stats
+}
+
+// CheckLatency compares a provider/model pair's p95 latency in a tenant's
+// window over DefaultWindow against th.P95Latency. It returns an alert when
+// the pair is in breach and hasn't alerted within th.Cooloff, and nil
+// otherwise.
+func CheckLatency(tenant, provider, model string, th Thresholds) *Alert {
+	if th.P95Latency <= 0 {
+		return nil
+	}
+	p95, n := P95Latency(tenant, provider, model, DefaultWindow)
+	return evaluate("latency", tenant, provider+"/"+model,
+		float64(p95.Milliseconds()), float64(th.P95Latency.Milliseconds()), n, th.Cooloff)
+}
+
+// RecordTenantOutcome records an upstream request's outcome for an account
+// in a tenant's error-rate window. RecordSuccess and RecordFailure keep the
+// account-wide window that routing uses.
+func RecordTenantOutcome(tenant, accountID string, ok bool) {
+	key := tenant + "\x00" + accountID
+	mu.Lock()
+	r, found := tenantOutcomes[key]
+	if !found {
+		r = &ring{}
+		tenantOutcomes[key] = r
+	}
+	mu.Unlock()
+
+	r.mu.Lock()
+	r.push(ok)
+	r.mu.Unlock()
+}
+
+// CheckErrorRate compares an account's error rate over DefaultWindow
+// against th.ErrorRate, with the same cooloff as CheckLatency. With a tenant
+// only that tenant's requests (see RecordTenantOutcome) count.
+func CheckErrorRate(tenant, accountID string, th Thresholds) *Alert {
+	if th.ErrorRate <= 0 {
+		return nil
+	}
+	rate, n := SuccessRate(accountID, DefaultWindow)
+	if tenant != "" {
+		rate, n = 1, 0
+		mu.RLock()
+		r, ok := tenantOutcomes[tenant+"\x00"+accountID]
+		mu.RUnlock()
+		if ok {
+			r.mu.Lock()
+			rate, n = r.rate(DefaultWindow)
+			r.mu.Unlock()
+		}
+	}
+	return evaluate("error_rate", tenant, accountID, 1-rate, th.ErrorRate, n, th.Cooloff)
+}
+
+// evaluate tracks whether subject is in breach for tenant and decides
+// whether the breach should be announced. Windows with fewer than
+// MinSamples never breach.
+func evaluate(kind, tenant, subject string, value, threshold float64, samples int, cooloff time.Duration) *Alert {
+	key := kind + ":" + tenant + ":" + subject
+	now := time.Now()
+
+	alertMu.Lock()
+	defer alertMu.Unlock()
+
+	if samples < MinSamples || value <= threshold {
+		delete(activeAlert, key)
+		return nil
+	}
+	a, ok := activeAlert[key]
+	if !ok {
+		a = &Alert{Kind: kind, Tenant: tenant, Subject: subject, Since: now.UTC()}
+		activeAlert[key] = a
+	}
+	a.Value, a.Threshold, a.Samples = value, threshold, samples
+
+	if last, ok := lastAlerted[key]; ok && now.Sub(last) < cooloff {
+		return nil
+	}
+	lastAlerted[key] = now
+	out := *a
+	return &out
+}
+
+// ActiveAlerts returns the breaches seen on the most recent check of each
+// subject, sorted by kind, tenant and subject.
+func ActiveAlerts() []Alert {
+	alertMu.Lock()
+	out := make([]Alert, 0, len(activeAlert))
+	for _, a := range activeAlert {
+		out = append(out, *a)
+	}
+	alertMu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Kind != out[j].Kind {
+			return out[i].Kind < out[j].Kind
+		}
+		if out[i].Tenant != out[j].Tenant {
+			return out[i].Tenant < out[j].Tenant
+		}
+		return out[i].Subject < out[j].Subject
+	})
+	return out
+}
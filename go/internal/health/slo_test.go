@@ -0,0 +1,139 @@
+package health
+
+import (
+	"testing"
+	"time"
+)
+
+func TestP95Latency(t *testing.T) {
+	Reset()
+	if _, n := P95Latency("", "anthropic", "m", DefaultWindow); n != 0 {
+		t.Errorf("no samples: n = %d", n)
+	}
+	for ms := 100; ms >= 1; ms-- {
+		RecordLatency("", "anthropic", "m", time.Duration(ms)*time.Millisecond)
+	}
+	if p95, n := P95Latency("", "anthropic", "m", DefaultWindow); n != 100 || p95 != 95*time.Millisecond {
+		t.Errorf("p95 = %v over %d, want 95ms over 100", p95, n)
+	}
+	if _, n := P95Latency("", "openai", "m", DefaultWindow); n != 0 {
+		t.Errorf("samples leaked to another provider: n = %d", n)
+	}
+
+	stats := LatencySnapshot(DefaultWindow)
+	if len(stats) != 1 || stats[0].Provider != "anthropic" || stats[0].Model != "m" || stats[0].P95Ms != 95 {
+		t.Errorf("LatencySnapshot = %+v", stats)
+	}
+}
+
+func TestP95Latency_Window(t *testing.T) {
+	Reset()
+	for i := 0; i < 10; i++ {
+		RecordLatency("", "openrouter", "anthropic/claude", 5*time.Second)
+	}
+	r := getLatencyRing("", "openrouter", "anthropic/claude")
+	r.mu.Lock()
+	for i := 0; i < r.n; i++ {
+		r.buf[i].at -= time.Minute.Milliseconds()
+	}
+	r.mu.Unlock()
+	RecordLatency("", "openrouter", "anthropic/claude", 10*time.Millisecond)
+
+	if p95, n := P95Latency("", "openrouter", "anthropic/claude", 30*time.Second); n != 1 || p95 != 10*time.Millisecond {
+		t.Errorf("p95 = %v over %d, want 10ms over 1", p95, n)
+	}
+	if stats := LatencySnapshot(DefaultWindow); len(stats) != 1 || stats[0].Model != "anthropic/claude" {
+		t.Errorf("LatencySnapshot = %+v, want the slash kept in the model", stats)
+	}
+}
+
+func TestCheckLatency_Cooloff(t *testing.T) {
+	Reset()
+	th := Thresholds{P95Latency: 100 * time.Millisecond, Cooloff: time.Hour}
+
+	for i := 0; i < MinSamples-1; i++ {
+		RecordLatency("", "anthropic", "m", time.Second)
+	}
+	if a := CheckLatency("", "anthropic", "m", th); a != nil {
+		t.Fatalf("alert below MinSamples: %+v", a)
+	}
+
+	alerts := 0
+	for i := 0; i < 10; i++ {
+		RecordLatency("", "anthropic", "m", time.Second)
+		if a := CheckLatency("", "anthropic", "m", th); a != nil {
+			alerts++
+			if a.Kind != "latency" || a.Subject != "anthropic/m" || a.Value != 1000 || a.Threshold != 100 {
+				t.Errorf("alert = %+v", a)
+			}
+		}
+	}
+	if alerts != 1 {
+		t.Errorf("alerts = %d, want 1 within the cooloff", alerts)
+	}
+	if active := ActiveAlerts(); len(active) != 1 || active[0].Samples != MinSamples+9 {
+		t.Errorf("ActiveAlerts = %+v", active)
+	}
+
+	// Recovery clears the active alert
+	for i := 0; i < latencyRingSize; i++ {
+		RecordLatency("", "anthropic", "m", time.Millisecond)
+	}
+	if a := CheckLatency("", "anthropic", "m", th); a != nil || len(ActiveAlerts()) != 0 {
+		t.Errorf("alert after recovery: %+v, active %+v", a, ActiveAlerts())
+	}
+}
+
+func TestCheckErrorRate(t *testing.T) {
+	Reset()
+	th := Thresholds{ErrorRate: 0.5}
+	if a := CheckLatency("", "anthropic", "m", th); a != nil {
+		t.Error("latency check should be disabled without a threshold")
+	}
+
+	RecordSuccess("acct")
+	for i := 0; i < MinSamples; i++ {
+		RecordFailure("acct")
+	}
+	a := CheckErrorRate("", "acct", th)
+	if a == nil || a.Kind != "error_rate" || a.Subject != "acct" {
+		t.Fatalf("alert = %+v, want an error_rate alert for acct", a)
+	}
+	// With no cooloff every check of a breach alerts again
+	if CheckErrorRate("", "acct", th) == nil {
+		t.Error("zero cooloff should not suppress alerts")
+	}
+}
+
+func TestSLO_PerTenant(t *testing.T) {
+	Reset()
+	th := Thresholds{P95Latency: 100 * time.Millisecond, ErrorRate: 0.5}
+	for i := 0; i < MinSamples; i++ {
+		RecordLatency("t-slow", "anthropic", "m", time.Second)
+		RecordLatency("t-fast", "anthropic", "m", time.Millisecond)
+		RecordFailure("acct")
+		RecordTenantOutcome("t-slow", "acct", false)
+		RecordTenantOutcome("t-fast", "acct", true)
+	}
+
+	if a := CheckLatency("t-slow", "anthropic", "m", th); a == nil || a.Tenant != "t-slow" || a.Subject != "anthropic/m" {
+		t.Errorf("t-slow latency alert = %+v", a)
+	}
+	if a := CheckLatency("t-fast", "anthropic", "m", th); a != nil {
+		t.Errorf("t-fast alerted on another tenant's latency: %+v", a)
+	}
+	if _, n := P95Latency("", "anthropic", "m", DefaultWindow); n != 0 {
+		t.Errorf("tenant samples leaked into the untenanted window: n = %d", n)
+	}
+	if a := CheckErrorRate("t-fast", "acct", th); a != nil {
+		t.Errorf("t-fast alerted on another tenant's errors: %+v", a)
+	}
+	if a := CheckErrorRate("t-slow", "acct", th); a == nil || a.Tenant != "t-slow" {
+		t.Errorf("t-slow error alert = %+v", a)
+	}
+
+	stats := LatencySnapshot(DefaultWindow)
+	if len(stats) != 2 || stats[0].Tenant != "t-fast" || stats[1].Tenant != "t-slow" || stats[1].P95Ms != 1000 {
+		t.Errorf("LatencySnapshot = %+v", stats)
+	}
+}
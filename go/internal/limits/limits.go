@@ -2,6 +2,7 @@ package limits
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -16,8 +17,18 @@ type ModelLimits struct {
 	MaxOutputTokens     *int
 	SupportsToolCalling *bool
 	SupportsReasoning   *bool
+
+	// MaxStopSequences and MaxStopSequenceLength cap the stop sequences
+	// sent to the model; see StopSequenceLimits.
+	MaxStopSequences      *int
+	MaxStopSequenceLength *int
 }
 
+// DefaultMaxStopSequences is the stop sequence cap for models without a
+// max_stop_sequences limit. OpenAI and most compatible providers reject
+// more than 4.
+const DefaultMaxStopSequences = 4
+
 var (
 	cache   = make(map[string]ModelLimits)
 	cacheMu sync.RWMutex
@@ -31,12 +42,12 @@ func dbPath() string {
 	return filepath.Join(dataDir, "codegate.db")
 }
 
-// InitModelLimitsTable creates the model_limits table if needed and loads cache.
-func InitModelLimitsTable() {
+// InitModelLimitsTable creates the model_limits table if needed and loads
+// cache. Without the table, built-in limits apply.
+func InitModelLimitsTable() error {
 	wConn, err := sql.Open("sqlite3", dbPath()+"?_journal_mode=WAL&_foreign_keys=on")
 	if err != nil {
-		log.Printf("[limits] Failed to open DB for init: %v", err)
-		return
+		return fmt.Errorf("open database: %w", err)
 	}
 	defer wConn.Close()
 
@@ -44,14 +55,27 @@ func InitModelLimitsTable() {
 		model_id TEXT PRIMARY KEY,
 		max_output_tokens INTEGER,
 		supports_tool_calling INTEGER,
-		supports_reasoning INTEGER
+		supports_reasoning INTEGER,
+		max_stop_sequences INTEGER,
+		max_stop_sequence_length INTEGER
 	)`)
 	if err != nil {
-		log.Printf("[limits] Failed to create table: %v", err)
+		return fmt.Errorf("create model_limits: %w", err)
+	}
+	for _, col := range []string{"max_stop_sequences", "max_stop_sequence_length"} {
+		var n int
+		wConn.QueryRow("SELECT COUNT(*) FROM pragma_table_info('model_limits') WHERE name = ?", col).Scan(&n)
+		if n > 0 {
+			continue
+		}
+		if _, err := wConn.Exec("ALTER TABLE model_limits ADD COLUMN " + col + " INTEGER"); err != nil {
+			log.Printf("[limits] Failed to add model_limits.%s: %v", col, err)
+		}
 	}
 
 	reloadCache()
 	log.Println("[limits] Model limits initialized")
+	return nil
 }
 
 func reloadCache() {
@@ -61,7 +85,7 @@ func reloadCache() {
 	}
 	defer conn.Close()
 
-	rows, err := conn.Query("SELECT model_id, max_output_tokens, supports_tool_calling, supports_reasoning FROM model_limits")
+	rows, err := conn.Query("SELECT model_id, max_output_tokens, supports_tool_calling, supports_reasoning, max_stop_sequences, max_stop_sequence_length FROM model_limits")
 	if err != nil {
 		return
 	}
@@ -72,8 +96,9 @@ func reloadCache() {
 		var modelID string
 		var maxOut sql.NullInt64
 		var toolCalling, reasoning sql.NullInt64
+		var maxStop, maxStopLen sql.NullInt64
 
-		if err := rows.Scan(&modelID, &maxOut, &toolCalling, &reasoning); err != nil {
+		if err := rows.Scan(&modelID, &maxOut, &toolCalling, &reasoning, &maxStop, &maxStopLen); err != nil {
 			continue
 		}
 
@@ -90,6 +115,14 @@ func reloadCache() {
 			v := reasoning.Int64 == 1
 			ml.SupportsReasoning = &v
 		}
+		if maxStop.Valid {
+			v := int(maxStop.Int64)
+			ml.MaxStopSequences = &v
+		}
+		if maxStopLen.Valid {
+			v := int(maxStopLen.Int64)
+			ml.MaxStopSequenceLength = &v
+		}
 		newCache[modelID] = ml
 	}
 
@@ -133,6 +166,25 @@ func ClampMaxTokens(value *int, modelID string) *int {
 	return value
 }
 
+// StopSequenceLimits returns how many stop sequences the model accepts, and
+// how long each may be in characters. The count is DefaultMaxStopSequences
+// unless the model has a max_stop_sequences limit; the length is unlimited
+// (0) unless it has a max_stop_sequence_length. A limit of 0 lifts the cap.
+func StopSequenceLimits(modelID string) (maxCount, maxLength int) {
+	maxCount = DefaultMaxStopSequences
+	ml := GetModelLimits(modelID)
+	if ml == nil {
+		return maxCount, 0
+	}
+	if ml.MaxStopSequences != nil {
+		maxCount = *ml.MaxStopSequences
+	}
+	if ml.MaxStopSequenceLength != nil {
+		maxLength = *ml.MaxStopSequenceLength
+	}
+	return maxCount, maxLength
+}
+
 // GetAllModelLimits returns all configured model limits.
 func GetAllModelLimits() map[string]ModelLimits {
 	cacheMu.RLock()
@@ -114,3 +114,22 @@ func TestGetAllModelLimits(t *testing.T) {
 		t.Errorf("expected 2 limits, got %d", len(all))
 	}
 }
+
+func TestStopSequenceLimits(t *testing.T) {
+	setCache(map[string]ModelLimits{
+		"deepseek": {MaxStopSequences: intPtr(16), MaxStopSequenceLength: intPtr(32)},
+		"qwen":     {MaxOutputTokens: intPtr(8192)},
+		"local":    {MaxStopSequences: intPtr(0)},
+	})
+
+	for model, want := range map[string][2]int{
+		"deepseek-chat": {16, 32},
+		"qwen-max":      {DefaultMaxStopSequences, 0},
+		"gpt-4o":        {DefaultMaxStopSequences, 0},
+		"local-llama":   {0, 0},
+	} {
+		if count, length := StopSequenceLimits(model); count != want[0] || length != want[1] {
+			t.Errorf("%s: limits = %d, %d; want %d, %d", model, count, length, want[0], want[1])
+		}
+	}
+}
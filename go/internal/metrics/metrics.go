@@ -0,0 +1,240 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Buckets are the upper bounds, in seconds, of histogram buckets. They are
+// sized for model requests, which take from a fraction of a second to
+// minutes.
+var Buckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+type histogram struct {
+	counts []int64 // observations per bucket, not cumulative; the last is +Inf
+	sum    float64
+	count  int64
+}
+
+var (
+	mu         sync.Mutex
+	counters   = make(map[string]int64)
+	gauges     = make(map[string]float64)
+	histograms = make(map[string]*histogram)
+)
+
+// Inc increments a counter identified by name and label pairs
+// (e.g. Inc("upstream_model_drift_total", "provider", "openrouter")).
+func Inc(name string, labels ...string) {
+	Add(name, 1, labels...)
+}
+
+// Add adds delta to a counter series.
+func Add(name string, delta int64, labels ...string) {
+	key := seriesKey(name, labels)
+	mu.Lock()
+	counters[key] += delta
+	mu.Unlock()
+}
+
+// Counter returns the current value of a counter series.
+func Counter(name string, labels ...string) int64 {
+	key := seriesKey(name, labels)
+	mu.Lock()
+	defer mu.Unlock()
+	return counters[key]
+}
+
+// Snapshot returns a copy of all counter series keyed by their series name.
+func Snapshot() map[string]int64 {
+	mu.Lock()
+	defer mu.Unlock()
+	result := make(map[string]int64, len(counters))
+	for k, v := range counters {
+		result[k] = v
+	}
+	return result
+}
+
+// SetGauge sets a gauge series to value.
+func SetGauge(name string, value float64, labels ...string) {
+	key := seriesKey(name, labels)
+	mu.Lock()
+	gauges[key] = value
+	mu.Unlock()
+}
+
+// Gauge returns the current value of a gauge series and whether it is set.
+func Gauge(name string, labels ...string) (float64, bool) {
+	key := seriesKey(name, labels)
+	mu.Lock()
+	defer mu.Unlock()
+	v, ok := gauges[key]
+	return v, ok
+}
+
+// GaugeSnapshot returns a copy of all gauge series keyed by their series name.
+func GaugeSnapshot() map[string]float64 {
+	mu.Lock()
+	defer mu.Unlock()
+	result := make(map[string]float64, len(gauges))
+	for k, v := range gauges {
+		result[k] = v
+	}
+	return result
+}
+
+// Observe records value in a histogram series with the bounds in Buckets.
+func Observe(name string, value float64, labels ...string) {
+	key := seriesKey(name, labels)
+	mu.Lock()
+	defer mu.Unlock()
+	h := histograms[key]
+	if h == nil {
+		h = &histogram{counts: make([]int64, len(Buckets)+1)}
+		histograms[key] = h
+	}
+	i := sort.SearchFloat64s(Buckets, value)
+	h.counts[i]++
+	h.sum += value
+	h.count++
+}
+
+// Histogram returns the number and sum of a histogram series' observations.
+func Histogram(name string, labels ...string) (count int64, sum float64) {
+	key := seriesKey(name, labels)
+	mu.Lock()
+	defer mu.Unlock()
+	if h := histograms[key]; h != nil {
+		return h.count, h.sum
+	}
+	return 0, 0
+}
+
+// Reset clears all counters, gauges and histograms.
+func Reset() {
+	mu.Lock()
+	counters = make(map[string]int64)
+	gauges = make(map[string]float64)
+	histograms = make(map[string]*histogram)
+	mu.Unlock()
+}
+
+// WriteText writes every series in the Prometheus text exposition format,
+// grouped by metric name.
+func WriteText(w io.Writer) error {
+	type family struct {
+		kind   string
+		series []string // lines, without the trailing newline
+	}
+	families := make(map[string]*family)
+	add := func(key, kind string, lines ...string) {
+		name, _ := splitKey(key)
+		f := families[name]
+		if f == nil {
+			f = &family{kind: kind}
+			families[name] = f
+		}
+		f.series = append(f.series, lines...)
+	}
+
+	mu.Lock()
+	for k, v := range counters {
+		add(k, "counter", k+" "+strconv.FormatInt(v, 10))
+	}
+	for k, v := range gauges {
+		add(k, "gauge", k+" "+formatFloat(v))
+	}
+	keys := make([]string, 0, len(histograms))
+	for k := range histograms {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h := histograms[k]
+		name, labels := splitKey(k)
+		prefix := ""
+		if labels != "" {
+			prefix = labels + ","
+		}
+		lines := make([]string, 0, len(h.counts)+2)
+		var cumulative int64
+		for i, n := range h.counts {
+			cumulative += n
+			le := "+Inf"
+			if i < len(Buckets) {
+				le = formatFloat(Buckets[i])
+			}
+			lines = append(lines, fmt.Sprintf(`%s_bucket{%sle="%s"} %d`, name, prefix, le, cumulative))
+		}
+		lines = append(lines, withLabels(name+"_sum", labels)+" "+formatFloat(h.sum),
+			withLabels(name+"_count", labels)+" "+strconv.FormatInt(h.count, 10))
+		add(k, "histogram", lines...)
+	}
+	mu.Unlock()
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		f := families[name]
+		if f.kind != "histogram" {
+			// Histogram lines are kept in bucket order
+			sort.Strings(f.series)
+		}
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, f.kind)
+		for _, line := range f.series {
+			bw.WriteString(line + "\n")
+		}
+	}
+	return bw.Flush()
+}
+
+// splitKey splits a series key into its metric name and the labels inside
+// its braces.
+func splitKey(key string) (name, labels string) {
+	name, labels, found := strings.Cut(key, "{")
+	if !found {
+		return key, ""
+	}
+	return name, strings.TrimSuffix(labels, "}")
+}
+
+func withLabels(name, labels string) string {
+	if labels == "" {
+		return name
+	}
+	return name + "{" + labels + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// seriesKey renders name{k="v",...} with labels sorted by key so the same
+// series always maps to the same entry regardless of argument order.
+func seriesKey(name string, labels []string) string {
+	if len(labels) < 2 {
+		return name
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+escapeLabel(labels[i+1])+`"`)
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `"`, `\"`)
+	return strings.ReplaceAll(v, "\n", `\n`)
+}
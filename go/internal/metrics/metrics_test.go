@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInc_LabelOrderIndependent(t *testing.T) {
+	Reset()
+	Inc("drift_total", "provider", "openai", "model", "gpt-4o")
+	Inc("drift_total", "model", "gpt-4o", "provider", "openai")
+
+	if got := Counter("drift_total", "provider", "openai", "model", "gpt-4o"); got != 2 {
+		t.Errorf("counter = %d, want 2", got)
+	}
+}
+
+func TestSnapshot_SeriesKey(t *testing.T) {
+	Reset()
+	Inc("requests_total")
+	Inc("drift_total", "model", `a"b`)
+
+	snap := Snapshot()
+	if snap["requests_total"] != 1 {
+		t.Errorf("requests_total = %d, want 1", snap["requests_total"])
+	}
+	if snap[`drift_total{model="a\"b"}`] != 1 {
+		t.Errorf("escaped series missing: %v", snap)
+	}
+}
+
+func TestGauge(t *testing.T) {
+	Reset()
+	if _, ok := Gauge("success_rate", "account_id", "a"); ok {
+		t.Fatal("unset gauge should report !ok")
+	}
+	SetGauge("success_rate", 0.5, "account_id", "a")
+	SetGauge("success_rate", 0.75, "account_id", "a")
+
+	if v, ok := Gauge("success_rate", "account_id", "a"); !ok || v != 0.75 {
+		t.Errorf("gauge = %v, %v; want 0.75", v, ok)
+	}
+	if snap := GaugeSnapshot(); snap[`success_rate{account_id="a"}`] != 0.75 {
+		t.Errorf("snapshot = %v", snap)
+	}
+
+	Reset()
+	if len(GaugeSnapshot()) != 0 {
+		t.Error("Reset should clear gauges")
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	Reset()
+	Inc("requests_total", "status", "200")
+	Inc("requests_total", "status", "502")
+	SetGauge("success_rate", 0.5)
+	Observe("duration_seconds", 0.3, "provider", "openai")
+	Observe("duration_seconds", 400, "provider", "openai")
+
+	var b strings.Builder
+	if err := WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# TYPE duration_seconds histogram
+duration_seconds_bucket{provider="openai",le="0.1"} 0
+duration_seconds_bucket{provider="openai",le="0.25"} 0
+duration_seconds_bucket{provider="openai",le="0.5"} 1
+duration_seconds_bucket{provider="openai",le="1"} 1
+duration_seconds_bucket{provider="openai",le="2.5"} 1
+duration_seconds_bucket{provider="openai",le="5"} 1
+duration_seconds_bucket{provider="openai",le="10"} 1
+duration_seconds_bucket{provider="openai",le="30"} 1
+duration_seconds_bucket{provider="openai",le="60"} 1
+duration_seconds_bucket{provider="openai",le="120"} 1
+duration_seconds_bucket{provider="openai",le="300"} 1
+duration_seconds_bucket{provider="openai",le="+Inf"} 2
+duration_seconds_sum{provider="openai"} 400.3
+duration_seconds_count{provider="openai"} 2
+# TYPE requests_total counter
+requests_total{status="200"} 1
+requests_total{status="502"} 1
+# TYPE success_rate gauge
+success_rate 0.5
+`
+	if b.String() != want {
+		t.Errorf("WriteText =\n%s\nwant\n%s", b.String(), want)
+	}
+	if n, sum := Histogram("duration_seconds", "provider", "openai"); n != 2 || sum != 400.3 {
+		t.Errorf("histogram = %d, %v", n, sum)
+	}
+}
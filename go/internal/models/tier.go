@@ -34,6 +34,14 @@ var CostRates = map[string][2]float64{
 	"claude-sonnet-4-20250514":   {3.0, 15.0},
 	"claude-opus-4-6":            {15.0, 75.0},
 	"claude-sonnet-4-6":          {3.0, 15.0},
+	// Claude 3 family, still sent by older clients
+	"claude-3-7-sonnet-20250219": {3.0, 15.0},
+	"claude-3-5-sonnet-20241022": {3.0, 15.0},
+	"claude-3-5-sonnet-20240620": {3.0, 15.0},
+	"claude-3-5-haiku-20241022":  {0.8, 4.0},
+	"claude-3-opus-20240229":     {15.0, 75.0},
+	"claude-3-sonnet-20240229":   {3.0, 15.0},
+	"claude-3-haiku-20240307":    {0.25, 1.25},
 	"gpt-4o":                     {2.5, 10.0},
 	"gpt-4o-mini":                {0.15, 0.6},
 	"gpt-4.1":                    {2.0, 8.0},
@@ -44,11 +52,89 @@ var CostRates = map[string][2]float64{
 
 var DefaultCostRate = [2]float64{2.0, 8.0}
 
+// Aliases maps Anthropic model aliases to the snapshot each stands for.
+// Routing sends an alias to Anthropic accounts as its snapshot, and it is
+// priced as one.
+var Aliases = map[string]string{
+	"claude-3-7-sonnet-latest": "claude-3-7-sonnet-20250219",
+	"claude-3-5-sonnet-latest": "claude-3-5-sonnet-20241022",
+	"claude-3-5-haiku-latest":  "claude-3-5-haiku-20241022",
+	"claude-3-opus-latest":     "claude-3-opus-20240229",
+}
+
+// ResolveAlias returns the snapshot an alias stands for, or model itself
+// when it isn't an alias.
+func ResolveAlias(model string) string {
+	if snapshot, ok := Aliases[model]; ok {
+		return snapshot
+	}
+	return model
+}
+
+// rates returns a model's per-million-token costs, looking through aliases.
+func rates(model string) ([2]float64, bool) {
+	r, ok := CostRates[ResolveAlias(model)]
+	return r, ok
+}
+
 // EstimateCost estimates the cost of a request in USD.
 func EstimateCost(model string, inputTokens, outputTokens int) float64 {
-	rates, ok := CostRates[model]
+	rates, ok := rates(model)
 	if !ok {
 		rates = DefaultCostRate
 	}
 	return float64(inputTokens)/1_000_000*rates[0] + float64(outputTokens)/1_000_000*rates[1]
 }
+
+// ServerToolRates is the USD price of one server-side tool request, keyed by
+// the usage.server_tool_use counter name. Counters without a rate are free.
+var ServerToolRates = map[string]float64{
+	"web_search_requests": 0.01, // $10 per 1,000 searches
+}
+
+// EstimateServerToolCost prices server tool requests. rate may return a
+// configured per-request price for a counter, overriding ServerToolRates.
+func EstimateServerToolCost(use map[string]int, rate func(counter string) (float64, bool)) float64 {
+	var cost float64
+	for counter, n := range use {
+		r, ok := 0.0, false
+		if rate != nil {
+			r, ok = rate(counter)
+		}
+		if !ok {
+			r = ServerToolRates[counter]
+		}
+		cost += float64(n) * r
+	}
+	return cost
+}
+
+// CountServerToolRequests returns the total number of server tool requests.
+func CountServerToolRequests(use map[string]int) int {
+	total := 0
+	for _, n := range use {
+		total += n
+	}
+	return total
+}
+
+// PricingModel returns the model a request should be priced as. The model the
+// upstream actually served wins when it has a known rate that differs from the
+// requested model's rate; otherwise the requested model is used.
+func PricingModel(requested, actual string) string {
+	if actual == "" || actual == requested {
+		return requested
+	}
+	actualRates, ok := rates(actual)
+	if !ok {
+		return requested
+	}
+	requestedRates, ok := rates(requested)
+	if !ok {
+		requestedRates = DefaultCostRate
+	}
+	if requestedRates == actualRates {
+		return requested
+	}
+	return actual
+}
@@ -10,6 +10,8 @@ func TestDetectTier(t *testing.T) {
 		{"claude-opus-4-20250514", TierOpus},
 		{"claude-sonnet-4-20250514", TierSonnet},
 		{"claude-haiku-4-5-20251001", TierHaiku},
+		{"claude-3-5-sonnet-20241022", TierSonnet},
+		{"claude-3-opus-latest", TierOpus},
 		{"gpt-4o", ""},
 		{"deepseek-r1", ""},
 	}
@@ -36,3 +38,81 @@ func TestEstimateCost(t *testing.T) {
 		t.Errorf("EstimateCost unknown = %f, want ~10.0", cost2)
 	}
 }
+
+func TestEstimateCost_LegacyModels(t *testing.T) {
+	tests := []struct {
+		model string
+		want  float64 // for a million tokens each way
+	}{
+		{"claude-3-opus-20240229", 90.0},
+		{"claude-3-opus-latest", 90.0},
+		{"claude-3-5-sonnet-latest", 18.0},
+		{"claude-3-5-haiku-20241022", 4.8},
+		{"claude-3-haiku-20240307", 1.5},
+	}
+	for _, tt := range tests {
+		if got := EstimateCost(tt.model, 1000000, 1000000); got < tt.want-0.01 || got > tt.want+0.01 {
+			t.Errorf("EstimateCost(%q) = %f, want %f", tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestResolveAlias(t *testing.T) {
+	for alias, want := range map[string]string{
+		"claude-3-5-sonnet-latest":   "claude-3-5-sonnet-20241022",
+		"claude-3-opus-latest":       "claude-3-opus-20240229",
+		"claude-3-5-sonnet-20240620": "claude-3-5-sonnet-20240620",
+		"gpt-4o":                     "gpt-4o",
+	} {
+		if got := ResolveAlias(alias); got != want {
+			t.Errorf("ResolveAlias(%q) = %q, want %q", alias, got, want)
+		}
+	}
+	for alias, snapshot := range Aliases {
+		if _, ok := CostRates[snapshot]; !ok {
+			t.Errorf("alias %q stands for %q, which has no rate", alias, snapshot)
+		}
+	}
+}
+
+func TestPricingModel(t *testing.T) {
+	tests := []struct {
+		requested, actual, want string
+	}{
+		{"gpt-4o", "", "gpt-4o"},
+		{"gpt-4o", "gpt-4o", "gpt-4o"},
+		{"gpt-4o", "gpt-4o-mini", "gpt-4o-mini"},                         // substitution with different pricing
+		{"claude-opus-4-6", "claude-opus-4-20250514", "claude-opus-4-6"}, // same rates
+		{"gpt-4o", "gpt-4o-2024-11-20", "gpt-4o"},                        // unknown snapshot keeps requested pricing
+		{"unknown-model", "gpt-4o-mini", "gpt-4o-mini"},
+		{"claude-3-5-sonnet-latest", "claude-3-5-sonnet-20241022", "claude-3-5-sonnet-latest"}, // alias priced as its snapshot
+	}
+	for _, tt := range tests {
+		if got := PricingModel(tt.requested, tt.actual); got != tt.want {
+			t.Errorf("PricingModel(%q, %q) = %q, want %q", tt.requested, tt.actual, got, tt.want)
+		}
+	}
+}
+
+func TestEstimateServerToolCost(t *testing.T) {
+	use := map[string]int{"web_search_requests": 3, "web_fetch_requests": 2}
+
+	// Built-in rates: $0.01 per search, fetches unpriced
+	if cost := EstimateServerToolCost(use, nil); cost < 0.0299 || cost > 0.0301 {
+		t.Errorf("default cost = %f, want 0.03", cost)
+	}
+
+	override := func(counter string) (float64, bool) {
+		if counter == "web_fetch_requests" {
+			return 0.005, true
+		}
+		return 0, false
+	}
+	if cost := EstimateServerToolCost(use, override); cost < 0.0399 || cost > 0.0401 {
+		t.Errorf("overridden cost = %f, want 0.04", cost)
+	}
+
+	if n := CountServerToolRequests(use); n != 5 {
+		t.Errorf("CountServerToolRequests = %d, want 5", n)
+	}
+}
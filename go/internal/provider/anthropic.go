@@ -1,23 +1,26 @@
 package provider
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
-	"net/url"
 	"strings"
 )
 
 const anthropicDefaultBase = "https://api.anthropic.com"
 
+// AnthropicVersion is the anthropic-version sent when the request doesn't
+// carry one, and the version the format converters are written against.
+const AnthropicVersion = "2023-06-01"
+
 // ForwardAnthropic forwards a request to the Anthropic API.
 func ForwardAnthropic(opts ForwardOptions) (*Response, error) {
 	outHeaders := map[string]string{
 		"Content-Type":      "application/json",
-		"Anthropic-Version": "2023-06-01",
+		"Anthropic-Version": AnthropicVersion,
 	}
 
 	if v := opts.Headers["anthropic-version"]; v != "" {
@@ -36,12 +39,6 @@ func ForwardAnthropic(opts ForwardOptions) (*Response, error) {
 		}
 		outHeaders["Anthropic-Beta"] = strings.Join(parts, ",")
 		outHeaders["Anthropic-Dangerous-Direct-Browser-Access"] = "true"
-		if ua := opts.Headers["user-agent"]; ua != "" {
-			outHeaders["User-Agent"] = ua
-		}
-		if xapp := opts.Headers["x-app"]; xapp != "" {
-			outHeaders["X-App"] = xapp
-		}
 	} else {
 		outHeaders["X-Api-Key"] = opts.APIKey
 	}
@@ -50,9 +47,12 @@ func ForwardAnthropic(opts ForwardOptions) (*Response, error) {
 		outHeaders["Anthropic-Beta"] = beta
 	}
 
-	targetURL := buildURL(opts.BaseURL, anthropicDefaultBase, opts.Path)
+	targetURL, err := buildURL(opts.BaseURL, anthropicDefaultBase, opts.Path)
+	if err != nil {
+		return nil, err
+	}
 
-	req, err := http.NewRequest(strings.ToUpper(opts.Method), targetURL, strings.NewReader(opts.Body))
+	req, err := newUpstreamRequest(opts, targetURL)
 	if err != nil {
 		return nil, fmt.Errorf("create request: %w", err)
 	}
@@ -61,7 +61,7 @@ func ForwardAnthropic(opts ForwardOptions) (*Response, error) {
 		req.Header.Set(k, v)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := send(req, opts)
 	if err != nil {
 		return nil, fmt.Errorf("send request: %w", err)
 	}
@@ -76,12 +76,16 @@ func ForwardAnthropic(opts ForwardOptions) (*Response, error) {
 
 	if isSSE {
 		pr, pw := io.Pipe()
-		usage := &TokenUsage{}
+		usage := newStreamUsage()
 
 		go func() {
 			defer pw.Close()
+			defer usage.finish() // before pw.Close, so reaching EOF means usage is final
 			tee := io.TeeReader(resp.Body, pw)
-			extractAnthropicSSETokens(tee, usage)
+			// A cancelled request means the client went away, not a bad stream
+			if err := extractSSETokens(tee, usage); err != nil && !errors.Is(err, context.Canceled) {
+				log.Printf("[anthropic] SSE parse error: %v", err)
+			}
 			resp.Body.Close()
 		}()
 
@@ -101,7 +105,8 @@ func ForwardAnthropic(opts ForwardOptions) (*Response, error) {
 		return nil, fmt.Errorf("read response: %w", err)
 	}
 
-	var inputTokens, outputTokens, cacheRead, cacheWrite int
+	var inputTokens, outputTokens, cacheRead, cacheWrite, reasoning int
+	var serverTools map[string]int
 	var model string
 
 	var parsed map[string]any
@@ -110,10 +115,10 @@ func ForwardAnthropic(opts ForwardOptions) (*Response, error) {
 			model = m
 		}
 		if u, ok := parsed["usage"].(map[string]any); ok {
-			inputTokens = intFromAny(u["input_tokens"])
-			outputTokens = intFromAny(u["output_tokens"])
-			cacheRead = intFromAny(u["cache_read_input_tokens"])
-			cacheWrite = intFromAny(u["cache_creation_input_tokens"])
+			c := parseUsage(u)
+			inputTokens, outputTokens = c.input, c.output
+			cacheRead, cacheWrite, reasoning = c.cacheRead, c.cacheWrite, c.reasoning
+			serverTools = c.serverTools
 		}
 	}
 
@@ -125,55 +130,13 @@ func ForwardAnthropic(opts ForwardOptions) (*Response, error) {
 		OutputTokens:     outputTokens,
 		CacheReadTokens:  cacheRead,
 		CacheWriteTokens: cacheWrite,
+		ReasoningTokens:  reasoning,
+		ServerToolUse:    serverTools,
 		Model:            model,
 		IsStream:         false,
 	}, nil
 }
 
-func extractAnthropicSSETokens(r io.Reader, usage *TokenUsage) {
-	scanner := bufio.NewScanner(r)
-	scanner.Buffer(make([]byte, 256*1024), 256*1024)
-
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-		jsonStr := line[6:]
-		if jsonStr == "[DONE]" {
-			continue
-		}
-
-		var ev map[string]any
-		if err := json.Unmarshal([]byte(jsonStr), &ev); err != nil {
-			continue
-		}
-
-		evType, _ := ev["type"].(string)
-		switch evType {
-		case "message_start":
-			if msg, ok := ev["message"].(map[string]any); ok {
-				if m, ok := msg["model"].(string); ok {
-					usage.Model.Store(m)
-				}
-				if u, ok := msg["usage"].(map[string]any); ok {
-					usage.InputTokens.Store(int64(intFromAny(u["input_tokens"])))
-					usage.CacheReadTokens.Store(int64(intFromAny(u["cache_read_input_tokens"])))
-					usage.CacheWriteTokens.Store(int64(intFromAny(u["cache_creation_input_tokens"])))
-				}
-			}
-		case "message_delta":
-			if u, ok := ev["usage"].(map[string]any); ok {
-				usage.OutputTokens.Store(int64(intFromAny(u["output_tokens"])))
-			}
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		log.Printf("[anthropic] SSE parse error: %v", err)
-	}
-}
-
 func splitBeta(beta string) []string {
 	if beta == "" {
 		return nil
@@ -194,21 +157,6 @@ func containsBeta(parts []string, target string) bool {
 	return false
 }
 
-func buildURL(baseURL, defaultBase, path string) string {
-	base := defaultBase
-	if baseURL != "" {
-		base = baseURL
-	}
-
-	parsed, err := url.Parse(base)
-	if err != nil {
-		return defaultBase + path
-	}
-
-	basePath := strings.TrimRight(parsed.Path, "/")
-	return fmt.Sprintf("%s://%s%s%s", parsed.Scheme, parsed.Host, basePath, path)
-}
-
 func intFromAny(v any) int {
 	switch n := v.(type) {
 	case float64:
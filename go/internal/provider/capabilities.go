@@ -0,0 +1,41 @@
+package provider
+
+import "codegate-proxy/internal/db"
+
+// Capabilities are the limits a provider's API puts on request content.
+// Zero values mean no known limit.
+type Capabilities struct {
+	// MaxImageBytes caps the decoded size of a single inline image.
+	MaxImageBytes int
+	// MaxImageDimension caps an inline image's width and height in pixels.
+	MaxImageDimension int
+	// FileParts says the OpenAI-compatible API takes PDFs as file content
+	// parts.
+	FileParts bool
+	// Store, Metadata and Prediction say the OpenAI-compatible API takes
+	// the Chat Completions store, metadata and prediction (predicted
+	// outputs) fields. APIs without them may reject requests that have them.
+	Store, Metadata, Prediction bool
+}
+
+// capabilities holds the documented limits of each provider's native API.
+var capabilities = map[string]Capabilities{
+	"anthropic":  {MaxImageBytes: 5 << 20, MaxImageDimension: 8000},
+	"openai":     {MaxImageBytes: 20 << 20, FileParts: true, Store: true, Metadata: true, Prediction: true},
+	"openai_sub": {MaxImageBytes: 20 << 20, FileParts: true, Store: true, Metadata: true, Prediction: true},
+	"openrouter": {FileParts: true, Prediction: true},
+	"gemini":     {MaxImageBytes: 20 << 20},
+}
+
+// CapabilitiesFor returns the limits of the API an account's requests go to.
+// Accounts speaking the Anthropic API are held to Anthropic's limits,
+// whatever their provider, and accounts pointed at OpenRouter to OpenRouter's.
+func CapabilitiesFor(account db.Account) Capabilities {
+	if account.SpeaksAnthropic() {
+		return capabilities["anthropic"]
+	}
+	if account.IsOpenRouter() {
+		return capabilities["openrouter"]
+	}
+	return capabilities[account.Provider]
+}
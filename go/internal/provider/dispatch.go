@@ -2,21 +2,57 @@ package provider
 
 import (
 	"codegate-proxy/internal/db"
+	"context"
 	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
 )
 
+// HopHeader counts how many CodeGate proxies a request has passed through,
+// so a base_url pointing back at a proxy can't loop forever. Only the count
+// is sent, and only to base URLs db.IsCodeGateURL recognizes; account names
+// stay local.
+const HopHeader = "X-CodeGate-Hop"
+
+// proxyRequestIDHeader is set on every CodeGate proxy response. An upstream
+// answering with it is another proxy, so later requests carry HopHeader.
+const proxyRequestIDHeader = "x-proxy-request-id"
+
+// RequestIDHeader carries the proxy's request ID upstream, so a provider's
+// or a downstream proxy's records can be matched to the proxy's own.
+const RequestIDHeader = "X-Request-Id"
+
 // Forward dispatches a request to the appropriate provider based on the account.
 func Forward(account db.Account, opts ForwardOptions) (*Response, error) {
+	resp, err := forward(account, opts)
+	if err == nil && resp.Headers[proxyRequestIDHeader] != "" {
+		db.MarkCodeGateURL(opts.BaseURL)
+	}
+	return resp, err
+}
+
+func forward(account db.Account, opts ForwardOptions) (*Response, error) {
+	// Simulator accounts answer locally, whatever their api_flavor
+	if account.Provider == SimulatorProvider {
+		return forwardSimulator(account, opts)
+	}
+
 	// Codex subscription accounts
-	if (account.Provider == "openai" || account.Provider == "openai_sub") &&
-		account.ExternalAccountID != "" && account.AuthType == "oauth" {
+	if isCodexAccount(account) {
 		return ForwardOpenAI(opts)
 	}
 
-	switch account.Provider {
-	case "anthropic":
+	// api_flavor decides the wire format; providers without one fall back
+	// to their native API below
+	if account.SpeaksAnthropic() {
 		return ForwardAnthropic(opts)
+	}
+	if account.APIFlavor == "openai" {
+		return ForwardOpenAI(opts)
+	}
 
+	switch account.Provider {
 	case "openai", "openai_sub", "glm", "cerebras", "deepseek", "gemini", "minimax":
 		return ForwardOpenAI(opts)
 
@@ -30,3 +66,43 @@ func Forward(account db.Account, opts ForwardOptions) (*Response, error) {
 		return nil, fmt.Errorf("unknown provider %q with no base_url configured", account.Provider)
 	}
 }
+
+// isCodexAccount reports whether an account is a ChatGPT (Codex)
+// subscription, which Forward always sends through ForwardOpenAI.
+func isCodexAccount(a db.Account) bool {
+	return (a.Provider == "openai" || a.Provider == "openai_sub") && a.ExternalAccountID != "" && a.AuthType == "oauth"
+}
+
+// usesCodexBackend reports whether ForwardOpenAI sends a request to the
+// Codex backend rather than the OpenAI API: a ChatGPT account ID with no
+// base_url of its own.
+func usesCodexBackend(externalAccountID, baseURL string) bool {
+	return externalAccountID != "" && baseURL == ""
+}
+
+// newUpstreamRequest creates the outbound request with the forwarded body and
+// the passthrough client headers. Forwarders set their own headers afterwards,
+// so those override anything the client sent.
+func newUpstreamRequest(opts ForwardOptions, targetURL string) (*http.Request, error) {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req, err := http.NewRequestWithContext(ctx, strings.ToUpper(opts.Method), targetURL, opts.Body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range opts.ClientHeaders {
+		req.Header.Set(k, v)
+	}
+	if opts.Hop > 0 && db.IsCodeGateURL(opts.BaseURL) {
+		req.Header.Set(HopHeader, strconv.Itoa(opts.Hop))
+	}
+	if opts.RequestID != "" {
+		req.Header.Set(RequestIDHeader, opts.RequestID)
+	}
+	if opts.BodyLength > 0 {
+		req.ContentLength = opts.BodyLength
+	}
+	return traceConnection(req), nil
+}
@@ -0,0 +1,244 @@
+package provider
+
+import (
+	"codegate-proxy/internal/db"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestForward_DispatchByFlavor(t *testing.T) {
+	var gotAPIKey, gotAuth, gotVersion string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAPIKey = r.Header.Get("X-Api-Key")
+		gotAuth = r.Header.Get("Authorization")
+		gotVersion = r.Header.Get("Anthropic-Version")
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{}`)
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		provider, flavor string
+		wantAnthropic    bool
+	}{
+		{"glm", "", false},
+		{"glm", "openai", false},
+		{"glm", "anthropic", true},
+		{"custom", "anthropic", true},
+		{"anthropic", "", true},
+		{"anthropic", "openai", false},
+	}
+	for _, c := range cases {
+		gotAPIKey, gotAuth, gotVersion = "", "", ""
+		account := db.Account{Provider: c.provider, APIFlavor: c.flavor, BaseURL: srv.URL}
+		_, err := Forward(account, ForwardOptions{
+			Path:    "/v1/messages",
+			Method:  "POST",
+			Body:    strings.NewReader(`{}`),
+			APIKey:  "key-123",
+			BaseURL: srv.URL,
+		})
+		if err != nil {
+			t.Fatalf("%s/%q: %v", c.provider, c.flavor, err)
+		}
+		if c.wantAnthropic {
+			if gotAPIKey != "key-123" || gotAuth != "" || gotVersion == "" {
+				t.Errorf("%s/%q: want Anthropic auth, got x-api-key=%q authorization=%q version=%q",
+					c.provider, c.flavor, gotAPIKey, gotAuth, gotVersion)
+			}
+		} else if gotAuth != "Bearer key-123" || gotAPIKey != "" {
+			t.Errorf("%s/%q: want bearer auth, got x-api-key=%q authorization=%q",
+				c.provider, c.flavor, gotAPIKey, gotAuth)
+		}
+	}
+}
+
+func TestSpeaksAnthropic(t *testing.T) {
+	cases := []struct {
+		provider, flavor string
+		want             bool
+	}{
+		{"anthropic", "", true},
+		{"anthropic", "openai", false},
+		{"glm", "", false},
+		{"glm", "anthropic", true},
+		{"openrouter", "", false},
+	}
+	for _, c := range cases {
+		a := db.Account{Provider: c.provider, APIFlavor: c.flavor}
+		if got := a.SpeaksAnthropic(); got != c.want {
+			t.Errorf("SpeaksAnthropic(%s, %q) = %v, want %v", c.provider, c.flavor, got, c.want)
+		}
+	}
+}
+
+func TestExtractAnthropicSSETokens_GLMUsage(t *testing.T) {
+	// GLM's Anthropic-compatible stream reports zeros up front and the real
+	// input and cache counts alongside output in message_delta
+	stream := "event: message_start\n" +
+		`data: {"type":"message_start","message":{"model":"glm-4.6","usage":{"input_tokens":0,"output_tokens":0}}}` + "\n\n" +
+		"event: message_delta\n" +
+		`data: {"type":"message_delta","usage":{"input_tokens":1200,"output_tokens":80,"cache_read_input_tokens":1024}}` + "\n\n"
+
+	usage := &TokenUsage{}
+	extractSSETokens(strings.NewReader(stream), usage)
+
+	if got := usage.InputTokens.Load(); got != 1200 {
+		t.Errorf("input = %d, want 1200", got)
+	}
+	if got := usage.OutputTokens.Load(); got != 80 {
+		t.Errorf("output = %d, want 80", got)
+	}
+	if got := usage.CacheReadTokens.Load(); got != 1024 {
+		t.Errorf("cache read = %d, want 1024", got)
+	}
+}
+
+func TestExtractAnthropicSSETokens_DeltaKeepsStartCounts(t *testing.T) {
+	stream := `data: {"type":"message_start","message":{"usage":{"input_tokens":50,"cache_read_input_tokens":10}}}` + "\n" +
+		`data: {"type":"message_delta","usage":{"output_tokens":7}}` + "\n"
+
+	usage := &TokenUsage{}
+	extractSSETokens(strings.NewReader(stream), usage)
+
+	if usage.InputTokens.Load() != 50 || usage.CacheReadTokens.Load() != 10 || usage.OutputTokens.Load() != 7 {
+		t.Errorf("got input=%d cache=%d output=%d, want 50/10/7",
+			usage.InputTokens.Load(), usage.CacheReadTokens.Load(), usage.OutputTokens.Load())
+	}
+}
+
+func TestParseUsage(t *testing.T) {
+	cases := []struct {
+		name string
+		u    map[string]any
+		want usageCounts
+	}{
+		{"anthropic", map[string]any{"input_tokens": 10.0, "output_tokens": 5.0,
+			"cache_read_input_tokens": 3.0, "cache_creation_input_tokens": 2.0}, usageCounts{input: 10, output: 5, cacheRead: 3, cacheWrite: 2}},
+		{"openai", map[string]any{"prompt_tokens": 10.0, "completion_tokens": 5.0,
+			"prompt_tokens_details": map[string]any{"cached_tokens": 4.0}}, usageCounts{input: 10, output: 5, cacheRead: 4}},
+		{"glm mixed", map[string]any{"prompt_tokens": 10.0, "output_tokens": 5.0,
+			"cached_tokens": 6.0}, usageCounts{input: 10, output: 5, cacheRead: 6}},
+		{"empty", map[string]any{}, usageCounts{}},
+	}
+	for _, c := range cases {
+		if got := parseUsage(c.u); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: parseUsage = %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestForward_ClientHeaders(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{}`)
+	}))
+	defer srv.Close()
+
+	client := map[string]string{"User-Agent": "my-app/1.0", "X-App": "cli"}
+	for _, provider := range []string{"anthropic", "openai"} {
+		got = nil
+		_, err := Forward(db.Account{Provider: provider, BaseURL: srv.URL}, ForwardOptions{
+			Path: "/v1/messages", Method: "POST", Body: strings.NewReader(`{}`),
+			APIKey: "k", BaseURL: srv.URL, ClientHeaders: client,
+		})
+		if err != nil {
+			t.Fatalf("%s: Forward: %v", provider, err)
+		}
+		if got.Get("User-Agent") != "my-app/1.0" || got.Get("X-App") != "cli" {
+			t.Errorf("%s: forwarded User-Agent = %q, X-App = %q", provider, got.Get("User-Agent"), got.Get("X-App"))
+		}
+	}
+
+	// Provider-set headers win over client headers
+	got = nil
+	_, err := Forward(db.Account{Provider: "openai", AuthType: "oauth", ExternalAccountID: "acct"}, ForwardOptions{
+		Path: "/responses", Method: "POST", Body: strings.NewReader(`{}`),
+		APIKey: "k", BaseURL: srv.URL, ExternalAccountID: "acct", ClientHeaders: client,
+	})
+	if err != nil {
+		t.Fatalf("codex: Forward: %v", err)
+	}
+	if ua := got.Get("User-Agent"); ua != "codex_cli_rs/0.1.0" {
+		t.Errorf("codex User-Agent = %q, want the provider's own", ua)
+	}
+}
+
+func TestForward_HopHeaders(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{}`)
+	}))
+	defer srv.Close()
+	t.Setenv("PROXY_PORT", srv.URL[strings.LastIndex(srv.URL, ":")+1:])
+
+	for _, provider := range []string{"anthropic", "openai"} {
+		got = nil
+		_, err := Forward(db.Account{Provider: provider, BaseURL: srv.URL}, ForwardOptions{
+			Path: "/v1/messages", Method: "POST", Body: strings.NewReader(`{}`),
+			APIKey: "k", BaseURL: srv.URL, Hop: 2,
+		})
+		if err != nil {
+			t.Fatalf("%s: Forward: %v", provider, err)
+		}
+		if got.Get(HopHeader) != "2" {
+			t.Errorf("%s: %s = %q, want 2", provider, HopHeader, got.Get(HopHeader))
+		}
+		if v := got.Get("X-CodeGate-Hop-Account"); v != "" {
+			t.Errorf("%s: account name %q sent upstream", provider, v)
+		}
+	}
+
+	got = nil
+	Forward(db.Account{Provider: "openai", BaseURL: srv.URL}, ForwardOptions{
+		Path: "/v1/chat/completions", Method: "POST", Body: strings.NewReader(`{}`), APIKey: "k", BaseURL: srv.URL,
+	})
+	if got.Get(HopHeader) != "" {
+		t.Errorf("%s sent without a hop count", HopHeader)
+	}
+}
+
+func TestForward_HopHeaderOnlyToProxies(t *testing.T) {
+	var got http.Header
+	var asProxy bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		if asProxy {
+			w.Header().Set("X-Proxy-Request-Id", "0123456789abcdef")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{}`)
+	}))
+	defer srv.Close()
+
+	send := func() {
+		got = nil
+		if _, err := Forward(db.Account{Provider: "anthropic", BaseURL: srv.URL}, ForwardOptions{
+			Path: "/v1/messages", Method: "POST", Body: strings.NewReader(`{}`),
+			APIKey: "k", BaseURL: srv.URL, Hop: 1,
+		}); err != nil {
+			t.Fatalf("Forward: %v", err)
+		}
+	}
+
+	send()
+	if v := got.Get(HopHeader); v != "" {
+		t.Errorf("%s = %q sent to a third-party base URL", HopHeader, v)
+	}
+
+	// Once the upstream answers as a CodeGate proxy, it gets the count
+	asProxy = true
+	send()
+	send()
+	if got.Get(HopHeader) != "1" {
+		t.Errorf("%s = %q after the upstream answered as a proxy, want 1", HopHeader, got.Get(HopHeader))
+	}
+}
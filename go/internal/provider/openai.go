@@ -1,19 +1,19 @@
 package provider
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
-	"regexp"
 	"strings"
 )
 
-const openaiDefaultBase = "https://api.openai.com"
-
-var versionPathRe = regexp.MustCompile(`/v\d+$`)
+const (
+	openaiDefaultBase = "https://api.openai.com"
+	codexDefaultBase  = "https://chatgpt.com/backend-api/codex"
+)
 
 // ForwardOpenAI forwards a request to an OpenAI-compatible API.
 func ForwardOpenAI(opts ForwardOptions) (*Response, error) {
@@ -32,17 +32,17 @@ func ForwardOpenAI(opts ForwardOptions) (*Response, error) {
 		outHeaders["Originator"] = "codex_cli_rs"
 	}
 
-	isCodexSub := opts.ExternalAccountID != "" && opts.BaseURL == ""
-	base := openaiDefaultBase
-	if isCodexSub {
-		base = "https://chatgpt.com/backend-api/codex"
-	} else if opts.BaseURL != "" {
-		base = opts.BaseURL
+	defaultBase := openaiDefaultBase
+	if usesCodexBackend(opts.ExternalAccountID, opts.BaseURL) {
+		defaultBase = codexDefaultBase
 	}
 
-	targetURL := buildOpenAIURL(base, opts.Path)
+	targetURL, err := buildURL(opts.BaseURL, defaultBase, opts.Path)
+	if err != nil {
+		return nil, err
+	}
 
-	req, err := http.NewRequest(strings.ToUpper(opts.Method), targetURL, strings.NewReader(opts.Body))
+	req, err := newUpstreamRequest(opts, targetURL)
 	if err != nil {
 		return nil, fmt.Errorf("create request: %w", err)
 	}
@@ -51,7 +51,7 @@ func ForwardOpenAI(opts ForwardOptions) (*Response, error) {
 		req.Header.Set(k, v)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := send(req, opts)
 	if err != nil {
 		return nil, fmt.Errorf("send request: %w", err)
 	}
@@ -66,12 +66,16 @@ func ForwardOpenAI(opts ForwardOptions) (*Response, error) {
 
 	if isSSE {
 		pr, pw := io.Pipe()
-		usage := &TokenUsage{}
+		usage := newStreamUsage()
 
 		go func() {
 			defer pw.Close()
+			defer usage.finish() // before pw.Close, so reaching EOF means usage is final
 			tee := io.TeeReader(resp.Body, pw)
-			extractOpenAISSETokens(tee, usage)
+			// A cancelled request means the client went away, not a bad stream
+			if err := extractSSETokens(tee, usage); err != nil && !errors.Is(err, context.Canceled) {
+				log.Printf("[openai] SSE parse error: %v", err)
+			}
 			resp.Body.Close()
 		}()
 
@@ -91,7 +95,8 @@ func ForwardOpenAI(opts ForwardOptions) (*Response, error) {
 		return nil, fmt.Errorf("read response: %w", err)
 	}
 
-	var inputTokens, outputTokens int
+	var inputTokens, outputTokens, cacheRead, reasoning int
+	var cost float64
 	var model string
 
 	var parsed map[string]any
@@ -100,70 +105,22 @@ func ForwardOpenAI(opts ForwardOptions) (*Response, error) {
 			model = m
 		}
 		if u, ok := parsed["usage"].(map[string]any); ok {
-			inputTokens = intFromAny(u["prompt_tokens"])
-			outputTokens = intFromAny(u["completion_tokens"])
+			c := parseUsage(u)
+			inputTokens, outputTokens, cacheRead, reasoning = c.input, c.output, c.cacheRead, c.reasoning
+			cost = c.cost
 		}
 	}
 
 	return &Response{
-		Status:       resp.StatusCode,
-		Headers:      responseHeaders,
-		Body:         io.NopCloser(strings.NewReader(string(bodyBytes))),
-		InputTokens:  inputTokens,
-		OutputTokens: outputTokens,
-		Model:        model,
-		IsStream:     false,
+		Status:          resp.StatusCode,
+		Headers:         responseHeaders,
+		Body:            io.NopCloser(strings.NewReader(string(bodyBytes))),
+		InputTokens:     inputTokens,
+		OutputTokens:    outputTokens,
+		CacheReadTokens: cacheRead,
+		ReasoningTokens: reasoning,
+		CostUSD:         cost,
+		Model:           model,
+		IsStream:        false,
 	}, nil
 }
-
-func extractOpenAISSETokens(r io.Reader, usage *TokenUsage) {
-	scanner := bufio.NewScanner(r)
-	scanner.Buffer(make([]byte, 256*1024), 256*1024)
-
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-		jsonStr := line[6:]
-		if jsonStr == "[DONE]" {
-			continue
-		}
-
-		var ev map[string]any
-		if err := json.Unmarshal([]byte(jsonStr), &ev); err != nil {
-			continue
-		}
-
-		if m, ok := ev["model"].(string); ok {
-			usage.Model.Store(m)
-		}
-		if u, ok := ev["usage"].(map[string]any); ok {
-			usage.InputTokens.Store(int64(intFromAny(u["prompt_tokens"])))
-			usage.OutputTokens.Store(int64(intFromAny(u["completion_tokens"])))
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		log.Printf("[openai] SSE parse error: %v", err)
-	}
-}
-
-func buildOpenAIURL(base, path string) string {
-	// Simple URL building
-	base = strings.TrimRight(base, "/")
-
-	// Gemini compatibility
-	if strings.Contains(base, "generativelanguage.googleapis.com") {
-		geminiPath := strings.Replace(path, "/v1/", "/", 1)
-		return base + "/v1beta/openai" + geminiPath
-	}
-
-	// If base has a version segment, strip /v1 from path
-	adjustedPath := path
-	if versionPathRe.MatchString(base) {
-		adjustedPath = strings.Replace(path, "/v1/", "/", 1)
-	}
-
-	return base + adjustedPath
-}
@@ -0,0 +1,350 @@
+package provider
+
+import (
+	"codegate-proxy/internal/db"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SimulatorProvider is the provider of accounts that answer locally, for
+// failover and alerting drills, without calling any upstream.
+const SimulatorProvider = "simulator"
+
+// simulatorSettings is how a simulator account behaves, set as JSON in its
+// simulator_settings. Zero values take the defaults below.
+type simulatorSettings struct {
+	// LatencyMs is waited before answering
+	LatencyMs int `json:"latency_ms"`
+	// ChunkIntervalMs is waited between the events of a stream
+	ChunkIntervalMs int `json:"chunk_interval_ms"`
+	// ErrorRate is the fraction of requests that fail, from 0 to 1. Failures
+	// are spread evenly rather than drawn at random, so 0.5 fails every
+	// second request
+	ErrorRate float64 `json:"error_rate"`
+	// ErrorStatuses are the statuses failed requests get, in turn; 500 if
+	// empty
+	ErrorStatuses []int `json:"error_statuses"`
+	// Text is the response's text, split over Chunks deltas when streamed
+	Text   string `json:"text"`
+	Chunks int    `json:"chunks"`
+	// InputTokens and OutputTokens are the usage reported
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	// Model is the model reported; the requested one if empty
+	Model string `json:"model"`
+}
+
+const (
+	simulatorDefaultText   = "This is a simulated response."
+	simulatorDefaultChunks = 5
+	simulatorDefaultInput  = 10
+	simulatorDefaultOutput = 20
+)
+
+// parseSimulatorSettings parses an account's simulator_settings, filling in
+// defaults.
+func parseSimulatorSettings(raw string) (simulatorSettings, error) {
+	var s simulatorSettings
+	if strings.TrimSpace(raw) != "" {
+		if err := json.Unmarshal([]byte(raw), &s); err != nil {
+			return s, fmt.Errorf("simulator_settings: %w", err)
+		}
+	}
+	if s.ErrorRate < 0 || s.ErrorRate > 1 {
+		return s, fmt.Errorf("simulator_settings: error_rate %v is not between 0 and 1", s.ErrorRate)
+	}
+	for _, status := range s.ErrorStatuses {
+		if status < 400 || status > 599 {
+			return s, fmt.Errorf("simulator_settings: error status %d is not an error", status)
+		}
+	}
+	if len(s.ErrorStatuses) == 0 {
+		s.ErrorStatuses = []int{500}
+	}
+	if s.Text == "" {
+		s.Text = simulatorDefaultText
+	}
+	if s.Chunks <= 0 {
+		s.Chunks = simulatorDefaultChunks
+	}
+	if s.InputTokens <= 0 {
+		s.InputTokens = simulatorDefaultInput
+	}
+	if s.OutputTokens <= 0 {
+		s.OutputTokens = simulatorDefaultOutput
+	}
+	return s, nil
+}
+
+// simulatorCounts numbers each simulator account's requests and failures,
+// so error_rate and error_statuses play out the same way on every run.
+var simulatorCounts = struct {
+	sync.Mutex
+	requests, failures map[string]int
+}{requests: make(map[string]int), failures: make(map[string]int)}
+
+// ResetSimulator restarts every simulator account's request count, so the
+// next request is its first.
+func ResetSimulator() {
+	simulatorCounts.Lock()
+	simulatorCounts.requests = make(map[string]int)
+	simulatorCounts.failures = make(map[string]int)
+	simulatorCounts.Unlock()
+}
+
+// simulatedFailure returns the status an account's next request fails with,
+// or 0 if it succeeds. Request n fails when it takes the failures so far
+// past n times the error rate.
+func simulatedFailure(accountID string, s simulatorSettings) int {
+	simulatorCounts.Lock()
+	defer simulatorCounts.Unlock()
+	n := simulatorCounts.requests[accountID]
+	simulatorCounts.requests[accountID] = n + 1
+	if math.Floor(float64(n+1)*s.ErrorRate+1e-9) <= math.Floor(float64(n)*s.ErrorRate+1e-9) {
+		return 0
+	}
+	f := simulatorCounts.failures[accountID]
+	simulatorCounts.failures[accountID] = f + 1
+	return s.ErrorStatuses[f%len(s.ErrorStatuses)]
+}
+
+// forwardSimulator answers a request the way the account's settings
+// describe, in the format the account speaks, without any network call.
+// Latency past the request's timeouts fails with a TimeoutError like a slow
+// upstream would.
+func forwardSimulator(account db.Account, opts ForwardOptions) (*Response, error) {
+	s, err := parseSimulatorSettings(account.SimulatorSettings)
+	if err != nil {
+		return nil, err
+	}
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	var req struct {
+		Model string `json:"model"`
+	}
+	if opts.Body != nil {
+		body, err := io.ReadAll(opts.Body)
+		if err != nil {
+			return nil, fmt.Errorf("read request: %w", err)
+		}
+		json.Unmarshal(body, &req)
+	}
+	model := s.Model
+	if model == "" {
+		model = req.Model
+	}
+
+	limit := &TimeoutError{Phase: "response", After: opts.Timeouts.Response}
+	if opts.Stream {
+		limit.Phase, limit.After = "response header", opts.Timeouts.Header
+	}
+	latency := time.Duration(s.LatencyMs) * time.Millisecond
+	if limit.After > 0 && latency > limit.After {
+		if err := sleepContext(ctx, limit.After); err != nil {
+			return nil, fmt.Errorf("send request: %w", err)
+		}
+		return nil, limit
+	}
+	if err := sleepContext(ctx, latency); err != nil {
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+
+	anthropic := account.SpeaksAnthropic()
+	idHeader := "x-request-id"
+	if anthropic {
+		idHeader = "request-id"
+	}
+	headers := map[string]string{"content-type": "application/json", idHeader: simulatedID("req_sim_")}
+
+	if status := simulatedFailure(account.ID, s); status != 0 {
+		body := simulatedError(anthropic, status)
+		return &Response{Status: status, Headers: headers, Body: io.NopCloser(strings.NewReader(body))}, nil
+	}
+
+	if strings.HasSuffix(opts.Path, "/count_tokens") {
+		body := fmt.Sprintf(`{"input_tokens":%d}`, s.InputTokens)
+		return &Response{Status: 200, Headers: headers, Body: io.NopCloser(strings.NewReader(body))}, nil
+	}
+
+	if !opts.Stream {
+		body, _ := json.Marshal(simulatedMessage(anthropic, model, s))
+		return &Response{
+			Status: 200, Headers: headers, Body: io.NopCloser(strings.NewReader(string(body))),
+			InputTokens: s.InputTokens, OutputTokens: s.OutputTokens, Model: model,
+		}, nil
+	}
+
+	headers["content-type"] = "text/event-stream"
+	format := "openai"
+	if anthropic {
+		format = "anthropic"
+	}
+	events := SimulatedStream(format, model, s.Text, s.Chunks, s.InputTokens, s.OutputTokens)
+	interval := time.Duration(s.ChunkIntervalMs) * time.Millisecond
+
+	pr, pw := io.Pipe()
+	usage := newStreamUsage()
+	usage.InputTokens.Store(int64(s.InputTokens))
+	usage.Model.Store(model)
+	go func() {
+		defer pw.Close()
+		defer usage.finish()
+		for i, event := range events {
+			if i > 0 {
+				if err := sleepContext(ctx, interval); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+			}
+			if _, err := io.WriteString(pw, event); err != nil {
+				return
+			}
+		}
+		usage.OutputTokens.Store(int64(s.OutputTokens))
+	}()
+	return &Response{Status: 200, Headers: headers, Body: pr, IsStream: true, Usage: usage}, nil
+}
+
+// SimulatedStream returns the events of a valid Anthropic or OpenAI
+// ("openai") stream whose reply is text, split evenly over chunks deltas.
+// Text shorter than chunks characters is repeated until it is long enough.
+// The stream reports input and output tokens of usage, the OpenAI one in a
+// final usage chunk, as with stream_options.include_usage.
+func SimulatedStream(format, model, text string, chunks, input, output int) []string {
+	pieces := splitText(text, max(chunks, 1))
+	var events []string
+	add := func(event string, payload map[string]any) {
+		data, _ := json.Marshal(payload)
+		if event != "" {
+			event = "event: " + event + "\n"
+		}
+		events = append(events, event+"data: "+string(data)+"\n\n")
+	}
+
+	if format == "anthropic" {
+		add("message_start", map[string]any{"type": "message_start", "message": map[string]any{
+			"id": simulatedID("msg_sim_"), "type": "message", "role": "assistant", "model": model,
+			"content": []any{}, "stop_reason": nil, "stop_sequence": nil,
+			"usage": map[string]any{"input_tokens": input, "output_tokens": 1},
+		}})
+		add("content_block_start", map[string]any{"type": "content_block_start", "index": 0,
+			"content_block": map[string]any{"type": "text", "text": ""}})
+		for _, p := range pieces {
+			add("content_block_delta", map[string]any{"type": "content_block_delta", "index": 0,
+				"delta": map[string]any{"type": "text_delta", "text": p}})
+		}
+		add("content_block_stop", map[string]any{"type": "content_block_stop", "index": 0})
+		add("message_delta", map[string]any{"type": "message_delta",
+			"delta": map[string]any{"stop_reason": "end_turn", "stop_sequence": nil},
+			"usage": map[string]any{"output_tokens": output}})
+		add("message_stop", map[string]any{"type": "message_stop"})
+		return events
+	}
+
+	id, created := simulatedID("chatcmpl-sim-"), time.Now().Unix()
+	chunk := func(delta map[string]any, finish any) map[string]any {
+		return map[string]any{"id": id, "object": "chat.completion.chunk", "created": created, "model": model,
+			"choices": []any{map[string]any{"index": 0, "delta": delta, "finish_reason": finish}}}
+	}
+	add("", chunk(map[string]any{"role": "assistant", "content": ""}, nil))
+	for _, p := range pieces {
+		add("", chunk(map[string]any{"content": p}, nil))
+	}
+	add("", chunk(map[string]any{}, "stop"))
+	add("", map[string]any{"id": id, "object": "chat.completion.chunk", "created": created, "model": model,
+		"choices": []any{}, "usage": map[string]any{"prompt_tokens": input, "completion_tokens": output, "total_tokens": input + output}})
+	events = append(events, "data: [DONE]\n\n")
+	return events
+}
+
+// simulatedMessage is a complete non-streamed reply.
+func simulatedMessage(anthropic bool, model string, s simulatorSettings) map[string]any {
+	if anthropic {
+		return map[string]any{"id": simulatedID("msg_sim_"), "type": "message", "role": "assistant", "model": model,
+			"content":     []any{map[string]any{"type": "text", "text": s.Text}},
+			"stop_reason": "end_turn", "stop_sequence": nil,
+			"usage": map[string]any{"input_tokens": s.InputTokens, "output_tokens": s.OutputTokens}}
+	}
+	return map[string]any{"id": simulatedID("chatcmpl-sim-"), "object": "chat.completion", "created": time.Now().Unix(), "model": model,
+		"choices": []any{map[string]any{"index": 0, "message": map[string]any{"role": "assistant", "content": s.Text}, "finish_reason": "stop"}},
+		"usage":   map[string]any{"prompt_tokens": s.InputTokens, "completion_tokens": s.OutputTokens, "total_tokens": s.InputTokens + s.OutputTokens}}
+}
+
+// simulatedError is the error body a provider answers status with.
+func simulatedError(anthropic bool, status int) string {
+	errType := "api_error"
+	switch {
+	case status == 400:
+		errType = "invalid_request_error"
+	case status == 401:
+		errType = "authentication_error"
+	case status == 403:
+		errType = "permission_error"
+	case status == 404:
+		errType = "not_found_error"
+	case status == 429:
+		errType = "rate_limit_error"
+	case status == 529:
+		errType = "overloaded_error"
+	case status < 500:
+		errType = "invalid_request_error"
+	}
+	message := fmt.Sprintf("Simulated %d error", status)
+	var body map[string]any
+	if anthropic {
+		body = map[string]any{"type": "error", "error": map[string]any{"type": errType, "message": message}}
+	} else {
+		body = map[string]any{"error": map[string]any{"type": errType, "message": message, "code": status}}
+	}
+	b, _ := json.Marshal(body)
+	return string(b)
+}
+
+// splitText splits text into n pieces of nearly equal length, repeating it
+// first if it has fewer than n characters.
+func splitText(text string, n int) []string {
+	runes := []rune(text)
+	if len(runes) == 0 {
+		runes = []rune(simulatorDefaultText)
+	}
+	for len(runes) < n {
+		runes = append(runes, runes...)
+	}
+	pieces := make([]string, n)
+	for i := range pieces {
+		pieces[i] = string(runes[i*len(runes)/n : (i+1)*len(runes)/n])
+	}
+	return pieces
+}
+
+func simulatedID(prefix string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
+
+// sleepContext waits d, or returns ctx's error if it is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
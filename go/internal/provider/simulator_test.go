@@ -0,0 +1,177 @@
+package provider
+
+import (
+	"codegate-proxy/internal/db"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func simulate(t *testing.T, account db.Account, opts ForwardOptions) *Response {
+	t.Helper()
+	if opts.Body == nil {
+		opts.Body = strings.NewReader(`{"model":"claude-sonnet-4-20250514"}`)
+	}
+	resp, err := Forward(account, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestSimulatedStream_Valid(t *testing.T) {
+	for _, format := range []string{"anthropic", "openai"} {
+		for _, chunks := range []int{1, 3, 40} {
+			events := SimulatedStream(format, "sim-model", "Hello there", chunks, 12, 34)
+			stream := strings.Join(events, "")
+
+			var text strings.Builder
+			if err := readSSE(strings.NewReader(stream), func(data string) {
+				if data == "[DONE]" {
+					return
+				}
+				var ev struct {
+					Delta struct {
+						Text string `json:"text"`
+					} `json:"delta"`
+					Choices []struct {
+						Delta struct {
+							Content string `json:"content"`
+						} `json:"delta"`
+					} `json:"choices"`
+				}
+				if err := json.Unmarshal([]byte(data), &ev); err != nil {
+					t.Fatalf("%s: invalid event %q", format, data)
+				}
+				text.WriteString(ev.Delta.Text)
+				for _, c := range ev.Choices {
+					text.WriteString(c.Delta.Content)
+				}
+			}); err != nil {
+				t.Fatal(err)
+			}
+			want := "Hello there"
+			if chunks == 40 {
+				want = strings.Repeat(want, 4)
+			}
+			if text.String() != want {
+				t.Errorf("%s, %d chunks: text = %q, want %q", format, chunks, text.String(), want)
+			}
+
+			usage := newStreamUsage()
+			extractSSETokens(strings.NewReader(stream), usage)
+			if usage.InputTokens.Load() != 12 || usage.OutputTokens.Load() != 34 || usage.Model.Load() != "sim-model" {
+				t.Errorf("%s: usage %d/%d, model %v", format, usage.InputTokens.Load(), usage.OutputTokens.Load(), usage.Model.Load())
+			}
+		}
+	}
+
+	// The Anthropic stream has its full event sequence; the OpenAI one ends in [DONE]
+	var types []string
+	for _, e := range SimulatedStream("anthropic", "m", "ab", 2, 1, 1) {
+		name, _, _ := strings.Cut(strings.TrimPrefix(e, "event: "), "\n")
+		types = append(types, name)
+	}
+	if got := strings.Join(types, ","); got != "message_start,content_block_start,content_block_delta,content_block_delta,content_block_stop,message_delta,message_stop" {
+		t.Errorf("anthropic events = %s", got)
+	}
+	if events := SimulatedStream("openai", "m", "ab", 2, 1, 1); events[len(events)-1] != "data: [DONE]\n\n" {
+		t.Errorf("openai stream ends with %q", events[len(events)-1])
+	}
+}
+
+func TestSimulator_ErrorRate(t *testing.T) {
+	ResetSimulator()
+	t.Cleanup(ResetSimulator)
+	account := db.Account{ID: "acct-sim", Provider: SimulatorProvider,
+		SimulatorSettings: `{"error_rate":0.5,"error_statuses":[500,529]}`}
+
+	var statuses []int
+	for range 6 {
+		statuses = append(statuses, simulate(t, account, ForwardOptions{Path: "/v1/chat/completions"}).Status)
+	}
+	if got := fmt.Sprint(statuses); got != "[200 500 200 529 200 500]" {
+		t.Errorf("statuses = %s", got)
+	}
+
+	// A failure answers in the account's format
+	ResetSimulator()
+	account.APIFlavor = "anthropic"
+	account.SimulatorSettings = `{"error_rate":1,"error_statuses":[429]}`
+	resp := simulate(t, account, ForwardOptions{Path: "/v1/messages"})
+	body, _ := io.ReadAll(resp.Body)
+	if resp.Status != 429 || resp.Headers["request-id"] == "" || string(body) != `{"error":{"message":"Simulated 429 error","type":"rate_limit_error"},"type":"error"}` {
+		t.Errorf("status %d, headers %v, body %s", resp.Status, resp.Headers, body)
+	}
+}
+
+func TestSimulator_Responses(t *testing.T) {
+	ResetSimulator()
+	t.Cleanup(ResetSimulator)
+	account := db.Account{ID: "acct-sim", Provider: SimulatorProvider,
+		SimulatorSettings: `{"text":"canned","input_tokens":7,"output_tokens":9}`}
+
+	resp := simulate(t, account, ForwardOptions{Path: "/v1/chat/completions"})
+	body, _ := io.ReadAll(resp.Body)
+	if resp.Status != 200 || resp.InputTokens != 7 || resp.OutputTokens != 9 || resp.Model != "claude-sonnet-4-20250514" ||
+		!strings.Contains(string(body), `"content":"canned"`) || !strings.Contains(string(body), `"completion_tokens":9`) {
+		t.Errorf("status %d, usage %d/%d, model %q, body %s", resp.Status, resp.InputTokens, resp.OutputTokens, resp.Model, body)
+	}
+
+	account.APIFlavor = "anthropic"
+	resp = simulate(t, account, ForwardOptions{Path: "/v1/messages", Stream: true})
+	stream, _ := io.ReadAll(resp.Body)
+	if !resp.IsStream || resp.Headers["content-type"] != "text/event-stream" || !strings.Contains(string(stream), "event: message_stop") {
+		t.Fatalf("stream %v, headers %v: %s", resp.IsStream, resp.Headers, stream)
+	}
+	if !resp.Usage.Wait(time.Second) || resp.Usage.InputTokens.Load() != 7 || resp.Usage.OutputTokens.Load() != 9 {
+		t.Errorf("stream usage %d/%d", resp.Usage.InputTokens.Load(), resp.Usage.OutputTokens.Load())
+	}
+
+	resp = simulate(t, account, ForwardOptions{Path: "/v1/messages/count_tokens"})
+	if body, _ := io.ReadAll(resp.Body); string(body) != `{"input_tokens":7}` {
+		t.Errorf("count_tokens = %s", body)
+	}
+
+	account.SimulatorSettings = `{"error_rate":2}`
+	if _, err := Forward(account, ForwardOptions{Path: "/v1/messages"}); err == nil {
+		t.Error("invalid settings accepted")
+	}
+}
+
+func TestSimulator_Latency(t *testing.T) {
+	ResetSimulator()
+	t.Cleanup(ResetSimulator)
+	account := db.Account{ID: "acct-sim", Provider: SimulatorProvider, SimulatorSettings: `{"latency_ms":50}`}
+
+	start := time.Now()
+	simulate(t, account, ForwardOptions{Path: "/v1/chat/completions"})
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("answered after %v, want 50ms", elapsed)
+	}
+
+	// Latency past the timeout fails like a slow upstream
+	_, err := Forward(account, ForwardOptions{Path: "/v1/chat/completions", Body: strings.NewReader(`{}`),
+		Timeouts: Timeouts{Response: 10 * time.Millisecond}})
+	var te *TimeoutError
+	if !errors.As(err, &te) || te.Phase != "response" {
+		t.Errorf("err = %v, want a response timeout", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Forward(account, ForwardOptions{Path: "/v1/chat/completions", Body: strings.NewReader(`{}`), Context: ctx}); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestSimulator_NotWarmed(t *testing.T) {
+	if origin := upstreamOrigin(db.Account{Provider: SimulatorProvider}); origin != "" {
+		t.Errorf("simulator origin = %q", origin)
+	}
+}
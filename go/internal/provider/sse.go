@@ -0,0 +1,118 @@
+package provider
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// readSSE calls onData with the data of each event in a server-sent event
+// stream. Lines may end in \n or \r\n, the space after "data:" is optional,
+// comments and other fields are skipped, and an event's data lines are
+// joined with newlines. Some OpenAI-compatible servers leave out the blank
+// line between events, so a data line that follows complete JSON starts a
+// new event. Lines have no length limit.
+func readSSE(r io.Reader, onData func(data string)) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	var data strings.Builder
+	pending := false
+	dispatch := func() {
+		if pending {
+			onData(data.String())
+		}
+		data.Reset()
+		pending = false
+	}
+
+	for {
+		line, err := br.ReadString('\n')
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		switch {
+		case line == "":
+			dispatch()
+		case strings.HasPrefix(line, ":"):
+			// comment
+		default:
+			field, value, _ := strings.Cut(line, ":")
+			if field != "data" {
+				break
+			}
+			if pending && json.Valid([]byte(data.String())) {
+				dispatch()
+			}
+			if pending {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(value, " "))
+			pending = true
+		}
+		if err != nil {
+			dispatch()
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// extractSSETokens reads token usage from an Anthropic or OpenAI-compatible
+// SSE stream into usage. Anthropic events are told apart by their type;
+// OpenAI-compatible chunks carry a top-level usage object, usually only in
+// the last chunk.
+func extractSSETokens(r io.Reader, usage *TokenUsage) error {
+	return readSSE(r, func(data string) {
+		if data == "[DONE]" {
+			return
+		}
+		var ev map[string]any
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			return
+		}
+
+		switch ev["type"] {
+		case "message_start":
+			if msg, ok := ev["message"].(map[string]any); ok {
+				if m, ok := msg["model"].(string); ok {
+					usage.Model.Store(m)
+				}
+				if u, ok := msg["usage"].(map[string]any); ok {
+					c := parseUsage(u)
+					usage.InputTokens.Store(int64(c.input))
+					usage.CacheReadTokens.Store(int64(c.cacheRead))
+					usage.CacheWriteTokens.Store(int64(c.cacheWrite))
+				}
+			}
+		case "message_delta":
+			// Anthropic only reports output here; GLM sends the final input
+			// and cache counts too, after zeros in message_start
+			if u, ok := ev["usage"].(map[string]any); ok {
+				c := parseUsage(u)
+				usage.OutputTokens.Store(int64(c.output))
+				storeNonZero(&usage.InputTokens, c.input)
+				storeNonZero(&usage.CacheReadTokens, c.cacheRead)
+				storeNonZero(&usage.CacheWriteTokens, c.cacheWrite)
+				storeNonZero(&usage.ReasoningTokens, c.reasoning)
+				// Counters are cumulative; the last delta has the totals
+				if c.serverTools != nil {
+					usage.ServerToolUse.Store(c.serverTools)
+				}
+			}
+		default:
+			if m, ok := ev["model"].(string); ok {
+				usage.Model.Store(m)
+			}
+			if u, ok := ev["usage"].(map[string]any); ok {
+				c := parseUsage(u)
+				usage.InputTokens.Store(int64(c.input))
+				usage.OutputTokens.Store(int64(c.output))
+				usage.CacheReadTokens.Store(int64(c.cacheRead))
+				usage.ReasoningTokens.Store(int64(c.reasoning))
+				if c.cost > 0 {
+					usage.CostUSD.Store(c.cost)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package provider
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadSSE(t *testing.T) {
+	stream := ": keep-alive\r\n" +
+		"event: message_start\r\n" +
+		"data:{\"a\":1}\r\n\r\n" +
+		"data: {\"b\":\r\n" +
+		"data: 2}\n\n" +
+		"data: {\"c\":3}\n" +
+		"data: {\"d\":4}\n" +
+		"data: [DONE]"
+
+	var got []string
+	if err := readSSE(strings.NewReader(stream), func(data string) { got = append(got, data) }); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`{"a":1}`, "{\"b\":\n2}", `{"c":3}`, `{"d":4}`, "[DONE]"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+}
+
+func TestExtractSSETokens(t *testing.T) {
+	type counts struct {
+		input, output, cacheRead, cacheWrite, reasoning int64
+		model                                           string
+	}
+	cases := []struct {
+		name, stream string
+		want         counts
+	}{
+		{"openai", `data: {"id":"c1","model":"o4-mini-2025-04-16","choices":[{"index":0,"delta":{"content":"hi"}}],"usage":null}
+
+data: {"id":"c1","model":"o4-mini-2025-04-16","choices":[{"index":0,"delta":{},"finish_reason":"stop"}],"usage":null}
+
+data: {"id":"c1","model":"o4-mini-2025-04-16","choices":[],"usage":{"prompt_tokens":1200,"completion_tokens":340,"total_tokens":1540,"prompt_tokens_details":{"cached_tokens":1024},"completion_tokens_details":{"reasoning_tokens":256}}}
+
+data: [DONE]
+
+`, counts{1200, 340, 1024, 0, 256, "o4-mini-2025-04-16"}},
+		{"deepseek", `data: {"id":"d1","model":"deepseek-reasoner","choices":[{"index":0,"delta":{"reasoning_content":"hmm"}}]}
+
+data: {"id":"d1","model":"deepseek-reasoner","choices":[{"index":0,"delta":{"content":"4"},"finish_reason":"stop"}],"usage":{"prompt_tokens":30,"completion_tokens":410,"total_tokens":440,"prompt_cache_hit_tokens":16,"prompt_cache_miss_tokens":14,"completion_tokens_details":{"reasoning_tokens":380}}}
+
+data: [DONE]
+
+`, counts{30, 410, 16, 0, 380, "deepseek-reasoner"}},
+		{"anthropic", `event: message_start
+data: {"type":"message_start","message":{"id":"msg_1","model":"claude-sonnet-4-6","usage":{"input_tokens":25,"cache_read_input_tokens":2000,"cache_creation_input_tokens":500,"output_tokens":1}}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"hi"}}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":42}}
+
+event: message_stop
+data: {"type":"message_stop"}
+
+`, counts{25, 42, 2000, 500, 0, "claude-sonnet-4-6"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			usage := &TokenUsage{}
+			if err := extractSSETokens(strings.NewReader(tc.stream), usage); err != nil {
+				t.Fatal(err)
+			}
+			model, _ := usage.Model.Load().(string)
+			got := counts{usage.InputTokens.Load(), usage.OutputTokens.Load(), usage.CacheReadTokens.Load(),
+				usage.CacheWriteTokens.Load(), usage.ReasoningTokens.Load(), model}
+			if got != tc.want {
+				t.Errorf("usage = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package provider
+
+import (
+	"codegate-proxy/internal/metrics"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+const (
+	// idleConnTimeout is how long a pooled upstream connection stays open
+	// without traffic.
+	idleConnTimeout = 90 * time.Second
+	// DefaultConnectTimeout bounds the TCP dial to a provider when
+	// Timeouts.Connect isn't set. The TLS handshake has its own
+	// tlsHandshakeTimeout.
+	DefaultConnectTimeout = 10 * time.Second
+	tlsHandshakeTimeout   = 10 * time.Second
+	// defaultMaxIdleConnsPerHost is the idle connections kept per upstream
+	// host until SetMaxIdleConnsPerHost changes it.
+	defaultMaxIdleConnsPerHost = 16
+)
+
+// upstreamTransport pools the connections of upstreamClient.
+var upstreamTransport = newUpstreamTransport()
+
+// upstreamClient is shared by the forwarders so requests to a provider reuse
+// pooled connections instead of paying a TCP and TLS handshake each time.
+// It has no overall timeout: send bounds each request by its Timeouts, since
+// a stream may rightly run for many minutes.
+var upstreamClient = &http.Client{Transport: upstreamTransport}
+
+func newUpstreamTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	// Anthropic and OpenAI both speak HTTP/2, which multiplexes concurrent
+	// streams over one connection
+	t.ForceAttemptHTTP2 = true
+	t.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	t.IdleConnTimeout = idleConnTimeout
+	t.TLSHandshakeTimeout = tlsHandshakeTimeout
+	t.DialContext = dialUpstream
+	return t
+}
+
+// SetMaxIdleConnsPerHost sets how many idle connections are kept per
+// upstream host, raising the pool's total to match. Call it before the first
+// request is sent.
+func SetMaxIdleConnsPerHost(n int) {
+	if n <= 0 {
+		return
+	}
+	upstreamTransport.MaxIdleConnsPerHost = n
+	if upstreamTransport.MaxIdleConns < n {
+		upstreamTransport.MaxIdleConns = n
+	}
+}
+
+// Timeouts bound an upstream request. Zero fields leave that phase
+// unbounded, except Connect, which falls back to DefaultConnectTimeout.
+type Timeouts struct {
+	// Connect bounds the TCP dial when a new connection is needed
+	Connect time.Duration
+	// Header bounds the wait for a streamed response's headers; the
+	// stream itself may then run as long as it needs
+	Header time.Duration
+	// Response bounds a request that isn't streamed, from sending it to
+	// reading the last byte of its response
+	Response time.Duration
+}
+
+// TimeoutError is returned, possibly wrapped, when an upstream request runs
+// past one of its Timeouts.
+type TimeoutError struct {
+	Phase string // "connect", "response header" or "response"
+	After time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("upstream %s timeout after %v", e.Phase, e.After)
+}
+
+// IsTimeout reports whether err is, or wraps, a TimeoutError.
+func IsTimeout(err error) bool {
+	var te *TimeoutError
+	return errors.As(err, &te)
+}
+
+type connectTimeoutKey struct{}
+
+var upstreamDialer = &net.Dialer{KeepAlive: 30 * time.Second}
+
+// dialUpstream dials with the connect timeout of the request that asked for
+// the connection.
+func dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	timeout, _ := ctx.Value(connectTimeoutKey{}).(time.Duration)
+	if timeout <= 0 {
+		timeout = DefaultConnectTimeout
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := upstreamDialer.DialContext(dialCtx, network, addr)
+	if err != nil && errors.Is(dialCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		return nil, &TimeoutError{Phase: "connect", After: timeout}
+	}
+	return conn, err
+}
+
+// send sends req through upstreamClient under opts.Timeouts. A request the
+// client asked to stream is bounded until its response headers arrive;
+// any other until its body has been read. A body cut short by the timeout
+// returns the TimeoutError from Read. Closing the body releases the
+// request's timer.
+func send(req *http.Request, opts ForwardOptions) (*http.Response, error) {
+	t := opts.Timeouts
+	ctx, cancel := context.WithCancelCause(req.Context())
+	ctx = context.WithValue(ctx, connectTimeoutKey{}, t.Connect)
+
+	limit := &TimeoutError{Phase: "response", After: t.Response}
+	if opts.Stream {
+		limit = &TimeoutError{Phase: "response header", After: t.Header}
+	}
+	var timer *time.Timer
+	if limit.After > 0 {
+		timer = time.AfterFunc(limit.After, func() { cancel(limit) })
+	}
+	release := func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		cancel(nil)
+	}
+
+	resp, err := upstreamClient.Do(req.WithContext(ctx))
+	if err != nil {
+		release()
+		if cause := context.Cause(ctx); cause == limit {
+			return nil, limit
+		}
+		return nil, err
+	}
+	if opts.Stream && timer != nil {
+		timer.Stop()
+	}
+	resp.Body = &timedBody{ReadCloser: resp.Body, ctx: ctx, limit: limit, release: release}
+	return resp, nil
+}
+
+// timedBody is a response body read under send's timer.
+type timedBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	limit   *TimeoutError
+	release func()
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && context.Cause(b.ctx) == b.limit {
+		err = b.limit
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// traceConnection counts whether req got a pooled connection or had to
+// open a new one, per upstream host.
+func traceConnection(req *http.Request) *http.Request {
+	host := req.URL.Host
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			reused := "false"
+			if info.Reused {
+				reused = "true"
+			}
+			metrics.Inc("codegate_upstream_connections_total", "host", host, "reused", reused)
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
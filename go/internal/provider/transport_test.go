@@ -0,0 +1,131 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowServer answers after headerDelay with headers, then after bodyDelay
+// with the body, as an SSE stream when stream is set.
+func slowServer(t *testing.T, headerDelay, bodyDelay time.Duration, stream bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		wait := func(d time.Duration) bool {
+			select {
+			case <-time.After(d):
+				return true
+			case <-r.Context().Done():
+				return false
+			}
+		}
+		if !wait(headerDelay) {
+			return
+		}
+		if stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		if !wait(bodyDelay) {
+			return
+		}
+		if stream {
+			fmt.Fprint(w, "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+		} else {
+			fmt.Fprint(w, `{"usage":{"input_tokens":1,"output_tokens":1}}`)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func forwardSlow(srv *httptest.Server, stream bool, timeouts Timeouts) (*Response, error) {
+	return ForwardAnthropic(ForwardOptions{
+		Path:     "/v1/messages",
+		Method:   "POST",
+		Body:     strings.NewReader(`{}`),
+		APIKey:   "key",
+		BaseURL:  srv.URL,
+		Stream:   stream,
+		Timeouts: timeouts,
+	})
+}
+
+func TestSend_Timeouts(t *testing.T) {
+	const slow = 300 * time.Millisecond
+	short := 50 * time.Millisecond
+
+	cases := []struct {
+		name                   string
+		headerDelay, bodyDelay time.Duration
+		stream                 bool
+		timeouts               Timeouts
+		wantPhase              string // "" for success
+	}{
+		{"non-stream slow headers", slow, 0, false, Timeouts{Response: short}, "response"},
+		{"non-stream slow body", 0, slow, false, Timeouts{Response: short}, "response"},
+		{"non-stream within limit", 0, 0, false, Timeouts{Response: slow}, ""},
+		{"stream slow headers", slow, 0, true, Timeouts{Header: short}, "response header"},
+		// A stream is bounded only until its headers arrive
+		{"stream slow body", 0, slow, true, Timeouts{Header: short, Response: short}, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := slowServer(t, tc.headerDelay, tc.bodyDelay, tc.stream)
+			resp, err := forwardSlow(srv, tc.stream, tc.timeouts)
+			if err == nil && resp.IsStream {
+				_, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			if tc.wantPhase == "" {
+				if err != nil {
+					t.Fatalf("err = %v, want none", err)
+				}
+				return
+			}
+			var te *TimeoutError
+			if !errors.As(err, &te) || te.Phase != tc.wantPhase {
+				t.Fatalf("err = %v, want a %s timeout", err, tc.wantPhase)
+			}
+			if !IsTimeout(err) {
+				t.Errorf("IsTimeout(%v) = false", err)
+			}
+		})
+	}
+}
+
+func TestSend_ConnectTimeout(t *testing.T) {
+	// A fresh server, so the dial can't be skipped with a pooled connection;
+	// the timeout is over before the dial starts
+	srv := slowServer(t, 0, 0, false)
+	_, err := forwardSlow(srv, false, Timeouts{Connect: time.Nanosecond})
+	var te *TimeoutError
+	if !errors.As(err, &te) || te.Phase != "connect" {
+		t.Fatalf("err = %v, want a connect timeout", err)
+	}
+}
+
+func TestSetMaxIdleConnsPerHost(t *testing.T) {
+	perHost, total := upstreamTransport.MaxIdleConnsPerHost, upstreamTransport.MaxIdleConns
+	t.Cleanup(func() {
+		upstreamTransport.MaxIdleConnsPerHost, upstreamTransport.MaxIdleConns = perHost, total
+	})
+
+	SetMaxIdleConnsPerHost(0)
+	if upstreamTransport.MaxIdleConnsPerHost != defaultMaxIdleConnsPerHost {
+		t.Errorf("0 changed the per-host pool to %d", upstreamTransport.MaxIdleConnsPerHost)
+	}
+	SetMaxIdleConnsPerHost(total + 50)
+	if upstreamTransport.MaxIdleConnsPerHost != total+50 || upstreamTransport.MaxIdleConns < total+50 {
+		t.Errorf("pool = %d per host, %d total; want %d per host", upstreamTransport.MaxIdleConnsPerHost, upstreamTransport.MaxIdleConns, total+50)
+	}
+}
@@ -1,8 +1,10 @@
 package provider
 
 import (
+	"context"
 	"io"
 	"sync/atomic"
+	"time"
 )
 
 // TokenUsage tracks token counts, populated asynchronously for streams.
@@ -11,7 +13,49 @@ type TokenUsage struct {
 	OutputTokens     atomic.Int64
 	CacheReadTokens  atomic.Int64
 	CacheWriteTokens atomic.Int64
+	ReasoningTokens  atomic.Int64
 	Model            atomic.Value // string
+	ServerToolUse    atomic.Value // map[string]int
+	CostUSD          atomic.Value // float64
+
+	done chan struct{} // closed once a stream's usage has been read; nil when not a stream
+}
+
+// newStreamUsage returns the TokenUsage for a stream. The goroutine reading
+// the stream calls finish when it is done.
+func newStreamUsage() *TokenUsage {
+	return &TokenUsage{done: make(chan struct{})}
+}
+
+func (u *TokenUsage) finish() {
+	close(u.done)
+}
+
+// Wait blocks until the stream's usage has been read to the end, or timeout
+// passes, and reports whether the counts are final. The reader finishes when
+// the upstream body ends or the response body is closed.
+func (u *TokenUsage) Wait(timeout time.Duration) bool {
+	if u.done == nil {
+		return true
+	}
+	select {
+	case <-u.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// ServerTools returns the server tool request counts seen in the stream.
+func (u *TokenUsage) ServerTools() map[string]int {
+	m, _ := u.ServerToolUse.Load().(map[string]int)
+	return m
+}
+
+// Cost returns the cost the provider reported in the stream, or 0.
+func (u *TokenUsage) Cost() float64 {
+	c, _ := u.CostUSD.Load().(float64)
+	return c
 }
 
 // Response represents a response from an LLM provider.
@@ -29,6 +73,18 @@ type Response struct {
 	CacheWriteTokens int
 	Model            string
 
+	// ReasoningTokens are the output tokens spent on reasoning, as OpenAI
+	// and DeepSeek report them. They are already part of OutputTokens.
+	ReasoningTokens int
+
+	// ServerToolUse counts server-side tool requests billed per use (e.g.
+	// Anthropic web_search_requests), keyed by the usage.server_tool_use field.
+	ServerToolUse map[string]int
+
+	// CostUSD is the cost the provider reported for the request (OpenRouter
+	// with usage accounting), or 0 when it doesn't report one.
+	CostUSD float64
+
 	// Usage is populated asynchronously for streaming responses.
 	Usage *TokenUsage
 }
@@ -38,9 +94,19 @@ type ForwardOptions struct {
 	Path              string
 	Method            string
 	Headers           map[string]string
-	Body              string
+	ClientHeaders     map[string]string // client identification headers to pass through; provider headers win
+	Body              io.Reader
+	BodyLength        int64 // Content-Length; needed when Body isn't a bytes/strings reader
 	APIKey            string
 	BaseURL           string
 	AuthType          string
 	ExternalAccountID string
+	Hop               int    // loop-detection hop count to send to a CodeGate base URL; 0 omits the hop header
+	RequestID         string // the proxy's request ID, sent as X-Request-Id; "" omits it
+	// Context cancels the request, and reading its response; nil for none
+	Context context.Context
+	// Stream is set when the client asked for a streamed response, so only
+	// Timeouts.Header applies and the stream has no overall deadline
+	Stream   bool
+	Timeouts Timeouts
 }
@@ -0,0 +1,74 @@
+package provider
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var versionPathRe = regexp.MustCompile(`/v\d+$`)
+
+const geminiHost = "generativelanguage.googleapis.com"
+
+// buildURL joins a provider base URL and a request path. Rules:
+//   - the base path is kept, so gateways mounted under a prefix work
+//   - a base ending in a version segment (/v1, /v4, ...) replaces the
+//     request's leading /v1 instead of doubling it
+//   - Gemini bases get the /v1beta/openai compatibility prefix unless they
+//     already include it
+//   - query strings on the base and on the path are both kept
+//
+// An empty baseURL uses defaultBase.
+func buildURL(baseURL, defaultBase, path string) (string, error) {
+	base := defaultBase
+	if baseURL != "" {
+		base = baseURL
+	}
+
+	parsed, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("invalid base_url %q: %w", base, err)
+	}
+	if parsed.Scheme == "" || parsed.Host == "" {
+		return "", fmt.Errorf("invalid base_url %q: scheme and host are required", base)
+	}
+
+	reqPath, reqQuery, _ := strings.Cut(path, "?")
+	basePath := strings.TrimRight(parsed.Path, "/")
+
+	if parsed.Hostname() == geminiHost {
+		switch {
+		case strings.HasSuffix(basePath, "/openai"):
+		case strings.HasSuffix(basePath, "/v1beta"):
+			basePath += "/openai"
+		default:
+			basePath += "/v1beta/openai"
+		}
+		reqPath = stripV1(reqPath)
+	} else if versionPathRe.MatchString(basePath) {
+		reqPath = stripV1(reqPath)
+	}
+
+	u := url.URL{Scheme: parsed.Scheme, User: parsed.User, Host: parsed.Host, Path: basePath + reqPath}
+	switch {
+	case parsed.RawQuery != "" && reqQuery != "":
+		u.RawQuery = parsed.RawQuery + "&" + reqQuery
+	case parsed.RawQuery != "":
+		u.RawQuery = parsed.RawQuery
+	default:
+		u.RawQuery = reqQuery
+	}
+	return u.String(), nil
+}
+
+// stripV1 drops a leading /v1 segment from a request path.
+func stripV1(path string) string {
+	if path == "/v1" {
+		return ""
+	}
+	if strings.HasPrefix(path, "/v1/") {
+		return path[len("/v1"):]
+	}
+	return path
+}
@@ -0,0 +1,70 @@
+package provider
+
+import "testing"
+
+func TestBuildURL(t *testing.T) {
+	tests := []struct {
+		name, base, def, path, want string
+	}{
+		// Defaults
+		{"anthropic default", "", anthropicDefaultBase, "/v1/messages", "https://api.anthropic.com/v1/messages"},
+		{"openai default", "", openaiDefaultBase, "/v1/chat/completions", "https://api.openai.com/v1/chat/completions"},
+		{"codex default", "", "https://chatgpt.com/backend-api/codex", "/responses", "https://chatgpt.com/backend-api/codex/responses"},
+
+		// Trailing slashes
+		{"host only", "https://api.deepseek.com", openaiDefaultBase, "/v1/chat/completions", "https://api.deepseek.com/v1/chat/completions"},
+		{"host trailing slash", "https://api.deepseek.com/", openaiDefaultBase, "/v1/chat/completions", "https://api.deepseek.com/v1/chat/completions"},
+		{"version trailing slash", "https://api.openai.com/v1/", openaiDefaultBase, "/v1/chat/completions", "https://api.openai.com/v1/chat/completions"},
+
+		// Version-suffixed bases replace the request's /v1
+		{"openai v1 base", "https://api.openai.com/v1", openaiDefaultBase, "/v1/chat/completions", "https://api.openai.com/v1/chat/completions"},
+		{"glm v4 base", "https://api.z.ai/api/paas/v4", openaiDefaultBase, "/v1/chat/completions", "https://api.z.ai/api/paas/v4/chat/completions"},
+		{"anthropic v1 base", "https://api.anthropic.com/v1", anthropicDefaultBase, "/v1/messages", "https://api.anthropic.com/v1/messages"},
+		{"anthropic v1 base count_tokens", "https://api.anthropic.com/v1", anthropicDefaultBase, "/v1/messages/count_tokens", "https://api.anthropic.com/v1/messages/count_tokens"},
+		{"version base bare v1 path", "https://api.openai.com/v1", openaiDefaultBase, "/v1", "https://api.openai.com/v1"},
+		{"version base unversioned path", "https://api.openai.com/v1", openaiDefaultBase, "/models", "https://api.openai.com/v1/models"},
+
+		// Path-prefixed gateways
+		{"openai gateway", "https://gateway.internal/llm/openai/v1", openaiDefaultBase, "/v1/chat/completions", "https://gateway.internal/llm/openai/v1/chat/completions"},
+		{"anthropic gateway", "https://gateway.internal/llm/anthropic/v1", anthropicDefaultBase, "/v1/messages", "https://gateway.internal/llm/anthropic/v1/messages"},
+		{"openai gateway no version", "https://gateway.internal/llm/openai", openaiDefaultBase, "/v1/chat/completions", "https://gateway.internal/llm/openai/v1/chat/completions"},
+		{"anthropic gateway no version", "https://api.z.ai/api/anthropic", anthropicDefaultBase, "/v1/messages", "https://api.z.ai/api/anthropic/v1/messages"},
+		{"gateway with port", "http://localhost:8080/proxy/", openaiDefaultBase, "/v1/chat/completions", "http://localhost:8080/proxy/v1/chat/completions"},
+		{"version-like segment mid-path", "https://gw.example.com/v2/tenant", openaiDefaultBase, "/v1/chat/completions", "https://gw.example.com/v2/tenant/v1/chat/completions"},
+
+		// Gemini
+		{"gemini host", "https://generativelanguage.googleapis.com", openaiDefaultBase, "/v1/chat/completions", "https://generativelanguage.googleapis.com/v1beta/openai/chat/completions"},
+		{"gemini trailing slash", "https://generativelanguage.googleapis.com/", openaiDefaultBase, "/v1/chat/completions", "https://generativelanguage.googleapis.com/v1beta/openai/chat/completions"},
+		{"gemini v1beta", "https://generativelanguage.googleapis.com/v1beta", openaiDefaultBase, "/v1/chat/completions", "https://generativelanguage.googleapis.com/v1beta/openai/chat/completions"},
+		{"gemini full", "https://generativelanguage.googleapis.com/v1beta/openai/", openaiDefaultBase, "/v1/chat/completions", "https://generativelanguage.googleapis.com/v1beta/openai/chat/completions"},
+
+		// Query strings
+		{"base query", "https://gw.example.com/openai/v1?api-version=2024-06-01", openaiDefaultBase, "/v1/chat/completions", "https://gw.example.com/openai/v1/chat/completions?api-version=2024-06-01"},
+		{"path query", "", anthropicDefaultBase, "/v1/messages?beta=true", "https://api.anthropic.com/v1/messages?beta=true"},
+		{"both queries", "https://gw.example.com/v1?key=abc", anthropicDefaultBase, "/v1/messages?beta=true", "https://gw.example.com/v1/messages?key=abc&beta=true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildURL(tt.base, tt.def, tt.path)
+			if err != nil {
+				t.Fatalf("buildURL: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("buildURL(%q, %q) = %q, want %q", tt.base, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildURL_Invalid(t *testing.T) {
+	for _, base := range []string{
+		"api.openai.com/v1",
+		"localhost:8080",
+		"https://",
+		"http://[::1",
+	} {
+		if got, err := buildURL(base, openaiDefaultBase, "/v1/chat/completions"); err == nil {
+			t.Errorf("buildURL(%q) = %q, want error", base, got)
+		}
+	}
+}
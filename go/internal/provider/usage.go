@@ -0,0 +1,78 @@
+package provider
+
+// usageCounts holds token counts read from a response's usage object.
+type usageCounts struct {
+	input, output, cacheRead, cacheWrite int
+	reasoning                            int // already counted in output
+	serverTools                          map[string]int
+	cost                                 float64 // USD the provider billed, if it says (OpenRouter's usage.cost)
+}
+
+// parseUsage reads token counts from either naming scheme. Anthropic-compatible
+// endpoints that aren't Anthropic (GLM's /api/anthropic in particular) mix the
+// two: they may report prompt_tokens/completion_tokens in a Messages response,
+// or OpenAI-style prompt_tokens_details.cached_tokens for cache hits.
+// OpenRouter's native counts, from the upstream model's own tokenizer, are
+// what it bills and win when present. DeepSeek reports cache hits as
+// prompt_cache_hit_tokens; reasoning models report their reasoning tokens in
+// completion_tokens_details.
+func parseUsage(u map[string]any) usageCounts {
+	c := usageCounts{
+		input:      firstInt(u, "native_tokens_prompt", "input_tokens", "prompt_tokens"),
+		output:     firstInt(u, "native_tokens_completion", "output_tokens", "completion_tokens"),
+		cacheRead:  firstInt(u, "cache_read_input_tokens", "cached_tokens", "prompt_cache_hit_tokens"),
+		cacheWrite: intFromAny(u["cache_creation_input_tokens"]),
+	}
+	if c.cacheRead == 0 {
+		if d, ok := u["prompt_tokens_details"].(map[string]any); ok {
+			c.cacheRead = intFromAny(d["cached_tokens"])
+		}
+	}
+	if d, ok := u["completion_tokens_details"].(map[string]any); ok {
+		c.reasoning = intFromAny(d["reasoning_tokens"])
+	}
+	if c.reasoning == 0 {
+		c.reasoning = intFromAny(u["reasoning_tokens"])
+	}
+	c.serverTools = parseServerToolUse(u["server_tool_use"])
+	c.cost, _ = u["cost"].(float64)
+	return c
+}
+
+// parseServerToolUse reads every numeric counter in usage.server_tool_use
+// (web_search_requests today; Anthropic adds counters as it adds tools).
+func parseServerToolUse(v any) map[string]int {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil
+	}
+	var counts map[string]int
+	for k, raw := range m {
+		if n := intFromAny(raw); n > 0 {
+			if counts == nil {
+				counts = make(map[string]int)
+			}
+			counts[k] = n
+		}
+	}
+	return counts
+}
+
+// firstInt returns the first non-zero integer among keys.
+func firstInt(m map[string]any, keys ...string) int {
+	for _, k := range keys {
+		if n := intFromAny(m[k]); n != 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+// storeNonZero sets v to n unless n is zero. Streams report usage in several
+// events and some providers send zeros in the later ones for fields they
+// already reported.
+func storeNonZero(v interface{ Store(int64) }, n int) {
+	if n != 0 {
+		v.Store(int64(n))
+	}
+}
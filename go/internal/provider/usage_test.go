@@ -0,0 +1,85 @@
+package provider
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseUsage_ServerTools(t *testing.T) {
+	u := map[string]any{"input_tokens": 10.0,
+		"server_tool_use": map[string]any{"web_search_requests": 3.0, "web_fetch_requests": 0.0}}
+	want := usageCounts{input: 10, serverTools: map[string]int{"web_search_requests": 3}}
+	if got := parseUsage(u); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseUsage = %+v, want %+v", got, want)
+	}
+}
+
+func TestForwardAnthropic_ServerToolUse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"msg_1","type":"message","model":"claude-sonnet-4-6","content":[],`+
+			`"usage":{"input_tokens":2100,"output_tokens":300,"server_tool_use":{"web_search_requests":2}}}`)
+	}))
+	defer srv.Close()
+
+	resp, err := ForwardAnthropic(ForwardOptions{Path: "/v1/messages", Method: "POST",
+		Body: strings.NewReader(`{}`), APIKey: "k", BaseURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.ServerToolUse["web_search_requests"]; got != 2 {
+		t.Errorf("web_search_requests = %d, want 2", got)
+	}
+}
+
+func TestExtractAnthropicSSETokens_ServerToolUse(t *testing.T) {
+	stream := `data: {"type":"message_start","message":{"usage":{"input_tokens":50}}}` + "\n" +
+		`data: {"type":"message_delta","usage":{"output_tokens":7,"server_tool_use":{"web_search_requests":1}}}` + "\n" +
+		`data: {"type":"message_delta","usage":{"output_tokens":90,"server_tool_use":{"web_search_requests":3}}}` + "\n"
+
+	usage := &TokenUsage{}
+	extractSSETokens(strings.NewReader(stream), usage)
+
+	if got := usage.ServerTools()["web_search_requests"]; got != 3 {
+		t.Errorf("web_search_requests = %d, want 3 (cumulative)", got)
+	}
+}
+
+func TestTokenUsage_WaitForStream(t *testing.T) {
+	if !(&TokenUsage{}).Wait(0) {
+		t.Error("Wait on non-stream usage should report final counts")
+	}
+
+	more := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, `data: {"type":"message_start","message":{"usage":{"input_tokens":50}}}`+"\n\n")
+		w.(http.Flusher).Flush()
+		<-more // stalled upstream
+		io.WriteString(w, `data: {"type":"message_delta","usage":{"output_tokens":7}}`+"\n\n")
+	}))
+	defer srv.Close()
+
+	resp, err := ForwardAnthropic(ForwardOptions{Path: "/v1/messages", Method: "POST",
+		Body: strings.NewReader(`{}`), APIKey: "k", BaseURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Read(make([]byte, 256))
+	resp.Body.Close() // client went away
+	if resp.Usage.Wait(50 * time.Millisecond) {
+		t.Fatal("Wait returned final counts while the upstream was stalled")
+	}
+	close(more)
+	if !resp.Usage.Wait(2 * time.Second) {
+		t.Fatal("usage reader did not finish after the upstream resumed")
+	}
+	if got := resp.Usage.InputTokens.Load(); got != 50 {
+		t.Errorf("input = %d, want 50", got)
+	}
+}
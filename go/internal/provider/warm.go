@@ -0,0 +1,106 @@
+package provider
+
+import (
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/run"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// warmTimeout bounds each warm-up request.
+const warmTimeout = 5 * time.Second
+
+// ConnectionWarmer opens pooled connections to every enabled account's
+// upstream when warm_connections=true, at start and again each time idle
+// connections would have expired, so first requests skip the handshakes.
+var ConnectionWarmer = run.Every(idleConnTimeout, warmIfEnabled)
+
+func warmIfEnabled(ctx context.Context) {
+	if db.GetSetting("warm_connections") != "true" {
+		return
+	}
+	accounts, err := db.GetEnabledAccounts()
+	if err != nil {
+		log.Printf("[warmup] Failed to get accounts: %v", err)
+		return
+	}
+	WarmConnections(ctx, accounts)
+}
+
+// WarmConnections sends a HEAD request to each distinct upstream origin
+// among accounts and returns how many answered. The requests carry no
+// credentials and bypass the handler, so they don't count toward rate
+// limits or usage.
+func WarmConnections(ctx context.Context, accounts []db.Account) int {
+	origins := make(map[string]bool)
+	for _, a := range accounts {
+		if origin := upstreamOrigin(a); origin != "" {
+			origins[origin] = true
+		}
+	}
+
+	var wg sync.WaitGroup
+	var warmed atomic.Int32
+	for origin := range origins {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := warm(ctx, origin); err != nil {
+				log.Printf("[warmup] %s: %v", origin, err)
+				return
+			}
+			warmed.Add(1)
+		}()
+	}
+	wg.Wait()
+	return int(warmed.Load())
+}
+
+func warm(ctx context.Context, origin string) error {
+	ctx, cancel := context.WithTimeout(ctx, warmTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, origin+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := upstreamClient.Do(traceConnection(req))
+	if err != nil {
+		return err
+	}
+	// Drain so the connection goes back to the pool
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return nil
+}
+
+// upstreamOrigin returns the scheme and host Forward sends an account's
+// requests to, or "" if its base URL doesn't parse or it has no upstream.
+func upstreamOrigin(a db.Account) string {
+	if a.Provider == SimulatorProvider {
+		return ""
+	}
+	base := a.BaseURL
+	if base == "" {
+		// Mirror Forward: which forwarder the account goes to, then that
+		// forwarder's default base
+		switch {
+		case a.SpeaksAnthropic() && !isCodexAccount(a):
+			base = anthropicDefaultBase
+		case usesCodexBackend(a.ExternalAccountID, a.BaseURL):
+			base = codexDefaultBase
+		default:
+			base = openaiDefaultBase
+		}
+	}
+	u, err := url.Parse(base)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
@@ -0,0 +1,118 @@
+package provider
+
+import (
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/metrics"
+	"codegate-proxy/internal/ratelimit"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnectionWarmer_WarmsAtStart(t *testing.T) {
+	tdb := dbtest.Open(t)
+	metrics.Reset()
+	tdb.SetSetting("warm_connections", "true")
+
+	var heads, other atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && r.URL.Path == "/" && r.Header.Get("X-Api-Key") == "" {
+			heads.Add(1)
+			return
+		}
+		other.Add(1)
+	})
+	a := httptest.NewServer(handler)
+	defer a.Close()
+	b := httptest.NewServer(handler)
+	defer b.Close()
+	tdb.AddAccount("acct-a", "alpha", "anthropic", a.URL+"/v1")
+	tdb.AddAccount("acct-a2", "alpha two", "anthropic", a.URL)
+	tdb.AddAccount("acct-b", "bravo", "openrouter", b.URL+"/api/v1")
+
+	ConnectionWarmer.Start(context.Background())
+	defer ConnectionWarmer.Stop()
+	deadline := time.Now().Add(2 * time.Second)
+	for heads.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if heads.Load() != 2 || other.Load() != 0 {
+		t.Fatalf("warm-up requests = %d (other %d), want one HEAD per upstream", heads.Load(), other.Load())
+	}
+
+	for _, id := range []string{"acct-a", "acct-a2", "acct-b"} {
+		if ratelimit.IsRateLimited(id, 1) {
+			t.Errorf("warm-up counted toward %s's rate limit", id)
+		}
+	}
+
+	// The next request rides the warmed connection
+	host := strings.TrimPrefix(a.URL, "http://")
+	if _, err := ForwardAnthropic(ForwardOptions{Path: "/v1/messages", Method: "POST", Body: strings.NewReader("{}"), BaseURL: a.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if n := metrics.Counter("codegate_upstream_connections_total", "host", host, "reused", "true"); n != 1 {
+		t.Errorf("reused connections = %d, want 1", n)
+	}
+	if n := metrics.Counter("codegate_upstream_connections_total", "host", host, "reused", "false"); n != 1 {
+		t.Errorf("new connections = %d, want only the warm-up's", n)
+	}
+}
+
+func TestWarmIfEnabled_Off(t *testing.T) {
+	tdb := dbtest.Open(t)
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits.Add(1) }))
+	defer srv.Close()
+	tdb.AddAccount("acct-a", "alpha", "anthropic", srv.URL)
+
+	warmIfEnabled(context.Background())
+	if hits.Load() != 0 {
+		t.Errorf("warm-up ran without warm_connections=true")
+	}
+}
+
+func TestUpstreamOrigin(t *testing.T) {
+	cases := []struct {
+		account db.Account
+		want    string
+	}{
+		{db.Account{Provider: "anthropic"}, anthropicDefaultBase},
+		{db.Account{Provider: "glm", APIFlavor: "anthropic", BaseURL: "https://api.z.ai/api/anthropic"}, "https://api.z.ai"},
+		{db.Account{Provider: "openai"}, openaiDefaultBase},
+		{db.Account{Provider: "openai", AuthType: "oauth", ExternalAccountID: "acct"}, "https://chatgpt.com"},
+		// ForwardOpenAI picks the Codex backend from the account ID alone
+		{db.Account{Provider: "openrouter", ExternalAccountID: "acct"}, "https://chatgpt.com"},
+		{db.Account{Provider: "custom", BaseURL: "localhost:8080"}, ""},
+	}
+	for _, c := range cases {
+		if got := upstreamOrigin(c.account); got != c.want {
+			t.Errorf("upstreamOrigin(%+v) = %q, want %q", c.account, got, c.want)
+		}
+	}
+}
+
+func TestUpstreamTransport_HTTP2(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	// A custom TLS config turns off HTTP/2 unless ForceAttemptHTTP2 is set
+	tr := newUpstreamTransport()
+	tr.TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig
+	resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("protocol = %s, want HTTP/2", resp.Proto)
+	}
+}
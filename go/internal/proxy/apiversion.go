@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/provider"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// knownAnthropicVersions reads anthropic_versions, the comma-separated
+// anthropic-version values clients may send without a warning. It defaults
+// to the version the converters are written against.
+func knownAnthropicVersions(getSetting func(string) string) []string {
+	if known := splitBetas(getSetting("anthropic_versions")); len(known) > 0 {
+		return known
+	}
+	return []string{provider.AnthropicVersion}
+}
+
+// anthropicVersionWarning returns a warning when the client asked for an
+// anthropic-version outside known. The header is still forwarded; responses
+// in a newer shape may not convert cleanly.
+func anthropicVersionWarning(requested string, known []string) string {
+	if requested == "" || slices.Contains(known, requested) {
+		return ""
+	}
+	return fmt.Sprintf("anthropic-version %s is not in anthropic_versions (%s)", requested, strings.Join(known, ", "))
+}
+
+// candidateVersion returns the request headers to forward to one account,
+// with anthropic-version replaced by the account's override if it has one.
+func candidateVersion(headers map[string]string, account db.Account) map[string]string {
+	if account.AnthropicVersion == "" || !account.SpeaksAnthropic() || headers["anthropic-version"] == account.AnthropicVersion {
+		return headers
+	}
+	out := maps.Clone(headers)
+	out["anthropic-version"] = account.AnthropicVersion
+	return out
+}
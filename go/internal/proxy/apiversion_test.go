@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/provider"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// versionUpstream records the anthropic-version of each request it serves.
+func versionUpstream(t *testing.T, got *string) *httptest.Server {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*got = r.Header.Get("Anthropic-Version")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestAnthropicVersion_Passthrough(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("request_logging", "true")
+	var got string
+	tdb.AddAccount("acct-version", "version", "anthropic", versionUpstream(t, &got).URL)
+
+	w := sendMessages(t, plainMessage, http.Header{"Anthropic-Version": {"2023-06-01"}})
+	if w.Code != 200 || got != "2023-06-01" {
+		t.Fatalf("status %d, upstream got anthropic-version %q", w.Code, got)
+	}
+	if warnings := w.Header().Get(conversionWarningsHeader); warnings != "" {
+		t.Errorf("%s = %q", conversionWarningsHeader, warnings)
+	}
+	var logged sql.NullString
+	waitFor(t, func() bool {
+		return tdb.QueryRow("SELECT anthropic_version FROM request_logs").Scan(&logged) == nil
+	})
+	if logged.String != "2023-06-01" {
+		t.Errorf("logged anthropic_version = %q", logged.String)
+	}
+
+	// OpenAI clients don't send one; converted requests get the default
+	w = httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"model":"claude-sonnet-4-20250514","messages":[{"role":"user","content":"hi"}]}`)))
+	if w.Code != 200 || got != provider.AnthropicVersion {
+		t.Errorf("openai inbound: status %d, upstream got anthropic-version %q", w.Code, got)
+	}
+}
+
+func TestAnthropicVersion_UnknownVersionWarns(t *testing.T) {
+	tdb := dbtest.Open(t)
+	var got string
+	tdb.AddAccount("acct-version-new", "version", "anthropic", versionUpstream(t, &got).URL)
+
+	header := http.Header{"Anthropic-Version": {"2099-01-01"}}
+	w := sendMessages(t, plainMessage, header)
+	if w.Code != 200 || got != "2099-01-01" {
+		t.Fatalf("status %d, upstream got anthropic-version %q", w.Code, got)
+	}
+	if warnings := w.Header().Get(conversionWarningsHeader); warnings != "anthropic-version 2099-01-01 is not in anthropic_versions (2023-06-01)" {
+		t.Errorf("%s = %q", conversionWarningsHeader, warnings)
+	}
+
+	tdb.SetSetting("anthropic_versions", "2023-06-01, 2099-01-01")
+	if w := sendMessages(t, plainMessage, header); w.Header().Get(conversionWarningsHeader) != "" {
+		t.Errorf("listed version warned: %q", w.Header().Get(conversionWarningsHeader))
+	}
+}
+
+func TestAnthropicVersion_AccountOverride(t *testing.T) {
+	tdb := dbtest.Open(t)
+	var got string
+	tdb.AddAccount("acct-version-pinned", "gateway", "anthropic", versionUpstream(t, &got).URL)
+	tdb.Exec("UPDATE accounts SET anthropic_version = '2023-01-01' WHERE id = 'acct-version-pinned'")
+
+	for _, header := range []http.Header{nil, {"Anthropic-Version": {"2023-06-01"}}} {
+		if w := sendMessages(t, plainMessage, header); w.Code != 200 || got != "2023-01-01" {
+			t.Errorf("client version %q: status %d, upstream got %q", header.Get("Anthropic-Version"), w.Code, got)
+		}
+	}
+}
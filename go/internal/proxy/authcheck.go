@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/guardrails"
+	"codegate-proxy/internal/models"
+	"codegate-proxy/internal/ratelimit"
+	"codegate-proxy/internal/routing"
+	"codegate-proxy/internal/tenant"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+)
+
+// authCheck is what GET /v1/auth/check tells a caller about its own key.
+type authCheck struct {
+	Key        string          `json:"key"` // "global", "tenant", or "none" on an open proxy
+	Tenant     string          `json:"tenant,omitempty"`
+	KeyLabel   string          `json:"key_label,omitempty"`
+	Config     string          `json:"config,omitempty"`
+	Models     []string        `json:"models"`
+	Tiers      []authCheckTier `json:"tiers"`
+	Guardrails bool            `json:"guardrails"`
+	RateLimit  *rateHeadroom   `json:"rate_limit,omitempty"` // only for tenants with a limit
+}
+
+// authCheckTier says whether requests for a tier can be routed right now.
+// Rows are counted, never named, so no account details leave the proxy.
+type authCheckTier struct {
+	Tier      string `json:"tier"`
+	Available bool   `json:"available"`
+	Routes    int    `json:"routes"` // accounts a request would be tried on
+
+	// Unavailable counts rows left out by reason, such as
+	// monthly_budget_exceeded or rate_limited
+	Unavailable map[string]int `json:"unavailable,omitempty"`
+
+	// Budget is what is left of the routes' budgets; omitted when they
+	// have none
+	Budget *budgetHeadroom `json:"budget,omitempty"`
+}
+
+// rateHeadroom is a tenant's per-minute rate limit and what is left of it.
+// Remaining is omitted for a limit that isn't set.
+type rateHeadroom struct {
+	Limit               int  `json:"limit"`
+	Remaining           *int `json:"remaining,omitempty"`
+	BackgroundLimit     int  `json:"background_limit"`
+	BackgroundRemaining *int `json:"background_remaining,omitempty"`
+}
+
+// budgetHeadroom is what is left of the budgets of the accounts a tier's
+// requests can be routed to, summed in USD. A total is omitted when one of
+// those accounts has no budget of that kind.
+type budgetHeadroom struct {
+	MonthlyRemainingUSD *float64 `json:"monthly_remaining_usd,omitempty"`
+	DailyRemainingUSD   *float64 `json:"daily_remaining_usd,omitempty"`
+}
+
+// handleAuthCheck lets a caller check its API key: GET /v1/auth/check,
+// authenticated like a proxied request. It reports the key's tenant, the
+// config routing uses for it, the models and tiers it can reach, whether
+// guardrails apply, and its rate limit and budget headroom. Nothing is sent
+// to a provider and no rate limit slot is used.
+func handleAuthCheck(w http.ResponseWriter, r *http.Request) {
+	t, adminKey, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	check := authCheck{Key: "none", Models: []string{}, Tiers: []authCheckTier{}}
+	getSetting := db.GetSetting
+	configID := ""
+	switch {
+	case adminKey:
+		check.Key = "global"
+	case t != nil:
+		check.Key, check.Tenant, check.KeyLabel = "tenant", t.Name, t.KeyLabel
+		getSetting = func(key string) string { return tenant.GetSetting(t, key) }
+		configID = t.ConfigID
+		check.RateLimit = tenantHeadroom(t)
+	}
+	check.Guardrails = guardrails.IsGuardrailsEnabledWith(getSetting)
+
+	list, err := modelList(configID)
+	if err != nil {
+		log.Printf("[auth-check] Failed to list models: %v", err)
+		writeError(w, r, "anthropic", 500, "api_error", "Failed to list models")
+		return
+	}
+	for _, m := range list {
+		check.Models = append(check.Models, m.ID)
+	}
+
+	accounts, err := db.GetEnabledAccounts()
+	if err != nil {
+		log.Printf("[auth-check] Failed to load accounts: %v", err)
+		writeError(w, r, "anthropic", 500, "api_error", "Failed to resolve route")
+		return
+	}
+	for _, tier := range []models.Tier{models.TierOpus, models.TierSonnet, models.TierHaiku} {
+		_, exp, err := routing.Explain(string(tier), t, routing.RequestTraits{})
+		if err != nil {
+			log.Printf("[auth-check] Failed to resolve %s: %v", tier, err)
+			writeError(w, r, "anthropic", 500, "api_error", "Failed to resolve route")
+			return
+		}
+		check.Config = exp.Config
+		ct := authCheckTier{Tier: string(tier), Available: len(exp.Order) > 0, Routes: len(exp.Order),
+			Budget: routesHeadroom(exp.Order, accounts)}
+		for _, row := range exp.Rows {
+			if row.Excluded == "" || row.Excluded == routing.ExcludedCondition {
+				continue
+			}
+			if ct.Unavailable == nil {
+				ct.Unavailable = make(map[string]int)
+			}
+			ct.Unavailable[row.Excluded]++
+		}
+		check.Tiers = append(check.Tiers, ct)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(check)
+}
+
+// tenantHeadroom returns what is left of a tenant's rate limit in the
+// current window, counted the way handleProxy enforces it, or nil when the
+// tenant has no limit.
+func tenantHeadroom(t *tenant.Tenant) *rateHeadroom {
+	if t.RateLimit <= 0 && t.RateLimitBackground <= 0 {
+		return nil
+	}
+	used, bgUsed := ratelimit.Usage("tenant:" + t.ID)
+	h := &rateHeadroom{Limit: t.RateLimit, BackgroundLimit: t.RateLimitBackground}
+	bg := -1
+	if t.RateLimit > 0 {
+		remaining := max(t.RateLimit-used, 0)
+		h.Remaining = &remaining
+		bg = max(t.RateLimit-backgroundHeadroom(t)-used, 0)
+	}
+	if t.RateLimitBackground > 0 && (bg < 0 || t.RateLimitBackground-bgUsed < bg) {
+		bg = max(t.RateLimitBackground-bgUsed, 0)
+	}
+	if bg >= 0 {
+		h.BackgroundRemaining = &bg
+	}
+	return h
+}
+
+// routesHeadroom sums what is left of the monthly and daily budgets of the
+// routed accounts, counting each account once. It is nil when neither total
+// is bounded.
+func routesHeadroom(routes []string, accounts []db.Account) *budgetHeadroom {
+	if len(routes) == 0 {
+		return nil
+	}
+	var monthly, daily float64
+	monthlyBounded, dailyBounded := true, true
+	for _, a := range accounts {
+		if !slices.Contains(routes, a.ID) {
+			continue
+		}
+		if a.MonthlyBudget.Valid && a.MonthlyBudget.Float64 > 0 {
+			monthly += max(a.MonthlyBudget.Float64-db.GetMonthlySpend(a.ID), 0)
+		} else {
+			monthlyBounded = false
+		}
+		if a.DailyBudget.Valid && a.DailyBudget.Float64 > 0 {
+			daily += max(a.DailyBudget.Float64-db.GetDailySpend(a.ID), 0)
+		} else {
+			dailyBounded = false
+		}
+	}
+	if !monthlyBounded && !dailyBounded {
+		return nil
+	}
+	h := &budgetHeadroom{}
+	if monthlyBounded {
+		h.MonthlyRemainingUSD = &monthly
+	}
+	if dailyBounded {
+		h.DailyRemainingUSD = &daily
+	}
+	return h
+}
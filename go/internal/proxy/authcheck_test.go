@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/ratelimit"
+	"codegate-proxy/internal/tenant"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// authCheckSetup adds a global config, a second config pinned to tenant
+// Acme (key cgk_acme_key, 10 requests a minute, guardrails on for it
+// alone), and another tenant that must not show up in Acme's answers.
+func authCheckSetup(t *testing.T) *dbtest.DB {
+	t.Helper()
+	tdb := dbtest.Open(t)
+	resetModelsCache(t)
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+	tdb.AddAccount("acct-claude", "claude-main", "anthropic", "")
+	tdb.AddAccount("acct-openai", "openai-team", "openai", "")
+	tdb.AddAccount("acct-off", "openai-spare", "openai", "")
+	tdb.Exec("UPDATE accounts SET api_key_enc = 'sk-secret-key', enabled = 0 WHERE id = 'acct-off'")
+	tdb.AddActiveConfig("cfg", "default")
+	tdb.AddTier("cfg", "sonnet", "acct-claude", 10, "")
+	tdb.AddTier("cfg", "opus", "acct-claude", 10, "")
+	tdb.Exec("INSERT INTO configs (id, name, is_active) VALUES ('cfg-acme', 'acme-routing', 0)")
+	tdb.AddTier("cfg-acme", "sonnet", "acct-openai", 10, "gpt-4.1")
+	tdb.AddTier("cfg-acme", "sonnet", "acct-off", 5, "gpt-4.1")
+
+	for id, key := range map[string]string{"t-acme": "cgk_acme_key", "t-other": "cgk_other_key"} {
+		sum := sha256.Sum256([]byte(key))
+		tdb.Exec("INSERT INTO tenants (id, name, api_key_hash, api_key_prefix) VALUES (?, ?, ?, ?)", id, strings.TrimPrefix(id, "t-"), hex.EncodeToString(sum[:]), key[:8])
+	}
+	tdb.Exec("UPDATE tenants SET config_id = 'cfg-acme', rate_limit = 10 WHERE id = 't-acme'")
+	tdb.Exec("INSERT INTO tenant_settings (tenant_id, key, value) VALUES ('t-acme', 'privacy_enabled', 'true')")
+	ratelimit.Clear("tenant:t-acme")
+	t.Cleanup(func() { ratelimit.Clear("tenant:t-acme") })
+	return tdb
+}
+
+func getAuthCheck(t *testing.T, key string) (*httptest.ResponseRecorder, authCheck) {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/v1/auth/check", nil)
+	if key != "" {
+		r.Header.Set("x-api-key", key)
+	}
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, r)
+	var check authCheck
+	if w.Code == 200 {
+		if err := json.Unmarshal(w.Body.Bytes(), &check); err != nil {
+			t.Fatalf("invalid JSON: %s", w.Body.String())
+		}
+	}
+	return w, check
+}
+
+func TestAuthCheck_TenantKey(t *testing.T) {
+	tdb := authCheckSetup(t)
+	tdb.Exec("UPDATE accounts SET monthly_budget = 50 WHERE id = 'acct-openai'")
+	tdb.Exec("INSERT INTO usage (id, account_id, cost_usd) VALUES ('u1', 'acct-openai', 10)")
+	// A proxied request earlier in the window
+	ratelimit.CheckAndRecordClass("tenant:t-acme", ratelimit.Interactive, ratelimit.ClassLimits{Total: 10})
+
+	w, check := getAuthCheck(t, "cgk_acme_key")
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if check.Key != "tenant" || check.Tenant != "acme" || check.Config != "acme-routing" || !check.Guardrails {
+		t.Errorf("check = %+v", check)
+	}
+	if !strings.Contains(strings.Join(check.Models, ","), "gpt-4.1") {
+		t.Errorf("models = %v, want the tenant config's", check.Models)
+	}
+	if len(check.Tiers) != 3 {
+		t.Fatalf("tiers = %+v", check.Tiers)
+	}
+	if sonnet := check.Tiers[1]; !sonnet.Available || sonnet.Routes != 1 || sonnet.Unavailable["account_disabled"] != 1 {
+		t.Errorf("sonnet = %+v, want one route and the disabled account counted", sonnet)
+	}
+	if rl := check.RateLimit; rl == nil || rl.Limit != 10 || rl.Remaining == nil || *rl.Remaining != 9 {
+		t.Errorf("rate limit = %+v, want 9 of 10 left", rl)
+	}
+	if b := check.Tiers[1].Budget; b == nil || b.MonthlyRemainingUSD == nil || *b.MonthlyRemainingUSD != 40 || b.DailyRemainingUSD != nil {
+		t.Errorf("sonnet budget = %+v, want $40 of the month left and no daily total", b)
+	}
+	if b := check.Tiers[0].Budget; b != nil {
+		t.Errorf("opus budget = %+v, want none for an account without one", b)
+	}
+
+	// Checking again uses no rate limit slot
+	if _, again := getAuthCheck(t, "cgk_acme_key"); *again.RateLimit.Remaining != 9 {
+		t.Errorf("remaining after a second check = %d", *again.RateLimit.Remaining)
+	}
+	for _, leak := range []string{"other", "sk-secret-key", "acct-", "openai-team", "claude-main", "default"} {
+		if strings.Contains(w.Body.String(), leak) {
+			t.Errorf("response leaks %q: %s", leak, w.Body.String())
+		}
+	}
+}
+
+func TestAuthCheck_GlobalKey(t *testing.T) {
+	authCheckSetup(t)
+	t.Setenv("PROXY_API_KEY", "global-secret")
+
+	w, check := getAuthCheck(t, "global-secret")
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if check.Key != "global" || check.Tenant != "" || check.Config != "default" || check.Guardrails || check.RateLimit != nil {
+		t.Errorf("check = %+v", check)
+	}
+	for _, tier := range check.Tiers {
+		if !tier.Available || tier.Unavailable != nil || tier.Budget != nil {
+			t.Errorf("%s = %+v", tier.Tier, tier)
+		}
+	}
+}
+
+func TestAuthCheck_InvalidKey(t *testing.T) {
+	authCheckSetup(t)
+	t.Setenv("PROXY_API_KEY", "global-secret")
+
+	for _, key := range []string{"", "cgk_wrong"} {
+		w, _ := getAuthCheck(t, key)
+		if w.Code != 401 {
+			t.Errorf("key %q: status = %d, want 401", key, w.Code)
+		}
+		if strings.Contains(w.Body.String(), "acme") {
+			t.Errorf("key %q: body leaks a tenant: %s", key, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/limits"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// output128kBeta lets a request ask for up to output128kMaxTokens output
+// tokens, beyond the model's usual limit.
+const (
+	output128kBeta      = "output-128k-2025-02-19"
+	output128kMaxTokens = 128000
+)
+
+// splitBetas parses a comma-separated anthropic-beta list.
+func splitBetas(s string) []string {
+	var out []string
+	for _, b := range strings.Split(s, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// mergeBetas appends the betas in add that list doesn't have yet.
+func mergeBetas(list []string, add ...string) []string {
+	for _, b := range add {
+		if !slices.Contains(list, b) {
+			list = append(list, b)
+		}
+	}
+	return list
+}
+
+// takeBodyBetas removes the betas field the Anthropic SDKs accept as a
+// request parameter from an Anthropic-format body and returns its values.
+// The Messages API only takes betas as the anthropic-beta header.
+func (b *requestBody) takeBodyBetas(inboundFormat string) []string {
+	if inboundFormat != "anthropic" {
+		return nil
+	}
+	var list []any
+	if b.spool != nil {
+		f, ok := b.spool.fields["betas"]
+		if !ok {
+			return nil
+		}
+		json.Unmarshal(f.raw, &list)
+		b.spool.removeField("betas")
+	} else {
+		raw, ok := b.anthropic["betas"]
+		if !ok {
+			return nil
+		}
+		delete(b.anthropic, "betas")
+		b.anthropicModified = true
+		list, _ = raw.([]any)
+	}
+	var betas []string
+	for _, v := range list {
+		if s, ok := v.(string); ok {
+			betas = mergeBetas(betas, splitBetas(s)...)
+		}
+	}
+	return betas
+}
+
+// candidateBetas returns the request headers to forward to one account and
+// the betas left out for it. For Anthropic accounts anthropic-beta carries
+// the header's and the body's betas that the account's allowed_betas
+// permits. Other providers have no use for betas; only the body's are
+// reported, since most Anthropic clients send the header on every request.
+func candidateBetas(headers map[string]string, bodyBetas []string, account db.Account) (map[string]string, []string) {
+	if !account.SpeaksAnthropic() {
+		return headers, bodyBetas
+	}
+	allowed := splitBetas(account.AllowedBetas)
+	var kept, dropped []string
+	for _, b := range mergeBetas(splitBetas(headers["anthropic-beta"]), bodyBetas...) {
+		if len(allowed) == 0 || slices.Contains(allowed, b) {
+			kept = append(kept, b)
+		} else {
+			dropped = append(dropped, b)
+		}
+	}
+	if strings.Join(kept, ",") == headers["anthropic-beta"] {
+		return headers, dropped
+	}
+	out := maps.Clone(headers)
+	if len(kept) > 0 {
+		out["anthropic-beta"] = strings.Join(kept, ",")
+	} else {
+		delete(out, "anthropic-beta")
+	}
+	return out, dropped
+}
+
+// betasWarning describes betas left out for an account, for the conversion
+// warnings header.
+func betasWarning(dropped []string, account db.Account) string {
+	if !account.SpeaksAnthropic() {
+		return fmt.Sprintf("dropped betas %s for a non-Anthropic provider", strings.Join(dropped, ", "))
+	}
+	return fmt.Sprintf("dropped betas %s not enabled for the account", strings.Join(dropped, ", "))
+}
+
+// hasBeta reports whether an anthropic-beta header value includes beta.
+func hasBeta(header, beta string) bool {
+	return slices.Contains(splitBetas(header), beta)
+}
+
+// setMaxTokens sets max_tokens on the body forwarded to the next candidate.
+func (b *requestBody) setMaxTokens(n int) {
+	switch {
+	case b.anthropic != nil:
+		if cur, _ := b.anthropic["max_tokens"].(float64); int(cur) != n {
+			b.anthropic["max_tokens"] = float64(n)
+			b.anthropicModified = true
+		}
+	case b.spool != nil:
+		b.spool.setField("max_tokens", n)
+	}
+}
+
+// clampMaxTokens clamps max_tokens to the model's output limit, which the
+// 128k-output beta raises.
+func clampMaxTokens(v int, model string, extendedOutput bool) int {
+	limit := v
+	if clamped := limits.ClampMaxTokens(&v, model); clamped != nil {
+		limit = *clamped
+	}
+	if extendedOutput && limit < v {
+		limit = min(v, output128kMaxTokens)
+	}
+	return limit
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/cooldown"
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/health"
+	"codegate-proxy/internal/limits"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCandidateBetas(t *testing.T) {
+	headers := map[string]string{"anthropic-beta": "prompt-caching-2024-07-31,interleaved-thinking-2025-05-14"}
+	body := []string{output128kBeta, "prompt-caching-2024-07-31"}
+
+	got, dropped := candidateBetas(headers, body, db.Account{Provider: "anthropic"})
+	if want := "prompt-caching-2024-07-31,interleaved-thinking-2025-05-14," + output128kBeta; got["anthropic-beta"] != want || dropped != nil {
+		t.Errorf("no allowlist: header = %q, dropped = %v", got["anthropic-beta"], dropped)
+	}
+
+	got, dropped = candidateBetas(headers, body, db.Account{Provider: "anthropic", AllowedBetas: "prompt-caching-2024-07-31, " + output128kBeta})
+	if want := "prompt-caching-2024-07-31," + output128kBeta; got["anthropic-beta"] != want {
+		t.Errorf("allowlist: header = %q, want %q", got["anthropic-beta"], want)
+	}
+	if want := []string{"interleaved-thinking-2025-05-14"}; !reflect.DeepEqual(dropped, want) {
+		t.Errorf("allowlist: dropped = %v, want %v", dropped, want)
+	}
+	if headers["anthropic-beta"] != "prompt-caching-2024-07-31,interleaved-thinking-2025-05-14" {
+		t.Error("request headers were modified")
+	}
+
+	got, dropped = candidateBetas(headers, nil, db.Account{Provider: "anthropic", AllowedBetas: "other"})
+	if _, ok := got["anthropic-beta"]; ok || len(dropped) != 2 {
+		t.Errorf("nothing allowed: header = %q, dropped = %v", got["anthropic-beta"], dropped)
+	}
+
+	// Only the body's betas are reported for other providers
+	got, dropped = candidateBetas(headers, body, db.Account{Provider: "openai"})
+	if !reflect.DeepEqual(dropped, body) || got["anthropic-beta"] != headers["anthropic-beta"] {
+		t.Errorf("openai: header = %q, dropped = %v", got["anthropic-beta"], dropped)
+	}
+}
+
+func TestTakeBodyBetas_Spooled(t *testing.T) {
+	for _, body := range []string{
+		`{"betas":["a","b"],"model":"m","max_tokens":1}`,
+		`{"model":"m", "betas" : ["a","b"] ,"max_tokens":1}`,
+		`{"model":"m","max_tokens":1,"betas":["a","b"]}`,
+		`{"betas":["a","b"]}`,
+	} {
+		req := &requestBody{spool: spoolString(t, body)}
+		if betas := req.takeBodyBetas("anthropic"); !reflect.DeepEqual(betas, []string{"a", "b"}) {
+			t.Errorf("%s: betas = %v", body, betas)
+		}
+		raw, err := req.spool.load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out map[string]any
+		if err := json.Unmarshal(raw, &out); err != nil {
+			t.Fatalf("%s: forwarded body %s is invalid: %v", body, raw, err)
+		}
+		if _, ok := out["betas"]; ok || (len(out) != 2 && len(out) != 0) {
+			t.Errorf("%s: forwarded body = %s", body, raw)
+		}
+	}
+}
+
+func TestBetas_StrippedForOpenAI(t *testing.T) {
+	tdb := dbtest.Open(t)
+	var sent map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&sent)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}]}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-betas-oai", "oai", "openai", upstream.URL)
+
+	w := sendMessages(t, `{"model":"claude-sonnet-4-20250514","max_tokens":16,"betas":["token-efficient-tools-2025-02-19"],`+
+		`"messages":[{"role":"user","content":"hi"}]}`, nil)
+	if w.Code != 200 {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if _, ok := sent["betas"]; ok {
+		t.Error("betas forwarded to an OpenAI provider")
+	}
+	if got := w.Header().Get(conversionWarningsHeader); got != "dropped betas token-efficient-tools-2025-02-19 for a non-Anthropic provider" {
+		t.Errorf("%s = %q", conversionWarningsHeader, got)
+	}
+}
+
+// upstreamCall is what an Anthropic upstream received.
+type upstreamCall struct {
+	beta      string
+	hasBetas  bool
+	maxTokens float64
+}
+
+func TestBetas_AllowlistAndOutputClamp(t *testing.T) {
+	tdb := dbtest.Open(t)
+	// The primary's 529 fails over at once
+	tdb.SetSetting("provider_retry_count", "0")
+	limits.InitModelLimitsTable()
+	limit := 64000
+	limits.SetModelLimit("claude-3-7-sonnet", &limit, nil, nil)
+	t.Cleanup(func() { limits.DeleteModelLimit("claude-3-7-sonnet") })
+
+	var calls []upstreamCall
+	record := func(status int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			raw, _ := io.ReadAll(r.Body)
+			var body map[string]any
+			json.Unmarshal(raw, &body)
+			_, hasBetas := body["betas"]
+			mt, _ := body["max_tokens"].(float64)
+			calls = append(calls, upstreamCall{beta: r.Header.Get("Anthropic-Beta"), hasBetas: hasBetas, maxTokens: mt})
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-3-7-sonnet-20250219","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+		}
+	}
+	primary := httptest.NewServer(record(529))
+	defer primary.Close()
+	backup := httptest.NewServer(record(200))
+	defer backup.Close()
+
+	tdb.AddAccount("acct-betas-all", "all betas", "anthropic", primary.URL)
+	tdb.AddAccount("acct-betas-some", "some betas", "anthropic", backup.URL)
+	tdb.Exec("UPDATE accounts SET allowed_betas = 'prompt-caching-2024-07-31' WHERE id = 'acct-betas-some'")
+	tdb.Exec("INSERT INTO configs (id, name, is_active) VALUES ('cfg-betas', 'betas', 1)")
+	tdb.Exec(`INSERT INTO config_tiers (id, config_id, tier, account_id, priority) VALUES
+		('bt1', 'cfg-betas', 'sonnet', 'acct-betas-all', 10), ('bt2', 'cfg-betas', 'sonnet', 'acct-betas-some', 5)`)
+	reset := func() {
+		cooldown.Clear("acct-betas-all")
+		cooldown.Clear("acct-betas-some")
+		health.Reset()
+	}
+	reset()
+	t.Cleanup(reset)
+
+	w := sendMessages(t, `{"model":"claude-3-7-sonnet-20250219","max_tokens":200000,"betas":["`+output128kBeta+`"],`+
+		`"messages":[{"role":"user","content":"hi"}]}`, http.Header{"Anthropic-Beta": {"prompt-caching-2024-07-31"}})
+	if w.Code != 200 || len(calls) != 2 {
+		t.Fatalf("status = %d, upstream calls = %d: %s", w.Code, len(calls), w.Body)
+	}
+
+	first, second := calls[0], calls[1]
+	if first.hasBetas || second.hasBetas {
+		t.Error("betas field forwarded in the body")
+	}
+	if want := "prompt-caching-2024-07-31," + output128kBeta; first.beta != want || first.maxTokens != output128kMaxTokens {
+		t.Errorf("account with all betas: anthropic-beta = %q, max_tokens = %v", first.beta, first.maxTokens)
+	}
+	if second.beta != "prompt-caching-2024-07-31" || second.maxTokens != 64000 {
+		t.Errorf("account without the 128k beta: anthropic-beta = %q, max_tokens = %v", second.beta, second.maxTokens)
+	}
+	if got := w.Header().Get(conversionWarningsHeader); !strings.Contains(got, "dropped betas "+output128kBeta+" not enabled for the account") {
+		t.Errorf("%s = %q", conversionWarningsHeader, got)
+	}
+}
+
+func TestClampMaxTokens_OutputBeta(t *testing.T) {
+	dbtest.Open(t)
+	limits.InitModelLimitsTable()
+	limit := 64000
+	limits.SetModelLimit("claude-3-7-sonnet", &limit, nil, nil)
+	t.Cleanup(func() { limits.DeleteModelLimit("claude-3-7-sonnet") })
+
+	for _, tc := range []struct {
+		v        int
+		extended bool
+		want     int
+	}{
+		{100000, false, 64000},
+		{100000, true, 100000},
+		{200000, true, 128000},
+		{1000, true, 1000},
+	} {
+		if got := clampMaxTokens(tc.v, "claude-3-7-sonnet-20250219", tc.extended); got != tc.want {
+			t.Errorf("clampMaxTokens(%d, extended=%v) = %d, want %d", tc.v, tc.extended, got, tc.want)
+		}
+	}
+}
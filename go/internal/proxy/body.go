@@ -0,0 +1,345 @@
+package proxy
+
+import (
+	"bytes"
+	"codegate-proxy/internal/convert"
+	"codegate-proxy/internal/guardrails"
+	"codegate-proxy/internal/limits"
+	"codegate-proxy/internal/provider"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// requestBody holds the parsed inbound request. The body is parsed exactly once
+// per request; per-candidate preparation reuses the parsed maps and marshals at
+// most once per candidate.
+type requestBody struct {
+	raw []byte
+
+	// parsed is the inbound body as sent by the client (nil for empty bodies).
+	parsed map[string]any
+
+	// anthropic is the Anthropic-format body used for routing and forwarding to
+	// Anthropic targets. It is owned by the handler: either the freshly parsed
+	// inbound body, the OpenAI->Anthropic conversion output, or the clone
+	// returned by guardrails. The model field is overwritten per candidate.
+	anthropic map[string]any
+
+	// anthropicModified is set once anthropic no longer matches raw (conversion,
+	// guardrails, or max_tokens clamping). While false, Anthropic-inbound
+	// requests to Anthropic targets forward raw with only the model spliced in.
+	anthropicModified bool
+
+	// anonymized is set once guardrails have run over anthropic. Every
+	// candidate and retry forwards that clone rather than anonymizing again.
+	anonymized bool
+
+	// detections counts the values guardrails replaced, by guardrail ID.
+	detections map[string]int
+
+	// conversionWarnings lists what the body forwarded to the current
+	// candidate lost in conversion, for the X-CodeGate-Conversion-Warnings
+	// header.
+	conversionWarnings []string
+
+	// inboundWarnings are the OpenAI->Anthropic conversion's warnings,
+	// reported when the converted body is forwarded.
+	inboundWarnings []string
+
+	// toolNames maps tool names rewritten for the current OpenAI candidate
+	// back to the client's names.
+	toolNames convert.ToolNames
+
+	// convertOptions adjusts conversion for OpenAI candidates.
+	convertOptions convert.Options
+
+	// targetCaps are the current candidate's provider capabilities.
+	targetCaps provider.Capabilities
+
+	// systemPrefix is injected ahead of the system prompt of the body
+	// forwarded to the current candidate, and promptInjected is set once
+	// it has been. A spooled body is loaded into memory to get it.
+	systemPrefix   string
+	promptInjected bool
+
+	// bodyBetas are the betas taken from the body's betas field, forwarded
+	// in the anthropic-beta header.
+	bodyBetas []string
+
+	// extendedMaxTokens is max_tokens as allowed by the 128k-output beta, or
+	// 0 if the request doesn't use it. Candidates without the beta get it
+	// clamped to the model limit.
+	extendedMaxTokens int
+
+	// bodyNotes describe changes made to the body for every candidate, such
+	// as tool results cut by max_tool_result_bytes, and other per-request
+	// notes like an unknown anthropic-version, for the conversion warnings
+	// header.
+	bodyNotes []string
+
+	// thinking is the client's enabled thinking config and thinkingBudget
+	// its budget_tokens, once fitThinkingBudget has looked for it.
+	// thinkingFitted is set while the forwarded body carries a changed one.
+	thinking       map[string]any
+	thinkingBudget int
+	thinkingFitted bool
+
+	// spool is set instead of raw/parsed for bodies above the spool threshold.
+	spool *spooledBody
+}
+
+// anonymize runs the guardrails over the Anthropic-format body. It only
+// does so once per request; later calls are no-ops.
+func (b *requestBody) anonymize(tenantID string) {
+	if b.anonymized || b.anthropic == nil {
+		return
+	}
+	b.anthropic, b.detections = guardrails.RunGuardrailsOnRequestBodyCounting(b.anthropic, tenantID)
+	b.anthropicModified = true
+	b.anonymized = true
+}
+
+// forward builds the upstream path and a fresh body reader for one candidate.
+// Spooled bodies are streamed from disk when the target speaks the inbound
+// format; a candidate that needs format conversion, a system prompt prefix
+// or optional OpenAI fields left out loads them into memory, so padding a
+// request past the spool threshold doesn't evade the prefix or forward
+// fields the provider rejects.
+func (b *requestBody) forward(inboundFormat string, targetIsAnthropic bool, targetModel, path string) (string, io.Reader, int64, error) {
+	b.conversionWarnings = nil
+	b.toolNames = nil
+	b.promptInjected = false
+	if b.spool != nil {
+		if (inboundFormat == "anthropic") == targetIsAnthropic && b.systemPrefix == "" &&
+			(targetIsAnthropic || !spoolHasUnsupportedOpenAIFields(b.spool, b.targetCaps)) {
+			b.spool.setField("model", targetModel)
+			r, n := b.spool.reader()
+			if targetIsAnthropic {
+				return anthropicPath(path), r, n, nil
+			}
+			return "/v1/chat/completions", r, n, nil
+		}
+		if err := b.materialize(inboundFormat); err != nil {
+			return "", nil, 0, err
+		}
+	}
+	forwardPath, body := b.forwardBody(inboundFormat, targetIsAnthropic, targetModel, path)
+	return forwardPath, strings.NewReader(body), int64(len(body)), nil
+}
+
+// materialize replaces the spool with an in-memory parse of its contents.
+// The handler materializes spooled bodies before guardrails run, so a body
+// materialized later, for conversion, never needs anonymizing.
+func (b *requestBody) materialize(inboundFormat string) error {
+	raw, err := b.spool.load()
+	if err != nil {
+		return fmt.Errorf("read spooled body: %w", err)
+	}
+	var parsed map[string]any
+	if err := json.Unmarshal(raw, &parsed); err != nil {
+		return fmt.Errorf("parse spooled body: %w", err)
+	}
+	b.spool.Close()
+	b.spool = nil
+	b.raw, b.parsed, b.anthropic = raw, parsed, parsed
+	if inboundFormat == "openai" {
+		if converted, warnings := convert.OpenAIToAnthropicRequestWithWarnings(parsed); converted != nil {
+			if m, ok := parsed["model"].(string); ok {
+				converted["model"] = m
+			}
+			b.anthropic = converted
+			b.anthropicModified = true
+			b.inboundWarnings = warnings
+		}
+	}
+	return nil
+}
+
+// choiceCount returns the number of choices (n) an OpenAI request asks for,
+// 1 when it doesn't say.
+func (b *requestBody) choiceCount() int {
+	var n float64
+	if b.spool != nil {
+		n, _ = b.spool.numberField("n")
+	} else {
+		n, _ = b.parsed["n"].(float64)
+	}
+	return max(1, int(n))
+}
+
+// includeUsage reports whether an OpenAI request set
+// stream_options.include_usage.
+func (b *requestBody) includeUsage() bool {
+	opts, _ := b.parsed["stream_options"].(map[string]any)
+	if b.spool != nil {
+		if f, ok := b.spool.fields["stream_options"]; ok {
+			json.Unmarshal(f.raw, &opts)
+		}
+	}
+	include, _ := opts["include_usage"].(bool)
+	return include
+}
+
+// logBody returns the request body for detailed request logging.
+func (b *requestBody) logBody() string {
+	if b.spool != nil {
+		return fmt.Sprintf("[spooled request body: %d bytes]", b.spool.size)
+	}
+	return string(b.raw)
+}
+
+// forwardBody builds the upstream path and body for one candidate.
+func (b *requestBody) forwardBody(inboundFormat string, targetIsAnthropic bool, targetModel, path string) (string, string) {
+	switch {
+	case inboundFormat == "openai" && !targetIsAnthropic:
+		// OpenAI client → OpenAI-compatible provider: forward original body
+		// with model swap, less the fields the provider doesn't take
+		dropped := unsupportedOpenAIFields(b.parsed, b.targetCaps)
+		if len(dropped) > 0 {
+			b.conversionWarnings = []string{fmt.Sprintf("dropped %s, which the provider doesn't take", strings.Join(dropped, ", "))}
+		}
+		if len(dropped) > 0 || b.systemPrefix != "" && b.parsed != nil {
+			return "/v1/chat/completions", b.parsedForCandidate(targetModel, dropped)
+		}
+		return "/v1/chat/completions", b.rawWithModel(targetModel)
+
+	case inboundFormat == "openai" && targetIsAnthropic:
+		// OpenAI client → Anthropic provider: use converted anthropic body
+		b.conversionWarnings = slices.Clone(b.inboundWarnings)
+		return "/v1/messages", b.anthropicWithModel(targetModel)
+
+	case inboundFormat == "anthropic" && !targetIsAnthropic:
+		// Anthropic client → OpenAI-compatible provider: convert to OpenAI format
+		opts := b.convertOptions
+		opts.Stop.MaxCount, opts.Stop.MaxLength = limits.StopSequenceLimits(targetModel)
+		if ml := limits.GetModelLimits(targetModel); ml != nil {
+			opts.Reasoning = ml.SupportsReasoning
+		}
+		openaiBody, warnings, toolNames := convert.AnthropicToOpenAIWithOptions(b.anthropic, targetModel, opts)
+		b.conversionWarnings, b.toolNames = warnings, toolNames
+		// Prepended after conversion, so it stays a message of its own
+		// however the client's system blocks are joined
+		if b.systemPrefix != "" && openaiBody != nil {
+			openaiBody = withSystemMessage(openaiBody, b.systemPrefix)
+			b.promptInjected = true
+		}
+		out, _ := json.Marshal(openaiBody)
+		return "/v1/chat/completions", string(out)
+
+	default:
+		// Anthropic client → Anthropic provider: forward as-is
+		forwardPath := anthropicPath(path)
+		if !b.anthropicModified && b.systemPrefix == "" {
+			return forwardPath, b.rawWithModel(targetModel)
+		}
+		return forwardPath, b.anthropicWithModel(targetModel)
+	}
+}
+
+// anthropicPath keeps Messages API subpaths (e.g. count_tokens) for Anthropic
+// targets and defaults everything else to /v1/messages.
+func anthropicPath(path string) string {
+	if strings.HasPrefix(path, "/v1/messages") {
+		return path
+	}
+	return "/v1/messages"
+}
+
+// rawWithModel returns the original request bytes with the top-level model
+// rewritten. Falls back to a single marshal of the parsed body when the model
+// field cannot be spliced in place.
+func (b *requestBody) rawWithModel(model string) string {
+	if b.parsed == nil {
+		return string(b.raw)
+	}
+	if out, ok := spliceTopLevelString(b.raw, "model", model); ok {
+		return string(out)
+	}
+	b.parsed["model"] = model
+	out, _ := json.Marshal(b.parsed)
+	return string(out)
+}
+
+// parsedForCandidate returns the parsed body with the model swapped, fields
+// left out and the system prefix added, leaving the parsed body itself as
+// it is for other candidates.
+func (b *requestBody) parsedForCandidate(model string, fields []string) string {
+	body := maps.Clone(b.parsed)
+	for _, f := range fields {
+		delete(body, f)
+	}
+	body["model"] = model
+	if b.systemPrefix != "" {
+		body = withSystemMessage(body, b.systemPrefix)
+		b.promptInjected = true
+	}
+	out, _ := json.Marshal(body)
+	return string(out)
+}
+
+// anthropicWithModel swaps the model on the owned Anthropic body and marshals
+// it, with the system prefix added to a copy.
+func (b *requestBody) anthropicWithModel(model string) string {
+	if b.anthropic == nil {
+		return string(b.raw)
+	}
+	b.anthropic["model"] = model
+	body := b.anthropic
+	if b.systemPrefix != "" {
+		body = withSystemBlock(body, b.systemPrefix)
+		b.promptInjected = true
+	}
+	out, _ := json.Marshal(body)
+	return string(out)
+}
+
+// spliceTopLevelString replaces the value of a top-level string field in a JSON
+// object without decoding the rest of the document into maps. If the key
+// appears more than once, the last occurrence is replaced, as that is the one
+// JSON decoders (and so upstreams) honour. Returns false if raw is not an
+// object or the key is absent.
+func spliceTopLevelString(raw []byte, key, value string) ([]byte, bool) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	tok, err := dec.Token()
+	if err != nil || tok != json.Delim('{') {
+		return nil, false
+	}
+
+	start, end := -1, -1
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, false
+		}
+		k, _ := tok.(string)
+
+		var val json.RawMessage
+		if err := dec.Decode(&val); err != nil {
+			return nil, false
+		}
+		if k == key {
+			end = int(dec.InputOffset())
+			start = end - len(val)
+		}
+	}
+	if start < 0 {
+		return nil, false
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, false
+	}
+	if bytes.Equal(raw[start:end], encoded) {
+		return raw, true
+	}
+	out := make([]byte, 0, len(raw)-(end-start)+len(encoded))
+	out = append(out, raw[:start]...)
+	out = append(out, encoded...)
+	out = append(out, raw[end:]...)
+	return out, true
+}
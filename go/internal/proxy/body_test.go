@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/guardrails"
+	"codegate-proxy/internal/limits"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSpliceTopLevelString(t *testing.T) {
+	raw := []byte(`{"model": "claude-opus-4-20250514", "messages":[{"role":"user","content":"model"}],"max_tokens":1024}`)
+
+	out, ok := spliceTopLevelString(raw, "model", "gpt-4o")
+	if !ok {
+		t.Fatal("splice should succeed")
+	}
+	want := `{"model": "gpt-4o", "messages":[{"role":"user","content":"model"}],"max_tokens":1024}`
+	if string(out) != want {
+		t.Errorf("spliced = %s\nwant     %s", out, want)
+	}
+}
+
+func TestSpliceTopLevelString_NestedKeyIgnored(t *testing.T) {
+	raw := []byte(`{"metadata":{"model":"nested"},"model":"a"}`)
+	out, ok := spliceTopLevelString(raw, "model", "b")
+	if !ok {
+		t.Fatal("splice should succeed")
+	}
+	if string(out) != `{"metadata":{"model":"nested"},"model":"b"}` {
+		t.Errorf("only the top-level field should change, got %s", out)
+	}
+}
+
+func TestSpliceTopLevelString_DuplicateKey(t *testing.T) {
+	raw := []byte(`{"model":"cheap","messages":[],"model":"claude-opus-4-20250514"}`)
+	out, ok := spliceTopLevelString(raw, "model", "gpt-4o")
+	if !ok {
+		t.Fatal("splice should succeed")
+	}
+	var decoded struct{ Model string }
+	if err := json.Unmarshal(out, &decoded); err != nil || decoded.Model != "gpt-4o" {
+		t.Errorf("decoded model = %q (err %v) from %s; the last occurrence should be rewritten", decoded.Model, err, out)
+	}
+}
+
+func TestSpliceTopLevelString_Unchanged(t *testing.T) {
+	raw := []byte(`{"model":"same","x":1}`)
+	out, ok := spliceTopLevelString(raw, "model", "same")
+	if !ok || string(out) != string(raw) {
+		t.Errorf("same value should return original bytes, got %s (ok=%v)", out, ok)
+	}
+}
+
+func TestSpliceTopLevelString_Missing(t *testing.T) {
+	if _, ok := spliceTopLevelString([]byte(`{"messages":[]}`), "model", "x"); ok {
+		t.Error("missing key should report false")
+	}
+	if _, ok := spliceTopLevelString([]byte(`[1,2]`), "model", "x"); ok {
+		t.Error("non-object should report false")
+	}
+}
+
+func TestForwardBody_PassthroughKeepsBytes(t *testing.T) {
+	raw := []byte(`{"model":"claude-sonnet-4-20250514","max_tokens":1024,"messages":[{"role":"user","content":"Hi"}],"unknown_field":{"a":1}}`)
+	req := parseTestBody(t, raw)
+
+	path, body := req.forwardBody("anthropic", true, "claude-opus-4-20250514", "/v1/messages")
+	if path != "/v1/messages" {
+		t.Errorf("path = %q", path)
+	}
+	want := strings.Replace(string(raw), "claude-sonnet-4-20250514", "claude-opus-4-20250514", 1)
+	if body != want {
+		t.Errorf("body = %s\nwant   %s", body, want)
+	}
+}
+
+func TestForwardBody_ModifiedMarshalsOwnedBody(t *testing.T) {
+	raw := []byte(`{"model":"claude-sonnet-4-20250514","max_tokens":1024,"messages":[]}`)
+	req := parseTestBody(t, raw)
+	req.anthropic["max_tokens"] = float64(512)
+	req.anthropicModified = true
+
+	_, body := req.forwardBody("anthropic", true, "target-model", "/v1/messages")
+	var parsed map[string]any
+	if err := json.Unmarshal([]byte(body), &parsed); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if parsed["model"] != "target-model" || parsed["max_tokens"] != float64(512) {
+		t.Errorf("unexpected body: %s", body)
+	}
+}
+
+func TestForwardBody_UnknownBlockTypes(t *testing.T) {
+	raw := []byte(`{"model":"claude-sonnet-4-20250514","max_tokens":16,"messages":[{"role":"user","content":[` +
+		`{"type":"text","text":"see"},{"type":"mystery_block","payload":{"x":[1,2]},"text":"keep me"}]}]}`)
+
+	// Anthropic targets get the block untouched, including after the body is re-marshaled
+	req := parseTestBody(t, raw)
+	for _, modified := range []bool{false, true} {
+		req.anthropicModified = modified
+		_, body := req.forwardBody("anthropic", true, "claude-sonnet-4-20250514", "/v1/messages")
+		if !strings.Contains(body, `"payload":{"x":[1,2]}`) || !strings.Contains(body, `"type":"mystery_block"`) {
+			t.Errorf("modified=%v: mystery_block not passed through: %s", modified, body)
+		}
+	}
+	if req.conversionWarnings != nil {
+		t.Errorf("warnings on the Anthropic path: %v", req.conversionWarnings)
+	}
+
+	_, _, _, err := req.forward("anthropic", false, "gpt-4o", "/v1/messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req.conversionWarnings) != 1 {
+		t.Errorf("conversionWarnings = %v, want the dropped mystery_block", req.conversionWarnings)
+	}
+	req.forward("anthropic", true, "claude-sonnet-4-20250514", "/v1/messages")
+	if req.conversionWarnings != nil {
+		t.Error("warnings should reset for the next candidate")
+	}
+}
+
+func TestForwardBody_StopSequenceLimits(t *testing.T) {
+	tdb := dbtest.Open(t)
+	limits.InitModelLimitsTable()
+	tdb.Exec("INSERT INTO model_limits (model_id, max_stop_sequences) VALUES ('deepseek-chat', 6)")
+	limits.InitModelLimitsTable() // reloads the cache
+	t.Cleanup(func() { limits.DeleteModelLimit("deepseek-chat") })
+
+	raw := []byte(`{"model":"claude-sonnet-4-20250514","max_tokens":16,"messages":[{"role":"user","content":"hi"}],` +
+		`"stop_sequences":["s0","s1","s2","s3","s4","s5","s6","s7","s8","s9"]}`)
+	req := parseTestBody(t, raw)
+	for model, want := range map[string]int{"gpt-4o": limits.DefaultMaxStopSequences, "deepseek-chat": 6} {
+		_, body := req.forwardBody("anthropic", false, model, "/v1/messages")
+		var sent struct{ Stop []string }
+		json.Unmarshal([]byte(body), &sent)
+		if len(sent.Stop) != want || sent.Stop[0] != "s0" {
+			t.Errorf("%s: stop = %v, want the first %d", model, sent.Stop, want)
+		}
+		if warning := fmt.Sprintf("kept the first %d of 10 stop sequences", want); len(req.conversionWarnings) != 1 || req.conversionWarnings[0] != warning {
+			t.Errorf("%s: warnings = %q, want %q", model, req.conversionWarnings, warning)
+		}
+	}
+}
+
+func TestForwardBody_ReasoningFromModelLimits(t *testing.T) {
+	dbtest.Open(t)
+	limits.InitModelLimitsTable()
+	yes := true
+	limits.SetModelLimit("qwq", nil, nil, &yes)
+	t.Cleanup(func() { limits.DeleteModelLimit("qwq") })
+
+	req := parseTestBody(t, []byte(`{"model":"claude-sonnet-4-20250514","max_tokens":32000,`+
+		`"messages":[{"role":"user","content":"hi"}],"thinking":{"type":"enabled","budget_tokens":20000}}`))
+	for model, want := range map[string]string{"qwq-32b": "high", "o3": "high", "gpt-4o": ""} {
+		_, body := req.forwardBody("anthropic", false, model, "/v1/messages")
+		var sent struct {
+			ReasoningEffort string `json:"reasoning_effort"`
+		}
+		json.Unmarshal([]byte(body), &sent)
+		if sent.ReasoningEffort != want {
+			t.Errorf("%s: reasoning_effort = %q, want %q", model, sent.ReasoningEffort, want)
+		}
+	}
+}
+
+func TestForwardBody_EmptyBody(t *testing.T) {
+	req := &requestBody{}
+	_, body := req.forwardBody("anthropic", true, "m", "/v1/messages")
+	if body != "" {
+		t.Errorf("empty body should forward empty, got %q", body)
+	}
+}
+
+func parseTestBody(t testing.TB, raw []byte) *requestBody {
+	t.Helper()
+	req := &requestBody{raw: raw}
+	if err := json.Unmarshal(raw, &req.parsed); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	req.anthropic = req.parsed
+	return req
+}
+
+// largeRequestFixture builds a ~500KB Anthropic request resembling a long
+// Claude Code session (many tool results with file contents).
+func largeRequestFixture() []byte {
+	line := strings.Repeat("func example() { return fmt.Sprintf(\"%d\", 42) }\n", 20)
+	var msgs []any
+	for i := 0; len(msgs) < 1000; i++ {
+		msgs = append(msgs,
+			map[string]any{"role": "assistant", "content": []any{
+				map[string]any{"type": "tool_use", "id": fmt.Sprintf("toolu_%d", i), "name": "Read", "input": map[string]any{"path": "main.go"}},
+			}},
+			map[string]any{"role": "user", "content": []any{
+				map[string]any{"type": "tool_result", "tool_use_id": fmt.Sprintf("toolu_%d", i), "content": line[:500]},
+			}},
+		)
+	}
+	b, _ := json.Marshal(map[string]any{
+		"model":      "claude-sonnet-4-20250514",
+		"max_tokens": 8192,
+		"stream":     true,
+		"system":     []any{map[string]any{"type": "text", "text": "You are Claude Code."}},
+		"messages":   msgs,
+	})
+	return b
+}
+
+// legacyForwardBody reproduces the previous per-candidate preparation: a
+// marshal/unmarshal deep copy followed by a marshal of the copy.
+func legacyForwardBody(body map[string]any, targetModel string) string {
+	b, _ := json.Marshal(body)
+	var forwardJSON map[string]any
+	json.Unmarshal(b, &forwardJSON)
+	forwardJSON["model"] = targetModel
+	out, _ := json.Marshal(forwardJSON)
+	return string(out)
+}
+
+func BenchmarkForwardBody_Legacy(b *testing.B) {
+	raw := largeRequestFixture()
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var parsed map[string]any
+		json.Unmarshal(raw, &parsed)
+		_ = legacyForwardBody(parsed, "claude-opus-4-20250514")
+	}
+}
+
+func BenchmarkForwardBody_Passthrough(b *testing.B) {
+	raw := largeRequestFixture()
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		req := parseTestBody(b, raw)
+		_, _ = req.forwardBody("anthropic", true, "claude-opus-4-20250514", "/v1/messages")
+	}
+}
+
+func BenchmarkForwardBody_Modified(b *testing.B) {
+	raw := largeRequestFixture()
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		req := parseTestBody(b, raw)
+		req.anthropicModified = true
+		_, _ = req.forwardBody("anthropic", true, "claude-opus-4-20250514", "/v1/messages")
+	}
+}
+
+func TestAnonymize_OncePerRequest(t *testing.T) {
+	// The guardrail key is created under the test's DATA_DIR
+	dbtest.Open(t)
+	guardrails.InitGuardrails()
+	req := parseTestBody(t, []byte(`{"model":"m","messages":[{"role":"user","content":"call 415-555-0134"}]}`))
+	req.anonymize("")
+	first, _ := json.Marshal(req.anthropic)
+	if strings.Contains(string(first), "415-555-0134") || !req.anthropicModified {
+		t.Fatalf("phone not anonymized: %s", first)
+	}
+
+	req.anonymize("")
+	second, _ := json.Marshal(req.anthropic)
+	if string(second) != string(first) {
+		t.Errorf("second anonymize changed the body:\n%s\n%s", first, second)
+	}
+}
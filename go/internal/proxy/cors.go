@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/tenant"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers browsers may read from proxy responses (exposedHeaders) and send
+// with requests (allowedHeaders). Features register theirs where they
+// declare them, through exposeHeader and allowHeader, so the CORS headers
+// list everything the proxy uses.
+var (
+	exposedHeaders = []string{"X-Proxy-Account", "X-Proxy-Strategy", "X-Proxy-Tenant"}
+	allowedHeaders = []string{"Content-Type", "Authorization", "X-Api-Key",
+		"Anthropic-Version", "Anthropic-Beta", "Anthropic-Dangerous-Direct-Browser-Access"}
+)
+
+// exposeHeader registers a response header for Access-Control-Expose-Headers
+// and returns its name.
+func exposeHeader(name string) string {
+	exposedHeaders = append(exposedHeaders, name)
+	return name
+}
+
+// allowHeader registers a request header for Access-Control-Allow-Headers
+// and returns its name.
+func allowHeader(name string) string {
+	allowedHeaders = append(allowedHeaders, name)
+	return name
+}
+
+// corsCacheTTL bounds how often the origin lists are read from the database.
+const corsCacheTTL = 10 * time.Second
+
+// corsCache holds the origin lists: the cors_allowed_origins setting, and
+// every origin any tenant lists, which preflights answer for since they
+// come without an API key.
+var corsCache struct {
+	mu        sync.Mutex
+	global    []string
+	open      bool // the setting is unset or "*"
+	anyTenant []string
+	expires   time.Time
+}
+
+// corsOrigins returns the cached origin lists, reading them when missing or
+// older than corsCacheTTL. The global list is open to all origins while
+// cors_allowed_origins is unset or "*"; a tenant's own list only limits
+// that tenant.
+func corsOrigins() (global []string, open bool, anyTenant []string) {
+	corsCache.mu.Lock()
+	defer corsCache.mu.Unlock()
+	if time.Now().After(corsCache.expires) {
+		setting := db.GetSetting("cors_allowed_origins")
+		corsCache.global = splitOrigins(setting)
+		corsCache.open = strings.TrimSpace(setting) == "*" || len(corsCache.global) == 0
+		if corsCache.open {
+			corsCache.global = nil
+		}
+		corsCache.anyTenant = nil
+		for _, v := range db.TenantSettingValues("cors_allowed_origins") {
+			corsCache.anyTenant = append(corsCache.anyTenant, splitOrigins(v)...)
+		}
+		corsCache.expires = time.Now().Add(corsCacheTTL)
+	}
+	return corsCache.global, corsCache.open, corsCache.anyTenant
+}
+
+// originAllowedFor reports whether a tenant's browser requests may come from
+// origin. A tenant with its own cors_allowed_origins takes that list and
+// the global one; other callers are open unless the global list is set.
+func originAllowedFor(t *tenant.Tenant, origin string) bool {
+	global, open, _ := corsOrigins()
+	var own []string
+	if t != nil {
+		own = splitOrigins(t.Settings["cors_allowed_origins"])
+	}
+	if len(own) == 0 && open {
+		return true
+	}
+	return slices.Contains(global, origin) || slices.Contains(own, origin)
+}
+
+// splitOrigins parses a comma-separated origin list.
+func splitOrigins(list string) []string {
+	var origins []string
+	for _, o := range strings.Split(list, ",") {
+		if o = strings.TrimSuffix(strings.TrimSpace(o), "/"); o != "" {
+			origins = append(origins, o)
+		}
+	}
+	return origins
+}
+
+// withCORS answers preflights and sets the CORS headers of every response.
+// With cors_allowed_origins set, only origins it or a tenant lists get
+// them; authenticate then checks the origin against the caller's tenant.
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		global, open, anyTenant := corsOrigins()
+		if open {
+			h.Set("Access-Control-Allow-Origin", "*")
+			h.Set("Access-Control-Allow-Headers", "*")
+		} else {
+			h.Add("Vary", "Origin")
+			if origin := r.Header.Get("Origin"); slices.Contains(global, origin) || slices.Contains(anyTenant, origin) {
+				h.Set("Access-Control-Allow-Origin", origin)
+				h.Set("Access-Control-Allow-Headers", strings.Join(allowedHeaders, ", "))
+			}
+		}
+		if h.Get("Access-Control-Allow-Origin") != "" {
+			h.Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			h.Set("Access-Control-Expose-Headers", strings.Join(exposedHeaders, ", "))
+		}
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(204)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
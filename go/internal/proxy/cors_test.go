@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/tenant"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetCORSCache drops the cached origin lists, before the test and after.
+func resetCORSCache(t *testing.T) {
+	reset := func() {
+		corsCache.mu.Lock()
+		corsCache.expires = time.Time{}
+		corsCache.mu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestCORSExposesRegisteredHeaders(t *testing.T) {
+	dbtest.Open(t)
+	resetCORSCache(t)
+	saved := exposedHeaders
+	t.Cleanup(func() { exposedHeaders = saved })
+	name := exposeHeader("X-CodeGate-Test-Feature")
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+
+	exposed := w.Header().Get("Access-Control-Expose-Headers")
+	for _, h := range []string{name, upstreamModelHeader, requestCostHeader, noFailoverHeader, "X-Proxy-Account"} {
+		if !strings.Contains(exposed, h) {
+			t.Errorf("Expose-Headers = %q, missing %s", exposed, h)
+		}
+	}
+}
+
+func TestCORSTenantOrigins(t *testing.T) {
+	tdb := dbtest.Open(t)
+	resetCORSCache(t)
+	tdb.SetSetting("cors_allowed_origins", "https://dashboard.example")
+	for _, id := range []string{"webapp", "other"} {
+		key := "cgk_" + id + "_key"
+		sum := sha256.Sum256([]byte(key))
+		tdb.Exec("INSERT INTO tenants (id, name, api_key_hash, api_key_prefix) VALUES (?, ?, ?, ?)", id, id, "hash-"+id, key[:8])
+		tdb.Exec("INSERT INTO tenant_keys (id, tenant_id, key_hash, key_prefix) VALUES (?, ?, ?, ?)", "k-"+id, id, hex.EncodeToString(sum[:]), key[:8])
+	}
+	tdb.Exec("INSERT INTO tenant_settings (tenant_id, key, value) VALUES ('webapp', 'cors_allowed_origins', 'https://app.example, https://beta.app.example/')")
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","content":[],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-cors", "cors", "anthropic", upstream.URL)
+
+	t.Run("preflight", func(t *testing.T) {
+		for origin, want := range map[string]string{
+			"https://app.example":       "https://app.example",
+			"https://beta.app.example":  "https://beta.app.example",
+			"https://dashboard.example": "https://dashboard.example",
+			"https://evil.example":      "",
+		} {
+			req := httptest.NewRequest("OPTIONS", "/v1/messages", nil)
+			req.Header.Set("Origin", origin)
+			w := httptest.NewRecorder()
+			Handler().ServeHTTP(w, req)
+
+			if got := w.Header().Get("Access-Control-Allow-Origin"); w.Code != 204 || got != want {
+				t.Errorf("%s: status = %d, Allow-Origin = %q, want %q", origin, w.Code, got, want)
+			}
+			if want == "" {
+				continue
+			}
+			allowed := w.Header().Get("Access-Control-Allow-Headers")
+			for _, h := range []string{"Anthropic-Version", "Anthropic-Beta", "X-Api-Key", sessionIDHeader} {
+				if !strings.Contains(allowed, h) {
+					t.Errorf("%s: Allow-Headers = %q, missing %s", origin, allowed, h)
+				}
+			}
+		}
+	})
+
+	cases := []struct {
+		name, key, origin string
+		status            int
+	}{
+		{"own origin", "cgk_webapp_key", "https://app.example", 200},
+		{"global origin", "cgk_other_key", "https://dashboard.example", 200},
+		{"other tenant's origin", "cgk_other_key", "https://app.example", 403},
+		{"no origin", "cgk_other_key", "", 200},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model":"claude-sonnet-4-6","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`))
+			req.Header.Set("X-Api-Key", tc.key)
+			if tc.origin != "" {
+				req.Header.Set("Origin", tc.origin)
+			}
+			w := httptest.NewRecorder()
+			Handler().ServeHTTP(w, req)
+
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); tc.status == 403 && got != "" {
+				t.Errorf("Allow-Origin = %q on a rejected origin", got)
+			}
+		})
+	}
+}
+
+func TestCORSTenantOriginsScoped(t *testing.T) {
+	tdb := dbtest.Open(t)
+	resetCORSCache(t)
+	for _, id := range []string{"webapp", "other"} {
+		key := "cgk_" + id + "_key"
+		sum := sha256.Sum256([]byte(key))
+		tdb.Exec("INSERT INTO tenants (id, name, api_key_hash, api_key_prefix) VALUES (?, ?, ?, ?)", id, id, "hash-"+id, key[:8])
+		tdb.Exec("INSERT INTO tenant_keys (id, tenant_id, key_hash, key_prefix) VALUES (?, ?, ?, ?)", "k-"+id, id, hex.EncodeToString(sum[:]), key[:8])
+	}
+	tdb.Exec("INSERT INTO tenant_settings (tenant_id, key, value) VALUES ('webapp', 'cors_allowed_origins', 'https://app.example')")
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","content":[],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-cors", "cors", "anthropic", upstream.URL)
+
+	cases := []struct {
+		name, key, path, origin string
+		status                  int
+	}{
+		{"other tenant, any origin", "cgk_other_key", "/v1/messages", "https://anywhere.example", 200},
+		{"own origin", "cgk_webapp_key", "/v1/messages", "https://app.example", 200},
+		{"unlisted origin", "cgk_webapp_key", "/v1/messages", "https://anywhere.example", 403},
+		{"unlisted origin, openai", "cgk_webapp_key", "/v1/chat/completions", "https://anywhere.example", 403},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := `{"model":"claude-sonnet-4-6","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`
+			req := httptest.NewRequest("POST", tc.path, strings.NewReader(body))
+			req.Header.Set("X-Api-Key", tc.key)
+			req.Header.Set("Origin", tc.origin)
+			w := httptest.NewRecorder()
+			Handler().ServeHTTP(w, req)
+
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			want := "*"
+			if tc.status == 403 {
+				want = ""
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != want {
+				t.Errorf("Allow-Origin = %q, want %q with no global list", got, want)
+			}
+			if tc.status == 403 && strings.Contains(tc.path, "/chat/completions") == strings.Contains(w.Body.String(), `"type":"error"`) {
+				t.Errorf("rejection body %s not in the %s format", w.Body.String(), tc.path)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"unicode/utf8"
+)
+
+// countTokensPath is the Messages API's token counting endpoint. Only
+// Anthropic providers have it, so for others the count is estimated here.
+const countTokensPath = "/v1/messages/count_tokens"
+
+const (
+	// charsPerToken is the rough number of characters in a token of
+	// English text or JSON
+	charsPerToken = 4
+	// imageTokens is what Anthropic counts for an image near its 1.15
+	// megapixel working size ((width * height) / 750). Images aren't decoded
+	// to size them.
+	imageTokens = 1600
+)
+
+// estimateInputTokens estimates the input_tokens Anthropic's count_tokens
+// would return for an Anthropic-format body: a token per charsPerToken
+// characters of the system prompt, message content and tool definitions,
+// and imageTokens per image.
+func estimateInputTokens(body map[string]any) int {
+	var est tokenEstimate
+	est.addSystem(body["system"])
+	messages, _ := body["messages"].([]any)
+	for _, m := range messages {
+		est.addMessage(m)
+	}
+	est.addTools(body["tools"])
+	return est.tokens()
+}
+
+// estimateSpooledInputTokens is estimateInputTokens for a spooled body. Only
+// one message is decoded at a time, so the body isn't held in memory.
+func estimateSpooledInputTokens(r io.Reader) (int, error) {
+	var est tokenEstimate
+	dec := json.NewDecoder(r)
+	if _, err := dec.Token(); err != nil {
+		return 0, err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return 0, err
+		}
+		switch tok {
+		case "messages":
+			if _, err := dec.Token(); err != nil {
+				return 0, err
+			}
+			for dec.More() {
+				var m any
+				if err := dec.Decode(&m); err != nil {
+					return 0, err
+				}
+				est.addMessage(m)
+			}
+			if _, err := dec.Token(); err != nil {
+				return 0, err
+			}
+		case "system", "tools":
+			var v any
+			if err := dec.Decode(&v); err != nil {
+				return 0, err
+			}
+			if tok == "system" {
+				est.addSystem(v)
+			} else {
+				est.addTools(v)
+			}
+		default:
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return est.tokens(), nil
+}
+
+// tokenEstimate adds up the parts of a body estimateInputTokens counts.
+type tokenEstimate struct {
+	chars, images int
+}
+
+func (e *tokenEstimate) addSystem(system any) {
+	switch sys := system.(type) {
+	case string:
+		e.chars += utf8.RuneCountInString(sys)
+	case []any:
+		for _, block := range sys {
+			e.chars += blockChars(block, &e.images)
+		}
+	}
+}
+
+func (e *tokenEstimate) addMessage(m any) {
+	msg, _ := m.(map[string]any)
+	switch content := msg["content"].(type) {
+	case string:
+		e.chars += utf8.RuneCountInString(content)
+	case []any:
+		for _, block := range content {
+			e.chars += blockChars(block, &e.images)
+		}
+	}
+}
+
+func (e *tokenEstimate) addTools(v any) {
+	tools, _ := v.([]any)
+	for _, tool := range tools {
+		e.chars += jsonChars(tool)
+	}
+}
+
+func (e *tokenEstimate) tokens() int {
+	return max(1, (e.chars+charsPerToken-1)/charsPerToken+e.images*imageTokens)
+}
+
+// blockChars returns the characters of a content block that count toward
+// its tokens, adding images to images.
+func blockChars(v any, images *int) int {
+	block, ok := v.(map[string]any)
+	if !ok {
+		s, _ := v.(string)
+		return utf8.RuneCountInString(s)
+	}
+	switch block["type"] {
+	case "text":
+		s, _ := block["text"].(string)
+		return utf8.RuneCountInString(s)
+	case "thinking":
+		s, _ := block["thinking"].(string)
+		return utf8.RuneCountInString(s)
+	case "image":
+		*images++
+		return 0
+	case "tool_use":
+		name, _ := block["name"].(string)
+		return utf8.RuneCountInString(name) + jsonChars(block["input"])
+	case "tool_result":
+		switch content := block["content"].(type) {
+		case string:
+			return utf8.RuneCountInString(content)
+		case []any:
+			n := 0
+			for _, b := range content {
+				n += blockChars(b, images)
+			}
+			return n
+		}
+		return 0
+	default:
+		return jsonChars(block)
+	}
+}
+
+func jsonChars(v any) int {
+	b, _ := json.Marshal(v)
+	return utf8.RuneCount(b)
+}
+
+// writeEstimatedTokenCount answers count_tokens with an estimate for the
+// body instead of forwarding it. A spooled body that can't be read back is
+// estimated from its size.
+func (b *requestBody) writeEstimatedTokenCount(w http.ResponseWriter) int {
+	tokens := 0
+	if b.spool != nil {
+		body, _ := b.spool.reader()
+		var err error
+		if tokens, err = estimateSpooledInputTokens(body); err != nil {
+			tokens = int(b.spool.size / charsPerToken)
+		}
+	} else {
+		tokens = estimateInputTokens(b.anthropic)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"input_tokens":%d}`, tokens)
+	return tokens
+}
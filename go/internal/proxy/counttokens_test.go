@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEstimateInputTokens(t *testing.T) {
+	text := strings.Repeat("word ", 80) // 400 characters
+	cases := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"empty", `{"messages":[]}`, 1},
+		{"string content", `{"messages":[{"role":"user","content":"` + text + `"}]}`, 100},
+		{"system", `{"system":"` + text + `","messages":[{"role":"user","content":[{"type":"text","text":"` + text + `"}]}]}`, 200},
+		{"system blocks", `{"system":[{"type":"text","text":"` + text + `"}],"messages":[]}`, 100},
+		{"image", `{"messages":[{"role":"user","content":[{"type":"image","source":{"type":"base64","media_type":"image/png","data":"` + strings.Repeat("A", 4000) + `"}},{"type":"text","text":"` + text + `"}]}]}`, 100 + imageTokens},
+		{"tool use", `{"messages":[{"role":"assistant","content":[{"type":"tool_use","id":"t1","name":"read","input":{"path":"/tmp/a"}}]}]}`, 6},
+		{"tool result", `{"messages":[{"role":"user","content":[{"type":"tool_result","tool_use_id":"t1","content":[{"type":"text","text":"` + text + `"},{"type":"image","source":{}}]}]}]}`, 100 + imageTokens},
+		{"tools", `{"tools":[{"name":"read","description":"Read a file","input_schema":{"type":"object"}}],"messages":[]}`, 19},
+	}
+	for _, tc := range cases {
+		var body map[string]any
+		if err := json.Unmarshal([]byte(tc.body), &body); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got := estimateInputTokens(body); got != tc.want {
+			t.Errorf("%s: estimateInputTokens = %d, want %d", tc.name, got, tc.want)
+		}
+		if got, err := estimateSpooledInputTokens(strings.NewReader(tc.body)); got != tc.want || err != nil {
+			t.Errorf("%s: estimateSpooledInputTokens = %d, %v, want %d", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestCountTokens(t *testing.T) {
+	const body = `{"model":"claude-sonnet-4-20250514","system":"Be brief.","tools":[{"name":"read","input_schema":{"type":"object"}}],"messages":[{"role":"user","content":[{"type":"text","text":"What is in this picture?"},{"type":"image","source":{"type":"url","url":"https://example.com/a.png"}}]}]}`
+	countTokens := func(t *testing.T) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		Handler().ServeHTTP(w, httptest.NewRequest("POST", "/v1/messages/count_tokens", strings.NewReader(body)))
+		return w
+	}
+
+	t.Run("estimated for OpenAI-compatible accounts", func(t *testing.T) {
+		tdb := dbtest.Open(t)
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("provider was sent %s", r.URL.Path)
+			w.WriteHeader(404)
+		}))
+		defer upstream.Close()
+		tdb.AddAccount("acct-openai", "openai", "openai", upstream.URL)
+
+		w := countTokens(t)
+		var got struct {
+			InputTokens int `json:"input_tokens"`
+		}
+		if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &got) != nil {
+			t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+		}
+		if got.InputTokens <= imageTokens || got.InputTokens > imageTokens+50 {
+			t.Errorf("input_tokens = %d, want an image and some text", got.InputTokens)
+		}
+	})
+
+	t.Run("estimated for spooled bodies", func(t *testing.T) {
+		tdb := dbtest.Open(t)
+		tdb.SetSetting("body_spool_threshold_mb", "0.0001")
+		tdb.AddAccount("acct-openai", "openai", "openai", "http://127.0.0.1:1")
+
+		// A megabyte of base64 is one image, not a quarter million tokens
+		spooled := `{"model":"claude-sonnet-4-20250514","messages":[{"role":"user","content":[{"type":"text","text":"What is in this picture?"},` +
+			`{"type":"image","source":{"type":"base64","media_type":"image/png","data":"` + strings.Repeat("A", 1<<20) + `"}}]}]}`
+		w := httptest.NewRecorder()
+		Handler().ServeHTTP(w, httptest.NewRequest("POST", "/v1/messages/count_tokens", strings.NewReader(spooled)))
+		var got struct {
+			InputTokens int `json:"input_tokens"`
+		}
+		if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &got) != nil {
+			t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+		}
+		if got.InputTokens != imageTokens+6 {
+			t.Errorf("input_tokens = %d, want %d", got.InputTokens, imageTokens+6)
+		}
+	})
+
+	t.Run("forwarded to Anthropic accounts", func(t *testing.T) {
+		tdb := dbtest.Open(t)
+		var path string
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path = r.URL.Path
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"input_tokens":1234}`)
+		}))
+		defer upstream.Close()
+		tdb.AddAccount("acct-anthropic", "anthropic", "anthropic", upstream.URL)
+
+		w := countTokens(t)
+		if w.Code != 200 || !strings.Contains(w.Body.String(), `"input_tokens":1234`) {
+			t.Errorf("status = %d, body = %s", w.Code, w.Body.String())
+		}
+		if path != countTokensPath {
+			t.Errorf("provider was sent %q, want %q", path, countTokensPath)
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/events"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// eventsKeepAlive is how often an idle event stream gets a comment line, so
+// intermediaries don't close it.
+const eventsKeepAlive = 15 * time.Second
+
+// handleEvents streams proxy state changes as server-sent events, one JSON
+// events.Event per message with the event type as the SSE event name. It
+// takes the same credentials as /admin/status.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		writeError(w, r, "anthropic", 401, "authentication_error", "Admin events require the proxy API key")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, "anthropic", 500, "api_error", "Streaming unsupported")
+		return
+	}
+
+	ch, cancel := events.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	// Lets clients know they are subscribed before the first event
+	fmt.Fprint(w, ": subscribed\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-ch:
+			data, _ := json.Marshal(ev)
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
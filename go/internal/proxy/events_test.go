@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"bufio"
+	"codegate-proxy/internal/cooldown"
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/events"
+	"codegate-proxy/internal/tenant"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminEvents_StreamsStateChanges(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+	tdb.AddAccount("acct-ev", "events", "anthropic", "")
+
+	// Status events only fire on a change from what this process last wrote
+	db.SetStatus("acct-ev", db.StatusActive, "")
+
+	srv := httptest.NewServer(Handler())
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/admin/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status = %d, content type = %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	lines := bufio.NewScanner(resp.Body)
+	if !lines.Scan() || lines.Text() != ": subscribed" {
+		t.Fatalf("first line = %q", lines.Text())
+	}
+
+	cooldown.Set("acct-ev", "test", 30)
+	t.Cleanup(func() { cooldown.Clear("acct-ev") })
+	db.SetStatus("acct-ev", db.StatusRateLimited, "")
+
+	// Other tests' async writes may publish too; only this account's count
+	var got []events.Event
+	var name string
+	for len(got) < 2 && lines.Scan() {
+		line := lines.Text()
+		if v, ok := strings.CutPrefix(line, "event: "); ok {
+			name = v
+			continue
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var ev events.Event
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			t.Fatalf("event data %q: %v", data, err)
+		}
+		if ev.Type != name {
+			t.Errorf("SSE event name %q, payload type %q", name, ev.Type)
+		}
+		if ev.EntityID == "acct-ev" {
+			got = append(got, ev)
+		}
+	}
+	if len(got) != 2 || got[0].Type != events.CooldownSet || got[1].Type != events.AccountStatusChanged {
+		t.Fatalf("events = %+v, want cooldown.set then account.status_changed", got)
+	}
+	if got[0].Time.IsZero() || got[1].Time.Before(got[0].Time) {
+		t.Errorf("timestamps out of order: %+v", got)
+	}
+}
+
+func TestAdminEvents_RequiresAdminKey(t *testing.T) {
+	dbtest.Open(t)
+	t.Setenv("PROXY_API_KEY", "admin-key")
+
+	w := getStatus(t, "/admin/events", "wrong-key")
+	if w.Code != 401 {
+		t.Errorf("status = %d, want 401", w.Code)
+	}
+}
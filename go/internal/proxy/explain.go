@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/routing"
+	"codegate-proxy/internal/tenant"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// handleRouteExplain shows how a request would be routed without sending
+// it: GET /admin/route-explain?model=...&thinking=1&tools=1&images=1.
+// background=1 explains it for background-priority traffic. The optional
+// config parameter explains against a config other than the active one, as
+// a tenant pinned to it would see. Round-robin counters are left untouched.
+func handleRouteExplain(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		writeError(w, r, "anthropic", 401, "authentication_error", "Route explain requires the proxy API key")
+		return
+	}
+	q := r.URL.Query()
+	model := q.Get("model")
+	if model == "" {
+		writeError(w, r, "anthropic", 400, "invalid_request_error", "model is required")
+		return
+	}
+	flag := func(name string) bool {
+		v, _ := strconv.ParseBool(q.Get(name))
+		return v
+	}
+	traits := routing.RequestTraits{Thinking: flag("thinking"), Tools: flag("tools"), Images: flag("images"), Background: flag("background")}
+	if traits.Background {
+		traits.WindowReserve = routing.WindowReserve(db.GetSetting)
+	}
+
+	var t *tenant.Tenant
+	if configID := q.Get("config"); configID != "" {
+		t = &tenant.Tenant{ConfigID: configID}
+	}
+	_, exp, err := routing.Explain(model, t, traits)
+	if err != nil {
+		log.Printf("[explain] Failed to resolve %s: %v", model, err)
+		writeError(w, r, "anthropic", 500, "api_error", "Failed to resolve route")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(exp)
+}
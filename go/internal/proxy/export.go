@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/tenant"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportFlushEvery is how many rows are written between flushes, so long
+// exports reach the client in chunks rather than all at the end.
+const exportFlushEvery = 500
+
+var usageColumns = []string{
+	"created_at", "account_id", "account_name", "tenant_id", "tenant_name", "config_id", "tier",
+	"original_model", "routed_model", "input_tokens", "output_tokens",
+	"cache_read_tokens", "cache_write_tokens", "server_tool_requests", "cost_usd",
+	"end_user", "tags",
+}
+
+var groupColumns = []string{
+	"key", "name", "requests", "input_tokens", "output_tokens",
+	"cache_read_tokens", "cache_write_tokens", "cost_usd",
+}
+
+var attemptColumns = []string{
+	"created_at", "request_id", "account_id", "account_name", "tenant_id", "tenant_name",
+	"routed_model", "status_code", "latency_ms", "reason", "retry", "error",
+}
+
+var attemptGroupColumns = []string{"key", "name", "attempts", "latency_ms"}
+
+// handleUsageExport streams usage rows as CSV or JSONL:
+//
+//	GET /admin/usage/export?from=YYYY-MM-DD&to=YYYY-MM-DD&format=csv|jsonl&group=day|account|tenant|model|end_user|tag:<key>&limit=N
+//
+// from defaults to the start of the current month and to to today. The proxy
+// API key exports everything (optionally ?tenant=<id>); a tenant key exports
+// only that tenant's usage. end_user=<id> and tags=k=v,k=v (as sent in
+// X-CodeGate-Tags) narrow it further. view=attempts exports the failed
+// attempts of requests that failed over instead, linked to their usage rows
+// by request_id; grouped, it counts them and sums their latency.
+func handleUsageExport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var tenantID string
+	if !adminAuthorized(r) {
+		t := tenant.Resolve(extractAPIKey(r))
+		if t == nil {
+			writeError(w, r, "anthropic", 401, "authentication_error", "Usage export requires the proxy API key or a tenant key")
+			return
+		}
+		tenantID = t.ID
+	} else {
+		tenantID = q.Get("tenant")
+	}
+
+	now := time.Now().UTC()
+	f := db.UsageFilter{
+		From:     q.Get("from"),
+		To:       q.Get("to"),
+		TenantID: tenantID,
+		EndUser:  q.Get("end_user"),
+	}
+	if f.From == "" {
+		f.From = now.Format("2006-01") + "-01"
+	}
+	if f.To == "" {
+		f.To = now.Format("2006-01-02")
+	}
+	for _, d := range []string{f.From, f.To} {
+		if _, err := time.Parse("2006-01-02", d); err != nil {
+			writeError(w, r, "anthropic", 400, "invalid_request_error", fmt.Sprintf("Invalid date %q (want YYYY-MM-DD)", d))
+			return
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeError(w, r, "anthropic", 400, "invalid_request_error", "limit must be a non-negative integer")
+			return
+		}
+		f.Limit = n
+	}
+	tags, err := parseTags(q.Get("tags"))
+	if err != nil {
+		writeError(w, r, "anthropic", 400, "invalid_request_error", "tags: "+err.Error())
+		return
+	}
+	f.Tags = tags
+
+	format := q.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "jsonl" {
+		writeError(w, r, "anthropic", 400, "invalid_request_error", "format must be csv or jsonl")
+		return
+	}
+	view := q.Get("view")
+	if view != "" && view != "usage" && view != "attempts" {
+		writeError(w, r, "anthropic", 400, "invalid_request_error", "view must be usage or attempts")
+		return
+	}
+	group := q.Get("group")
+	if _, ok := db.UsageGrouping(group); group != "" && !ok {
+		writeError(w, r, "anthropic", 400, "invalid_request_error", "group must be day, account, tenant, model, end_user, or tag:<key>")
+		return
+	}
+
+	filename := "codegate-usage-" + f.From + "-to-" + f.To
+	if view == "attempts" {
+		filename = "codegate-attempts-" + f.From + "-to-" + f.To
+	}
+	if group != "" {
+		filename += "-by-" + strings.ReplaceAll(group, ":", "-")
+	}
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, filename, format))
+
+	out := newExportWriter(w, format)
+	switch {
+	case view == "attempts" && group == "":
+		out.header(attemptColumns)
+		err = db.StreamAttempts(r.Context(), f, func(a db.AttemptRecord) error {
+			return out.row(a, []string{
+				a.CreatedAt, a.RequestID, a.AccountID, a.AccountName, a.TenantID, a.TenantName,
+				a.RoutedModel, strconv.Itoa(a.StatusCode), strconv.Itoa(a.LatencyMs), a.Reason,
+				strconv.FormatBool(a.Retry), a.Error,
+			})
+		})
+	case view == "attempts":
+		out.header(attemptGroupColumns)
+		err = db.StreamAttemptGroups(r.Context(), f, group, func(g db.AttemptGroup) error {
+			return out.row(g, []string{g.Key, g.Name, strconv.Itoa(g.Attempts), strconv.Itoa(g.LatencyMs)})
+		})
+	case group == "":
+		out.header(usageColumns)
+		err = db.StreamUsage(r.Context(), f, func(u db.UsageRecord) error {
+			return out.row(u, []string{
+				u.CreatedAt, u.AccountID, u.AccountName, u.TenantID, u.TenantName, u.ConfigID, u.Tier,
+				u.OriginalModel, u.RoutedModel, strconv.Itoa(u.InputTokens), strconv.Itoa(u.OutputTokens),
+				strconv.Itoa(u.CacheReadTokens), strconv.Itoa(u.CacheWriteTokens), strconv.Itoa(u.ServerToolRequests),
+				strconv.FormatFloat(u.CostUSD, 'f', -1, 64), u.EndUser, formatTags(u.Tags),
+			})
+		})
+	default:
+		out.header(groupColumns)
+		err = db.StreamUsageGroups(r.Context(), f, group, func(g db.UsageGroup) error {
+			return out.row(g, []string{
+				g.Key, g.Name, strconv.Itoa(g.Requests), strconv.Itoa(g.InputTokens), strconv.Itoa(g.OutputTokens),
+				strconv.Itoa(g.CacheReadTokens), strconv.Itoa(g.CacheWriteTokens),
+				strconv.FormatFloat(g.CostUSD, 'f', -1, 64),
+			})
+		})
+	}
+	if ferr := out.flush(); err == nil {
+		err = ferr
+	}
+	if err != nil && r.Context().Err() == nil {
+		// Headers are already sent; the truncated body is all we can signal
+		log.Printf("[export] Usage export failed after %d rows: %v", out.rows, err)
+	}
+}
+
+// exportWriter writes rows as RFC 4180 CSV (CRLF line endings, quoted
+// fields where needed) or as one JSON object per line, flushing every
+// exportFlushEvery rows.
+type exportWriter struct {
+	csv     *csv.Writer
+	json    *json.Encoder
+	rows    int
+	flusher http.Flusher
+}
+
+func newExportWriter(w http.ResponseWriter, format string) *exportWriter {
+	e := &exportWriter{}
+	e.flusher, _ = w.(http.Flusher)
+	if format == "csv" {
+		e.csv = csv.NewWriter(w)
+		e.csv.UseCRLF = true
+	} else {
+		e.json = json.NewEncoder(w)
+	}
+	return e
+}
+
+func (e *exportWriter) header(cols []string) {
+	if e.csv != nil {
+		e.csv.Write(cols)
+	}
+}
+
+// row writes v as JSON, or fields as a CSV record.
+func (e *exportWriter) row(v any, fields []string) error {
+	var err error
+	if e.csv != nil {
+		err = e.csv.Write(fields)
+	} else {
+		err = e.json.Encode(v)
+	}
+	if err != nil {
+		return err
+	}
+	e.rows++
+	if e.rows%exportFlushEvery == 0 {
+		return e.flush()
+	}
+	return nil
+}
+
+func (e *exportWriter) flush() error {
+	if e.csv != nil {
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if e.flusher != nil {
+		e.flusher.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"bufio"
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/tenant"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flushRecorder counts flushes so tests can tell a streamed export from a
+// buffered one.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (f *flushRecorder) Flush() {
+	f.flushes++
+	f.ResponseRecorder.Flush()
+}
+
+func exportUsage(t *testing.T, target, apiKey string) *flushRecorder {
+	t.Helper()
+	req := httptest.NewRequest("GET", target, nil)
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	Handler().ServeHTTP(w, req)
+	return w
+}
+
+var today = time.Now().UTC().Format("2006-01-02")
+
+func TestUsageExport_CSVEscaping(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+	tdb.AddAccount("acct-1", "Team, \"Prod\"", "openai", "")
+	tdb.Exec(`INSERT INTO usage (id, account_id, routed_model, original_model, input_tokens, cost_usd)
+		VALUES ('u1', 'acct-1', 'vendor/model,"beta"', 'line
+break', 10, 0.125)`)
+
+	w := exportUsage(t, "/admin/usage/export?from="+today+"&to="+today, "")
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	want := `attachment; filename="codegate-usage-` + today + `-to-` + today + `.csv"`
+	if got := w.Header().Get("Content-Disposition"); got != want {
+		t.Errorf("Content-Disposition = %q, want %q", got, want)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `"vendor/model,""beta"""`) || !strings.Contains(body, `"Team, ""Prod"""`) {
+		t.Errorf("fields not RFC 4180 quoted:\n%s", body)
+	}
+	if !strings.HasPrefix(body, strings.Join(usageColumns, ",")+"\r\n") {
+		t.Errorf("header line missing or not CRLF-terminated:\n%q", body)
+	}
+
+	records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatalf("parse CSV: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want header + 1", len(records))
+	}
+	row := records[1]
+	if row[2] != `Team, "Prod"` || row[7] != "line\nbreak" || row[8] != `vendor/model,"beta"` || row[14] != "0.125" {
+		t.Errorf("row = %q", row)
+	}
+}
+
+func TestUsageExport_StreamsLargeExports(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+	tdb.AddAccount("acct-1", "alpha", "anthropic", "")
+	tdb.Exec(`WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 3000)
+		INSERT INTO usage (id, account_id, routed_model, input_tokens, output_tokens, cost_usd)
+		SELECT 'u' || i, 'acct-1', 'claude-sonnet-4', i, 1, 0.001 FROM n`)
+
+	w := exportUsage(t, "/admin/usage/export?format=jsonl&from="+today+"&to="+today, "")
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	lines := 0
+	sc := bufio.NewScanner(w.Body)
+	for sc.Scan() {
+		var rec map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("line %d: %v", lines+1, err)
+		}
+		if rec["account_name"] != "alpha" {
+			t.Fatalf("line %d: account_name = %v", lines+1, rec["account_name"])
+		}
+		lines++
+	}
+	if lines != 3000 {
+		t.Errorf("exported %d rows, want 3000", lines)
+	}
+	if w.flushes < 3000/exportFlushEvery {
+		t.Errorf("flushed %d times, want at least %d", w.flushes, 3000/exportFlushEvery)
+	}
+
+	w = exportUsage(t, "/admin/usage/export?format=jsonl&limit=1000&from="+today+"&to="+today, "")
+	if n := strings.Count(w.Body.String(), "\n"); n != 1000 {
+		t.Errorf("limit=1000 exported %d rows", n)
+	}
+
+	w = exportUsage(t, "/admin/usage/export?group=account&from="+today+"&to="+today, "")
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("parse CSV: %v", err)
+	}
+	if len(records) != 2 || records[1][0] != "acct-1" || records[1][1] != "alpha" || records[1][2] != "3000" {
+		t.Errorf("group=account records = %q", records)
+	}
+}
+
+func TestUsageExport_TenantKeyScoped(t *testing.T) {
+	tdb := dbtest.Open(t)
+	t.Setenv("PROXY_API_KEY", "admin-secret")
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+
+	sum := sha256.Sum256([]byte("cgk_acme"))
+	tdb.Exec("INSERT INTO tenants (id, name, api_key_hash, api_key_prefix) VALUES ('t1', 'Acme', ?, 'cgk_acme'), ('t2', 'Other', 'other-hash', 'cgk_othe')",
+		hex.EncodeToString(sum[:]))
+	tdb.Exec("INSERT INTO usage (id, tenant_id, routed_model) VALUES ('u1', 't1', 'm1'), ('u2', 't2', 'm2'), ('u3', 't2', 'm3')")
+
+	// A tenant key only sees its own rows, even when asking for another tenant
+	w := exportUsage(t, "/admin/usage/export?format=jsonl&tenant=t2&from="+today+"&to="+today, "cgk_acme")
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if body := w.Body.String(); strings.Count(body, "\n") != 1 || !strings.Contains(body, `"tenant_name":"Acme"`) {
+		t.Errorf("tenant export = %s", body)
+	}
+
+	w = exportUsage(t, "/admin/usage/export?format=jsonl&tenant=t2&from="+today+"&to="+today, "admin-secret")
+	if n := strings.Count(w.Body.String(), "\n"); n != 2 {
+		t.Errorf("admin export for t2 returned %d rows, want 2", n)
+	}
+
+	if w := exportUsage(t, "/admin/usage/export", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("bad key: status = %d, want 401", w.Code)
+	}
+}
+
+func TestUsageExport_ChargebackDimensions(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+	tdb.Exec(`INSERT INTO usage (id, routed_model, end_user, tags, input_tokens, cost_usd) VALUES
+		('u1', 'm', 'alice', '{"team":"search","project":"ranking"}', 10, 0.5),
+		('u2', 'm', 'alice', '{"team":"search"}', 20, 0.25),
+		('u3', 'm', 'bob', '{"team":"ads"}', 40, 1),
+		('u4', 'm', NULL, NULL, 80, 2)`)
+	span := "&from=" + today + "&to=" + today
+
+	w := exportUsage(t, "/admin/usage/export?group=tag:team"+span, "")
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("parse CSV: %v", err)
+	}
+	want := [][]string{{"", "1", "80"}, {"ads", "1", "40"}, {"search", "2", "30"}}
+	if len(records) != 4 {
+		t.Fatalf("group=tag:team records = %q", records)
+	}
+	for i, row := range records[1:] {
+		if row[0] != want[i][0] || row[2] != want[i][1] || row[3] != want[i][2] {
+			t.Errorf("group=tag:team row %d = %q, want key/requests/input %q", i, row, want[i])
+		}
+	}
+
+	w = exportUsage(t, "/admin/usage/export?format=jsonl&group=end_user&tags=team=search"+span, "")
+	if body := w.Body.String(); strings.Count(body, "\n") != 1 || !strings.Contains(body, `"key":"alice","name":"","requests":2`) {
+		t.Errorf("group=end_user filtered by team=search = %s", body)
+	}
+
+	w = exportUsage(t, "/admin/usage/export?end_user=alice&tags=team=search,project=ranking"+span, "")
+	records, err = csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("parse CSV: %v", err)
+	}
+	if len(records) != 2 || records[1][15] != "alice" || records[1][16] != "project=ranking,team=search" {
+		t.Errorf("filtered rows = %q", records)
+	}
+}
+
+func TestUsageExport_Attempts(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+	tdb.AddAccount("acct-1", "flaky", "anthropic", "")
+	tdb.AddAccount("acct-2", "steady", "anthropic", "")
+	tdb.Exec(`INSERT INTO usage (id, account_id, routed_model, request_id) VALUES ('u1', 'acct-2', 'm', 'req-1')`)
+	tdb.Exec(`INSERT INTO request_attempts (id, request_id, account_id, routed_model, status_code, latency_ms, reason, retry) VALUES
+		('a1', 'req-1', 'acct-1', 'm', 503, 120, 'server_error', 1),
+		('a2', 'req-1', 'acct-1', 'm', 503, 80, 'server_error', 0),
+		('a3', 'req-2', 'acct-2', 'm', 0, 30, 'connection_error', 0)`)
+	span := "&from=" + today + "&to=" + today
+
+	w := exportUsage(t, "/admin/usage/export?view=attempts"+span, "")
+	if want := `attachment; filename="codegate-attempts-` + today + `-to-` + today + `.csv"`; w.Header().Get("Content-Disposition") != want {
+		t.Errorf("Content-Disposition = %q", w.Header().Get("Content-Disposition"))
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("parse CSV: %v", err)
+	}
+	if len(records) != 4 || strings.Join(records[0], ",") != strings.Join(attemptColumns, ",") {
+		t.Fatalf("records = %q", records)
+	}
+	if row := records[1]; row[1] != "req-1" || row[3] != "flaky" || row[7] != "503" || row[8] != "120" || row[9] != "server_error" || row[10] != "true" {
+		t.Errorf("row = %q", row)
+	}
+
+	w = exportUsage(t, "/admin/usage/export?view=attempts&format=jsonl&group=account"+span, "")
+	body := w.Body.String()
+	if !strings.Contains(body, `{"key":"acct-1","name":"flaky","attempts":2,"latency_ms":200}`) ||
+		!strings.Contains(body, `{"key":"acct-2","name":"steady","attempts":1,"latency_ms":30}`) {
+		t.Errorf("group=account = %s", body)
+	}
+}
+
+func TestUsageExport_BadParams(t *testing.T) {
+	dbtest.Open(t)
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+	for _, q := range []string{"from=2024-13-01", "format=xml", "group=week", "group=tag:Team", "tags=team", "limit=-1", "view=errors"} {
+		if w := exportUsage(t, "/admin/usage/export?"+q, ""); w.Code != 400 {
+			t.Errorf("%s: status = %d, want 400", q, w.Code)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/routing"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// noFailoverHeader lets clients send side-effectful turns to a single
+// account: an upstream error is returned as-is instead of being retried
+// elsewhere. The proxy echoes it on the response when honored.
+var noFailoverHeader = exposeHeader(allowHeader("X-CodeGate-No-Failover"))
+
+// noFailoverRequested reports whether the client set noFailoverHeader.
+func noFailoverRequested(h http.Header) bool {
+	v := strings.ToLower(strings.TrimSpace(h.Get(noFailoverHeader)))
+	return v == "true" || v == "1"
+}
+
+// limitCandidates applies the failover_enabled and max_failover_candidates
+// settings, and the first candidate's account overrides of both, to the
+// ordered candidate list: with failover disabled only the first candidate is
+// kept, and the cap bounds how many fallbacks follow it. Where the setting
+// and the account disagree the stricter one wins. It reports whether any
+// candidates were dropped.
+func limitCandidates(cands []routing.Candidate, getSetting func(string) string) ([]routing.Candidate, bool) {
+	if len(cands) == 0 {
+		return cands, false
+	}
+	primary := cands[0].Account
+	keep := len(cands)
+	if getSetting("failover_enabled") == "false" || primary.NoFailover {
+		keep = 1
+	}
+	if n, err := strconv.Atoi(strings.TrimSpace(getSetting("max_failover_candidates"))); err == nil && n >= 0 && 1+n < keep {
+		keep = 1 + n
+	}
+	if n := primary.MaxFailoverCandidates; n.Valid && n.Int64 >= 0 && 1+int(n.Int64) < keep {
+		keep = 1 + int(n.Int64)
+	}
+	if keep >= len(cands) {
+		return cands, false
+	}
+	return cands[:keep], true
+}
+
+// parseStatusList parses the comma-separated failover_unsafe_statuses
+// setting. Entries that aren't HTTP status codes are ignored.
+func parseStatusList(s string) map[int]bool {
+	var out map[int]bool
+	for _, part := range strings.Split(s, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || code < 100 || code > 599 {
+			continue
+		}
+		if out == nil {
+			out = make(map[int]bool)
+		}
+		out[code] = true
+	}
+	return out
+}
+
+// hasToolSideEffects reports whether an Anthropic-format request may have
+// triggered tool side effects upstream: it forces a specific tool, or its
+// last message returns tool results mid-loop. Such requests aren't retried
+// on the statuses listed in failover_unsafe_statuses.
+func hasToolSideEffects(body map[string]any) bool {
+	if body == nil {
+		return false
+	}
+	if tc, ok := body["tool_choice"].(map[string]any); ok && tc["type"] == "tool" {
+		return true
+	}
+	msgs, ok := body["messages"].([]any)
+	if !ok || len(msgs) == 0 {
+		return false
+	}
+	last, ok := msgs[len(msgs)-1].(map[string]any)
+	if !ok || last["role"] != "user" {
+		return false
+	}
+	blocks, _ := last["content"].([]any)
+	for _, b := range blocks {
+		if bm, ok := b.(map[string]any); ok && bm["type"] == "tool_result" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,410 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/cooldown"
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/guardrails"
+	"codegate-proxy/internal/health"
+	"codegate-proxy/internal/routing"
+	"codegate-proxy/internal/tenant"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// failoverPair configures a primary account that returns 502 and a backup
+// that succeeds, and returns a counter of requests the backup served.
+func failoverPair(t *testing.T, tdb *dbtest.DB) *atomic.Int32 {
+	t.Helper()
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(502)
+		fmt.Fprint(w, `{"type":"error","error":{"type":"api_error","message":"bad gateway"}}`)
+	}))
+	t.Cleanup(primary.Close)
+	var backupHits atomic.Int32
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backupHits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	t.Cleanup(backup.Close)
+
+	tdb.AddAccount("acct-primary", "primary", "anthropic", primary.URL)
+	tdb.AddAccount("acct-backup", "backup", "anthropic", backup.URL)
+	tdb.Exec("INSERT INTO configs (id, name, is_active) VALUES ('cfg', 'default', 1)")
+	tdb.Exec("INSERT INTO config_tiers (id, config_id, tier, account_id, priority) VALUES ('ct1', 'cfg', 'sonnet', 'acct-primary', 10)")
+	tdb.Exec("INSERT INTO config_tiers (id, config_id, tier, account_id, priority) VALUES ('ct2', 'cfg', 'sonnet', 'acct-backup', 5)")
+	// Failures recorded by earlier tests would demote the primary
+	reset := func() {
+		cooldown.Clear("acct-primary")
+		cooldown.Clear("acct-backup")
+		health.Reset()
+	}
+	reset()
+	t.Cleanup(reset)
+	return &backupHits
+}
+
+func sendMessages(t *testing.T, body string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	// The primary's 502 puts it on cooldown; keep it first in line
+	cooldown.Clear("acct-primary")
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+	return w
+}
+
+const plainMessage = `{"model":"claude-sonnet-4-20250514","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`
+
+func TestNoFailoverHeader_SuppressesFailover(t *testing.T) {
+	tdb := dbtest.Open(t)
+	backupHits := failoverPair(t, tdb)
+
+	w := sendMessages(t, plainMessage, http.Header{"X-Codegate-No-Failover": {"true"}})
+	if w.Code != 502 {
+		t.Fatalf("status = %d, want the primary's 502 (body %s)", w.Code, w.Body.String())
+	}
+	if backupHits.Load() != 0 {
+		t.Errorf("backup served %d requests, want 0", backupHits.Load())
+	}
+	if got := w.Header().Get(noFailoverHeader); got != "true" {
+		t.Errorf("%s = %q, want true", noFailoverHeader, got)
+	}
+
+	w = sendMessages(t, plainMessage, nil)
+	if w.Code != 200 || backupHits.Load() != 1 {
+		t.Fatalf("without the header: status = %d, backup hits = %d; want failover to the backup", w.Code, backupHits.Load())
+	}
+	if w.Header().Get(noFailoverHeader) != "" {
+		t.Errorf("%s set on a request that didn't ask for it", noFailoverHeader)
+	}
+}
+
+func TestFailoverUnsafeStatuses(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("failover_unsafe_statuses", "502, 504")
+	backupHits := failoverPair(t, tdb)
+
+	forced := `{"model":"claude-sonnet-4-20250514","max_tokens":16,` +
+		`"tools":[{"name":"create_batch","input_schema":{"type":"object"}}],` +
+		`"tool_choice":{"type":"tool","name":"create_batch"},` +
+		`"messages":[{"role":"user","content":"go"}]}`
+	if w := sendMessages(t, forced, nil); w.Code != 502 || backupHits.Load() != 0 {
+		t.Fatalf("forced tool: status = %d, backup hits = %d; want 502 without failover", w.Code, backupHits.Load())
+	}
+
+	if w := sendMessages(t, plainMessage, nil); w.Code != 200 || backupHits.Load() != 1 {
+		t.Fatalf("plain request: status = %d, backup hits = %d; want failover to the backup", w.Code, backupHits.Load())
+	}
+}
+
+func TestHasToolSideEffects(t *testing.T) {
+	cases := []struct {
+		name string
+		body map[string]any
+		want bool
+	}{
+		{"nil", nil, false},
+		{"plain", map[string]any{"messages": []any{map[string]any{"role": "user", "content": "hi"}}}, false},
+		{"tool_choice auto", map[string]any{"tool_choice": map[string]any{"type": "auto"}}, false},
+		{"forced tool", map[string]any{"tool_choice": map[string]any{"type": "tool", "name": "x"}}, true},
+		{"tool result", map[string]any{"messages": []any{
+			map[string]any{"role": "assistant", "content": []any{map[string]any{"type": "tool_use", "id": "t1"}}},
+			map[string]any{"role": "user", "content": []any{map[string]any{"type": "tool_result", "tool_use_id": "t1"}}},
+		}}, true},
+		{"earlier tool result", map[string]any{"messages": []any{
+			map[string]any{"role": "user", "content": []any{map[string]any{"type": "tool_result", "tool_use_id": "t1"}}},
+			map[string]any{"role": "assistant", "content": "done"},
+			map[string]any{"role": "user", "content": "thanks"},
+		}}, false},
+	}
+	for _, c := range cases {
+		if got := hasToolSideEffects(c.body); got != c.want {
+			t.Errorf("%s: hasToolSideEffects = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestParseStatusList(t *testing.T) {
+	got := parseStatusList(" 502,abc,504 ,42,")
+	if len(got) != 2 || !got[502] || !got[504] {
+		t.Errorf("parseStatusList = %v, want 502 and 504", got)
+	}
+	if parseStatusList("") != nil {
+		t.Error("empty setting should parse to nil")
+	}
+}
+
+func TestGuardrails_FailoverForwardsSameAnonymizedBody(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("provider_retry_count", "0")
+	tdb.SetSetting("privacy_enabled", "true")
+	guardrails.InitGuardrails()
+
+	var bodies []string
+	record := func(status int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			bodies = append(bodies, string(b))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+		}
+	}
+	primary := httptest.NewServer(record(502))
+	defer primary.Close()
+	backup := httptest.NewServer(record(200))
+	defer backup.Close()
+	tdb.AddAccount("acct-primary", "primary", "anthropic", primary.URL)
+	tdb.AddAccount("acct-backup", "backup", "anthropic", backup.URL)
+	tdb.Exec("INSERT INTO configs (id, name, is_active) VALUES ('cfg', 'default', 1)")
+	tdb.Exec("INSERT INTO config_tiers (id, config_id, tier, account_id, priority) VALUES ('ct1', 'cfg', 'sonnet', 'acct-primary', 10)")
+	tdb.Exec("INSERT INTO config_tiers (id, config_id, tier, account_id, priority) VALUES ('ct2', 'cfg', 'sonnet', 'acct-backup', 5)")
+	t.Cleanup(func() {
+		cooldown.Clear("acct-primary")
+		cooldown.Clear("acct-backup")
+	})
+
+	w := sendMessages(t, `{"model":"claude-sonnet-4-20250514","max_tokens":16,`+
+		`"messages":[{"role":"user","content":"call 415-555-0134 or mail jane.doe@example.com"}]}`, nil)
+	if w.Code != 200 || len(bodies) != 2 {
+		t.Fatalf("status = %d after %d upstream requests, want 200 after failover", w.Code, len(bodies))
+	}
+
+	content := func(body string) string {
+		var parsed struct {
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		if err := json.Unmarshal([]byte(body), &parsed); err != nil || len(parsed.Messages) != 1 {
+			t.Fatalf("unexpected upstream body %s", body)
+		}
+		return parsed.Messages[0].Content
+	}
+	first, second := content(bodies[0]), content(bodies[1])
+	if first != second {
+		t.Errorf("candidates got different text:\n%s\n%s", first, second)
+	}
+	if strings.Contains(first, "415-555-0134") || strings.Contains(first, "jane.doe@example.com") {
+		t.Errorf("upstream saw the original values: %s", first)
+	}
+}
+
+func TestFailoverDisabledForTenant(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+	sum := sha256.Sum256([]byte("cgk_resident"))
+	tdb.Exec("INSERT INTO tenants (id, name, api_key_hash, api_key_prefix) VALUES ('t1', 'Resident', ?, 'cgk_resi')", hex.EncodeToString(sum[:]))
+	tdb.Exec("INSERT INTO tenant_settings (tenant_id, key, value) VALUES ('t1', 'failover_enabled', 'false')")
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(429)
+		fmt.Fprint(w, `{"type":"error","error":{"type":"rate_limit_error","message":"slow down"}}`)
+	}))
+	defer primary.Close()
+	backupHits := failoverPair(t, tdb)
+	tdb.Exec("UPDATE accounts SET base_url = ? WHERE id = 'acct-primary'", primary.URL)
+
+	w := sendMessages(t, plainMessage, http.Header{"Authorization": {"Bearer cgk_resident"}})
+	if w.Code != 429 {
+		t.Fatalf("status = %d, want the primary's 429 (body %s)", w.Code, w.Body.String())
+	}
+	if backupHits.Load() != 0 {
+		t.Errorf("backup served %d requests, want 0", backupHits.Load())
+	}
+	if got := w.Header().Get("X-Proxy-Strategy"); got != "config+no-failover" {
+		t.Errorf("X-Proxy-Strategy = %q, want config+no-failover", got)
+	}
+}
+
+func TestMaxFailoverCandidates(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("max_failover_candidates", "1")
+	failoverPair(t, tdb)
+
+	var lastHits atomic.Int32
+	last := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastHits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	defer last.Close()
+	tdb.AddAccount("acct-last", "last", "anthropic", last.URL)
+	tdb.Exec("INSERT INTO config_tiers (id, config_id, tier, account_id, priority) VALUES ('ct3', 'cfg', 'sonnet', 'acct-last', 1)")
+	// The backup fails too, leaving only the third account able to answer
+	tdb.Exec("UPDATE accounts SET base_url = (SELECT base_url FROM accounts WHERE id = 'acct-primary') WHERE id = 'acct-backup'")
+	t.Cleanup(func() { cooldown.Clear("acct-last") })
+
+	cooldown.Clear("acct-backup")
+	w := sendMessages(t, plainMessage, nil)
+	if w.Code != 502 {
+		t.Fatalf("status = %d, want 502 after one fallback (body %s)", w.Code, w.Body.String())
+	}
+	if lastHits.Load() != 0 {
+		t.Errorf("third account served %d requests, want only the primary and one fallback tried", lastHits.Load())
+	}
+
+	tdb.SetSetting("max_failover_candidates", "")
+	cooldown.Clear("acct-backup")
+	if w := sendMessages(t, plainMessage, nil); w.Code != 200 || lastHits.Load() != 1 {
+		t.Errorf("uncapped: status = %d, last hits = %d; want the third account to answer", w.Code, lastHits.Load())
+	}
+}
+
+func TestLimitCandidates(t *testing.T) {
+	cands := []routing.Candidate{{TargetModel: "a"}, {TargetModel: "b"}, {TargetModel: "c"}}
+	settings := map[string]string{}
+	get := func(k string) string { return settings[k] }
+
+	if got, limited := limitCandidates(cands, get); len(got) != 3 || limited {
+		t.Errorf("defaults: %d candidates, limited=%v", len(got), limited)
+	}
+	settings["max_failover_candidates"] = "1"
+	if got, limited := limitCandidates(cands, get); len(got) != 2 || !limited {
+		t.Errorf("cap 1: %d candidates, limited=%v", len(got), limited)
+	}
+	settings["max_failover_candidates"] = "5"
+	if got, limited := limitCandidates(cands, get); len(got) != 3 || limited {
+		t.Errorf("cap 5: %d candidates, limited=%v", len(got), limited)
+	}
+	settings["failover_enabled"] = "false"
+	if got, limited := limitCandidates(cands, get); len(got) != 1 || got[0].TargetModel != "a" || !limited {
+		t.Errorf("disabled: %v, limited=%v", got, limited)
+	}
+	if got, limited := limitCandidates(cands[:1], get); len(got) != 1 || limited {
+		t.Errorf("single candidate should not count as limited")
+	}
+
+	// The primary's account can restrict failover further, never loosen it
+	delete(settings, "failover_enabled")
+	acct := []routing.Candidate{{Account: db.Account{NoFailover: true}}, {}, {}}
+	if got, limited := limitCandidates(acct, get); len(got) != 1 || !limited {
+		t.Errorf("account disabled: %d candidates, limited=%v", len(got), limited)
+	}
+	acct[0].Account = db.Account{MaxFailoverCandidates: sql.NullInt64{Int64: 0, Valid: true}}
+	if got, limited := limitCandidates(acct, get); len(got) != 1 || !limited {
+		t.Errorf("account cap 0: %d candidates, limited=%v", len(got), limited)
+	}
+	settings["max_failover_candidates"] = "1"
+	acct[0].Account = db.Account{MaxFailoverCandidates: sql.NullInt64{Int64: 5, Valid: true}}
+	if got, _ := limitCandidates(acct, get); len(got) != 2 {
+		t.Errorf("account cap 5 under setting cap 1: %d candidates, want 2", len(got))
+	}
+	// Only the primary's overrides count
+	acct[0].Account, acct[1].Account = db.Account{}, db.Account{NoFailover: true}
+	delete(settings, "max_failover_candidates")
+	if got, limited := limitCandidates(acct, get); len(got) != 3 || limited {
+		t.Errorf("fallback's override applied: %d candidates, limited=%v", len(got), limited)
+	}
+}
+
+func TestFailoverDisabledForAccount(t *testing.T) {
+	tdb := dbtest.Open(t)
+	backupHits := failoverPair(t, tdb)
+	tdb.Exec("UPDATE accounts SET failover_enabled = 0 WHERE id = 'acct-primary'")
+
+	w := sendMessages(t, plainMessage, nil)
+	if w.Code != 502 || backupHits.Load() != 0 {
+		t.Errorf("status = %d, backup hits = %d; want the primary's 502 and no failover", w.Code, backupHits.Load())
+	}
+	if got := w.Header().Get("X-Proxy-Strategy"); got != "config+no-failover" {
+		t.Errorf("X-Proxy-Strategy = %q, want config+no-failover", got)
+	}
+}
+
+// An account already cooling down is routed around before the request is
+// sent, which isn't a failover; falling back after an upstream error is.
+func TestCooledDownPrimary_NotLabeledFailover(t *testing.T) {
+	tdb := dbtest.Open(t)
+	backupHits := failoverPair(t, tdb)
+
+	send := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		Handler().ServeHTTP(w, httptest.NewRequest("POST", "/v1/messages", strings.NewReader(plainMessage)))
+		if w.Code != 200 || w.Header().Get("X-Proxy-Account") != "backup" {
+			t.Fatalf("status = %d, account = %q", w.Code, w.Header().Get("X-Proxy-Account"))
+		}
+		return w
+	}
+
+	cooldown.Set("acct-primary", "test", 60)
+	if got := send().Header().Get("X-Proxy-Strategy"); got != "config" {
+		t.Errorf("primary cooling down: X-Proxy-Strategy = %q, want config", got)
+	}
+
+	cooldown.Clear("acct-primary")
+	if got := send().Header().Get("X-Proxy-Strategy"); got != "config+failover" {
+		t.Errorf("primary failed: X-Proxy-Strategy = %q, want config+failover", got)
+	}
+	if backupHits.Load() != 2 {
+		t.Errorf("backup served %d requests, want 2", backupHits.Load())
+	}
+}
+
+// A failover records the failed candidate in request_attempts, linked to
+// the final usage row by request ID.
+func TestFailover_RecordsAttempt(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("provider_retry_count", "0")
+	failoverPair(t, tdb)
+
+	if w := sendMessages(t, plainMessage, nil); w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var usageAccount, usageRequest string
+	waitFor(t, func() bool {
+		return tdb.QueryRow("SELECT account_id, COALESCE(request_id, '') FROM usage").Scan(&usageAccount, &usageRequest) == nil
+	})
+	var n, status, latency int
+	var account, request, reason string
+	tdb.QueryRow("SELECT COUNT(*) FROM request_attempts").Scan(&n)
+	if err := tdb.QueryRow("SELECT account_id, request_id, status_code, latency_ms, reason FROM request_attempts").
+		Scan(&account, &request, &status, &latency, &reason); err != nil || n != 1 {
+		t.Fatalf("%d attempt rows (%v), want 1", n, err)
+	}
+	if usageAccount != "acct-backup" || usageRequest == "" {
+		t.Errorf("usage row: account %q, request %q", usageAccount, usageRequest)
+	}
+	if account != "acct-primary" || request != usageRequest || status != 502 || reason != "server_error" || latency < 0 {
+		t.Errorf("attempt row: account %q, request %q, status %d, reason %q, latency %d", account, request, status, reason, latency)
+	}
+}
+
+// Attempts of a request every candidate failed are recorded without usage.
+func TestFailover_RecordsAttemptsWithoutUsage(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("provider_retry_count", "0")
+	flakyUpstream(t, tdb, "acct-first", 1, dropConnection)
+	flakyUpstream(t, tdb, "acct-second", 1, dropConnection)
+	tdb.AddActiveConfig("cfg", "default")
+	tdb.AddTier("cfg", "sonnet", "acct-first", 10, "")
+	tdb.AddTier("cfg", "sonnet", "acct-second", 5, "")
+
+	if w := sendMessages(t, plainMessage, nil); w.Code != 502 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var account, reason string
+	waitFor(t, func() bool {
+		return tdb.QueryRow("SELECT account_id, reason FROM request_attempts").Scan(&account, &reason) == nil
+	})
+	if account != "acct-first" || reason != "connection_error" {
+		t.Errorf("attempt row: account %q, reason %q", account, reason)
+	}
+}
@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/tenant"
+	"net/http"
+	"strings"
+)
+
+// guardrailsHeader lets trusted callers that handle PII themselves send and
+// receive exact values for one request.
+var guardrailsHeader = allowHeader("X-CodeGate-Guardrails")
+
+// guardrailsOptOut reports whether a request turns guardrails off: it sends
+// X-CodeGate-Guardrails: off and either authenticated with the global proxy
+// key or comes from a tenant whose own guardrails_optout_allowed setting is
+// true. Anyone else's header is ignored rather than rejected, so it can't be
+// used to probe what a key is allowed to do.
+func guardrailsOptOut(r *http.Request, adminKey bool, t *tenant.Tenant) bool {
+	if !strings.EqualFold(strings.TrimSpace(r.Header.Get(guardrailsHeader)), "off") {
+		return false
+	}
+	if adminKey {
+		return true
+	}
+	return t != nil && t.Settings["guardrails_optout_allowed"] == "true"
+}
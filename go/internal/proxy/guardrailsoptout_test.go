@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/guardrails"
+	"codegate-proxy/internal/tenant"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGuardrailsOptOut(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("privacy_enabled", "true")
+	tdb.SetSetting("request_logging", "true")
+	guardrails.InitGuardrails()
+	t.Setenv("PROXY_API_KEY", "admin-secret")
+
+	addTenant := func(id, key string) {
+		sum := sha256.Sum256([]byte(key))
+		tdb.Exec("INSERT INTO tenants (id, name, api_key_hash, api_key_prefix) VALUES (?, ?, ?, ?)", id, id, "hash-"+id, key[:8])
+		tdb.Exec("INSERT INTO tenant_keys (id, tenant_id, key_hash, key_prefix) VALUES (?, ?, ?, ?)", "k-"+id, id, hex.EncodeToString(sum[:]), key[:8])
+	}
+	addTenant("trusted", "cgk_trusted_key")
+	addTenant("other", "cgk_other_key")
+	tdb.Exec("INSERT INTO tenant_settings (tenant_id, key, value) VALUES ('trusted', 'guardrails_optout_allowed', 'true')")
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+
+	var sent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		sent = body.Messages[0].Content
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-optout", "optout", "anthropic", upstream.URL)
+
+	const email = "jane.doe@example.com"
+	cases := []struct {
+		name, key, header string
+		bypassed          bool
+	}{
+		{"admin key", "admin-secret", "off", true},
+		{"tenant allowed", "cgk_trusted_key", "OFF", true},
+		{"tenant not allowed", "cgk_other_key", "off", false},
+		{"no header", "admin-secret", "", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tdb.Exec("DELETE FROM request_logs")
+			h := http.Header{"Authorization": {"Bearer " + tc.key}}
+			if tc.header != "" {
+				h.Set(guardrailsHeader, tc.header)
+			}
+			w := sendMessages(t, `{"model":"claude-sonnet-4-20250514","max_tokens":16,`+
+				`"messages":[{"role":"user","content":"mail `+email+`"}]}`, h)
+			if w.Code != 200 {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			if got := strings.Contains(sent, email); got != tc.bypassed {
+				t.Errorf("upstream got %q; exact values sent = %v, want %v", sent, got, tc.bypassed)
+			}
+
+			var logged int
+			waitFor(t, func() bool {
+				return tdb.QueryRow("SELECT guardrails_bypassed FROM request_logs").Scan(&logged) == nil
+			})
+			if (logged == 1) != tc.bypassed {
+				t.Errorf("guardrails_bypassed = %d, want %v", logged, tc.bypassed)
+			}
+		})
+	}
+}
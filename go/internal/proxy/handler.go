@@ -1,22 +1,28 @@
 package proxy
 
 import (
+	"bytes"
 	"codegate-proxy/internal/auth"
 	"codegate-proxy/internal/convert"
 	"codegate-proxy/internal/cooldown"
 	"codegate-proxy/internal/db"
 	"codegate-proxy/internal/guardrails"
 	"codegate-proxy/internal/limits"
+	"codegate-proxy/internal/metrics"
 	"codegate-proxy/internal/models"
 	"codegate-proxy/internal/provider"
 	"codegate-proxy/internal/ratelimit"
 	"codegate-proxy/internal/routing"
+	"codegate-proxy/internal/subscription"
 	"codegate-proxy/internal/tenant"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"maps"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -26,10 +32,19 @@ func Handler() http.Handler {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("GET /health", handleHealth)
+	mux.HandleFunc("GET /ready", handleReady)
+	mux.HandleFunc("GET /metrics", handleMetrics)
+	mux.HandleFunc("GET /admin/status", handleStatus)
+	mux.HandleFunc("GET /admin/usage/export", handleUsageExport)
+	mux.HandleFunc("GET /admin/events", handleEvents)
+	mux.HandleFunc("GET /admin/route-explain", handleRouteExplain)
 	mux.HandleFunc("GET /v1/models", handleModels)
-	mux.HandleFunc("/v1/", handleProxy)
+	mux.HandleFunc("GET /v1/auth/check", handleAuthCheck)
+	mux.HandleFunc("/v1/", withMetrics(withRecover(handleProxy)))
 
-	return withCORS(mux)
+	// Proxied requests recover inside withMetrics, so their 500 is counted;
+	// this catches panics in every other handler
+	return withCORS(withRecover(mux.ServeHTTP))
 }
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -37,13 +52,100 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, `{"status":"ok","timestamp":"%s","version":"2.0.0-go"}`, time.Now().UTC().Format(time.RFC3339))
 }
 
-func handleModels(w http.ResponseWriter, r *http.Request) {
+// handleReady reports whether the proxy can serve requests. A read-only data
+// directory still serves traffic, so it reports "degraded" with 200 and lists
+// the features that are off; an unreadable database reports 503.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	type dbState struct {
+		Readable bool   `json:"readable"`
+		Writable bool   `json:"writable"`
+		Error    string `json:"error,omitempty"`
+	}
+	type keyState struct {
+		Source string `json:"source"`
+		Error  string `json:"error,omitempty"`
+	}
+	resp := struct {
+		Status           string    `json:"status"`
+		Database         dbState   `json:"database"`
+		GuardrailKey     *keyState `json:"guardrail_key,omitempty"`
+		DisabledFeatures []string  `json:"disabled_features,omitempty"`
+	}{Status: "ready", Database: dbState{Readable: true, Writable: db.Writable()}}
+
+	code := http.StatusOK
+	if err := db.Ping(); err != nil {
+		resp.Status = "unavailable"
+		resp.Database.Readable = false
+		resp.Database.Error = err.Error()
+		code = http.StatusServiceUnavailable
+	} else if !resp.Database.Writable {
+		resp.Status = "degraded"
+		resp.Database.Error = db.ReadOnlyReason()
+		resp.DisabledFeatures = db.ReadOnlyFeatures
+	}
+
+	if source := guardrails.Stats().KeySource; source != "" {
+		resp.GuardrailKey = &keyState{Source: source}
+		if err := guardrails.KeyError(); err != nil {
+			resp.GuardrailKey.Error = err.Error()
+			if resp.Status == "ready" {
+				resp.Status = "degraded"
+			}
+			resp.DisabledFeatures = append(slices.Clip(resp.DisabledFeatures), "deanonymization of tokens issued with the other guardrail key")
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(`{"object":"list","data":[
-		{"id":"claude-sonnet-4-20250514","object":"model","created":1700000000,"owned_by":"anthropic"},
-		{"id":"claude-opus-4-20250514","object":"model","created":1700000000,"owned_by":"anthropic"},
-		{"id":"claude-haiku-4-20250514","object":"model","created":1700000000,"owned_by":"anthropic"}
-	]}`))
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// authenticate checks a request's API key: the global PROXY_API_KEY
+// (adminKey), a tenant key (the tenant), or none when the proxy is open. It
+// also rejects browser requests from an origin the key's tenant doesn't
+// allow. On failure it writes the error in the request's format and
+// returns ok false.
+func authenticate(w http.ResponseWriter, r *http.Request) (t *tenant.Tenant, adminKey, ok bool) {
+	format := requestFormat(r)
+	apiKey := extractAPIKey(r)
+	globalKey := getEnvDefault("PROXY_API_KEY", "")
+	adminKey = globalKey != "" && apiKey == globalKey
+	if adminKey {
+		// Global key matched — no tenant, backward compat
+	} else if tenant.HasTenants() {
+		if !db.FeatureAvailable(db.FeatureTenants) {
+			// Tenants exist but their keys can't be checked on this schema
+			writeError(w, r, format, 503, "api_error", "Tenant authentication is unavailable: the database schema is out of date")
+			return nil, false, false
+		}
+		t = tenant.Resolve(apiKey)
+		if t == nil {
+			writeError(w, r, format, 401, "authentication_error", "Invalid API key")
+			return nil, false, false
+		}
+	} else if globalKey != "" {
+		writeError(w, r, format, 401, "authentication_error", "Invalid or missing proxy API key")
+		return nil, false, false
+	}
+	// else: no global key AND no tenants = open proxy (current behavior)
+
+	if origin := r.Header.Get("Origin"); origin != "" && !originAllowedFor(t, origin) {
+		w.Header().Del("Access-Control-Allow-Origin")
+		writeError(w, r, format, 403, "permission_error", "Origin not allowed for this API key")
+		return nil, false, false
+	}
+	return t, adminKey, true
+}
+
+// requestFormat is the API format a request's errors are written in:
+// OpenAI for Chat Completions, and for model lists requested without
+// anthropic-version; Anthropic otherwise.
+func requestFormat(r *http.Request) string {
+	if strings.Contains(r.URL.Path, "/chat/completions") ||
+		r.URL.Path == "/v1/models" && r.Header.Get("anthropic-version") == "" {
+		return "openai"
+	}
+	return "anthropic"
 }
 
 func handleProxy(w http.ResponseWriter, r *http.Request) {
@@ -51,38 +153,42 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 	method := r.Method
 
-	// CORS preflight
-	if method == "OPTIONS" {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "*")
-		w.WriteHeader(204)
-		return
+	// The request's ID goes back to the client, upstream, into its usage
+	// and request log rows, and ahead of each of its log lines. A client's
+	// own ID is echoed and logged next to it
+	reqID := newRequestID()
+	w.Header().Set(requestIDHeader, reqID)
+	logf := requestLogf(reqID)
+	clientReqID := clientRequestID(r)
+	if clientReqID != "" {
+		w.Header().Set(clientRequestIDHeader, clientReqID)
+		logf("[proxy] Client request ID %s", clientReqID)
 	}
 
 	// 1. Tenant-aware authentication
-	apiKey := extractAPIKey(r)
-	var tenantCtx *tenant.Tenant
-
-	globalKey := getEnvDefault("PROXY_API_KEY", "")
-	if globalKey != "" && apiKey == globalKey {
-		// Global key matched — no tenant, backward compat
-	} else if tenant.HasTenants() {
-		tenantCtx = tenant.Resolve(apiKey)
-		if tenantCtx == nil {
-			writeError(w, r, "anthropic", 401, "authentication_error", "Invalid API key")
-			return
-		}
-	} else if globalKey != "" {
-		writeError(w, r, "anthropic", 401, "authentication_error", "Invalid or missing proxy API key")
+	tenantCtx, adminKey, ok := authenticate(w, r)
+	if !ok {
 		return
 	}
-	// else: no global key AND no tenants = open proxy (current behavior)
 
-	// 1.5 Tenant-level rate limiting
-	if tenantCtx != nil && tenantCtx.RateLimit > 0 {
-		if ratelimit.CheckAndRecord("tenant:"+tenantCtx.ID, tenantCtx.RateLimit) {
-			writeError(w, r, "anthropic", 429, "rate_limit_error", "Rate limit exceeded")
+	// 1.5 Tenant-level rate limiting, split by traffic class
+	if tenantCtx != nil && (tenantCtx.RateLimit > 0 || tenantCtx.RateLimitBackground > 0) {
+		class := ratelimit.ParseClass(r.Header.Get(priorityHeader))
+		limits := ratelimit.ClassLimits{
+			Total:      tenantCtx.RateLimit,
+			Background: tenantCtx.RateLimitBackground,
+			Headroom:   backgroundHeadroom(tenantCtx),
+		}
+		key := "tenant:" + tenantCtx.ID
+		limited := ratelimit.CheckAndRecordClass(key, class, limits)
+		tenantRateLimitHeaders.set(w.Header(), key, tenantCtx.RateLimit)
+		if limited {
+			msg := "Rate limit exceeded"
+			if class == ratelimit.Background {
+				msg = "Rate limit exceeded for background traffic"
+			}
+			w.Header().Set(retryAfterHeader, strconv.Itoa(tenantRetryAfter(key, class, limits)))
+			writeError(w, r, "anthropic", 429, "rate_limit_error", msg)
 			return
 		}
 	}
@@ -93,84 +199,253 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 		inboundFormat = "openai"
 	}
 
+	// 2.5 Loop protection: an account whose base_url points back at a proxy
+	// sends the request around again with a higher hop count
+	hop := inboundHop(r.Header)
+	if hop > maxProxyHops() {
+		logf("[proxy] Proxy loop detected: %d hops", hop)
+		w.Header().Set(loopHeader, loopDetected)
+		writeError(w, r, inboundFormat, 508, "invalid_request_error",
+			fmt.Sprintf("Proxy loop detected: the request passed through %d CodeGate proxies.", hop))
+		return
+	}
+	// Retries to the same upstream send the same count; only passing
+	// through a proxy adds a hop
+	upstreamHop := hop + 1
+
+	// 2.6 Chargeback tags the caller attributes the request to
+	tags, err := parseTags(r.Header.Get(tagsHeader))
+	if err != nil {
+		writeError(w, r, inboundFormat, 400, "invalid_request_error", tagsHeader+": "+err.Error())
+		return
+	}
+
 	// Settings helper: tenant-scoped if available
 	getSetting := db.GetSetting
+	tenantIDForLog, tenantKeyLabel := "", ""
 	if tenantCtx != nil {
 		getSetting = func(key string) string {
 			return tenant.GetSetting(tenantCtx, key)
 		}
+		tenantIDForLog, tenantKeyLabel = tenantCtx.ID, tenantCtx.KeyLabel
 	}
+	sessionID := requestSessionID(r)
+	slo := newSLOScope(tenantIDForLog, getSetting)
 
-	// 3. Read request body
-	bodyBytes, err := io.ReadAll(r.Body)
+	// 3. Read request body (bodies above the spool threshold go to disk)
+	bodyBytes, spool, err := readRequestBody(r.Body, spoolThreshold(getSetting))
 	r.Body.Close()
 	if err != nil {
 		writeError(w, r, inboundFormat, 400, "invalid_request_error", "Failed to read request body")
 		return
 	}
+	defer spool.Close()
 
-	// 4. Parse body JSON
-	var bodyJSON map[string]any
+	// 4. Parse body JSON (once; later stages reuse the parsed maps)
+	req := &requestBody{raw: bodyBytes, spool: spool}
+	req.convertOptions.SplitSystem = getSetting("preserve_system_blocks") == "true"
 	originalModel := "claude-sonnet-4-20250514"
 	isStreamRequest := false
+	var traits routing.RequestTraits
 
-	if len(bodyBytes) > 0 {
-		if err := json.Unmarshal(bodyBytes, &bodyJSON); err != nil {
+	if spool != nil {
+		// Spooled: read only the top-level fields the pipeline needs
+		if err := spool.scan(); err != nil {
+			writeError(w, r, inboundFormat, 400, "invalid_request_error", "Invalid JSON in request body")
+			return
+		}
+		if m, ok := spool.stringField("model"); ok {
+			originalModel = m
+		}
+		if s, ok := spool.boolField("stream"); ok {
+			isStreamRequest = s
+		}
+		traits = spooledTraits(spool)
+	} else if len(bodyBytes) > 0 {
+		if err := json.Unmarshal(bodyBytes, &req.parsed); err != nil {
 			writeError(w, r, inboundFormat, 400, "invalid_request_error", "Invalid JSON in request body")
 			return
 		}
-		if m, ok := bodyJSON["model"].(string); ok {
+		if m, ok := req.parsed["model"].(string); ok {
 			originalModel = m
 		}
-		if s, ok := bodyJSON["stream"].(bool); ok {
+		if s, ok := req.parsed["stream"].(bool); ok {
 			isStreamRequest = s
 		}
+		traits = requestTraits(req.parsed)
+		// strict_tool_choice rejects a forced tool the request doesn't
+		// declare; otherwise conversion sends it as auto
+		if getSetting("strict_tool_choice") == "true" {
+			if missing := convert.MissingForcedTool(req.parsed, inboundFormat); missing != "" {
+				writeError(w, r, inboundFormat, 400, "invalid_request_error",
+					fmt.Sprintf("tool_choice names tool %q, which is not declared in tools", missing))
+				return
+			}
+		}
 	}
 
 	_ = isStreamRequest
 
+	// 4.5 Optionally hash end-user IDs before they reach any provider
+	if getSetting("hash_end_user_ids") == "true" {
+		var err error
+		if req.parsed != nil {
+			var changed bool
+			if changed, err = hashEndUserIDs(req.parsed); changed {
+				req.raw, _ = json.Marshal(req.parsed)
+			}
+		} else if spool != nil {
+			err = hashSpooledEndUserIDs(logf, spool)
+		}
+		if err != nil {
+			// Fail closed: the raw IDs must not reach the provider
+			logf("[proxy] Can't hash end-user IDs: %v", err)
+			writeError(w, r, inboundFormat, 500, "api_error", "Failed to hash end-user IDs")
+			return
+		}
+	}
+
 	// 5. If inbound is OpenAI format, convert to Anthropic internally for routing
-	anthropicBody := bodyJSON
+	req.anthropic = req.parsed
 	if inboundFormat == "openai" && len(bodyBytes) > 0 {
-		converted := convert.OpenAIToAnthropicRequest(bodyJSON)
+		converted, warnings := convert.OpenAIToAnthropicRequestWithWarnings(req.parsed)
 		if converted != nil {
-			anthropicBody = converted
+			req.anthropic = converted
+			req.anthropicModified = true
+			req.inboundWarnings = warnings
 			// Preserve original model for routing
-			if m, ok := bodyJSON["model"].(string); ok {
-				anthropicBody["model"] = m
+			if m, ok := req.parsed["model"].(string); ok {
+				req.anthropic["model"] = m
 			}
 		}
 	}
 
-	// 6. Guardrails: anonymize outgoing request body
+	usageDims := db.UsageDimensions{TenantID: tenantIDForLog, EndUser: req.endUser(), Tags: tagsJSON(tags), RequestID: reqID}
+
+	// 5.5 Betas sent in the body (the SDKs' betas parameter) go upstream in
+	// the anthropic-beta header instead, filtered per account
+	req.bodyBetas = req.takeBodyBetas(inboundFormat)
+	extendedOutput := hasBeta(r.Header.Get("anthropic-beta"), output128kBeta) || slices.Contains(req.bodyBetas, output128kBeta)
+
+	// 6. Guardrails: anonymize outgoing request body. The returned clone is
+	// owned by the handler, so no further copies are needed per candidate.
 	guardrailsActive := guardrails.IsGuardrailsEnabledWith(getSetting)
-	if guardrailsActive && len(bodyBytes) > 0 {
-		anthropicBody = guardrails.RunGuardrailsOnRequestBody(anthropicBody)
+	// Trusted callers can turn them off for the request; request logs
+	// record that they did
+	guardrailsBypassed := guardrailsActive && guardrailsOptOut(r, adminKey, tenantCtx)
+	if guardrailsBypassed {
+		guardrailsActive = false
+		logf("[proxy] Guardrails bypassed for this request (%s: off)", guardrailsHeader)
+	}
+	guardrailsTenant := ""
+	if tenantCtx != nil {
+		guardrailsTenant = tenantCtx.ID
+	}
+	if guardrailsActive && spool != nil {
+		// Guardrails need the whole document: load the spool rather than
+		// send it upstream unanonymized
+		if err := req.materialize(inboundFormat); err != nil {
+			logf("[proxy] Failed to load spooled request body for guardrails: %v", err)
+			writeError(w, r, inboundFormat, 413, "request_too_large", "Request body could not be loaded for guardrails")
+			return
+		}
+		spool = nil
+	}
+	if guardrailsActive {
+		req.anonymize(guardrailsTenant)
 	}
 
-	// 6.5 Clamp max_tokens to model limits
+	// 6.2 Split or truncate oversized tool results (max_tool_result_bytes),
+	// after guardrails so they see the whole result
+	if limit, mode := toolResultLimit(getSetting); limit > 0 {
+		if spool != nil {
+			logf("[proxy] Tool result limit skipped for spooled request body (%d bytes)", spool.size)
+		} else {
+			if note := req.limitToolResults(inboundFormat, limit, mode); note != "" {
+				req.bodyNotes = append(req.bodyNotes, note)
+			}
+		}
+	}
+
+	// 6.3 Download image URLs and inline them as base64 for backends that
+	// don't take URL sources (convert_fetch_image_urls)
+	if getSetting("convert_fetch_image_urls") == "true" {
+		if spool != nil {
+			logf("[proxy] Image URL fetch skipped for spooled request body (%d bytes)", spool.size)
+		} else {
+			n, err := req.fetchImageURLs(r.Context(), imageFetchLimit(getSetting))
+			if err != nil {
+				writeError(w, r, inboundFormat, 400, "invalid_request_error", err.Error())
+				return
+			}
+			if n > 0 {
+				req.bodyNotes = append(req.bodyNotes, fmt.Sprintf("inlined %d image URLs as base64", n))
+			}
+		}
+	}
+
+	// 6.5 Clamp max_tokens to model limits, raised by the 128k-output beta.
+	// A thinking budget that no longer fits under max_tokens is cut with it;
+	// with the beta that happens per candidate.
+	thinkingMarginTokens := thinkingMargin(getSetting)
+	clampedMaxTokens := 0
+	anthropicBody := req.anthropic
 	if model, ok := anthropicBody["model"].(string); ok {
 		if mt, ok := anthropicBody["max_tokens"].(float64); ok {
 			v := int(mt)
-			if clamped := limits.ClampMaxTokens(&v, model); clamped != nil {
-				anthropicBody["max_tokens"] = float64(*clamped)
+			clamped := clampMaxTokens(v, model, extendedOutput)
+			if clamped != v {
+				anthropicBody["max_tokens"] = float64(clamped)
+				req.anthropicModified = true
+				clampedMaxTokens = clamped
+			}
+			if extendedOutput {
+				req.extendedMaxTokens = clamped
 			}
 		}
 		if mct, ok := anthropicBody["max_completion_tokens"].(float64); ok {
 			v := int(mct)
-			if clamped := limits.ClampMaxTokens(&v, model); clamped != nil {
+			if clamped := limits.ClampMaxTokens(&v, model); clamped != nil && *clamped != v {
 				anthropicBody["max_completion_tokens"] = float64(*clamped)
+				req.anthropicModified = true
+			}
+		}
+	}
+	if spool != nil {
+		for _, key := range []string{"max_tokens", "max_completion_tokens"} {
+			if mt, ok := spool.numberField(key); ok {
+				v := int(mt)
+				extended := extendedOutput && key == "max_tokens"
+				clamped := clampMaxTokens(v, originalModel, extended)
+				if clamped != v {
+					spool.setField(key, clamped)
+					if key == "max_tokens" {
+						clampedMaxTokens = clamped
+					}
+				}
+				if extended {
+					req.extendedMaxTokens = clamped
+				}
 			}
 		}
 	}
+	if clampedMaxTokens > 0 && req.extendedMaxTokens == 0 {
+		if note := req.fitThinkingBudget(clampedMaxTokens, thinkingMarginTokens); note != "" {
+			req.bodyNotes = append(req.bodyNotes, note)
+		}
+	}
 
 	// 7. Detect tier
 	tier := models.DetectTier(originalModel)
 
 	// 8. Resolve route
-	route, err := routing.ResolveForTenant(originalModel, tenantCtx)
+	traits.Background = ratelimit.ParseClass(r.Header.Get(priorityHeader)) == ratelimit.Background
+	if traits.Background {
+		traits.WindowReserve = routing.WindowReserve(getSetting)
+	}
+	route, err := routing.ResolveForTenant(originalModel, tenantCtx, traits)
 	if err != nil {
-		log.Printf("[proxy] Route resolution error: %v", err)
+		logf("[proxy] Route resolution error: %v", err)
 		writeError(w, r, inboundFormat, 503, "overloaded_error", "Route resolution failed")
 		return
 	}
@@ -179,83 +454,273 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Build candidate list: primary + fallbacks
+	// Build candidate list: primary + fallbacks. Routing already put
+	// cooled-down accounts last, so the primary is the preferred account
+	// that can take the request.
 	allCandidates := make([]routing.Candidate, 0, 1+len(route.Fallbacks))
-	allCandidates = append(allCandidates, routing.Candidate{Account: route.Account, TargetModel: route.TargetModel})
+	allCandidates = append(allCandidates, routing.Candidate{Account: route.Account, TargetModel: route.TargetModel, FallbackModels: route.FallbackModels})
 	allCandidates = append(allCandidates, route.Fallbacks...)
-	allCandidates = routing.SortByCooldown(allCandidates)
+
+	// Tenants and accounts can disable or cap failover, and clients can pin
+	// side-effectful turns to the first candidate
+	allCandidates, failoverLimited := limitCandidates(allCandidates, getSetting)
+	if noFailoverRequested(r.Header) {
+		failoverLimited = failoverLimited || len(allCandidates) > 1
+		allCandidates = allCandidates[:1]
+		w.Header().Set(noFailoverHeader, "true")
+	}
+
+	// 8.5 An external policy service can deny the request or cap its
+	// max_tokens, given its metadata (policy_webhook_url)
+	if webhook, ok := policyWebhookFor(tenantCtx); ok {
+		targetModel := allCandidates[0].TargetModel
+		if targetModel == "" {
+			targetModel = originalModel
+		}
+		pr := req.policyRequest(usageDims.RequestID, tenantIDForLog, inboundFormat, originalModel, targetModel, guardrailsActive)
+		pr.EndUser, pr.Tags = usageDims.EndUser, tags
+		decision := webhook.decide(r.Context(), pr)
+		switch decision.Decision {
+		case policyDeny:
+			logf("[policy] Request denied: %s", decision.Message)
+			msg := "Request denied by policy"
+			if decision.Message != "" {
+				msg += ": " + decision.Message
+			}
+			writeError(w, r, inboundFormat, 403, "permission_error", msg)
+			return
+		case policyUnavailable:
+			writeError(w, r, inboundFormat, 503, "api_error", "Request not sent: the policy service could not be reached")
+			return
+		case policyModify:
+			if note := req.capMaxTokens(inboundFormat, decision.MaxTokens); note != "" {
+				logf("[policy] %s", note)
+				req.bodyNotes = append(req.bodyNotes, note)
+				if note := req.fitThinkingBudget(decision.MaxTokens, thinkingMarginTokens); note != "" {
+					req.bodyNotes = append(req.bodyNotes, note)
+				}
+			}
+		}
+	}
 
 	autoSwitchOnError := getSetting("auto_switch_on_error") != "false"
 	autoSwitchOnRateLimit := getSetting("auto_switch_on_rate_limit") != "false"
+	injectRoutingMetadata := getSetting("inject_routing_metadata") == "true"
+	debugHeaders := getSetting("debug_headers") == "true"
+	stallTimeout := clientStallTimeout(getSetting)
+	downscaleImages := getSetting("downscale_images") == "true"
+
+	// Statuses that must not be retried elsewhere when the request may have
+	// already run a tool upstream (spooled bodies aren't inspected)
+	unsafeStatuses := parseStatusList(getSetting("failover_unsafe_statuses"))
+	sideEffectful := len(unsafeStatuses) > 0 && hasToolSideEffects(req.anthropic)
+	retrySafe := func(status int) bool {
+		if sideEffectful && unsafeStatuses[status] {
+			logf("[proxy] Not failing over %d: request may have run tool side effects (failover_unsafe_statuses)", status)
+			return false
+		}
+		return true
+	}
 
 	// Collect request headers for forwarding
 	reqHeaders := make(map[string]string)
 	for k := range r.Header {
 		reqHeaders[strings.ToLower(k)] = r.Header.Get(k)
 	}
+	clientHeaders := forwardClientHeaders(reqHeaders, getSetting("forward_client_headers"))
+
+	// Versions outside anthropic_versions are forwarded as sent, but flagged:
+	// a newer response shape can surface as a conversion bug
+	anthropicVersion := reqHeaders["anthropic-version"]
+	if note := anthropicVersionWarning(anthropicVersion, knownAnthropicVersions(getSetting)); note != "" {
+		req.bodyNotes = append(req.bodyNotes, note)
+		metrics.Inc("codegate_unknown_anthropic_version_total")
+	}
 
-	// Try each candidate account in order (primary + fallbacks)
-	for i, cand := range allCandidates {
+	// Upstream errors that triggered failover, logged with the final attempt
+	// and recorded in request_attempts with its usage, or on their own if
+	// the request ends without usage
+	var failedAttempts []failoverAttempt
+	attemptsRecorded := false
+	defer func() {
+		if !attemptsRecorded && len(failedAttempts) > 0 {
+			db.Go(func() { db.RecordAttempts(usageDims, attemptRows(failedAttempts)...) })
+		}
+	}()
+	// Transient failures retried on the same account, across candidates
+	retries := 0
+	maxRetries := providerRetries(getSetting)
+
+	// Set once tool output has been trimmed to fit the context window
+	contextTrimmed := false
+
+	// Hedged requests race the first candidate against a partner once.
+	// Spooled bodies aren't hedged, nor are those forcing a tool call.
+	hedging := spool == nil && hedgeRequested(r, tenantCtx, getSetting) && !forcesToolUse(req.anthropic)
+	hedged := false
+
+	// Try each candidate account in order (primary + fallbacks). A model
+	// fallback is inserted after the candidate whose model was overloaded.
+	for i := 0; i < len(allCandidates); i++ {
+		cand := allCandidates[i]
 		account := cand.Account
 		targetModel := cand.TargetModel
 		if targetModel == "" {
 			targetModel = originalModel
 		}
+		// Anthropic accounts are sent the snapshot an alias stands for
+		if account.Provider == "anthropic" {
+			targetModel = models.ResolveAlias(targetModel)
+		}
+		// Serving anything but the primary deviates from the config's
+		// preference among available accounts
 		isFailover := i > 0
 		isLastCandidate := i == len(allCandidates)-1
-		targetIsAnthropic := account.Provider == "anthropic"
+		targetIsAnthropic := account.SpeaksAnthropic()
+		caps := provider.CapabilitiesFor(account)
 
-		// Skip cooled-down accounts unless last candidate
+		// Skip cooled-down accounts, and those with a used-up subscription
+		// window, unless last candidate
 		if !isLastCandidate && cooldown.IsOnCooldown(account.ID) {
-			log.Printf("[proxy] Skipping %q (on cooldown), %d candidates left", account.Name, len(allCandidates)-i-1)
+			logf("[proxy] Skipping %q (on cooldown), %d candidates left", account.Name, len(allCandidates)-i-1)
+			continue
+		}
+		if cooldown.IsModelOnCooldown(account.ID, targetModel) {
+			if next, ok := nextModelFallback(cand); ok {
+				logf("[proxy] %s on %q is on cooldown, trying %s", targetModel, account.Name, next.TargetModel)
+				allCandidates = slices.Insert(allCandidates, i+1, next)
+				continue
+			}
+			if !isLastCandidate {
+				logf("[proxy] Skipping %q (%s on cooldown), %d candidates left", account.Name, targetModel, len(allCandidates)-i-1)
+				continue
+			}
+		}
+		if !isLastCandidate && routing.UnavailableUntil(account.ID, traits).After(time.Now()) {
+			logf("[proxy] Skipping %q (subscription window used up), %d candidates left", account.Name, len(allCandidates)-i-1)
 			continue
 		}
 
+		// OpenAI-compatible providers have no count_tokens endpoint, so the
+		// count is estimated without contacting them
+		if path == countTokensPath && !targetIsAnthropic {
+			tokens := req.writeEstimatedTokenCount(w)
+			logf("[proxy] Estimated count_tokens for %q (%s): %d tokens", account.Name, targetModel, tokens)
+			return
+		}
+
+		// Inline images over the provider's limits are downscaled when
+		// downscale_images is on, or rule the account out (spooled bodies
+		// aren't inspected)
+		if req.spool == nil {
+			note, err := req.guardImages(inboundFormat, targetIsAnthropic, caps, downscaleImages)
+			if note != "" {
+				req.bodyNotes = append(req.bodyNotes, note)
+			}
+			if err != nil {
+				if !isLastCandidate {
+					logf("[proxy] Skipping %q (%v), %d candidates left", account.Name, err, len(allCandidates)-i-1)
+					continue
+				}
+				writeError(w, r, inboundFormat, 400, "invalid_request_error", fmt.Sprintf("Request not sent to %q: %v", account.Name, err))
+				return
+			}
+		}
+
+		// Anthropic returns one message per request, so n > 1 needs an
+		// OpenAI-compatible account
+		if n := req.choiceCount(); n > 1 && inboundFormat == "openai" && targetIsAnthropic {
+			if !isLastCandidate {
+				logf("[proxy] Skipping %q (n=%d needs an OpenAI-compatible account), %d candidates left", account.Name, n, len(allCandidates)-i-1)
+				continue
+			}
+			writeError(w, r, inboundFormat, 400, "invalid_request_error",
+				fmt.Sprintf("n=%d is not supported by %q: Anthropic models return one choice per request", n, account.Name))
+			return
+		}
+
 		// Atomic rate limit check + record
 		if ratelimit.CheckAndRecord(account.ID, account.RateLimit) {
 			if !isLastCandidate {
-				log.Printf("[proxy] Skipping %q (rate limited), %d candidates left", account.Name, len(allCandidates)-i-1)
+				logf("[proxy] Skipping %q (rate limited), %d candidates left", account.Name, len(allCandidates)-i-1)
 				continue
 			}
+			accountRateLimitHeaders.set(w.Header(), account.ID, account.RateLimit)
+			_, wait := ratelimit.Remaining(account.ID, account.RateLimit)
+			w.Header().Set(retryAfterHeader, strconv.Itoa(max(ceilSeconds(wait), 1)))
 			writeError(w, r, inboundFormat, 429, "rate_limit_error",
 				fmt.Sprintf("Rate limit exceeded for account %q (%d req/min)", account.Name, account.RateLimit))
 			return
 		}
 
+		// Betas the account doesn't accept are left out, and with them the
+		// 128k-output beta's higher max_tokens
+		headers, droppedBetas := candidateBetas(reqHeaders, req.bodyBetas, account)
+		headers = candidateVersion(headers, account)
+		thinkingNote := ""
+		if req.extendedMaxTokens > 0 {
+			extended := targetIsAnthropic && hasBeta(headers["anthropic-beta"], output128kBeta)
+			maxTokens := clampMaxTokens(req.extendedMaxTokens, originalModel, extended)
+			req.setMaxTokens(maxTokens)
+			thinkingNote = req.fitThinkingBudget(maxTokens, thinkingMarginTokens)
+		}
+
 		// ── Decide conversion path ──────────────────────────────
-		var forwardPath string
-		var forwardBody string
-
-		if inboundFormat == "openai" && !targetIsAnthropic {
-			// OpenAI client → OpenAI-compatible provider: forward original body with model swap
-			forwardJSON := deepCopy(bodyJSON)
-			forwardJSON["model"] = targetModel
-			b, _ := json.Marshal(forwardJSON)
-			forwardBody = string(b)
-			forwardPath = "/v1/chat/completions"
-		} else if inboundFormat == "openai" && targetIsAnthropic {
-			// OpenAI client → Anthropic provider: use converted anthropic body
-			forwardJSON := deepCopy(anthropicBody)
-			forwardJSON["model"] = targetModel
-			b, _ := json.Marshal(forwardJSON)
-			forwardBody = string(b)
-			forwardPath = "/v1/messages"
-		} else if inboundFormat == "anthropic" && !targetIsAnthropic {
-			// Anthropic client → OpenAI-compatible provider: convert to OpenAI format
-			openaiBody := convert.AnthropicToOpenAI(anthropicBody, targetModel)
-			b, _ := json.Marshal(openaiBody)
-			forwardBody = string(b)
-			forwardPath = "/v1/chat/completions"
-		} else {
-			// Anthropic client → Anthropic provider: forward as-is
-			forwardJSON := deepCopy(anthropicBody)
-			forwardJSON["model"] = targetModel
-			b, _ := json.Marshal(forwardJSON)
-			forwardBody = string(b)
-			forwardPath = "/v1/messages"
-			if strings.HasPrefix(path, "/v1/messages") {
-				forwardPath = path
+		req.convertOptions.FileParts = caps.FileParts
+		req.targetCaps = caps
+		req.systemPrefix = systemPromptPrefix(logf, getSetting, account)
+		forwardPath, forwardBody, forwardLen, err := req.forward(inboundFormat, targetIsAnthropic, targetModel, path)
+		if err != nil {
+			logf("[proxy] Failed to prepare request body: %v", err)
+			writeError(w, r, inboundFormat, 500, "api_error", "Failed to prepare request body")
+			return
+		}
+		// OpenRouter accounts get their provider preferences merged in and
+		// the app attribution headers
+		candidateClientHeaders := clientHeaders
+		if !targetIsAnthropic && account.IsOpenRouter() {
+			forwardBody, forwardLen = withOpenRouterPrefs(logf, forwardBody, forwardLen, req.spool != nil, account)
+			candidateClientHeaders = openRouterAttribution(clientHeaders, getSetting)
+		}
+		// forwardWith sends a body to an account. The first attempt, its
+		// hedge and the retries below all go through it, so their options
+		// can't drift. Requests go with the client request's context, so
+		// the provider stops generating when the client goes away.
+		forwardWith := func(ctx context.Context, acct db.Account, body io.Reader, length int64) (*provider.Response, error) {
+			acctClientHeaders := candidateClientHeaders
+			if acct.AuthType == "oauth" {
+				acctClientHeaders = withOAuthClientHeaders(candidateClientHeaders, reqHeaders)
 			}
+			return provider.Forward(acct, provider.ForwardOptions{
+				Context:           ctx,
+				Path:              forwardPath,
+				Method:            method,
+				Headers:           headers,
+				ClientHeaders:     acctClientHeaders,
+				Body:              body,
+				BodyLength:        length,
+				APIKey:            acct.APIKey,
+				BaseURL:           acct.BaseURL,
+				AuthType:          acct.AuthType,
+				ExternalAccountID: acct.ExternalAccountID,
+				Hop:               upstreamHop,
+				RequestID:         reqID,
+				Stream:            isStreamRequest,
+				Timeouts:          upstreamTimeouts(getSetting, acct),
+			})
+		}
+		forwardTo := func(acct db.Account, body io.Reader, length int64) (*provider.Response, error) {
+			return forwardWith(r.Context(), acct, body, length)
+		}
+		if len(droppedBetas) > 0 {
+			req.conversionWarnings = append(req.conversionWarnings, betasWarning(droppedBetas, account))
+		}
+		req.conversionWarnings = append(req.conversionWarnings, req.bodyNotes...)
+		if thinkingNote != "" {
+			req.conversionWarnings = append(req.conversionWarnings, thinkingNote)
+		}
+		for _, warning := range req.conversionWarnings {
+			logf("[convert] %s for %q (%s)", warning, account.Name, targetModel)
 		}
 
 		strategy := "config"
@@ -266,71 +731,308 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 		action := "Routing"
 		if isFailover {
 			action = "Failover"
+			metrics.Inc("codegate_failovers_total", "provider", account.Provider)
 		}
-		log.Printf("[proxy] %s [%s] to %q (%s/%s) model=%s", action, inboundFormat, account.Name, account.Provider, account.AuthType, targetModel)
+		logf("[proxy] %s [%s] to %q (%s/%s) model=%s", action, inboundFormat, account.Name, account.Provider, account.AuthType, targetModel)
+		setMetricsProvider(w, account.Provider)
 
 		// OAuth token refresh before forwarding
 		if account.AuthType == "oauth" {
 			if err := auth.EnsureValidToken(&account); err != nil {
-				log.Printf("[proxy] Token refresh failed for %q: %v", account.Name, err)
+				logf("[proxy] Token refresh failed for %q: %v", account.Name, err)
 			}
 		}
 
-		// Forward to provider
-		provResp, err := provider.Forward(account, provider.ForwardOptions{
-			Path:              forwardPath,
-			Method:            method,
-			Headers:           reqHeaders,
-			Body:              forwardBody,
-			APIKey:            account.APIKey,
-			BaseURL:           account.BaseURL,
-			AuthType:          account.AuthType,
-			ExternalAccountID: account.ExternalAccountID,
-		})
+		// Forward to provider. A hedged request also goes to a partner that
+		// takes the same body if this candidate is slow to respond.
+		attemptStart := time.Now()
+		var provResp *provider.Response
+		partnerIdx := -1
+		if hedging && !hedged {
+			// The partner is sent this candidate's body, prompt prefix
+			// included, so it must take the same one
+			partnerIdx = hedgePartner(allCandidates, i, originalModel, func(acct db.Account, model string) bool {
+				partnerHeaders, _ := candidateBetas(reqHeaders, req.bodyBetas, acct)
+				return model == targetModel && acct.SpeaksAnthropic() == targetIsAnthropic &&
+					provider.CapabilitiesFor(acct) == caps && acct.IsOpenRouter() == account.IsOpenRouter() &&
+					acct.OpenRouterPrefs == account.OpenRouterPrefs &&
+					acct.SystemPromptPrefix == account.SystemPromptPrefix &&
+					maps.Equal(candidateVersion(partnerHeaders, acct), headers) &&
+					!cooldown.IsModelOnCooldown(acct.ID, model) &&
+					!routing.UnavailableUntil(acct.ID, traits).After(time.Now())
+			})
+		}
+		if partnerIdx >= 0 {
+			hedged = true
+			partner := allCandidates[partnerIdx]
+			body, _ := io.ReadAll(forwardBody)
+			delay := hedgeDelay(getSetting)
+			race := raceHedged(r.Context(), delay, func(ctx context.Context, n int) (*provider.Response, error) {
+				acct := account
+				if n == 1 {
+					acct = partner.Account
+				}
+				return forwardWith(ctx, acct, bytes.NewReader(body), int64(len(body)))
+			}, func() bool {
+				// Rate limits count both launches
+				if ratelimit.CheckAndRecord(partner.Account.ID, partner.Account.RateLimit) {
+					logf("[proxy] Not hedging with %q (rate limited)", partner.Account.Name)
+					return false
+				}
+				logf("[proxy] No response from %q after %v, hedging with %q", account.Name, delay, partner.Account.Name)
+				if partner.Account.AuthType == "oauth" {
+					if err := auth.EnsureValidToken(&partner.Account); err != nil {
+						logf("[proxy] Token refresh failed for %q: %v", partner.Account.Name, err)
+					}
+				}
+				return true
+			})
+			defer race.cancel()
+			provResp, err = race.won.resp, race.won.err
+			if lost := race.lost; lost != nil {
+				// The partner has been tried; it isn't a failover candidate
+				allCandidates = slices.Delete(allCandidates, partnerIdx, partnerIdx+1)
+				isLastCandidate = i == len(allCandidates)-1
+				loser := account
+				if race.won.index == 1 {
+					loser, account, cand = account, partner.Account, partner
+				} else {
+					loser = partner.Account
+				}
+				if lost.err == errHedgeCancelled {
+					metrics.Inc("codegate_hedged_requests_total", "winner", []string{"first", "partner"}[race.won.index])
+					logf("[proxy] Hedged request: %q responded first, cancelled %q", account.Name, loser.Name)
+					if getSetting("request_logging") == "true" {
+						entry := db.RequestLog{
+							Method: method, Path: path, InboundFormat: inboundFormat,
+							AccountID: loser.ID, AccountName: loser.Name, Provider: loser.Provider,
+							OriginalModel: originalModel, RoutedModel: targetModel,
+							LatencyMs: int(time.Since(attemptStart).Milliseconds()), IsStream: isStreamRequest,
+							ErrorMessage: fmt.Sprintf("%v: %q responded first", errHedgeCancelled, account.Name),
+							TenantID: tenantIDForLog, TenantKeyLabel: tenantKeyLabel,
+							AnthropicVersion: anthropicVersion, GuardrailsBypassed: guardrailsBypassed,
+							EndUser: usageDims.EndUser, Tags: usageDims.Tags, RequestID: reqID, ClientRequestID: clientReqID,
+						}
+						db.Go(func() { db.InsertRequestLog(entry) })
+					}
+				} else {
+					attempt := newAttempt(loser, targetModel, "", attemptStart)
+					if lost.err != nil {
+						attempt.Error = lost.err.Error()
+					} else {
+						attempt.Status, attempt.RequestID = lost.resp.Status, upstreamRequestID(lost.resp.Headers)
+					}
+					attempt.Reason = attemptReason(attempt.Status, lost.err)
+					logf("[proxy] Hedged request failed on %q too", loser.Name)
+					failedAttempts = append(failedAttempts, attempt)
+				}
+			}
+		} else {
+			// Transient failures are retried on the same account, after a
+			// backoff, before failing over. Nothing has been sent to the
+			// client yet, streamed or not.
+			replay := replayableBody(req.spool, forwardBody, forwardLen)
+			body, length := replay()
+			tryStart := attemptStart
+			provResp, err = forwardTo(account, body, length)
+			for n := 0; n < maxRetries && transientFailure(provResp, err) && (err != nil || retrySafe(provResp.Status)); n++ {
+				attempt := newAttempt(account, targetModel, "", tryStart)
+				attempt.Retry = true
+				if err != nil {
+					attempt.Error = err.Error()
+				} else {
+					attempt.Status, attempt.RequestID = provResp.Status, upstreamRequestID(provResp.Headers)
+					provResp.Body.Close()
+				}
+				wait := retryBackoff(n)
+				logf("[proxy] Transient failure from %q (%s); retrying in %v (%d of %d)",
+					account.Name, attempt.describe(), wait.Round(time.Millisecond), n+1, maxRetries)
+				attempt.Reason = attemptReason(attempt.Status, err)
+				failedAttempts = append(failedAttempts, attempt)
+				retries++
+				if !sleepContext(r.Context(), wait) {
+					logf("[proxy] Client disconnected while waiting to retry %q (termination_reason=%s)",
+						account.Name, terminationClientDisconnected)
+					return
+				}
+				body, length = replay()
+				tryStart = time.Now()
+				provResp, err = forwardTo(account, body, length)
+			}
+		}
 
+		if err != nil && r.Context().Err() != nil {
+			// The client went away, which isn't the account's failure
+			logf("[proxy] Client disconnected before %q responded; request cancelled (termination_reason=%s)",
+				account.Name, terminationClientDisconnected)
+			return
+		}
 		if err != nil {
 			errMsg := err.Error()
-			log.Printf("[proxy] Error forwarding to %q: %s", account.Name, errMsg)
+			logf("[proxy] Error forwarding to %q: %s", account.Name, errMsg)
 			db.RecordAccountError(account.ID, errMsg)
-			db.UpdateAccountStatus(account.ID, "error", errMsg)
-			cooldown.Set(account.ID, "connection_error", 0)
+			db.SetStatus(account.ID, db.StatusError, errMsg)
+			slo.recordFailure(account)
+			timedOut := provider.IsTimeout(err)
+			reason := attemptReason(0, err)
+			cooldown.Set(account.ID, reason, 0)
 
 			if autoSwitchOnError && !isLastCandidate {
-				log.Printf("[proxy] Attempting failover (%d accounts left)...", len(allCandidates)-i-1)
+				logf("[proxy] Attempting failover (%d accounts left)...", len(allCandidates)-i-1)
+				attempt := newAttempt(account, targetModel, reason, attemptStart)
+				attempt.Error = errMsg
+				failedAttempts = append(failedAttempts, attempt)
 				continue
 			}
 
+			if timedOut {
+				writeError(w, r, inboundFormat, 504, "timeout_error",
+					fmt.Sprintf("Provider timed out. Last error: %s", errMsg))
+				return
+			}
 			writeError(w, r, inboundFormat, 502, "api_error",
 				fmt.Sprintf("All provider accounts failed. Last error: %s", errMsg))
 			return
 		}
 
+		upstreamReqID := upstreamRequestID(provResp.Headers)
+		// Latency is time to response headers, so long streams don't read as slow
+		if provResp.Status >= 200 && provResp.Status < 300 {
+			slo.observeLatency(account, targetModel, time.Since(attemptStart))
+		}
+
+		// ── Context overflow: trim old tool output and retry once ──
+		if provResp.Status == 400 && !provResp.IsStream && targetIsAnthropic && !contextTrimmed &&
+			getSetting("auto_trim_on_context_overflow") == "true" {
+			errBody, _ := io.ReadAll(provResp.Body)
+			provResp.Body.Close()
+			provResp.Body = io.NopCloser(bytes.NewReader(errBody))
+			if tokens, limit, ok := parsePromptTooLong(string(errBody)); ok {
+				if blocks, trimmedBytes := req.trimForContext(tokens, limit); blocks > 0 {
+					contextTrimmed = true
+					kb := (trimmedBytes + 1023) / 1024
+					note := fmt.Sprintf("trimmed %d tool results (%d KB) to fit the %d-token context", blocks, kb, limit)
+					logf("[proxy] Prompt too long for %q (%d > %d tokens); %s and retrying", account.Name, tokens, limit, note)
+					_, retryBody, retryLen, retryErr := req.forward(inboundFormat, targetIsAnthropic, targetModel, path)
+					req.conversionWarnings = append(req.conversionWarnings, note)
+					var retryResp *provider.Response
+					if retryErr == nil {
+						retryResp, retryErr = forwardTo(account, retryBody, retryLen)
+					}
+					if retryErr == nil {
+						provResp = retryResp
+						upstreamReqID = upstreamRequestID(provResp.Headers)
+						w.Header().Set(trimmedHeader, fmt.Sprintf("%d tool results, %d KB", blocks, kb))
+					} else {
+						logf("[proxy] Retry after trimming failed for %q: %v", account.Name, retryErr)
+					}
+				}
+			}
+		}
+
+		// Subscription accounts report their window usage on every response
+		subscription.Observe(account.ID, provResp.Headers)
+
+		// ── Model overloaded: retry the account with a fallback model ──
+		if next, ok := nextModelFallback(cand); ok && (provResp.Status == 429 || provResp.Status == 529) {
+			errBody, _ := io.ReadAll(provResp.Body)
+			provResp.Body.Close()
+			provResp.Body = io.NopCloser(bytes.NewReader(errBody))
+			if modelScopedError(provResp.Status, errBody, targetModel) && retrySafe(provResp.Status) {
+				cooldown.SetModel(account.ID, targetModel, "overloaded", cooldown.ParseRetryAfter(provResp.Headers["retry-after"]))
+				logf("[proxy] Got %d for %s from %q (request %s), retrying with %s...",
+					provResp.Status, targetModel, account.Name, upstreamReqID, next.TargetModel)
+				provResp.Body.Close()
+				attempt := newAttempt(account, targetModel, "overloaded", attemptStart)
+				attempt.Status, attempt.RequestID = provResp.Status, upstreamReqID
+				failedAttempts = append(failedAttempts, attempt)
+				allCandidates = slices.Insert(allCandidates, i+1, next)
+				continue
+			}
+		}
+
 		// ── Check for retryable errors ──────────────────────────
 		if provResp.Status == 429 {
-			db.UpdateAccountStatus(account.ID, "rate_limited", "Rate limited (429)")
+			db.SetStatus(account.ID, db.StatusRateLimited, "Rate limited (429)")
 			db.RecordAccountError(account.ID, "Rate limited (429)")
+			slo.recordFailure(account)
 			retryAfter := cooldown.ParseRetryAfter(provResp.Headers["retry-after"])
 			cooldown.Set(account.ID, "rate_limit", retryAfter)
-			if autoSwitchOnRateLimit && !isLastCandidate {
-				log.Printf("[proxy] Got 429 from %q, trying failover...", account.Name)
+			if autoSwitchOnRateLimit && !isLastCandidate && retrySafe(429) {
+				logf("[proxy] Got 429 from %q (request %s), trying failover...", account.Name, upstreamReqID)
 				provResp.Body.Close()
+				attempt := newAttempt(account, targetModel, "rate_limit", attemptStart)
+				attempt.Status, attempt.RequestID = 429, upstreamReqID
+				failedAttempts = append(failedAttempts, attempt)
 				continue
 			}
 		} else if provResp.Status >= 500 {
 			db.RecordAccountError(account.ID, fmt.Sprintf("Server error (%d)", provResp.Status))
+			slo.recordFailure(account)
 			cooldown.Set(account.ID, "server_error", 0)
-			if autoSwitchOnError && !isLastCandidate {
-				log.Printf("[proxy] Got %d from %q, trying failover...", provResp.Status, account.Name)
+			if autoSwitchOnError && !isLastCandidate && retrySafe(provResp.Status) {
+				logf("[proxy] Got %d from %q (request %s), trying failover...", provResp.Status, account.Name, upstreamReqID)
 				provResp.Body.Close()
+				attempt := newAttempt(account, targetModel, "server_error", attemptStart)
+				attempt.Status, attempt.RequestID = provResp.Status, upstreamReqID
+				failedAttempts = append(failedAttempts, attempt)
 				continue
 			}
 		}
 
+		// A loop the upstream detected is named after the account that
+		// sent the request into it
+		if msg, ok := loopError(provResp, account.Name); ok {
+			provResp.Body.Close()
+			logf("[proxy] Account %q forwarded into a proxy loop", account.Name)
+			w.Header().Set(loopHeader, loopNamed)
+			writeError(w, r, inboundFormat, 508, "invalid_request_error", msg)
+			return
+		}
+
 		// ── Handle streaming response ────────────────────────────
 		if provResp.IsStream {
+			// A stream that fails before its first event is failed over
+			// like a 5xx: nothing has been sent to the client yet
+			if wait := firstEventTimeout(getSetting); wait > 0 && provResp.Status >= 200 && provResp.Status < 300 {
+				peeked := peekStream(provResp.Body)
+				provResp.Body = peeked
+				if peeked.wait(wait) {
+					if msg, failed := streamStartError(peeked.buf, peeked.err); failed {
+						if r.Context().Err() != nil {
+							provResp.Body.Close()
+							logf("[proxy] Client disconnected before the stream from %q started; request cancelled (termination_reason=%s)",
+								account.Name, terminationClientDisconnected)
+							return
+						}
+						logf("[proxy] Stream from %q (request %s) failed: %s", account.Name, upstreamReqID, msg)
+						db.RecordAccountError(account.ID, msg)
+						slo.recordFailure(account)
+						cooldown.Set(account.ID, "server_error", 0)
+						if autoSwitchOnError && !isLastCandidate && retrySafe(502) {
+							logf("[proxy] Attempting failover (%d accounts left)...", len(allCandidates)-i-1)
+							provResp.Body.Close()
+							attempt := newAttempt(account, targetModel, "stream_error", attemptStart)
+							attempt.RequestID, attempt.Error = upstreamReqID, msg
+							failedAttempts = append(failedAttempts, attempt)
+							continue
+						}
+						// An error event is passed on as the stream; a
+						// stream without a whole event isn't worth starting
+						if !eventEnded(peeked.buf) {
+							provResp.Body.Close()
+							writeError(w, r, inboundFormat, 502, "api_error",
+								fmt.Sprintf("All provider accounts failed. Last error: %s", msg))
+							return
+						}
+					}
+				}
+			}
 			if provResp.Status >= 200 && provResp.Status < 300 {
 				db.RecordAccountSuccess(account.ID)
+				slo.recordSuccess(account)
 				cooldown.Clear(account.ID)
+				cooldown.ClearModel(account.ID, targetModel)
 			}
 
 			responseStream := provResp.Body
@@ -338,82 +1040,156 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 			// Convert stream format if there's a mismatch
 			if inboundFormat == "anthropic" && !targetIsAnthropic {
 				// Provider sends OpenAI SSE, client wants Anthropic SSE
-				responseStream = convert.ConvertSSEStream(provResp.Body, originalModel)
+				responseStream = convert.ConvertSSEStreamWithPing(provResp.Body, originalModel, req.toolNames, streamPingInterval(getSetting))
 			} else if inboundFormat == "openai" && targetIsAnthropic {
 				// Provider sends Anthropic SSE, client wants OpenAI SSE
-				responseStream = convert.ConvertAnthropicSSEToOpenAI(provResp.Body, targetModel)
+				responseStream = convert.ConvertAnthropicSSEToOpenAIWithUsage(provResp.Body, targetModel, req.includeUsage())
+			}
+			if strip, marker := reasoningStripping(getSetting); strip && provResp.Status >= 200 && provResp.Status < 300 {
+				// Before deanonymization, so reasoning is never restored
+				responseStream = newReasoningFilterStream(responseStream, inboundFormat, marker)
 			}
 
 			// Guardrails: deanonymize streaming response
+			// Unrestored tokens are reported when the stream ends, even
+			// if the client stopped reading; the header only if it didn't
+			unresolvedTokens := make(chan guardrails.Unresolved, 1)
 			if guardrailsActive {
-				responseStream = guardrails.CreateDeanonymizeStream(responseStream)
+				accountName, upstreamID := account.Name, upstreamReqID
+				responseStream = guardrails.CreateDeanonymizeStreamForTenantWithUnresolved(responseStream, guardrailsTenant, func(u guardrails.Unresolved) {
+					reportUnresolved(logf, u, accountName, upstreamID)
+					unresolvedTokens <- u
+				})
+			}
+			if injectRoutingMetadata && provResp.Status >= 200 && provResp.Status < 300 {
+				responseStream = newRoutingMetadataStream(responseStream, routingMetadata{
+					Account: account.Name, Provider: account.Provider, TargetModel: targetModel, Failover: isFailover,
+				})
 			}
+			// Closing the outermost wrapper stops every converter goroutine
+			// and closes the upstream body, even if the copy below ends early
+			defer responseStream.Close()
 
 			// Write SSE response headers
 			w.Header().Set("Content-Type", "text/event-stream")
 			w.Header().Set("Cache-Control", "no-cache")
 			w.Header().Set("Connection", "keep-alive")
 			w.Header().Set("X-Proxy-Account", account.Name)
+			accountRateLimitHeaders.set(w.Header(), account.ID, account.RateLimit)
+			if provResp.Status == 429 {
+				setUpstreamRetryAfter(w.Header(), provResp.Headers, account.ID)
+			}
+			if upstreamReqID != "" {
+				w.Header().Set(upstreamRequestIDHeader, upstreamReqID)
+			}
+			setConversionWarnings(w, req.conversionWarnings)
+			if debugHeaders && req.promptInjected {
+				w.Header().Set(injectedPromptHeader, "true")
+			}
 			if tenantCtx != nil {
 				w.Header().Set("X-Proxy-Tenant", tenantCtx.Name)
 			}
 			strategyLabel := strategy
-			if isFailover {
+			if cand.ModelFallback {
+				strategyLabel = modelFallbackStrategy
+			} else if isFailover {
 				strategyLabel = strategy + "+failover"
+			} else if failoverLimited {
+				strategyLabel = strategy + "+no-failover"
 			}
 			w.Header().Set("X-Proxy-Strategy", strategyLabel)
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Headers", "*")
-			w.Header().Set("Access-Control-Expose-Headers", "x-proxy-account, x-proxy-strategy, x-proxy-tenant")
+			// The served model and the request's cost are only known once
+			// the stream has been read, so they are sent as trailers.
+			w.Header().Set("Trailer", upstreamModelHeader)
+			w.Header().Add("Trailer", requestCostHeader+", "+requestTokensHeader)
+			if sessionID != "" {
+				w.Header().Add("Trailer", sessionCostHeader+", "+sessionTokensHeader)
+			}
+			if guardrailsActive && debugHeaders {
+				w.Header().Add("Trailer", guardrailsUnresolvedHeader)
+			}
 			w.WriteHeader(provResp.Status)
 
-			// Stream with flushing
-			flusher, hasFlusher := w.(http.Flusher)
-			buf := make([]byte, 32*1024)
-			for {
-				n, readErr := responseStream.Read(buf)
-				if n > 0 {
-					w.Write(buf[:n])
-					if hasFlusher {
-						flusher.Flush()
-					}
-				}
-				if readErr != nil {
-					break
-				}
+			// Stream with flushing; a client that went away or stopped
+			// reading ends the copy and closes the upstream
+			if err := copyStream(r.Context(), w, responseStream, stallTimeout); clientStalled(err) {
+				logf("[proxy] Client stopped reading the stream from %q for %s; aborted (termination_reason=%s)",
+					account.Name, stallTimeout, terminationClientStalled)
+			} else if err != nil && r.Context().Err() != nil {
+				logf("[proxy] Client disconnected from the stream from %q; upstream request cancelled (termination_reason=%s)",
+					account.Name, terminationClientDisconnected)
 			}
-			responseStream.Close()
 
-			// Read token counts from atomic usage (populated during streaming)
-			var inputTok, outputTok, cacheReadTok, cacheWriteTok int
+			// Read token counts from atomic usage (populated during streaming).
+			// The provider's reader is done by the time a stream ends, or
+			// once the upstream request is cancelled after a client
+			// disconnect; either way, what was counted is recorded.
+			var inputTok, outputTok, cacheReadTok, cacheWriteTok, reasoningTok int
+			var serverTools map[string]int
+			var actualModel string
 			if provResp.Usage != nil {
+				if !provResp.Usage.Wait(streamUsageWait) {
+					logf("[proxy] Stream usage from %q still incomplete after %s; recording what was read", account.Name, streamUsageWait)
+				}
 				inputTok = int(provResp.Usage.InputTokens.Load())
 				outputTok = int(provResp.Usage.OutputTokens.Load())
 				cacheReadTok = int(provResp.Usage.CacheReadTokens.Load())
 				cacheWriteTok = int(provResp.Usage.CacheWriteTokens.Load())
+				reasoningTok = int(provResp.Usage.ReasoningTokens.Load())
+				serverTools = provResp.Usage.ServerTools()
+				actualModel, _ = provResp.Usage.Model.Load().(string)
+			}
+			if actualModel != "" {
+				w.Header().Set(upstreamModelHeader, actualModel)
+			}
+			select {
+			case u := <-unresolvedTokens:
+				if debugHeaders && u.Total() > 0 {
+					w.Header().Set(guardrailsUnresolvedHeader, u.String())
+				}
+			default:
+			}
+			costUSD := models.EstimateCost(models.PricingModel(targetModel, actualModel), inputTok, outputTok) +
+				serverToolCost(serverTools, getSetting)
+			if provResp.Usage != nil && provResp.Usage.Cost() > 0 {
+				costUSD = provResp.Usage.Cost() // billed by the provider; beats our estimate
+			}
+			if provResp.Status >= 200 && provResp.Status < 300 {
+				checkUpstreamModel(logf, account, targetModel, actualModel)
+				usage := newRequestUsage(tenantIDForLog, sessionID, costUSD, inputTok+outputTok)
+				usage.setHeaders(w.Header())
+				if getSetting("stream_usage_comment") == "true" {
+					usage.writeComment(w)
+				}
 			}
 
 			// Record usage async
 			latencyMs := int(time.Since(startTime).Milliseconds())
-			tenantIDForLog := ""
-			if tenantCtx != nil {
-				tenantIDForLog = tenantCtx.ID
-			}
-			go func() {
-				costUSD := models.EstimateCost(targetModel, inputTok, outputTok)
+			countTokens(account.ID, inputTok, outputTok)
+			attemptsRecorded = true
+			db.Go(func() {
 				db.RecordUsage(account.ID, route.ConfigID, string(tier), originalModel, targetModel,
-					inputTok, outputTok, cacheReadTok, cacheWriteTok, costUSD, tenantIDForLog)
+					inputTok, outputTok, cacheReadTok, cacheWriteTok, reasoningTok, models.CountServerToolRequests(serverTools), costUSD, usageDims, attemptRows(failedAttempts)...)
 
 				if getSetting("request_logging") == "true" {
 					reqBody, respBody := "", ""
 					if getSetting("detailed_request_logging") == "true" {
-						reqBody = string(bodyBytes)
+						reqBody = req.logBody()
 					}
-					db.InsertRequestLog(method, path, inboundFormat, account.ID, account.Name, account.Provider,
-						originalModel, targetModel, provResp.Status, inputTok, outputTok,
-						latencyMs, true, isFailover, "", reqBody, respBody, tenantIDForLog)
+					db.InsertRequestLog(db.RequestLog{
+						Method: method, Path: path, InboundFormat: inboundFormat,
+						AccountID: account.ID, AccountName: account.Name, Provider: account.Provider,
+						OriginalModel: originalModel, RoutedModel: targetModel, RoutedModelActual: actualModel,
+						StatusCode: provResp.Status, InputTokens: inputTok, OutputTokens: outputTok,
+						LatencyMs: latencyMs, IsStream: true, IsFailover: isFailover,
+						RequestBody: reqBody, ResponseBody: respBody,
+						TenantID: tenantIDForLog, TenantKeyLabel: tenantKeyLabel,
+						UpstreamRequestID: upstreamReqID, FailoverAttempts: attemptsJSON(failedAttempts), Retries: retries,
+						AnthropicVersion: anthropicVersion, GuardrailsBypassed: guardrailsBypassed,
+						EndUser: usageDims.EndUser, Tags: usageDims.Tags, RequestID: reqID, ClientRequestID: clientReqID,
+					})
 				}
-			}()
+			})
 
 			return
 		}
@@ -430,22 +1206,21 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 		// OAuth 401 retry: force sync and retry once
 		if provResp.Status == 401 && account.AuthType == "oauth" && !isFailover {
 			if updated := auth.ForceSyncFromFile(&account); updated != nil {
-				log.Printf("[proxy] Retrying with refreshed token for %q", account.Name)
-				provResp2, err2 := provider.Forward(*updated, provider.ForwardOptions{
-					Path:              forwardPath,
-					Method:            method,
-					Headers:           reqHeaders,
-					Body:              forwardBody,
-					APIKey:            updated.APIKey,
-					BaseURL:           updated.BaseURL,
-					AuthType:          updated.AuthType,
-					ExternalAccountID: updated.ExternalAccountID,
-				})
+				logf("[proxy] Retrying with refreshed token for %q", account.Name)
+				// The first attempt consumed the body reader
+				_, retryBody, retryLen, err2 := req.forward(inboundFormat, targetIsAnthropic, targetModel, path)
+				var provResp2 *provider.Response
 				if err2 == nil {
+					provResp2, err2 = forwardTo(*updated, retryBody, retryLen)
+				}
+				if err2 != nil {
+					logf("[proxy] Retry with refreshed token failed for %q: %v", account.Name, err2)
+				} else {
 					responseBodyBytes, _ = io.ReadAll(provResp2.Body)
 					provResp2.Body.Close()
 					responseBodyStr = string(responseBodyBytes)
 					provResp = provResp2
+					upstreamReqID = upstreamRequestID(provResp.Headers)
 				}
 			}
 		}
@@ -456,7 +1231,7 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 				// Provider returned OpenAI format, client wants Anthropic
 				var openaiResp map[string]any
 				if err := json.Unmarshal(responseBodyBytes, &openaiResp); err == nil {
-					anthropicResp := convert.OpenAIToAnthropic(openaiResp, originalModel)
+					anthropicResp := convert.OpenAIToAnthropic(openaiResp, originalModel, req.toolNames)
 					if b, err := json.Marshal(anthropicResp); err == nil {
 						responseBodyStr = string(b)
 					}
@@ -471,6 +1246,9 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 					}
 				}
 			}
+			if strip, marker := reasoningStripping(getSetting); strip {
+				responseBodyStr = string(stripReasoning([]byte(responseBodyStr), inboundFormat, marker))
+			}
 		} else {
 			// Error response: convert to the client's expected error format
 			if inboundFormat == "openai" {
@@ -478,26 +1256,41 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 			} else if !targetIsAnthropic {
 				responseBodyStr = toAnthropicError(responseBodyStr, provResp.Status, account.Provider)
 			}
+			responseBodyStr = withProviderRequestID(responseBodyStr, upstreamReqID)
 		}
 
 		// Guardrails: deanonymize non-streaming response
 		if guardrailsActive {
-			responseBodyStr = guardrails.Deanonymize(responseBodyStr)
+			var unresolved guardrails.Unresolved
+			responseBodyStr, unresolved = guardrails.DeanonymizeForTenantWithUnresolved(responseBodyStr, guardrailsTenant)
+			reportUnresolved(logf, unresolved, account.Name, upstreamReqID)
+			if debugHeaders && unresolved.Total() > 0 {
+				w.Header().Set(guardrailsUnresolvedHeader, unresolved.String())
+			}
+		}
+		if injectRoutingMetadata && provResp.Status >= 200 && provResp.Status < 300 {
+			responseBodyStr = string(withRoutingMetadata([]byte(responseBodyStr), routingMetadata{
+				Account: account.Name, Provider: account.Provider, TargetModel: targetModel, Failover: isFailover,
+			}))
 		}
 
 		// Track account status
 		if provResp.Status >= 200 && provResp.Status < 300 {
 			db.RecordAccountSuccess(account.ID)
+			slo.recordSuccess(account)
 			cooldown.Clear(account.ID)
+			cooldown.ClearModel(account.ID, targetModel)
+			checkUpstreamModel(logf, account, targetModel, provResp.Model)
 		} else if provResp.Status == 401 {
-			db.UpdateAccountStatus(account.ID, "expired", "Authentication failed (401)")
+			db.SetStatus(account.ID, db.StatusExpired, "Authentication failed (401)")
 			db.RecordAccountError(account.ID, "Authentication failed (401)")
+			slo.recordFailure(account)
 		} else if provResp.Status == 429 {
-			db.UpdateAccountStatus(account.ID, "rate_limited", "Rate limited (429)")
+			db.SetStatus(account.ID, db.StatusRateLimited, "Rate limited (429)")
 			db.RecordAccountError(account.ID, "Rate limited (429)")
 		} else if provResp.Status >= 400 {
 			db.RecordAccountError(account.ID, fmt.Sprintf("HTTP %d", provResp.Status))
-			db.UpdateAccountStatus(account.ID, "error", fmt.Sprintf("HTTP %d", provResp.Status))
+			db.SetStatus(account.ID, db.StatusError, fmt.Sprintf("HTTP %d", provResp.Status))
 		}
 
 		upstreamContentType := provResp.Headers["content-type"]
@@ -507,30 +1300,54 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 
 		w.Header().Set("Content-Type", upstreamContentType)
 		w.Header().Set("X-Proxy-Account", account.Name)
+		accountRateLimitHeaders.set(w.Header(), account.ID, account.RateLimit)
+		if provResp.Status == 429 {
+			setUpstreamRetryAfter(w.Header(), provResp.Headers, account.ID)
+		}
+		if upstreamReqID != "" {
+			w.Header().Set(upstreamRequestIDHeader, upstreamReqID)
+		}
+		setConversionWarnings(w, req.conversionWarnings)
+		if debugHeaders && req.promptInjected {
+			w.Header().Set(injectedPromptHeader, "true")
+		}
 		if tenantCtx != nil {
 			w.Header().Set("X-Proxy-Tenant", tenantCtx.Name)
 		}
 		strategyLabel := strategy
-		if isFailover {
+		if cand.ModelFallback {
+			strategyLabel = modelFallbackStrategy
+		} else if isFailover {
 			strategyLabel = strategy + "+failover"
+		} else if failoverLimited {
+			strategyLabel = strategy + "+no-failover"
 		}
 		w.Header().Set("X-Proxy-Strategy", strategyLabel)
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "*")
-		w.Header().Set("Access-Control-Expose-Headers", "x-proxy-account, x-proxy-strategy, x-proxy-tenant")
+		if provResp.Model != "" {
+			w.Header().Set(upstreamModelHeader, provResp.Model)
+		}
+		costUSD := models.EstimateCost(models.PricingModel(targetModel, provResp.Model), provResp.InputTokens, provResp.OutputTokens) +
+			serverToolCost(provResp.ServerToolUse, getSetting)
+		if provResp.CostUSD > 0 {
+			costUSD = provResp.CostUSD // billed by the provider; beats our estimate
+		}
+		if provResp.Status >= 200 && provResp.Status < 300 {
+			newRequestUsage(tenantIDForLog, sessionID, costUSD, provResp.InputTokens+provResp.OutputTokens).setHeaders(w.Header())
+		}
 		w.WriteHeader(provResp.Status)
-		w.Write([]byte(responseBodyStr))
+		if err := writeBody(w, []byte(responseBodyStr), stallTimeout); clientStalled(err) {
+			logf("[proxy] Client stopped reading the response from %q for %s; aborted (termination_reason=%s)",
+				account.Name, stallTimeout, terminationClientStalled)
+		}
 
 		// Record usage async
 		latencyMs := int(time.Since(startTime).Milliseconds())
-		tenantIDForLog2 := ""
-		if tenantCtx != nil {
-			tenantIDForLog2 = tenantCtx.ID
-		}
-		go func() {
-			costUSD := models.EstimateCost(targetModel, provResp.InputTokens, provResp.OutputTokens)
+		countTokens(account.ID, provResp.InputTokens, provResp.OutputTokens)
+		attemptsRecorded = true
+		db.Go(func() {
 			db.RecordUsage(account.ID, route.ConfigID, string(tier), originalModel, targetModel,
-				provResp.InputTokens, provResp.OutputTokens, provResp.CacheReadTokens, provResp.CacheWriteTokens, costUSD, tenantIDForLog2)
+				provResp.InputTokens, provResp.OutputTokens, provResp.CacheReadTokens, provResp.CacheWriteTokens, provResp.ReasoningTokens,
+				models.CountServerToolRequests(provResp.ServerToolUse), costUSD, usageDims, attemptRows(failedAttempts)...)
 
 			if getSetting("request_logging") == "true" {
 				errMessage := ""
@@ -543,14 +1360,23 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 				}
 				reqBody, respBody := "", ""
 				if getSetting("detailed_request_logging") == "true" {
-					reqBody = string(bodyBytes)
+					reqBody = req.logBody()
 					respBody = responseBodyStr
 				}
-				db.InsertRequestLog(method, path, inboundFormat, account.ID, account.Name, account.Provider,
-					originalModel, targetModel, provResp.Status, provResp.InputTokens, provResp.OutputTokens,
-					latencyMs, false, isFailover, errMessage, reqBody, respBody, tenantIDForLog2)
+				db.InsertRequestLog(db.RequestLog{
+					Method: method, Path: path, InboundFormat: inboundFormat,
+					AccountID: account.ID, AccountName: account.Name, Provider: account.Provider,
+					OriginalModel: originalModel, RoutedModel: targetModel, RoutedModelActual: provResp.Model,
+					StatusCode: provResp.Status, InputTokens: provResp.InputTokens, OutputTokens: provResp.OutputTokens,
+					LatencyMs: latencyMs, IsFailover: isFailover,
+					ErrorMessage: errMessage, RequestBody: reqBody, ResponseBody: respBody,
+					TenantID: tenantIDForLog, TenantKeyLabel: tenantKeyLabel,
+					UpstreamRequestID: upstreamReqID, FailoverAttempts: attemptsJSON(failedAttempts), Retries: retries,
+					AnthropicVersion: anthropicVersion, GuardrailsBypassed: guardrailsBypassed,
+					EndUser: usageDims.EndUser, Tags: usageDims.Tags, RequestID: reqID, ClientRequestID: clientReqID,
+				})
 			}
-		}()
+		})
 
 		return
 	}
@@ -559,19 +1385,195 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 	writeError(w, r, inboundFormat, 502, "api_error", "No accounts available after exhausting all candidates")
 }
 
+// streamUsageWait bounds how long a finished stream waits for the provider's
+// usage reader, which can be stuck on a stalled upstream after a disconnect.
+const streamUsageWait = 5 * time.Second
+
+// conversionWarningsHeader lists content the proxy had to drop when
+// converting the request for the target provider.
+var conversionWarningsHeader = exposeHeader("X-CodeGate-Conversion-Warnings")
+
+func setConversionWarnings(w http.ResponseWriter, warnings []string) {
+	if len(warnings) > 0 {
+		w.Header().Set(conversionWarningsHeader, strings.Join(warnings, "; "))
+	}
+}
+
+// ─── Upstream model drift ───────────────────────────────────────────────────
+
+// upstreamModelHeader carries the model the provider reported serving.
+var upstreamModelHeader = exposeHeader("X-CodeGate-Upstream-Model")
+
+// checkUpstreamModel flags responses where the provider served a different
+// model than the one requested (alias resolution, OpenRouter fallbacks, ...).
+// The served model is whatever the upstream reports, so it goes to the log
+// only; the metric is labelled with what the proxy configured.
+func checkUpstreamModel(logf func(string, ...any), account db.Account, targetModel, actualModel string) {
+	if actualModel == "" || actualModel == targetModel {
+		return
+	}
+	logf("[proxy] WARN upstream model drift on %q (%s): requested %s, served %s",
+		account.Name, account.Provider, targetModel, actualModel)
+	metrics.Inc("codegate_upstream_model_drift_total", "account_id", account.ID, "target_model", targetModel)
+}
+
+// ─── Upstream request IDs ───────────────────────────────────────────────────
+
+// upstreamRequestIDHeader carries the provider's request ID so failed calls can
+// be referenced in provider support tickets.
+var upstreamRequestIDHeader = exposeHeader("X-Upstream-Request-Id")
+
+// failoverAttempt is a candidate that failed before the final attempt.
+type failoverAttempt struct {
+	Account   string `json:"account"`
+	Status    int    `json:"status,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// Retry is set on attempts retried on the same account
+	Retry bool `json:"retry,omitempty"`
+
+	// Recorded in request_attempts only
+	AccountID string `json:"-"`
+	Model     string `json:"-"`
+	LatencyMs int    `json:"-"`
+	Reason    string `json:"-"`
+}
+
+// newAttempt starts the record of an attempt on acct, begun at start, that
+// failed for reason.
+func newAttempt(acct db.Account, model, reason string, start time.Time) failoverAttempt {
+	return failoverAttempt{Account: acct.Name, AccountID: acct.ID, Model: model, Reason: reason,
+		LatencyMs: int(time.Since(start).Milliseconds())}
+}
+
+// attemptReason names why an attempt failed, given its error or status,
+// as its cooldown does.
+func attemptReason(status int, err error) string {
+	switch {
+	case provider.IsTimeout(err):
+		return "timeout"
+	case err != nil:
+		return "connection_error"
+	case status == 429:
+		return "rate_limit"
+	}
+	return "server_error"
+}
+
+// attemptRows converts failed attempts to request_attempts rows.
+func attemptRows(attempts []failoverAttempt) []db.Attempt {
+	rows := make([]db.Attempt, len(attempts))
+	for i, a := range attempts {
+		rows[i] = db.Attempt{
+			AccountID: a.AccountID, RoutedModel: a.Model, StatusCode: a.Status, LatencyMs: a.LatencyMs,
+			Reason: a.Reason, Error: a.Error, Retry: a.Retry,
+		}
+	}
+	return rows
+}
+
+// describe returns the attempt's failure for logs: its status, or its error.
+func (a failoverAttempt) describe() string {
+	if a.Error != "" {
+		return a.Error
+	}
+	return fmt.Sprintf("status %d", a.Status)
+}
+
+// priorityHeader lets clients mark requests as interactive (default) or
+// background so batch jobs can't starve interactive sessions of a tenant.
+var priorityHeader = allowHeader("X-CodeGate-Priority")
+
+// defaultBackgroundHeadroomPct is the share of a tenant's rate limit reserved
+// for interactive traffic.
+const defaultBackgroundHeadroomPct = 20
+
+// backgroundHeadroom returns how many requests per minute of the tenant's
+// limit background traffic may not use, from the background_headroom_pct
+// setting (tenant or global). The share rounds down, and background traffic
+// always keeps at least one request, so small limits don't lock it out.
+func backgroundHeadroom(t *tenant.Tenant) int {
+	if t.RateLimit <= 0 {
+		return 0
+	}
+	pct := defaultBackgroundHeadroomPct
+	if v, err := strconv.Atoi(tenant.GetSetting(t, "background_headroom_pct")); err == nil && v >= 0 && v <= 100 {
+		pct = v
+	}
+	return min(t.RateLimit*pct/100, t.RateLimit-1)
+}
+
+// serverToolCost prices server tool requests. A setting named
+// server_tool_cost_<counter> (e.g. server_tool_cost_web_search_requests)
+// overrides the built-in USD-per-request rate for that counter.
+func serverToolCost(use map[string]int, getSetting func(string) string) float64 {
+	if len(use) == 0 {
+		return 0
+	}
+	return models.EstimateServerToolCost(use, func(counter string) (float64, bool) {
+		v, err := strconv.ParseFloat(getSetting("server_tool_cost_"+counter), 64)
+		return v, err == nil && v >= 0
+	})
+}
+
+// upstreamRequestID returns the provider request ID from lowercased response
+// headers (Anthropic sends request-id, OpenAI-compatible APIs x-request-id).
+func upstreamRequestID(headers map[string]string) string {
+	if id := headers["request-id"]; id != "" {
+		return id
+	}
+	return headers["x-request-id"]
+}
+
+// withProviderRequestID adds a top-level provider_request_id field to a JSON
+// error body. Non-JSON bodies are returned unchanged.
+func withProviderRequestID(body, requestID string) string {
+	if requestID == "" {
+		return body
+	}
+	var parsed map[string]any
+	if err := json.Unmarshal([]byte(body), &parsed); err != nil {
+		return body
+	}
+	parsed["provider_request_id"] = requestID
+	b, err := json.Marshal(parsed)
+	if err != nil {
+		return body
+	}
+	return string(b)
+}
+
+func attemptsJSON(attempts []failoverAttempt) string {
+	if len(attempts) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(attempts)
+	return string(b)
+}
+
 // ─── Error format helpers ───────────────────────────────────────────────────
 
 func toOpenAIError(rawBody string, status int, providerName string) string {
 	var parsed map[string]any
+	errType := "server_error"
+	switch {
+	case status == 401:
+		errType = "authentication_error"
+	case status == 429:
+		errType = "rate_limit_error"
+	case status < 500:
+		errType = "invalid_request_error"
+	}
+
 	if err := json.Unmarshal([]byte(rawBody), &parsed); err == nil {
 		errMsg := extractErrorMessage(parsed, providerName, status)
 		b, _ := json.Marshal(map[string]any{
-			"error": map[string]any{"message": errMsg, "type": "server_error", "code": status},
+			"error": map[string]any{"message": errMsg, "type": errType, "code": status},
 		})
 		return string(b)
 	}
 	b, _ := json.Marshal(map[string]any{
-		"error": map[string]any{"message": fmt.Sprintf("Provider %s returned HTTP %d", providerName, status), "type": "server_error", "code": status},
+		"error": map[string]any{"message": fmt.Sprintf("Provider %s returned HTTP %d", providerName, status), "type": errType, "code": status},
 	})
 	return string(b)
 }
@@ -624,17 +1626,8 @@ func extractErrorMessage(parsed map[string]any, providerName string, status int)
 
 // ─── Helpers ───────────────────────────────────────────────────────────────
 
-func deepCopy(m map[string]any) map[string]any {
-	b, _ := json.Marshal(m)
-	var result map[string]any
-	json.Unmarshal(b, &result)
-	return result
-}
-
-
 func writeError(w http.ResponseWriter, r *http.Request, inboundFormat string, status int, errType, message string) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.WriteHeader(status)
 
 	if inboundFormat == "openai" {
@@ -654,18 +1647,3 @@ func extractAPIKey(r *http.Request) string {
 	}
 	return ""
 }
-
-func withCORS(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "*")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(204)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
-}
@@ -1,9 +1,30 @@
 package proxy
 
 import (
+	"codegate-proxy/internal/cooldown"
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/guardrails"
+	"codegate-proxy/internal/health"
+	"codegate-proxy/internal/metrics"
+	"codegate-proxy/internal/models"
+	"codegate-proxy/internal/ratelimit"
+	"codegate-proxy/internal/tenant"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestHealthEndpoint(t *testing.T) {
@@ -27,6 +48,9 @@ func TestHealthEndpoint(t *testing.T) {
 }
 
 func TestModelsEndpoint(t *testing.T) {
+	tdb := dbtest.Open(t)
+	resetModelsCache(t)
+	tdb.AddAccount("acct-claude", "claude", "anthropic", "")
 	handler := Handler()
 
 	req := httptest.NewRequest("GET", "/v1/models", nil)
@@ -62,6 +86,14 @@ func TestToOpenAIError(t *testing.T) {
 	if errObj["message"] != "Rate limit exceeded" {
 		t.Error("should preserve error message")
 	}
+	if errObj["type"] != "rate_limit_error" {
+		t.Errorf("error type = %v, want rate_limit_error", errObj["type"])
+	}
+
+	json.Unmarshal([]byte(toOpenAIError(`{"error":{"message":"bad"}}`, 400, "anthropic")), &parsed)
+	if got := parsed["error"].(map[string]any)["type"]; got != "invalid_request_error" {
+		t.Errorf("400 error type = %v, want invalid_request_error", got)
+	}
 }
 
 func TestToAnthropicError(t *testing.T) {
@@ -164,3 +196,934 @@ func containsHelper(s, substr string) bool {
 	}
 	return false
 }
+
+// ─── Upstream model drift ───────────────────────────────────────────────────
+
+func TestUpstreamModelDrift_NonStreaming(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("request_logging", "true")
+	metrics.Reset()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"chatcmpl-1","object":"chat.completion","model":"gpt-4o-mini",
+			"choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}],
+			"usage":{"prompt_tokens":1000,"completion_tokens":500}}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-drift", "drift", "openrouter", upstream.URL)
+	logs := &lockedBuffer{}
+	log.SetOutput(logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-CodeGate-Upstream-Model"); got != "gpt-4o-mini" {
+		t.Errorf("upstream model header = %q, want gpt-4o-mini", got)
+	}
+	if id := w.Header().Get(requestIDHeader); !strings.Contains(logs.String(), "[proxy] ["+id+"] WARN upstream model drift") {
+		t.Errorf("drift log line without the request ID %s:\n%s", id, logs.String())
+	}
+	if n := metrics.Counter("codegate_upstream_model_drift_total",
+		"account_id", "acct-drift", "target_model", "gpt-4o"); n != 1 {
+		t.Errorf("drift counter = %d, want 1", n)
+	}
+
+	var actual sql.NullString
+	waitFor(t, func() bool {
+		return tdb.QueryRow("SELECT routed_model_actual FROM request_logs").Scan(&actual) == nil
+	})
+	if actual.String != "gpt-4o-mini" {
+		t.Errorf("routed_model_actual = %q, want gpt-4o-mini", actual.String)
+	}
+
+	var cost float64
+	waitFor(t, func() bool {
+		return tdb.QueryRow("SELECT cost_usd FROM usage").Scan(&cost) == nil
+	})
+	if want := models.EstimateCost("gpt-4o-mini", 1000, 500); math.Abs(cost-want) > 1e-9 {
+		t.Errorf("cost_usd = %v, want %v (priced as served model)", cost, want)
+	}
+}
+
+func TestUpstreamModelDrift_StreamingTrailer(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("request_logging", "true")
+	metrics.Reset()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"model\":\"claude-sonnet-4-20250514\",\"usage\":{\"input_tokens\":10}}}\n\n")
+		fmt.Fprint(w, "event: message_delta\ndata: {\"type\":\"message_delta\",\"usage\":{\"output_tokens\":5}}\n\n")
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-stream", "stream", "anthropic", upstream.URL)
+
+	req := httptest.NewRequest("POST", "/v1/messages",
+		strings.NewReader(`{"model":"claude-sonnet-4-6","stream":true,"max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`))
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+
+	res := w.Result()
+	if got := res.Trailer.Get("X-CodeGate-Upstream-Model"); got != "claude-sonnet-4-20250514" {
+		t.Errorf("upstream model trailer = %q, want claude-sonnet-4-20250514", got)
+	}
+
+	var actual sql.NullString
+	waitFor(t, func() bool {
+		return tdb.QueryRow("SELECT routed_model_actual FROM request_logs").Scan(&actual) == nil
+	})
+	if actual.String != "claude-sonnet-4-20250514" {
+		t.Errorf("routed_model_actual = %q", actual.String)
+	}
+}
+
+func TestUpstreamModel_NoDriftWhenMatching(t *testing.T) {
+	tdb := dbtest.Open(t)
+	metrics.Reset()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}]}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-same", "same", "openai", upstream.URL)
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+
+	if got := w.Header().Get("X-CodeGate-Upstream-Model"); got != "gpt-4o" {
+		t.Errorf("upstream model header = %q, want gpt-4o", got)
+	}
+	for series := range metrics.Snapshot() {
+		if strings.HasPrefix(series, "codegate_upstream_model_drift_total") {
+			t.Errorf("no drift expected, got %v", metrics.Snapshot())
+		}
+	}
+	var n int
+	waitFor(t, func() bool {
+		return tdb.QueryRow("SELECT COUNT(*) FROM usage").Scan(&n) == nil && n == 1
+	})
+}
+
+func TestLegacyAlias_SentAsSnapshot(t *testing.T) {
+	tdb := dbtest.Open(t)
+	metrics.Reset()
+
+	var sent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model string `json:"model"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		sent = body.Model
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":"msg_1","type":"message","role":"assistant","model":%q,"content":[{"type":"text","text":"hi"}],"usage":{"input_tokens":1000,"output_tokens":500}}`, body.Model)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-claude", "claude", "anthropic", upstream.URL)
+
+	req := httptest.NewRequest("POST", "/v1/messages",
+		strings.NewReader(`{"model":"claude-3-opus-latest","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`))
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if sent != "claude-3-opus-20240229" {
+		t.Errorf("upstream sent model %q, want claude-3-opus-20240229", sent)
+	}
+	if n := metrics.Counter("codegate_upstream_model_drift_total",
+		"account_id", "acct-claude", "target_model", "claude-3-opus-20240229"); n != 0 {
+		t.Errorf("drift counter = %d, want 0", n)
+	}
+
+	// Priced as Opus, not at the default rate
+	var cost float64
+	waitFor(t, func() bool {
+		return tdb.QueryRow("SELECT cost_usd FROM usage").Scan(&cost) == nil
+	})
+	if want := 1000*15.0/1e6 + 500*75.0/1e6; math.Abs(cost-want) > 1e-9 {
+		t.Errorf("cost_usd = %v, want %v", cost, want)
+	}
+}
+
+// waitFor polls cond until it holds; usage and request logs are written async.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// ─── Tenant auth ────────────────────────────────────────────────────────────
+
+func TestTenantKeyLabelLogged(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("request_logging", "true")
+	tdb.Exec("INSERT INTO tenants (id, name, api_key_hash, api_key_prefix) VALUES ('t1', 'Acme', 'legacy-hash', 'cgk_lega')")
+	sum := sha256.Sum256([]byte("cgk_ci_secret"))
+	tdb.Exec("INSERT INTO tenant_keys (id, tenant_id, key_hash, key_prefix, label) VALUES ('k1', 't1', ?, 'cgk_ci_s', 'github-actions')", hex.EncodeToString(sum[:]))
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}]}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-t", "tenant-acct", "openai", upstream.URL)
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Authorization", "Bearer cgk_ci_secret")
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-Proxy-Tenant"); got != "Acme" {
+		t.Errorf("X-Proxy-Tenant = %q, want Acme", got)
+	}
+
+	var tenantID, label sql.NullString
+	waitFor(t, func() bool {
+		return tdb.QueryRow("SELECT tenant_id, tenant_key_label FROM request_logs").Scan(&tenantID, &label) == nil
+	})
+	if tenantID.String != "t1" || label.String != "github-actions" {
+		t.Errorf("logged tenant=%q label=%q, want t1/github-actions", tenantID.String, label.String)
+	}
+	waitFor(t, func() bool {
+		var lastUsed sql.NullString
+		tdb.QueryRow("SELECT last_used_at FROM tenant_keys WHERE id = 'k1'").Scan(&lastUsed)
+		return lastUsed.Valid
+	})
+}
+
+func TestTenantAuth_FailsClosedOnSchemaDrift(t *testing.T) {
+	tdb := dbtest.Open(t)
+	t.Setenv("PROXY_API_KEY", "")
+	tdb.Exec("INSERT INTO tenants (id, name, api_key_hash, api_key_prefix) VALUES ('t1', 'Acme', 'hash', 'cgk_')")
+	tdb.Exec("DROP TABLE tenant_settings")
+	db.CheckSchema(false)
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+
+	req := httptest.NewRequest("POST", "/v1/messages",
+		strings.NewReader(`{"model":"claude-sonnet-4-20250514","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`))
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+	if w.Code != 503 || !strings.Contains(w.Body.String(), "Tenant authentication is unavailable") {
+		t.Errorf("status = %d, body = %s; want 503 while tenants can't be checked", w.Code, w.Body.String())
+	}
+}
+
+// ─── Upstream request IDs ───────────────────────────────────────────────────
+
+func TestRelayed429_PreservesUpstreamRequestID(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("request_logging", "true")
+
+	overloaded := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Request-Id", "req_first")
+		w.WriteHeader(529)
+		fmt.Fprint(w, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`)
+	}))
+	defer overloaded.Close()
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Request-Id", "req_final")
+		w.WriteHeader(429)
+		fmt.Fprint(w, `{"type":"error","error":{"type":"rate_limit_error","message":"Too many requests"}}`)
+	}))
+	defer limited.Close()
+
+	tdb.AddAccount("acct-529", "primary", "anthropic", overloaded.URL)
+	tdb.AddAccount("acct-429", "backup", "anthropic", limited.URL)
+	tdb.Exec("INSERT INTO configs (id, name, is_active) VALUES ('cfg', 'default', 1)")
+	tdb.Exec("INSERT INTO config_tiers (id, config_id, tier, account_id, priority) VALUES ('ct1', 'cfg', 'sonnet', 'acct-529', 10)")
+	tdb.Exec("INSERT INTO config_tiers (id, config_id, tier, account_id, priority) VALUES ('ct2', 'cfg', 'sonnet', 'acct-429', 5)")
+
+	req := httptest.NewRequest("POST", "/v1/messages",
+		strings.NewReader(`{"model":"claude-sonnet-4-20250514","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`))
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+
+	if w.Code != 429 {
+		t.Fatalf("status = %d, want 429 (body %s)", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-Upstream-Request-Id"); got != "req_final" {
+		t.Errorf("X-Upstream-Request-Id = %q, want req_final", got)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if body["provider_request_id"] != "req_final" {
+		t.Errorf("provider_request_id = %v, want req_final", body["provider_request_id"])
+	}
+	if body["type"] != "error" {
+		t.Errorf("relayed body should keep the Anthropic error shape: %v", body)
+	}
+
+	var upstreamID, attempts sql.NullString
+	waitFor(t, func() bool {
+		return tdb.QueryRow("SELECT upstream_request_id, failover_attempts FROM request_logs").Scan(&upstreamID, &attempts) == nil
+	})
+	if upstreamID.String != "req_final" {
+		t.Errorf("logged upstream_request_id = %q, want req_final", upstreamID.String)
+	}
+	if !strings.Contains(attempts.String, `"request_id":"req_first"`) || !strings.Contains(attempts.String, `"status":529`) {
+		t.Errorf("failover_attempts = %q, want the skipped 529 with req_first", attempts.String)
+	}
+}
+
+func TestWithProviderRequestID(t *testing.T) {
+	body := toOpenAIError(`{"error":{"message":"Rate limit exceeded"}}`, 429, "openai")
+	out := withProviderRequestID(body, "req_123")
+
+	var parsed map[string]any
+	if err := json.Unmarshal([]byte(out), &parsed); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if parsed["provider_request_id"] != "req_123" {
+		t.Errorf("provider_request_id = %v", parsed["provider_request_id"])
+	}
+	if parsed["error"].(map[string]any)["message"] != "Rate limit exceeded" {
+		t.Error("error message should be preserved")
+	}
+
+	if got := withProviderRequestID("not json", "req_123"); got != "not json" {
+		t.Errorf("non-JSON body should be unchanged, got %q", got)
+	}
+	if got := withProviderRequestID(body, ""); got != body {
+		t.Error("empty request ID should leave body unchanged")
+	}
+}
+
+// ─── API flavor ─────────────────────────────────────────────────────────────
+
+func TestGLMAnthropicFlavor_NoConversion(t *testing.T) {
+	tdb := dbtest.Open(t)
+
+	reqBody := `{"model":"claude-sonnet-4-6","max_tokens":1024,"messages":[` +
+		`{"role":"user","content":"2+2?"},` +
+		`{"role":"assistant","content":[{"type":"thinking","thinking":"add them","signature":"sig"},{"type":"text","text":"4"}]},` +
+		`{"role":"user","content":"and 3+3?"}]}`
+	respBody := `{"id":"msg_glm","type":"message","role":"assistant","model":"glm-4.6",` +
+		`"content":[{"type":"thinking","thinking":"add again"},{"type":"text","text":"6"}],` +
+		`"stop_reason":"end_turn","usage":{"input_tokens":42,"output_tokens":7}}`
+
+	var gotPath, gotAuth, gotBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, respBody)
+	}))
+	defer upstream.Close()
+
+	tdb.AddAccount("acct-glm", "glm", "glm", upstream.URL+"/api/anthropic")
+	tdb.Exec("UPDATE accounts SET api_flavor = 'anthropic' WHERE id = 'acct-glm'")
+
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(reqBody))
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if gotPath != "/api/anthropic/v1/messages" {
+		t.Errorf("upstream path = %q, want /api/anthropic/v1/messages", gotPath)
+	}
+	if gotAuth != "" {
+		t.Errorf("Authorization = %q, want Anthropic-style x-api-key auth", gotAuth)
+	}
+	if gotBody != reqBody {
+		t.Errorf("request body was rewritten:\n got %s\nwant %s", gotBody, reqBody)
+	}
+	if w.Body.String() != respBody {
+		t.Errorf("response body was rewritten:\n got %s\nwant %s", w.Body.String(), respBody)
+	}
+
+	var input int
+	waitFor(t, func() bool {
+		return tdb.QueryRow("SELECT input_tokens FROM usage").Scan(&input) == nil
+	})
+	if input != 42 {
+		t.Errorf("usage input_tokens = %d, want 42", input)
+	}
+}
+
+// ─── Server tool usage ──────────────────────────────────────────────────────
+
+func TestServerToolUse_RecordedAndPriced(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("server_tool_cost_web_search_requests", "0.02")
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-6",`+
+			`"content":[{"type":"text","text":"found it"}],`+
+			`"usage":{"input_tokens":1000,"output_tokens":100,"server_tool_use":{"web_search_requests":4}}}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-search", "search", "anthropic", upstream.URL)
+
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(
+		`{"model":"claude-sonnet-4-6","max_tokens":64,"tools":[{"type":"web_search_20250305","name":"web_search"}],`+
+			`"messages":[{"role":"user","content":"news?"}]}`))
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	var searches int
+	var cost float64
+	waitFor(t, func() bool {
+		return tdb.QueryRow("SELECT server_tool_requests, cost_usd FROM usage").Scan(&searches, &cost) == nil
+	})
+	if searches != 4 {
+		t.Errorf("server_tool_requests = %d, want 4", searches)
+	}
+	want := models.EstimateCost("claude-sonnet-4-6", 1000, 100) + 4*0.02
+	if math.Abs(cost-want) > 1e-9 {
+		t.Errorf("cost_usd = %v, want %v", cost, want)
+	}
+}
+
+// ─── Readiness ──────────────────────────────────────────────────────────────
+
+func readyResponse(t *testing.T) (int, map[string]any) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+	var body map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	return w.Code, body
+}
+
+func TestReady(t *testing.T) {
+	dbtest.Open(t)
+	db.CheckWritable()
+
+	code, body := readyResponse(t)
+	if code != 200 || body["status"] != "ready" {
+		t.Errorf("ready = %d %v", code, body)
+	}
+}
+
+func TestReady_ReadOnly(t *testing.T) {
+	dbtest.Open(t)
+	t.Cleanup(func() { db.CheckWritable() })
+	t.Setenv("DB_READONLY", "true")
+	db.CheckWritable()
+
+	code, body := readyResponse(t)
+	if code != 200 || body["status"] != "degraded" {
+		t.Fatalf("ready = %d %v", code, body)
+	}
+	if dbState, _ := body["database"].(map[string]any); dbState["writable"] != false {
+		t.Errorf("database = %v, want writable=false", body["database"])
+	}
+	if features, _ := body["disabled_features"].([]any); len(features) != len(db.ReadOnlyFeatures) {
+		t.Errorf("disabled_features = %v", body["disabled_features"])
+	}
+}
+
+func TestReady_DatabaseUnavailable(t *testing.T) {
+	dbtest.Open(t)
+	db.Close()
+
+	code, body := readyResponse(t)
+	if code != 503 || body["status"] != "unavailable" {
+		t.Errorf("ready = %d %v", code, body)
+	}
+}
+
+func TestReady_GuardrailKeyMismatch(t *testing.T) {
+	tdb := dbtest.Open(t)
+	db.CheckWritable()
+	t.Setenv("GUARDRAIL_KEY", "")
+	guardrails.ResetForTest()
+	t.Cleanup(guardrails.ResetForTest)
+
+	// The dashboard's key issues the canary, then the proxy starts with a
+	// different data directory and generates a key of its own
+	if err := guardrails.InitGuardrails(); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DATA_DIR", t.TempDir())
+	guardrails.ResetForTest()
+	if err := guardrails.InitGuardrails(); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DATA_DIR", tdb.Dir)
+
+	code, body := readyResponse(t)
+	if code != 200 || body["status"] != "degraded" {
+		t.Fatalf("ready = %d %v", code, body)
+	}
+	key, _ := body["guardrail_key"].(map[string]any)
+	if key["source"] != "generated" || !strings.Contains(fmt.Sprint(key["error"]), "doesn't match") {
+		t.Errorf("guardrail_key = %v", body["guardrail_key"])
+	}
+}
+
+// ─── Traffic classes ────────────────────────────────────────────────────────
+
+func TestTenantRateLimit_BackgroundYieldsToInteractive(t *testing.T) {
+	tdb := dbtest.Open(t)
+	sum := sha256.Sum256([]byte("cgk_batch_secret"))
+	tdb.Exec("INSERT INTO tenants (id, name, api_key_hash, api_key_prefix, rate_limit) VALUES ('t-mix', 'Mixed', ?, 'cgk_batc', 10)",
+		hex.EncodeToString(sum[:]))
+	tdb.Exec("UPDATE tenants SET rate_limit_background = 6 WHERE id = 't-mix'")
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+	ratelimit.Clear("tenant:t-mix")
+	t.Cleanup(func() { ratelimit.Clear("tenant:t-mix") })
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}]}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-mix", "mix", "openai", upstream.URL)
+
+	send := func(priority string) int {
+		req := httptest.NewRequest("POST", "/v1/chat/completions",
+			strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+		req.Header.Set("Authorization", "Bearer cgk_batch_secret")
+		if priority != "" {
+			req.Header.Set("X-CodeGate-Priority", priority)
+		}
+		w := httptest.NewRecorder()
+		Handler().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// A batch job floods the tenant; its own cap of 6 applies first
+	var bgOK, bgLimited int
+	for i := 0; i < 12; i++ {
+		if send("background") == 200 {
+			bgOK++
+		} else {
+			bgLimited++
+		}
+	}
+	if bgOK != 6 || bgLimited != 6 {
+		t.Errorf("background: %d ok / %d limited, want 6/6", bgOK, bgLimited)
+	}
+
+	// Interactive sessions (default class) keep the rest of the bucket
+	for i := 0; i < 4; i++ {
+		if code := send(""); code != 200 {
+			t.Fatalf("interactive request %d: status %d", i+1, code)
+		}
+	}
+	if code := send("interactive"); code != 429 {
+		t.Errorf("interactive over the total limit: status %d, want 429", code)
+	}
+}
+
+func TestBackgroundHeadroom(t *testing.T) {
+	dbtest.Open(t)
+	cases := []struct {
+		limit   int
+		setting string
+		want    int
+	}{
+		{10, "", 2},
+		{7, "", 1}, // rounds down
+		{10, "50", 5},
+		{10, "0", 0},
+		{10, "150", 2}, // out of range: default
+		{0, "", 0},
+		// Small limits leave background traffic at least one request
+		{1, "", 0},
+		{4, "", 0},
+		{4, "50", 2},
+		{1, "100", 0},
+		{4, "100", 3},
+	}
+	for _, c := range cases {
+		tn := &tenant.Tenant{RateLimit: c.limit, Settings: map[string]string{}}
+		if c.setting != "" {
+			tn.Settings["background_headroom_pct"] = c.setting
+		}
+		if got := backgroundHeadroom(tn); got != c.want {
+			t.Errorf("backgroundHeadroom(limit=%d, pct=%q) = %d, want %d", c.limit, c.setting, got, c.want)
+		}
+	}
+}
+
+// ─── Account health ─────────────────────────────────────────────────────────
+
+func TestAccountHealth_RecordedFromUpstreamOutcomes(t *testing.T) {
+	tdb := dbtest.Open(t)
+	health.Reset()
+	t.Cleanup(health.Reset)
+
+	fail := true
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if fail {
+			w.WriteHeader(502)
+			fmt.Fprint(w, `{"error":{"message":"bad gateway"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}]}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-health", "health", "openai", upstream.URL)
+	t.Cleanup(func() { cooldown.Clear("acct-health") })
+
+	send := func() {
+		req := httptest.NewRequest("POST", "/v1/chat/completions",
+			strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+		Handler().ServeHTTP(httptest.NewRecorder(), req)
+	}
+	send()
+	fail = false
+	send()
+	send()
+
+	rate, n := health.SuccessRate("acct-health", health.DefaultWindow)
+	if n != 3 || math.Abs(rate-2.0/3) > 1e-9 {
+		t.Errorf("success rate = %v over %d, want 2/3 over 3", rate, n)
+	}
+}
+
+const undeclaredToolChoice = `{"model":"claude-sonnet-4-20250514","max_tokens":16,` +
+	`"tools":[{"name":"github.create_issue","input_schema":{"type":"object"}}],` +
+	`"tool_choice":{"type":"tool","name":"fetch_url"},` +
+	`"messages":[{"role":"user","content":"file it"}]}`
+
+func TestToolChoice_UndeclaredToolDowngraded(t *testing.T) {
+	tdb := dbtest.Open(t)
+	var sent map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&sent)
+		name := sent["tools"].([]any)[0].(map[string]any)["function"].(map[string]any)["name"]
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","tool_calls":[`+
+			`{"id":"call_1","type":"function","function":{"name":%q,"arguments":"{}"}}]},"finish_reason":"tool_calls"}]}`, name)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-oai", "oai", "openai", upstream.URL)
+
+	w := sendMessages(t, undeclaredToolChoice, nil)
+	if w.Code != 200 {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	if sent["tool_choice"] != "auto" {
+		t.Errorf("upstream tool_choice = %v, want auto", sent["tool_choice"])
+	}
+	if got := w.Header().Get(conversionWarningsHeader); !strings.Contains(got, `"fetch_url"`) {
+		t.Errorf("%s = %q", conversionWarningsHeader, got)
+	}
+	// The sanitized name the provider answered with maps back to the client's
+	if !strings.Contains(w.Body.String(), `"name":"github.create_issue"`) {
+		t.Errorf("response doesn't name the client's tool: %s", w.Body.String())
+	}
+}
+
+func TestToolChoice_StrictRejectsUndeclaredTool(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("strict_tool_choice", "true")
+	hits := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits++ }))
+	defer upstream.Close()
+	tdb.AddAccount("acct-a", "alpha", "anthropic", upstream.URL)
+
+	w := sendMessages(t, undeclaredToolChoice, nil)
+	if w.Code != 400 || hits != 0 {
+		t.Fatalf("status = %d after %d upstream requests, want a 400 before forwarding", w.Code, hits)
+	}
+	if !strings.Contains(w.Body.String(), `\"fetch_url\"`) {
+		t.Errorf("error doesn't name the missing tool: %s", w.Body.String())
+	}
+}
+
+// ─── Request and session cost ───────────────────────────────────────────────
+
+func TestRequestCost_HeadersAndSessionTotals(t *testing.T) {
+	tdb := dbtest.Open(t)
+	resetSessions()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}],
+			"usage":{"prompt_tokens":1000,"completion_tokens":500}}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-cost", "cost", "openai", upstream.URL)
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions",
+			strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+		req.Header.Set("X-Session-Id", "sess-1")
+		w := httptest.NewRecorder()
+		Handler().ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+		}
+		return w
+	}
+	first := send()
+
+	var cost float64
+	waitFor(t, func() bool {
+		return tdb.QueryRow("SELECT cost_usd FROM usage").Scan(&cost) == nil
+	})
+	if got := first.Header().Get("X-CodeGate-Request-Cost-USD"); got != formatCost(cost) {
+		t.Errorf("request cost header = %q, recorded cost_usd = %v", got, cost)
+	}
+	if got := first.Header().Get("X-CodeGate-Request-Tokens"); got != "1500" {
+		t.Errorf("request tokens header = %q, want 1500", got)
+	}
+	if got := first.Header().Get("X-CodeGate-Session-Cost-USD"); got != formatCost(cost) {
+		t.Errorf("session cost after one request = %q, want %q", got, formatCost(cost))
+	}
+
+	second := send()
+	if got := second.Header().Get("X-CodeGate-Session-Cost-USD"); got != formatCost(2*cost) {
+		t.Errorf("session cost = %q, want %q", got, formatCost(2*cost))
+	}
+	if got := second.Header().Get("X-CodeGate-Session-Tokens"); got != "3000" {
+		t.Errorf("session tokens = %q, want 3000", got)
+	}
+}
+
+func TestRequestCost_StreamTrailersAndComment(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("stream_usage_comment", "true")
+	resetSessions()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"model\":\"claude-sonnet-4-20250514\",\"usage\":{\"input_tokens\":10}}}\n\n")
+		fmt.Fprint(w, "event: message_delta\ndata: {\"type\":\"message_delta\",\"usage\":{\"output_tokens\":5}}\n\n")
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-stream-cost", "stream", "anthropic", upstream.URL)
+
+	req := httptest.NewRequest("POST", "/v1/messages",
+		strings.NewReader(`{"model":"claude-sonnet-4-6","stream":true,"max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("X-Session-Id", "sess-stream")
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+
+	want := formatCost(models.EstimateCost("claude-sonnet-4-20250514", 10, 5))
+	res := w.Result()
+	if got := res.Trailer.Get("X-CodeGate-Request-Cost-USD"); got != want {
+		t.Errorf("request cost trailer = %q, want %q", got, want)
+	}
+	if got := res.Trailer.Get("X-CodeGate-Session-Tokens"); got != "15" {
+		t.Errorf("session tokens trailer = %q, want 15", got)
+	}
+	body := w.Body.String()
+	i := strings.LastIndex(body, ": codegate-usage ")
+	if i < 0 || !strings.HasSuffix(body, "\n\n") {
+		t.Fatalf("stream does not end with the usage comment: %q", body)
+	}
+	var usage requestUsage
+	if err := json.Unmarshal([]byte(strings.TrimSpace(body[i+len(": codegate-usage "):])), &usage); err != nil {
+		t.Fatalf("usage comment: %v", err)
+	}
+	if formatCost(usage.CostUSD) != want || usage.Tokens != 15 || usage.SessionTokens == nil || *usage.SessionTokens != 15 {
+		t.Errorf("usage comment = %+v", usage)
+	}
+}
+
+// Stream token counts arrive with the final events, after the body has
+// been mostly forwarded. Usage and the request log must still get them.
+func TestStreamUsage_RecordedAfterStream(t *testing.T) {
+	for _, tc := range []struct {
+		provider string
+		events   []string
+	}{
+		{"anthropic", []string{
+			`event: message_start` + "\n" + `data: {"type":"message_start","message":{"id":"msg_1","model":"claude-sonnet-4-20250514","usage":{"input_tokens":120,"cache_read_input_tokens":64,"cache_creation_input_tokens":8}}}`,
+			`event: content_block_delta` + "\n" + `data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"hi"}}`,
+			`event: message_delta` + "\n" + `data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":30}}`,
+			`event: message_stop` + "\n" + `data: {"type":"message_stop"}`,
+		}},
+		// stream_options.include_usage puts usage in a chunk after the finish
+		{"openai", []string{
+			`data: {"id":"c1","model":"gpt-4.1","choices":[{"index":0,"delta":{"role":"assistant","content":"hi"}}]}`,
+			`data: {"id":"c1","model":"gpt-4.1","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+			`data: {"id":"c1","model":"gpt-4.1","choices":[],"usage":{"prompt_tokens":120,"completion_tokens":30,"prompt_tokens_details":{"cached_tokens":64}}}`,
+			`data: [DONE]`,
+		}},
+	} {
+		t.Run(tc.provider, func(t *testing.T) {
+			tdb := dbtest.Open(t)
+			tdb.SetSetting("request_logging", "true")
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				for _, event := range tc.events {
+					fmt.Fprint(w, event+"\n\n")
+					w.(http.Flusher).Flush()
+					time.Sleep(5 * time.Millisecond)
+				}
+			}))
+			defer upstream.Close()
+			tdb.AddAccount("acct-stream-usage-"+tc.provider, "stream", tc.provider, upstream.URL)
+
+			model := "claude-sonnet-4-20250514"
+			if tc.provider == "openai" {
+				model = "gpt-4.1"
+			}
+			w := httptest.NewRecorder()
+			Handler().ServeHTTP(w, httptest.NewRequest("POST", "/v1/messages", strings.NewReader(
+				`{"model":"`+model+`","stream":true,"max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`)))
+			if w.Code != 200 {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			var input, output, cacheRead int
+			var cost float64
+			waitFor(t, func() bool {
+				return tdb.QueryRow("SELECT input_tokens, output_tokens, cache_read_tokens, cost_usd FROM usage").Scan(&input, &output, &cacheRead, &cost) == nil
+			})
+			if input != 120 || output != 30 || cacheRead != 64 || cost <= 0 {
+				t.Errorf("usage = %d in, %d out, %d cache read, $%v", input, output, cacheRead, cost)
+			}
+			var logIn, logOut int
+			waitFor(t, func() bool {
+				return tdb.QueryRow("SELECT input_tokens, output_tokens FROM request_logs").Scan(&logIn, &logOut) == nil
+			})
+			if logIn != 120 || logOut != 30 {
+				t.Errorf("request log tokens = %d in, %d out", logIn, logOut)
+			}
+		})
+	}
+}
+
+func TestSessionUsage_ScopedByTenant(t *testing.T) {
+	resetSessions()
+	addSessionUsage("tenant-a", "s", 1, 10)
+	if got := addSessionUsage("tenant-b", "s", 1, 10); got.tokens != 10 {
+		t.Errorf("tenant-b tokens = %d, want 10", got.tokens)
+	}
+	if got := addSessionUsage("tenant-a", "s", 1, 10); got.tokens != 20 {
+		t.Errorf("tenant-a tokens = %d, want 20", got.tokens)
+	}
+}
+
+func TestSessionUsage_EvictsLeastRecentlyUsed(t *testing.T) {
+	resetSessions()
+	t.Cleanup(resetSessions)
+	for i := range maxSessions {
+		addSessionUsage("tenant", strconv.Itoa(i), 1, 10)
+	}
+	addSessionUsage("tenant", "0", 1, 10) // now the most recently used
+	addSessionUsage("tenant", "new", 1, 10)
+
+	sessions.Lock()
+	_, kept := sessions.m["tenant\x000"]
+	_, evicted := sessions.m["tenant\x001"]
+	n := len(sessions.m)
+	sessions.Unlock()
+	if n != maxSessions || !kept || evicted {
+		t.Errorf("%d sessions, recently used kept = %v, least recently used kept = %v", n, kept, evicted)
+	}
+	if got := addSessionUsage("tenant", "0", 1, 10); got.tokens != 30 {
+		t.Errorf("tokens = %d, want 30", got.tokens)
+	}
+}
+
+func TestPreserveSystemBlocks(t *testing.T) {
+	tdb := dbtest.Open(t)
+	var sent map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&sent)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}]}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-sys", "oai", "openai", upstream.URL)
+
+	body := `{"model":"claude-sonnet-4-20250514","max_tokens":16,"system":[` +
+		`{"type":"text","text":"static","cache_control":{"type":"ephemeral"}},{"type":"text","text":"dynamic"}],` +
+		`"messages":[{"role":"user","content":"hi"}]}`
+	systemMessages := func() int {
+		n := 0
+		for _, m := range sent["messages"].([]any) {
+			if m.(map[string]any)["role"] == "system" {
+				n++
+			}
+		}
+		return n
+	}
+
+	w := sendMessages(t, body, nil)
+	if n := systemMessages(); n != 1 {
+		t.Errorf("default: %d system messages, want 1", n)
+	}
+	if got := w.Header().Get(conversionWarningsHeader); !strings.Contains(got, "merged 2 system blocks") {
+		t.Errorf("%s = %q", conversionWarningsHeader, got)
+	}
+
+	tdb.SetSetting("preserve_system_blocks", "true")
+	w = sendMessages(t, body, nil)
+	if n := systemMessages(); n != 2 {
+		t.Errorf("preserve_system_blocks: %d system messages, want 2", n)
+	}
+	if got := w.Header().Get(conversionWarningsHeader); got != "dropped cache_control from system blocks" {
+		t.Errorf("%s = %q", conversionWarningsHeader, got)
+	}
+}
+
+func TestOpenAIClient_MultipleChoicesToAnthropic(t *testing.T) {
+	tdb := dbtest.Open(t)
+	called := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-n", "anthropic-n", "anthropic", upstream.URL)
+
+	send := func(n int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(
+			fmt.Sprintf(`{"model":"claude-sonnet-4-20250514","n":%d,"messages":[{"role":"user","content":"hi"}]}`, n)))
+		w := httptest.NewRecorder()
+		Handler().ServeHTTP(w, req)
+		return w
+	}
+
+	w := send(2)
+	if w.Code != 400 || called != 0 {
+		t.Fatalf("n=2: status = %d, upstream called %d times", w.Code, called)
+	}
+	if !strings.Contains(w.Body.String(), "n=2 is not supported") {
+		t.Errorf("n=2: body = %s", w.Body.String())
+	}
+
+	if w := send(1); w.Code != 200 || called != 1 {
+		t.Errorf("n=1: status = %d, upstream called %d times", w.Code, called)
+	}
+}
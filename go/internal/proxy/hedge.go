@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/provider"
+	"codegate-proxy/internal/routing"
+	"codegate-proxy/internal/tenant"
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hedgeHeader asks for a hedged request: "true" sends it to a second
+// candidate too if the first is slow to respond, and keeps whichever
+// answers first. Callers must be listed in the hedge_tenants setting.
+var hedgeHeader = allowHeader("X-CodeGate-Hedge")
+
+// defaultHedgeDelay is how long the first candidate has to respond before
+// a hedged request also goes to the second.
+const defaultHedgeDelay = 300 * time.Millisecond
+
+// errHedgeCancelled is the result of a launch cancelled because the other
+// one responded first.
+var errHedgeCancelled = errors.New("hedge_cancelled")
+
+// hedgeRequested reports whether a request is to be hedged: asked for in
+// hedgeHeader or by the hedge_requests setting, by a caller the global
+// hedge_tenants setting lists. hedge_tenants is a comma-separated list of
+// tenant IDs, or "*" for every caller, including those without a tenant.
+func hedgeRequested(r *http.Request, tenantCtx *tenant.Tenant, getSetting func(string) string) bool {
+	if r.Header.Get(hedgeHeader) != "true" && getSetting("hedge_requests") != "true" {
+		return false
+	}
+	for _, id := range strings.Split(db.GetSetting("hedge_tenants"), ",") {
+		id = strings.TrimSpace(id)
+		if id == "*" || tenantCtx != nil && id == tenantCtx.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// hedgeDelay returns the hedge_delay_ms setting, or defaultHedgeDelay.
+func hedgeDelay(getSetting func(string) string) time.Duration {
+	if ms, err := strconv.Atoi(getSetting("hedge_delay_ms")); err == nil && ms >= 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return defaultHedgeDelay
+}
+
+// forcesToolUse reports whether an Anthropic body's tool_choice makes the
+// model call a tool. Such requests aren't hedged: both launches could set
+// off the same side effect.
+func forcesToolUse(body map[string]any) bool {
+	tc, _ := body["tool_choice"].(map[string]any)
+	t, _ := tc["type"].(string)
+	return t == "any" || t == "tool"
+}
+
+// hedgePartner returns the index of the first candidate after i that can
+// be sent the body prepared for candidate i, as compatible decides, or -1.
+func hedgePartner(candidates []routing.Candidate, i int, originalModel string, compatible func(acct db.Account, targetModel string) bool) int {
+	for j := i + 1; j < len(candidates); j++ {
+		targetModel := candidates[j].TargetModel
+		if targetModel == "" {
+			targetModel = originalModel
+		}
+		if compatible(candidates[j].Account, targetModel) {
+			return j
+		}
+	}
+	return -1
+}
+
+// hedgeResult is what one launch of a hedged request got: index 0 is the
+// first candidate, 1 its partner.
+type hedgeResult struct {
+	index int
+	resp  *provider.Response
+	err   error
+}
+
+// ok reports whether the launch got a response worth returning. A failure
+// lets the other launch win.
+func (h hedgeResult) ok() bool {
+	return h.err == nil && h.resp.Status < 500 && h.resp.Status != 429
+}
+
+func (h hedgeResult) close() {
+	if h.resp != nil {
+		h.resp.Body.Close()
+	}
+}
+
+// hedgeRace is the outcome of raceHedged.
+type hedgeRace struct {
+	won hedgeResult
+	// lost is the other launch when the partner was sent: cancelled with
+	// errHedgeCancelled if won is ok, or a failure if neither launch
+	// succeeded. Its response body is closed.
+	lost *hedgeResult
+	// cancel ends won's request once the handler is done with it.
+	cancel context.CancelFunc
+}
+
+// raceHedged sends a request with send(ctx, 0), and if it hasn't responded
+// within delay and sendPartner agrees, with send(ctx, 1) too. The first ok
+// response wins and the other launch is cancelled. If both fail, the first
+// candidate's result is returned, so failover goes on from there.
+func raceHedged(parent context.Context, delay time.Duration, send func(ctx context.Context, n int) (*provider.Response, error), sendPartner func() bool) hedgeRace {
+	results := make(chan hedgeResult, 2)
+	var cancels [2]context.CancelFunc
+	launch := func(n int) {
+		ctx, cancel := context.WithCancel(parent)
+		cancels[n] = cancel
+		go func() {
+			resp, err := send(ctx, n)
+			results <- hedgeResult{index: n, resp: resp, err: err}
+		}()
+	}
+
+	launch(0)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case res := <-results:
+		return hedgeRace{won: res, cancel: cancels[0]}
+	case <-timer.C:
+	}
+	if !sendPartner() {
+		return hedgeRace{won: <-results, cancel: cancels[0]}
+	}
+	launch(1)
+
+	won := <-results
+	if won.ok() {
+		lost := 1 - won.index
+		cancels[lost]()
+		go func() { (<-results).close() }()
+		return hedgeRace{won: won, lost: &hedgeResult{index: lost, err: errHedgeCancelled}, cancel: cancels[won.index]}
+	}
+	other := <-results
+	if other.ok() || other.index == 0 {
+		won, other = other, won
+	}
+	other.close()
+	cancels[other.index]()
+	return hedgeRace{won: won, lost: &other, cancel: cancels[won.index]}
+}
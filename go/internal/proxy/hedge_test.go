@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/cooldown"
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/health"
+	"codegate-proxy/internal/provider"
+	"codegate-proxy/internal/subscription"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// hedgePair configures a slow primary account and a fast backup, and
+// returns a channel closed when the primary's request is cancelled and a
+// counter of requests the backup served. The primary answers after wait.
+func hedgePair(t *testing.T, tdb *dbtest.DB, wait time.Duration) (<-chan struct{}, *atomic.Int32) {
+	t.Helper()
+	cancelled := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server notices the client going away once the body is read
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+			return
+		case <-time.After(wait):
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_slow","type":"message","role":"assistant","content":[{"type":"text","text":"slow"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	t.Cleanup(slow.Close)
+	var fastHits atomic.Int32
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fastHits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_fast","type":"message","role":"assistant","content":[{"type":"text","text":"fast"}],"usage":{"input_tokens":7,"output_tokens":3}}`)
+	}))
+	t.Cleanup(fast.Close)
+
+	tdb.AddAccount("acct-slow", "slow", "anthropic", slow.URL)
+	tdb.AddAccount("acct-fast", "fast", "anthropic", fast.URL)
+	tdb.AddActiveConfig("cfg", "default")
+	tdb.AddTier("cfg", "sonnet", "acct-slow", 10, "")
+	tdb.AddTier("cfg", "sonnet", "acct-fast", 5, "")
+	tdb.SetSetting("request_logging", "true")
+	tdb.SetSetting("hedge_delay_ms", "20")
+	reset := func() {
+		cooldown.Clear("acct-slow")
+		cooldown.Clear("acct-fast")
+		health.Reset()
+	}
+	reset()
+	t.Cleanup(reset)
+	return cancelled, &fastHits
+}
+
+var hedgeRequest = http.Header{"X-Codegate-Hedge": {"true"}}
+
+func TestHedgedRequest_FastPartnerWins(t *testing.T) {
+	tdb := dbtest.Open(t)
+	cancelled, _ := hedgePair(t, tdb, 5*time.Second)
+	tdb.SetSetting("hedge_tenants", "*")
+
+	start := time.Now()
+	w := sendMessages(t, plainMessage, hedgeRequest)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"text":"fast"`) {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("hedged request took %v", elapsed)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Error("the slow provider's request wasn't cancelled")
+	}
+
+	// Usage goes to the winner only; the loser gets a hedge_cancelled log
+	var account string
+	var input int
+	waitFor(t, func() bool {
+		return tdb.QueryRow("SELECT account_id, input_tokens FROM usage").Scan(&account, &input) == nil
+	})
+	if account != "acct-fast" || input != 7 {
+		t.Errorf("usage recorded for %s (%d input tokens), want acct-fast (7)", account, input)
+	}
+	var errMsg string
+	waitFor(t, func() bool {
+		return tdb.QueryRow("SELECT error_message FROM request_logs WHERE account_id = 'acct-slow'").Scan(&errMsg) == nil
+	})
+	if !strings.HasPrefix(errMsg, "hedge_cancelled") {
+		t.Errorf("loser's request log error = %q", errMsg)
+	}
+	var n int
+	tdb.QueryRow("SELECT COUNT(*) FROM usage").Scan(&n)
+	if n != 1 {
+		t.Errorf("%d usage rows, want 1", n)
+	}
+}
+
+func TestHedgedRequest_NotHedged(t *testing.T) {
+	forcedTool := `{"model":"claude-sonnet-4-20250514","max_tokens":16,"tools":[{"name":"deploy","input_schema":{"type":"object"}}],"tool_choice":{"type":"tool","name":"deploy"},"messages":[{"role":"user","content":"hi"}]}`
+	cases := []struct {
+		name, allowlist, body string
+		header                http.Header
+		setup                 func(*testing.T, *dbtest.DB)
+	}{
+		{"not on the allowlist", "", plainMessage, hedgeRequest, nil},
+		{"other tenants allowed", "t-other", plainMessage, hedgeRequest, nil},
+		{"not asked for", "*", plainMessage, nil, nil},
+		{"forced tool call", "*", forcedTool, hedgeRequest, nil},
+		{"partner has another prompt prefix", "*", plainMessage, hedgeRequest, func(t *testing.T, tdb *dbtest.DB) {
+			tdb.Exec("UPDATE accounts SET system_prompt_prefix = 'Follow the fast policy.' WHERE id = 'acct-fast'")
+		}},
+		{"partner's subscription window used up", "*", plainMessage, hedgeRequest, func(t *testing.T, tdb *dbtest.DB) {
+			subscription.Observe("acct-fast", map[string]string{
+				"anthropic-ratelimit-unified-status": "rejected",
+				"anthropic-ratelimit-unified-reset":  unixIn(time.Hour),
+			})
+			t.Cleanup(func() { subscription.Forget("acct-fast") })
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tdb := dbtest.Open(t)
+			_, fastHits := hedgePair(t, tdb, 100*time.Millisecond)
+			tdb.SetSetting("hedge_tenants", tc.allowlist)
+			if tc.setup != nil {
+				tc.setup(t, tdb)
+			}
+
+			w := sendMessages(t, tc.body, tc.header)
+			if w.Code != 200 || !strings.Contains(w.Body.String(), `"text":"slow"`) {
+				t.Errorf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			if n := fastHits.Load(); n != 0 {
+				t.Errorf("partner was sent %d requests", n)
+			}
+		})
+	}
+}
+
+func TestRaceHedged(t *testing.T) {
+	response := func(status int) *provider.Response {
+		return &provider.Response{Status: status, Body: io.NopCloser(strings.NewReader(""))}
+	}
+	// send answers launch n after delays[n] with statuses[n], or fails when
+	// the status is 0
+	sender := func(delays [2]time.Duration, statuses [2]int) func(context.Context, int) (*provider.Response, error) {
+		return func(ctx context.Context, n int) (*provider.Response, error) {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delays[n]):
+			}
+			if statuses[n] == 0 {
+				return nil, errors.New("connection refused")
+			}
+			return response(statuses[n]), nil
+		}
+	}
+	partnerAllowed := func() bool { return true }
+
+	cases := []struct {
+		name     string
+		delays   [2]time.Duration
+		statuses [2]int
+		partner  func() bool
+		won      int
+		lost     bool
+		lostErr  error
+	}{
+		{"first responds in time", [2]time.Duration{0, 0}, [2]int{200, 200}, partnerAllowed, 0, false, nil},
+		{"partner faster", [2]time.Duration{time.Second, 0}, [2]int{200, 200}, partnerAllowed, 1, true, errHedgeCancelled},
+		{"first answers once hedged", [2]time.Duration{30 * time.Millisecond, time.Second}, [2]int{200, 200}, partnerAllowed, 0, true, errHedgeCancelled},
+		{"partner fails fast", [2]time.Duration{50 * time.Millisecond, 0}, [2]int{200, 503}, partnerAllowed, 0, true, nil},
+		{"both fail", [2]time.Duration{50 * time.Millisecond, 0}, [2]int{502, 0}, partnerAllowed, 0, true, nil},
+		{"partner not sent", [2]time.Duration{50 * time.Millisecond, 0}, [2]int{200, 200}, func() bool { return false }, 0, false, nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			race := raceHedged(context.Background(), 10*time.Millisecond, sender(tc.delays, tc.statuses), tc.partner)
+			defer race.cancel()
+			if race.won.index != tc.won {
+				t.Errorf("launch %d won, want %d", race.won.index, tc.won)
+			}
+			if (race.lost != nil) != tc.lost {
+				t.Fatalf("lost = %+v, want one: %v", race.lost, tc.lost)
+			}
+			if race.lost != nil && tc.lostErr != nil && race.lost.err != tc.lostErr {
+				t.Errorf("lost err = %v, want %v", race.lost.err, tc.lostErr)
+			}
+		})
+	}
+}
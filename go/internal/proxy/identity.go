@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/db"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// defaultClientHeaders are passed through to providers when the
+// forward_client_headers setting is unset. Providers use them to attribute
+// abuse and quality signals to the calling application.
+const defaultClientHeaders = "user-agent,x-app"
+
+// blockedClientHeaders can't be allowlisted: they carry credentials or are
+// managed by the proxy itself.
+var blockedClientHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"x-api-key":           true,
+	"cookie":              true,
+	"host":                true,
+	"content-length":      true,
+	"content-type":        true,
+	"transfer-encoding":   true,
+	"connection":          true,
+}
+
+// oauthClientHeaders are sent to OAuth accounts whatever
+// forward_client_headers says: subscription endpoints reject requests that
+// don't identify the client.
+var oauthClientHeaders = []string{"user-agent", "x-app"}
+
+// forwardClientHeaders picks the allowlisted headers from the lowercased
+// inbound headers. allowlist is the comma-separated forward_client_headers
+// setting; empty means the defaults and "none" forwards nothing.
+func forwardClientHeaders(reqHeaders map[string]string, allowlist string) map[string]string {
+	allowlist = strings.TrimSpace(allowlist)
+	if allowlist == "" {
+		allowlist = defaultClientHeaders
+	}
+	if strings.EqualFold(allowlist, "none") {
+		return nil
+	}
+
+	out := make(map[string]string)
+	for _, name := range strings.Split(allowlist, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || blockedClientHeaders[name] {
+			continue
+		}
+		if v := reqHeaders[name]; v != "" {
+			out[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+	return out
+}
+
+// withOAuthClientHeaders adds the client's oauthClientHeaders to the
+// forwarded headers, leaving clientHeaders itself unchanged.
+func withOAuthClientHeaders(clientHeaders, reqHeaders map[string]string) map[string]string {
+	out := make(map[string]string, len(clientHeaders)+len(oauthClientHeaders))
+	for k, v := range clientHeaders {
+		out[k] = v
+	}
+	for _, name := range oauthClientHeaders {
+		if v := reqHeaders[name]; v != "" {
+			out[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+	return out
+}
+
+// hashEndUserIDs replaces the end-user identifier in a request body (OpenAI
+// "user" or Anthropic metadata.user_id) with its hashUserID, so providers
+// can still tell users apart without seeing the raw ID. Reports whether the
+// body changed.
+func hashEndUserIDs(body map[string]any) (bool, error) {
+	changed := false
+	if user, ok := body["user"].(string); ok && user != "" {
+		hashed, err := hashUserID(user)
+		if err != nil {
+			return false, err
+		}
+		body["user"] = hashed
+		changed = true
+	}
+	if md, ok := body["metadata"].(map[string]any); ok {
+		if uid, ok := md["user_id"].(string); ok && uid != "" {
+			hashed, err := hashUserID(uid)
+			if err != nil {
+				return false, err
+			}
+			md["user_id"] = hashed
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// hashUserID is the HMAC-SHA256 of an end-user ID under the install's
+// secret (db.EndUserIDKey), so IDs can't be recovered by hashing guesses.
+func hashUserID(id string) (string, error) {
+	key, err := db.EndUserIDKey()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// hashSpooledEndUserIDs is hashEndUserIDs for a spooled body. A metadata
+// object too large to have been captured is dropped rather than forwarded
+// with its user_id unhashed.
+func hashSpooledEndUserIDs(logf func(string, ...any), spool *spooledBody) error {
+	if u, ok := spool.stringField("user"); ok && u != "" {
+		hashed, err := hashUserID(u)
+		if err != nil {
+			return err
+		}
+		spool.setField("user", hashed)
+	}
+	f, ok := spool.fields["metadata"]
+	if !ok {
+		return nil
+	}
+	var md map[string]any
+	if err := json.Unmarshal(f.raw, &md); err != nil {
+		logf("[proxy] Dropping metadata from spooled request body: it can't be read to hash user_id")
+		spool.removeField("metadata")
+		return nil
+	}
+	changed, err := hashEndUserIDs(map[string]any{"metadata": md})
+	if changed {
+		spool.setField("metadata", md)
+	}
+	return err
+}
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestForwardClientHeaders(t *testing.T) {
+	in := map[string]string{
+		"user-agent":    "my-app/1.0",
+		"x-app":         "cli",
+		"x-request-tag": "nightly",
+		"authorization": "Bearer secret",
+		"x-api-key":     "secret",
+	}
+	tests := []struct {
+		allowlist string
+		want      map[string]string
+	}{
+		{"", map[string]string{"User-Agent": "my-app/1.0", "X-App": "cli"}},
+		{"X-Request-Tag, user-agent", map[string]string{"X-Request-Tag": "nightly", "User-Agent": "my-app/1.0"}},
+		{"authorization,x-api-key,x-app", map[string]string{"X-App": "cli"}},
+		{"x-missing", map[string]string{}},
+		{"none", nil},
+	}
+	for _, tt := range tests {
+		if got := forwardClientHeaders(in, tt.allowlist); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("forwardClientHeaders(%q) = %v, want %v", tt.allowlist, got, tt.want)
+		}
+	}
+}
+
+func TestHashEndUserIDs(t *testing.T) {
+	body := map[string]any{
+		"user":     "alice",
+		"metadata": map[string]any{"user_id": "bob"},
+	}
+	if changed, err := hashEndUserIDs(body); !changed || err != nil {
+		t.Fatalf("hashEndUserIDs = %v, %v; want a change", changed, err)
+	}
+	if body["user"] != mustHashUserID(t, "alice") || len(body["user"].(string)) != 64 {
+		t.Errorf("user = %v", body["user"])
+	}
+	if md := body["metadata"].(map[string]any); md["user_id"] != mustHashUserID(t, "bob") {
+		t.Errorf("metadata.user_id = %v", md["user_id"])
+	}
+
+	if changed, _ := hashEndUserIDs(map[string]any{"model": "m"}); changed {
+		t.Error("hashEndUserIDs should not report a change without user IDs")
+	}
+}
+
+// captureUpstream starts an OpenAI-compatible upstream that records the last
+// request body and headers.
+func captureUpstream(t *testing.T, body *map[string]any, headers *http.Header) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*headers = r.Header.Clone()
+		json.NewDecoder(r.Body).Decode(body)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}]}`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestEndUserID_ForwardedToOpenAI(t *testing.T) {
+	for _, hash := range []bool{false, true} {
+		t.Run(fmt.Sprintf("hash=%v", hash), func(t *testing.T) {
+			tdb := dbtest.Open(t)
+			if hash {
+				tdb.SetSetting("hash_end_user_ids", "true")
+			}
+			var got map[string]any
+			var headers http.Header
+			tdb.AddAccount("acct-user", "user", "openai", captureUpstream(t, &got, &headers))
+
+			req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(
+				`{"model":"gpt-4o","max_tokens":10,"metadata":{"user_id":"user-42"},"messages":[{"role":"user","content":"hi"}]}`))
+			req.Header.Set("User-Agent", "my-app/1.0")
+			w := httptest.NewRecorder()
+			Handler().ServeHTTP(w, req)
+			if w.Code != 200 {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+
+			want := "user-42"
+			if hash {
+				want = mustHashUserID(t, "user-42")
+			}
+			if got["user"] != want {
+				t.Errorf("upstream user = %v, want %v", got["user"], want)
+			}
+			if ua := headers.Get("User-Agent"); ua != "my-app/1.0" {
+				t.Errorf("upstream User-Agent = %q, want the client's", ua)
+			}
+		})
+	}
+}
+
+func TestEndUserID_HashedOnPassthrough(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("hash_end_user_ids", "true")
+	tdb.SetSetting("forward_client_headers", "none")
+	var got map[string]any
+	var headers http.Header
+	tdb.AddAccount("acct-pass", "pass", "openai", captureUpstream(t, &got, &headers))
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(
+		`{"model":"gpt-4o","user":"alice","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("User-Agent", "my-app/1.0")
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if got["user"] != mustHashUserID(t, "alice") {
+		t.Errorf("upstream user = %v, want hashed", got["user"])
+	}
+	if ua := headers.Get("User-Agent"); ua == "my-app/1.0" {
+		t.Error("User-Agent forwarded with forward_client_headers=none")
+	}
+}
+
+func TestHashUserID_KeyedPerInstall(t *testing.T) {
+	tdb := dbtest.Open(t)
+	plain := sha256.Sum256([]byte("alice"))
+	first := mustHashUserID(t, "alice")
+	if first == hex.EncodeToString(plain[:]) {
+		t.Fatal("hashUserID is an unkeyed SHA-256")
+	}
+	if mustHashUserID(t, "alice") != first {
+		t.Error("hashUserID isn't stable")
+	}
+	info, err := os.Stat(filepath.Join(tdb.Dir, ".user-id-key"))
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("key file: %v, %v", info, err)
+	}
+
+	// Another install hashes the same ID differently
+	dbtest.Open(t)
+	if mustHashUserID(t, "alice") == first {
+		t.Error("two installs share a hash")
+	}
+}
+
+func TestEndUserID_HashedInSpooledBody(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("hash_end_user_ids", "true")
+	tdb.SetSetting("body_spool_threshold_mb", "0.0001")
+	var got map[string]any
+	var headers http.Header
+	tdb.AddAccount("acct-spool-user", "spool-user", "openai", captureUpstream(t, &got, &headers))
+
+	// Anthropic client, OpenAI target: the spool is converted after hashing
+	body := `{"model":"gpt-4o","max_tokens":10,"metadata":{"user_id":"user-42"},"messages":[{"role":"user","content":"hi` +
+		strings.Repeat(" ", 200) + `"}]}`
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if got["user"] != mustHashUserID(t, "user-42") {
+		t.Errorf("upstream user = %v, want hashed", got["user"])
+	}
+}
+
+// mustHashUserID is hashUserID for tests, which have a key file to hash with.
+func mustHashUserID(t *testing.T, id string) string {
+	t.Helper()
+	hashed, err := hashUserID(id)
+	if err != nil {
+		t.Fatalf("hashUserID: %v", err)
+	}
+	return hashed
+}
+
+func TestClientHeaders_AlwaysSentToOAuth(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("forward_client_headers", "none")
+	var headers http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	t.Cleanup(upstream.Close)
+	tdb.AddAccount("acct-oauth", "max", "anthropic", upstream.URL)
+	tdb.Exec("UPDATE accounts SET auth_type = 'oauth' WHERE id = 'acct-oauth'")
+
+	w := sendMessages(t, plainMessage, http.Header{"User-Agent": {"claude-cli/1.0"}, "X-App": {"cli"}, "X-Other": {"x"}})
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if headers.Get("User-Agent") != "claude-cli/1.0" || headers.Get("X-App") != "cli" {
+		t.Errorf("OAuth upstream got User-Agent %q, X-App %q; want the client's", headers.Get("User-Agent"), headers.Get("X-App"))
+	}
+	if headers.Get("X-Other") != "" {
+		t.Error("a header outside the allowlist was forwarded")
+	}
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultImageFetchMaxBytes caps images fetched or passed inline when
+// convert_fetch_image_urls is on and convert_image_max_mb isn't set.
+const defaultImageFetchMaxBytes = 5 << 20
+
+// imageFetchTimeout bounds the download of one image URL.
+const imageFetchTimeout = 10 * time.Second
+
+// fetchedImageTypes are the media types Anthropic accepts for images.
+var fetchedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// imageFetchClient downloads image URLs. Its dialer refuses loopback,
+// private and link-local addresses, so clients can't use the proxy to
+// reach internal services.
+var imageFetchClient = &http.Client{
+	Timeout: imageFetchTimeout,
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout: imageFetchTimeout,
+			Control: refusePrivateAddress,
+		}).DialContext,
+	},
+}
+
+func refusePrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("refusing to fetch from %s", host)
+	}
+	return nil
+}
+
+// imageFetchLimit returns the image size cap for convert_fetch_image_urls:
+// convert_image_max_mb, or 5 MB.
+func imageFetchLimit(getSetting func(string) string) int {
+	if mb, err := strconv.ParseFloat(getSetting("convert_image_max_mb"), 64); err == nil && mb > 0 {
+		return int(mb * (1 << 20))
+	}
+	return defaultImageFetchMaxBytes
+}
+
+// fetchImageURLs downloads the URL images of the Anthropic body and inlines
+// them as base64, for Anthropic-compatible backends that only take inline
+// images. Inline images are held to the same maxBytes cap. Images that are
+// too large or couldn't be fetched are listed in the error; the returned
+// count is the number of images inlined.
+func (b *requestBody) fetchImageURLs(ctx context.Context, maxBytes int) (int, error) {
+	var problems []string
+	fetched := 0
+	eachAnthropicImage(b.anthropic, func(path string, src map[string]any) {
+		switch src["type"] {
+		case "base64":
+			data, _ := src["data"].(string)
+			if size := base64.StdEncoding.DecodedLen(len(data)); size > maxBytes {
+				problems = append(problems, fmt.Sprintf("%s is %s (limit %s)", path, humanBytes(size), humanBytes(maxBytes)))
+			}
+		case "url":
+			url, _ := src["url"].(string)
+			mediaType, data, err := fetchImage(ctx, url, maxBytes)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s (%s): %v", path, url, err))
+				return
+			}
+			delete(src, "url")
+			src["type"], src["media_type"], src["data"] = "base64", mediaType, data
+			fetched++
+		}
+	})
+
+	if fetched > 0 {
+		b.anthropicModified = true
+	}
+	if len(problems) > 0 {
+		return fetched, fmt.Errorf("image not accepted: %s", strings.Join(problems, "; "))
+	}
+	return fetched, nil
+}
+
+// fetchImage downloads an http(s) image of at most maxBytes and returns its
+// detected media type and base64 data.
+func fetchImage(ctx context.Context, url string, maxBytes int) (string, string, error) {
+	if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+		return "", "", errors.New("not an http(s) URL")
+	}
+	ctx, cancel := context.WithTimeout(ctx, imageFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := imageFetchClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", "", fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	if resp.ContentLength > int64(maxBytes) {
+		return "", "", fmt.Errorf("%s (limit %s)", humanBytes(int(resp.ContentLength)), humanBytes(maxBytes))
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxBytes)+1))
+	if err != nil {
+		return "", "", err
+	}
+	if len(data) > maxBytes {
+		return "", "", fmt.Errorf("too large (limit %s)", humanBytes(maxBytes))
+	}
+	mediaType := http.DetectContentType(data)
+	if !fetchedImageTypes[mediaType] {
+		return "", "", fmt.Errorf("not a supported image (%s)", mediaType)
+	}
+	return mediaType, base64.StdEncoding.EncodeToString(data), nil
+}
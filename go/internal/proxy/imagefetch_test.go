@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// imageServer serves a base64 image at /img.png, through a client that
+// skips the private-address check.
+func imageServer(t *testing.T, data string) string {
+	raw, _ := base64.StdEncoding.DecodeString(data)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(raw)
+	}))
+	t.Cleanup(srv.Close)
+	prev := imageFetchClient
+	imageFetchClient = srv.Client()
+	t.Cleanup(func() { imageFetchClient = prev })
+	return srv.URL + "/img.png"
+}
+
+func openAIImageURLRequest(url string) string {
+	return `{"model":"claude-sonnet-4-6","max_tokens":16,"messages":[{"role":"user","content":[
+		{"type":"text","text":"what is on screen?"},
+		{"type":"image_url","image_url":{"url":"` + url + `"}}]}]}`
+}
+
+func TestFetchImageURLs_Inlines(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("convert_fetch_image_urls", "true")
+	data := testPNG(16, 16, false)
+	url := imageServer(t, data)
+
+	var got map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		json.Unmarshal(b, &got)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"msg_1","type":"message","role":"assistant","content":[],"usage":{"input_tokens":1,"output_tokens":1}}`))
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-img", "img", "anthropic", upstream.URL)
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(openAIImageURLRequest(url)))
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	src := lastContent(got)[1].(map[string]any)["source"].(map[string]any)
+	if src["type"] != "base64" || src["media_type"] != "image/png" || src["data"] != data || src["url"] != nil {
+		t.Errorf("source = %v", src)
+	}
+}
+
+func TestFetchImageURLs_OverLimit(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("convert_fetch_image_urls", "true")
+	tdb.SetSetting("convert_image_max_mb", "0.01")
+	url := imageServer(t, testPNG(200, 200, true))
+
+	called := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-img", "img", "anthropic", upstream.URL)
+
+	for _, tc := range []struct{ name, body string }{
+		{"url", openAIImageURLRequest(url)},
+		{"data URI", openAIImageURLRequest("data:image/png;base64," + testPNG(200, 200, true))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(tc.body))
+			w := httptest.NewRecorder()
+			Handler().ServeHTTP(w, req)
+
+			if w.Code != 400 || called {
+				t.Fatalf("status = %d, upstream called = %v", w.Code, called)
+			}
+			var resp struct {
+				Error struct{ Type, Message string }
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if resp.Error.Type != "invalid_request_error" || !strings.Contains(resp.Error.Message, "messages[0].content[1]") ||
+				!strings.Contains(resp.Error.Message, "(limit 11 KB)") {
+				t.Errorf("error = %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestFetchImage_RefusesPrivateAddress(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("loopback server was fetched")
+	}))
+	defer srv.Close()
+
+	if _, _, err := fetchImage(context.Background(), srv.URL, defaultImageFetchMaxBytes); err == nil || !strings.Contains(err.Error(), "refusing to fetch") {
+		t.Errorf("err = %v", err)
+	}
+}
@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"bytes"
+	"codegate-proxy/internal/provider"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"math"
+	"strings"
+)
+
+// downscaleQuality is the JPEG quality oversized images are re-encoded at.
+const downscaleQuality = 80
+
+// maxDecodePixels bounds the images downscaling decodes. A few hundred bytes
+// of PNG can declare a 50000x50000 image, which would take gigabytes to
+// decode.
+const maxDecodePixels = 50_000_000
+
+// inlineImage is a base64 image in the forwarded body.
+type inlineImage struct {
+	// path locates the block, e.g. messages[2].content[0].content[1].
+	path string
+	data string
+	// set replaces the image's media type and data in the body.
+	set func(mediaType, data string)
+}
+
+// guardImages checks the inline images of the body forwarded to a candidate
+// against its provider's limits. With downscale, oversized images are
+// re-encoded as JPEG to fit and the returned note gives the sizes before and
+// after. Images left over a limit are listed in the error.
+func (b *requestBody) guardImages(inboundFormat string, targetIsAnthropic bool, caps provider.Capabilities, downscale bool) (string, error) {
+	if caps == (provider.Capabilities{}) {
+		return "", nil
+	}
+	openAIBody := inboundFormat == "openai" && !targetIsAnthropic
+	var images []inlineImage
+	if openAIBody {
+		images = openAIImages(b.parsed)
+	} else {
+		images = anthropicImages(b.anthropic)
+	}
+
+	var offending []string
+	var scaled, before, after int
+	for _, img := range images {
+		size, width, height := measureImage(img.data)
+		problem := imageViolation(caps, size, width, height)
+		if problem == "" {
+			continue
+		}
+		if downscale {
+			if data, n, ok := downscaleImage(img.data, caps); ok {
+				img.set("image/jpeg", data)
+				scaled++
+				before, after = before+size, after+n
+				continue
+			}
+		}
+		offending = append(offending, img.path+" is "+problem)
+	}
+
+	note := ""
+	if scaled > 0 {
+		if openAIBody {
+			b.raw, _ = json.Marshal(b.parsed)
+		} else {
+			b.anthropicModified = true
+		}
+		note = fmt.Sprintf("downscaled %d images over the provider's limits to JPEG (%s to %s)",
+			scaled, humanBytes(before), humanBytes(after))
+	}
+	if len(offending) > 0 {
+		return note, fmt.Errorf("image over the provider's limits: %s", strings.Join(offending, "; "))
+	}
+	return note, nil
+}
+
+// anthropicImages returns the base64 image blocks of an Anthropic body's
+// messages, including those inside tool results.
+func anthropicImages(body map[string]any) []inlineImage {
+	var images []inlineImage
+	eachAnthropicImage(body, func(path string, src map[string]any) {
+		data, _ := src["data"].(string)
+		if src["type"] != "base64" || data == "" {
+			return
+		}
+		images = append(images, inlineImage{path: path, data: data, set: func(mediaType, data string) {
+			src["media_type"], src["data"] = mediaType, data
+		}})
+	})
+	return images
+}
+
+// eachAnthropicImage calls fn with the path and source of each image block in
+// an Anthropic body's messages, including those inside tool results.
+func eachAnthropicImage(body map[string]any, fn func(path string, src map[string]any)) {
+	visit := func(path string, block map[string]any) {
+		if src, ok := block["source"].(map[string]any); ok && block["type"] == "image" {
+			fn(path, src)
+		}
+	}
+
+	msgs, _ := body["messages"].([]any)
+	for i, rm := range msgs {
+		m, _ := rm.(map[string]any)
+		blocks, _ := m["content"].([]any)
+		for j, rb := range blocks {
+			block, _ := rb.(map[string]any)
+			path := fmt.Sprintf("messages[%d].content[%d]", i, j)
+			visit(path, block)
+			if block["type"] != "tool_result" {
+				continue
+			}
+			inner, _ := block["content"].([]any)
+			for k, ri := range inner {
+				ib, _ := ri.(map[string]any)
+				visit(fmt.Sprintf("%s.content[%d]", path, k), ib)
+			}
+		}
+	}
+}
+
+// openAIImages returns the data URL image parts of an OpenAI body's messages.
+func openAIImages(body map[string]any) []inlineImage {
+	var images []inlineImage
+	msgs, _ := body["messages"].([]any)
+	for i, rm := range msgs {
+		m, _ := rm.(map[string]any)
+		parts, _ := m["content"].([]any)
+		for j, rp := range parts {
+			part, _ := rp.(map[string]any)
+			iu, _ := part["image_url"].(map[string]any)
+			url, _ := iu["url"].(string)
+			if part["type"] != "image_url" || !strings.HasPrefix(url, "data:") {
+				continue
+			}
+			_, data, ok := strings.Cut(url, ";base64,")
+			if !ok {
+				continue
+			}
+			images = append(images, inlineImage{path: fmt.Sprintf("messages[%d].content[%d]", i, j), data: data,
+				set: func(mediaType, data string) {
+					iu["url"] = "data:" + mediaType + ";base64," + data
+				}})
+		}
+	}
+	return images
+}
+
+// measureImage returns an image's decoded size and, for formats the image
+// package reads (PNG, JPEG, GIF), its dimensions. Only the header is decoded.
+func measureImage(data string) (size, width, height int) {
+	size = len(data) / 4 * 3
+	if len(data) >= 2 {
+		size -= strings.Count(data[len(data)-2:], "=")
+	}
+	cfg, _, err := image.DecodeConfig(base64.NewDecoder(base64.StdEncoding, strings.NewReader(data)))
+	if err == nil {
+		width, height = cfg.Width, cfg.Height
+	}
+	return size, width, height
+}
+
+// imageViolation describes how an image exceeds caps, or returns "".
+func imageViolation(caps provider.Capabilities, size, width, height int) string {
+	var problems []string
+	if caps.MaxImageBytes > 0 && size > caps.MaxImageBytes {
+		problems = append(problems, fmt.Sprintf("%s (limit %s)", humanBytes(size), humanBytes(caps.MaxImageBytes)))
+	}
+	if caps.MaxImageDimension > 0 && max(width, height) > caps.MaxImageDimension {
+		problems = append(problems, fmt.Sprintf("%dx%d px (limit %d px)", width, height, caps.MaxImageDimension))
+	}
+	return strings.Join(problems, " and ")
+}
+
+// downscaleImage re-encodes a base64 image as a JPEG within caps, shrinking
+// it further while the encoding is still too large. It returns the new data
+// and its decoded size, or false if the image can't be decoded, is over
+// maxDecodePixels, or can't be made to fit.
+func downscaleImage(data string, caps provider.Capabilities) (string, int, bool) {
+	cfg, _, err := image.DecodeConfig(base64.NewDecoder(base64.StdEncoding, strings.NewReader(data)))
+	if err != nil || int64(cfg.Width)*int64(cfg.Height) > maxDecodePixels {
+		return "", 0, false
+	}
+	src, _, err := image.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(data)))
+	if err != nil {
+		return "", 0, false
+	}
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	if d := caps.MaxImageDimension; d > 0 && max(width, height) > d {
+		scale := float64(d) / float64(max(width, height))
+		width, height = scaleDims(width, height, scale)
+	}
+	for range 6 {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, resizeImage(src, width, height), &jpeg.Options{Quality: downscaleQuality}); err != nil {
+			return "", 0, false
+		}
+		if caps.MaxImageBytes <= 0 || buf.Len() <= caps.MaxImageBytes {
+			return base64.StdEncoding.EncodeToString(buf.Bytes()), buf.Len(), true
+		}
+		// Size scales with area; aim a little under to save a round
+		scale := math.Sqrt(float64(caps.MaxImageBytes)/float64(buf.Len())) * 0.9
+		width, height = scaleDims(width, height, scale)
+	}
+	return "", 0, false
+}
+
+func scaleDims(width, height int, scale float64) (int, int) {
+	return max(1, int(float64(width)*scale)), max(1, int(float64(height)*scale))
+}
+
+// resizeImage scales src to width x height by averaging the source pixels
+// under each target pixel, flattened onto white since JPEG has no alpha.
+func resizeImage(src image.Image, width, height int) *image.RGBA {
+	at := pixelReader(src)
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		y0 := b.Min.Y + y*b.Dy()/height
+		y1 := max(b.Min.Y+(y+1)*b.Dy()/height, y0+1)
+		for x := range width {
+			x0 := b.Min.X + x*b.Dx()/width
+			x1 := max(b.Min.X+(x+1)*b.Dx()/width, x0+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := at(sx, sy)
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			// Colours are premultiplied, so white shows through by 1-alpha
+			white := 0xffff - a/n
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8((r/n + white) >> 8), G: uint8((g/n + white) >> 8), B: uint8((bl/n + white) >> 8), A: 0xff,
+			})
+		}
+	}
+	return dst
+}
+
+// pixelReader returns a function reading src's colour at a point. The
+// decoders' own image types are read through their typed accessors, which
+// return concrete colours; src.At allocates a color.Color for every pixel.
+func pixelReader(src image.Image) func(x, y int) (r, g, b, a uint32) {
+	switch img := src.(type) {
+	case *image.YCbCr:
+		return func(x, y int) (uint32, uint32, uint32, uint32) { return img.YCbCrAt(x, y).RGBA() }
+	case *image.RGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) { return img.RGBAAt(x, y).RGBA() }
+	case *image.NRGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) { return img.NRGBAAt(x, y).RGBA() }
+	case *image.Gray:
+		return func(x, y int) (uint32, uint32, uint32, uint32) { return img.GrayAt(x, y).RGBA() }
+	}
+	return func(x, y int) (uint32, uint32, uint32, uint32) { return src.At(x, y).RGBA() }
+}
+
+// humanBytes formats a byte count in KB or, from 1 MB, MB.
+func humanBytes(n int) string {
+	if n >= 1<<20 {
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	}
+	return fmt.Sprintf("%d KB", (n+1023)/1024)
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"bytes"
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/provider"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testPNG returns a base64 PNG of the given size. Noise defeats compression,
+// so a noisy image's size grows with its area.
+func testPNG(width, height int, noise bool) string {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	rng := rand.New(rand.NewSource(1))
+	for y := range height {
+		for x := range width {
+			c := color.NRGBA{R: 200, G: 80, B: 40, A: 0xff}
+			if noise {
+				c = color.NRGBA{R: uint8(rng.Intn(256)), G: uint8(rng.Intn(256)), B: uint8(rng.Intn(256)), A: 0xff}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func imageRequest(data string) string {
+	return `{"model":"claude-sonnet-4-6","max_tokens":16,"messages":[{"role":"user","content":[
+		{"type":"text","text":"what is on screen?"},
+		{"type":"image","source":{"type":"base64","media_type":"image/png","data":"` + data + `"}}]}]}`
+}
+
+func TestImageGuard_RejectsOversized(t *testing.T) {
+	tdb := dbtest.Open(t)
+	called := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-img", "img", "anthropic", upstream.URL)
+
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(imageRequest(testPNG(9000, 4, false))))
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+
+	if w.Code != 400 || called {
+		t.Fatalf("status = %d, upstream called = %v", w.Code, called)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "messages[0].content[1] is 9000x4 px (limit 8000 px)") {
+		t.Errorf("error doesn't name the image: %s", body)
+	}
+}
+
+func TestImageGuard_Downscales(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("downscale_images", "true")
+	var got map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		json.Unmarshal(b, &got)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"msg_1","type":"message","role":"assistant","content":[],"usage":{"input_tokens":1,"output_tokens":1}}`))
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-img", "img", "anthropic", upstream.URL)
+
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(imageRequest(testPNG(9000, 4, false))))
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	src := lastContent(got)[1].(map[string]any)["source"].(map[string]any)
+	if src["media_type"] != "image/jpeg" {
+		t.Fatalf("media_type = %v", src["media_type"])
+	}
+	if _, width, height := measureImage(src["data"].(string)); width != 8000 || height != 3 {
+		t.Errorf("downscaled to %dx%d, want 8000x3", width, height)
+	}
+	if warn := w.Header().Get(conversionWarningsHeader); !strings.Contains(warn, "downscaled 1 images over the provider's limits to JPEG") {
+		t.Errorf("warnings = %q", warn)
+	}
+}
+
+func TestGuardImages_BytesInToolResult(t *testing.T) {
+	caps := provider.Capabilities{MaxImageBytes: 64 << 10}
+	newReq := func() *requestBody {
+		var body map[string]any
+		json.Unmarshal([]byte(`{"messages":[{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":[
+			{"type":"image","source":{"type":"base64","media_type":"image/png","data":"`+testPNG(300, 300, true)+`"}}]}]}]}`), &body)
+		return &requestBody{parsed: body, anthropic: body}
+	}
+
+	req := newReq()
+	if _, err := req.guardImages("anthropic", true, caps, false); err == nil ||
+		!strings.Contains(err.Error(), "messages[0].content[0].content[0] is ") {
+		t.Fatalf("err = %v", err)
+	}
+	if req.anthropicModified {
+		t.Error("rejected body was modified")
+	}
+
+	req = newReq()
+	note, err := req.guardImages("anthropic", true, caps, true)
+	if err != nil || !strings.HasPrefix(note, "downscaled 1 images") || !req.anthropicModified {
+		t.Fatalf("note = %q, err = %v, modified = %v", note, err, req.anthropicModified)
+	}
+	src := lastContent(req.anthropic)[0].(map[string]any)["content"].([]any)[0].(map[string]any)["source"].(map[string]any)
+	if size, _, _ := measureImage(src["data"].(string)); size > caps.MaxImageBytes || src["media_type"] != "image/jpeg" {
+		t.Errorf("downscaled image is %d bytes of %v", size, src["media_type"])
+	}
+}
+
+func TestGuardImages_OpenAIDataURL(t *testing.T) {
+	var body map[string]any
+	json.Unmarshal([]byte(`{"model":"gpt-4o","messages":[{"role":"user","content":[
+		{"type":"image_url","image_url":{"url":"data:image/png;base64,`+testPNG(200, 50, false)+`"}}]}]}`), &body)
+	req := &requestBody{parsed: body}
+
+	note, err := req.guardImages("openai", false, provider.Capabilities{MaxImageDimension: 100}, true)
+	if err != nil || note == "" {
+		t.Fatalf("note = %q, err = %v", note, err)
+	}
+	url := lastContent(body)[0].(map[string]any)["image_url"].(map[string]any)["url"].(string)
+	data, ok := strings.CutPrefix(url, "data:image/jpeg;base64,")
+	if !ok {
+		t.Fatalf("url = %.40s...", url)
+	}
+	if _, width, height := measureImage(data); width != 100 || height != 25 {
+		t.Errorf("downscaled to %dx%d, want 100x25", width, height)
+	}
+	if !strings.Contains(string(req.raw), "data:image/jpeg;base64,") {
+		t.Error("raw body not rewritten")
+	}
+}
+
+// A PNG header declaring a huge image is refused before it is decoded
+func TestDownscaleImage_DecompressionBomb(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1)))
+	header := buf.Bytes()
+	// IHDR starts after the 8-byte signature, 4-byte length and 4-byte type
+	binary.BigEndian.PutUint32(header[16:], 50000)
+	binary.BigEndian.PutUint32(header[20:], 50000)
+	binary.BigEndian.PutUint32(header[29:], crc32.ChecksumIEEE(header[12:29]))
+	data := base64.StdEncoding.EncodeToString(header)
+
+	if _, w, h := measureImage(data); w != 50000 || h != 50000 {
+		t.Fatalf("measured %dx%d", w, h)
+	}
+	if _, _, ok := downscaleImage(data, provider.Capabilities{MaxImageDimension: 8000}); ok {
+		t.Error("downscaled a 2.5 GP image")
+	}
+}
+
+func TestPixelReader_MatchesAt(t *testing.T) {
+	rect := image.Rect(1, 2, 5, 6)
+	nrgba := image.NewNRGBA(rect)
+	rgba := image.NewRGBA(rect)
+	gray := image.NewGray(rect)
+	ycbcr := image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)
+	paletted := image.NewPaletted(rect, color.Palette{color.Black, color.RGBA{10, 20, 30, 255}})
+	rng := rand.New(rand.NewSource(1))
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			c := color.NRGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256))}
+			nrgba.SetNRGBA(x, y, c)
+			rgba.Set(x, y, c)
+			gray.Set(x, y, c)
+			paletted.SetColorIndex(x, y, uint8(rng.Intn(2)))
+			ycbcr.Y[ycbcr.YOffset(x, y)] = uint8(rng.Intn(256))
+			ycbcr.Cb[ycbcr.COffset(x, y)] = uint8(rng.Intn(256))
+			ycbcr.Cr[ycbcr.COffset(x, y)] = uint8(rng.Intn(256))
+		}
+	}
+	for _, img := range []image.Image{nrgba, rgba, gray, ycbcr, paletted} {
+		at := pixelReader(img)
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				r, g, b, a := at(x, y)
+				wr, wg, wb, wa := img.At(x, y).RGBA()
+				if r != wr || g != wg || b != wb || a != wa {
+					t.Fatalf("%T at %d,%d = %d,%d,%d,%d, want %d,%d,%d,%d", img, x, y, r, g, b, a, wr, wg, wb, wa)
+				}
+			}
+		}
+	}
+}
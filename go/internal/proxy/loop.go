@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/provider"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxProxyHops allows a request through a couple of chained CodeGate
+// proxies (e.g. a team proxy in front of a shared one) before it is treated
+// as a loop.
+const defaultMaxProxyHops = 2
+
+// maxProxyHops returns the max_proxy_hops setting, or the default.
+func maxProxyHops() int {
+	if n, err := strconv.Atoi(db.GetSetting("max_proxy_hops")); err == nil && n >= 0 {
+		return n
+	}
+	return defaultMaxProxyHops
+}
+
+// inboundHop returns how many CodeGate proxies already forwarded the request.
+func inboundHop(h http.Header) int {
+	n, err := strconv.Atoi(strings.TrimSpace(h.Get(provider.HopHeader)))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// loopHeader marks a 508 answering a request that went around a proxy loop.
+// The proxy that cuts the loop off sets it to loopDetected; the proxy that
+// forwarded the request there names its account in the error and sets it to
+// loopNamed, so proxies further back relay that error unchanged.
+var loopHeader = exposeHeader("X-CodeGate-Loop")
+
+const (
+	loopDetected = "detected"
+	loopNamed    = "named"
+)
+
+// loopError returns the error to send back for an upstream loop response
+// to a request forwarded through accountName. ok is false if resp isn't one.
+func loopError(resp *provider.Response, accountName string) (msg string, ok bool) {
+	if resp.Status != 508 {
+		return "", false
+	}
+	switch resp.Headers[strings.ToLower(loopHeader)] {
+	case loopDetected:
+		return fmt.Sprintf("Proxy loop detected: account %q has a base_url that points back at a CodeGate proxy.", accountName), true
+	case loopNamed:
+		// Both formats carry the message at error.message
+		var body struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(data, &body) == nil && body.Error.Message != "" {
+			return body.Error.Message, true
+		}
+		return "Proxy loop detected.", true
+	}
+	return "", false
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/cooldown"
+	"codegate-proxy/internal/dbtest"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// countingHandler counts requests reaching a proxy instance.
+func countingHandler(n *atomic.Int32) http.Handler {
+	h := Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.Add(1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func TestProxyLoop_Terminates(t *testing.T) {
+	tdb := dbtest.Open(t)
+
+	// The client talks to front; the only account's base_url points at back,
+	// which routes to itself through the same account
+	var frontHits, backHits atomic.Int32
+	front := httptest.NewServer(countingHandler(&frontHits))
+	defer front.Close()
+	back := httptest.NewServer(countingHandler(&backHits))
+	defer back.Close()
+	// back listens on the proxy port, so it is sent the hop count
+	t.Setenv("PROXY_PORT", back.URL[strings.LastIndex(back.URL, ":")+1:])
+	tdb.AddAccount("acct-loop", "pasted proxy url", "anthropic", back.URL)
+	t.Cleanup(func() { cooldown.Clear("acct-loop") })
+
+	resp, err := http.Post(front.URL+"/v1/messages", "application/json",
+		strings.NewReader(`{"model":"claude-sonnet-4-20250514","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := new(strings.Builder)
+	if _, err := io.Copy(body, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != 508 {
+		t.Fatalf("status = %d, want 508 (body %s)", resp.StatusCode, body)
+	}
+	if !strings.Contains(body.String(), "Proxy loop detected") || !strings.Contains(body.String(), `\"pasted proxy url\"`) {
+		t.Errorf("body = %s, want a loop error naming the account", body)
+	}
+	if n := strings.Count(body.String(), "Proxy loop detected"); n != 1 {
+		t.Errorf("body = %s, want the loop error once", body)
+	}
+	// front (hop 0) -> back (hop 1) -> back (hop 2) -> back (hop 3, rejected)
+	if frontHits.Load() != 1 || backHits.Load() != defaultMaxProxyHops+1 {
+		t.Errorf("front hits = %d, back hits = %d", frontHits.Load(), backHits.Load())
+	}
+}
+
+func TestProxyLoop_MaxHopsSetting(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("max_proxy_hops", "0")
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{}`))
+	req.Header.Set("X-CodeGate-Hop", "1")
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+	if w.Code != 508 || !strings.Contains(w.Body.String(), `"code":508`) {
+		t.Errorf("status = %d, body = %s; want an OpenAI-format 508", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get(loopHeader); got != loopDetected {
+		t.Errorf("%s = %q, want %q", loopHeader, got, loopDetected)
+	}
+}
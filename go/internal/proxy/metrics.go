@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/metrics"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handleMetrics serves the proxy's counters, gauges and histograms in the
+// Prometheus text format: GET /metrics. When PROXY_METRICS_TOKEN is set it
+// must be sent as a bearer token, so a scraper needs no proxy API key.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if token := getEnvDefault("PROXY_METRICS_TOKEN", ""); token != "" {
+		got, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeError(w, r, "anthropic", 401, "authentication_error", "Invalid or missing metrics token")
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := metrics.WriteText(w); err != nil {
+		log.Printf("[metrics] Failed to write metrics: %v", err)
+	}
+}
+
+// withMetrics counts proxied requests in codegate_requests_total and times
+// them, to the end of the response body, in
+// codegate_request_duration_seconds. Both are labelled with the inbound
+// format and the provider of the last account the request was sent to ("" if
+// none); requests also with the status they were answered with, or 499 if
+// the client went away first.
+func withMetrics(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		mw := &metricsWriter{ResponseWriter: w}
+		defer func() {
+			format := "anthropic"
+			if strings.Contains(r.URL.Path, "/chat/completions") {
+				format = "openai"
+			}
+			status := mw.status
+			if status == 0 {
+				status = 499
+			}
+			metrics.Inc("codegate_requests_total", "inbound_format", format, "provider", mw.provider, "status", strconv.Itoa(status))
+			metrics.Observe("codegate_request_duration_seconds", time.Since(start).Seconds(), "inbound_format", format, "provider", mw.provider)
+		}()
+		next(mw, r)
+	}
+}
+
+// setMetricsProvider labels the request's metrics with the provider of the
+// account it is being sent to.
+func setMetricsProvider(w http.ResponseWriter, provider string) {
+	for {
+		switch rw := w.(type) {
+		case *metricsWriter:
+			rw.provider = provider
+			return
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return
+		}
+	}
+}
+
+// countTokens adds a response's tokens to codegate_tokens_total for the
+// account that served it.
+func countTokens(accountID string, input, output int) {
+	metrics.Add("codegate_tokens_total", int64(input), "account_id", accountID, "direction", "input")
+	metrics.Add("codegate_tokens_total", int64(output), "account_id", accountID, "direction", "output")
+}
+
+// metricsWriter records the status a request was answered with.
+type metricsWriter struct {
+	http.ResponseWriter
+	status   int
+	provider string
+}
+
+func (w *metricsWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *metricsWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *metricsWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *metricsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
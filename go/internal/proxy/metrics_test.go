@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/guardrails"
+	"codegate-proxy/internal/metrics"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func getMetrics(t *testing.T, auth string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	if auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, r)
+	return w
+}
+
+func TestMetrics_AfterFailover(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("provider_retry_count", "0")
+	tdb.SetSetting("privacy_enabled", "true")
+	guardrails.InitGuardrails()
+	failoverPair(t, tdb)
+	metrics.Reset()
+
+	w := sendMessages(t, `{"model":"claude-sonnet-4-20250514","max_tokens":16,"messages":[{"role":"user","content":"mail jane.doe@example.com"}]}`, nil)
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	w = getMetrics(t, "")
+	if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("status = %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE codegate_requests_total counter",
+		`codegate_requests_total{inbound_format="anthropic",provider="anthropic",status="200"} 1`,
+		"# TYPE codegate_request_duration_seconds histogram",
+		`codegate_request_duration_seconds_count{inbound_format="anthropic",provider="anthropic"} 1`,
+		`codegate_failovers_total{provider="anthropic"} 1`,
+		`codegate_cooldowns_total{reason="server_error",scope="account"} 1`,
+		`codegate_tokens_total{account_id="acct-backup",direction="input"} 1`,
+		`codegate_tokens_total{account_id="acct-backup",direction="output"} 1`,
+		`codegate_guardrail_detections_total{guardrail="email"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %s:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetrics_ClientClosed(t *testing.T) {
+	metrics.Reset()
+
+	withMetrics(func(w http.ResponseWriter, r *http.Request) {})(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/chat/completions", nil))
+	if n := metrics.Counter("codegate_requests_total", "inbound_format", "openai", "provider", "", "status", "499"); n != 1 {
+		t.Errorf("unanswered requests = %d, want 1", n)
+	}
+}
+
+func TestMetrics_Token(t *testing.T) {
+	dbtest.Open(t)
+	t.Setenv("PROXY_METRICS_TOKEN", "scrape-secret")
+	t.Setenv("PROXY_API_KEY", "global-secret")
+
+	for _, auth := range []string{"", "Bearer wrong", "global-secret", "Bearer global-secret"} {
+		if w := getMetrics(t, auth); w.Code != 401 {
+			t.Errorf("auth %q: status = %d, want 401", auth, w.Code)
+		}
+	}
+	if w := getMetrics(t, "Bearer scrape-secret"); w.Code != 200 {
+		t.Errorf("status = %d, want 200", w.Code)
+	}
+}
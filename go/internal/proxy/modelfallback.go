@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/routing"
+	"encoding/json"
+	"strings"
+)
+
+// modelFallbackStrategy labels responses served by a fallback model on the
+// account the request was routed to.
+const modelFallbackStrategy = "model-fallback"
+
+// nextModelFallback returns the candidate retrying c's account with its
+// next fallback model.
+func nextModelFallback(c routing.Candidate) (routing.Candidate, bool) {
+	if len(c.FallbackModels) == 0 {
+		return routing.Candidate{}, false
+	}
+	return routing.Candidate{
+		Account:        c.Account,
+		TargetModel:    c.FallbackModels[0],
+		FallbackModels: c.FallbackModels[1:],
+		ModelFallback:  true,
+	}, true
+}
+
+// modelScopedError reports whether a 429 or 529 concerns the target model
+// rather than the account: Anthropic's overloaded_error, or a rate limit
+// whose message names the model (OpenAI's "Rate limit reached for gpt-4o
+// in organization ...").
+func modelScopedError(status int, body []byte, model string) bool {
+	if status != 429 && status != 529 {
+		return false
+	}
+	var resp struct {
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &resp) != nil {
+		return false
+	}
+	if resp.Error.Type == "overloaded_error" {
+		return true
+	}
+	return model != "" && strings.Contains(strings.ToLower(resp.Error.Message), strings.ToLower(model))
+}
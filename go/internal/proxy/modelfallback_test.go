@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/cooldown"
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/health"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestModelFallback(t *testing.T) {
+	cases := []struct {
+		name, overloaded string
+		wantModels       []string
+		wantBackup       int32
+		wantStrategy     string
+	}{
+		{"model overloaded", `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+			[]string{"claude-opus-4-6", "claude-sonnet-4-6"}, 0, modelFallbackStrategy},
+		{"account rate limited", `{"type":"error","error":{"type":"rate_limit_error","message":"This request would exceed your organization's rate limit"}}`,
+			[]string{"claude-opus-4-6"}, 1, "config+failover"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tdb := dbtest.Open(t)
+			// Overloads go to the fallback model without a retry
+			tdb.SetSetting("provider_retry_count", "0")
+			var mu sync.Mutex
+			var models []string
+			primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body struct{ Model string }
+				json.NewDecoder(r.Body).Decode(&body)
+				mu.Lock()
+				models = append(models, body.Model)
+				mu.Unlock()
+				w.Header().Set("Content-Type", "application/json")
+				if body.Model == "claude-opus-4-6" {
+					status := 529
+					if strings.Contains(tc.overloaded, "rate_limit_error") {
+						status = 429
+					}
+					w.WriteHeader(status)
+					fmt.Fprint(w, tc.overloaded)
+					return
+				}
+				fmt.Fprintf(w, `{"id":"msg_1","type":"message","role":"assistant","model":%q,"content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`, body.Model)
+			}))
+			defer primary.Close()
+			var backupHits atomic.Int32
+			backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				backupHits.Add(1)
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"id":"msg_2","type":"message","role":"assistant","model":"claude-opus-4-6","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+			}))
+			defer backup.Close()
+
+			tdb.AddAccount("acct-primary", "primary", "anthropic", primary.URL)
+			tdb.AddAccount("acct-backup", "backup", "anthropic", backup.URL)
+			tdb.Exec("INSERT INTO configs (id, name, is_active) VALUES ('cfg', 'default', 1)")
+			tdb.Exec(`INSERT INTO config_tiers (id, config_id, tier, account_id, priority, target_model, fallback_models)
+				VALUES ('ct1', 'cfg', 'sonnet', 'acct-primary', 10, 'claude-opus-4-6', '["claude-sonnet-4-6"]')`)
+			tdb.Exec("INSERT INTO config_tiers (id, config_id, tier, account_id, priority, target_model) VALUES ('ct2', 'cfg', 'sonnet', 'acct-backup', 5, 'claude-opus-4-6')")
+			reset := func() {
+				cooldown.Clear("acct-primary")
+				cooldown.Clear("acct-backup")
+				cooldown.ClearModel("acct-primary", "claude-opus-4-6")
+				health.Reset()
+			}
+			reset()
+			t.Cleanup(reset)
+
+			w := sendMessages(t, plainMessage, nil)
+			if w.Code != 200 {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !slices.Equal(models, tc.wantModels) || backupHits.Load() != tc.wantBackup {
+				t.Errorf("primary served %v, backup hits = %d; want %v, %d", models, backupHits.Load(), tc.wantModels, tc.wantBackup)
+			}
+			if got := w.Header().Get("X-Proxy-Strategy"); got != tc.wantStrategy {
+				t.Errorf("X-Proxy-Strategy = %q, want %q", got, tc.wantStrategy)
+			}
+			if overloaded := cooldown.IsModelOnCooldown("acct-primary", "claude-opus-4-6"); overloaded != (tc.wantBackup == 0) {
+				t.Errorf("model cooldown = %v", overloaded)
+			}
+		})
+	}
+}
+
+func TestModelScopedError(t *testing.T) {
+	cases := []struct {
+		status int
+		body   string
+		want   bool
+	}{
+		{529, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`, true},
+		{429, `{"error":{"message":"Rate limit reached for gpt-4o in organization org-1 on tokens per min","type":"tokens"}}`, true},
+		{429, `{"error":{"message":"You exceeded your current quota","type":"insufficient_quota"}}`, false},
+		{500, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`, false},
+		{529, `Service Unavailable`, false},
+	}
+	for _, tc := range cases {
+		if got := modelScopedError(tc.status, []byte(tc.body), "gpt-4o"); got != tc.want {
+			t.Errorf("modelScopedError(%d, %s) = %v, want %v", tc.status, tc.body, got, tc.want)
+		}
+	}
+}
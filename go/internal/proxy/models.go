@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/models"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// modelsCacheTTL bounds how often /v1/models reads the routing config.
+const modelsCacheTTL = 10 * time.Second
+
+// modelsCreated is the creation time reported for every model. Providers
+// don't say when a model was released, and clients only sort by it.
+var modelsCreated = time.Unix(1700000000, 0).UTC()
+
+// listedModel is a model /v1/models lists: a name clients can send, and
+// the provider of the account it is routed to. Aliases name the snapshot
+// they stand for in AliasOf.
+type listedModel struct {
+	ID      string
+	OwnedBy string
+	AliasOf string
+}
+
+var modelsCache struct {
+	mu sync.Mutex
+	// lists are keyed by config ID, "" for the active config
+	lists map[string]cachedModelList
+}
+
+type cachedModelList struct {
+	models  []listedModel
+	expires time.Time
+}
+
+// handleModels lists the models reachable through the caller's config: a
+// tenant's own config when its key has one, or the active config. It takes
+// the same credentials as proxied requests. Anthropic clients, which send
+// anthropic-version, get the Anthropic list shape; others get OpenAI's.
+func handleModels(w http.ResponseWriter, r *http.Request) {
+	format := requestFormat(r)
+	t, _, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	configID := ""
+	if t != nil {
+		configID = t.ConfigID
+	}
+
+	list, err := modelList(configID)
+	if err != nil {
+		log.Printf("[models] Failed to list models: %v", err)
+		writeError(w, r, format, 500, "api_error", "Failed to list models")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if format == "anthropic" {
+		json.NewEncoder(w).Encode(anthropicModelList(list))
+		return
+	}
+	json.NewEncoder(w).Encode(openAIModelList(list))
+}
+
+// modelList returns the cached model list for a config, building it when
+// missing or older than modelsCacheTTL.
+func modelList(configID string) ([]listedModel, error) {
+	modelsCache.mu.Lock()
+	defer modelsCache.mu.Unlock()
+	if cached, ok := modelsCache.lists[configID]; ok && time.Now().Before(cached.expires) {
+		return cached.models, nil
+	}
+	list, err := buildModelList(configID)
+	if err != nil {
+		return nil, err
+	}
+	if modelsCache.lists == nil {
+		modelsCache.lists = make(map[string]cachedModelList)
+	}
+	modelsCache.lists[configID] = cachedModelList{models: list, expires: time.Now().Add(modelsCacheTTL)}
+	return list, nil
+}
+
+// buildModelList lists a config's target models, and the model names in
+// models.CostRates whose tier the config routes, since routing passes them
+// through to accounts without a target model. Each is owned by the
+// provider of the highest-priority enabled account serving it. Without a
+// config, requests go to the first enabled account (Anthropic first), so
+// every tiered name is listed as that account's. Aliases in models.Aliases
+// are listed alongside their snapshots.
+func buildModelList(configID string) ([]listedModel, error) {
+	var config *db.Config
+	var err error
+	if configID != "" {
+		config, err = db.GetConfigByID(configID)
+	} else {
+		config, err = db.GetActiveConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+	accounts, err := db.GetEnabledAccounts()
+	if err != nil {
+		return nil, err
+	}
+
+	owners := make(map[string]string)
+	add := func(id, provider string) {
+		if _, ok := owners[id]; !ok {
+			owners[id] = provider
+		}
+	}
+	// tierOwners maps each routed tier to its top account's provider
+	tierOwners := make(map[models.Tier]string)
+
+	if config == nil {
+		if len(accounts) > 0 {
+			i := slices.IndexFunc(accounts, func(a db.Account) bool { return a.Provider == "anthropic" })
+			provider := accounts[max(i, 0)].Provider
+			for _, tier := range []models.Tier{models.TierOpus, models.TierSonnet, models.TierHaiku} {
+				tierOwners[tier] = provider
+			}
+		}
+	} else {
+		tiers, err := db.GetConfigTiers(config.ID)
+		if err != nil {
+			return nil, err
+		}
+		enabled := make(map[string]db.Account, len(accounts))
+		for _, a := range accounts {
+			enabled[a.ID] = a
+		}
+		// Rows come in priority order within each tier
+		for _, t := range tiers {
+			account, ok := enabled[t.AccountID]
+			if !ok {
+				continue
+			}
+			if t.TargetModel != "" {
+				add(t.TargetModel, account.Provider)
+			}
+			if _, ok := tierOwners[models.Tier(t.Tier)]; !ok {
+				tierOwners[models.Tier(t.Tier)] = account.Provider
+			}
+		}
+	}
+
+	for name := range models.CostRates {
+		if provider, ok := tierOwners[models.DetectTier(name)]; ok {
+			add(name, provider)
+		}
+	}
+
+	list := make([]listedModel, 0, len(owners))
+	for id, provider := range owners {
+		list = append(list, listedModel{ID: id, OwnedBy: provider})
+	}
+	for alias, snapshot := range models.Aliases {
+		if provider, ok := owners[snapshot]; ok {
+			if _, taken := owners[alias]; !taken {
+				list = append(list, listedModel{ID: alias, OwnedBy: provider, AliasOf: snapshot})
+			}
+		}
+	}
+	slices.SortFunc(list, func(a, b listedModel) int { return strings.Compare(a.ID, b.ID) })
+	return list, nil
+}
+
+func openAIModelList(list []listedModel) map[string]any {
+	data := make([]map[string]any, len(list))
+	for i, m := range list {
+		data[i] = map[string]any{"id": m.ID, "object": "model", "created": modelsCreated.Unix(), "owned_by": m.OwnedBy}
+		if m.AliasOf != "" {
+			data[i]["alias_of"] = m.AliasOf
+		}
+	}
+	return map[string]any{"object": "list", "data": data}
+}
+
+func anthropicModelList(list []listedModel) map[string]any {
+	data := make([]map[string]any, len(list))
+	for i, m := range list {
+		data[i] = map[string]any{"type": "model", "id": m.ID, "display_name": m.ID, "created_at": modelsCreated.Format(time.RFC3339)}
+		if m.AliasOf != "" {
+			data[i]["alias_of"] = m.AliasOf
+		}
+	}
+	resp := map[string]any{"data": data, "has_more": false, "first_id": nil, "last_id": nil}
+	if len(list) > 0 {
+		resp["first_id"], resp["last_id"] = list[0].ID, list[len(list)-1].ID
+	}
+	return resp
+}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/tenant"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func resetModelsCache(t *testing.T) {
+	reset := func() {
+		modelsCache.mu.Lock()
+		modelsCache.lists = nil
+		modelsCache.mu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+type openAIModels struct {
+	Object string `json:"object"`
+	Data   []struct {
+		ID      string `json:"id"`
+		Object  string `json:"object"`
+		OwnedBy string `json:"owned_by"`
+	} `json:"data"`
+}
+
+func getModels(t *testing.T, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/v1/models", nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	return w
+}
+
+// listedOwners returns the models an OpenAI-shaped list has, by owner.
+func listedOwners(t *testing.T, w *httptest.ResponseRecorder) map[string]string {
+	t.Helper()
+	var list openAIModels
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || list.Object != "list" {
+		t.Fatalf("body = %s (%v)", w.Body.String(), err)
+	}
+	owners := make(map[string]string)
+	for _, m := range list.Data {
+		owners[m.ID] = m.OwnedBy
+	}
+	return owners
+}
+
+func TestModels_FromActiveConfig(t *testing.T) {
+	tdb := dbtest.Open(t)
+	resetModelsCache(t)
+	tdb.AddAccount("acct-claude", "claude", "anthropic", "")
+	tdb.AddAccount("acct-deepseek", "deepseek", "deepseek", "")
+	tdb.AddAccount("acct-off", "off", "openai", "")
+	tdb.Exec("UPDATE accounts SET enabled = 0 WHERE id = 'acct-off'")
+	tdb.AddActiveConfig("cfg", "default")
+	tdb.AddTier("cfg", "sonnet", "acct-claude", 10, "")
+	tdb.AddTier("cfg", "sonnet", "acct-deepseek", 5, "deepseek-chat")
+	tdb.AddTier("cfg", "opus", "acct-deepseek", 10, "deepseek-reasoner")
+	tdb.AddTier("cfg", "haiku", "acct-off", 10, "gpt-4o-mini")
+
+	owners := listedOwners(t, getModels(t, nil))
+	want := map[string]string{
+		"deepseek-chat":              "deepseek",
+		"deepseek-reasoner":          "deepseek",
+		"claude-sonnet-4-20250514":   "anthropic",
+		"claude-sonnet-4-6":          "anthropic",
+		"claude-sonnet-4-6-20250219": "anthropic",
+		"claude-opus-4-20250514":     "deepseek",
+		"claude-opus-4-6":            "deepseek",
+		"claude-opus-4-6-20250219":   "deepseek",
+		"claude-3-7-sonnet-20250219": "anthropic",
+		"claude-3-7-sonnet-latest":   "anthropic",
+		"claude-3-5-sonnet-20241022": "anthropic",
+		"claude-3-5-sonnet-20240620": "anthropic",
+		"claude-3-5-sonnet-latest":   "anthropic",
+		"claude-3-sonnet-20240229":   "anthropic",
+		"claude-3-opus-20240229":     "deepseek",
+		"claude-3-opus-latest":       "deepseek",
+	}
+	for id, owner := range want {
+		if owners[id] != owner {
+			t.Errorf("%s owned by %q, want %q", id, owners[id], owner)
+		}
+	}
+	// Haiku is only routed to a disabled account
+	for _, id := range []string{"gpt-4o-mini", "claude-haiku-4-5-20251001", "claude-3-5-haiku-latest"} {
+		if _, ok := owners[id]; ok {
+			t.Errorf("%s listed, but its only account is disabled", id)
+		}
+	}
+	if len(owners) != len(want) {
+		t.Errorf("listed %v, want %d models", owners, len(want))
+	}
+}
+
+func TestModels_TenantConfig(t *testing.T) {
+	tdb := dbtest.Open(t)
+	resetModelsCache(t)
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+	tdb.AddAccount("acct-claude", "claude", "anthropic", "")
+	tdb.AddAccount("acct-openai", "openai", "openai", "")
+	tdb.AddActiveConfig("cfg", "default")
+	tdb.AddTier("cfg", "sonnet", "acct-claude", 10, "")
+	tdb.Exec("INSERT INTO configs (id, name, is_active) VALUES ('cfg-tenant', 'tenant', 0)")
+	tdb.AddTier("cfg-tenant", "sonnet", "acct-openai", 10, "gpt-4.1")
+	sum := sha256.Sum256([]byte("cgk_scoped"))
+	tdb.Exec("INSERT INTO tenants (id, name, api_key_hash, api_key_prefix, config_id) VALUES ('t1', 'Scoped', ?, 'cgk_scop', 'cfg-tenant')", hex.EncodeToString(sum[:]))
+
+	scoped := listedOwners(t, getModels(t, http.Header{"Authorization": {"Bearer cgk_scoped"}}))
+	if scoped["gpt-4.1"] != "openai" || scoped["claude-sonnet-4-20250514"] != "openai" {
+		t.Errorf("tenant's list = %v", scoped)
+	}
+	t.Setenv("PROXY_API_KEY", "global-key")
+	global := listedOwners(t, getModels(t, http.Header{"X-Api-Key": {"global-key"}}))
+	if _, ok := global["gpt-4.1"]; ok || global["claude-sonnet-4-20250514"] != "anthropic" {
+		t.Errorf("global list = %v", global)
+	}
+}
+
+// The list names target models and providers, so it takes the same
+// credentials as proxied requests
+func TestModels_Authenticated(t *testing.T) {
+	tdb := dbtest.Open(t)
+	resetModelsCache(t)
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+	tdb.AddAccount("acct-claude", "claude", "anthropic", "")
+	t.Setenv("PROXY_API_KEY", "global-key")
+
+	for name, header := range map[string]http.Header{
+		"missing": nil,
+		"wrong":   {"X-Api-Key": {"not-the-key"}},
+	} {
+		req := httptest.NewRequest("GET", "/v1/models", nil)
+		req.Header = header
+		w := httptest.NewRecorder()
+		Handler().ServeHTTP(w, req)
+		if w.Code != 401 {
+			t.Errorf("%s key: status = %d, want 401", name, w.Code)
+		}
+	}
+
+	sum := sha256.Sum256([]byte("cgk_known"))
+	tdb.Exec("INSERT INTO tenants (id, name, api_key_hash, api_key_prefix) VALUES ('t1', 'Known', ?, 'cgk_know')", hex.EncodeToString(sum[:]))
+	tenant.InvalidateAll()
+	req := httptest.NewRequest("GET", "/v1/models", nil)
+	req.Header.Set("Authorization", "Bearer cgk_unknown")
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+	if w.Code != 401 {
+		t.Errorf("unknown tenant key: status = %d, want 401", w.Code)
+	}
+	getModels(t, http.Header{"Authorization": {"Bearer cgk_known"}})
+}
+
+func TestModels_AnthropicShape(t *testing.T) {
+	tdb := dbtest.Open(t)
+	resetModelsCache(t)
+	tdb.AddAccount("acct-claude", "claude", "anthropic", "")
+
+	w := getModels(t, http.Header{"Anthropic-Version": {"2023-06-01"}})
+	var list struct {
+		Data []struct {
+			Type      string `json:"type"`
+			ID        string `json:"id"`
+			CreatedAt string `json:"created_at"`
+			AliasOf   string `json:"alias_of"`
+		} `json:"data"`
+		HasMore bool   `json:"has_more"`
+		FirstID string `json:"first_id"`
+		LastID  string `json:"last_id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	// Without a config every Claude model goes to the Anthropic account
+	if len(list.Data) != 18 || list.HasMore {
+		t.Fatalf("body = %s", w.Body.String())
+	}
+	if m := list.Data[0]; m.Type != "model" || m.CreatedAt == "" || m.ID != list.FirstID || list.Data[17].ID != list.LastID {
+		t.Errorf("body = %s", w.Body.String())
+	}
+	aliases := make(map[string]string)
+	for _, m := range list.Data {
+		if m.AliasOf != "" {
+			aliases[m.ID] = m.AliasOf
+		}
+	}
+	if len(aliases) != 4 || aliases["claude-3-5-sonnet-latest"] != "claude-3-5-sonnet-20241022" {
+		t.Errorf("aliases = %v", aliases)
+	}
+}
+
+func TestModels_Cached(t *testing.T) {
+	tdb := dbtest.Open(t)
+	resetModelsCache(t)
+	tdb.AddAccount("acct-claude", "claude", "anthropic", "")
+	tdb.AddActiveConfig("cfg", "default")
+	tdb.AddTier("cfg", "sonnet", "acct-claude", 10, "claude-sonnet-4-6")
+
+	first := getModels(t, nil).Body.String()
+	tdb.AddTier("cfg", "opus", "acct-claude", 10, "claude-opus-4-6")
+	if second := getModels(t, nil).Body.String(); second != first {
+		t.Errorf("list changed within the cache TTL:\n%s\n%s", first, second)
+	}
+	resetModelsCache(t)
+	if owners := listedOwners(t, getModels(t, nil)); owners["claude-opus-4-6"] != "anthropic" {
+		t.Errorf("list after expiry = %v", owners)
+	}
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import "codegate-proxy/internal/provider"
+
+// optionalOpenAIFields are Chat Completions fields only some
+// OpenAI-compatible APIs take, with the capability that says a provider
+// does. Others, like DeepSeek, reject requests that have them.
+var optionalOpenAIFields = []struct {
+	name      string
+	supported func(provider.Capabilities) bool
+}{
+	{"store", func(c provider.Capabilities) bool { return c.Store }},
+	{"metadata", func(c provider.Capabilities) bool { return c.Metadata }},
+	{"prediction", func(c provider.Capabilities) bool { return c.Prediction }},
+}
+
+// unsupportedOpenAIFields lists the optional fields an OpenAI request body
+// has that a provider with caps doesn't take.
+func unsupportedOpenAIFields(body map[string]any, caps provider.Capabilities) []string {
+	var dropped []string
+	for _, f := range optionalOpenAIFields {
+		if _, ok := body[f.name]; ok && !f.supported(caps) {
+			dropped = append(dropped, f.name)
+		}
+	}
+	return dropped
+}
+
+// spoolHasUnsupportedOpenAIFields reports whether a spooled body has an
+// optional field a provider with caps doesn't take.
+func spoolHasUnsupportedOpenAIFields(s *spooledBody, caps provider.Capabilities) bool {
+	for _, f := range optionalOpenAIFields {
+		if _, ok := s.fields[f.name]; ok && !f.supported(caps) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOpenAIPassthrough_OptionalFields(t *testing.T) {
+	const body = `{"model":"gpt-4o","store":true,"metadata":{"team":"search"},"prediction":{"type":"content","content":"x"},"messages":[{"role":"user","content":"hi"}]}`
+	cases := []struct {
+		provider string
+		kept     []string
+		warning  string
+	}{
+		{"openai", []string{"store", "metadata", "prediction"}, ""},
+		{"openrouter", []string{"prediction"}, "dropped store, metadata, which the provider doesn't take"},
+		{"deepseek", nil, "dropped store, metadata, prediction, which the provider doesn't take"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.provider, func(t *testing.T) {
+			testOptionalFieldsForwarded(t, body, "", tc.provider, tc.kept, tc.warning)
+		})
+		// Spooled with a prediction too large for the spool's field scan
+		t.Run(tc.provider+" spooled", func(t *testing.T) {
+			large := strings.Replace(body, `"content":"x"`, `"content":"`+strings.Repeat("x", 2*maxCapturedField)+`"`, 1)
+			testOptionalFieldsForwarded(t, large, "0.001", tc.provider, tc.kept, tc.warning)
+		})
+	}
+}
+
+// testOptionalFieldsForwarded sends body to a provider and checks which
+// optional fields reach it and the warning listing the rest.
+func testOptionalFieldsForwarded(t *testing.T, body, spoolThresholdMB, providerName string, kept []string, warning string) {
+	t.Helper()
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("body_spool_threshold_mb", spoolThresholdMB)
+	var forwarded map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		json.Unmarshal(b, &forwarded)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}]}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-"+providerName, providerName, providerName, upstream.URL)
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	for _, field := range optionalOpenAIFields {
+		if _, ok := forwarded[field.name]; ok != slices.Contains(kept, field.name) {
+			t.Errorf("%s forwarded = %v, want %v", field.name, ok, !ok)
+		}
+	}
+	if got := w.Header().Get(conversionWarningsHeader); got != warning {
+		t.Errorf("%s = %q, want %q", conversionWarningsHeader, got, warning)
+	}
+}
+
+func TestOpenAIToAnthropic_OptionalFields(t *testing.T) {
+	tdb := dbtest.Open(t)
+	var forwarded map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		json.Unmarshal(b, &forwarded)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-anthropic", "anthropic", "anthropic", upstream.URL)
+
+	const body = `{"model":"claude-sonnet-4-20250514","store":true,"metadata":{"user_id":"u1","team":"search"},"prediction":{"type":"content","content":"x"},"messages":[{"role":"user","content":"hi"}]}`
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if _, ok := forwarded["store"]; ok {
+		t.Error("store was forwarded")
+	}
+	if _, ok := forwarded["prediction"]; ok {
+		t.Error("prediction was forwarded")
+	}
+	if md, _ := forwarded["metadata"].(map[string]any); len(md) != 1 || md["user_id"] != "u1" {
+		t.Errorf("metadata = %v, want user_id u1 only", forwarded["metadata"])
+	}
+	warnings := w.Header().Get(conversionWarningsHeader)
+	for _, want := range []string{"dropped store", "dropped prediction", "dropped metadata team"} {
+		if !strings.Contains(warnings, want) {
+			t.Errorf("%s = %q, want it to mention %q", conversionWarningsHeader, warnings, want)
+		}
+	}
+}
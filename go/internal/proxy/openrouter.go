@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"bytes"
+	"codegate-proxy/internal/db"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+)
+
+// openRouterPrefFields are the request fields an account's openrouter_prefs
+// may set, with a check for each value's shape.
+var openRouterPrefFields = map[string]func(any) error{
+	"provider":   checkOpenRouterProvider,
+	"models":     checkStrings,
+	"transforms": checkStrings,
+	"route":      checkOneOf("fallback"),
+}
+
+// openRouterProviderFields are the keys OpenRouter accepts in the provider
+// routing object.
+var openRouterProviderFields = map[string]func(any) error{
+	"order":              checkStrings,
+	"only":               checkStrings,
+	"ignore":             checkStrings,
+	"allow_fallbacks":    checkBool,
+	"require_parameters": checkBool,
+	"data_collection":    checkOneOf("allow", "deny"),
+	"sort":               checkOneOf("price", "throughput", "latency"),
+	"quantizations":      checkStringsOneOf("int4", "int8", "fp4", "fp6", "fp8", "fp16", "bf16", "fp32", "unknown"),
+	"max_price":          checkPrices,
+}
+
+// parseOpenRouterPrefs parses and validates an account's openrouter_prefs.
+// An empty value means no preferences.
+func parseOpenRouterPrefs(raw string) (map[string]any, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var prefs map[string]any
+	if err := json.Unmarshal([]byte(raw), &prefs); err != nil {
+		return nil, fmt.Errorf("not a JSON object: %w", err)
+	}
+	if err := checkFields(prefs, openRouterPrefFields); err != nil {
+		return nil, err
+	}
+	return prefs, nil
+}
+
+// withOpenRouterPrefs merges an OpenRouter account's preferences into the
+// OpenAI-format body forwarded to it, and asks for usage accounting so the
+// response reports what the request cost. Fields the account sets replace
+// the client's; provider objects are merged key by key. Spooled bodies are
+// forwarded unchanged.
+func withOpenRouterPrefs(logf func(string, ...any), body io.Reader, n int64, spooled bool, account db.Account) (io.Reader, int64) {
+	if spooled {
+		logf("[proxy] OpenRouter preferences skipped for spooled request body (%d bytes)", n)
+		return body, n
+	}
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return bytes.NewReader(raw), int64(len(raw))
+	}
+	prefs, err := parseOpenRouterPrefs(account.OpenRouterPrefs)
+	if err != nil {
+		logf("[proxy] Ignoring openrouter_prefs for %q: %v", account.Name, err)
+	}
+	merged, err := mergeOpenRouterPrefs(raw, prefs)
+	if err != nil {
+		return bytes.NewReader(raw), int64(len(raw))
+	}
+	return bytes.NewReader(merged), int64(len(merged))
+}
+
+// mergeOpenRouterPrefs does withOpenRouterPrefs' merge on a JSON body.
+func mergeOpenRouterPrefs(raw []byte, prefs map[string]any) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var body map[string]any
+	if err := dec.Decode(&body); err != nil {
+		return nil, err
+	}
+	for k, v := range prefs {
+		if override, ok := v.(map[string]any); ok && k == "provider" {
+			if client, ok := body["provider"].(map[string]any); ok {
+				merged := maps.Clone(client)
+				maps.Copy(merged, override)
+				v = merged
+			}
+		}
+		body[k] = v
+	}
+	if _, ok := body["usage"]; !ok {
+		body["usage"] = map[string]any{"include": true}
+	}
+	return json.Marshal(body)
+}
+
+// openRouterAttribution adds the HTTP-Referer and X-Title headers OpenRouter
+// credits an app's traffic to, from openrouter_referer and openrouter_title,
+// to the client headers forwarded.
+func openRouterAttribution(clientHeaders map[string]string, getSetting func(string) string) map[string]string {
+	referer, title := getSetting("openrouter_referer"), getSetting("openrouter_title")
+	if referer == "" && title == "" {
+		return clientHeaders
+	}
+	out := maps.Clone(clientHeaders)
+	if out == nil {
+		out = make(map[string]string)
+	}
+	if referer != "" {
+		out["Http-Referer"] = referer
+	}
+	if title != "" {
+		out["X-Title"] = title
+	}
+	return out
+}
+
+func checkFields(obj map[string]any, fields map[string]func(any) error) error {
+	for k, v := range obj {
+		check, ok := fields[k]
+		if !ok {
+			return fmt.Errorf("unknown field %q", k)
+		}
+		if err := check(v); err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+	}
+	return nil
+}
+
+func checkOpenRouterProvider(v any) error {
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return fmt.Errorf("must be an object")
+	}
+	return checkFields(obj, openRouterProviderFields)
+}
+
+func checkStrings(v any) error {
+	list, ok := v.([]any)
+	if !ok {
+		return fmt.Errorf("must be an array of strings")
+	}
+	for _, item := range list {
+		if _, ok := item.(string); !ok {
+			return fmt.Errorf("must be an array of strings")
+		}
+	}
+	return nil
+}
+
+func checkBool(v any) error {
+	if _, ok := v.(bool); !ok {
+		return fmt.Errorf("must be true or false")
+	}
+	return nil
+}
+
+func checkOneOf(allowed ...string) func(any) error {
+	return func(v any) error {
+		if s, ok := v.(string); !ok || !slices.Contains(allowed, s) {
+			return fmt.Errorf("must be one of %q", allowed)
+		}
+		return nil
+	}
+}
+
+func checkStringsOneOf(allowed ...string) func(any) error {
+	one := checkOneOf(allowed...)
+	return func(v any) error {
+		if err := checkStrings(v); err != nil {
+			return err
+		}
+		for _, item := range v.([]any) {
+			if err := one(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func checkPrices(v any) error {
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return fmt.Errorf("must be an object")
+	}
+	for k, price := range obj {
+		if _, ok := price.(float64); !ok {
+			return fmt.Errorf("%s must be a number", k)
+		}
+	}
+	return nil
+}
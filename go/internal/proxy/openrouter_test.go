@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/dbtest"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseOpenRouterPrefs(t *testing.T) {
+	for raw, wantErr := range map[string]string{
+		``: "",
+		`{"provider":{"order":["anthropic","google-vertex"],"allow_fallbacks":false,"quantizations":["fp8"],"max_price":{"prompt":1}},"models":["openai/gpt-4.1"],"route":"fallback"}`: "",
+		`{"provider":{"order":"anthropic"}}`:        "provider: order: must be an array of strings",
+		`{"provider":{"quantizations":["fp3"]}}`:    `provider: quantizations: must be one of`,
+		`{"provider":{"sort":"cheapest"}}`:          `provider: sort: must be one of`,
+		`{"temperature":0}`:                         `unknown field "temperature"`,
+		`["anthropic"]`:                             "not a JSON object",
+		`{"provider":{"allow_fallbacks":"no"}}`:     "provider: allow_fallbacks: must be true or false",
+		`{"provider":{"max_price":{"prompt":"1"}}}`: "provider: max_price: prompt must be a number",
+	} {
+		_, err := parseOpenRouterPrefs(raw)
+		if (err == nil) != (wantErr == "") || (err != nil && !strings.Contains(err.Error(), wantErr)) {
+			t.Errorf("parseOpenRouterPrefs(%s) = %v, want %q", raw, err, wantErr)
+		}
+	}
+}
+
+func TestIsOpenRouter(t *testing.T) {
+	for _, tc := range []struct {
+		account db.Account
+		want    bool
+	}{
+		{db.Account{Provider: "openrouter"}, true},
+		{db.Account{Provider: "custom", BaseURL: "https://openrouter.ai/api"}, true},
+		{db.Account{Provider: "custom", BaseURL: "https://notopenrouter.ai/api"}, false},
+		{db.Account{Provider: "openai"}, false},
+	} {
+		if got := tc.account.IsOpenRouter(); got != tc.want {
+			t.Errorf("%s %q: IsOpenRouter = %v", tc.account.Provider, tc.account.BaseURL, got)
+		}
+	}
+}
+
+func TestOpenRouterPrefs_MergedWithAttributionAndCost(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("openrouter_referer", "https://codegate.example")
+	tdb.SetSetting("openrouter_title", "CodeGate")
+
+	var sent map[string]any
+	var referer, title string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&sent)
+		referer, title = r.Header.Get("HTTP-Referer"), r.Header.Get("X-Title")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"gen-1","object":"chat.completion","model":"anthropic/claude-sonnet-4","choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}],
+			"usage":{"prompt_tokens":1000,"completion_tokens":500,"total_tokens":1500,"cost":0.0421}}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-openrouter", "router", "openrouter", upstream.URL)
+	tdb.Exec(`UPDATE accounts SET openrouter_prefs = ? WHERE id = 'acct-openrouter'`,
+		`{"provider":{"order":["anthropic","google-vertex"],"allow_fallbacks":false},"models":["openai/gpt-4.1"]}`)
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(
+		`{"model":"anthropic/claude-sonnet-4","messages":[{"role":"user","content":"hi"}],"provider":{"sort":"price","allow_fallbacks":true}}`)))
+	if w.Code != 200 {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	wantProvider := map[string]any{"order": []any{"anthropic", "google-vertex"}, "allow_fallbacks": false, "sort": "price"}
+	if !reflect.DeepEqual(sent["provider"], wantProvider) {
+		t.Errorf("provider = %v, want %v", sent["provider"], wantProvider)
+	}
+	if !reflect.DeepEqual(sent["models"], []any{"openai/gpt-4.1"}) || !reflect.DeepEqual(sent["usage"], map[string]any{"include": true}) {
+		t.Errorf("models = %v, usage = %v", sent["models"], sent["usage"])
+	}
+	if referer != "https://codegate.example" || title != "CodeGate" {
+		t.Errorf("HTTP-Referer = %q, X-Title = %q", referer, title)
+	}
+
+	// OpenRouter's billed cost replaces the token estimate
+	if got := w.Header().Get(requestCostHeader); got != "0.042100" {
+		t.Errorf("%s = %q", requestCostHeader, got)
+	}
+	var cost float64
+	waitFor(t, func() bool {
+		return tdb.QueryRow("SELECT cost_usd FROM usage").Scan(&cost) == nil
+	})
+	if math.Abs(cost-0.0421) > 1e-9 {
+		t.Errorf("cost_usd = %v, want 0.0421", cost)
+	}
+}
+
+func TestOpenRouterPrefs_OtherProvidersUntouched(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("openrouter_title", "CodeGate")
+	var sent map[string]any
+	var title string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&sent)
+		title = r.Header.Get("X-Title")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"c1","object":"chat.completion","model":"gpt-4.1","choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}],"usage":{"prompt_tokens":1,"completion_tokens":1}}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-plain-openai", "plain", "openai", upstream.URL)
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(
+		`{"model":"gpt-4.1","messages":[{"role":"user","content":"hi"}]}`)))
+	if w.Code != 200 || sent["usage"] != nil || title != "" {
+		t.Errorf("status %d, usage %v, X-Title %q", w.Code, sent["usage"], title)
+	}
+}
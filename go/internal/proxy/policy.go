@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"bytes"
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/metrics"
+	"codegate-proxy/internal/tenant"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultPolicyTimeout bounds a policy webhook call when
+// policy_webhook_timeout_ms isn't set. Every request waits for it.
+const defaultPolicyTimeout = 2 * time.Second
+
+// Decisions a policy webhook can return. policyUnavailable is the proxy's
+// own: the webhook failed and policy_webhook_fail_closed is on.
+const (
+	policyAllow       = "allow"
+	policyDeny        = "deny"
+	policyModify      = "modify"
+	policyUnavailable = "unavailable"
+)
+
+var policyClient = &http.Client{}
+
+// policyWebhook is the external policy service every request is checked
+// against before it is forwarded.
+type policyWebhook struct {
+	url        string
+	secret     string
+	timeout    time.Duration
+	failClosed bool
+}
+
+// policyWebhookFor returns the webhook configured by policy_webhook_url and
+// its companion settings, which are global so tenants can't point their
+// traffic elsewhere. Tenants whose own policy_webhook_skip setting is true
+// aren't checked.
+func policyWebhookFor(t *tenant.Tenant) (policyWebhook, bool) {
+	url := db.GetSetting("policy_webhook_url")
+	if url == "" || (t != nil && t.Settings["policy_webhook_skip"] == "true") {
+		return policyWebhook{}, false
+	}
+	p := policyWebhook{
+		url:        url,
+		secret:     db.GetSetting("policy_webhook_secret"),
+		timeout:    defaultPolicyTimeout,
+		failClosed: db.GetSetting("policy_webhook_fail_closed") == "true",
+	}
+	if ms, err := strconv.Atoi(db.GetSetting("policy_webhook_timeout_ms")); err == nil && ms > 0 {
+		p.timeout = time.Duration(ms) * time.Millisecond
+	}
+	return p, true
+}
+
+// policyRequest is the metadata sent for a decision. The prompt itself is
+// never sent.
+type policyRequest struct {
+	RequestID            string           `json:"request_id"`
+	TenantID             string           `json:"tenant_id,omitempty"`
+	InboundFormat        string           `json:"inbound_format"`
+	Model                string           `json:"model"`
+	TargetModel          string           `json:"target_model"`
+	EstimatedInputTokens int              `json:"estimated_input_tokens"`
+	MaxTokens            int              `json:"max_tokens,omitempty"`
+	Guardrails           policyGuardrails `json:"guardrails"`
+	Tools                []string         `json:"tools"`
+	// EndUser and Tags are the request's chargeback dimensions
+	EndUser string            `json:"end_user,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+// policyGuardrails summarizes what guardrails found in the request: how many
+// values each guardrail replaced.
+type policyGuardrails struct {
+	Enabled    bool           `json:"enabled"`
+	Detections map[string]int `json:"detections"`
+}
+
+// policyDecision is the webhook's answer. modify caps max_tokens at
+// MaxTokens; deny's Message is shown to the client.
+type policyDecision struct {
+	Decision  string `json:"decision"`
+	Message   string `json:"message,omitempty"`
+	MaxTokens int    `json:"max_tokens,omitempty"`
+}
+
+// decide asks the webhook about pr. A webhook that times out, fails, or
+// answers with something other than a decision allows the request, or with
+// policy_webhook_fail_closed makes it unavailable. Decisions are counted in
+// codegate_policy_decisions_total and call durations in the
+// codegate_policy_webhook_seconds histogram.
+func (p policyWebhook) decide(ctx context.Context, pr policyRequest) policyDecision {
+	start := time.Now()
+	d, err := p.call(ctx, pr)
+	metrics.Observe("codegate_policy_webhook_seconds", time.Since(start).Seconds())
+	if err != nil {
+		d = policyDecision{Decision: policyAllow}
+		if p.failClosed {
+			d.Decision = policyUnavailable
+		}
+		requestLogf(pr.RequestID)("[policy] Webhook failed, treating it as %s: %v", d.Decision, err)
+	}
+	metrics.Inc("codegate_policy_decisions_total", "decision", d.Decision)
+	return d
+}
+
+// call posts pr to the webhook, signed like SLO alerts when a secret is set,
+// and parses its decision.
+func (p policyWebhook) call(ctx context.Context, pr policyRequest) (policyDecision, error) {
+	var d policyDecision
+	body, err := json.Marshal(pr)
+	if err != nil {
+		return d, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return d, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.secret != "" {
+		mac := hmac.New(sha256.New, []byte(p.secret))
+		mac.Write(body)
+		req.Header.Set(sloSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := policyClient.Do(req)
+	if err != nil {
+		return d, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return d, fmt.Errorf("webhook returned HTTP %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&d); err != nil {
+		return d, fmt.Errorf("parse decision: %w", err)
+	}
+	switch {
+	case d.Decision == policyAllow, d.Decision == policyDeny:
+	case d.Decision == policyModify && d.MaxTokens > 0:
+	default:
+		return d, fmt.Errorf("invalid decision %q (max_tokens %d)", d.Decision, d.MaxTokens)
+	}
+	return d, nil
+}
+
+// policyRequest builds the decision request for the body as it will be
+// forwarded: after guardrails, with the route's primary target model.
+func (b *requestBody) policyRequest(id, tenantID, inboundFormat, model, targetModel string, guardrailsActive bool) policyRequest {
+	pr := policyRequest{
+		RequestID:     id,
+		TenantID:      tenantID,
+		InboundFormat: inboundFormat,
+		Model:         model,
+		TargetModel:   targetModel,
+		Guardrails:    policyGuardrails{Enabled: guardrailsActive, Detections: b.detections},
+		Tools:         []string{},
+	}
+	// Roughly four bytes of JSON per token
+	if b.spool != nil {
+		pr.EstimatedInputTokens = int(b.spool.size / 4)
+		mt, _ := b.spool.numberField("max_tokens")
+		pr.MaxTokens = int(mt)
+	} else {
+		pr.EstimatedInputTokens = len(b.raw) / 4
+		mt, _ := b.anthropic["max_tokens"].(float64)
+		pr.MaxTokens = int(mt)
+	}
+	if pr.Guardrails.Detections == nil {
+		pr.Guardrails.Detections = map[string]int{}
+	}
+	tools, _ := b.anthropic["tools"].([]any)
+	for _, tool := range tools {
+		if name, _ := tool.(map[string]any)["name"].(string); name != "" {
+			pr.Tools = append(pr.Tools, name)
+		}
+	}
+	return pr
+}
+
+// capMaxTokens lowers max_tokens to n for every candidate, as a policy
+// webhook's modify decision asks. It returns a note for the conversion
+// warnings header, or "" if the request already asked for n or fewer.
+func (b *requestBody) capMaxTokens(inboundFormat string, n int) string {
+	key := "max_tokens"
+	var cur float64
+	if b.spool != nil {
+		if v, ok := b.spool.numberField("max_completion_tokens"); ok {
+			key, cur = "max_completion_tokens", v
+		} else {
+			cur, _ = b.spool.numberField("max_tokens")
+		}
+		if cur > 0 && int(cur) <= n {
+			return ""
+		}
+		b.spool.setField(key, n)
+	} else {
+		anthropicMax, _ := b.anthropic["max_tokens"].(float64)
+		cur = anthropicMax
+		// OpenAI-compatible targets are sent the client's own body
+		openai := inboundFormat == "openai" && b.parsed != nil
+		if openai {
+			if v, ok := b.parsed["max_completion_tokens"].(float64); ok || b.parsed["max_tokens"] == nil {
+				key, cur = "max_completion_tokens", v
+			} else {
+				cur, _ = b.parsed["max_tokens"].(float64)
+			}
+		}
+		if cur > 0 && int(cur) <= n {
+			return ""
+		}
+		if openai {
+			b.parsed[key] = float64(n)
+			b.raw, _ = json.Marshal(b.parsed)
+		}
+		if b.anthropic != nil && (anthropicMax == 0 || int(anthropicMax) > n) {
+			b.anthropic["max_tokens"] = float64(n)
+			b.anthropicModified = true
+		}
+	}
+	if b.extendedMaxTokens > n {
+		b.extendedMaxTokens = n
+	}
+	return fmt.Sprintf("max_tokens capped at %d by policy", n)
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/metrics"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPolicyWebhook(t *testing.T) {
+	tdb := dbtest.Open(t)
+
+	// A timed-out policy call is still running when the next case starts
+	var mu sync.Mutex
+	var forwarded map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		forwarded = nil
+		json.NewDecoder(r.Body).Decode(&forwarded)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-policy", "policy", "anthropic", upstream.URL)
+
+	var answer string
+	var delay time.Duration
+	var asked policyRequest
+	var signed bool
+	policy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("policy-secret"))
+		mac.Write(body)
+		mu.Lock()
+		signed = r.Header.Get(sloSignatureHeader) == "sha256="+hex.EncodeToString(mac.Sum(nil))
+		json.Unmarshal(body, &asked)
+		wait, reply := delay, answer
+		mu.Unlock()
+		time.Sleep(wait)
+		fmt.Fprint(w, reply)
+	}))
+	defer policy.Close()
+	tdb.SetSetting("policy_webhook_url", policy.URL)
+	tdb.SetSetting("policy_webhook_secret", "policy-secret")
+	tdb.SetSetting("policy_webhook_timeout_ms", "100")
+
+	const request = `{"model":"claude-sonnet-4-20250514","max_tokens":1000,"messages":[{"role":"user","content":"hi"}],` +
+		`"tools":[{"name":"lookup","input_schema":{"type":"object"}}]}`
+	cases := []struct {
+		name, answer string
+		delay        time.Duration
+		failClosed   bool
+		status       int
+		maxTokens    float64
+		decision     string
+	}{
+		{"allow", `{"decision":"allow"}`, 0, false, 200, 1000, policyAllow},
+		{"deny", `{"decision":"deny","message":"model not approved for tenant"}`, 0, false, 403, 0, policyDeny},
+		{"modify", `{"decision":"modify","max_tokens":200}`, 0, false, 200, 200, policyModify},
+		{"timeout open", `{"decision":"deny"}`, 300 * time.Millisecond, false, 200, 1000, policyAllow},
+		{"timeout closed", `{"decision":"allow"}`, 300 * time.Millisecond, true, 503, 0, policyUnavailable},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.Reset()
+			mu.Lock()
+			answer, delay, forwarded = tc.answer, tc.delay, nil
+			mu.Unlock()
+			tdb.SetSetting("policy_webhook_fail_closed", fmt.Sprint(tc.failClosed))
+
+			w := sendMessages(t, request, nil)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !signed || asked.Model != "claude-sonnet-4-20250514" || asked.MaxTokens != 1000 ||
+				len(asked.Tools) != 1 || asked.Tools[0] != "lookup" || asked.EstimatedInputTokens == 0 {
+				t.Errorf("signed = %v, policy asked %+v", signed, asked)
+			}
+			if tc.status == 200 && forwarded["max_tokens"] != tc.maxTokens {
+				t.Errorf("forwarded max_tokens = %v, want %v", forwarded["max_tokens"], tc.maxTokens)
+			}
+			if tc.status != 200 && forwarded != nil {
+				t.Error("request was forwarded")
+			}
+			if tc.decision == policyDeny && !strings.Contains(w.Body.String(), "model not approved for tenant") {
+				t.Errorf("denial doesn't cite the policy: %s", w.Body.String())
+			}
+			if n := metrics.Counter("codegate_policy_decisions_total", "decision", tc.decision); n != 1 {
+				t.Errorf("decisions{%s} = %d, want 1", tc.decision, n)
+			}
+			if n, _ := metrics.Histogram("codegate_policy_webhook_seconds"); n != 1 {
+				t.Errorf("webhook durations observed = %d, want 1", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/cooldown"
+	"codegate-proxy/internal/ratelimit"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// rateLimitHeaders name a bucket's limit per minute, the requests it has
+// left, and the seconds until its oldest request leaves the window and
+// frees a slot.
+type rateLimitHeaders struct {
+	limit, remaining, reset string
+}
+
+// Rate limit headers: the account that served the request, and the tenant.
+var (
+	accountRateLimitHeaders = rateLimitHeaders{
+		limit:     exposeHeader("X-Proxy-RateLimit-Limit"),
+		remaining: exposeHeader("X-Proxy-RateLimit-Remaining"),
+		reset:     exposeHeader("X-Proxy-RateLimit-Reset"),
+	}
+	tenantRateLimitHeaders = rateLimitHeaders{
+		limit:     exposeHeader("X-Proxy-Tenant-RateLimit-Limit"),
+		remaining: exposeHeader("X-Proxy-Tenant-RateLimit-Remaining"),
+		reset:     exposeHeader("X-Proxy-Tenant-RateLimit-Reset"),
+	}
+)
+
+// retryAfterHeader tells a client rejected with a 429 when to retry.
+var retryAfterHeader = exposeHeader("Retry-After")
+
+// set reports a bucket's window, or removes the headers for an unlimited
+// one, so an account failed over from doesn't leave its numbers behind.
+func (names rateLimitHeaders) set(h http.Header, key string, limit int) {
+	remaining, reset := ratelimit.Remaining(key, limit)
+	if remaining < 0 {
+		h.Del(names.limit)
+		h.Del(names.remaining)
+		h.Del(names.reset)
+		return
+	}
+	h.Set(names.limit, strconv.Itoa(limit))
+	h.Set(names.remaining, strconv.Itoa(remaining))
+	h.Set(names.reset, strconv.Itoa(ceilSeconds(reset)))
+}
+
+// tenantRetryAfter is how long a tenant rejected by its rate limit waits
+// for a slot its class may use. Background requests may also be waiting on
+// their own cap.
+func tenantRetryAfter(key string, class ratelimit.Class, l ratelimit.ClassLimits) int {
+	_, wait := ratelimit.Remaining(key, l.Total)
+	if class == ratelimit.Background {
+		if left, bgWait := ratelimit.Remaining(key+":"+string(ratelimit.Background), l.Background); left == 0 {
+			wait = max(wait, bgWait)
+		}
+	}
+	return max(ceilSeconds(wait), 1)
+}
+
+// setUpstreamRetryAfter passes a 429's Retry-After on to the client, or
+// when the upstream sent none, the cooldown it put the account on.
+func setUpstreamRetryAfter(h http.Header, upstream map[string]string, accountID string) {
+	if v := upstream["retry-after"]; v != "" {
+		h.Set(retryAfterHeader, v)
+	} else if sec := cooldown.RemainingSeconds(accountID); sec > 0 {
+		h.Set(retryAfterHeader, strconv.Itoa(sec))
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
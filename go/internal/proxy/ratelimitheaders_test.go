@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/cooldown"
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/ratelimit"
+	"codegate-proxy/internal/tenant"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// rateLimitedAccount adds account acct-rl, limited to limit requests a
+// minute, in front of an upstream that answers with status and headers.
+func rateLimitedAccount(t *testing.T, tdb *dbtest.DB, limit, status int, headers map[string]string) {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range headers {
+			w.Header().Set(k, v)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if status == 429 {
+			fmt.Fprint(w, `{"type":"error","error":{"type":"rate_limit_error","message":"slow down"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	t.Cleanup(upstream.Close)
+	tdb.AddAccount("acct-rl", "limited", "anthropic", upstream.URL)
+	tdb.Exec("UPDATE accounts SET rate_limit = ? WHERE id = 'acct-rl'", limit)
+	reset := func() {
+		ratelimit.Clear("acct-rl")
+		cooldown.Clear("acct-rl")
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestRateLimitHeaders_CountDown(t *testing.T) {
+	tdb := dbtest.Open(t)
+	rateLimitedAccount(t, tdb, 3, 200, nil)
+
+	for want := 2; want >= 0; want-- {
+		w := sendMessages(t, plainMessage, nil)
+		h := w.Header()
+		if w.Code != 200 || h.Get("X-Proxy-RateLimit-Limit") != "3" || h.Get("X-Proxy-RateLimit-Remaining") != strconv.Itoa(want) {
+			t.Fatalf("status %d, limit %q, remaining %q, want %d", w.Code,
+				h.Get("X-Proxy-RateLimit-Limit"), h.Get("X-Proxy-RateLimit-Remaining"), want)
+		}
+		if reset, _ := strconv.Atoi(h.Get("X-Proxy-RateLimit-Reset")); reset < 59 || reset > 60 {
+			t.Errorf("reset = %q, want the minute to pass", h.Get("X-Proxy-RateLimit-Reset"))
+		}
+		if h.Get("Retry-After") != "" {
+			t.Errorf("Retry-After %q on a 200", h.Get("Retry-After"))
+		}
+	}
+
+	w := sendMessages(t, plainMessage, nil)
+	if w.Code != 429 || w.Header().Get("X-Proxy-RateLimit-Remaining") != "0" {
+		t.Fatalf("status %d, remaining %q", w.Code, w.Header().Get("X-Proxy-RateLimit-Remaining"))
+	}
+	if retry, _ := strconv.Atoi(w.Header().Get("Retry-After")); retry < 59 || retry > 60 {
+		t.Errorf("Retry-After = %q, want the minute to pass", w.Header().Get("Retry-After"))
+	}
+}
+
+func TestRateLimitHeaders_Unlimited(t *testing.T) {
+	tdb := dbtest.Open(t)
+	rateLimitedAccount(t, tdb, 0, 200, nil)
+
+	w := sendMessages(t, plainMessage, nil)
+	for _, name := range []string{"X-Proxy-RateLimit-Limit", "X-Proxy-RateLimit-Remaining", "X-Proxy-RateLimit-Reset", "X-Proxy-Tenant-RateLimit-Limit"} {
+		if v := w.Header().Get(name); v != "" {
+			t.Errorf("%s = %q for an unlimited account", name, v)
+		}
+	}
+}
+
+func TestRateLimitHeaders_Tenant(t *testing.T) {
+	tdb := dbtest.Open(t)
+	rateLimitedAccount(t, tdb, 0, 200, nil)
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+	sum := sha256.Sum256([]byte("cgk_rl_key"))
+	tdb.Exec("INSERT INTO tenants (id, name, api_key_hash, api_key_prefix, rate_limit) VALUES ('t-rl', 'rl', ?, 'cgk_rl_k', 2)", hex.EncodeToString(sum[:]))
+	ratelimit.Clear("tenant:t-rl")
+	t.Cleanup(func() { ratelimit.Clear("tenant:t-rl") })
+
+	key := http.Header{"X-Api-Key": {"cgk_rl_key"}}
+	for want := 1; want >= 0; want-- {
+		w := sendMessages(t, plainMessage, key)
+		if w.Code != 200 || w.Header().Get("X-Proxy-Tenant-RateLimit-Limit") != "2" ||
+			w.Header().Get("X-Proxy-Tenant-RateLimit-Remaining") != strconv.Itoa(want) {
+			t.Fatalf("status %d, headers %v, want %d remaining", w.Code, w.Header(), want)
+		}
+	}
+
+	w := sendMessages(t, plainMessage, key)
+	if w.Code != 429 || w.Header().Get("X-Proxy-Tenant-RateLimit-Remaining") != "0" {
+		t.Fatalf("status %d, headers %v", w.Code, w.Header())
+	}
+	if retry, _ := strconv.Atoi(w.Header().Get("Retry-After")); retry < 59 || retry > 60 {
+		t.Errorf("Retry-After = %q, want the minute to pass", w.Header().Get("Retry-After"))
+	}
+}
+
+func TestRateLimitHeaders_UpstreamRetryAfter(t *testing.T) {
+	t.Run("relayed", func(t *testing.T) {
+		tdb := dbtest.Open(t)
+		rateLimitedAccount(t, tdb, 0, 429, map[string]string{"Retry-After": "7"})
+		w := sendMessages(t, plainMessage, nil)
+		if w.Code != 429 || w.Header().Get("Retry-After") != "7" {
+			t.Errorf("status %d, Retry-After %q, want 7", w.Code, w.Header().Get("Retry-After"))
+		}
+	})
+	t.Run("from cooldown", func(t *testing.T) {
+		tdb := dbtest.Open(t)
+		rateLimitedAccount(t, tdb, 0, 429, nil)
+		w := sendMessages(t, plainMessage, nil)
+		if w.Code != 429 || w.Header().Get("Retry-After") != strconv.Itoa(cooldown.RemainingSeconds("acct-rl")) {
+			t.Errorf("status %d, Retry-After %q, want the cooldown's %ds", w.Code, w.Header().Get("Retry-After"), cooldown.RemainingSeconds("acct-rl"))
+		}
+	})
+}
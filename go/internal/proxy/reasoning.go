@@ -0,0 +1,307 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// reasoningMarker stands in for stripped reasoning when
+// strip_reasoning_from_responses is "marker".
+const reasoningMarker = "[reasoning hidden]"
+
+// reasoningFields are the OpenAI-format fields reasoning comes back in:
+// DeepSeek's reasoning_content, and OpenRouter's reasoning and
+// reasoning_details.
+var reasoningFields = []string{"reasoning_content", "reasoning", "reasoning_details"}
+
+// reasoningStripping reads strip_reasoning_from_responses: "true" removes
+// the model's reasoning from responses, "marker" also leaves
+// reasoningMarker once in its place.
+func reasoningStripping(getSetting func(string) string) (strip, marker bool) {
+	switch strings.TrimSpace(getSetting("strip_reasoning_from_responses")) {
+	case "true":
+		return true, false
+	case "marker":
+		return true, true
+	}
+	return false, false
+}
+
+// isReasoningBlock reports whether an Anthropic content block type holds
+// reasoning.
+func isReasoningBlock(blockType any) bool {
+	return blockType == "thinking" || blockType == "redacted_thinking"
+}
+
+// stripReasoning removes reasoning from a response body in the client's
+// format: Anthropic thinking and redacted_thinking blocks, or the reasoning
+// fields of each OpenAI choice's message. With marker, the first is
+// replaced by a text block (Anthropic) or reasoning_content (OpenAI) saying
+// reasoningMarker. A body with no reasoning is returned unchanged.
+func stripReasoning(body []byte, format string, marker bool) []byte {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var resp map[string]any
+	if dec.Decode(&resp) != nil {
+		return body
+	}
+
+	stripped := false
+	if format == "openai" {
+		choices, _ := resp["choices"].([]any)
+		for _, c := range choices {
+			choice, _ := c.(map[string]any)
+			message, _ := choice["message"].(map[string]any)
+			if stripReasoningFields(message, marker && !stripped) {
+				stripped = true
+			}
+		}
+	} else {
+		content, _ := resp["content"].([]any)
+		kept := make([]any, 0, len(content))
+		for _, b := range content {
+			block, _ := b.(map[string]any)
+			if !isReasoningBlock(block["type"]) {
+				kept = append(kept, b)
+				continue
+			}
+			if marker && !stripped {
+				kept = append(kept, map[string]any{"type": "text", "text": reasoningMarker})
+			}
+			stripped = true
+		}
+		resp["content"] = kept
+	}
+	if !stripped {
+		return body
+	}
+	out, err := json.Marshal(resp)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// stripReasoningFields deletes the reasoning fields from an OpenAI message
+// or delta, setting reasoning_content to reasoningMarker instead when marker
+// is true, and reports whether there was any reasoning.
+func stripReasoningFields(m map[string]any, marker bool) bool {
+	found := false
+	for _, f := range reasoningFields {
+		v, ok := m[f]
+		if !ok {
+			continue
+		}
+		delete(m, f)
+		if v != nil && v != "" {
+			found = true
+		}
+	}
+	if found && marker {
+		m["reasoning_content"] = reasoningMarker
+	}
+	return found
+}
+
+// reasoningFilterStream removes reasoning from a stream in the client's
+// format. In an Anthropic stream, thinking and redacted_thinking blocks are
+// dropped, start to stop, and the blocks after them renumbered; with marker,
+// the first becomes a text block saying reasoningMarker. In an OpenAI
+// stream, reasoning fields are removed from each chunk's deltas and chunks
+// left with nothing else are dropped; with marker, the first is replaced by
+// reasoning_content saying reasoningMarker. Usage has already been read
+// from the provider's stream, so token counts are unaffected.
+type reasoningFilterStream struct {
+	src     io.ReadCloser
+	br      *bufio.Reader
+	openai  bool
+	marker  bool
+	event   []byte // lines of the event being read
+	pending []byte
+	err     error
+
+	markerSent bool
+	dropped    int                 // Anthropic blocks dropped so far
+	blocks     map[int]streamBlock // open Anthropic blocks by upstream index
+}
+
+// streamBlock is how an open Anthropic block is passed on.
+type streamBlock struct {
+	index  int  // the client's index for it
+	drop   bool // reasoning, dropped
+	marker bool // reasoning, replaced by the marker
+}
+
+func newReasoningFilterStream(src io.ReadCloser, format string, marker bool) *reasoningFilterStream {
+	return &reasoningFilterStream{src: src, br: bufio.NewReader(src), openai: format == "openai", marker: marker,
+		blocks: make(map[int]streamBlock)}
+}
+
+func (s *reasoningFilterStream) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		line, err := s.br.ReadBytes('\n')
+		s.err = err
+		s.event = append(s.event, line...)
+		if err != nil || len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// A blank line ends the event; what is left at the end of the
+			// stream is passed on as it is
+			event := s.event
+			s.event = nil
+			if err == nil {
+				event = s.filter(event)
+			}
+			s.pending = event
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *reasoningFilterStream) Close() error {
+	return s.src.Close()
+}
+
+// filter returns event without its reasoning, or nil to drop it.
+func (s *reasoningFilterStream) filter(event []byte) []byte {
+	var eventLine string
+	var data []byte
+	for _, line := range bytes.SplitAfter(event, []byte("\n")) {
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if name, ok := bytes.CutPrefix(trimmed, []byte("event:")); ok {
+			eventLine = "event: " + string(bytes.TrimSpace(name)) + "\n"
+		} else if d, ok := bytes.CutPrefix(trimmed, []byte("data:")); ok {
+			data = bytes.TrimSpace(d)
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var payload map[string]any
+	if data == nil || dec.Decode(&payload) != nil {
+		return event
+	}
+
+	var out []map[string]any
+	var changed bool
+	if s.openai {
+		out, changed = s.filterOpenAI(payload)
+	} else {
+		out, changed = s.filterAnthropic(payload)
+	}
+	if !changed {
+		return event
+	}
+	var b bytes.Buffer
+	for _, p := range out {
+		if t, ok := p["type"].(string); ok && !s.openai {
+			eventLine = "event: " + t + "\n"
+		}
+		v, err := json.Marshal(p)
+		if err != nil {
+			return event
+		}
+		b.WriteString(eventLine + "data: " + string(v) + "\n\n")
+	}
+	return b.Bytes()
+}
+
+// filterOpenAI strips one chunk, returning the events to send in its place
+// and whether they differ from it.
+func (s *reasoningFilterStream) filterOpenAI(chunk map[string]any) ([]map[string]any, bool) {
+	choices, _ := chunk["choices"].([]any)
+	stripped, empty := false, true
+	for _, c := range choices {
+		choice, _ := c.(map[string]any)
+		delta, _ := choice["delta"].(map[string]any)
+		if stripReasoningFields(delta, s.marker && !s.markerSent) {
+			stripped = true
+			s.markerSent = s.markerSent || s.marker
+		}
+		if len(delta) > 0 || choice["finish_reason"] != nil {
+			empty = false
+		}
+	}
+	switch {
+	case !stripped:
+		return nil, false
+	case empty && chunk["usage"] == nil:
+		return nil, true
+	}
+	return []map[string]any{chunk}, true
+}
+
+// filterAnthropic strips one event, returning the events to send in its
+// place and whether they differ from it.
+func (s *reasoningFilterStream) filterAnthropic(event map[string]any) ([]map[string]any, bool) {
+	index, ok := jsonInt(event["index"])
+	if !ok {
+		return nil, false
+	}
+	switch event["type"] {
+	case "content_block_start":
+		block, _ := event["content_block"].(map[string]any)
+		b := streamBlock{index: index - s.dropped}
+		switch {
+		case !isReasoningBlock(block["type"]):
+		case s.marker && !s.markerSent:
+			s.markerSent = true
+			b.marker = true
+		default:
+			b.drop = true
+			s.dropped++
+		}
+		s.blocks[index] = b
+		switch {
+		case b.drop:
+			return nil, true
+		case b.marker:
+			return []map[string]any{
+				{"type": "content_block_start", "index": b.index, "content_block": map[string]any{"type": "text", "text": ""}},
+				{"type": "content_block_delta", "index": b.index, "delta": map[string]any{"type": "text_delta", "text": reasoningMarker}},
+			}, true
+		}
+		return renumbered(event, index, b.index)
+	case "content_block_delta", "content_block_stop":
+		b, open := s.blocks[index]
+		if !open {
+			// A block that never started: it may still need renumbering
+			return renumbered(event, index, index-s.dropped)
+		}
+		if event["type"] == "content_block_stop" {
+			delete(s.blocks, index)
+		} else if b.marker {
+			// The reasoning the marker stands in for
+			return nil, true
+		}
+		if b.drop {
+			return nil, true
+		}
+		return renumbered(event, index, b.index)
+	}
+	return nil, false
+}
+
+// renumbered returns event with its index moved from from to to.
+func renumbered(event map[string]any, from, to int) ([]map[string]any, bool) {
+	if from == to {
+		return nil, false
+	}
+	event["index"] = to
+	return []map[string]any{event}, true
+}
+
+// jsonInt returns a number decoded with UseNumber as an int.
+func jsonInt(v any) (int, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	i, err := n.Int64()
+	return int(i), err == nil
+}
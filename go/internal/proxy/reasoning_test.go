@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStripReasoning(t *testing.T) {
+	const anthropic = `{"id":"msg_1","content":[{"type":"thinking","thinking":"secret plan","signature":"sig"},` +
+		`{"type":"redacted_thinking","data":"abc"},{"type":"text","text":"Answer"}],"usage":{"input_tokens":3,"output_tokens":40}}`
+	const openai = `{"choices":[{"index":0,"message":{"role":"assistant","content":"Answer","reasoning_content":"secret plan"}}],"usage":{"completion_tokens":40}}`
+
+	cases := []struct {
+		name, body, format string
+		marker             bool
+		want               string
+	}{
+		{"anthropic", anthropic, "anthropic", false, `"content":[{"text":"Answer","type":"text"}]`},
+		{"anthropic marker", anthropic, "anthropic", true, `"content":[{"text":"[reasoning hidden]","type":"text"},{"text":"Answer","type":"text"}]`},
+		{"openai", openai, "openai", false, `"message":{"content":"Answer","role":"assistant"}`},
+		{"openai marker", openai, "openai", true, `"reasoning_content":"[reasoning hidden]"`},
+	}
+	for _, tc := range cases {
+		got := string(stripReasoning([]byte(tc.body), tc.format, tc.marker))
+		if !strings.Contains(got, tc.want) || strings.Contains(got, "secret plan") || strings.Contains(got, "abc") {
+			t.Errorf("%s: stripReasoning = %s, want %s", tc.name, got, tc.want)
+		}
+		if !strings.Contains(got, `"output_tokens":40`) && !strings.Contains(got, `"completion_tokens":40`) {
+			t.Errorf("%s: usage changed: %s", tc.name, got)
+		}
+	}
+
+	// Bodies without reasoning are left byte for byte
+	for _, body := range []string{`{"content":[{"type":"text","text":"a<b"}]}`, `{"choices":[]}`, `not json`} {
+		if got := string(stripReasoning([]byte(body), "anthropic", true)); got != body {
+			t.Errorf("stripReasoning(%s) = %s", body, got)
+		}
+	}
+}
+
+const thinkingStream = "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":3}}}\n\n" +
+	"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"thinking\",\"thinking\":\"\"}}\n\n" +
+	"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"thinking_delta\",\"thinking\":\"secret plan\"}}\n\n" +
+	"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"signature_delta\",\"signature\":\"sig\"}}\n\n" +
+	"event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":0}\n\n" +
+	"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":1,\"content_block\":{\"type\":\"redacted_thinking\",\"data\":\"abc\"}}\n\n" +
+	"event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":1}\n\n" +
+	"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":2,\"content_block\":{\"type\":\"text\",\"text\":\"\"}}\n\n" +
+	"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":2,\"delta\":{\"type\":\"text_delta\",\"text\":\"Answer\"}}\n\n" +
+	"event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":2}\n\n" +
+	"event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"},\"usage\":{\"output_tokens\":40}}\n\n" +
+	"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n"
+
+// streamEvents returns the JSON data payloads of a stream.
+func streamEvents(t *testing.T, stream string) []map[string]any {
+	t.Helper()
+	var events []map[string]any
+	for _, line := range strings.Split(stream, "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var e map[string]any
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			t.Fatalf("invalid data line %q", data)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestReasoningFilterStream_Anthropic(t *testing.T) {
+	for _, marker := range []bool{false, true} {
+		out, err := io.ReadAll(newReasoningFilterStream(io.NopCloser(strings.NewReader(thinkingStream)), "anthropic", marker))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(out), "secret plan") || strings.Contains(string(out), "thinking") || strings.Contains(string(out), "abc") {
+			t.Errorf("marker %v: reasoning left in %s", marker, out)
+		}
+		var starts []string
+		for _, e := range streamEvents(t, string(out)) {
+			if e["type"] == "content_block_start" {
+				block := e["content_block"].(map[string]any)
+				starts = append(starts, fmt.Sprintf("%v:%v", e["index"], block["type"]))
+			}
+		}
+		want, text := "[0:text]", "Answer"
+		if marker {
+			want = "[0:text 1:text]"
+			text = reasoningMarker
+		}
+		if fmt.Sprint(starts) != want || !strings.Contains(string(out), text) || !strings.Contains(string(out), `"output_tokens":40`) {
+			t.Errorf("marker %v: blocks %v in %s", marker, starts, out)
+		}
+		if marker && strings.Count(string(out), reasoningMarker) != 1 {
+			t.Errorf("marker sent %d times", strings.Count(string(out), reasoningMarker))
+		}
+	}
+
+	// A stream without reasoning passes through unchanged
+	plain := "event: content_block_start\r\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"text\",\"text\":\"\"}}\r\n\r\n: ping\n\npartial"
+	if out, _ := io.ReadAll(newReasoningFilterStream(io.NopCloser(strings.NewReader(plain)), "anthropic", true)); string(out) != plain {
+		t.Errorf("plain stream = %q", out)
+	}
+}
+
+const reasoningChunks = "data: {\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"content\":null,\"reasoning_content\":\"\"},\"finish_reason\":null}]}\n\n" +
+	"data: {\"choices\":[{\"index\":0,\"delta\":{\"reasoning_content\":\"secret \"},\"finish_reason\":null}]}\n\n" +
+	"data: {\"choices\":[{\"index\":0,\"delta\":{\"reasoning_content\":\"plan\"},\"finish_reason\":null}]}\n\n" +
+	"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Answer\"},\"finish_reason\":null}]}\n\n" +
+	"data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":40}}\n\n" +
+	"data: [DONE]\n\n"
+
+func TestReasoningFilterStream_OpenAI(t *testing.T) {
+	for _, marker := range []bool{false, true} {
+		out, err := io.ReadAll(newReasoningFilterStream(io.NopCloser(strings.NewReader(reasoningChunks)), "openai", marker))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := string(out)
+		if strings.Contains(s, "secret") || strings.Contains(s, "plan") {
+			t.Errorf("marker %v: reasoning left in %s", marker, s)
+		}
+		want := 4 // the role chunk, the answer, the finish chunk and [DONE]
+		if marker {
+			want = 5
+		}
+		if n := strings.Count(s, "data: "); n != want || strings.Count(s, reasoningMarker) != want-4 {
+			t.Errorf("marker %v: %d chunks in %s", marker, n, s)
+		}
+		if !strings.Contains(s, `"content":"Answer"`) || !strings.Contains(s, `"completion_tokens":40`) || !strings.HasSuffix(s, "data: [DONE]\n\n") {
+			t.Errorf("marker %v: stream = %s", marker, s)
+		}
+	}
+}
+
+// reasoningUpstream is an OpenAI-compatible account whose model reasons, as
+// DeepSeek's reasoner does, streamed or not.
+func reasoningUpstream(t *testing.T, tdb *dbtest.DB) {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(raw), `"stream":true`) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, reasoningChunks)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"model":"deepseek-reasoner","choices":[{"index":0,"message":{"role":"assistant","content":"Answer","reasoning_content":"secret plan"},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":40}}`)
+	}))
+	t.Cleanup(upstream.Close)
+	tdb.AddAccount("acct-reasoner", "reasoner", "openai", upstream.URL)
+	tdb.AddActiveConfig("cfg", "default")
+	tdb.AddTier("cfg", "sonnet", "acct-reasoner", 10, "deepseek-reasoner")
+}
+
+func TestStripReasoningFromResponses(t *testing.T) {
+	const (
+		anthropicReq = `{"model":"claude-sonnet-4-20250514","max_tokens":64,"messages":[{"role":"user","content":"hi"}]`
+		openaiReq    = `{"model":"claude-sonnet-4-20250514","messages":[{"role":"user","content":"hi"}]`
+	)
+	cases := []struct {
+		name, path, body string
+	}{
+		{"anthropic", "/v1/messages", anthropicReq + `}`},
+		{"anthropic stream", "/v1/messages", anthropicReq + `,"stream":true}`},
+		{"openai", "/v1/chat/completions", openaiReq + `}`},
+		{"openai stream", "/v1/chat/completions", openaiReq + `,"stream":true}`},
+	}
+	for _, setting := range []string{"", "true"} {
+		for _, tc := range cases {
+			t.Run(fmt.Sprintf("%s, setting %q", tc.name, setting), func(t *testing.T) {
+				tdb := dbtest.Open(t)
+				tdb.SetSetting("strip_reasoning_from_responses", setting)
+				reasoningUpstream(t, tdb)
+
+				req := httptest.NewRequest("POST", tc.path, strings.NewReader(tc.body))
+				w := httptest.NewRecorder()
+				Handler().ServeHTTP(w, req)
+				if w.Code != 200 || !strings.Contains(w.Body.String(), "Answer") {
+					t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+				}
+				if got := strings.Contains(w.Body.String(), "secret"); got != (setting == "") {
+					t.Errorf("reasoning in response = %v: %s", got, w.Body.String())
+				}
+
+				// Output tokens still count the reasoning
+				var out int
+				waitFor(t, func() bool {
+					return tdb.QueryRow("SELECT output_tokens FROM usage WHERE account_id = 'acct-reasoner'").Scan(&out) == nil
+				})
+				if out != 40 {
+					t.Errorf("output tokens = %d, want 40", out)
+				}
+			})
+		}
+	}
+}
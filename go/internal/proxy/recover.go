@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/metrics"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// withRecover turns a panic in a request handler into a logged stack trace
+// and a 500, instead of net/http dropping the connection. The 500 carries
+// the logged ID in requestIDHeader, so it can be matched to its stack
+// trace. If the response has already started, it is aborted like net/http
+// would. With request_logging on, the request is logged with the panic as
+// its error.
+func withRecover(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &recoverWriter{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			// Proxied requests already have an ID, in their log lines too
+			id := rw.Header().Get(requestIDHeader)
+			if id == "" {
+				id = newRequestID()
+			}
+			requestLogf(id)("[proxy] Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, p, debug.Stack())
+			metrics.Inc("codegate_panics_total")
+			format := requestFormat(r)
+			if db.GetSetting("request_logging") == "true" {
+				status := 500
+				if rw.wroteHeader {
+					status = 0
+				}
+				entry := db.RequestLog{
+					Method: r.Method, Path: r.URL.Path, InboundFormat: format, StatusCode: status,
+					LatencyMs:    int(time.Since(start).Milliseconds()),
+					ErrorMessage: fmt.Sprintf("panic (request %s): %v", id, p), RequestID: id,
+					ClientRequestID: clientRequestID(r),
+				}
+				db.Go(func() { db.InsertRequestLog(entry) })
+			}
+			if rw.wroteHeader {
+				panic(http.ErrAbortHandler)
+			}
+			rw.Header().Set(requestIDHeader, id)
+			writeError(rw, r, format, 500, "api_error", fmt.Sprintf("Internal proxy error (request %s)", id))
+		}()
+		next(rw, r)
+	}
+}
+
+// recoverWriter records whether the response has started.
+type recoverWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *recoverWriter) WriteHeader(code int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recoverWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recoverWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wroteHeader = true
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *recoverWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
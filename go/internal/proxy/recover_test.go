@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithRecover_Panic(t *testing.T) {
+	h := withRecover(func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]any
+		m["boom"] = 1
+	})
+	for path, wantType := range map[string]string{
+		"/v1/messages":         "error",
+		"/v1/chat/completions": "",
+	} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("POST", path, nil))
+		if w.Code != 500 {
+			t.Fatalf("%s: status = %d", path, w.Code)
+		}
+		id := w.Header().Get(requestIDHeader)
+		if len(id) != 16 {
+			t.Errorf("%s: %s = %q", path, requestIDHeader, id)
+		}
+		var body map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: body %s: %v", path, w.Body, err)
+		}
+		if got, _ := body["type"].(string); got != wantType {
+			t.Errorf("%s: type = %q, want %q", path, got, wantType)
+		}
+		if _, ok := body["error"].(map[string]any); !ok {
+			t.Errorf("%s: no error object in %s", path, w.Body)
+		}
+	}
+}
+
+func TestWithRecover_AfterWrite(t *testing.T) {
+	h := withRecover(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		panic("mid-stream")
+	})
+	w := httptest.NewRecorder()
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", p)
+		}
+		if !w.Flushed || w.Code != 200 {
+			t.Errorf("flushed = %v, status = %d", w.Flushed, w.Code)
+		}
+	}()
+	h(w, httptest.NewRequest("POST", "/v1/messages", nil))
+}
+
+func TestWithRecover_RequestLogged(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("request_logging", "true")
+	h := withRecover(func(w http.ResponseWriter, r *http.Request) {
+		panic("bad body")
+	})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("POST", "/v1/chat/completions", nil))
+
+	var status int
+	var format, msg string
+	waitFor(t, func() bool {
+		return tdb.QueryRow("SELECT status_code, inbound_format, error_message FROM request_logs WHERE path = '/v1/chat/completions'").Scan(&status, &format, &msg) == nil
+	})
+	id := w.Header().Get(requestIDHeader)
+	if status != 500 || format != "openai" || !strings.Contains(msg, id) || !strings.Contains(msg, "bad body") {
+		t.Errorf("logged status %d, format %q, error %q", status, format, msg)
+	}
+}
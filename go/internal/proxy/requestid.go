@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// requestIDHeader carries the proxy's ID for a request back to the client.
+// The same ID prefixes the request's log lines, is sent upstream, and is
+// recorded in its usage and request_logs rows. The proxy always generates
+// it, so it stays unique and can't be chosen by a tenant.
+var requestIDHeader = exposeHeader("X-Proxy-Request-Id")
+
+// clientRequestIDHeader is an ID the client chose for its request, to
+// correlate the proxy's records with its own. It is echoed back, logged,
+// and recorded in request_logs next to the proxy's ID.
+var clientRequestIDHeader = exposeHeader(allowHeader("X-Request-Id"))
+
+// maxRequestIDLength bounds a client-chosen request ID.
+const maxRequestIDLength = 128
+
+// clientRequestID returns the client's X-Request-Id when it is a usable ID,
+// and "" otherwise. IDs are limited to letters, digits and ._:- so they are
+// safe in log lines and headers.
+func clientRequestID(r *http.Request) string {
+	id := strings.TrimSpace(r.Header.Get(clientRequestIDHeader))
+	if len(id) > maxRequestIDLength {
+		return ""
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', strings.ContainsRune("._:-", c):
+		default:
+			return ""
+		}
+	}
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestLogf returns a log.Printf for one request's lines. The request ID
+// goes after the line's "[tag] " prefix, so each request can be followed
+// through the log.
+func requestLogf(id string) func(format string, args ...any) {
+	return func(format string, args ...any) {
+		if tag, rest, ok := strings.Cut(format, "] "); ok && strings.HasPrefix(tag, "[") {
+			log.Printf(tag+"] [%s] "+rest, append([]any{id}, args...)...)
+			return
+		}
+		log.Printf("[%s] "+format, append([]any{id}, args...)...)
+	}
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRequestID_RoundTrip(t *testing.T) {
+	cases := []struct {
+		name, body, sent string
+		wantSent         bool // the client's ID is echoed and recorded
+	}{
+		{"non-streaming", plainMessage, "client-req_42", true},
+		{"streaming", streamedMessage, "client-req_43", true},
+		{"none sent", plainMessage, "", false},
+		{"unusable", plainMessage, "has spaces\tand tabs", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tdb := dbtest.Open(t)
+			tdb.SetSetting("request_logging", "true")
+			logs := &lockedBuffer{}
+			log.SetOutput(logs)
+			t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+			var mu sync.Mutex
+			var upstreamID string
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				upstreamID = r.Header.Get("X-Request-Id")
+				mu.Unlock()
+				if strings.Contains(tc.body, `"stream":true`) {
+					w.Header().Set("Content-Type", "text/event-stream")
+					fmt.Fprint(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":1}}}\n\n")
+					fmt.Fprint(w, "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+			}))
+			defer upstream.Close()
+			tdb.AddAccount("acct-id", "id", "anthropic", upstream.URL)
+
+			header := http.Header{}
+			if tc.sent != "" {
+				header.Set("X-Request-Id", tc.sent)
+			}
+			w := sendMessages(t, tc.body, header)
+			if w.Code != 200 {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			id := w.Header().Get(requestIDHeader)
+			if len(id) != 16 || id == tc.sent {
+				t.Fatalf("%s = %q, want a generated ID", requestIDHeader, id)
+			}
+			wantClientID := ""
+			if tc.wantSent {
+				wantClientID = tc.sent
+			}
+			if got := w.Header().Get(clientRequestIDHeader); got != wantClientID {
+				t.Errorf("%s echoed as %q, want %q", clientRequestIDHeader, got, wantClientID)
+			}
+			mu.Lock()
+			if upstreamID != id {
+				t.Errorf("upstream got X-Request-Id %q, want %q", upstreamID, id)
+			}
+			mu.Unlock()
+
+			var logged, loggedClient, usage string
+			waitFor(t, func() bool {
+				return tdb.QueryRow("SELECT COALESCE(request_id, ''), COALESCE(client_request_id, '') FROM request_logs").Scan(&logged, &loggedClient) == nil &&
+					tdb.QueryRow("SELECT COALESCE(request_id, '') FROM usage").Scan(&usage) == nil
+			})
+			if logged != id || usage != id {
+				t.Errorf("request_logs request_id = %q, usage request_id = %q, want %q", logged, usage, id)
+			}
+			if loggedClient != wantClientID {
+				t.Errorf("request_logs client_request_id = %q, want %q", loggedClient, wantClientID)
+			}
+			if !strings.Contains(logs.String(), "[proxy] ["+id+"] Routing [anthropic]") {
+				t.Errorf("routing log line without the request ID:\n%s", logs.String())
+			}
+			if tc.wantSent && !strings.Contains(logs.String(), "[proxy] ["+id+"] Client request ID "+tc.sent) {
+				t.Errorf("client's request ID not logged:\n%s", logs.String())
+			}
+		})
+	}
+}
+
+func TestRequestID_OnErrors(t *testing.T) {
+	dbtest.Open(t)
+	t.Setenv("PROXY_API_KEY", "secret")
+
+	w := sendMessages(t, plainMessage, http.Header{"X-Request-Id": {"denied-1"}})
+	if w.Code != 401 || len(w.Header().Get(requestIDHeader)) != 16 || w.Header().Get(clientRequestIDHeader) != "denied-1" {
+		t.Errorf("status = %d, %s = %q, %s = %q", w.Code, requestIDHeader, w.Header().Get(requestIDHeader),
+			clientRequestIDHeader, w.Header().Get(clientRequestIDHeader))
+	}
+}
+
+func TestRequestLogf(t *testing.T) {
+	logs := &lockedBuffer{}
+	log.SetOutput(logs)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	})
+
+	logf := requestLogf("abc")
+	logf("[proxy] Got %d from %q", 500, "primary")
+	logf("no tag %s", "here")
+	if got, want := logs.String(), "[proxy] [abc] Got 500 from \"primary\"\n[abc] no tag here\n"; got != want {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"bytes"
+	"codegate-proxy/internal/provider"
+	"context"
+	"io"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultProviderRetries is how many times a transient failure is retried
+// on the same account when provider_retry_count isn't set.
+const defaultProviderRetries = 1
+
+const (
+	// retryBaseDelay is the backoff before the first retry; each retry
+	// after it doubles, up to retryMaxDelay.
+	retryBaseDelay = 250 * time.Millisecond
+	retryMaxDelay  = 4 * time.Second
+)
+
+// providerRetries reads provider_retry_count through getSetting; 0 turns
+// retries off.
+func providerRetries(getSetting func(string) string) int {
+	if n, err := strconv.Atoi(strings.TrimSpace(getSetting("provider_retry_count"))); err == nil && n >= 0 {
+		return n
+	}
+	return defaultProviderRetries
+}
+
+// transientFailure reports whether an attempt failed in a way worth
+// retrying on the same account before failing over: a connection error, or
+// a 502, 503 or 529. Timeouts aren't retried, since the attempt has already
+// waited out its limit.
+func transientFailure(resp *provider.Response, err error) bool {
+	if err != nil {
+		return !provider.IsTimeout(err)
+	}
+	switch resp.Status {
+	case 502, 503, 529:
+		return true
+	}
+	return false
+}
+
+// retryBackoff returns the wait before retry n, counting from 0:
+// retryBaseDelay doubled n times, capped at retryMaxDelay, with up to half
+// of it taken off at random so clients failing together don't retry
+// together.
+func retryBackoff(n int) time.Duration {
+	d := retryMaxDelay
+	if n < 16 && retryBaseDelay<<n < retryMaxDelay {
+		d = retryBaseDelay << n
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// sleepContext waits for d and reports whether it did, or returns false as
+// soon as ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// replayableBody returns a function giving the request body for each
+// attempt. Spooled bodies are read from disk again; others are buffered on
+// the first call, so they are sent as the first attempt sent them.
+func replayableBody(spool *spooledBody, body io.Reader, n int64) func() (io.Reader, int64) {
+	if spool != nil {
+		first := true
+		return func() (io.Reader, int64) {
+			if first {
+				first = false
+				return body, n
+			}
+			return spool.reader()
+		}
+	}
+	var buf []byte
+	return func() (io.Reader, int64) {
+		if buf == nil {
+			buf, _ = io.ReadAll(body)
+		}
+		return bytes.NewReader(buf), int64(len(buf))
+	}
+}
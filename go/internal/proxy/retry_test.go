@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/cooldown"
+	"codegate-proxy/internal/dbtest"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyUpstream adds an Anthropic account whose upstream fails its first
+// failures requests with fail, then answers, streaming when asked to. It
+// returns the number of requests it has seen.
+func flakyUpstream(t *testing.T, tdb *dbtest.DB, id string, failures int32, fail func(w http.ResponseWriter)) *atomic.Int32 {
+	t.Helper()
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		if hits.Add(1) <= failures {
+			fail(w)
+			return
+		}
+		if strings.Contains(string(raw), `"stream":true`) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"type\":\"message\",\"role\":\"assistant\",\"model\":\"claude-sonnet-4-20250514\",\"content\":[],\"usage\":{\"input_tokens\":3,\"output_tokens\":0}}}\n\n")
+			fmt.Fprint(w, "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	t.Cleanup(upstream.Close)
+	tdb.AddAccount(id, id, "anthropic", upstream.URL)
+	t.Cleanup(func() { cooldown.Clear(id) })
+	return &hits
+}
+
+func failWith(status int) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"type":"error","error":{"type":"api_error","message":"upstream unavailable"}}`)
+	}
+}
+
+// dropConnection closes the connection without a response.
+func dropConnection(w http.ResponseWriter) {
+	conn, _, _ := w.(http.Hijacker).Hijack()
+	conn.Close()
+}
+
+func TestTransientRetry_FailsOnceThenSucceeds(t *testing.T) {
+	const streamed = `{"model":"claude-sonnet-4-20250514","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	cases := []struct {
+		name string
+		fail func(w http.ResponseWriter)
+		body string
+	}{
+		{"502", failWith(502), plainMessage},
+		{"503", failWith(503), plainMessage},
+		{"529", failWith(529), plainMessage},
+		{"connection error", dropConnection, plainMessage},
+		{"stream 503", failWith(503), streamed},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tdb := dbtest.Open(t)
+			tdb.SetSetting("request_logging", "true")
+			hits := flakyUpstream(t, tdb, "acct-flaky", 1, tc.fail)
+			backup := flakyUpstream(t, tdb, "acct-backup", 0, nil)
+			tdb.AddActiveConfig("cfg", "default")
+			tdb.AddTier("cfg", "sonnet", "acct-flaky", 10, "")
+			tdb.AddTier("cfg", "sonnet", "acct-backup", 5, "")
+
+			w := sendMessages(t, tc.body, nil)
+			if w.Code != 200 {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			if hits.Load() != 2 || backup.Load() != 0 {
+				t.Errorf("flaky account hit %d times, backup %d; want 2 and 0", hits.Load(), backup.Load())
+			}
+			var retries int
+			var attempts string
+			waitFor(t, func() bool {
+				return tdb.QueryRow("SELECT retries, COALESCE(failover_attempts, '') FROM request_logs WHERE account_id = 'acct-flaky'").Scan(&retries, &attempts) == nil
+			})
+			if retries != 1 || !strings.Contains(attempts, `"retry":true`) {
+				t.Errorf("logged retries = %d, attempts = %s", retries, attempts)
+			}
+		})
+	}
+}
+
+func TestTransientRetry_NotRetried(t *testing.T) {
+	cases := []struct {
+		name, retries string
+		status        int
+	}{
+		{"retries off", "0", 503},
+		{"500 isn't transient", "", 500},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tdb := dbtest.Open(t)
+			tdb.SetSetting("provider_retry_count", tc.retries)
+			hits := flakyUpstream(t, tdb, "acct-flaky", 1, failWith(tc.status))
+			backup := flakyUpstream(t, tdb, "acct-backup", 0, nil)
+			tdb.AddActiveConfig("cfg", "default")
+			tdb.AddTier("cfg", "sonnet", "acct-flaky", 10, "")
+			tdb.AddTier("cfg", "sonnet", "acct-backup", 5, "")
+
+			if w := sendMessages(t, plainMessage, nil); w.Code != 200 {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			if hits.Load() != 1 || backup.Load() != 1 {
+				t.Errorf("flaky account hit %d times, backup %d; want a failover after 1", hits.Load(), backup.Load())
+			}
+		})
+	}
+}
+
+// A provider that keeps failing is retried provider_retry_count times, then
+// failed over from.
+func TestTransientRetry_ThenFailover(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("provider_retry_count", "2")
+	hits := flakyUpstream(t, tdb, "acct-flaky", 10, failWith(503))
+	backup := flakyUpstream(t, tdb, "acct-backup", 0, nil)
+	tdb.AddActiveConfig("cfg", "default")
+	tdb.AddTier("cfg", "sonnet", "acct-flaky", 10, "")
+	tdb.AddTier("cfg", "sonnet", "acct-backup", 5, "")
+
+	if w := sendMessages(t, plainMessage, nil); w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if hits.Load() != 3 || backup.Load() != 1 {
+		t.Errorf("flaky account hit %d times, backup %d; want 3 and 1", hits.Load(), backup.Load())
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	for n, want := range []time.Duration{retryBaseDelay, 2 * retryBaseDelay, 4 * retryBaseDelay, 8 * retryBaseDelay, retryMaxDelay, retryMaxDelay} {
+		for range 20 {
+			if d := retryBackoff(n); d < want/2 || d > want {
+				t.Fatalf("retryBackoff(%d) = %v, want between %v and %v", n, d, want/2, want)
+			}
+		}
+	}
+	if d := retryBackoff(100); d > retryMaxDelay {
+		t.Errorf("retryBackoff(100) = %v, over the cap", d)
+	}
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// routingMetadataField is the top-level response field inject_routing_metadata
+// adds, for clients whose SDKs hide the X-Proxy-* headers.
+const routingMetadataField = "codegate"
+
+// routingMetadata says which account and model served a response.
+type routingMetadata struct {
+	Account     string `json:"account"`
+	Provider    string `json:"provider"`
+	TargetModel string `json:"target_model"`
+	Failover    bool   `json:"failover"`
+}
+
+// member returns the metadata as a JSON object member.
+func (m routingMetadata) member() []byte {
+	v, _ := json.Marshal(m)
+	return append([]byte(`"`+routingMetadataField+`":`), v...)
+}
+
+// withRoutingMetadata adds the metadata as the last member of a JSON object
+// body, leaving the rest of the body byte for byte. Anything but an object is
+// returned unchanged.
+func withRoutingMetadata(body []byte, meta routingMetadata) []byte {
+	return appendMember(body, meta.member())
+}
+
+// appendMember inserts member before the closing brace of a JSON object.
+func appendMember(obj, member []byte) []byte {
+	trimmed := bytes.TrimSpace(obj)
+	if len(trimmed) < 2 || trimmed[0] != '{' || trimmed[len(trimmed)-1] != '}' || !json.Valid(trimmed) {
+		return obj
+	}
+	inner := bytes.TrimSpace(trimmed[1 : len(trimmed)-1])
+	out := make([]byte, 0, len(trimmed)+len(member)+1)
+	out = append(out, trimmed[:len(trimmed)-1]...)
+	if len(inner) > 0 {
+		out = append(out, ',')
+	}
+	out = append(out, member...)
+	return append(out, '}')
+}
+
+// routingMetadataStream adds the metadata to the event that ends a streamed
+// message: Anthropic's message_delta, or the OpenAI chunk with a
+// finish_reason (or, for a pause_turn, the anthropic_stop_reason the
+// converter sends with a null one). Only the first such event gets it.
+type routingMetadataStream struct {
+	src     io.ReadCloser
+	br      *bufio.Reader
+	member  []byte
+	pending []byte
+	done    bool
+	err     error
+}
+
+func newRoutingMetadataStream(src io.ReadCloser, meta routingMetadata) *routingMetadataStream {
+	return &routingMetadataStream{src: src, br: bufio.NewReader(src), member: meta.member()}
+}
+
+func (s *routingMetadataStream) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		line, err := s.br.ReadBytes('\n')
+		s.err = err
+		s.pending = s.inject(line)
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *routingMetadataStream) Close() error {
+	return s.src.Close()
+}
+
+// inject adds the metadata to line if it is the data line of the final event.
+func (s *routingMetadataStream) inject(line []byte) []byte {
+	if s.done {
+		return line
+	}
+	payload, ok := bytes.CutPrefix(line, []byte("data:"))
+	if !ok {
+		return line
+	}
+	var event struct {
+		Type    string `json:"type"`
+		Choices []struct {
+			FinishReason *string `json:"finish_reason"`
+			StopReason   string  `json:"anthropic_stop_reason"`
+		} `json:"choices"`
+	}
+	if json.Unmarshal(payload, &event) != nil {
+		return line
+	}
+	final := event.Type == "message_delta"
+	for _, c := range event.Choices {
+		final = final || c.FinishReason != nil || c.StopReason != ""
+	}
+	if !final {
+		return line
+	}
+	s.done = true
+	end := bytes.TrimRight(payload, "\r\n")
+	out := append([]byte("data: "), appendMember(end, s.member)...)
+	return append(out, line[len(line)-(len(payload)-len(end)):]...)
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var testRoutingMetadata = routingMetadata{Account: "main", Provider: "anthropic", TargetModel: "claude-sonnet-4-20250514"}
+
+func TestWithRoutingMetadata(t *testing.T) {
+	member := `"codegate":{"account":"main","provider":"anthropic","target_model":"claude-sonnet-4-20250514","failover":false}`
+	for in, want := range map[string]string{
+		`{"id":"msg_1","content":[]}`: `{"id":"msg_1","content":[]` + "," + member + `}`,
+		" {}\n":                       `{` + member + `}`,
+		`[1]`:                         `[1]`,
+		`{"truncated":`:               `{"truncated":`,
+	} {
+		if got := string(withRoutingMetadata([]byte(in), testRoutingMetadata)); got != want {
+			t.Errorf("withRoutingMetadata(%q) = %s", in, got)
+		}
+	}
+}
+
+func TestRoutingMetadataStream(t *testing.T) {
+	for name, tc := range map[string]struct {
+		stream string
+		event  string
+	}{
+		"anthropic": {
+			"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"hi\"}}\n\n" +
+				"event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"},\"usage\":{\"output_tokens\":1}}\r\n\r\n" +
+				"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n",
+			"message_delta",
+		},
+		"openai": {
+			"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"hi\"},\"finish_reason\":null}]}\n\n" +
+				"data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n" +
+				"data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n" +
+				"data: [DONE]\n\n",
+			"stop",
+		},
+		"openai pause_turn": {
+			"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"hi\"},\"finish_reason\":null}]}\n\n" +
+				"data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":null,\"anthropic_stop_reason\":\"pause_turn\"}]}\n\n" +
+				"data: [DONE]\n\n",
+			"pause_turn",
+		},
+	} {
+		out, err := io.ReadAll(newRoutingMetadataStream(io.NopCloser(strings.NewReader(tc.stream)), testRoutingMetadata))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tagged []string
+		for _, line := range strings.Split(string(out), "\n") {
+			data, ok := strings.CutPrefix(strings.TrimSuffix(line, "\r"), "data: ")
+			if !ok || data == "[DONE]" {
+				continue
+			}
+			if !json.Valid([]byte(data)) {
+				t.Errorf("%s: invalid data line %q", name, data)
+			}
+			if strings.Contains(data, `"codegate":`) {
+				tagged = append(tagged, data)
+			}
+		}
+		if len(tagged) != 1 || !strings.Contains(tagged[0], tc.event) {
+			t.Errorf("%s: tagged events = %v", name, tagged)
+		}
+		if got := strings.Count(string(out), "\n"); got != strings.Count(tc.stream, "\n") {
+			t.Errorf("%s: %d lines, want %d", name, got, strings.Count(tc.stream, "\n"))
+		}
+	}
+}
+
+func TestInjectRoutingMetadata(t *testing.T) {
+	tdb := dbtest.Open(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["stream"] == true {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"model\":\"claude-sonnet-4-20250514\",\"usage\":{\"input_tokens\":1,\"output_tokens\":0}}}\n\n"+
+				"event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"},\"usage\":{\"output_tokens\":1}}\n\n"+
+				"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"ok"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-routing-meta", "meta", "anthropic", upstream.URL)
+
+	send := func(path, body string) map[string]any {
+		t.Helper()
+		w := httptest.NewRecorder()
+		Handler().ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		if w.Code != 200 {
+			t.Fatalf("%s: status %d: %s", path, w.Code, w.Body)
+		}
+		var resp map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %v: %s", path, err, w.Body)
+		}
+		meta, _ := resp["codegate"].(map[string]any)
+		return meta
+	}
+	anthropicReq := `{"model":"claude-sonnet-4-20250514","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`
+	openaiReq := `{"model":"claude-sonnet-4-20250514","messages":[{"role":"user","content":"hi"}]}`
+
+	if meta := send("/v1/messages", anthropicReq); meta != nil {
+		t.Errorf("metadata injected while disabled: %v", meta)
+	}
+
+	tdb.SetSetting("inject_routing_metadata", "true")
+	for path, body := range map[string]string{"/v1/messages": anthropicReq, "/v1/chat/completions": openaiReq} {
+		meta := send(path, body)
+		if meta["account"] != "meta" || meta["provider"] != "anthropic" || meta["target_model"] != "claude-sonnet-4-20250514" || meta["failover"] != false {
+			t.Errorf("%s: codegate = %v", path, meta)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("POST", "/v1/messages", strings.NewReader(strings.Replace(anthropicReq, "{", `{"stream":true,`, 1))))
+	if !strings.Contains(w.Body.String(), `"stop_reason":"end_turn"},"usage":{"output_tokens":1},"codegate":{"account":"meta"`) {
+		t.Errorf("stream = %s", w.Body)
+	}
+}
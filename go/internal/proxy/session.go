@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sessionIDHeader names the client's conversation. Requests from the same
+// tenant with the same ID accumulate cost and token totals.
+var sessionIDHeader = allowHeader("X-Session-Id")
+
+// Usage headers. Tokens are input plus output tokens.
+var (
+	requestCostHeader   = exposeHeader("X-CodeGate-Request-Cost-USD")
+	requestTokensHeader = exposeHeader("X-CodeGate-Request-Tokens")
+	sessionCostHeader   = exposeHeader("X-CodeGate-Session-Cost-USD")
+	sessionTokensHeader = exposeHeader("X-CodeGate-Session-Tokens")
+)
+
+const (
+	// sessionTTL is how long a session's totals are kept after its last
+	// request.
+	sessionTTL = time.Hour
+
+	// maxSessions bounds the accumulator; the least recently used session
+	// is dropped to make room.
+	maxSessions = 10000
+
+	maxSessionIDLen = 128
+)
+
+type sessionTotals struct {
+	key      string
+	costUSD  float64
+	tokens   int
+	lastSeen time.Time
+}
+
+// sessions holds the totals by key, and in lru from most to least recently
+// used, so the sessions to evict are always at the back.
+var sessions = struct {
+	sync.Mutex
+	m   map[string]*list.Element // of *sessionTotals
+	lru *list.List
+}{m: make(map[string]*list.Element), lru: list.New()}
+
+// addSessionUsage adds a request's cost and tokens to the tenant's session
+// and returns the new totals.
+func addSessionUsage(tenantID, sessionID string, costUSD float64, tokens int) sessionTotals {
+	key := tenantID + "\x00" + sessionID
+	now := time.Now()
+
+	sessions.Lock()
+	defer sessions.Unlock()
+	var s *sessionTotals
+	if e, ok := sessions.m[key]; ok {
+		s = e.Value.(*sessionTotals)
+		if now.Sub(s.lastSeen) > sessionTTL {
+			s.costUSD, s.tokens = 0, 0
+		}
+		sessions.lru.MoveToFront(e)
+	} else {
+		evictSessions(now)
+		s = &sessionTotals{key: key}
+		sessions.m[key] = sessions.lru.PushFront(s)
+	}
+	s.costUSD += costUSD
+	s.tokens += tokens
+	s.lastSeen = now
+	return *s
+}
+
+// evictSessions drops expired sessions from the back of the list, then the
+// least recently used ones until there is room for another. The caller
+// holds the lock.
+func evictSessions(now time.Time) {
+	for e := sessions.lru.Back(); e != nil; e = sessions.lru.Back() {
+		s := e.Value.(*sessionTotals)
+		if now.Sub(s.lastSeen) <= sessionTTL && len(sessions.m) < maxSessions {
+			return
+		}
+		sessions.lru.Remove(e)
+		delete(sessions.m, s.key)
+	}
+}
+
+func resetSessions() {
+	sessions.Lock()
+	sessions.m = make(map[string]*list.Element)
+	sessions.lru.Init()
+	sessions.Unlock()
+}
+
+// requestSessionID returns the client's session ID, or "" when none (or an
+// implausibly long one) was sent.
+func requestSessionID(r *http.Request) string {
+	id := r.Header.Get(sessionIDHeader)
+	if len(id) > maxSessionIDLen {
+		return ""
+	}
+	return id
+}
+
+// requestUsage is a successful request's cost, and its session's totals
+// when the client sent a session ID.
+type requestUsage struct {
+	CostUSD        float64  `json:"request_cost_usd"`
+	Tokens         int      `json:"request_tokens"`
+	SessionCostUSD *float64 `json:"session_cost_usd,omitempty"`
+	SessionTokens  *int     `json:"session_tokens,omitempty"`
+}
+
+func newRequestUsage(tenantID, sessionID string, costUSD float64, tokens int) requestUsage {
+	u := requestUsage{CostUSD: costUSD, Tokens: tokens}
+	if sessionID != "" {
+		totals := addSessionUsage(tenantID, sessionID, costUSD, tokens)
+		u.SessionCostUSD, u.SessionTokens = &totals.costUSD, &totals.tokens
+	}
+	return u
+}
+
+// setHeaders sets the usage headers (or trailers, for streams).
+func (u requestUsage) setHeaders(h http.Header) {
+	h.Set(requestCostHeader, formatCost(u.CostUSD))
+	h.Set(requestTokensHeader, strconv.Itoa(u.Tokens))
+	if u.SessionCostUSD != nil {
+		h.Set(sessionCostHeader, formatCost(*u.SessionCostUSD))
+		h.Set(sessionTokensHeader, strconv.Itoa(*u.SessionTokens))
+	}
+}
+
+// writeComment appends the usage to an SSE stream as a comment line, which
+// SSE parsers skip.
+func (u requestUsage) writeComment(w io.Writer) {
+	b, _ := json.Marshal(u)
+	fmt.Fprintf(w, ": codegate-usage %s\n\n", b)
+}
+
+func formatCost(usd float64) string {
+	return strconv.FormatFloat(usd, 'f', 6, 64)
+}
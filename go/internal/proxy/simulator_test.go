@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/cooldown"
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/health"
+	"codegate-proxy/internal/metrics"
+	"codegate-proxy/internal/provider"
+	"strings"
+	"testing"
+)
+
+// A drill against a primary that fails half its requests: every request
+// is still served, and exactly half of them fail over.
+func TestSimulator_FailoverStatistics(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("provider_retry_count", "0")
+	metrics.Reset()
+	provider.ResetSimulator()
+	t.Cleanup(provider.ResetSimulator)
+	tdb.AddAccount("acct-primary", "flaky", "simulator", "")
+	tdb.AddAccount("acct-backup", "steady", "simulator", "")
+	tdb.Exec(`UPDATE accounts SET api_flavor = 'anthropic', simulator_settings = '{"error_rate":0.5,"error_statuses":[500]}' WHERE id = 'acct-primary'`)
+	tdb.Exec(`UPDATE accounts SET simulator_settings = '{"text":"steady reply","chunks":8,"input_tokens":5,"output_tokens":7}' WHERE id = 'acct-backup'`)
+	tdb.AddActiveConfig("cfg", "default")
+	tdb.AddTier("cfg", "sonnet", "acct-primary", 10, "")
+	tdb.AddTier("cfg", "sonnet", "acct-backup", 5, "")
+	reset := func() {
+		cooldown.Clear("acct-primary")
+		cooldown.Clear("acct-backup")
+		health.Reset()
+	}
+	reset()
+	t.Cleanup(reset)
+
+	const requests = 10
+	for i := range requests {
+		body := plainMessage
+		if i%2 == 0 {
+			body = strings.Replace(body, `"max_tokens":16`, `"max_tokens":16,"stream":true`, 1)
+		}
+		// Health and cooldowns would demote the primary; keep it first in line
+		health.Reset()
+		w := sendMessages(t, body, nil)
+		if w.Code != 200 || !strings.Contains(w.Body.String(), "end_turn") {
+			t.Fatalf("request %d: status = %d, body = %s", i, w.Code, w.Body.String())
+		}
+	}
+
+	if n := metrics.Counter("codegate_failovers_total", "provider", "simulator"); n != requests/2 {
+		t.Errorf("failovers = %d, want %d", n, requests/2)
+	}
+	counts := make(map[string]int)
+	waitFor(t, func() bool {
+		var primary, backup int
+		tdb.QueryRow("SELECT COUNT(*) FROM usage WHERE account_id = 'acct-primary'").Scan(&primary)
+		tdb.QueryRow("SELECT COUNT(*) FROM usage WHERE account_id = 'acct-backup'").Scan(&backup)
+		counts["primary"], counts["backup"] = primary, backup
+		return primary+backup == requests
+	})
+	if counts["primary"] != requests/2 || counts["backup"] != requests/2 {
+		t.Errorf("served %v, want half each", counts)
+	}
+	var attempts, status int
+	tdb.QueryRow("SELECT COUNT(*), MAX(status_code) FROM request_attempts WHERE account_id = 'acct-primary'").Scan(&attempts, &status)
+	if attempts != requests/2 || status != 500 {
+		t.Errorf("%d failed attempts with status %d, want %d with 500", attempts, status, requests/2)
+	}
+	var input, output int
+	tdb.QueryRow("SELECT SUM(input_tokens), SUM(output_tokens) FROM usage WHERE account_id = 'acct-backup'").Scan(&input, &output)
+	if input != 5*requests/2 || output != 7*requests/2 {
+		t.Errorf("backup usage %d/%d", input, output)
+	}
+}
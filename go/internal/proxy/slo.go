@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"bytes"
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/health"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultSLOCooloff is how long a breached subject stays quiet after an
+// alert when slo_alert_cooloff_seconds isn't set.
+const defaultSLOCooloff = 15 * time.Minute
+
+// sloSignatureHeader carries the hex HMAC-SHA256 of an alert webhook body,
+// keyed with slo_alert_webhook_secret.
+const sloSignatureHeader = "X-CodeGate-Signature"
+
+var sloWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// sloThresholds reads slo_p95_latency_ms, slo_error_rate, and
+// slo_alert_cooloff_seconds through getSetting. Unset or invalid thresholds
+// disable the check.
+func sloThresholds(getSetting func(string) string) health.Thresholds {
+	th := health.Thresholds{Cooloff: defaultSLOCooloff}
+	if ms, err := strconv.Atoi(getSetting("slo_p95_latency_ms")); err == nil && ms > 0 {
+		th.P95Latency = time.Duration(ms) * time.Millisecond
+	}
+	if rate, err := strconv.ParseFloat(getSetting("slo_error_rate"), 64); err == nil && rate > 0 && rate < 1 {
+		th.ErrorRate = rate
+	}
+	if s, err := strconv.Atoi(getSetting("slo_alert_cooloff_seconds")); err == nil && s >= 0 {
+		th.Cooloff = time.Duration(s) * time.Second
+	}
+	return th
+}
+
+// sloScope is the tenant a request's SLO samples are also recorded under
+// ("" for none) and the thresholds they are checked against, read once per
+// request. Every request feeds the global windows, checked against the
+// global settings; a tenant's request feeds the tenant's windows on top,
+// checked against the tenant's settings.
+type sloScope struct {
+	tenantID     string
+	th, tenantTh health.Thresholds
+}
+
+func newSLOScope(tenantID string, getSetting func(string) string) sloScope {
+	s := sloScope{tenantID: tenantID, th: sloThresholds(db.GetSetting)}
+	if tenantID != "" {
+		s.tenantTh = sloThresholds(getSetting)
+	}
+	return s
+}
+
+// each calls fn with the global windows' tenant and thresholds, then the
+// request tenant's.
+func (s sloScope) each(fn func(tenant string, th health.Thresholds)) {
+	fn("", s.th)
+	if s.tenantID != "" {
+		fn(s.tenantID, s.tenantTh)
+	}
+}
+
+// observeLatency records how long an account's upstream took to answer and
+// checks the model's p95 against slo_p95_latency_ms.
+func (s sloScope) observeLatency(account db.Account, model string, d time.Duration) {
+	s.each(func(tenant string, th health.Thresholds) {
+		health.RecordLatency(tenant, account.Provider, model, d)
+		if a := health.CheckLatency(tenant, account.Provider, model, th); a != nil {
+			raiseAlert(a)
+		}
+	})
+}
+
+// recordFailure records a failed upstream request and checks the account's
+// error rate against slo_error_rate.
+func (s sloScope) recordFailure(account db.Account) {
+	s.record(account, false)
+	s.each(func(tenant string, th health.Thresholds) {
+		if a := health.CheckErrorRate(tenant, account.ID, th); a != nil {
+			raiseAlert(a)
+		}
+	})
+}
+
+// recordSuccess records a successful upstream request. A success can end an
+// error-rate breach, so the check runs here too.
+func (s sloScope) recordSuccess(account db.Account) {
+	s.record(account, true)
+	s.each(func(tenant string, th health.Thresholds) {
+		health.CheckErrorRate(tenant, account.ID, th)
+	})
+}
+
+// record feeds the account-wide outcome window routing uses and, for a
+// tenant's request, the tenant's own window.
+func (s sloScope) record(account db.Account, ok bool) {
+	if ok {
+		health.RecordSuccess(account.ID)
+	} else {
+		health.RecordFailure(account.ID)
+	}
+	if s.tenantID != "" {
+		health.RecordTenantOutcome(s.tenantID, account.ID, ok)
+	}
+}
+
+// raiseAlert logs a breach and, when slo_alert_webhook_url is set, posts it
+// there through SLOAlertWebhooks.
+func raiseAlert(a *health.Alert) {
+	scope := ""
+	if a.Tenant != "" {
+		scope = fmt.Sprintf(" for tenant %s", a.Tenant)
+	}
+	if a.Kind == "latency" {
+		log.Printf("[slo] ERROR p95 latency of %s%s is %.0fms over %d requests (threshold %.0fms)",
+			a.Subject, scope, a.Value, a.Samples, a.Threshold)
+	} else {
+		log.Printf("[slo] ERROR error rate of account %s%s is %.1f%% over %d requests (threshold %.1f%%)",
+			a.Subject, scope, a.Value*100, a.Samples, a.Threshold*100)
+	}
+
+	url := db.GetSetting("slo_alert_webhook_url")
+	if url == "" {
+		return
+	}
+	SLOAlertWebhooks.send(url, db.GetSetting("slo_alert_webhook_secret"), a)
+}
+
+// SLOAlertWebhooks posts SLO alerts in the background. Stopping it waits
+// for deliveries in flight, each bounded by the webhook client's timeout;
+// alerts raised while it is stopped are only logged.
+var SLOAlertWebhooks = &alertWebhooks{}
+
+type alertWebhooks struct {
+	mu      sync.Mutex
+	stopped bool
+	pending sync.WaitGroup
+}
+
+// Start lets alerts be delivered again after Stop. Deliveries don't use
+// ctx, so one already sent isn't cut off by shutdown.
+func (h *alertWebhooks) Start(context.Context) {
+	h.mu.Lock()
+	h.stopped = false
+	h.mu.Unlock()
+}
+
+// Stop refuses further deliveries and waits for those in flight.
+func (h *alertWebhooks) Stop() {
+	h.mu.Lock()
+	h.stopped = true
+	h.mu.Unlock()
+	h.pending.Wait()
+}
+
+func (h *alertWebhooks) send(url, secret string, a *health.Alert) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stopped {
+		log.Printf("[slo] Alert webhook not sent: shutting down")
+		return
+	}
+	h.pending.Add(1)
+	go func() {
+		defer h.pending.Done()
+		if err := postAlert(url, secret, a); err != nil {
+			log.Printf("[slo] Alert webhook failed: %v", err)
+		}
+	}()
+}
+
+// postAlert sends a as JSON, signed with secret when one is set.
+func postAlert(url, secret string, a *health.Alert) error {
+	body, err := json.Marshal(map[string]any{"event": "slo_breach", "alert": a})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set(sloSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := sloWebhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
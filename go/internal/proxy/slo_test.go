@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/health"
+	"codegate-proxy/internal/tenant"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSLO_LatencyBreachAlertsOnce(t *testing.T) {
+	tdb := dbtest.Open(t)
+	resetStatusCache(t)
+	health.Reset()
+	t.Cleanup(health.Reset)
+
+	var mu sync.Mutex
+	var hooks [][]byte
+	var sigs []string
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		hooks = append(hooks, b)
+		sigs = append(sigs, r.Header.Get(sloSignatureHeader))
+		mu.Unlock()
+	}))
+	defer hook.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	defer upstream.Close()
+
+	tdb.AddAccount("acct-a", "alpha", "anthropic", upstream.URL)
+	tdb.SetSetting("slo_p95_latency_ms", "500")
+	tdb.SetSetting("slo_alert_webhook_url", hook.URL)
+	tdb.SetSetting("slo_alert_webhook_secret", "s3cret")
+
+	// Seed a degraded window; the fast requests below don't pull p95 under
+	for i := 0; i < 20; i++ {
+		health.RecordLatency("", "anthropic", "claude-sonnet-4-20250514", 2*time.Second)
+	}
+	for i := 0; i < 3; i++ {
+		if w := sendMessages(t, plainMessage, nil); w.Code != 200 {
+			t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(hooks) > 0
+	})
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(hooks) != 1 {
+		t.Fatalf("webhook calls = %d, want 1 within the cooloff", len(hooks))
+	}
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(hooks[0])
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); sigs[0] != want {
+		t.Errorf("signature = %q, want %q", sigs[0], want)
+	}
+	var payload struct {
+		Event string       `json:"event"`
+		Alert health.Alert `json:"alert"`
+	}
+	if err := json.Unmarshal(hooks[0], &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != "slo_breach" || payload.Alert.Kind != "latency" ||
+		payload.Alert.Subject != "anthropic/claude-sonnet-4-20250514" || payload.Alert.Threshold != 500 {
+		t.Errorf("payload = %+v", payload)
+	}
+
+	var snap statusSnapshot
+	json.Unmarshal(getStatus(t, "/admin/status", "").Body.Bytes(), &snap)
+	if len(snap.Alerts) != 1 || snap.Alerts[0].Subject != "anthropic/claude-sonnet-4-20250514" {
+		t.Errorf("status alerts = %+v", snap.Alerts)
+	}
+	if len(snap.Latency) != 1 || snap.Latency[0].Samples != 23 || snap.Latency[0].P95Ms != 2000 {
+		t.Errorf("status latency = %+v", snap.Latency)
+	}
+	if html := getStatus(t, "/admin/status?format=html", "").Body.String(); !strings.Contains(html, "SLO alerts") {
+		t.Error("HTML status doesn't list the alert")
+	}
+}
+
+func TestSLO_ErrorRateAlert(t *testing.T) {
+	tdb := dbtest.Open(t)
+	health.Reset()
+	t.Cleanup(health.Reset)
+	tdb.SetSetting("slo_error_rate", "0.5")
+
+	backupHits := failoverPair(t, tdb)
+	for i := 0; i < health.MinSamples; i++ {
+		sendMessages(t, plainMessage, nil)
+	}
+	if backupHits.Load() != int32(health.MinSamples) {
+		t.Fatalf("backup hits = %d", backupHits.Load())
+	}
+	alerts := health.ActiveAlerts()
+	if len(alerts) != 1 || alerts[0].Kind != "error_rate" || alerts[0].Subject != "acct-primary" || alerts[0].Value != 1 {
+		t.Errorf("alerts = %+v, want the primary's error rate", alerts)
+	}
+}
+
+func TestSLO_TenantRequestsFeedGlobalWindows(t *testing.T) {
+	tdb := dbtest.Open(t)
+	health.Reset()
+	t.Cleanup(health.Reset)
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+	sum := sha256.Sum256([]byte("cgk_slo_key"))
+	tdb.Exec("INSERT INTO tenants (id, name, api_key_hash, api_key_prefix) VALUES ('t-slo', 'slo', ?, 'cgk_slo_')", hex.EncodeToString(sum[:]))
+	tdb.SetSetting("slo_error_rate", "0.5")
+
+	backupHits := failoverPair(t, tdb)
+	for i := 0; i < health.MinSamples; i++ {
+		sendMessages(t, plainMessage, http.Header{"X-Api-Key": {"cgk_slo_key"}})
+	}
+	if backupHits.Load() != int32(health.MinSamples) {
+		t.Fatalf("backup hits = %d", backupHits.Load())
+	}
+	var tenants []string
+	for _, a := range health.ActiveAlerts() {
+		if a.Kind == "error_rate" && a.Subject == "acct-primary" {
+			tenants = append(tenants, a.Tenant)
+		}
+	}
+	if !slices.Equal(tenants, []string{"", "t-slo"}) {
+		t.Errorf("primary's error rate alerted for tenants %q, want global and t-slo", tenants)
+	}
+	for _, tenantID := range []string{"", "t-slo"} {
+		if _, n := health.P95Latency(tenantID, "anthropic", "claude-sonnet-4-20250514", health.DefaultWindow); n != health.MinSamples {
+			t.Errorf("latency samples for tenant %q = %d, want %d", tenantID, n, health.MinSamples)
+		}
+	}
+}
+
+func TestSLOAlertWebhooks_StopWaitsForDeliveries(t *testing.T) {
+	tdb := dbtest.Open(t)
+	release := make(chan struct{})
+	var hits atomic.Int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+	}))
+	defer hook.Close()
+	tdb.SetSetting("slo_alert_webhook_url", hook.URL)
+	t.Cleanup(func() { SLOAlertWebhooks.Start(context.Background()) })
+
+	raiseAlert(&health.Alert{Kind: "latency", Subject: "anthropic/claude-sonnet-4-20250514"})
+	waitFor(t, func() bool { return hits.Load() == 1 })
+	stopped := make(chan struct{})
+	go func() {
+		SLOAlertWebhooks.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned with a delivery in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-stopped
+
+	raiseAlert(&health.Alert{Kind: "latency", Subject: "anthropic/claude-sonnet-4-20250514"})
+	time.Sleep(50 * time.Millisecond)
+	if hits.Load() != 1 {
+		t.Errorf("webhook calls = %d after Stop, want 1", hits.Load())
+	}
+}
+
+func TestSLOThresholds(t *testing.T) {
+	tdb := dbtest.Open(t)
+	if th := sloThresholds(db.GetSetting); th.P95Latency != 0 || th.ErrorRate != 0 || th.Cooloff != defaultSLOCooloff {
+		t.Errorf("defaults = %+v", th)
+	}
+	tdb.SetSetting("slo_p95_latency_ms", "1500")
+	tdb.SetSetting("slo_error_rate", "1.5")
+	tdb.SetSetting("slo_alert_cooloff_seconds", "60")
+	if th := sloThresholds(db.GetSetting); th.P95Latency != 1500*time.Millisecond || th.ErrorRate != 0 || th.Cooloff != time.Minute {
+		t.Errorf("thresholds = %+v", th)
+	}
+}
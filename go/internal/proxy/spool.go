@@ -0,0 +1,463 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// spooledBody is a request body above the spool threshold, kept in a temp file
+// under DATA_DIR/tmp instead of memory. Only the top-level fields the pipeline
+// needs are read; everything else is streamed from disk to the provider.
+type spooledBody struct {
+	file *os.File
+	size int64
+
+	// fields holds the raw JSON and byte span of selected top-level values.
+	fields map[string]rawSpan
+	// objStart is the offset of the document's opening brace.
+	objStart int64
+	// empty is set when the document is an object without members, so an
+	// inserted member must not end with a comma.
+	empty bool
+	// edits replaces top-level values when forwarding (model, clamped max_tokens).
+	edits map[string][]byte
+}
+
+type rawSpan struct {
+	start, end int64
+	// raw is nil when the value was too large to capture.
+	raw []byte
+	// member is the span that removes the key and value along with one
+	// adjoining comma.
+	member [2]int64
+}
+
+// maxCapturedField bounds how much of a scanned top-level value is kept in
+// memory. The fields the pipeline reads are small scalars.
+const maxCapturedField = 4096
+
+// spooledFields are the top-level fields read from spooled bodies.
+var spooledFields = []string{"model", "stream", "max_tokens", "max_completion_tokens", "user", "tools", "thinking", "reasoning_effort", "betas", "metadata", "store", "prediction"}
+
+// spoolThreshold returns the body size above which requests are spooled to
+// disk, from the body_spool_threshold_mb setting. 0 disables spooling.
+func spoolThreshold(getSetting func(string) string) int64 {
+	mb, err := strconv.ParseFloat(getSetting("body_spool_threshold_mb"), 64)
+	if err != nil || mb <= 0 {
+		return 0
+	}
+	return int64(mb * 1024 * 1024)
+}
+
+// readRequestBody reads the body into memory, or spools it to disk when it is
+// larger than threshold (threshold <= 0 always reads into memory).
+func readRequestBody(r io.Reader, threshold int64) ([]byte, *spooledBody, error) {
+	if threshold <= 0 {
+		b, err := io.ReadAll(r)
+		return b, nil, err
+	}
+
+	head, err := io.ReadAll(io.LimitReader(r, threshold+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(head)) <= threshold {
+		return head, nil, nil
+	}
+
+	dir := filepath.Join(getEnvDefault("DATA_DIR", "./data"), "tmp")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, nil, fmt.Errorf("create spool dir: %w", err)
+	}
+	f, err := os.CreateTemp(dir, "body-*.json")
+	if err != nil {
+		return nil, nil, fmt.Errorf("create spool file: %w", err)
+	}
+	sp := &spooledBody{file: f}
+
+	n, err := f.Write(head)
+	head = nil
+	if err == nil {
+		var rest int64
+		rest, err = io.Copy(f, r)
+		sp.size = int64(n) + rest
+	}
+	if err != nil {
+		sp.Close()
+		return nil, nil, err
+	}
+	return nil, sp, nil
+}
+
+// Close removes the spool file.
+func (s *spooledBody) Close() {
+	if s == nil || s.file == nil {
+		return
+	}
+	s.file.Close()
+	os.Remove(s.file.Name())
+	s.file = nil
+}
+
+// scan records the top-level fields listed in spooledFields without decoding
+// the rest of the document.
+func (s *spooledBody) scan() error {
+	want := make(map[string]bool, len(spooledFields))
+	for _, k := range spooledFields {
+		want[k] = true
+	}
+	fields, objStart, err := scanTopLevel(io.NewSectionReader(s.file, 0, s.size), want)
+	if err != nil {
+		return err
+	}
+	s.fields, s.objStart = fields, objStart
+	sc := &byteScanner{r: bufio.NewReader(io.NewSectionReader(s.file, objStart+1, s.size-objStart-1))}
+	c, err := sc.nonSpace()
+	s.empty = err == nil && c == '}'
+	return nil
+}
+
+// stringField returns a scanned top-level string value.
+func (s *spooledBody) stringField(key string) (string, bool) {
+	var v string
+	f, ok := s.fields[key]
+	if !ok || json.Unmarshal(f.raw, &v) != nil {
+		return "", false
+	}
+	return v, true
+}
+
+// numberField returns a scanned top-level numeric value.
+func (s *spooledBody) numberField(key string) (float64, bool) {
+	var v float64
+	f, ok := s.fields[key]
+	if !ok || json.Unmarshal(f.raw, &v) != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// boolField returns a scanned top-level boolean value.
+func (s *spooledBody) boolField(key string) (bool, bool) {
+	var v bool
+	f, ok := s.fields[key]
+	if !ok || json.Unmarshal(f.raw, &v) != nil {
+		return false, false
+	}
+	return v, true
+}
+
+// setField replaces a scanned top-level value in the forwarded body, or
+// inserts it after the opening brace if the body doesn't have it.
+func (s *spooledBody) setField(key string, value any) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+	if _, ok := s.fields[key]; !ok {
+		k, _ := json.Marshal(key)
+		b = append(append(append(k, ':'), b...), ',')
+		s.fields[key] = rawSpan{start: s.objStart + 1, end: s.objStart + 1}
+	}
+	if s.edits == nil {
+		s.edits = make(map[string][]byte)
+	}
+	s.edits[key] = b
+}
+
+// removeField drops a scanned top-level key from the forwarded body.
+func (s *spooledBody) removeField(key string) {
+	f, ok := s.fields[key]
+	if !ok {
+		return
+	}
+	s.fields[key] = rawSpan{start: f.member[0], end: f.member[1], raw: f.raw, member: f.member}
+	if s.edits == nil {
+		s.edits = make(map[string][]byte)
+	}
+	s.edits[key] = []byte{}
+}
+
+// reader returns a fresh reader over the spooled body with edits applied, and
+// its length. Each call starts from the beginning so failover can replay it.
+func (s *spooledBody) reader() (io.Reader, int64) {
+	type edit struct {
+		key  string
+		span rawSpan
+		b    []byte
+	}
+	edits := make([]edit, 0, len(s.edits))
+	for k, b := range s.edits {
+		edits = append(edits, edit{key: k, span: s.fields[k], b: b})
+	}
+	sort.Slice(edits, func(i, j int) bool {
+		if edits[i].span.start != edits[j].span.start {
+			return edits[i].span.start < edits[j].span.start
+		}
+		return edits[i].key < edits[j].key
+	})
+	if s.empty {
+		// Inserted members all sit after the brace; the last needs no comma
+		last := -1
+		for i, e := range edits {
+			if e.span.start == s.objStart+1 && e.span.end == e.span.start {
+				last = i
+			}
+		}
+		if last >= 0 {
+			edits[last].b = bytes.TrimSuffix(edits[last].b, []byte{','})
+		}
+	}
+
+	var parts []io.Reader
+	var pos, length int64
+	for _, e := range edits {
+		parts = append(parts, io.NewSectionReader(s.file, pos, e.span.start-pos), bytes.NewReader(e.b))
+		length += e.span.start - pos + int64(len(e.b))
+		pos = e.span.end
+	}
+	parts = append(parts, io.NewSectionReader(s.file, pos, s.size-pos))
+	length += s.size - pos
+	return io.MultiReader(parts...), length
+}
+
+// load reads the whole spooled body, with edits applied, into memory. Used
+// when a candidate needs format conversion, which works on the decoded document.
+func (s *spooledBody) load() ([]byte, error) {
+	r, _ := s.reader()
+	return io.ReadAll(r)
+}
+
+// ─── Top-level scanner ──────────────────────────────────────────────────────
+
+var errNotObject = errors.New("request body is not a JSON object")
+
+// scanTopLevel walks a JSON object and returns the byte spans of the wanted
+// top-level keys, including those whose values are too large to capture.
+// Nested values are skipped byte by byte, so memory use does not depend on
+// the document size.
+func scanTopLevel(r io.Reader, want map[string]bool) (map[string]rawSpan, int64, error) {
+	sc := &byteScanner{r: bufio.NewReaderSize(r, 64*1024)}
+	fields := make(map[string]rawSpan)
+
+	c, err := sc.nonSpace()
+	if err != nil {
+		return nil, 0, err
+	}
+	if c != '{' {
+		return nil, 0, errNotObject
+	}
+	objStart := sc.pos - 1
+	prevComma := int64(-1)
+
+	for {
+		c, err := sc.nonSpace()
+		if err != nil {
+			return nil, 0, err
+		}
+		if c == '}' {
+			return fields, objStart, nil
+		}
+		if c != '"' {
+			return nil, 0, fmt.Errorf("expected object key at offset %d", sc.pos-1)
+		}
+		keyStart := sc.pos - 1
+		key, err := sc.readKey()
+		if err != nil {
+			return nil, 0, err
+		}
+		if c, err = sc.nonSpace(); err != nil {
+			return nil, 0, err
+		}
+		if c != ':' {
+			return nil, 0, fmt.Errorf("expected ':' at offset %d", sc.pos-1)
+		}
+		if c, err = sc.nonSpace(); err != nil {
+			return nil, 0, err
+		}
+
+		start := sc.pos - 1
+		raw, end, next, err := sc.skipValue(c, want[key])
+		if err != nil {
+			return nil, 0, err
+		}
+		if want[key] {
+			member := [2]int64{keyStart, end}
+			switch {
+			case next == ',':
+				member[1] = sc.pos
+			case prevComma >= 0:
+				member[0] = prevComma
+			}
+			fields[key] = rawSpan{start: start, end: end, raw: raw, member: member}
+		}
+
+		switch next {
+		case ',':
+			prevComma = sc.pos - 1
+		case '}':
+			return fields, objStart, nil
+		default:
+			return nil, 0, fmt.Errorf("unexpected %q at offset %d", next, sc.pos-1)
+		}
+	}
+}
+
+type byteScanner struct {
+	r   *bufio.Reader
+	pos int64
+
+	// capture collects the bytes of the current value while capturing; it is
+	// dropped once the value grows beyond maxCapturedField.
+	capture   []byte
+	capturing bool
+}
+
+func (s *byteScanner) next() (byte, error) {
+	c, err := s.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	s.pos++
+	if s.capturing {
+		if len(s.capture) >= maxCapturedField {
+			s.capture, s.capturing = nil, false
+		} else {
+			s.capture = append(s.capture, c)
+		}
+	}
+	return c, nil
+}
+
+func (s *byteScanner) nonSpace() (byte, error) {
+	for {
+		c, err := s.next()
+		if err != nil {
+			return 0, err
+		}
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			continue
+		}
+		return c, nil
+	}
+}
+
+// readKey reads an object key after its opening quote.
+func (s *byteScanner) readKey() (string, error) {
+	buf := []byte{'"'}
+	for {
+		c, err := s.next()
+		if err != nil {
+			return "", err
+		}
+		buf = append(buf, c)
+		switch c {
+		case '"':
+			var key string
+			if err := json.Unmarshal(buf, &key); err != nil {
+				return "", err
+			}
+			return key, nil
+		case '\\':
+			e, err := s.next()
+			if err != nil {
+				return "", err
+			}
+			buf = append(buf, e)
+		}
+	}
+}
+
+// skipString consumes a string after its opening quote.
+func (s *byteScanner) skipString() error {
+	for {
+		c, err := s.next()
+		if err != nil {
+			return err
+		}
+		switch c {
+		case '"':
+			return nil
+		case '\\':
+			if _, err := s.next(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// skipValue consumes the value starting with first. It returns the value's raw
+// bytes when capture is set (nil if too large), the offset just past the value,
+// and the next structural byte after it (',' or '}' at the top level).
+func (s *byteScanner) skipValue(first byte, capture bool) (raw []byte, end int64, next byte, err error) {
+	if capture {
+		s.capture, s.capturing = []byte{first}, true
+	}
+	defer func() { s.capture, s.capturing = nil, false }()
+
+	switch first {
+	case '"':
+		if err := s.skipString(); err != nil {
+			return nil, 0, 0, err
+		}
+	case '{', '[':
+		depth := 1
+		for depth > 0 {
+			c, err := s.next()
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			switch c {
+			case '"':
+				if err := s.skipString(); err != nil {
+					return nil, 0, 0, err
+				}
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+			}
+		}
+	default:
+		// Scalar: runs until whitespace or a structural byte
+		for {
+			c, err := s.next()
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			switch c {
+			case ' ', '\t', '\n', '\r', ',', '}':
+				end = s.pos - 1
+				if s.capturing {
+					raw = s.capture[:len(s.capture)-1]
+				}
+				s.capturing = false
+				if c == ',' || c == '}' {
+					return raw, end, c, nil
+				}
+				next, err = s.nonSpace()
+				return raw, end, next, err
+			}
+		}
+	}
+
+	end = s.pos
+	if s.capturing {
+		raw = s.capture
+	}
+	s.capturing = false
+	next, err = s.nonSpace()
+	return raw, end, next, err
+}
@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"bytes"
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/guardrails"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func spoolString(t *testing.T, body string) *spooledBody {
+	t.Helper()
+	t.Setenv("DATA_DIR", t.TempDir())
+	raw, sp, err := readRequestBody(strings.NewReader(body), 1)
+	if err != nil {
+		t.Fatalf("readRequestBody: %v", err)
+	}
+	if raw != nil || sp == nil {
+		t.Fatal("expected body to be spooled")
+	}
+	t.Cleanup(sp.Close)
+	if err := sp.scan(); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	return sp
+}
+
+func TestScanTopLevel_Fields(t *testing.T) {
+	body := `{"messages":[{"role":"user","content":"say \"model\": {x}"}],` +
+		` "model" : "claude-sonnet-4-6", "stream":true,"max_tokens":1024 ,"nested":{"model":"nope"}}`
+	sp := spoolString(t, body)
+
+	if m, ok := sp.stringField("model"); !ok || m != "claude-sonnet-4-6" {
+		t.Errorf("model = %q, %v", m, ok)
+	}
+	if s, ok := sp.boolField("stream"); !ok || !s {
+		t.Errorf("stream = %v, %v", s, ok)
+	}
+	if n, ok := sp.numberField("max_tokens"); !ok || n != 1024 {
+		t.Errorf("max_tokens = %v, %v", n, ok)
+	}
+	if _, ok := sp.numberField("max_completion_tokens"); ok {
+		t.Error("max_completion_tokens should be absent")
+	}
+}
+
+func TestScanTopLevel_Invalid(t *testing.T) {
+	for _, body := range []string{`[1,2]`, `{"model":"x"`, `{"model" "x"}`, `{"a":[1,2}`} {
+		_, _, err := scanTopLevel(strings.NewReader(body), map[string]bool{"model": true})
+		if err == nil {
+			t.Errorf("scanTopLevel(%q) should fail", body)
+		}
+	}
+}
+
+func TestSpooledBody_Edits(t *testing.T) {
+	sp := spoolString(t, `{"model":"gpt-4o","max_tokens":999999,"messages":[]}`)
+	sp.setField("model", "gpt-4o-mini")
+	sp.setField("max_tokens", 4096)
+	sp.setField("stream", true)
+
+	got, err := sp.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"stream":true,"model":"gpt-4o-mini","max_tokens":4096,"messages":[]}`
+	if string(got) != want {
+		t.Errorf("edited body = %s\nwant %s", got, want)
+	}
+	if _, n := sp.reader(); n != int64(len(want)) {
+		t.Errorf("reader length = %d, want %d", n, len(want))
+	}
+
+	// Each reader replays from the start
+	again, _ := sp.load()
+	if !bytes.Equal(got, again) {
+		t.Error("second load differs from first")
+	}
+}
+
+func TestSpooledBody_InsertIntoEmptyObject(t *testing.T) {
+	for _, body := range []string{`{}`, `{ }`, " {\n}"} {
+		sp := spoolString(t, body)
+		sp.setField("user", "u1")
+		sp.setField("model", "m")
+		got, err := sp.load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var parsed map[string]any
+		if err := json.Unmarshal(got, &parsed); err != nil || parsed["user"] != "u1" || parsed["model"] != "m" {
+			t.Errorf("%q with inserts = %s (%v)", body, got, err)
+		}
+	}
+}
+
+func TestSpooledRequest_GuardrailsAnonymize(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("body_spool_threshold_mb", "0.0001")
+	tdb.SetSetting("privacy_enabled", "true")
+	guardrails.InitGuardrails()
+
+	var received []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","model":"claude-sonnet-4-6","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-spool-pii", "pii", "anthropic", upstream.URL)
+
+	body := `{"model":"claude-sonnet-4-6","max_tokens":16,"messages":[{"role":"user","content":"call 415-555-0134` +
+		strings.Repeat(" ", 200) + `"}]}`
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if len(received) == 0 || bytes.Contains(received, []byte("415-555-0134")) {
+		t.Errorf("upstream got the spooled body unanonymized: %.120s", received)
+	}
+}
+
+func TestReadRequestBody_Threshold(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+
+	raw, sp, err := readRequestBody(strings.NewReader(`{"a":1}`), 7)
+	if err != nil || sp != nil || string(raw) != `{"a":1}` {
+		t.Fatalf("at threshold: raw=%q spool=%v err=%v", raw, sp, err)
+	}
+
+	raw, sp, err = readRequestBody(strings.NewReader(`{"a":12}`), 7)
+	if err != nil || sp == nil || raw != nil {
+		t.Fatalf("over threshold: raw=%q spool=%v err=%v", raw, sp, err)
+	}
+	if sp.size != 8 {
+		t.Errorf("spool size = %d, want 8", sp.size)
+	}
+	name := sp.file.Name()
+	sp.Close()
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("spool file not removed: %v", err)
+	}
+}
+
+func TestSpoolThreshold(t *testing.T) {
+	cases := map[string]int64{"": 0, "0": 0, "-1": 0, "abc": 0, "8": 8 << 20, "0.5": 512 << 10}
+	for v, want := range cases {
+		got := spoolThreshold(func(string) string { return v })
+		if got != want {
+			t.Errorf("spoolThreshold(%q) = %d, want %d", v, got, want)
+		}
+	}
+}
+
+// syntheticImageBody produces a Messages request carrying size bytes of
+// base64 image data without holding it in memory.
+func syntheticImageBody(size int64) io.Reader {
+	head := `{"model":"claude-sonnet-4-6","max_tokens":16,"messages":[{"role":"user","content":[` +
+		`{"type":"image","source":{"type":"base64","media_type":"image/png","data":"`
+	tail := `"}},{"type":"text","text":"describe"}]}]}`
+	return io.MultiReader(strings.NewReader(head), io.LimitReader(repeatReader('A'), size), strings.NewReader(tail))
+}
+
+type repeatReader byte
+
+func (r repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+func TestSpooledRequest_StreamsLargeBody(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("body_spool_threshold_mb", "1")
+	tdb.SetSetting("request_logging", "true")
+	tdb.SetSetting("detailed_request_logging", "true")
+
+	const imageBytes = 50 << 20
+	var received int64
+	var upstreamModel string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		head := make([]byte, 256)
+		n, _ := io.ReadFull(r.Body, head)
+		if i := bytes.Index(head[:n], []byte(`"model":"`)); i >= 0 {
+			rest := head[i+len(`"model":"`) : n]
+			upstreamModel = string(rest[:bytes.IndexByte(rest, '"')])
+		}
+		rest, _ := io.Copy(io.Discard, r.Body)
+		received = int64(n) + rest
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","model":"claude-sonnet-4-6","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-big", "big", "anthropic", upstream.URL)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	req := httptest.NewRequest("POST", "/v1/messages", syntheticImageBody(imageBytes))
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+
+	runtime.ReadMemStats(&after)
+
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if received < imageBytes {
+		t.Errorf("upstream received %d bytes, want > %d", received, imageBytes)
+	}
+	if upstreamModel != "claude-sonnet-4-6" {
+		t.Errorf("upstream model = %q", upstreamModel)
+	}
+	// Buffering the body in memory would allocate at least its size; the
+	// spooled path only allocates copy buffers and the 1MB head.
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 20<<20 {
+		t.Errorf("allocated %d MB while proxying a %d MB body", alloc>>20, imageBytes>>20)
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(tdb.Dir, "tmp"))
+	if len(entries) != 0 {
+		t.Errorf("spool files left behind: %d", len(entries))
+	}
+
+	var logged string
+	waitFor(t, func() bool {
+		return tdb.QueryRow("SELECT request_body FROM request_logs").Scan(&logged) == nil
+	})
+	if !strings.HasPrefix(logged, "[spooled request body:") {
+		t.Errorf("logged request body = %.80q", logged)
+	}
+}
+
+func TestSpooledRequest_InvalidJSON(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("body_spool_threshold_mb", "0.0001")
+
+	body := `{"model":"claude-sonnet-4-6","messages":` + strings.Repeat(" ", 200)
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+
+	if w.Code != 400 {
+		t.Fatalf("status = %d, want 400", w.Code)
+	}
+	var resp map[string]any
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp["type"] != "error" {
+		t.Errorf("expected anthropic error envelope, got %s", w.Body.String())
+	}
+}
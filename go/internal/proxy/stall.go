@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/convert"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultClientStallTimeout is how long a write to the client may block when
+// stream_stall_timeout_seconds isn't set.
+const defaultClientStallTimeout = 60 * time.Second
+
+// terminationClientStalled is logged as the termination_reason of responses
+// abandoned because the client stopped reading.
+const terminationClientStalled = "client_stalled"
+
+// terminationClientDisconnected is logged as the termination_reason of
+// responses abandoned because the client went away.
+const terminationClientDisconnected = "client_disconnected"
+
+// clientStallTimeout reads stream_stall_timeout_seconds through getSetting.
+func clientStallTimeout(getSetting func(string) string) time.Duration {
+	if s, err := strconv.Atoi(getSetting("stream_stall_timeout_seconds")); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return defaultClientStallTimeout
+}
+
+// streamPingInterval returns how long a stream converted to Anthropic format
+// may go without output before a ping event is sent: stream_ping_seconds,
+// where 0 turns pings off, or 15 seconds.
+func streamPingInterval(getSetting func(string) string) time.Duration {
+	if s, err := strconv.Atoi(getSetting("stream_ping_seconds")); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second
+	}
+	return convert.DefaultPingInterval
+}
+
+// copyStream copies src to the client, flushing after every chunk, and closes
+// src when done. Each write and flush gets a fresh write deadline, so a client
+// that stops reading (a suspended laptop, a zero TCP window) fails the write
+// after timeout instead of blocking it, and the upstream, forever. ctx is the
+// client request's: src is expected to be read from an upstream request
+// made with it, so a client that goes away fails the read at once instead
+// of at the next chunk. It returns ctx's error if the client went away, the
+// write error that ended the copy, or nil if src ran out.
+func copyStream(ctx context.Context, w http.ResponseWriter, src io.ReadCloser, timeout time.Duration) error {
+	defer src.Close()
+	rc := http.NewResponseController(w)
+	// The connection may serve further requests; they get no deadline
+	defer rc.SetWriteDeadline(time.Time{})
+
+	buf := make([]byte, 32*1024)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			rc.SetWriteDeadline(time.Now().Add(timeout))
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				return err
+			}
+		}
+		if readErr != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// writeBody writes a whole non-streaming response body under a single write
+// deadline.
+func writeBody(w http.ResponseWriter, body []byte, timeout time.Duration) error {
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Now().Add(timeout))
+	defer rc.SetWriteDeadline(time.Time{})
+	_, err := w.Write(body)
+	return err
+}
+
+// clientStalled reports whether a write failed on its deadline rather than
+// because the client went away.
+func clientStalled(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/cooldown"
+	"codegate-proxy/internal/dbtest"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stalledWriter is a client that never reads: once headers are sent, every
+// write blocks until the write deadline passes.
+type stalledWriter struct {
+	*httptest.ResponseRecorder
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (w *stalledWriter) SetWriteDeadline(d time.Time) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.deadline = d
+	return nil
+}
+
+func (w *stalledWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	d := w.deadline
+	w.mu.Unlock()
+	if d.IsZero() {
+		d = time.Now().Add(30 * time.Second)
+	}
+	time.Sleep(time.Until(d))
+	return 0, os.ErrDeadlineExceeded
+}
+
+func TestClientStall_AbortsStream(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("stream_stall_timeout_seconds", "1")
+
+	upstreamDone := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(upstreamDone)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for {
+			fmt.Fprint(w, "event: ping\ndata: {\"type\":\"ping\"}\n\n")
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-stall", "stall", "anthropic", upstream.URL)
+
+	req := httptest.NewRequest("POST", "/v1/messages",
+		strings.NewReader(`{"model":"claude-sonnet-4-6","stream":true,"max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`))
+	w := &stalledWriter{ResponseRecorder: httptest.NewRecorder()}
+
+	start := time.Now()
+	Handler().ServeHTTP(w, req)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("handler returned after %s, want about the 1s stall timeout", elapsed)
+	}
+
+	select {
+	case <-upstreamDone:
+	case <-time.After(5 * time.Second):
+		t.Error("upstream stream still open after the client stalled")
+	}
+}
+
+func TestClientStallTimeout(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":    defaultClientStallTimeout,
+		"abc": defaultClientStallTimeout,
+		"0":   defaultClientStallTimeout,
+		"15":  15 * time.Second,
+	}
+	for v, want := range cases {
+		got := clientStallTimeout(func(string) string { return v })
+		if got != want {
+			t.Errorf("stream_stall_timeout_seconds=%q: got %s, want %s", v, got, want)
+		}
+	}
+}
+
+// streamingWriter is a client that signals wrote once the stream starts.
+type streamingWriter struct {
+	*httptest.ResponseRecorder
+	once  sync.Once
+	wrote chan struct{}
+}
+
+func (w *streamingWriter) Write(b []byte) (int, error) {
+	defer w.once.Do(func() { close(w.wrote) })
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestClientDisconnect_CancelsUpstream(t *testing.T) {
+	const body = `{"model":"claude-sonnet-4-6","stream":true,"max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`
+
+	t.Run("mid-stream", func(t *testing.T) {
+		tdb := dbtest.Open(t)
+		upstreamClosed := make(chan struct{})
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"model\":\"claude-sonnet-4-6\",\"usage\":{\"input_tokens\":42,\"output_tokens\":1}}}\n\n")
+			fmt.Fprint(w, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Once upon\"}}\n\n")
+			w.(http.Flusher).Flush()
+			// Still generating until the proxy goes away
+			<-r.Context().Done()
+			close(upstreamClosed)
+		}))
+		defer upstream.Close()
+		tdb.AddAccount("acct-gone", "gone", "anthropic", upstream.URL)
+		t.Cleanup(func() { cooldown.Clear("acct-gone") })
+
+		ctx, cancel := context.WithCancel(context.Background())
+		w := &streamingWriter{ResponseRecorder: httptest.NewRecorder(), wrote: make(chan struct{})}
+		handlerDone := make(chan struct{})
+		go func() {
+			defer close(handlerDone)
+			req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(body)).WithContext(ctx)
+			Handler().ServeHTTP(w, req)
+		}()
+		<-w.wrote
+		cancel()
+
+		select {
+		case <-upstreamClosed:
+		case <-time.After(2 * time.Second):
+			t.Fatal("upstream request still open after the client disconnected")
+		}
+		select {
+		case <-handlerDone:
+		case <-time.After(2 * time.Second):
+			t.Fatal("handler still copying after the client disconnected")
+		}
+
+		// Usage counted before the disconnect is still recorded
+		var input int
+		waitFor(t, func() bool {
+			return tdb.QueryRow("SELECT input_tokens FROM usage WHERE account_id = 'acct-gone'").Scan(&input) == nil
+		})
+		if input != 42 {
+			t.Errorf("input_tokens = %d, want 42", input)
+		}
+	})
+
+	t.Run("before the response", func(t *testing.T) {
+		tdb := dbtest.Open(t)
+		received, upstreamClosed := make(chan struct{}), make(chan struct{})
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			close(received)
+			<-r.Context().Done()
+			close(upstreamClosed)
+		}))
+		defer upstream.Close()
+		tdb.AddAccount("acct-slow", "slow", "anthropic", upstream.URL)
+		t.Cleanup(func() { cooldown.Clear("acct-slow") })
+
+		ctx, cancel := context.WithCancel(context.Background())
+		handlerDone := make(chan struct{})
+		go func() {
+			defer close(handlerDone)
+			req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(body)).WithContext(ctx)
+			Handler().ServeHTTP(httptest.NewRecorder(), req)
+		}()
+		<-received
+		cancel()
+
+		select {
+		case <-upstreamClosed:
+		case <-time.After(2 * time.Second):
+			t.Fatal("upstream request still open after the client disconnected")
+		}
+		<-handlerDone
+		// The client leaving isn't the account's failure
+		if cooldown.IsOnCooldown("acct-slow") {
+			t.Error("account put on cooldown after the client disconnected")
+		}
+	})
+}
@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/cooldown"
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/guardrails"
+	"codegate-proxy/internal/health"
+	"codegate-proxy/internal/subscription"
+	"codegate-proxy/internal/tenant"
+	"encoding/json"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// statusCacheTTL bounds how often /admin/status hits the database.
+const statusCacheTTL = 5 * time.Second
+
+type accountStatus struct {
+	ID                  string   `json:"id"`
+	Name                string   `json:"name"`
+	Provider            string   `json:"provider"`
+	Enabled             bool     `json:"enabled"`
+	Status              string   `json:"status"`
+	ErrorCount          int      `json:"error_count"`
+	LastError           string   `json:"last_error,omitempty"`
+	CooldownRemainingMs int64    `json:"cooldown_remaining_ms"`
+	SuccessRate         *float64 `json:"success_rate"` // over health.DefaultWindow; null without recent requests
+	RecentRequests      int      `json:"recent_requests"`
+	RequestsToday       int      `json:"requests_today"`
+	CostTodayUSD        float64  `json:"cost_today_usd"`
+
+	// Subscription windows as of the account's last response; only
+	// accounts that report them (Claude subscriptions) have any
+	SubscriptionWindows  []windowStatus `json:"subscription_windows,omitempty"`
+	WindowExhaustedUntil *time.Time     `json:"window_exhausted_until,omitempty"`
+}
+
+type windowStatus struct {
+	Name         string    `json:"name"`
+	Status       string    `json:"status,omitempty"`
+	RemainingPct float64   `json:"remaining_pct"`
+	ResetsAt     time.Time `json:"resets_at"`
+}
+
+type configStatus struct {
+	Name     string `json:"name"`
+	Strategy string `json:"strategy"`
+}
+
+type statusSnapshot struct {
+	GeneratedAt       time.Time            `json:"generated_at"`
+	Accounts          []accountStatus      `json:"accounts"`
+	ActiveConfig      *configStatus        `json:"active_config"`
+	Tenants           int                  `json:"tenants"`
+	GuardrailsEnabled bool                 `json:"guardrails_enabled"`
+	DatabaseWritable  bool                 `json:"database_writable"`
+	Latency           []health.LatencyStat `json:"latency"` // p95 per provider/model over health.DefaultWindow
+	Alerts            []health.Alert       `json:"alerts"`  // SLO breaches in effect
+}
+
+var statusCache struct {
+	mu      sync.Mutex
+	snap    *statusSnapshot
+	expires time.Time
+}
+
+// handleStatus serves a compact snapshot of proxy state so operators can
+// check on accounts while the dashboard is down. ?format=html renders it as
+// a plain page. It requires PROXY_API_KEY when one is set, and is refused
+// to tenant keys.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		writeError(w, r, "anthropic", 401, "authentication_error", "Admin status requires the proxy API key")
+		return
+	}
+
+	snap, err := currentStatus()
+	if err != nil {
+		log.Printf("[status] Failed to build snapshot: %v", err)
+		writeError(w, r, "anthropic", 500, "api_error", "Failed to read status")
+		return
+	}
+
+	if r.URL.Query().Get("format") == "html" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusTemplate.Execute(w, snap); err != nil {
+			log.Printf("[status] Template error: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snap)
+}
+
+// adminAuthorized allows the global proxy key, or anyone on an open proxy
+// (no global key and no tenants).
+func adminAuthorized(r *http.Request) bool {
+	globalKey := getEnvDefault("PROXY_API_KEY", "")
+	if globalKey == "" {
+		return !tenant.HasTenants()
+	}
+	return extractAPIKey(r) == globalKey
+}
+
+// currentStatus returns the cached snapshot, rebuilding it once it expires.
+func currentStatus() (*statusSnapshot, error) {
+	statusCache.mu.Lock()
+	defer statusCache.mu.Unlock()
+
+	if statusCache.snap != nil && time.Now().Before(statusCache.expires) {
+		return statusCache.snap, nil
+	}
+	snap, err := buildStatus()
+	if err != nil {
+		return nil, err
+	}
+	statusCache.snap = snap
+	statusCache.expires = time.Now().Add(statusCacheTTL)
+	return snap, nil
+}
+
+func buildStatus() (*statusSnapshot, error) {
+	rows, err := db.GetAccountStatuses()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := db.GetActiveConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &statusSnapshot{
+		GeneratedAt:       time.Now().UTC(),
+		Accounts:          make([]accountStatus, 0, len(rows)),
+		Tenants:           db.CountTenants(),
+		GuardrailsEnabled: guardrails.IsGuardrailsEnabled(),
+		DatabaseWritable:  db.Writable(),
+		Latency:           health.LatencySnapshot(health.DefaultWindow),
+		Alerts:            health.ActiveAlerts(),
+	}
+	if cfg != nil {
+		snap.ActiveConfig = &configStatus{Name: cfg.Name, Strategy: cfg.RoutingStrategy}
+	}
+
+	cooling := cooldown.Snapshot()
+	windows := subscription.Snapshot()
+	for _, a := range rows {
+		var successRate *float64
+		rate, recent := health.SuccessRate(a.ID, health.DefaultWindow)
+		if recent > 0 {
+			successRate = &rate
+		}
+		st := accountStatus{
+			ID:                  a.ID,
+			Name:                a.Name,
+			Provider:            a.Provider,
+			Enabled:             a.Enabled,
+			Status:              string(a.Status),
+			ErrorCount:          a.ErrorCount,
+			LastError:           a.LastError,
+			CooldownRemainingMs: cooling[a.ID].Milliseconds(),
+			SuccessRate:         successRate,
+			RecentRequests:      recent,
+			RequestsToday:       a.RequestsToday,
+			CostTodayUSD:        math.Round(a.CostToday*1e6) / 1e6,
+		}
+		if sub, ok := windows[a.ID]; ok {
+			for _, w := range sub.Windows {
+				st.SubscriptionWindows = append(st.SubscriptionWindows, windowStatus{
+					Name:         w.Name,
+					Status:       w.Status,
+					RemainingPct: math.Round(max(0, 1-w.Utilization)*1000) / 10,
+					ResetsAt:     w.ResetsAt.UTC(),
+				})
+			}
+			if !sub.ExhaustedUntil.IsZero() {
+				until := sub.ExhaustedUntil.UTC()
+				st.WindowExhaustedUntil = &until
+			}
+		}
+		snap.Accounts = append(snap.Accounts, st)
+	}
+	return snap, nil
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"pct": func(f *float64) float64 { return *f * 100 },
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>CodeGate status</title>
+<style>body{font-family:monospace;margin:2em}table{border-collapse:collapse}td,th{border:1px solid #ccc;padding:4px 8px;text-align:left}</style>
+</head><body>
+<h1>CodeGate status</h1>
+<p>Generated {{.GeneratedAt.Format "2006-01-02 15:04:05 UTC"}}</p>
+<p>Active config: {{with .ActiveConfig}}{{.Name}} ({{.Strategy}}){{else}}none{{end}}
+ &middot; Tenants: {{.Tenants}}
+ &middot; Guardrails: {{if .GuardrailsEnabled}}on{{else}}off{{end}}
+ &middot; Database: {{if .DatabaseWritable}}writable{{else}}read-only{{end}}</p>
+<table>
+<tr><th>Account</th><th>Provider</th><th>Enabled</th><th>Status</th><th>Errors</th><th>Cooldown (ms)</th><th>Success (10m)</th><th>Requests today</th><th>Cost today</th><th>Window left</th><th>Last error</th></tr>
+{{range .Accounts}}<tr><td>{{.Name}}</td><td>{{.Provider}}</td><td>{{.Enabled}}</td><td>{{.Status}}</td><td>{{.ErrorCount}}</td><td>{{.CooldownRemainingMs}}</td><td>{{with .SuccessRate}}{{printf "%.0f%%" (pct .)}}{{else}}-{{end}} ({{.RecentRequests}})</td><td>{{.RequestsToday}}</td><td>${{printf "%.4f" .CostTodayUSD}}</td><td>{{range .SubscriptionWindows}}{{.Name}} {{printf "%.0f%%" .RemainingPct}} {{end}}{{with .WindowExhaustedUntil}}(exhausted until {{.Format "15:04 UTC"}}){{end}}</td><td>{{.LastError}}</td></tr>
+{{end}}</table>
+{{with .Alerts}}<h2>SLO alerts</h2>
+<table>
+<tr><th>Kind</th><th>Tenant</th><th>Subject</th><th>Value</th><th>Threshold</th><th>Requests</th><th>Since</th></tr>
+{{range .}}<tr><td>{{.Kind}}</td><td>{{.Tenant}}</td><td>{{.Subject}}</td><td>{{printf "%.3g" .Value}}</td><td>{{printf "%.3g" .Threshold}}</td><td>{{.Samples}}</td><td>{{.Since.Format "15:04:05 UTC"}}</td></tr>
+{{end}}</table>{{end}}
+{{with .Latency}}<h2>Latency (10m)</h2>
+<table>
+<tr><th>Tenant</th><th>Provider</th><th>Model</th><th>p95 (ms)</th><th>Requests</th></tr>
+{{range .}}<tr><td>{{.Tenant}}</td><td>{{.Provider}}</td><td>{{.Model}}</td><td>{{.P95Ms}}</td><td>{{.Samples}}</td></tr>
+{{end}}</table>{{end}}
+</body></html>
+`))
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/cooldown"
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/health"
+	"codegate-proxy/internal/tenant"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func resetStatusCache(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		statusCache.mu.Lock()
+		statusCache.snap = nil
+		statusCache.mu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func getStatus(t *testing.T, target, apiKey string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("GET", target, nil)
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminStatus_JSON(t *testing.T) {
+	tdb := dbtest.Open(t)
+	resetStatusCache(t)
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+
+	tdb.AddAccount("acct-a", "alpha", "anthropic", "")
+	tdb.AddAccount("acct-b", "beta", "openai", "")
+	tdb.Exec("UPDATE accounts SET status = 'error', error_count = 3, last_error = 'Server error (502)' WHERE id = 'acct-b'")
+	tdb.Exec("INSERT INTO usage (id, account_id, cost_usd) VALUES ('u1', 'acct-a', 0.25), ('u2', 'acct-a', 0.5)")
+	tdb.Exec("INSERT INTO usage (id, account_id, cost_usd, created_at) VALUES ('u3', 'acct-a', 9, datetime('now', '-2 days'))")
+	tdb.Exec("INSERT INTO configs (id, name, is_active, routing_strategy) VALUES ('cfg', 'Main', 1, 'round-robin')")
+	tdb.SetSetting("privacy_enabled", "true")
+	cooldown.Set("acct-b", "test", 30)
+	t.Cleanup(func() { cooldown.Clear("acct-b") })
+	health.Reset()
+	t.Cleanup(health.Reset)
+	health.RecordSuccess("acct-b")
+	health.RecordFailure("acct-b")
+	health.RecordFailure("acct-b")
+	health.RecordFailure("acct-b")
+
+	w := getStatus(t, "/admin/status", "")
+	if w.Code != 200 {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	var snap struct {
+		Accounts []struct {
+			ID                  string   `json:"id"`
+			Status              string   `json:"status"`
+			ErrorCount          int      `json:"error_count"`
+			LastError           string   `json:"last_error"`
+			CooldownRemainingMs int64    `json:"cooldown_remaining_ms"`
+			SuccessRate         *float64 `json:"success_rate"`
+			RecentRequests      int      `json:"recent_requests"`
+			RequestsToday       int      `json:"requests_today"`
+			CostTodayUSD        float64  `json:"cost_today_usd"`
+		} `json:"accounts"`
+		ActiveConfig *struct {
+			Name     string `json:"name"`
+			Strategy string `json:"strategy"`
+		} `json:"active_config"`
+		Tenants           *int  `json:"tenants"`
+		GuardrailsEnabled bool  `json:"guardrails_enabled"`
+		DatabaseWritable  *bool `json:"database_writable"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &snap); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+
+	if len(snap.Accounts) != 2 {
+		t.Fatalf("accounts = %+v", snap.Accounts)
+	}
+	byID := map[string]int{}
+	for i, a := range snap.Accounts {
+		byID[a.ID] = i
+	}
+	a, b := snap.Accounts[byID["acct-a"]], snap.Accounts[byID["acct-b"]]
+	if a.RequestsToday != 2 || a.CostTodayUSD != 0.75 {
+		t.Errorf("alpha today = %d requests, $%v; want 2, $0.75", a.RequestsToday, a.CostTodayUSD)
+	}
+	if b.Status != "error" || b.ErrorCount != 3 || b.LastError != "Server error (502)" {
+		t.Errorf("beta = %+v", b)
+	}
+	if b.CooldownRemainingMs <= 25000 || b.CooldownRemainingMs > 30000 {
+		t.Errorf("beta cooldown_remaining_ms = %d, want ~30000", b.CooldownRemainingMs)
+	}
+	if b.SuccessRate == nil || *b.SuccessRate != 0.25 || b.RecentRequests != 4 {
+		t.Errorf("beta success_rate = %v over %d, want 0.25 over 4", b.SuccessRate, b.RecentRequests)
+	}
+	if a.SuccessRate != nil {
+		t.Errorf("alpha success_rate = %v, want null without recent requests", *a.SuccessRate)
+	}
+	if a.CooldownRemainingMs != 0 {
+		t.Errorf("alpha cooldown_remaining_ms = %d, want 0", a.CooldownRemainingMs)
+	}
+	if snap.ActiveConfig == nil || snap.ActiveConfig.Name != "Main" || snap.ActiveConfig.Strategy != "round-robin" {
+		t.Errorf("active_config = %+v", snap.ActiveConfig)
+	}
+	if snap.Tenants == nil || *snap.Tenants != 0 {
+		t.Errorf("tenants = %v, want 0", snap.Tenants)
+	}
+	if !snap.GuardrailsEnabled {
+		t.Error("guardrails_enabled = false, want true")
+	}
+	if snap.DatabaseWritable == nil {
+		t.Error("database_writable missing")
+	}
+}
+
+func TestAdminStatus_Cached(t *testing.T) {
+	tdb := dbtest.Open(t)
+	resetStatusCache(t)
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+
+	tdb.AddAccount("acct-1", "one", "anthropic", "")
+	countAccounts := func() int {
+		var snap struct {
+			Accounts []json.RawMessage `json:"accounts"`
+		}
+		json.Unmarshal(getStatus(t, "/admin/status", "").Body.Bytes(), &snap)
+		return len(snap.Accounts)
+	}
+
+	if n := countAccounts(); n != 1 {
+		t.Fatalf("accounts = %d, want 1", n)
+	}
+	tdb.AddAccount("acct-2", "two", "anthropic", "")
+	if n := countAccounts(); n != 1 {
+		t.Errorf("accounts = %d within the cache window, want cached 1", n)
+	}
+
+	statusCache.mu.Lock()
+	statusCache.expires = time.Now().Add(-time.Second)
+	statusCache.mu.Unlock()
+	if n := countAccounts(); n != 2 {
+		t.Errorf("accounts = %d after expiry, want 2", n)
+	}
+}
+
+func TestAdminStatus_HTML(t *testing.T) {
+	tdb := dbtest.Open(t)
+	resetStatusCache(t)
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+	tdb.AddAccount("acct-h", "<script>x</script>", "anthropic", "")
+
+	w := getStatus(t, "/admin/status?format=html", "")
+	if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("status = %d, content-type = %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	if strings.Contains(body, "<script>x") || !strings.Contains(body, "&lt;script&gt;x") {
+		t.Error("account names should be HTML-escaped")
+	}
+}
+
+func TestAdminStatus_RequiresProxyKey(t *testing.T) {
+	dbtest.Open(t)
+	resetStatusCache(t)
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+	t.Setenv("PROXY_API_KEY", "admin-secret")
+
+	if w := getStatus(t, "/admin/status", ""); w.Code != 401 {
+		t.Errorf("no key: status = %d, want 401", w.Code)
+	}
+	if w := getStatus(t, "/admin/status", "wrong"); w.Code != 401 {
+		t.Errorf("wrong key: status = %d, want 401", w.Code)
+	}
+	if w := getStatus(t, "/admin/status", "admin-secret"); w.Code != 200 {
+		t.Errorf("proxy key: status = %d, want 200", w.Code)
+	}
+}
+
+func TestAdminStatus_TenantsWithoutProxyKey(t *testing.T) {
+	tdb := dbtest.Open(t)
+	resetStatusCache(t)
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+	tdb.Exec("INSERT INTO tenants (id, name, api_key_hash, api_key_prefix) VALUES ('t1', 'T', 'hash', 'cgk_xxxx')")
+
+	if w := getStatus(t, "/admin/status", ""); w.Code != 401 {
+		t.Errorf("status = %d, want 401 when tenants exist and no proxy key is set", w.Code)
+	}
+}
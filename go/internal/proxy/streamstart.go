@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultFirstEventTimeout is how long a stream's first event is waited for
+// before the response is committed to the client when
+// stream_first_event_timeout_ms isn't set.
+const defaultFirstEventTimeout = 5 * time.Second
+
+// maxFirstEventBytes bounds how much of a stream is buffered looking for
+// the end of its first event.
+const maxFirstEventBytes = 64 * 1024
+
+// firstEventTimeout reads stream_first_event_timeout_ms through getSetting;
+// 0 commits streams at once, without looking at their first event.
+func firstEventTimeout(getSetting func(string) string) time.Duration {
+	if ms, err := strconv.Atoi(strings.TrimSpace(getSetting("stream_first_event_timeout_ms"))); err == nil && ms >= 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return defaultFirstEventTimeout
+}
+
+// peekedStream is an upstream stream whose first event is read ahead, so
+// it can be checked before any of it is sent. Reads return the buffered
+// bytes first, waiting for the read-ahead if it hasn't finished, then the
+// rest of the stream.
+type peekedStream struct {
+	io.ReadCloser
+	done chan struct{}
+	buf  []byte
+	err  error // read error that ended the read-ahead, if any
+}
+
+// peekStream starts reading body up to the end of its first event.
+func peekStream(body io.ReadCloser) *peekedStream {
+	p := &peekedStream{ReadCloser: body, done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		chunk := make([]byte, 4096)
+		for len(p.buf) < maxFirstEventBytes && !eventEnded(p.buf) {
+			n, err := body.Read(chunk)
+			p.buf = append(p.buf, chunk[:n]...)
+			if err != nil {
+				p.err = err
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// wait waits up to timeout for the read-ahead to finish, and reports
+// whether it did. After it has, buf and err hold what it read.
+func (p *peekedStream) wait(timeout time.Duration) bool {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-p.done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+func (p *peekedStream) Read(b []byte) (int, error) {
+	<-p.done
+	if len(p.buf) > 0 {
+		n := copy(b, p.buf)
+		p.buf = p.buf[n:]
+		return n, nil
+	}
+	if p.err != nil {
+		return 0, p.err
+	}
+	return p.ReadCloser.Read(b)
+}
+
+// eventEnded reports whether buf holds a whole SSE event.
+func eventEnded(buf []byte) bool {
+	return bytes.Contains(buf, []byte("\n\n")) || bytes.Contains(buf, []byte("\r\n\r\n"))
+}
+
+// streamStartError returns why a stream failed before sending anything
+// worth passing on: its first event is an error (an Anthropic error event,
+// or an OpenAI-compatible data line with an "error" field), or it ended
+// before a whole event. Such a stream can be failed over like a 5xx, since
+// nothing has been written to the client yet. ok is false for a stream
+// that started well.
+func streamStartError(event []byte, readErr error) (msg string, ok bool) {
+	for _, line := range strings.Split(string(event), "\n") {
+		data, found := strings.CutPrefix(strings.TrimSpace(line), "data:")
+		if !found {
+			continue
+		}
+		var payload struct {
+			Type  string          `json:"type"`
+			Error json.RawMessage `json:"error"`
+		}
+		if json.Unmarshal([]byte(strings.TrimSpace(data)), &payload) != nil || len(payload.Error) == 0 || string(payload.Error) == "null" ||
+			payload.Type != "" && payload.Type != "error" {
+			continue
+		}
+		var e struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(payload.Error, &e) != nil {
+			// A bare string error
+			json.Unmarshal(payload.Error, &e.Message)
+		}
+		if e.Message == "" {
+			e.Message = "no message"
+		}
+		if e.Type != "" {
+			return fmt.Sprintf("stream started with an error: %s: %s", e.Type, e.Message), true
+		}
+		return "stream started with an error: " + e.Message, true
+	}
+	if readErr != nil && !eventEnded(event) {
+		if errors.Is(readErr, io.EOF) {
+			return "stream ended before its first event", true
+		}
+		return fmt.Sprintf("stream failed before its first event: %v", readErr), true
+	}
+	return "", false
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const streamedMessage = `{"model":"claude-sonnet-4-20250514","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`
+
+// errorEventStream answers with a stream holding nothing but an error event.
+func errorEventStream(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	fmt.Fprint(w, "event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\n")
+}
+
+// emptyStream sends stream headers, then drops the connection.
+func emptyStream(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.(http.Flusher).Flush()
+	panic(http.ErrAbortHandler)
+}
+
+func TestStreamStartError_FailsOver(t *testing.T) {
+	cases := []struct {
+		name, attempt string
+		fail          func(w http.ResponseWriter)
+	}{
+		{"error event", "overloaded_error: Overloaded", errorEventStream},
+		{"connection dropped", "before its first event", emptyStream},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tdb := dbtest.Open(t)
+			tdb.SetSetting("provider_retry_count", "0")
+			tdb.SetSetting("request_logging", "true")
+			first := flakyUpstream(t, tdb, "acct-first", 1, tc.fail)
+			second := flakyUpstream(t, tdb, "acct-second", 0, nil)
+			tdb.AddActiveConfig("cfg", "default")
+			tdb.AddTier("cfg", "sonnet", "acct-first", 10, "")
+			tdb.AddTier("cfg", "sonnet", "acct-second", 5, "")
+
+			w := sendMessages(t, streamedMessage, nil)
+			if w.Code != 200 || w.Header().Get("X-Proxy-Account") != "acct-second" {
+				t.Fatalf("status = %d, account = %q; want the second account's stream", w.Code, w.Header().Get("X-Proxy-Account"))
+			}
+			if body := w.Body.String(); !strings.Contains(body, "message_stop") || strings.Contains(body, "Overloaded") {
+				t.Errorf("client got %s, want only the second stream", body)
+			}
+			if first.Load() != 1 || second.Load() != 1 {
+				t.Errorf("first hit %d times, second %d; want 1 each", first.Load(), second.Load())
+			}
+			var attempts string
+			waitFor(t, func() bool {
+				return tdb.QueryRow("SELECT COALESCE(failover_attempts, '') FROM request_logs WHERE account_id = 'acct-second'").Scan(&attempts) == nil
+			})
+			if !strings.Contains(attempts, tc.attempt) {
+				t.Errorf("failover attempts = %s", attempts)
+			}
+		})
+	}
+}
+
+func TestStreamStartError_LastCandidate(t *testing.T) {
+	t.Run("error event is passed on", func(t *testing.T) {
+		tdb := dbtest.Open(t)
+		flakyUpstream(t, tdb, "acct-only", 1, errorEventStream)
+		w := sendMessages(t, streamedMessage, nil)
+		if w.Code != 200 || !strings.Contains(w.Body.String(), "overloaded_error") {
+			t.Errorf("status = %d, body = %s; want the error event", w.Code, w.Body.String())
+		}
+	})
+	t.Run("empty stream is a 502", func(t *testing.T) {
+		tdb := dbtest.Open(t)
+		flakyUpstream(t, tdb, "acct-only", 1, emptyStream)
+		w := sendMessages(t, streamedMessage, nil)
+		if w.Code != 502 || !strings.Contains(w.Body.String(), "before its first event") {
+			t.Errorf("status = %d, body = %s; want a 502", w.Code, w.Body.String())
+		}
+	})
+}
+
+// A stream slower to start than stream_first_event_timeout_ms is committed
+// to, not failed over.
+func TestStreamStart_SlowFirstEvent(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("stream_first_event_timeout_ms", "50")
+	slowUpstream(t, tdb, 0, 200*time.Millisecond)
+	backup := flakyUpstream(t, tdb, "acct-backup", 0, nil)
+	tdb.AddActiveConfig("cfg", "default")
+	tdb.AddTier("cfg", "sonnet", "acct-slow", 10, "")
+	tdb.AddTier("cfg", "sonnet", "acct-backup", 5, "")
+
+	w := sendMessages(t, streamedMessage, nil)
+	if w.Code != 200 || w.Header().Get("X-Proxy-Account") != "slow" || !strings.Contains(w.Body.String(), "message_stop") {
+		t.Fatalf("status = %d, account = %q, body = %s", w.Code, w.Header().Get("X-Proxy-Account"), w.Body.String())
+	}
+	if backup.Load() != 0 {
+		t.Error("slow stream was failed over")
+	}
+}
+
+func TestStreamStartError(t *testing.T) {
+	cases := []struct {
+		name, event string
+		err         error
+		want        string // "" for a stream that started well
+	}{
+		{"message start", "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{}}\n\n", nil, ""},
+		{"openai chunk", "data: {\"choices\":[{\"delta\":{\"content\":\"Hi\"}}],\"error\":null}\n\n", nil, ""},
+		{"comment", ": PROCESSING\n\n", nil, ""},
+		{"anthropic error", "event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"api_error\",\"message\":\"boom\"}}\n\n", nil, "api_error: boom"},
+		{"openai error", "data: {\"error\":{\"message\":\"upstream overloaded\",\"code\":503}}\n\n", nil, "upstream overloaded"},
+		{"string error", "data: {\"error\":\"bad gateway\"}\n\n", io.EOF, "bad gateway"},
+		{"eof", "", io.EOF, "ended before its first event"},
+		{"reset", "", errors.New("connection reset"), "connection reset"},
+		{"partial event", "event: message_start\ndata: {", io.ErrUnexpectedEOF, "unexpected EOF"},
+		{"whole event, then eof", "data: [DONE]\n\n", io.EOF, ""},
+	}
+	for _, tc := range cases {
+		msg, failed := streamStartError([]byte(tc.event), tc.err)
+		if failed != (tc.want != "") || !strings.Contains(msg, tc.want) {
+			t.Errorf("%s: streamStartError = %q, %v; want %q", tc.name, msg, failed, tc.want)
+		}
+	}
+}
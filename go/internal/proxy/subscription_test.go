@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/cooldown"
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/health"
+	"codegate-proxy/internal/routing"
+	"codegate-proxy/internal/subscription"
+	"codegate-proxy/internal/tenant"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// subscriptionPair configures a Claude subscription account, preferred by
+// the config, and an API-key account behind it. The subscription answers
+// with the unified rate limit headers respond returns; each account's
+// request count is returned.
+func subscriptionPair(t *testing.T, tdb *dbtest.DB, respond func() (int, map[string]string)) (subHits, apiHits *atomic.Int32) {
+	t.Helper()
+	subHits, apiHits = new(atomic.Int32), new(atomic.Int32)
+	sub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subHits.Add(1)
+		status, headers := respond()
+		for k, v := range headers {
+			w.Header().Set(k, v)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if status == 429 {
+			fmt.Fprint(w, `{"type":"error","error":{"type":"rate_limit_error","message":"usage limit reached"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	t.Cleanup(sub.Close)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiHits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_2","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	t.Cleanup(api.Close)
+
+	tdb.AddAccount("acct-sub", "max", "anthropic", sub.URL)
+	tdb.AddAccount("acct-api", "api", "anthropic", api.URL)
+	tdb.Exec("UPDATE accounts SET auth_type = 'oauth' WHERE id = 'acct-sub'")
+	tdb.Exec("INSERT INTO configs (id, name, is_active) VALUES ('cfg', 'default', 1)")
+	tdb.Exec("INSERT INTO config_tiers (id, config_id, tier, account_id, priority) VALUES ('ct1', 'cfg', 'sonnet', 'acct-sub', 10)")
+	tdb.Exec("INSERT INTO config_tiers (id, config_id, tier, account_id, priority) VALUES ('ct2', 'cfg', 'sonnet', 'acct-api', 5)")
+	reset := func() {
+		for _, id := range []string{"acct-sub", "acct-api"} {
+			cooldown.Clear(id)
+			subscription.Forget(id)
+		}
+		health.Reset()
+	}
+	reset()
+	t.Cleanup(reset)
+	return subHits, apiHits
+}
+
+func unixIn(d time.Duration) string {
+	return strconv.FormatInt(time.Now().Add(d).Unix(), 10)
+}
+
+func TestSubscriptionWindow_ExhaustedPrefersAPIKey(t *testing.T) {
+	tdb := dbtest.Open(t)
+	resetStatusCache(t)
+	reset := unixIn(3 * time.Hour)
+	subHits, apiHits := subscriptionPair(t, tdb, func() (int, map[string]string) {
+		return 429, map[string]string{
+			"Retry-After":                                "5",
+			"Anthropic-Ratelimit-Unified-Status":         "rejected",
+			"Anthropic-Ratelimit-Unified-Reset":          reset,
+			"Anthropic-Ratelimit-Unified-5h-Status":      "rejected",
+			"Anthropic-Ratelimit-Unified-5h-Utilization": "1.0",
+			"Anthropic-Ratelimit-Unified-5h-Reset":       reset,
+		}
+	})
+
+	if w := sendMessages(t, plainMessage, nil); w.Code != 200 || apiHits.Load() != 1 {
+		t.Fatalf("status %d, api hits %d; want failover to the API-key account", w.Code, apiHits.Load())
+	}
+	if got := strconv.FormatInt(subscription.ExhaustedUntil("acct-sub").Unix(), 10); got != reset {
+		t.Errorf("window exhausted until %s, want %s", got, reset)
+	}
+
+	// The short Retry-After cooldown runs out long before the window resets
+	cooldown.Clear("acct-sub")
+	_, exp, err := routing.Explain("claude-sonnet-4-20250514", nil, routing.RequestTraits{})
+	if err != nil || !reflect.DeepEqual(exp.Order, []string{"acct-api", "acct-sub"}) {
+		t.Errorf("order = %v, %v; want the API-key account first", exp.Order, err)
+	}
+	if w := sendMessages(t, plainMessage, nil); w.Code != 200 || subHits.Load() != 1 || apiHits.Load() != 2 {
+		t.Errorf("status %d, subscription hits %d, api hits %d; want the exhausted account skipped", w.Code, subHits.Load(), apiHits.Load())
+	}
+
+	var snap struct {
+		Accounts []struct {
+			ID                   string     `json:"id"`
+			WindowExhaustedUntil *time.Time `json:"window_exhausted_until"`
+			SubscriptionWindows  []struct {
+				Name         string  `json:"name"`
+				RemainingPct float64 `json:"remaining_pct"`
+			} `json:"subscription_windows"`
+		} `json:"accounts"`
+	}
+	json.Unmarshal(getStatus(t, "/admin/status", "").Body.Bytes(), &snap)
+	for _, a := range snap.Accounts {
+		switch a.ID {
+		case "acct-sub":
+			if a.WindowExhaustedUntil == nil || len(a.SubscriptionWindows) != 1 || a.SubscriptionWindows[0].Name != "5h" || a.SubscriptionWindows[0].RemainingPct != 0 {
+				t.Errorf("subscription status = %+v", a)
+			}
+		case "acct-api":
+			if a.WindowExhaustedUntil != nil || a.SubscriptionWindows != nil {
+				t.Errorf("API-key account has window status: %+v", a)
+			}
+		}
+	}
+}
+
+func TestSubscriptionWindow_ReserveForInteractive(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("subscription_window_reserve_pct", "20")
+	subHits, apiHits := subscriptionPair(t, tdb, func() (int, map[string]string) {
+		return 200, map[string]string{
+			"Anthropic-Ratelimit-Unified-Status":         "allowed_warning",
+			"Anthropic-Ratelimit-Unified-5h-Status":      "allowed_warning",
+			"Anthropic-Ratelimit-Unified-5h-Utilization": "0.85",
+			"Anthropic-Ratelimit-Unified-5h-Reset":       unixIn(time.Hour),
+		}
+	})
+	background := http.Header{"X-Codegate-Priority": {"background"}}
+
+	if w := sendMessages(t, plainMessage, nil); w.Code != 200 || subHits.Load() != 1 {
+		t.Fatalf("interactive: status %d, subscription hits %d", w.Code, subHits.Load())
+	}
+	if w := sendMessages(t, plainMessage, background); w.Code != 200 || apiHits.Load() != 1 {
+		t.Errorf("background at 85%% with a 20%% reserve: status %d, api hits %d", w.Code, apiHits.Load())
+	}
+	if w := sendMessages(t, plainMessage, nil); w.Code != 200 || subHits.Load() != 2 {
+		t.Errorf("interactive: status %d, subscription hits %d; the reserve is theirs", w.Code, subHits.Load())
+	}
+
+	tdb.SetSetting("subscription_window_reserve_pct", "10")
+	if w := sendMessages(t, plainMessage, background); w.Code != 200 || subHits.Load() != 3 {
+		t.Errorf("background at 85%% with a 10%% reserve: status %d, subscription hits %d", w.Code, subHits.Load())
+	}
+}
+
+func TestSubscriptionWindow_TenantReserve(t *testing.T) {
+	tdb := dbtest.Open(t)
+	subHits, apiHits := subscriptionPair(t, tdb, func() (int, map[string]string) {
+		return 200, map[string]string{
+			"Anthropic-Ratelimit-Unified-Status":         "allowed_warning",
+			"Anthropic-Ratelimit-Unified-5h-Status":      "allowed_warning",
+			"Anthropic-Ratelimit-Unified-5h-Utilization": "0.85",
+			"Anthropic-Ratelimit-Unified-5h-Reset":       unixIn(time.Hour),
+		}
+	})
+	tenant.InvalidateAll()
+	t.Cleanup(tenant.InvalidateAll)
+	sum := sha256.Sum256([]byte("cgk_reserve_key"))
+	tdb.Exec("INSERT INTO tenants (id, name, api_key_hash, api_key_prefix) VALUES ('t-reserve', 'reserve', ?, 'cgk_rese')", hex.EncodeToString(sum[:]))
+	tdb.Exec("INSERT INTO tenant_settings (tenant_id, key, value) VALUES ('t-reserve', 'subscription_window_reserve_pct', '20')")
+	background := http.Header{"X-Codegate-Priority": {"background"}, "X-Api-Key": {"cgk_reserve_key"}}
+
+	if w := sendMessages(t, plainMessage, http.Header{"X-Api-Key": {"cgk_reserve_key"}}); w.Code != 200 || subHits.Load() != 1 {
+		t.Fatalf("interactive: status %d, subscription hits %d", w.Code, subHits.Load())
+	}
+	if w := sendMessages(t, plainMessage, background); w.Code != 200 || apiHits.Load() != 1 {
+		t.Errorf("background with the tenant's 20%% reserve: status %d, api hits %d", w.Code, apiHits.Load())
+	}
+}
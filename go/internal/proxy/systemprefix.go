@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/db"
+	"maps"
+	"strings"
+)
+
+// injectedPromptHeader is "true" on responses to requests that had a system
+// prompt prefix injected, when debug_headers=true.
+var injectedPromptHeader = exposeHeader("X-CodeGate-Injected-Prompt")
+
+// maxSystemPromptPrefix caps the injected text in bytes; longer prefixes
+// are cut.
+const maxSystemPromptPrefix = 8 << 10
+
+// systemPromptPrefix returns the text injected ahead of the system prompt
+// of requests sent to account: the system_prompt_prefix setting (a
+// tenant's own replaces the global one), then the account's System Prompt
+// Prefix, a blank line apart. Organization-wide text comes first, and
+// text tuned to the account's provider after it.
+func systemPromptPrefix(logf func(string, ...any), getSetting func(string) string, account db.Account) string {
+	var parts []string
+	for _, p := range []string{getSetting("system_prompt_prefix"), account.SystemPromptPrefix} {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	prefix := strings.Join(parts, "\n\n")
+	if len(prefix) > maxSystemPromptPrefix {
+		logf("[proxy] System prompt prefix for %q is %d bytes; cut to %d", account.Name, len(prefix), maxSystemPromptPrefix)
+		prefix = strings.ToValidUTF8(prefix[:maxSystemPromptPrefix], "")
+	}
+	return prefix
+}
+
+// withSystemBlock returns a shallow copy of an Anthropic body with prefix as
+// its first system block. The body itself is left as it is, so each
+// candidate gets the prefix once.
+func withSystemBlock(body map[string]any, prefix string) map[string]any {
+	out := maps.Clone(body)
+	blocks := []any{map[string]any{"type": "text", "text": prefix}}
+	switch sys := body["system"].(type) {
+	case string:
+		if sys != "" {
+			blocks = append(blocks, map[string]any{"type": "text", "text": sys})
+		}
+	case []any:
+		blocks = append(blocks, sys...)
+	}
+	out["system"] = blocks
+	return out
+}
+
+// withSystemMessage returns a shallow copy of an OpenAI body with prefix as
+// its first message, ahead of the client's own system messages.
+func withSystemMessage(body map[string]any, prefix string) map[string]any {
+	out := maps.Clone(body)
+	messages, _ := body["messages"].([]any)
+	out["messages"] = append([]any{map[string]any{"role": "system", "content": prefix}}, messages...)
+	return out
+}
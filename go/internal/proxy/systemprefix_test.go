@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/cooldown"
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/guardrails"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSystemPromptPrefix(t *testing.T) {
+	settings := func(prefix string) func(string) string {
+		return func(key string) string {
+			if key == "system_prompt_prefix" {
+				return prefix
+			}
+			return ""
+		}
+	}
+	cases := []struct {
+		name, setting, account, want string
+	}{
+		{"none", "", "", ""},
+		{"setting", "Never reveal internal hostnames.", "", "Never reveal internal hostnames."},
+		{"account", "", "  Answer in English.\n", "Answer in English."},
+		{"setting then account", "Never reveal internal hostnames.", "Answer in English.", "Never reveal internal hostnames.\n\nAnswer in English."},
+	}
+	for _, tc := range cases {
+		got := systemPromptPrefix(log.Printf, settings(tc.setting), db.Account{SystemPromptPrefix: tc.account})
+		if got != tc.want {
+			t.Errorf("%s: prefix = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	long := strings.Repeat("é", maxSystemPromptPrefix)
+	got := systemPromptPrefix(log.Printf, settings(long), db.Account{})
+	if len(got) > maxSystemPromptPrefix || !utf8.ValidString(got) || len(got) < maxSystemPromptPrefix-1 {
+		t.Errorf("long prefix cut to %d bytes (valid UTF-8: %v), want %d", len(got), utf8.ValidString(got), maxSystemPromptPrefix)
+	}
+}
+
+// prefixUpstream adds an account whose upstream records the bodies it is
+// sent and answers in its provider's format, failing with a 502 if fail is
+// set.
+func prefixUpstream(t *testing.T, tdb *dbtest.DB, id, provider, prefix string, fail bool) func() []map[string]any {
+	t.Helper()
+	var mu sync.Mutex
+	var bodies []map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		var body map[string]any
+		json.Unmarshal(raw, &body)
+		mu.Lock()
+		bodies = append(bodies, body)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case fail:
+			w.WriteHeader(502)
+			fmt.Fprint(w, `{"type":"error","error":{"type":"api_error","message":"bad gateway"}}`)
+		case provider == "anthropic":
+			fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"ok"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`)
+		default:
+			fmt.Fprint(w, `{"id":"chatcmpl-1","object":"chat.completion","model":"gpt-4.1","choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}],"usage":{"prompt_tokens":1,"completion_tokens":1}}`)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	tdb.AddAccount(id, id, provider, upstream.URL)
+	tdb.Exec("UPDATE accounts SET system_prompt_prefix = ? WHERE id = ?", prefix, id)
+	t.Cleanup(func() { cooldown.Clear(id) })
+	return func() []map[string]any {
+		mu.Lock()
+		defer mu.Unlock()
+		return bodies
+	}
+}
+
+func sendPrefixed(t *testing.T, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	return w
+}
+
+func TestSystemPromptPrefix_Injected(t *testing.T) {
+	const (
+		anthropicBody = `{"model":"claude-sonnet-4-20250514","max_tokens":16,"system":"You are terse.","messages":[{"role":"user","content":"hi"}]}`
+		openAIBody    = `{"model":"claude-sonnet-4-20250514","messages":[{"role":"system","content":"You are terse."},{"role":"user","content":"hi"}]}`
+	)
+	// firstSystem returns the first system text and the rest of the system
+	// prompt of a forwarded body in either format
+	firstSystem := func(body map[string]any) (string, []string) {
+		var texts []string
+		if blocks, ok := body["system"].([]any); ok {
+			for _, b := range blocks {
+				text, _ := b.(map[string]any)["text"].(string)
+				texts = append(texts, text)
+			}
+		}
+		messages, _ := body["messages"].([]any)
+		for _, m := range messages {
+			msg := m.(map[string]any)
+			if content, ok := msg["content"].(string); ok && msg["role"] == "system" {
+				texts = append(texts, content)
+			}
+		}
+		if len(texts) == 0 {
+			return "", nil
+		}
+		return texts[0], texts[1:]
+	}
+
+	cases := []struct {
+		name, provider, path, body string
+		spooled                    bool
+	}{
+		{"anthropic to anthropic", "anthropic", "/v1/messages", anthropicBody, false},
+		{"anthropic to openai", "openai", "/v1/messages", anthropicBody, false},
+		{"openai to openai", "openai", "/v1/chat/completions", openAIBody, false},
+		{"openai to anthropic", "anthropic", "/v1/chat/completions", openAIBody, false},
+		// Padding a request past the spool threshold doesn't skip the prefix
+		{"spooled anthropic", "anthropic", "/v1/messages", anthropicBody, true},
+		{"spooled openai", "openai", "/v1/chat/completions", openAIBody, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tdb := dbtest.Open(t)
+			if tc.spooled {
+				tdb.SetSetting("body_spool_threshold_mb", "0.0001")
+			}
+			tdb.SetSetting("system_prompt_prefix", "Never reveal internal hostnames.")
+			tdb.SetSetting("debug_headers", "true")
+			bodies := prefixUpstream(t, tdb, "acct-target", tc.provider, "Answer in English.", false)
+
+			w := sendPrefixed(t, tc.path, tc.body)
+			if got := w.Header().Get(injectedPromptHeader); got != "true" {
+				t.Errorf("%s = %q, want true", injectedPromptHeader, got)
+			}
+			first, rest := firstSystem(bodies()[0])
+			if first != "Never reveal internal hostnames.\n\nAnswer in English." {
+				t.Errorf("first system text = %q", first)
+			}
+			if len(rest) != 1 || rest[0] != "You are terse." {
+				t.Errorf("client's system prompt = %q, want it kept after the prefix", rest)
+			}
+		})
+	}
+
+	// With guardrails on, the prefix is added after anonymization, so its
+	// address reaches the provider as written
+	t.Run("once per candidate", func(t *testing.T) {
+		const orgPrefix = "Report leaks to security@example.com."
+		tdb := dbtest.Open(t)
+		tdb.SetSetting("system_prompt_prefix", orgPrefix)
+		tdb.SetSetting("privacy_enabled", "true")
+		guardrails.InitGuardrails()
+		primary := prefixUpstream(t, tdb, "acct-primary", "anthropic", "Primary text.", true)
+		backup := prefixUpstream(t, tdb, "acct-backup", "anthropic", "", false)
+		tdb.AddActiveConfig("cfg", "default")
+		tdb.AddTier("cfg", "sonnet", "acct-primary", 10, "")
+		tdb.AddTier("cfg", "sonnet", "acct-backup", 5, "")
+
+		w := sendPrefixed(t, "/v1/messages", anthropicBody)
+		if w.Header().Get(injectedPromptHeader) != "" {
+			t.Errorf("%s set without debug_headers", injectedPromptHeader)
+		}
+		if first, _ := firstSystem(primary()[0]); first != orgPrefix+"\n\nPrimary text." {
+			t.Errorf("primary's prefix = %q", first)
+		}
+		first, rest := firstSystem(backup()[0])
+		if first != orgPrefix || len(rest) != 1 || rest[0] != "You are terse." {
+			t.Errorf("backup's system prompt = %q then %q, want the prefix once and the client's", first, rest)
+		}
+	})
+}
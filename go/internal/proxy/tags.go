@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/db"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// tagsHeader carries chargeback tags for a request as comma-separated
+// key=value pairs, e.g. "team=search,project=ranking". They are recorded
+// with its usage and request log and sent to the policy webhook.
+var tagsHeader = allowHeader("X-CodeGate-Tags")
+
+const (
+	maxTags       = 10
+	maxTagsHeader = 1024
+	// maxEndUser caps the end-user ID recorded with usage
+	maxEndUser = 256
+)
+
+var tagValuePattern = regexp.MustCompile(`^[A-Za-z0-9_.:/@-]{1,64}$`)
+
+// parseTags parses key=value pairs as sent in tagsHeader. Keys are
+// db.ValidTagKey; values are letters, digits, and _.:/@- up to 64
+// characters. An empty string has no tags.
+func parseTags(header string) (map[string]string, error) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return nil, nil
+	}
+	if len(header) > maxTagsHeader {
+		return nil, fmt.Errorf("tags are longer than %d bytes", maxTagsHeader)
+	}
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("%q is not a key=value pair", pair)
+		case !db.ValidTagKey(key):
+			return nil, fmt.Errorf("invalid tag key %q", key)
+		case !tagValuePattern.MatchString(value):
+			return nil, fmt.Errorf("invalid value for tag %q", key)
+		}
+		if _, dup := tags[key]; dup {
+			return nil, fmt.Errorf("tag %q is set more than once", key)
+		}
+		tags[key] = value
+	}
+	if len(tags) > maxTags {
+		return nil, fmt.Errorf("more than %d tags", maxTags)
+	}
+	return tags, nil
+}
+
+// tagsJSON is the stored form of tags: a JSON object, or "" for none.
+func tagsJSON(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(tags)
+	return string(b)
+}
+
+// formatTags writes tags the way tagsHeader takes them, sorted by key.
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// endUser returns the end-user ID the request names, Anthropic
+// metadata.user_id or OpenAI user, as it will be forwarded: hashed when
+// hash_end_user_ids is on.
+func (b *requestBody) endUser() string {
+	var id string
+	if b.spool != nil {
+		if f, ok := b.spool.fields["metadata"]; ok {
+			var md map[string]any
+			if json.Unmarshal(f.raw, &md) == nil {
+				id, _ = md["user_id"].(string)
+			}
+		}
+		if id == "" {
+			id, _ = b.spool.stringField("user")
+		}
+	} else {
+		md, _ := b.anthropic["metadata"].(map[string]any)
+		id, _ = md["user_id"].(string)
+		if id == "" {
+			id, _ = b.parsed["user"].(string)
+		}
+	}
+	if len(id) > maxEndUser {
+		id = id[:maxEndUser]
+	}
+	return id
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	cases := []struct {
+		header string
+		want   map[string]string
+		err    string
+	}{
+		{"", nil, ""},
+		{" team=search , project=ranking-v2 ", map[string]string{"team": "search", "project": "ranking-v2"}, ""},
+		{"owner=jane@example.com,repo=org/app:main", map[string]string{"owner": "jane@example.com", "repo": "org/app:main"}, ""},
+		{"team", nil, "not a key=value pair"},
+		{"Team=search", nil, "invalid tag key"},
+		{"team=", nil, "invalid value"},
+		{"team=a b", nil, "invalid value"},
+		{"team=search,team=ads", nil, "more than once"},
+		{strings.Repeat("k", 33) + "=v", nil, "invalid tag key"},
+		{"team=" + strings.Repeat("v", 65), nil, "invalid value"},
+		{"a=1,b=1,c=1,d=1,e=1,f=1,g=1,h=1,i=1,j=1,k=1", nil, "more than 10 tags"},
+		{"team=" + strings.Repeat("v,x=", 300) + "v", nil, "longer than"},
+	}
+	for _, tc := range cases {
+		got, err := parseTags(tc.header)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("parseTags(%.40q) error = %v, want %q", tc.header, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseTags(%q) = %v, %v, want %v", tc.header, got, err, tc.want)
+		}
+	}
+}
+
+func TestChargebackDimensionsRecorded(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("request_logging", "true")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-tags", "tags", "anthropic", upstream.URL)
+
+	var asked policyRequest
+	policy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&asked)
+		fmt.Fprint(w, `{"decision":"allow"}`)
+	}))
+	defer policy.Close()
+	tdb.SetSetting("policy_webhook_url", policy.URL)
+
+	const body = `{"model":"claude-sonnet-4-20250514","max_tokens":16,"metadata":{"user_id":"user-42"},"messages":[{"role":"user","content":"hi"}]}`
+	w := sendMessages(t, body, http.Header{"X-Codegate-Tags": {"team=search,project=ranking"}})
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	wantTags := map[string]string{"team": "search", "project": "ranking"}
+	if asked.EndUser != "user-42" || !reflect.DeepEqual(asked.Tags, wantTags) {
+		t.Errorf("policy asked end_user %q, tags %v", asked.EndUser, asked.Tags)
+	}
+
+	var endUser, tags string
+	waitFor(t, func() bool {
+		return tdb.QueryRow("SELECT end_user, tags FROM usage").Scan(&endUser, &tags) == nil
+	})
+	if endUser != "user-42" || tags != `{"project":"ranking","team":"search"}` {
+		t.Errorf("usage end_user = %q, tags = %q", endUser, tags)
+	}
+	waitFor(t, func() bool {
+		return tdb.QueryRow("SELECT end_user, tags FROM request_logs").Scan(&endUser, &tags) == nil
+	})
+	if endUser != "user-42" || tags != `{"project":"ranking","team":"search"}` {
+		t.Errorf("request log end_user = %q, tags = %q", endUser, tags)
+	}
+
+	// Hashed IDs are recorded the way providers see them
+	tdb.Exec("DELETE FROM usage")
+	tdb.SetSetting("hash_end_user_ids", "true")
+	if w := sendMessages(t, body, nil); w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	waitFor(t, func() bool {
+		return tdb.QueryRow("SELECT end_user FROM usage").Scan(&endUser) == nil
+	})
+	if endUser != mustHashUserID(t, "user-42") {
+		t.Errorf("hashed end_user = %q", endUser)
+	}
+
+	w = sendMessages(t, body, http.Header{"X-Codegate-Tags": {"Team=search"}})
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "X-CodeGate-Tags: invalid tag key") {
+		t.Errorf("invalid tags: status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
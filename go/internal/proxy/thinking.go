@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/convert"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strconv"
+)
+
+// defaultThinkingMargin is how many tokens of max_tokens are left for the
+// answer when a thinking budget is cut to fit (thinking_budget_margin).
+const defaultThinkingMargin = 1024
+
+// thinkingMargin reads thinking_budget_margin.
+func thinkingMargin(getSetting func(string) string) int {
+	n, err := strconv.Atoi(getSetting("thinking_budget_margin"))
+	if err != nil || n < 0 {
+		return defaultThinkingMargin
+	}
+	return n
+}
+
+// enabledThinking returns the body's thinking config if it enables thinking
+// with a budget.
+func (b *requestBody) enabledThinking() (map[string]any, int) {
+	var thinking map[string]any
+	switch {
+	case b.anthropic != nil:
+		thinking, _ = b.anthropic["thinking"].(map[string]any)
+	case b.spool != nil:
+		if f, ok := b.spool.fields["thinking"]; ok {
+			json.Unmarshal(f.raw, &thinking)
+		}
+	}
+	budget, _ := thinking["budget_tokens"].(float64)
+	if thinking["type"] != "enabled" || budget <= 0 {
+		return nil, 0
+	}
+	return thinking, int(budget)
+}
+
+// setThinking replaces the thinking config on the forwarded body.
+func (b *requestBody) setThinking(thinking map[string]any) {
+	switch {
+	case b.anthropic != nil:
+		b.anthropic["thinking"] = thinking
+		b.anthropicModified = true
+	case b.spool != nil:
+		b.spool.setField("thinking", thinking)
+	}
+}
+
+// fitThinkingBudget keeps the client's thinking budget below maxTokens, as
+// Anthropic requires, after the proxy lowered max_tokens. A budget that
+// doesn't fit is cut to maxTokens minus margin, or thinking is disabled when
+// that leaves less than the minimum budget. It returns a warning describing
+// the change, or "" if the client's budget fits. Each call starts from the
+// client's config, so a candidate with a higher max_tokens gets it back.
+func (b *requestBody) fitThinkingBudget(maxTokens, margin int) string {
+	if b.thinking == nil {
+		b.thinking, b.thinkingBudget = b.enabledThinking()
+		if b.thinking == nil {
+			return ""
+		}
+	}
+	budget := b.thinkingBudget
+	// max_tokens must stay strictly above the budget, even with no margin
+	switch fitted := maxTokens - max(margin, 1); {
+	case budget < maxTokens:
+		if b.thinkingFitted {
+			b.setThinking(b.thinking)
+			b.thinkingFitted = false
+		}
+		return ""
+	case fitted < convert.MinThinkingBudget:
+		b.setThinking(map[string]any{"type": "disabled"})
+		b.thinkingFitted = true
+		return fmt.Sprintf("disabled thinking: max_tokens %d leaves no room for a thinking budget", maxTokens)
+	default:
+		thinking := maps.Clone(b.thinking)
+		thinking["budget_tokens"] = float64(fitted)
+		b.setThinking(thinking)
+		b.thinkingFitted = true
+		return fmt.Sprintf("reduced thinking budget_tokens from %d to %d to fit max_tokens %d", budget, fitted, maxTokens)
+	}
+}
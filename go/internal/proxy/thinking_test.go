@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/limits"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func thinkingBody(maxTokens, budget int) map[string]any {
+	var body map[string]any
+	json.Unmarshal([]byte(fmt.Sprintf(`{"model":"claude-3-7-sonnet-20250219","max_tokens":%d,
+		"thinking":{"type":"enabled","budget_tokens":%d},"messages":[{"role":"user","content":"hi"}]}`, maxTokens, budget)), &body)
+	return body
+}
+
+func TestFitThinkingBudget(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		maxTokens  int
+		wantType   string
+		wantBudget float64
+		wantNote   string
+	}{
+		{"fits", 16000, "enabled", 10000, ""},
+		{"limit clamp", 8192, "enabled", 7168, "reduced thinking budget_tokens from 10000 to 7168 to fit max_tokens 8192"},
+		{"too small to think", 1500, "disabled", 0, "disabled thinking: max_tokens 1500 leaves no room for a thinking budget"},
+	} {
+		req := &requestBody{anthropic: thinkingBody(16000, 10000)}
+		note := req.fitThinkingBudget(tc.maxTokens, defaultThinkingMargin)
+		thinking := req.anthropic["thinking"].(map[string]any)
+		budget, _ := thinking["budget_tokens"].(float64)
+		if note != tc.wantNote || thinking["type"] != tc.wantType || budget != tc.wantBudget {
+			t.Errorf("%s: note %q, thinking %v", tc.name, note, thinking)
+		}
+		if req.anthropicModified != (tc.wantNote != "") {
+			t.Errorf("%s: modified = %v", tc.name, req.anthropicModified)
+		}
+	}
+}
+
+// A candidate that gets the 128k-output beta back after one that didn't
+// forwards the client's budget again.
+func TestFitThinkingBudget_PerCandidate(t *testing.T) {
+	req := &requestBody{anthropic: thinkingBody(100000, 90000)}
+	if note := req.fitThinkingBudget(64000, defaultThinkingMargin); note == "" {
+		t.Fatal("budget not cut for the 64000 limit")
+	}
+	if note := req.fitThinkingBudget(100000, defaultThinkingMargin); note != "" {
+		t.Errorf("note = %q", note)
+	}
+	if thinking := req.anthropic["thinking"].(map[string]any); thinking["budget_tokens"] != float64(90000) {
+		t.Errorf("thinking = %v", thinking)
+	}
+}
+
+func TestFitThinkingBudget_Spooled(t *testing.T) {
+	req := &requestBody{spool: spoolString(t, `{"model":"m","max_tokens":16000,"thinking":{"type":"enabled","budget_tokens":10000},"messages":[]}`)}
+	if note := req.fitThinkingBudget(1200, 0); note != "reduced thinking budget_tokens from 10000 to 1199 to fit max_tokens 1200" {
+		t.Errorf("no margin: %q", note)
+	}
+	req.fitThinkingBudget(8192, 1024)
+	raw, err := req.spool.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Thinking map[string]any `json:"thinking"`
+	}
+	if err := json.Unmarshal(raw, &out); err != nil || out.Thinking["budget_tokens"] != float64(7168) {
+		t.Errorf("forwarded %s (%v)", raw, err)
+	}
+}
+
+func TestThinkingBudget_ModelLimitClamp(t *testing.T) {
+	tdb := dbtest.Open(t)
+	limits.InitModelLimitsTable()
+	limit := 8192
+	limits.SetModelLimit("claude-3-7-sonnet", &limit, nil, nil)
+	t.Cleanup(func() { limits.DeleteModelLimit("claude-3-7-sonnet") })
+	tdb.SetSetting("thinking_budget_margin", "2000")
+
+	var sent map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&sent)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-3-7-sonnet-20250219","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-thinking", "thinking", "anthropic", upstream.URL)
+
+	body, _ := json.Marshal(thinkingBody(16000, 10000))
+	w := sendMessages(t, string(body), nil)
+	if w.Code != 200 {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	thinking, _ := sent["thinking"].(map[string]any)
+	if sent["max_tokens"] != float64(8192) || thinking["budget_tokens"] != float64(6192) {
+		t.Errorf("forwarded max_tokens %v, thinking %v", sent["max_tokens"], thinking)
+	}
+	if got := w.Header().Get(conversionWarningsHeader); got != "reduced thinking budget_tokens from 10000 to 6192 to fit max_tokens 8192" {
+		t.Errorf("%s = %q", conversionWarningsHeader, got)
+	}
+}
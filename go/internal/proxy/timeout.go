@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/provider"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultHeaderTimeout bounds the wait for a stream's first response
+	// headers. Providers send them once generation starts, so this only
+	// has to cover queueing.
+	defaultHeaderTimeout = 2 * time.Minute
+	// defaultResponseTimeout bounds a request that isn't streamed, matching
+	// the provider SDKs' own default.
+	defaultResponseTimeout = 10 * time.Minute
+)
+
+// upstreamTimeouts returns the timeouts for requests sent to account: its
+// own Connect/Header/Response Timeout fields where set, otherwise the
+// provider_connect_timeout_ms, provider_header_timeout_ms and
+// provider_response_timeout_ms settings. A header or response setting of 0
+// turns that timeout off.
+func upstreamTimeouts(getSetting func(string) string, account db.Account) provider.Timeouts {
+	timeout := func(accountMs int, setting string, def time.Duration) time.Duration {
+		if accountMs > 0 {
+			return time.Duration(accountMs) * time.Millisecond
+		}
+		if ms, err := strconv.Atoi(strings.TrimSpace(getSetting(setting))); err == nil && ms >= 0 {
+			return time.Duration(ms) * time.Millisecond
+		}
+		return def
+	}
+	return provider.Timeouts{
+		Connect:  timeout(account.ConnectTimeoutMs, "provider_connect_timeout_ms", provider.DefaultConnectTimeout),
+		Header:   timeout(account.HeaderTimeoutMs, "provider_header_timeout_ms", defaultHeaderTimeout),
+		Response: timeout(account.ResponseTimeoutMs, "provider_response_timeout_ms", defaultResponseTimeout),
+	}
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/cooldown"
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/dbtest"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpstreamTimeouts(t *testing.T) {
+	settings := map[string]string{
+		"provider_connect_timeout_ms":  "2500",
+		"provider_header_timeout_ms":   "0",
+		"provider_response_timeout_ms": "bogus",
+	}
+	getSetting := func(key string) string { return settings[key] }
+
+	got := upstreamTimeouts(getSetting, db.Account{})
+	if got.Connect != 2500*time.Millisecond || got.Header != 0 || got.Response != defaultResponseTimeout {
+		t.Errorf("from settings = %+v", got)
+	}
+	got = upstreamTimeouts(getSetting, db.Account{HeaderTimeoutMs: 30000, ResponseTimeoutMs: 1200000})
+	if got.Connect != 2500*time.Millisecond || got.Header != 30*time.Second || got.Response != 20*time.Minute {
+		t.Errorf("with account overrides = %+v", got)
+	}
+	got = upstreamTimeouts(func(string) string { return "" }, db.Account{})
+	if got.Header != defaultHeaderTimeout || got.Response != defaultResponseTimeout {
+		t.Errorf("defaults = %+v", got)
+	}
+}
+
+// slowUpstream adds an Anthropic account whose upstream sends headers after
+// headerDelay and the rest of the response after bodyDelay, streaming when
+// the request asks to.
+func slowUpstream(t *testing.T, tdb *dbtest.DB, headerDelay, bodyDelay time.Duration) {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		wait := func(d time.Duration) bool {
+			select {
+			case <-time.After(d):
+				return true
+			case <-r.Context().Done():
+				return false
+			}
+		}
+		if !wait(headerDelay) {
+			return
+		}
+		if strings.Contains(string(raw), `"stream":true`) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.(http.Flusher).Flush()
+			if !wait(bodyDelay) {
+				return
+			}
+			fmt.Fprint(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"type\":\"message\",\"role\":\"assistant\",\"model\":\"claude-sonnet-4-20250514\",\"content\":[],\"usage\":{\"input_tokens\":3,\"output_tokens\":0}}}\n\n")
+			fmt.Fprint(w, "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"ok"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	t.Cleanup(upstream.Close)
+	tdb.AddAccount("acct-slow", "slow", "anthropic", upstream.URL)
+	t.Cleanup(func() { cooldown.Clear("acct-slow") })
+}
+
+func TestUpstreamTimeout_Returns504(t *testing.T) {
+	cases := []struct {
+		name, path, body string
+		check            func(t *testing.T, body []byte)
+	}{
+		{"anthropic", "/v1/messages", plainMessage, func(t *testing.T, body []byte) {
+			var e struct {
+				Type  string `json:"type"`
+				Error struct {
+					Type string `json:"type"`
+				} `json:"error"`
+			}
+			if json.Unmarshal(body, &e) != nil || e.Type != "error" || e.Error.Type != "timeout_error" {
+				t.Errorf("body = %s, want an Anthropic timeout_error", body)
+			}
+		}},
+		{"openai", "/v1/chat/completions", `{"model":"claude-sonnet-4-20250514","messages":[{"role":"user","content":"hi"}]}`, func(t *testing.T, body []byte) {
+			var e struct {
+				Error struct {
+					Type string `json:"type"`
+					Code int    `json:"code"`
+				} `json:"error"`
+			}
+			if json.Unmarshal(body, &e) != nil || e.Error.Type != "timeout_error" || e.Error.Code != 504 {
+				t.Errorf("body = %s, want an OpenAI timeout_error", body)
+			}
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tdb := dbtest.Open(t)
+			tdb.SetSetting("provider_response_timeout_ms", "50")
+			slowUpstream(t, tdb, 2*time.Second, 0)
+
+			start := time.Now()
+			w := httptest.NewRecorder()
+			Handler().ServeHTTP(w, httptest.NewRequest("POST", tc.path, strings.NewReader(tc.body)))
+			if w.Code != 504 {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("took %v, want the 50ms timeout to end it", elapsed)
+			}
+			tc.check(t, w.Body.Bytes())
+			if !cooldown.IsOnCooldown("acct-slow") {
+				t.Error("timed-out account not on cooldown")
+			}
+		})
+	}
+}
+
+func TestUpstreamTimeout_AccountOverride(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("provider_response_timeout_ms", "50")
+	slowUpstream(t, tdb, 200*time.Millisecond, 0)
+	tdb.Exec("UPDATE accounts SET response_timeout_ms = 5000 WHERE id = 'acct-slow'")
+
+	if w := sendMessages(t, plainMessage, nil); w.Code != 200 {
+		t.Fatalf("status = %d, body = %s; want the account's longer timeout to apply", w.Code, w.Body.String())
+	}
+}
+
+func TestUpstreamTimeout_StreamOnlyBoundsHeaders(t *testing.T) {
+	const streamed = `{"model":"claude-sonnet-4-20250514","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}`
+
+	t.Run("slow body", func(t *testing.T) {
+		tdb := dbtest.Open(t)
+		tdb.SetSetting("provider_header_timeout_ms", "100")
+		tdb.SetSetting("provider_response_timeout_ms", "50")
+		slowUpstream(t, tdb, 0, 200*time.Millisecond)
+		w := sendMessages(t, streamed, nil)
+		if w.Code != 200 || !strings.Contains(w.Body.String(), "message_stop") {
+			t.Fatalf("status = %d, body = %s; want the whole stream", w.Code, w.Body.String())
+		}
+	})
+	t.Run("slow headers", func(t *testing.T) {
+		tdb := dbtest.Open(t)
+		tdb.SetSetting("provider_header_timeout_ms", "50")
+		slowUpstream(t, tdb, 2*time.Second, 0)
+		if w := sendMessages(t, streamed, nil); w.Code != 504 {
+			t.Fatalf("status = %d, body = %s; want 504", w.Code, w.Body.String())
+		}
+	})
+}
@@ -0,0 +1,248 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Modes for tool results over max_tool_result_bytes.
+const (
+	toolResultSplit    = "split"
+	toolResultTruncate = "truncate"
+)
+
+// toolResultLimit reads max_tool_result_bytes and max_tool_result_mode. It
+// returns a zero limit when the mode is off (the default) or the size unset.
+func toolResultLimit(getSetting func(string) string) (int, string) {
+	mode := getSetting("max_tool_result_mode")
+	if mode != toolResultSplit && mode != toolResultTruncate {
+		return 0, ""
+	}
+	n, err := strconv.Atoi(getSetting("max_tool_result_bytes"))
+	if err != nil || n <= 0 {
+		return 0, ""
+	}
+	return n, mode
+}
+
+// limitToolResults applies the tool result limit to the Anthropic body and,
+// for OpenAI clients, to the tool messages forwarded as-is to OpenAI
+// providers. Truncation keeps the head and tail of the text around an
+// omission marker; splitting replaces the result with consecutive results
+// for the same tool call, each holding one marked part. It returns a note
+// for the conversion warnings header, or "" if nothing was over the limit.
+func (b *requestBody) limitToolResults(inboundFormat string, limit int, mode string) string {
+	var results, cut int
+	if b.anthropic != nil {
+		if n, c := limitAnthropicToolResults(b.anthropic, limit, mode); n > 0 {
+			results, cut = n, c
+			b.anthropicModified = true
+		}
+	}
+	if inboundFormat == "openai" && b.parsed != nil {
+		if n, _ := limitOpenAIToolMessages(b.parsed, limit, mode); n > 0 {
+			b.raw, _ = json.Marshal(b.parsed)
+		}
+	}
+	if results == 0 {
+		return ""
+	}
+	if mode == toolResultSplit {
+		return fmt.Sprintf("split %d tool results over %d bytes into parts", results, limit)
+	}
+	return fmt.Sprintf("truncated %d tool results over %d bytes (%d KB omitted)", results, limit, (cut+1023)/1024)
+}
+
+// limitAnthropicToolResults limits the tool_result blocks of user messages.
+// It returns how many blocks were over the limit and the bytes truncated.
+func limitAnthropicToolResults(body map[string]any, limit int, mode string) (int, int) {
+	msgs, _ := body["messages"].([]any)
+	var results, cut int
+	for _, raw := range msgs {
+		m, _ := raw.(map[string]any)
+		blocks, ok := m["content"].([]any)
+		if !ok {
+			continue
+		}
+		out := blocks[:0:0]
+		changed := false
+		for _, rb := range blocks {
+			block, ok := rb.(map[string]any)
+			if !ok || block["type"] != "tool_result" {
+				out = append(out, rb)
+				continue
+			}
+			text, rest, ok := toolResultText(block["content"])
+			if !ok || len(text) <= limit {
+				out = append(out, rb)
+				continue
+			}
+			results++
+			changed = true
+			if mode == toolResultTruncate {
+				truncated := truncateMiddle(text, limit)
+				cut += len(text) - len(truncated)
+				block["content"] = withText(truncated, rest)
+				out = append(out, block)
+				continue
+			}
+			parts := splitText(text, limit)
+			for i, part := range parts {
+				p := make(map[string]any, len(block))
+				for k, v := range block {
+					p[k] = v
+				}
+				var partRest []any
+				if i == 0 {
+					partRest = rest
+				}
+				p["content"] = withText(part, partRest)
+				// A cache breakpoint belongs after the last part
+				if i < len(parts)-1 {
+					delete(p, "cache_control")
+				}
+				out = append(out, p)
+			}
+		}
+		if changed {
+			m["content"] = out
+		}
+	}
+	return results, cut
+}
+
+// limitOpenAIToolMessages limits the content of role "tool" messages.
+func limitOpenAIToolMessages(body map[string]any, limit int, mode string) (int, int) {
+	msgs, _ := body["messages"].([]any)
+	out := make([]any, 0, len(msgs))
+	var results, cut int
+	for _, raw := range msgs {
+		m, ok := raw.(map[string]any)
+		if !ok || m["role"] != "tool" {
+			out = append(out, raw)
+			continue
+		}
+		text, rest, ok := toolResultText(m["content"])
+		if !ok || len(rest) > 0 || len(text) <= limit {
+			out = append(out, raw)
+			continue
+		}
+		results++
+		if mode == toolResultTruncate {
+			truncated := truncateMiddle(text, limit)
+			cut += len(text) - len(truncated)
+			m["content"] = truncated
+			out = append(out, m)
+			continue
+		}
+		for _, part := range splitText(text, limit) {
+			p := make(map[string]any, len(m))
+			for k, v := range m {
+				p[k] = v
+			}
+			p["content"] = part
+			out = append(out, p)
+		}
+	}
+	if results > 0 {
+		body["messages"] = out
+	}
+	return results, cut
+}
+
+// toolResultText returns the text of tool result content: a string, or the
+// text parts of an array joined by newlines, with its other parts (images)
+// in rest. ok is false for content with no text.
+func toolResultText(content any) (text string, rest []any, ok bool) {
+	switch c := content.(type) {
+	case string:
+		return c, nil, true
+	case []any:
+		var texts []string
+		for _, item := range c {
+			part, _ := item.(map[string]any)
+			if s, isText := part["text"].(string); isText && part["type"] == "text" {
+				texts = append(texts, s)
+			} else {
+				rest = append(rest, item)
+			}
+		}
+		if len(texts) == 0 {
+			return "", nil, false
+		}
+		return strings.Join(texts, "\n"), rest, true
+	}
+	return "", nil, false
+}
+
+// withText returns tool_result content holding text, as a string when there
+// are no other parts.
+func withText(text string, rest []any) any {
+	if len(rest) == 0 {
+		return text
+	}
+	return append([]any{map[string]any{"type": "text", "text": text}}, rest...)
+}
+
+// truncateMiddle cuts the middle of s, leaving an omission marker, so the
+// result is at most limit bytes where the limit allows the marker.
+func truncateMiddle(s string, limit int) string {
+	// Sized for the longest marker, since the omitted count isn't known yet
+	keep := max(limit-len(omittedMarker(len(s))), 0)
+	head := runeBoundary(s, keep/2)
+	tail := runeBoundaryAfter(s, len(s)-(keep-keep/2))
+	return s[:head] + omittedMarker(tail-head) + s[tail:]
+}
+
+func omittedMarker(n int) string {
+	return fmt.Sprintf("\n[... %d KB omitted ...]\n", (n+1023)/1024)
+}
+
+// splitText splits s into marked parts of at most limit bytes each, cutting
+// at line ends where one falls in the second half of a part.
+func splitText(s string, limit int) []string {
+	// Room for a "[part NN of NN]\n" marker
+	marker := len(fmt.Sprintf("[part %d of %d]\n", len(s), len(s)))
+	size := max(limit-marker, 1)
+	var chunks []string
+	for len(s) > size {
+		end := runeBoundary(s, size)
+		if nl := strings.LastIndexByte(s[:end], '\n'); nl >= end/2 {
+			end = nl + 1
+		}
+		if end == 0 {
+			// A rune wider than the part size
+			_, w := utf8.DecodeRuneInString(s)
+			end = w
+		}
+		chunks = append(chunks, s[:end])
+		s = s[end:]
+	}
+	chunks = append(chunks, s)
+	for i, c := range chunks {
+		chunks[i] = fmt.Sprintf("[part %d of %d]\n", i+1, len(chunks)) + c
+	}
+	return chunks
+}
+
+// runeBoundary returns the largest rune boundary in s at or before i.
+func runeBoundary(s string, i int) int {
+	if i >= len(s) {
+		return len(s)
+	}
+	for i > 0 && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return i
+}
+
+// runeBoundaryAfter returns the smallest rune boundary in s at or after i.
+func runeBoundaryAfter(s string, i int) int {
+	for i < len(s) && !utf8.RuneStart(s[i]) {
+		i++
+	}
+	return i
+}
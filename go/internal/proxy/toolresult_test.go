@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// bigToolOutput returns numbered lines totalling about n bytes.
+func bigToolOutput(n int) string {
+	var sb strings.Builder
+	for i := 0; sb.Len() < n; i++ {
+		fmt.Fprintf(&sb, "line %05d of the file\n", i)
+	}
+	return sb.String()
+}
+
+func toolResultBody(output string) map[string]any {
+	var body map[string]any
+	json.Unmarshal([]byte(`{"model":"claude-sonnet-4-20250514","max_tokens":16,"messages":[
+		{"role":"user","content":"read it"},
+		{"role":"assistant","content":[{"type":"tool_use","id":"toolu_1","name":"read_file","input":{}},{"type":"tool_use","id":"toolu_2","name":"read_file","input":{}}]},
+		{"role":"user","content":[
+			{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":`+jsonString(output)+`},{"type":"image","source":{"type":"base64","media_type":"image/png","data":"AAAA"}}],"cache_control":{"type":"ephemeral"}},
+			{"type":"tool_result","tool_use_id":"toolu_2","content":"short"},
+			{"type":"text","text":"summarize"}]}]}`), &body)
+	return body
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// lastContent returns the content blocks of the final message.
+func lastContent(body map[string]any) []any {
+	msgs := body["messages"].([]any)
+	return msgs[len(msgs)-1].(map[string]any)["content"].([]any)
+}
+
+var partMarkerRe = regexp.MustCompile(`^\[part \d+ of \d+\]\n`)
+
+func TestLimitToolResults_Split(t *testing.T) {
+	output := bigToolOutput(10000)
+	body := toolResultBody(output)
+	req := &requestBody{parsed: body, anthropic: body}
+
+	note := req.limitToolResults("anthropic", 2000, toolResultSplit)
+	if note != "split 1 tool results over 2000 bytes into parts" || !req.anthropicModified {
+		t.Fatalf("note = %q, modified = %v", note, req.anthropicModified)
+	}
+	blocks := lastContent(body)
+	parts := blocks[:len(blocks)-2]
+	if len(parts) < 5 {
+		t.Fatalf("%d parts", len(parts))
+	}
+	var joined string
+	for i, raw := range parts {
+		p := raw.(map[string]any)
+		if p["type"] != "tool_result" || p["tool_use_id"] != "toolu_1" {
+			t.Fatalf("part %d = %v", i, p)
+		}
+		text, rest, _ := toolResultText(p["content"])
+		if len(text) > 2000 {
+			t.Errorf("part %d is %d bytes", i, len(text))
+		}
+		if want := fmt.Sprintf("[part %d of %d]\n", i+1, len(parts)); !strings.HasPrefix(text, want) {
+			t.Errorf("part %d starts %q", i, text[:20])
+		}
+		if (len(rest) == 1) != (i == 0) {
+			t.Errorf("part %d has %d non-text items; the image belongs to the first", i, len(rest))
+		}
+		if _, ok := p["cache_control"]; ok != (i == len(parts)-1) {
+			t.Errorf("part %d cache_control = %v", i, ok)
+		}
+		joined += partMarkerRe.ReplaceAllString(text, "")
+	}
+	if joined != output {
+		t.Error("parts don't add up to the original output")
+	}
+	if b := blocks[len(blocks)-2].(map[string]any); b["tool_use_id"] != "toolu_2" || b["content"] != "short" {
+		t.Errorf("following result = %v", b)
+	}
+	if b := blocks[len(blocks)-1].(map[string]any); b["text"] != "summarize" {
+		t.Errorf("last block = %v", b)
+	}
+}
+
+func TestLimitToolResults_Truncate(t *testing.T) {
+	output := bigToolOutput(10000) + "héllo"
+	body := toolResultBody(output)
+	req := &requestBody{parsed: body, anthropic: body}
+
+	note := req.limitToolResults("anthropic", 2000, toolResultTruncate)
+	if !strings.HasPrefix(note, "truncated 1 tool results over 2000 bytes") {
+		t.Fatalf("note = %q", note)
+	}
+	blocks := lastContent(body)
+	if len(blocks) != 3 {
+		t.Fatalf("%d blocks", len(blocks))
+	}
+	text, rest, _ := toolResultText(blocks[0].(map[string]any)["content"])
+	if len(text) > 2000 || len(rest) != 1 {
+		t.Errorf("%d bytes, %d other items", len(text), len(rest))
+	}
+	if !strings.HasPrefix(text, "line 00000") || !strings.HasSuffix(text, "héllo") || !strings.Contains(text, " KB omitted ...]") {
+		t.Errorf("truncated to %q", text)
+	}
+	if _, err := json.Marshal(body); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLimitToolResults_OpenAIToolMessages(t *testing.T) {
+	output := bigToolOutput(5000)
+	var body map[string]any
+	json.Unmarshal([]byte(`{"model":"gpt-4o","messages":[
+		{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"read_file","arguments":"{}"}}]},
+		{"role":"tool","tool_call_id":"call_1","content":`+jsonString(output)+`},
+		{"role":"user","content":"next"}]}`), &body)
+	req := &requestBody{parsed: body, anthropic: map[string]any{}}
+
+	req.limitToolResults("openai", 1000, toolResultSplit)
+	var sent map[string]any
+	json.Unmarshal(req.raw, &sent)
+	msgs := sent["messages"].([]any)
+	if len(msgs) < 7 || msgs[len(msgs)-1].(map[string]any)["content"] != "next" {
+		t.Fatalf("messages = %d", len(msgs))
+	}
+	for _, raw := range msgs[1 : len(msgs)-1] {
+		m := raw.(map[string]any)
+		if m["role"] != "tool" || m["tool_call_id"] != "call_1" || len(m["content"].(string)) > 1000 {
+			t.Errorf("tool message = %v", m["tool_call_id"])
+		}
+	}
+}
+
+func TestToolResultLimit_Setting(t *testing.T) {
+	tdb := dbtest.Open(t)
+	var sent map[string]any
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&sent)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-toolresult", "toolresult", "anthropic", upstream.URL)
+
+	raw, _ := json.Marshal(toolResultBody(bigToolOutput(10000)))
+	firstResult := func() string {
+		text, _, _ := toolResultText(lastContent(sent)[0].(map[string]any)["content"])
+		return text
+	}
+
+	// Off by default, even with a size set
+	tdb.SetSetting("max_tool_result_bytes", "2000")
+	w := sendMessages(t, string(raw), nil)
+	if w.Code != 200 || len(firstResult()) < 10000 || w.Header().Get(conversionWarningsHeader) != "" {
+		t.Fatalf("off: status %d, %d bytes forwarded, warnings %q", w.Code, len(firstResult()), w.Header().Get(conversionWarningsHeader))
+	}
+
+	tdb.SetSetting("max_tool_result_mode", "truncate")
+	w = sendMessages(t, string(raw), nil)
+	if w.Code != 200 || len(firstResult()) > 2000 {
+		t.Fatalf("truncate: status %d, %d bytes forwarded", w.Code, len(firstResult()))
+	}
+	if got := w.Header().Get(conversionWarningsHeader); !strings.Contains(got, "truncated 1 tool results over 2000 bytes") {
+		t.Errorf("%s = %q", conversionWarningsHeader, got)
+	}
+
+	tdb.SetSetting("max_tool_result_mode", "split")
+	w = sendMessages(t, string(raw), nil)
+	if n := len(lastContent(sent)); w.Code != 200 || n < 7 {
+		t.Fatalf("split: status %d, %d blocks forwarded", w.Code, n)
+	}
+}
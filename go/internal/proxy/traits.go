@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/routing"
+	"encoding/json"
+)
+
+// requestTraits reads the routing traits from a parsed inbound body, in
+// either format.
+func requestTraits(body map[string]any) routing.RequestTraits {
+	var t routing.RequestTraits
+	if tools, _ := body["tools"].([]any); len(tools) > 0 {
+		t.Tools = true
+	}
+	t.Thinking = thinkingRequested(body["thinking"], body["reasoning_effort"])
+	messages, _ := body["messages"].([]any)
+	for _, m := range messages {
+		msg, _ := m.(map[string]any)
+		if hasImage(msg["content"]) {
+			t.Images = true
+			break
+		}
+	}
+	return t
+}
+
+// spooledTraits reads what it can of the routing traits from a spooled body's
+// top-level fields. Messages aren't scanned, so images go undetected.
+func spooledTraits(s *spooledBody) routing.RequestTraits {
+	var t routing.RequestTraits
+	if f, ok := s.fields["tools"]; ok {
+		var tools []json.RawMessage
+		t.Tools = json.Unmarshal(f.raw, &tools) == nil && len(tools) > 0
+	}
+	var thinking any
+	if f, ok := s.fields["thinking"]; ok {
+		json.Unmarshal(f.raw, &thinking)
+	}
+	effort, _ := s.stringField("reasoning_effort")
+	t.Thinking = thinkingRequested(thinking, effort)
+	return t
+}
+
+// thinkingRequested reports whether an Anthropic thinking config or an
+// OpenAI reasoning_effort asks for reasoning.
+func thinkingRequested(thinking, reasoningEffort any) bool {
+	if cfg, ok := thinking.(map[string]any); ok && cfg["type"] != "disabled" {
+		return true
+	}
+	effort, _ := reasoningEffort.(string)
+	return effort != "" && effort != "none"
+}
+
+// hasImage reports whether message content includes an image, including
+// images returned inside Anthropic tool results.
+func hasImage(content any) bool {
+	blocks, _ := content.([]any)
+	for _, b := range blocks {
+		block, _ := b.(map[string]any)
+		switch block["type"] {
+		case "image", "image_url", "input_image":
+			return true
+		case "tool_result":
+			if hasImage(block["content"]) {
+				return true
+			}
+		}
+	}
+	return false
+}
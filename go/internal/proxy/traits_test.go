@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/routing"
+	"encoding/json"
+	"testing"
+)
+
+func TestRequestTraits(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		want routing.RequestTraits
+	}{
+		{"plain", `{"messages":[{"role":"user","content":"hi"}]}`, routing.RequestTraits{}},
+		{"anthropic thinking", `{"thinking":{"type":"enabled","budget_tokens":2048}}`, routing.RequestTraits{Thinking: true}},
+		{"thinking disabled", `{"thinking":{"type":"disabled"}}`, routing.RequestTraits{}},
+		{"reasoning effort", `{"reasoning_effort":"high"}`, routing.RequestTraits{Thinking: true}},
+		{"reasoning effort none", `{"reasoning_effort":"none"}`, routing.RequestTraits{}},
+		{"tools", `{"tools":[{"name":"get_weather"}]}`, routing.RequestTraits{Tools: true}},
+		{"empty tools", `{"tools":[]}`, routing.RequestTraits{}},
+		{"anthropic image", `{"messages":[{"role":"user","content":[{"type":"image","source":{}}]}]}`, routing.RequestTraits{Images: true}},
+		{"openai image", `{"messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"x"}}]}]}`, routing.RequestTraits{Images: true}},
+		{"image in tool result", `{"messages":[{"role":"user","content":[{"type":"tool_result","content":[{"type":"image"}]}]}]}`, routing.RequestTraits{Images: true}},
+	}
+	for _, tc := range cases {
+		var body map[string]any
+		if err := json.Unmarshal([]byte(tc.body), &body); err != nil {
+			t.Fatal(err)
+		}
+		if got := requestTraits(body); got != tc.want {
+			t.Errorf("%s: traits = %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSpooledTraits(t *testing.T) {
+	sp := spoolString(t, `{"model":"m","tools":[{"name":"a"}],"thinking":{"type":"enabled"},"messages":[]}`)
+	if got, want := spooledTraits(sp), (routing.RequestTraits{Thinking: true, Tools: true}); got != want {
+		t.Errorf("traits = %+v, want %+v", got, want)
+	}
+}
+
+func TestRouteExplain(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.AddAccount("acct-rx", "explain", "openai", "")
+	tdb.Exec("INSERT INTO configs (id, name, is_active, routing_strategy) VALUES ('cfg-rx', 'Explain', 1, 'priority')")
+	tdb.Exec(`INSERT INTO config_tiers (id, config_id, tier, account_id, priority, target_model, condition) VALUES
+		('rx1', 'cfg-rx', 'opus', 'acct-rx', 1, 'o3', 'thinking'),
+		('rx2', 'cfg-rx', 'opus', 'acct-rx', 1, 'gpt-4.1', 'no_thinking')`)
+
+	w := getStatus(t, "/admin/route-explain?model=claude-opus-4-20250514&thinking=true", "")
+	if w.Code != 200 {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var exp routing.Explanation
+	if err := json.Unmarshal(w.Body.Bytes(), &exp); err != nil {
+		t.Fatal(err)
+	}
+	if exp.Condition != "thinking" || exp.TargetModel != "o3" || !exp.Traits.Thinking || len(exp.Rows) != 2 {
+		t.Errorf("explanation = %+v", exp)
+	}
+
+	if w := getStatus(t, "/admin/route-explain", ""); w.Code != 400 {
+		t.Errorf("missing model: status = %d, want 400", w.Code)
+	}
+	t.Setenv("PROXY_API_KEY", "admin-key")
+	if w := getStatus(t, "/admin/route-explain?model=opus", "wrong-key"); w.Code != 401 {
+		t.Errorf("wrong key: status = %d, want 401", w.Code)
+	}
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// trimmedHeader reports how much tool output was trimmed before the request
+// fit the model's context window.
+var trimmedHeader = exposeHeader("X-CodeGate-Trimmed")
+
+const (
+	// trimKeepRecent is how many trailing messages are never trimmed, so the
+	// turn in progress keeps its tool results.
+	trimKeepRecent = 4
+
+	// trimTargetRatio aims below the limit, since the size-to-token estimate
+	// is rough.
+	trimTargetRatio = 0.9
+)
+
+var promptTooLongRe = regexp.MustCompile(`prompt is too long: (\d+) tokens > (\d+) maximum`)
+
+// parsePromptTooLong extracts the token count and limit from Anthropic's
+// "prompt is too long: N tokens > M maximum" error body.
+func parsePromptTooLong(body string) (tokens, limit int, ok bool) {
+	m := promptTooLongRe.FindStringSubmatch(body)
+	if m == nil {
+		return 0, 0, false
+	}
+	tokens, err1 := strconv.Atoi(m[1])
+	limit, err2 := strconv.Atoi(m[2])
+	if err1 != nil || err2 != nil || limit <= 0 || tokens <= limit {
+		return 0, 0, false
+	}
+	return tokens, limit, true
+}
+
+type trimCandidate struct {
+	block map[string]any
+	size  int
+}
+
+// trimForContext replaces the content of the largest tool_result blocks
+// (oldest first among equals) with a short placeholder until the body's
+// estimated token count is under trimTargetRatio of limit. The system
+// prompt and the last trimKeepRecent messages are left alone. It returns
+// how many blocks and bytes were trimmed, or zeros (with the body
+// untouched) when trimming can't bring the request under the limit.
+func (b *requestBody) trimForContext(tokens, limit int) (int, int) {
+	if b.anthropic == nil {
+		return 0, 0
+	}
+	msgs, _ := b.anthropic["messages"].([]any)
+	full, err := json.Marshal(b.anthropic)
+	if err != nil || len(msgs) <= trimKeepRecent {
+		return 0, 0
+	}
+	bytesPerToken := float64(len(full)) / float64(tokens)
+	need := int(float64(tokens-int(float64(limit)*trimTargetRatio)) * bytesPerToken)
+
+	var cands []trimCandidate
+	for _, raw := range msgs[:len(msgs)-trimKeepRecent] {
+		m, _ := raw.(map[string]any)
+		blocks, _ := m["content"].([]any)
+		for _, rb := range blocks {
+			block, ok := rb.(map[string]any)
+			if !ok || block["type"] != "tool_result" || block["content"] == nil {
+				continue
+			}
+			content, _ := json.Marshal(block["content"])
+			cands = append(cands, trimCandidate{block: block, size: len(content)})
+		}
+	}
+	sort.SliceStable(cands, func(i, j int) bool { return cands[i].size > cands[j].size })
+
+	var picked []trimCandidate
+	saved := 0
+	for _, c := range cands {
+		if saved >= need {
+			break
+		}
+		saved += c.size - len(trimPlaceholder(c.size))
+		picked = append(picked, c)
+	}
+	if saved < need {
+		return 0, 0
+	}
+
+	for _, c := range picked {
+		c.block["content"] = trimPlaceholder(c.size)
+	}
+	b.anthropicModified = true
+	return len(picked), saved
+}
+
+func trimPlaceholder(size int) string {
+	return fmt.Sprintf("[trimmed: %d KB tool output]", (size+1023)/1024)
+}
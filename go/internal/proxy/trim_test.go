@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/dbtest"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const promptTooLongBody = `{"type":"error","error":{"type":"invalid_request_error","message":"prompt is too long: 250000 tokens > 200000 maximum"}}`
+
+// overflowConversation has two large tool results in old turns and one in
+// the last trimKeepRecent messages.
+func overflowConversation() string {
+	big := func(c byte, n int) string { return strings.Repeat(string(c), n) }
+	toolTurn := func(id, output string) string {
+		return `{"role":"assistant","content":[{"type":"tool_use","id":"` + id + `","name":"read","input":{}}]},` +
+			`{"role":"user","content":[{"type":"tool_result","tool_use_id":"` + id + `","content":"` + output + `"}]}`
+	}
+	return `{"model":"claude-sonnet-4-20250514","max_tokens":16,"system":"` + big('s', 1000) + `","messages":[` +
+		`{"role":"user","content":"start"},` +
+		toolTurn("t1", big('a', 60_000)) + `,` +
+		toolTurn("t2", big('b', 120_000)) + `,` +
+		`{"role":"assistant","content":"ok"},` +
+		toolTurn("t3", big('c', 80_000)) + `,` +
+		`{"role":"assistant","content":"next"},{"role":"user","content":"go on"}]}`
+}
+
+func TestContextOverflow_TrimsAndRetries(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.SetSetting("auto_trim_on_context_overflow", "true")
+
+	var mu sync.Mutex
+	var bodies []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(b))
+		first := len(bodies) == 1
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if first {
+			w.WriteHeader(400)
+			fmt.Fprint(w, promptTooLongBody)
+			return
+		}
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-a", "alpha", "anthropic", upstream.URL)
+
+	w := sendMessages(t, overflowConversation(), nil)
+	if w.Code != 200 || len(bodies) != 2 {
+		t.Fatalf("status = %d after %d upstream requests, want 200 after one retry: %s", w.Code, len(bodies), w.Body.String())
+	}
+	if got := w.Header().Get(trimmedHeader); got != "1 tool results, 118 KB" {
+		t.Errorf("%s = %q", trimmedHeader, got)
+	}
+	if got := w.Header().Get(conversionWarningsHeader); !strings.Contains(got, "trimmed 1 tool results") {
+		t.Errorf("%s = %q, want the trim noted", conversionWarningsHeader, got)
+	}
+
+	first, retry := bodies[0], bodies[1]
+	if len(retry) > len(first)*3/4 {
+		t.Errorf("retry body is %d bytes, original %d; want it to shrink by the largest tool result", len(retry), len(first))
+	}
+	var parsed struct {
+		System   string `json:"system"`
+		Messages []struct {
+			Content json.RawMessage `json:"content"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal([]byte(retry), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.System) != 1000 {
+		t.Error("system prompt was trimmed")
+	}
+	content := func(i int) string { return string(parsed.Messages[i].Content) }
+	if !strings.Contains(content(4), "[trimmed: 118 KB tool output]") {
+		t.Errorf("largest old tool result not trimmed: %.80s", content(4))
+	}
+	if !strings.Contains(content(2), strings.Repeat("a", 60_000)) {
+		t.Error("smaller tool result trimmed although one was enough")
+	}
+	if !strings.Contains(content(7), strings.Repeat("c", 80_000)) {
+		t.Error("tool result in the recent messages was trimmed")
+	}
+}
+
+func TestContextOverflow_DisabledByDefault(t *testing.T) {
+	tdb := dbtest.Open(t)
+	hits := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		fmt.Fprint(w, promptTooLongBody)
+	}))
+	defer upstream.Close()
+	tdb.AddAccount("acct-a", "alpha", "anthropic", upstream.URL)
+
+	w := sendMessages(t, overflowConversation(), nil)
+	if w.Code != 400 || hits != 1 {
+		t.Errorf("status = %d after %d upstream requests, want the 400 passed through", w.Code, hits)
+	}
+	if !strings.Contains(w.Body.String(), "prompt is too long") || w.Header().Get(trimmedHeader) != "" {
+		t.Errorf("unexpected response: %s", w.Body.String())
+	}
+}
+
+func TestParsePromptTooLong(t *testing.T) {
+	if tokens, limit, ok := parsePromptTooLong(promptTooLongBody); !ok || tokens != 250000 || limit != 200000 {
+		t.Errorf("parsePromptTooLong = %d, %d, %v", tokens, limit, ok)
+	}
+	for _, body := range []string{
+		`{"error":{"message":"max_tokens: 5000 > 4096"}}`,
+		`{"error":{"message":"prompt is too long: 100 tokens > 200 maximum"}}`,
+	} {
+		if _, _, ok := parsePromptTooLong(body); ok {
+			t.Errorf("parsed %s", body)
+		}
+	}
+}
+
+func TestTrimForContext_GivesUpWhenInsufficient(t *testing.T) {
+	req := parseTestBody(t, []byte(overflowConversation()))
+	// The old tool results are under 70% of the body; trimming both can't
+	// bring it down to a fifth
+	if blocks, _ := req.trimForContext(1000000, 200000); blocks != 0 {
+		t.Errorf("trimmed %d blocks for an unreachable target", blocks)
+	}
+	if req.anthropicModified || strings.Contains(req.anthropicWithModel("m"), "[trimmed:") {
+		t.Error("body changed although trimming was abandoned")
+	}
+}
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"codegate-proxy/internal/guardrails"
+	"codegate-proxy/internal/metrics"
+)
+
+// guardrailsUnresolvedHeader carries the per-category count of anonymised
+// tokens a response returned unrestored, when debug_headers is on.
+var guardrailsUnresolvedHeader = exposeHeader("X-Guardrails-Unresolved")
+
+// reportUnresolved logs and counts the tokens deanonymization left in a
+// response, so a guardrail key mismatch shows up before users report
+// "[SSN-...]" in their answers. Only categories are logged, never tokens.
+func reportUnresolved(logf func(string, ...any), u guardrails.Unresolved, account, upstreamReqID string) {
+	if u.Total() == 0 {
+		return
+	}
+	request := ""
+	if upstreamReqID != "" {
+		request = " (request " + upstreamReqID + ")"
+	}
+	logf("[guardrails] WARN response from %q%s has tokens that could not be deanonymized: %s", account, request, u)
+	for category, n := range u {
+		metrics.Add("codegate_guardrails_unresolved_tokens_total", int64(n), "category", category)
+	}
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"bytes"
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/guardrails"
+	"codegate-proxy/internal/metrics"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// lockedBuffer collects log output written from handler goroutines.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestUnresolvedGuardrailTokens(t *testing.T) {
+	// A token issued under another guardrail key, and one the model cut short
+	const answer = "Your SSN is [SSN-AbC123xyzQ] and your card [VISA-0000dead"
+	cases := []struct {
+		name, body, debug, want string
+	}{
+		{"non-streaming", plainMessage, "true", "ssn=1"},
+		{"streaming", `{"model":"claude-sonnet-4-20250514","stream":true,"max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`, "true", "ssn=1"},
+		{"debug headers off", plainMessage, "", ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tdb := dbtest.Open(t)
+			tdb.SetSetting("privacy_enabled", "true")
+			tdb.SetSetting("debug_headers", tc.debug)
+			guardrails.InitGuardrails()
+			metrics.Reset()
+			logs := &lockedBuffer{}
+			log.SetOutput(logs)
+			t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Request-Id", "req_upstream_1")
+				if strings.Contains(tc.body, `"stream":true`) {
+					w.Header().Set("Content-Type", "text/event-stream")
+					fmt.Fprint(w, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Your SSN is [SSN-AbC\"}}\n\n")
+					fmt.Fprintf(w, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":%q}}\n\n", strings.TrimPrefix(answer, "Your SSN is [SSN-AbC"))
+					fmt.Fprint(w, "event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":0}\n\n")
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":%q}],"usage":{"input_tokens":1,"output_tokens":1}}`, answer)
+			}))
+			defer upstream.Close()
+			tdb.AddAccount("acct-unresolved", "unresolved", "anthropic", upstream.URL)
+
+			w := sendMessages(t, tc.body, nil)
+			if w.Code != 200 {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), "[SSN-AbC123xyzQ]") {
+				t.Errorf("body = %s", w.Body.String())
+			}
+			res := w.Result()
+			got := res.Header.Get(guardrailsUnresolvedHeader)
+			if got == "" {
+				got = res.Trailer.Get(guardrailsUnresolvedHeader)
+			}
+			if got != tc.want {
+				t.Errorf("%s = %q, want %q", guardrailsUnresolvedHeader, got, tc.want)
+			}
+
+			if n := metrics.Counter("codegate_guardrails_unresolved_tokens_total", "category", "ssn"); n != 1 {
+				t.Errorf("unresolved ssn counter = %d, want 1", n)
+			}
+			logged := logs.String()
+			if !strings.Contains(logged, `from "unresolved" (request req_upstream_1) has tokens that could not be deanonymized: ssn=1`) {
+				t.Errorf("log = %s", logged)
+			}
+			if strings.Contains(logged, "AbC123xyzQ") {
+				t.Errorf("log carries the token: %s", logged)
+			}
+		})
+	}
+}
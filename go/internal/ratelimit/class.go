@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"strings"
+	"time"
+)
+
+// Class is a traffic class sharing a rate limit bucket.
+type Class string
+
+const (
+	Interactive Class = "interactive"
+	Background  Class = "background"
+)
+
+// ParseClass maps an X-CodeGate-Priority header value to a Class.
+// Anything other than "background" is interactive.
+func ParseClass(s string) Class {
+	if strings.EqualFold(strings.TrimSpace(s), string(Background)) {
+		return Background
+	}
+	return Interactive
+}
+
+// ClassLimits are the per-minute limits for a class-aware bucket.
+type ClassLimits struct {
+	Total      int // all traffic; 0 = unlimited
+	Background int // background traffic alone; 0 = no separate cap
+	Headroom   int // part of Total background traffic may not use
+}
+
+// CheckAndRecordClass is CheckAndRecord for a bucket shared by interactive and
+// background traffic. Interactive requests are limited by Total only.
+// Background requests are also limited by their own cap and may not use the
+// last Headroom slots of Total, so under pressure they are rejected first.
+// Returns true if the request is rate-limited (rejected).
+func CheckAndRecordClass(key string, class Class, l ClassLimits) bool {
+	if l.Total <= 0 && l.Background <= 0 {
+		return false
+	}
+
+	// Lock order: total window, then background window
+	total := getWindow(key)
+	bg := getWindow(key + ":" + string(Background))
+	total.mu.Lock()
+	defer total.mu.Unlock()
+	bg.mu.Lock()
+	defer bg.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	cutoff := now - windowDuration.Milliseconds()
+	total.prune(cutoff)
+	bg.prune(cutoff)
+
+	if class == Background {
+		if l.Total > 0 && len(total.timestamps) >= l.Total-l.Headroom {
+			return rejected(key, class)
+		}
+		if l.Background > 0 && len(bg.timestamps) >= l.Background {
+			return rejected(key, class)
+		}
+		bg.timestamps = append(bg.timestamps, now)
+	} else if l.Total > 0 && len(total.timestamps) >= l.Total {
+		return rejected(key, class)
+	}
+
+	total.timestamps = append(total.timestamps, now)
+	return false
+}
+
+// Usage returns how many requests a class-aware bucket has let through in
+// the current window, in total and from background traffic, without
+// recording one.
+func Usage(key string) (total, background int) {
+	cutoff := time.Now().UnixMilli() - windowDuration.Milliseconds()
+	count := func(w *window) int {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.prune(cutoff)
+		return len(w.timestamps)
+	}
+	return count(getWindow(key)), count(getWindow(key + ":" + string(Background)))
+}
+
+// prune drops timestamps at or before cutoff. Callers hold w.mu.
+func (w *window) prune(cutoff int64) {
+	pruned := w.timestamps[:0]
+	for _, t := range w.timestamps {
+		if t > cutoff {
+			pruned = append(pruned, t)
+		}
+	}
+	w.timestamps = pruned
+}
@@ -1,6 +1,8 @@
 package ratelimit
 
 import (
+	"codegate-proxy/internal/metrics"
+	"strings"
 	"sync"
 	"time"
 )
@@ -48,19 +50,10 @@ func CheckAndRecord(accountID string, rateLimit int) bool {
 	defer w.mu.Unlock()
 
 	now := time.Now().UnixMilli()
-	cutoff := now - windowDuration.Milliseconds()
-
-	// Prune old timestamps
-	pruned := w.timestamps[:0]
-	for _, t := range w.timestamps {
-		if t > cutoff {
-			pruned = append(pruned, t)
-		}
-	}
-	w.timestamps = pruned
+	w.prune(now - windowDuration.Milliseconds())
 
 	if len(w.timestamps) >= rateLimit {
-		return true
+		return rejected(accountID, "")
 	}
 
 	w.timestamps = append(w.timestamps, now)
@@ -89,9 +82,49 @@ func IsRateLimited(accountID string, rateLimit int) bool {
 	return count >= rateLimit
 }
 
-// Clear removes rate limit state for an account.
+// Remaining returns how many more requests rateLimit lets through in the
+// current window, without recording one, and how long until the oldest
+// request leaves the window and frees a slot (zero for an empty window).
+// A rateLimit of 0 or less is unlimited, reported as -1 remaining.
+func Remaining(accountID string, rateLimit int) (int, time.Duration) {
+	if rateLimit <= 0 {
+		return -1, 0
+	}
+
+	w := getWindow(accountID)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	w.prune(now - windowDuration.Milliseconds())
+
+	var reset time.Duration
+	if len(w.timestamps) > 0 {
+		reset = time.Duration(w.timestamps[0]+windowDuration.Milliseconds()-now) * time.Millisecond
+	}
+	return max(rateLimit-len(w.timestamps), 0), reset
+}
+
+// rejected counts a rejected request and returns true. Its scope is the
+// prefix of a class-aware bucket key, such as "tenant" for tenant:<id>, or
+// "account" for an account ID.
+func rejected(key string, class Class) bool {
+	scope := "account"
+	if prefix, _, found := strings.Cut(key, ":"); found {
+		scope = prefix
+	}
+	labels := []string{"scope", scope}
+	if class != "" {
+		labels = append(labels, "class", string(class))
+	}
+	metrics.Inc("codegate_rate_limit_rejections_total", labels...)
+	return true
+}
+
+// Clear removes rate limit state for an account or class-aware bucket.
 func Clear(accountID string) {
 	mu.Lock()
 	defer mu.Unlock()
 	delete(windows, accountID)
+	delete(windows, accountID+":"+string(Background))
 }
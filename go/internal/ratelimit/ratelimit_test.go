@@ -1,6 +1,10 @@
 package ratelimit
 
-import "testing"
+import (
+	"codegate-proxy/internal/metrics"
+	"testing"
+	"time"
+)
 
 func TestCheckAndRecord_UnderLimit(t *testing.T) {
 	Clear("test-acct")
@@ -46,6 +50,32 @@ func TestIsRateLimited_NoRecord(t *testing.T) {
 	}
 }
 
+func TestRemaining_CountsDown(t *testing.T) {
+	Clear("test-remaining")
+
+	if left, reset := Remaining("test-remaining", 3); left != 3 || reset != 0 {
+		t.Errorf("empty window: %d left, reset %v", left, reset)
+	}
+	for want := 2; want >= 0; want-- {
+		CheckAndRecord("test-remaining", 3)
+		left, reset := Remaining("test-remaining", 3)
+		if left != want {
+			t.Errorf("%d left, want %d", left, want)
+		}
+		if reset <= 59*time.Second || reset > time.Minute {
+			t.Errorf("reset = %v, want about a minute", reset)
+		}
+	}
+	// A rejected request doesn't count
+	CheckAndRecord("test-remaining", 3)
+	if left, _ := Remaining("test-remaining", 3); left != 0 {
+		t.Errorf("%d left after a rejection", left)
+	}
+	if left, _ := Remaining("test-remaining", 0); left != -1 {
+		t.Errorf("unlimited: %d left, want -1", left)
+	}
+}
+
 func TestClear(t *testing.T) {
 	Clear("test-clear")
 
@@ -65,3 +95,111 @@ func TestClear(t *testing.T) {
 		t.Error("should not be limited after clear")
 	}
 }
+
+func TestParseClass(t *testing.T) {
+	for in, want := range map[string]Class{
+		"":            Interactive,
+		"interactive": Interactive,
+		"background":  Background,
+		" Background": Background,
+		"batch":       Interactive,
+	} {
+		if got := ParseClass(in); got != want {
+			t.Errorf("ParseClass(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCheckAndRecordClass_BackgroundRejectedFirst(t *testing.T) {
+	Clear("test-class")
+	limits := ClassLimits{Total: 10, Headroom: 3}
+
+	// Background may use 10-3 = 7 slots
+	for i := 0; i < 7; i++ {
+		if CheckAndRecordClass("test-class", Background, limits) {
+			t.Fatalf("background request %d rejected early", i+1)
+		}
+	}
+	if !CheckAndRecordClass("test-class", Background, limits) {
+		t.Error("background should be rejected inside the interactive headroom")
+	}
+
+	// Interactive still gets the reserved 3
+	for i := 0; i < 3; i++ {
+		if CheckAndRecordClass("test-class", Interactive, limits) {
+			t.Fatalf("interactive request %d rejected", i+1)
+		}
+	}
+	if !CheckAndRecordClass("test-class", Interactive, limits) {
+		t.Error("interactive should be rejected at the total limit")
+	}
+}
+
+func TestCheckAndRecordClass_BackgroundCap(t *testing.T) {
+	Clear("test-bgcap")
+	limits := ClassLimits{Total: 100, Background: 2}
+
+	CheckAndRecordClass("test-bgcap", Background, limits)
+	CheckAndRecordClass("test-bgcap", Background, limits)
+	if !CheckAndRecordClass("test-bgcap", Background, limits) {
+		t.Error("background should be rejected at its own cap")
+	}
+	if CheckAndRecordClass("test-bgcap", Interactive, limits) {
+		t.Error("interactive should not be affected by the background cap")
+	}
+}
+
+func TestCheckAndRecordClass_BackgroundCapOnly(t *testing.T) {
+	Clear("test-bgonly")
+	limits := ClassLimits{Background: 1}
+
+	CheckAndRecordClass("test-bgonly", Background, limits)
+	if !CheckAndRecordClass("test-bgonly", Background, limits) {
+		t.Error("background should be rejected at its cap with no total limit")
+	}
+	for i := 0; i < 50; i++ {
+		if CheckAndRecordClass("test-bgonly", Interactive, limits) {
+			t.Fatal("interactive should be unlimited without a total limit")
+		}
+	}
+}
+
+func TestClear_ClassBuckets(t *testing.T) {
+	Clear("test-clearclass")
+	limits := ClassLimits{Background: 1}
+	CheckAndRecordClass("test-clearclass", Background, limits)
+	Clear("test-clearclass")
+	if CheckAndRecordClass("test-clearclass", Background, limits) {
+		t.Error("Clear should reset the background bucket")
+	}
+}
+
+func TestUsage_NoRecord(t *testing.T) {
+	Clear("test-usage")
+	limits := ClassLimits{Total: 10}
+	CheckAndRecordClass("test-usage", Interactive, limits)
+	CheckAndRecordClass("test-usage", Background, limits)
+
+	for i := 0; i < 3; i++ {
+		if total, bg := Usage("test-usage"); total != 2 || bg != 1 {
+			t.Fatalf("Usage = %d, %d; want 2, 1", total, bg)
+		}
+	}
+}
+
+func TestRejectionsCounted(t *testing.T) {
+	metrics.Reset()
+	Clear("acct-counted")
+	Clear("tenant:counted")
+	CheckAndRecord("acct-counted", 1)
+	CheckAndRecord("acct-counted", 1)
+	CheckAndRecordClass("tenant:counted", Background, ClassLimits{Background: 1})
+	CheckAndRecordClass("tenant:counted", Background, ClassLimits{Background: 1})
+
+	if n := metrics.Counter("codegate_rate_limit_rejections_total", "scope", "account"); n != 1 {
+		t.Errorf("account rejections = %d, want 1", n)
+	}
+	if n := metrics.Counter("codegate_rate_limit_rejections_total", "scope", "tenant", "class", "background"); n != 1 {
+		t.Errorf("tenant background rejections = %d, want 1", n)
+	}
+}
@@ -0,0 +1,108 @@
+// Package redact scrubs credentials from text the proxy stores or logs, such
+// as upstream error messages that echo a rejected API key. Unlike the
+// guardrails, which swap secrets for reversible tokens, it replaces them
+// outright. The patterns here are the ones the API key, AWS and JWT
+// guardrails detect.
+package redact
+
+import (
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// VendorPrefixes lists 40+ known API key prefixes.
+var VendorPrefixes = []string{
+	"sk-ant-", "sk-proj-", "sk-", "ghp_", "gho_", "glpat-", "xoxb-",
+	"xoxp-", "xapp-", "xoxe-", "AKIA", "AIza", "hf_", "pk_live_", "sk_live_",
+	"rk_live_", "whsec_", "github_pat_", "pypi-", "npm_", "FLWSECK-",
+	"sq0atp-", "SG.", "key-", "sk-or-", "r8_", "sntrys_",
+	"op_", "Bearer ey",
+}
+
+// KnownPrefixRe matches API keys that start with one of VendorPrefixes.
+var KnownPrefixRe = regexp.MustCompile(
+	`(?:sk-ant-|sk-proj-|sk-|ghp_|gho_|glpat-|xoxb-|xoxp-|xapp-|xoxe-|AKIA|AIza|hf_|pk_live_|sk_live_|rk_live_|whsec_|github_pat_|pypi-|npm_|FLWSECK-|sq0atp-|SG\.|key-|sk-or-|r8_|sntrys_|op_|Bearer\s+ey)[A-Za-z0-9_\-/.+=]{10,}`,
+)
+
+// AWSAccessKeyRe matches AWS access key IDs.
+var AWSAccessKeyRe = regexp.MustCompile(`\b(AKIA[0-9A-Z]{16})\b`)
+
+// JWTRe matches JSON Web Tokens.
+var JWTRe = regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\b`)
+
+// triggers holds a substring of every possible match, so clean text is
+// passed through without running the regexps.
+var triggers = func() []string {
+	prefixes := slices.Clone(VendorPrefixes)
+	slices.SortFunc(prefixes, func(a, b string) int { return len(a) - len(b) })
+	out := []string{"eyJ", "Bearer"}
+	for _, p := range prefixes {
+		// "sk-ant-" is covered by "sk-", "Bearer ey" by "Bearer"
+		if !slices.ContainsFunc(out, func(t string) bool { return strings.Contains(p, t) }) {
+			out = append(out, p)
+		}
+	}
+	return out
+}()
+
+// mayContainSecret reports whether s contains any trigger.
+func mayContainSecret(s string) bool {
+	for _, t := range triggers {
+		if strings.Contains(s, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns s with API keys and JWTs replaced. Key prefixes are kept
+// (e.g. "sk-ant-[REDACTED]") so messages still say which kind of key it was.
+func String(s string) string {
+	if !mayContainSecret(s) {
+		return s
+	}
+	s = JWTRe.ReplaceAllString(s, "[REDACTED-JWT]")
+	s = AWSAccessKeyRe.ReplaceAllString(s, "AKIA[REDACTED]")
+	return KnownPrefixRe.ReplaceAllStringFunc(s, func(match string) string {
+		if strings.HasPrefix(match, "Bearer") {
+			return "Bearer [REDACTED]"
+		}
+		prefix := ""
+		for _, p := range VendorPrefixes {
+			if strings.HasPrefix(match, p) && len(p) > len(prefix) {
+				prefix = p
+			}
+		}
+		return prefix + "[REDACTED]"
+	})
+}
+
+// Writer scrubs everything written through it while enabled reports true.
+// A log.Logger writes each entry in a single call, so secrets are never
+// split across writes.
+type Writer struct {
+	w       io.Writer
+	enabled func() bool
+}
+
+// NewWriter returns a Writer that scrubs writes to w. enabled is called for
+// every write; nil means always on.
+func NewWriter(w io.Writer, enabled func() bool) *Writer {
+	return &Writer{w: w, enabled: enabled}
+}
+
+func (rw *Writer) Write(p []byte) (int, error) {
+	if rw.enabled != nil && !rw.enabled() {
+		return rw.w.Write(p)
+	}
+	s := string(p)
+	if !mayContainSecret(s) {
+		return rw.w.Write(p)
+	}
+	if _, err := io.WriteString(rw.w, String(s)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,99 @@
+package routing
+
+import (
+	"codegate-proxy/internal/tenant"
+	"strings"
+)
+
+// RequestTraits are the request properties a config tier row's condition
+// can match on.
+type RequestTraits struct {
+	Thinking bool `json:"thinking"` // extended thinking or a reasoning effort was requested
+	Tools    bool `json:"tools"`    // tools are declared
+	Images   bool `json:"images"`   // a message contains an image
+
+	// Background is set for X-CodeGate-Priority: background requests, which
+	// may not use the reserved part of a subscription window
+	Background bool `json:"background"`
+	// WindowReserve is the fraction of a subscription window background
+	// requests leave for interactive ones, read once per request
+	WindowReserve float64 `json:"-"`
+}
+
+// Matches reports whether a config tier condition applies to a request with
+// these traits. Conditions are "thinking", "tools" or "vision", optionally
+// negated with a "no_" prefix. The empty condition matches every request;
+// unknown conditions match none.
+func (t RequestTraits) Matches(condition string) bool {
+	if condition == "" {
+		return true
+	}
+	want := true
+	if rest, ok := strings.CutPrefix(condition, "no_"); ok {
+		want, condition = false, rest
+	}
+	switch condition {
+	case "thinking":
+		return t.Thinking == want
+	case "tools":
+		return t.Tools == want
+	case "vision":
+		return t.Images == want
+	}
+	return false
+}
+
+// Row exclusion reasons reported by Explain.
+const (
+	ExcludedCondition     = "condition_not_matched"
+	ExcludedDisabled      = "account_disabled"
+	ExcludedRateLimited   = "rate_limited"
+	ExcludedMonthlyBudget = "monthly_budget_exceeded"
+	ExcludedDailyBudget   = "daily_budget_exceeded"
+)
+
+// Explanation describes how a route was resolved: which config and tier
+// rows were considered, why rows were left out, and the order the rest
+// would be tried in.
+type Explanation struct {
+	Model       string         `json:"model"`
+	Tier        string         `json:"tier"`
+	Traits      RequestTraits  `json:"traits"`
+	Config      string         `json:"config,omitempty"`
+	Strategy    string         `json:"strategy,omitempty"`
+	Rows        []ExplainedRow `json:"rows"`
+	Condition   string         `json:"matched_condition,omitempty"` // condition of the selected row
+	TargetModel string         `json:"target_model,omitempty"`      // model the selected row maps to
+	Order       []string       `json:"order"`                       // account IDs in the order they would be tried
+}
+
+// ExplainedRow is one config tier row considered for the request.
+type ExplainedRow struct {
+	AccountID   string `json:"account_id"`
+	AccountName string `json:"account_name,omitempty"`
+	TargetModel string `json:"target_model,omitempty"`
+	Condition   string `json:"condition,omitempty"`
+	Excluded    string `json:"excluded,omitempty"`
+}
+
+// Explain resolves a route like ResolveForTenant without advancing
+// round-robin counters, and reports how it got there.
+func Explain(model string, t *tenant.Tenant, traits RequestTraits) (*ResolvedRoute, *Explanation, error) {
+	configID := ""
+	if t != nil {
+		configID = t.ConfigID
+	}
+	exp := &Explanation{Model: model, Traits: traits, Rows: []ExplainedRow{}, Order: []string{}}
+	route, err := resolveWithConfigID(model, configID, traits, exp)
+	if err != nil {
+		return nil, nil, err
+	}
+	if route != nil {
+		exp.Condition, exp.TargetModel = route.Condition, route.TargetModel
+		exp.Order = append(exp.Order, route.Account.ID)
+		for _, c := range route.Fallbacks {
+			exp.Order = append(exp.Order, c.Account.ID)
+		}
+	}
+	return route, exp, nil
+}
@@ -0,0 +1,41 @@
+package routing
+
+import (
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/health"
+	"strconv"
+)
+
+// defaultDemoteBelowPct is the success rate under which an account is moved
+// behind healthier candidates.
+const defaultDemoteBelowPct = 50
+
+// demoteBelow returns the success-rate threshold for demotion, from the
+// health_demote_below_pct setting (0 disables demotion).
+func demoteBelow() float64 {
+	pct := defaultDemoteBelowPct
+	if v, err := strconv.Atoi(db.GetSetting("health_demote_below_pct")); err == nil && v >= 0 && v <= 100 {
+		pct = v
+	}
+	return float64(pct) / 100
+}
+
+// demoteUnhealthy moves candidates whose recent success rate is below
+// threshold to the end, keeping the strategy's order within each group.
+// Accounts with too few recent requests are left where they are.
+func demoteUnhealthy(candidates []candidate, threshold float64) []candidate {
+	if threshold <= 0 {
+		return candidates
+	}
+	healthy := make([]candidate, 0, len(candidates))
+	var demoted []candidate
+	for _, c := range candidates {
+		rate, samples := health.SuccessRate(c.account.ID, health.DefaultWindow)
+		if samples >= health.MinSamples && rate < threshold {
+			demoted = append(demoted, c)
+			continue
+		}
+		healthy = append(healthy, c)
+	}
+	return append(healthy, demoted...)
+}
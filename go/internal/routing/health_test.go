@@ -0,0 +1,91 @@
+package routing
+
+import (
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/health"
+	"reflect"
+	"testing"
+)
+
+func record(accountID string, outcomes ...bool) {
+	for _, ok := range outcomes {
+		if ok {
+			health.RecordSuccess(accountID)
+		} else {
+			health.RecordFailure(accountID)
+		}
+	}
+}
+
+func ids(cs []candidate) []string {
+	var out []string
+	for _, c := range cs {
+		out = append(out, c.account.ID)
+	}
+	return out
+}
+
+func TestDemoteUnhealthy(t *testing.T) {
+	health.Reset()
+	t.Cleanup(health.Reset)
+
+	// a: 2/6 succeed (33%) → demoted
+	record("a", true, false, false, true, false, false)
+	// b: 4/6 succeed (67%) → kept
+	record("b", true, true, false, true, false, true)
+	// c: 0/3 → too few samples to judge
+	record("c", false, false, false)
+	// d: 1/5 (20%) → demoted
+	record("d", false, true, false, false, false)
+
+	in := []candidate{
+		{account: db.Account{ID: "a"}}, {account: db.Account{ID: "b"}},
+		{account: db.Account{ID: "c"}}, {account: db.Account{ID: "d"}},
+		{account: db.Account{ID: "e"}},
+	}
+
+	got := ids(demoteUnhealthy(in, 0.5))
+	if want := []string{"b", "c", "e", "a", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+	if got := ids(demoteUnhealthy(in, 0)); !reflect.DeepEqual(got, ids(in)) {
+		t.Errorf("threshold 0 should disable demotion, got %v", got)
+	}
+}
+
+func TestResolve_DemotesFailingAccount(t *testing.T) {
+	tdb := dbtest.Open(t)
+	health.Reset()
+	t.Cleanup(health.Reset)
+
+	tdb.AddAccount("primary", "primary", "anthropic", "")
+	tdb.AddAccount("backup", "backup", "anthropic", "")
+	tdb.Exec("INSERT INTO configs (id, name, is_active, routing_strategy) VALUES ('cfg', 'Main', 1, 'priority')")
+	tdb.Exec(`INSERT INTO config_tiers (id, config_id, tier, account_id, priority) VALUES
+		('t1', 'cfg', 'sonnet', 'primary', 10), ('t2', 'cfg', 'sonnet', 'backup', 1)`)
+
+	resolvePrimary := func() string {
+		t.Helper()
+		route, err := Resolve("claude-sonnet-4-20250514", RequestTraits{})
+		if err != nil || route == nil {
+			t.Fatalf("Resolve = %v, %v", route, err)
+		}
+		return route.Account.ID
+	}
+
+	if got := resolvePrimary(); got != "primary" {
+		t.Fatalf("healthy: primary = %q, want primary", got)
+	}
+
+	// 2 of 10 recent requests succeeded
+	record("primary", false, false, true, false, false, false, true, false, false, false)
+	if got := resolvePrimary(); got != "backup" {
+		t.Errorf("after failures: primary = %q, want backup", got)
+	}
+
+	tdb.SetSetting("health_demote_below_pct", "0")
+	if got := resolvePrimary(); got != "primary" {
+		t.Errorf("demotion disabled: primary = %q, want primary", got)
+	}
+}
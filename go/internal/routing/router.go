@@ -1,8 +1,8 @@
 package routing
 
 import (
-	"codegate-proxy/internal/cooldown"
 	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/metrics"
 	"codegate-proxy/internal/models"
 	"codegate-proxy/internal/ratelimit"
 	"codegate-proxy/internal/tenant"
@@ -19,12 +19,20 @@ type ResolvedRoute struct {
 	Tier                models.Tier
 	ConfigID            string
 	Fallbacks           []Candidate
+	Condition           string // condition of the primary's tier row; "" if it has none
+	FallbackModels      []string // models to try on the primary's account when its model is overloaded
 }
 
 // Candidate is an account+model pair for failover.
 type Candidate struct {
 	Account     db.Account
 	TargetModel string
+	// FallbackModels are tried in order on the same account when
+	// TargetModel is overloaded.
+	FallbackModels []string
+	// ModelFallback marks a candidate retrying the previous candidate's
+	// account with one of its fallback models.
+	ModelFallback bool
 }
 
 var (
@@ -33,20 +41,26 @@ var (
 )
 
 // Resolve resolves a route for a given model using the global active config.
-func Resolve(model string) (*ResolvedRoute, error) {
-	return resolveWithConfigID(model, "")
+// Tier rows whose condition doesn't match traits are skipped.
+func Resolve(model string, traits RequestTraits) (*ResolvedRoute, error) {
+	return resolveWithConfigID(model, "", traits, nil)
 }
 
 // ResolveForTenant resolves a route with tenant-scoped config.
-func ResolveForTenant(model string, t *tenant.Tenant) (*ResolvedRoute, error) {
+func ResolveForTenant(model string, t *tenant.Tenant, traits RequestTraits) (*ResolvedRoute, error) {
 	if t == nil || t.ConfigID == "" {
-		return Resolve(model)
+		return Resolve(model, traits)
 	}
-	return resolveWithConfigID(model, t.ConfigID)
+	return resolveWithConfigID(model, t.ConfigID, traits, nil)
 }
 
-func resolveWithConfigID(model string, configID string) (*ResolvedRoute, error) {
+// resolveWithConfigID resolves a route. When exp is non-nil it is filled in
+// as the route is resolved, and round-robin counters are left alone.
+func resolveWithConfigID(model string, configID string, traits RequestTraits, exp *Explanation) (*ResolvedRoute, error) {
 	tier := models.DetectTier(model)
+	if exp != nil {
+		exp.Tier = string(tier)
+	}
 
 	var activeConfig *db.Config
 	var err error
@@ -64,6 +78,10 @@ func resolveWithConfigID(model string, configID string) (*ResolvedRoute, error)
 		return nil, err
 	}
 
+	if exp != nil && activeConfig != nil {
+		exp.Config, exp.Strategy = activeConfig.Name, activeConfig.RoutingStrategy
+	}
+
 	if activeConfig == nil {
 		// No active config: pick first enabled account
 		if len(enabledAccounts) == 0 {
@@ -85,7 +103,7 @@ func resolveWithConfigID(model string, configID string) (*ResolvedRoute, error)
 		return &ResolvedRoute{
 			Account:            account,
 			TargetModel:        "",
-			NeedsFormatConvert: account.Provider != "anthropic",
+			NeedsFormatConvert: !account.SpeaksAnthropic(),
 			Tier:               tier,
 			ConfigID:           "",
 			Fallbacks:          nil,
@@ -117,7 +135,7 @@ func resolveWithConfigID(model string, configID string) (*ResolvedRoute, error)
 		return &ResolvedRoute{
 			Account:            enabledAccounts[0],
 			TargetModel:        "",
-			NeedsFormatConvert: enabledAccounts[0].Provider != "anthropic",
+			NeedsFormatConvert: !enabledAccounts[0].SpeaksAnthropic(),
 			Tier:               tier,
 			ConfigID:           activeConfig.ID,
 			Fallbacks:          nil,
@@ -134,58 +152,85 @@ func resolveWithConfigID(model string, configID string) (*ResolvedRoute, error)
 	var candidates []candidate
 	for _, assignment := range tierAssignments {
 		account, ok := accountMap[assignment.AccountID]
-		if !ok {
-			continue
+		excluded := ""
+		switch {
+		case !traits.Matches(assignment.Condition):
+			excluded = ExcludedCondition
+		case !ok:
+			excluded = ExcludedDisabled
+		case ratelimit.IsRateLimited(account.ID, account.RateLimit):
+			excluded = ExcludedRateLimited
+		case account.MonthlyBudget.Valid && account.MonthlyBudget.Float64 > 0 &&
+			db.GetMonthlySpend(account.ID) >= account.MonthlyBudget.Float64:
+			excluded = ExcludedMonthlyBudget
+		case account.DailyBudget.Valid && account.DailyBudget.Float64 > 0 &&
+			db.GetDailySpend(account.ID) >= account.DailyBudget.Float64:
+			excluded = ExcludedDailyBudget
 		}
-		if ratelimit.IsRateLimited(account.ID, account.RateLimit) {
-			continue
+		if exp != nil {
+			exp.Rows = append(exp.Rows, ExplainedRow{
+				AccountID: assignment.AccountID, AccountName: account.Name,
+				TargetModel: assignment.TargetModel, Condition: assignment.Condition, Excluded: excluded,
+			})
 		}
-		if account.MonthlyBudget.Valid && account.MonthlyBudget.Float64 > 0 {
-			spend := db.GetMonthlySpend(account.ID)
-			if spend >= account.MonthlyBudget.Float64 {
-				continue
+		if excluded != "" {
+			if exp == nil && excluded != ExcludedCondition {
+				metrics.Inc("codegate_route_exclusions_total", "tier", string(tier), "reason", excluded)
 			}
+			continue
 		}
 		tm := assignment.TargetModel
-		candidates = append(candidates, candidate{account: account, targetModel: tm, priority: assignment.Priority})
+		candidates = append(candidates, candidate{account: account, targetModel: tm, priority: assignment.Priority, condition: assignment.Condition,
+			fallbackModels: assignment.FallbackModels})
 	}
 
 	if len(candidates) == 0 {
 		return nil, nil
 	}
 
-	// Apply routing strategy
-	ordered := selectByStrategy(activeConfig.RoutingStrategy, candidates, activeConfig.ID, string(tier))
+	// Apply routing strategy, then move accounts failing most recent requests
+	// last, and cooled-down accounts after them
+	ordered := selectByStrategy(activeConfig.RoutingStrategy, candidates, activeConfig.ID, string(tier), exp == nil)
+	ordered = demoteUnhealthy(ordered, demoteBelow())
+	ordered = demoteCooledDown(ordered, traits)
 
 	primary := ordered[0]
 	var fallbacks []Candidate
 	for _, c := range ordered[1:] {
-		fallbacks = append(fallbacks, Candidate{Account: c.account, TargetModel: c.targetModel})
+		fallbacks = append(fallbacks, Candidate{Account: c.account, TargetModel: c.targetModel, FallbackModels: c.fallbackModels})
 	}
 
 	return &ResolvedRoute{
 		Account:            primary.account,
 		TargetModel:        primary.targetModel,
-		NeedsFormatConvert: primary.account.Provider != "anthropic",
+		NeedsFormatConvert: !primary.account.SpeaksAnthropic(),
 		Tier:               tier,
 		ConfigID:           activeConfig.ID,
 		Fallbacks:          fallbacks,
+		Condition:          primary.condition,
+		FallbackModels:     primary.fallbackModels,
 	}, nil
 }
 
 type candidate struct {
-	account     db.Account
-	targetModel string
-	priority    int
+	account        db.Account
+	targetModel    string
+	priority       int
+	condition      string
+	fallbackModels []string
 }
 
-func selectByStrategy(strategy string, candidates []candidate, configID, tier string) []candidate {
+// selectByStrategy orders candidates by the config's routing strategy.
+// advance is false when explaining a route, so round-robin doesn't move on.
+func selectByStrategy(strategy string, candidates []candidate, configID, tier string, advance bool) []candidate {
 	switch strategy {
 	case "round-robin":
 		key := configID + ":" + tier
 		roundRobinMu.Lock()
 		counter := roundRobinCounters[key]
-		roundRobinCounters[key] = counter + 1
+		if advance {
+			roundRobinCounters[key] = counter + 1
+		}
 		roundRobinMu.Unlock()
 
 		idx := counter % len(candidates)
@@ -239,28 +284,31 @@ func selectByStrategy(strategy string, candidates []candidate, configID, tier st
 	}
 }
 
-// SortByCooldown sorts candidates so non-cooled-down accounts come first.
-func SortByCooldown(candidates []Candidate) []Candidate {
+// demoteCooledDown moves candidates on cooldown, or with a used-up
+// subscription window, to the end, soonest to recover first, keeping the
+// order of the rest. The handler skips them anyway, so the primary is the
+// preferred account that can take the request. If every candidate is
+// unavailable they are all kept, in recovery order.
+func demoteCooledDown(candidates []candidate, traits RequestTraits) []candidate {
 	now := time.Now()
-	sorted := make([]Candidate, len(candidates))
+	until := make(map[string]time.Time)
+	for _, c := range candidates {
+		if t := UnavailableUntil(c.account.ID, traits); t.After(now) {
+			until[c.account.ID] = t
+		}
+	}
+	if len(until) == 0 {
+		return candidates
+	}
+	sorted := make([]candidate, len(candidates))
 	copy(sorted, candidates)
-
 	sort.SliceStable(sorted, func(i, j int) bool {
-		cdI := cooldown.CooldownUntil(sorted[i].Account.ID)
-		cdJ := cooldown.CooldownUntil(sorted[j].Account.ID)
-		cooledI := !cdI.IsZero() && cdI.After(now)
-		cooledJ := !cdJ.IsZero() && cdJ.After(now)
-
-		if !cooledI && !cooledJ {
-			return false
-		}
-		if !cooledI {
-			return true
-		}
-		if !cooledJ {
-			return false
+		ti, cooledI := until[sorted[i].account.ID]
+		tj, cooledJ := until[sorted[j].account.ID]
+		if cooledI != cooledJ {
+			return cooledJ
 		}
-		return cdI.Before(cdJ)
+		return cooledI && ti.Before(tj)
 	})
 	return sorted
 }
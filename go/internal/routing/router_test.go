@@ -0,0 +1,213 @@
+package routing
+
+import (
+	"codegate-proxy/internal/cooldown"
+	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/dbtest"
+	"codegate-proxy/internal/metrics"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRequestTraits_Matches(t *testing.T) {
+	traits := RequestTraits{Thinking: true, Images: true}
+	for cond, want := range map[string]bool{
+		"":            true,
+		"thinking":    true,
+		"no_thinking": false,
+		"tools":       false,
+		"no_tools":    true,
+		"vision":      true,
+		"no_vision":   false,
+		"audio":       false,
+		"no_audio":    false,
+	} {
+		if got := traits.Matches(cond); got != want {
+			t.Errorf("Matches(%q) = %v, want %v", cond, got, want)
+		}
+	}
+}
+
+// conditionedConfig sets up an opus tier where thinking requests go to a
+// reasoning model, plain ones to a cheaper model on the same account, and
+// tool or vision requests also to a catch-all backup.
+func conditionedConfig(t *testing.T, strategy string) {
+	tdb := dbtest.Open(t)
+	tdb.AddAccount("main", "main", "openai", "")
+	tdb.AddAccount("backup", "backup", "anthropic", "")
+	tdb.Exec("INSERT INTO configs (id, name, is_active, routing_strategy) VALUES ('cfg', 'Main', 1, ?)", strategy)
+	tdb.Exec(`INSERT INTO config_tiers (id, config_id, tier, account_id, priority, target_model, condition) VALUES
+		('t1', 'cfg', 'opus', 'main', 10, 'o3', 'thinking'),
+		('t2', 'cfg', 'opus', 'main', 10, 'gpt-4.1-mini', 'no_thinking'),
+		('t3', 'cfg', 'opus', 'backup', 5, '', 'tools'),
+		('t4', 'cfg', 'opus', 'backup', 1, '', NULL)`)
+}
+
+func TestResolve_ConditionedRows(t *testing.T) {
+	conditionedConfig(t, "priority")
+
+	type hop struct{ account, model string }
+	cases := []struct {
+		traits RequestTraits
+		want   []hop
+	}{
+		{RequestTraits{}, []hop{{"main", "gpt-4.1-mini"}, {"backup", ""}}},
+		{RequestTraits{Thinking: true}, []hop{{"main", "o3"}, {"backup", ""}}},
+		{RequestTraits{Tools: true}, []hop{{"main", "gpt-4.1-mini"}, {"backup", ""}, {"backup", ""}}},
+		{RequestTraits{Thinking: true, Tools: true}, []hop{{"main", "o3"}, {"backup", ""}, {"backup", ""}}},
+		{RequestTraits{Images: true}, []hop{{"main", "gpt-4.1-mini"}, {"backup", ""}}},
+		{RequestTraits{Thinking: true, Tools: true, Images: true}, []hop{{"main", "o3"}, {"backup", ""}, {"backup", ""}}},
+	}
+	for _, tc := range cases {
+		route, err := Resolve("claude-opus-4-20250514", tc.traits)
+		if err != nil || route == nil {
+			t.Fatalf("%+v: Resolve = %v, %v", tc.traits, route, err)
+		}
+		got := []hop{{route.Account.ID, route.TargetModel}}
+		for _, f := range route.Fallbacks {
+			got = append(got, hop{f.Account.ID, f.TargetModel})
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%+v: route = %v, want %v", tc.traits, got, tc.want)
+		}
+	}
+}
+
+func TestExplain_ReportsConditions(t *testing.T) {
+	conditionedConfig(t, "priority")
+
+	route, exp, err := Explain("claude-opus-4-20250514", nil, RequestTraits{Thinking: true})
+	if err != nil || route == nil {
+		t.Fatalf("Explain = %v, %v", route, err)
+	}
+	if exp.Tier != "opus" || exp.Config != "Main" || exp.Condition != "thinking" || exp.TargetModel != "o3" {
+		t.Errorf("explanation = %+v", exp)
+	}
+	excluded := map[string]string{}
+	for _, row := range exp.Rows {
+		excluded[row.Condition] = row.Excluded
+	}
+	want := map[string]string{"thinking": "", "no_thinking": ExcludedCondition, "tools": ExcludedCondition, "": ""}
+	if !reflect.DeepEqual(excluded, want) {
+		t.Errorf("exclusions = %v, want %v", excluded, want)
+	}
+	if want := []string{"main", "backup"}; !reflect.DeepEqual(exp.Order, want) {
+		t.Errorf("order = %v, want %v", exp.Order, want)
+	}
+}
+
+func TestExplain_DoesNotAdvanceRoundRobin(t *testing.T) {
+	conditionedConfig(t, "round-robin")
+	roundRobinMu.Lock()
+	delete(roundRobinCounters, "cfg:opus")
+	roundRobinMu.Unlock()
+
+	for i := 0; i < 3; i++ {
+		if _, exp, _ := Explain("claude-opus-4-20250514", nil, RequestTraits{}); exp.Order[0] != "main" {
+			t.Fatalf("explain %d: order = %v", i, exp.Order)
+		}
+	}
+	route, _ := Resolve("claude-opus-4-20250514", RequestTraits{})
+	if route.Account.ID != "main" {
+		t.Errorf("first real request went to %s, want main", route.Account.ID)
+	}
+	if _, exp, _ := Explain("claude-opus-4-20250514", nil, RequestTraits{}); exp.Order[0] != "backup" {
+		t.Errorf("after one request: order = %v, want backup first", exp.Order)
+	}
+}
+
+func TestResolve_DailyBudget(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.AddAccount("capped", "capped", "anthropic", "")
+	tdb.AddAccount("spare", "spare", "anthropic", "")
+	tdb.Exec("UPDATE accounts SET daily_budget = 10, monthly_budget = 100 WHERE id = 'capped'")
+	tdb.Exec("INSERT INTO configs (id, name, is_active) VALUES ('cfg', 'Main', 1)")
+	tdb.Exec(`INSERT INTO config_tiers (id, config_id, tier, account_id, priority) VALUES
+		('t1', 'cfg', 'sonnet', 'capped', 10), ('t2', 'cfg', 'sonnet', 'spare', 1)`)
+	tdb.Exec(`INSERT INTO usage (id, account_id, cost_usd, created_at) VALUES
+		('u1', 'capped', 50, '2026-03-09 23:59:59'), ('u2', 'capped', 6, '2026-03-10 09:00:00')`)
+
+	clock := time.Date(2026, 3, 10, 15, 0, 0, 0, time.UTC)
+	db.Now = func() time.Time { return clock }
+	t.Cleanup(func() { db.Now = time.Now })
+
+	explain := func() *Explanation {
+		t.Helper()
+		_, exp, err := Explain("claude-sonnet-4-20250514", nil, RequestTraits{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exp
+	}
+
+	// Yesterday's spend doesn't count against today's cap
+	if exp := explain(); exp.Rows[0].Excluded != "" || exp.Order[0] != "capped" {
+		t.Fatalf("under the cap: rows %+v, order %v", exp.Rows, exp.Order)
+	}
+
+	tdb.Exec("INSERT INTO usage (id, account_id, cost_usd, created_at) VALUES ('u3', 'capped', 5, '2026-03-10 14:30:00')")
+	exp := explain()
+	if exp.Rows[0].Excluded != ExcludedDailyBudget || !reflect.DeepEqual(exp.Order, []string{"spare"}) {
+		t.Errorf("over the cap: rows %+v, order %v", exp.Rows, exp.Order)
+	}
+	// Resolving counts the exclusion; explaining doesn't
+	metrics.Reset()
+	if _, err := Resolve("claude-sonnet-4-20250514", RequestTraits{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := metrics.Counter("codegate_route_exclusions_total", "tier", "sonnet", "reason", ExcludedDailyBudget); n != 1 {
+		t.Errorf("codegate_route_exclusions_total = %d, want 1", n)
+	}
+
+	clock = time.Date(2026, 3, 11, 0, 5, 0, 0, time.UTC)
+	if route, err := Resolve("claude-sonnet-4-20250514", RequestTraits{}); err != nil || route == nil || route.Account.ID != "capped" {
+		t.Errorf("next day: route = %+v, %v", route, err)
+	}
+}
+
+func TestResolve_DemotesCooledDown(t *testing.T) {
+	tdb := dbtest.Open(t)
+	tdb.Exec("INSERT INTO configs (id, name, is_active) VALUES ('cfg', 'Main', 1)")
+	for i, id := range []string{"first", "second", "third"} {
+		tdb.AddAccount(id, id, "anthropic", "")
+		tdb.Exec("INSERT INTO config_tiers (id, config_id, tier, account_id, priority) VALUES (?, 'cfg', 'sonnet', ?, ?)", "t-"+id, id, 10-i)
+	}
+	reset := func() {
+		for _, id := range []string{"first", "second", "third"} {
+			cooldown.Clear(id)
+		}
+	}
+	reset()
+	t.Cleanup(reset)
+
+	order := func() []string {
+		t.Helper()
+		_, exp, err := Explain("claude-sonnet-4-20250514", nil, RequestTraits{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exp.Order
+	}
+
+	cooldown.Set("first", "test", 60)
+	cooldown.Set("second", "test", 30)
+	if got, want := order(), []string{"third", "second", "first"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("two cooled down: order = %v, want %v", got, want)
+	}
+	route, err := Resolve("claude-sonnet-4-20250514", RequestTraits{})
+	if err != nil || route.Account.ID != "third" {
+		t.Errorf("primary = %+v, %v; want third", route, err)
+	}
+
+	// With every account cooling down, the soonest to recover leads
+	cooldown.Set("third", "test", 90)
+	if got, want := order(), []string{"second", "first", "third"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("all cooled down: order = %v, want %v", got, want)
+	}
+
+	reset()
+	if got, want := order(), []string{"first", "second", "third"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recovered: order = %v, want %v", got, want)
+	}
+}
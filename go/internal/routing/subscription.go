@@ -0,0 +1,34 @@
+package routing
+
+import (
+	"codegate-proxy/internal/cooldown"
+	"codegate-proxy/internal/subscription"
+	"strconv"
+	"time"
+)
+
+// WindowReserve returns the fraction of a subscription window kept for
+// interactive traffic, from the subscription_window_reserve_pct setting.
+func WindowReserve(getSetting func(string) string) float64 {
+	if v, err := strconv.Atoi(getSetting("subscription_window_reserve_pct")); err == nil && v > 0 && v <= 100 {
+		return float64(v) / 100
+	}
+	return 0
+}
+
+// UnavailableUntil returns when an account can take a request again: the
+// end of its cooldown, or the reset of a used-up subscription window. For
+// background traffic a window is used up once only traits.WindowReserve is
+// left. The zero time means it is available now.
+func UnavailableUntil(accountID string, traits RequestTraits) time.Time {
+	until := cooldown.CooldownUntil(accountID)
+	if t := subscription.ExhaustedUntil(accountID); t.After(until) {
+		until = t
+	}
+	if traits.Background {
+		if t := subscription.ReservedUntil(accountID, traits.WindowReserve); t.After(until) {
+			until = t
+		}
+	}
+	return until
+}
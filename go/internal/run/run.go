@@ -0,0 +1,160 @@
+// Package run starts and stops the proxy's background loops. Each loop is a
+// Component registered with a Manager, which starts them all under one
+// context and stops them in reverse order on shutdown.
+package run
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Component is a background task. Start launches it and returns; it runs
+// until ctx is cancelled or Stop is called. Stop returns once it has
+// finished, and does nothing if it isn't running. A stopped component can
+// be started again.
+type Component interface {
+	Start(ctx context.Context)
+	Stop()
+}
+
+// Manager starts and stops a set of components together.
+type Manager struct {
+	mu         sync.Mutex
+	names      []string
+	components []Component
+	cancel     context.CancelFunc
+}
+
+// Register adds a component, started after those registered before it and
+// stopped before them.
+func (m *Manager) Register(name string, c Component) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.names = append(m.names, name)
+	m.components = append(m.components, c)
+}
+
+// Start starts every component with a context derived from ctx. Starting a
+// running manager does nothing.
+func (m *Manager) Start(ctx context.Context) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cancel != nil {
+		return
+	}
+	ctx, m.cancel = context.WithCancel(ctx)
+	for _, c := range m.components {
+		c.Start(ctx)
+	}
+	if len(m.names) > 0 {
+		log.Printf("[run] Started %s", strings.Join(m.names, ", "))
+	}
+}
+
+// Stop cancels the components' context and stops them in reverse order,
+// waiting up to timeout in all. It returns an error naming any still
+// running then; those are left to finish on their own.
+func (m *Manager) Stop(timeout time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cancel == nil {
+		return nil
+	}
+	m.cancel()
+	m.cancel = nil
+
+	deadline := time.After(timeout)
+	var pending []string
+	for i := len(m.components) - 1; i >= 0; i-- {
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			m.components[i].Stop()
+		}()
+		select {
+		case <-stopped:
+		case <-deadline:
+			// Out of time: don't wait on this one or those before it
+			for j := i; j >= 0; j-- {
+				pending = append(pending, m.names[j])
+			}
+			return fmt.Errorf("still running after %s: %s", timeout, strings.Join(pending, ", "))
+		}
+	}
+	return nil
+}
+
+// Loop is a Component that calls its tick function once at start and then
+// every interval.
+type Loop struct {
+	interval time.Duration
+	tick     func(ctx context.Context)
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Every returns a Loop calling tick every interval. tick is passed the
+// loop's context, and should return early once it is cancelled.
+func Every(interval time.Duration, tick func(ctx context.Context)) *Loop {
+	return &Loop{interval: interval, tick: tick}
+}
+
+// Start starts the loop, unless it is already running.
+func (l *Loop) Start(ctx context.Context) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done != nil {
+		return
+	}
+	ctx, l.cancel = context.WithCancel(ctx)
+	done := make(chan struct{})
+	l.done = done
+	go func() {
+		defer close(done)
+		l.tick(ctx)
+		ticker := time.NewTicker(l.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				l.tick(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the loop, waiting for a tick in progress to return.
+func (l *Loop) Stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done == nil {
+		return
+	}
+	l.cancel()
+	<-l.done
+	l.done = nil
+}
+
+// Running reports whether the loop has been started and not stopped. A
+// loop whose context was cancelled is still running until it returns.
+func (l *Loop) Running() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done == nil {
+		return false
+	}
+	select {
+	case <-l.done:
+		return false
+	default:
+		return true
+	}
+}
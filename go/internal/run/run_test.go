@@ -0,0 +1,146 @@
+package run
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// leakedGoroutines returns the stacks of goroutines this package started
+// that are still running, after giving exiting ones a moment to finish.
+func leakedGoroutines() []string {
+	var leaked []string
+	for range 50 {
+		leaked = nil
+		buf := make([]byte, 1<<20)
+		buf = buf[:runtime.Stack(buf, true)]
+		for _, g := range strings.Split(string(buf), "\n\n") {
+			if strings.Contains(g, "created by codegate-proxy/internal/run.") {
+				leaked = append(leaked, g)
+			}
+		}
+		if len(leaked) == 0 {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return leaked
+}
+
+func assertNoLeaks(t *testing.T) {
+	t.Helper()
+	if leaked := leakedGoroutines(); len(leaked) > 0 {
+		t.Errorf("%d goroutines still running:\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+	}
+}
+
+func TestManager_StartStop(t *testing.T) {
+	var ticks [2]atomic.Int32
+	var m Manager
+	m.Register("a", Every(time.Millisecond, func(context.Context) { ticks[0].Add(1) }))
+	m.Register("b", Every(time.Hour, func(context.Context) { ticks[1].Add(1) }))
+
+	for round := 1; round <= 2; round++ {
+		m.Start(context.Background())
+		m.Start(context.Background()) // no second set of loops
+		deadline := time.Now().Add(2 * time.Second)
+		for ticks[0].Load() < int32(3*round) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if err := m.Stop(time.Second); err != nil {
+			t.Fatal(err)
+		}
+		// b ticks once at each start, then not for an hour
+		if n := ticks[1].Load(); n != int32(round) {
+			t.Errorf("round %d: b ticked %d times", round, n)
+		}
+		if ticks[0].Load() < int32(3*round) {
+			t.Errorf("round %d: a ticked %d times", round, ticks[0].Load())
+		}
+		assertNoLeaks(t)
+	}
+	if err := m.Stop(time.Second); err != nil {
+		t.Errorf("stopping a stopped manager: %v", err)
+	}
+}
+
+func TestManager_StopsInReverseOrder(t *testing.T) {
+	var order []string
+	var m Manager
+	for _, name := range []string{"first", "second", "third"} {
+		m.Register(name, &recorder{name: name, order: &order})
+	}
+	m.Start(context.Background())
+	if err := m.Stop(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(order, " "); got != "start first start second start third stop third stop second stop first" {
+		t.Errorf("order = %s", got)
+	}
+}
+
+type recorder struct {
+	name  string
+	order *[]string
+}
+
+func (r *recorder) Start(context.Context) { *r.order = append(*r.order, "start "+r.name) }
+func (r *recorder) Stop()                 { *r.order = append(*r.order, "stop "+r.name) }
+
+func TestManager_StopTimeout(t *testing.T) {
+	release := make(chan struct{})
+	var m Manager
+	m.Register("quick", Every(time.Hour, func(context.Context) {}))
+	// stuck ignores its context until released
+	started := make(chan struct{})
+	m.Register("stuck", Every(time.Hour, func(context.Context) {
+		close(started)
+		<-release
+	}))
+	m.Start(context.Background())
+	<-started
+
+	err := m.Stop(20 * time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "stuck, quick") {
+		t.Errorf("Stop = %v, want stuck and the loops stopped after it named", err)
+	}
+	close(release)
+	assertNoLeaks(t)
+}
+
+func TestLoop_StopsWhenContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var tickCtx atomic.Value
+	l := Every(time.Hour, func(ctx context.Context) { tickCtx.Store(ctx) })
+	l.Start(ctx)
+	if !l.Running() {
+		t.Fatal("loop not running")
+	}
+	cancel()
+	deadline := time.Now().Add(2 * time.Second)
+	for l.Running() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if l.Running() {
+		t.Error("loop still running after its context was cancelled")
+	}
+	if c, _ := tickCtx.Load().(context.Context); c == nil || c.Err() == nil {
+		t.Error("tick wasn't passed the loop's context")
+	}
+	l.Stop()
+	assertNoLeaks(t)
+
+	// A cancelled loop can be started again
+	l.Start(context.Background())
+	if !l.Running() {
+		t.Error("loop not restarted")
+	}
+	l.Stop()
+	if l.Running() {
+		t.Error("loop running after Stop")
+	}
+	assertNoLeaks(t)
+}
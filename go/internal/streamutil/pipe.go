@@ -0,0 +1,65 @@
+// Package streamutil holds the plumbing shared by the goroutines that rewrite
+// SSE streams (format conversion, guardrail deanonymization): a pipe reader
+// that can be closed early, and panic recovery for the writer goroutine.
+package streamutil
+
+import (
+	"codegate-proxy/internal/metrics"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+// ErrClosed is returned to a writer goroutine still writing after the
+// consumer closed the stream.
+var ErrClosed = errors.New("stream closed by reader")
+
+// Pipe is the read side of a stream rewriter. Closing it fails any pending
+// write in the writer goroutine, closes the source so a blocked read returns,
+// and signals the goroutine to stop.
+type Pipe struct {
+	*io.PipeReader
+	src  io.Reader
+	done chan struct{}
+	once sync.Once
+}
+
+// NewPipe wraps pr, the read side of the pipe a goroutine rewrites src into.
+func NewPipe(pr *io.PipeReader, src io.Reader) *Pipe {
+	return &Pipe{PipeReader: pr, src: src, done: make(chan struct{})}
+}
+
+func (p *Pipe) Close() error {
+	p.once.Do(func() {
+		close(p.done)
+		p.PipeReader.CloseWithError(ErrClosed)
+		if c, ok := p.src.(io.Closer); ok {
+			c.Close()
+		}
+	})
+	return nil
+}
+
+// Closed reports whether the consumer has closed the stream.
+func (p *Pipe) Closed() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Recover is deferred by a writer goroutine so a panic on malformed input
+// fails the stream instead of crashing the process. pkg prefixes the log
+// line and the error, name identifies the goroutine.
+func Recover(pw *io.PipeWriter, pkg, name string) {
+	if p := recover(); p != nil {
+		log.Printf("[%s] Panic in %s: %v\n%s", pkg, name, p, debug.Stack())
+		metrics.Inc("codegate_panics_total")
+		pw.CloseWithError(fmt.Errorf("%s: %s: %v", pkg, name, p))
+	}
+}
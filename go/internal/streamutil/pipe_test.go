@@ -0,0 +1,52 @@
+package streamutil
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestPipe_CloseStopsWriter(t *testing.T) {
+	src := &closeRecorder{Reader: strings.NewReader("data")}
+	pr, pw := io.Pipe()
+	p := NewPipe(pr, src)
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := pw.Write([]byte("blocked until read"))
+		written <- err
+	}()
+
+	p.Close()
+	if err := <-written; !errors.Is(err, ErrClosed) {
+		t.Errorf("pending write error = %v, want ErrClosed", err)
+	}
+	if !p.Closed() || !src.closed {
+		t.Errorf("Closed() = %v, source closed = %v", p.Closed(), src.closed)
+	}
+	p.Close() // a second Close is a no-op
+}
+
+func TestRecover_FailsStream(t *testing.T) {
+	pr, pw := io.Pipe()
+	go func() {
+		defer pw.Close()
+		defer Recover(pw, "test", "panicky")
+		panic("boom")
+	}()
+	_, err := io.ReadAll(pr)
+	if err == nil || err.Error() != "test: panicky: boom" {
+		t.Errorf("read error = %v, want the recovered panic", err)
+	}
+}
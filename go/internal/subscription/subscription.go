@@ -0,0 +1,265 @@
+// Package subscription tracks the usage windows of Claude subscription
+// accounts. Claude Max limits OAuth accounts per rolling 5-hour (and 7-day)
+// window rather than per minute, and reports where an account stands in
+// anthropic-ratelimit-unified-* headers on every response.
+package subscription
+
+import (
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const headerPrefix = "anthropic-ratelimit-unified-"
+
+// exhaustedFallback is how long an account is treated as exhausted when a
+// rejection carries no reset time.
+const exhaustedFallback = 5 * time.Hour
+
+// Window is one usage window as last reported by Anthropic.
+type Window struct {
+	Name        string    `json:"name"`             // "5h", "7d", ...
+	Status      string    `json:"status,omitempty"` // allowed, allowed_warning or rejected
+	Utilization float64   `json:"utilization"`      // fraction of the window used, 0-1
+	ResetsAt    time.Time `json:"resets_at"`
+}
+
+// State is what the last response from an account said about its windows.
+type State struct {
+	Status         string    `json:"status"` // unified status: allowed, allowed_warning or rejected
+	ExhaustedUntil time.Time `json:"exhausted_until,omitzero"`
+	Windows        []Window  `json:"windows"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// staleAfter is how long an account's state is kept without a response
+// reporting it, longer than the longest window. Accounts that are deleted
+// or no longer used are dropped after it, unless still exhausted.
+const staleAfter = 8 * 24 * time.Hour
+
+// sweepInterval is how often Observe drops stale states.
+const sweepInterval = time.Hour
+
+var (
+	mu        sync.RWMutex
+	states    = make(map[string]*State)
+	lastSweep time.Time
+)
+
+// Observe records the unified rate limit headers of a response from an
+// account, keyed by lowercase name. It reports whether there were any;
+// responses without them leave the account's state alone.
+func Observe(accountID string, headers map[string]string) bool {
+	st, ok := parse(headers, time.Now())
+	if !ok {
+		return false
+	}
+	mu.Lock()
+	prev := states[accountID]
+	states[accountID] = st
+	if st.UpdatedAt.Sub(lastSweep) >= sweepInterval {
+		sweepStale(st.UpdatedAt)
+		lastSweep = st.UpdatedAt
+	}
+	mu.Unlock()
+
+	wasExhausted := prev != nil && prev.ExhaustedUntil.After(st.UpdatedAt)
+	if !st.ExhaustedUntil.IsZero() && !wasExhausted {
+		log.Printf("[subscription] Account %s window exhausted until %s", accountID, st.ExhaustedUntil.UTC().Format(time.RFC3339))
+	}
+	return true
+}
+
+// sweepStale drops states not updated within staleAfter whose exhaustion, if
+// any, has ended. mu must be held.
+func sweepStale(now time.Time) {
+	for id, st := range states {
+		if now.Sub(st.UpdatedAt) > staleAfter && !now.Before(st.ExhaustedUntil) {
+			delete(states, id)
+		}
+	}
+}
+
+// parse reads the unified headers. Per-window headers are named
+// <prefix><window>-status, -reset and -utilization.
+func parse(headers map[string]string, now time.Time) (*State, bool) {
+	st := &State{UpdatedAt: now}
+	windows := make(map[string]*Window)
+	found := false
+	var reset time.Time
+	for k, v := range headers {
+		rest, ok := strings.CutPrefix(k, headerPrefix)
+		if !ok {
+			continue
+		}
+		found = true
+		switch rest {
+		case "status":
+			st.Status = v
+			continue
+		case "reset":
+			reset = parseReset(v)
+			continue
+		}
+		name, field, ok := cutLast(rest, "-")
+		if !ok || name == "overage" {
+			continue // overage is billing beyond the windows, not a window
+		}
+		w := windows[name]
+		if w == nil {
+			w = &Window{Name: name}
+		}
+		switch field {
+		case "status":
+			w.Status = v
+		case "reset":
+			w.ResetsAt = parseReset(v)
+		case "utilization":
+			u, err := strconv.ParseFloat(v, 64)
+			if err != nil || math.IsNaN(u) {
+				continue
+			}
+			w.Utilization = u
+		default:
+			continue
+		}
+		windows[name] = w
+	}
+	if !found {
+		return nil, false
+	}
+
+	for _, w := range windows {
+		st.Windows = append(st.Windows, *w)
+		if w.Status == "rejected" || w.Utilization >= 1 {
+			st.ExhaustedUntil = later(st.ExhaustedUntil, w.ResetsAt)
+		}
+	}
+	sort.Slice(st.Windows, func(i, j int) bool { return st.Windows[i].Name < st.Windows[j].Name })
+	if st.Status == "rejected" {
+		st.ExhaustedUntil = later(st.ExhaustedUntil, reset)
+		if !st.ExhaustedUntil.After(now) {
+			st.ExhaustedUntil = now.Add(exhaustedFallback)
+		}
+	}
+	if !st.ExhaustedUntil.After(now) {
+		st.ExhaustedUntil = time.Time{}
+	}
+	return st, true
+}
+
+// parseReset reads a reset time sent as Unix seconds or RFC 3339.
+func parseReset(v string) time.Time {
+	if n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil && n > 0 {
+		return time.Unix(n, 0)
+	}
+	if t, err := time.Parse(time.RFC3339, strings.TrimSpace(v)); err == nil {
+		return t
+	}
+	return time.Time{}
+}
+
+func cutLast(s, sep string) (before, after string, ok bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+func later(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// ExhaustedUntil returns when an account's exhausted window resets, or the
+// zero time if none is exhausted.
+func ExhaustedUntil(accountID string) time.Time {
+	mu.RLock()
+	defer mu.RUnlock()
+	st := states[accountID]
+	if st == nil || !time.Now().Before(st.ExhaustedUntil) {
+		return time.Time{}
+	}
+	return st.ExhaustedUntil
+}
+
+// IsExhausted reports whether one of an account's windows is used up.
+func IsExhausted(accountID string) bool {
+	return !ExhaustedUntil(accountID).IsZero()
+}
+
+// ReservedUntil returns when the account stops being held back for
+// interactive traffic: the latest reset of a window whose utilization has
+// reached 1-reserve. It is the zero time when reserve is 0 or no window is
+// that full.
+func ReservedUntil(accountID string, reserve float64) time.Time {
+	if reserve <= 0 {
+		return time.Time{}
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	st := states[accountID]
+	if st == nil {
+		return time.Time{}
+	}
+	now := time.Now()
+	var until time.Time
+	for _, w := range st.Windows {
+		if w.ResetsAt.After(now) && w.Utilization >= 1-reserve {
+			until = later(until, w.ResetsAt)
+		}
+	}
+	return until
+}
+
+// Get returns the last state seen for an account, with windows that have
+// since reset left out.
+func Get(accountID string) (State, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	st := states[accountID]
+	if st == nil {
+		return State{}, false
+	}
+	return current(st, time.Now()), true
+}
+
+// Snapshot returns the current state of every account seen.
+func Snapshot() map[string]State {
+	mu.RLock()
+	defer mu.RUnlock()
+	now := time.Now()
+	out := make(map[string]State, len(states))
+	for id, st := range states {
+		out[id] = current(st, now)
+	}
+	return out
+}
+
+func current(st *State, now time.Time) State {
+	out := *st
+	out.Windows = nil
+	for _, w := range st.Windows {
+		if w.ResetsAt.IsZero() || w.ResetsAt.After(now) {
+			out.Windows = append(out.Windows, w)
+		}
+	}
+	if !now.Before(out.ExhaustedUntil) {
+		out.ExhaustedUntil = time.Time{}
+	}
+	return out
+}
+
+// Forget drops what is known about an account.
+func Forget(accountID string) {
+	mu.Lock()
+	delete(states, accountID)
+	mu.Unlock()
+}
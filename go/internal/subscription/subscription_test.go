@@ -0,0 +1,130 @@
+package subscription
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func epoch(d time.Duration) string {
+	return strconv.FormatInt(time.Now().Add(d).Unix(), 10)
+}
+
+func TestObserve_Allowed(t *testing.T) {
+	t.Cleanup(func() { Forget("acct-allowed") })
+	ok := Observe("acct-allowed", map[string]string{
+		"anthropic-ratelimit-unified-status":              "allowed_warning",
+		"anthropic-ratelimit-unified-reset":               epoch(2 * time.Hour),
+		"anthropic-ratelimit-unified-5h-status":           "allowed_warning",
+		"anthropic-ratelimit-unified-5h-utilization":      "0.82",
+		"anthropic-ratelimit-unified-5h-reset":            epoch(2 * time.Hour),
+		"anthropic-ratelimit-unified-7d-status":           "allowed",
+		"anthropic-ratelimit-unified-7d-utilization":      "0.3",
+		"anthropic-ratelimit-unified-7d-reset":            epoch(72 * time.Hour),
+		"anthropic-ratelimit-unified-overage-status":      "rejected",
+		"anthropic-ratelimit-unified-fallback-percentage": "0.5",
+		"content-type": "application/json",
+	})
+	if !ok {
+		t.Fatal("Observe found no unified headers")
+	}
+	if IsExhausted("acct-allowed") {
+		t.Error("allowed account reported exhausted")
+	}
+	st, _ := Get("acct-allowed")
+	if st.Status != "allowed_warning" || len(st.Windows) != 2 || st.Windows[0].Name != "5h" || st.Windows[0].Utilization != 0.82 || st.Windows[1].Name != "7d" {
+		t.Errorf("state = %+v", st)
+	}
+
+	if got := ReservedUntil("acct-allowed", 0.1); !got.IsZero() {
+		t.Errorf("10%% reserve: reserved until %v, want not reserved at 82%%", got)
+	}
+	if got := time.Until(ReservedUntil("acct-allowed", 0.2)); got < time.Hour || got > 2*time.Hour {
+		t.Errorf("20%% reserve: reserved for %v, want until the 5h reset", got)
+	}
+}
+
+func TestObserve_RejectedUntilReset(t *testing.T) {
+	t.Cleanup(func() { Forget("acct-rejected") })
+	reset := epoch(3 * time.Hour)
+	Observe("acct-rejected", map[string]string{
+		"anthropic-ratelimit-unified-status":         "rejected",
+		"anthropic-ratelimit-unified-reset":          reset,
+		"anthropic-ratelimit-unified-5h-status":      "rejected",
+		"anthropic-ratelimit-unified-5h-utilization": "1.0",
+		"anthropic-ratelimit-unified-5h-reset":       reset,
+	})
+	if got := ExhaustedUntil("acct-rejected"); strconv.FormatInt(got.Unix(), 10) != reset {
+		t.Errorf("exhausted until %v, want the reset", got)
+	}
+
+	// The next window's first success lifts it
+	Observe("acct-rejected", map[string]string{
+		"anthropic-ratelimit-unified-status":         "allowed",
+		"anthropic-ratelimit-unified-5h-utilization": "0.01",
+		"anthropic-ratelimit-unified-5h-reset":       epoch(5 * time.Hour),
+	})
+	if IsExhausted("acct-rejected") {
+		t.Error("still exhausted after an allowed response")
+	}
+}
+
+func TestObserve_RejectedWithoutReset(t *testing.T) {
+	t.Cleanup(func() { Forget("acct-no-reset") })
+	Observe("acct-no-reset", map[string]string{"anthropic-ratelimit-unified-status": "rejected"})
+	if until := time.Until(ExhaustedUntil("acct-no-reset")); until < 4*time.Hour || until > exhaustedFallback {
+		t.Errorf("exhausted for %v, want about %v", until, exhaustedFallback)
+	}
+}
+
+func TestObserve_NoHeaders(t *testing.T) {
+	t.Cleanup(func() { Forget("acct-api-key") })
+	if Observe("acct-api-key", map[string]string{"content-type": "application/json", "anthropic-ratelimit-requests-remaining": "49"}) {
+		t.Error("Observe reported unified headers on an API-key response")
+	}
+	if _, ok := Get("acct-api-key"); ok {
+		t.Error("state recorded without unified headers")
+	}
+}
+
+func TestGet_DropsResetWindows(t *testing.T) {
+	t.Cleanup(func() { Forget("acct-stale") })
+	Observe("acct-stale", map[string]string{
+		"anthropic-ratelimit-unified-status":         "allowed",
+		"anthropic-ratelimit-unified-5h-utilization": "0.9",
+		"anthropic-ratelimit-unified-5h-reset":       epoch(-time.Minute),
+		"anthropic-ratelimit-unified-7d-utilization": "0.4",
+		"anthropic-ratelimit-unified-7d-reset":       epoch(time.Hour),
+	})
+	if st, _ := Get("acct-stale"); len(st.Windows) != 1 || st.Windows[0].Name != "7d" {
+		t.Errorf("windows = %+v, want only 7d", st.Windows)
+	}
+	if !ReservedUntil("acct-stale", 0.5).IsZero() {
+		t.Error("a window that has reset still holds the account back")
+	}
+}
+
+func TestObserve_SweepsStaleStates(t *testing.T) {
+	t.Cleanup(func() {
+		for _, id := range []string{"acct-gone", "acct-exhausted", "acct-active"} {
+			Forget(id)
+		}
+	})
+	mu.Lock()
+	old := time.Now().Add(-staleAfter - time.Hour)
+	states["acct-gone"] = &State{Status: "allowed", UpdatedAt: old}
+	states["acct-exhausted"] = &State{Status: "rejected", UpdatedAt: old, ExhaustedUntil: time.Now().Add(time.Hour)}
+	lastSweep = time.Time{}
+	mu.Unlock()
+
+	Observe("acct-active", map[string]string{"anthropic-ratelimit-unified-status": "allowed"})
+	if _, ok := Get("acct-gone"); ok {
+		t.Error("a state not updated in over staleAfter was kept")
+	}
+	if !IsExhausted("acct-exhausted") {
+		t.Error("a stale state dropped while still exhausted")
+	}
+	if _, ok := Get("acct-active"); !ok {
+		t.Error("the observed state is missing")
+	}
+}
@@ -2,6 +2,7 @@ package tenant
 
 import (
 	"codegate-proxy/internal/db"
+	"codegate-proxy/internal/events"
 	"crypto/sha256"
 	"encoding/hex"
 	"sync"
@@ -10,11 +11,14 @@ import (
 
 // Tenant represents a resolved tenant from the database.
 type Tenant struct {
-	ID        string
-	Name      string
-	ConfigID  string            // "" = use global active config
-	RateLimit int               // 0 = no tenant-level limit
-	Settings  map[string]string // cached tenant_settings
+	ID                  string
+	Name                string
+	ConfigID            string            // "" = use global active config
+	RateLimit           int               // 0 = no tenant-level limit
+	RateLimitBackground int               // background traffic cap; 0 = only the shared limit applies
+	Settings            map[string]string // cached tenant_settings
+	KeyID               string            // tenant_keys.id; "" for the legacy tenants.api_key_hash key
+	KeyLabel            string            // label of the matched tenant_keys entry
 }
 
 type cachedTenant struct {
@@ -32,10 +36,17 @@ var (
 	tenantCache    = make(map[string]*cachedTenant)
 	hasTenantsMu   sync.RWMutex
 	hasTenantsCached *cachedBool
+
+	touchMu     sync.Mutex
+	lastTouched = make(map[string]time.Time)
+	lastPruned  time.Time
 )
 
 const cacheTTL = 30 * time.Second
 
+// touchInterval limits how often last_used_at is written per key.
+const touchInterval = time.Minute
+
 // Resolve looks up a tenant by raw API key.
 // Returns nil if no matching tenant found or if tenants table doesn't exist.
 func Resolve(rawAPIKey string) *Tenant {
@@ -48,6 +59,7 @@ func Resolve(rawAPIKey string) *Tenant {
 			return nil
 		}
 		t := *cached.tenant
+		touchKey(t.KeyID)
 		settings := make(map[string]string, len(cached.tenant.Settings))
 		for k, v := range cached.tenant.Settings {
 			settings[k] = v
@@ -57,7 +69,15 @@ func Resolve(rawAPIKey string) *Tenant {
 	}
 	cacheMu.RUnlock()
 
+	// Legacy single key on the tenants row, then additional tenant_keys
+	var keyID, keyLabel string
 	row := db.GetTenantByKeyHash(hash)
+	if row == nil {
+		if k := db.GetTenantKeyByHash(hash); k != nil {
+			row = &k.Tenant
+			keyID, keyLabel = k.KeyID, k.Label
+		}
+	}
 	if row == nil {
 		cacheMu.Lock()
 		tenantCache[hash] = &cachedTenant{tenant: nil, expiresAt: time.Now().Add(cacheTTL)}
@@ -68,17 +88,22 @@ func Resolve(rawAPIKey string) *Tenant {
 	settings := db.GetTenantSettings(row.ID)
 
 	t := &Tenant{
-		ID:        row.ID,
-		Name:      row.Name,
-		ConfigID:  row.ConfigID,
-		RateLimit: row.RateLimit,
-		Settings:  settings,
+		ID:                  row.ID,
+		Name:                row.Name,
+		ConfigID:            row.ConfigID,
+		RateLimit:           row.RateLimit,
+		RateLimitBackground: row.RateLimitBackground,
+		Settings:            settings,
+		KeyID:               keyID,
+		KeyLabel:            keyLabel,
 	}
 
 	cacheMu.Lock()
 	tenantCache[hash] = &cachedTenant{tenant: t, expiresAt: time.Now().Add(cacheTTL)}
 	cacheMu.Unlock()
 
+	touchKey(keyID)
+
 	result := *t
 	settingsCopy := make(map[string]string, len(settings))
 	for k, v := range settings {
@@ -88,6 +113,56 @@ func Resolve(rawAPIKey string) *Tenant {
 	return &result
 }
 
+// InvalidateKey drops the cached resolution for a raw API key so a revoked or
+// re-enabled key takes effect without waiting for the cache TTL.
+func InvalidateKey(rawAPIKey string) {
+	hash := hashKey(rawAPIKey)
+	cacheMu.Lock()
+	delete(tenantCache, hash)
+	cacheMu.Unlock()
+	events.Publish(events.CacheInvalidated, "tenant_key:"+hash)
+}
+
+// InvalidateAll drops every cached tenant resolution and the HasTenants flag.
+func InvalidateAll() {
+	cacheMu.Lock()
+	tenantCache = make(map[string]*cachedTenant)
+	cacheMu.Unlock()
+
+	hasTenantsMu.Lock()
+	hasTenantsCached = nil
+	hasTenantsMu.Unlock()
+	events.Publish(events.CacheInvalidated, "tenants")
+}
+
+// touchKey updates tenant_keys.last_used_at asynchronously, at most once per
+// touchInterval per key. Once per touchInterval it also drops the keys whose
+// last write is older than that, since those would be written anyway, so
+// deleted or idle keys don't stay in lastTouched.
+func touchKey(keyID string) {
+	if keyID == "" {
+		return
+	}
+	now := time.Now()
+	touchMu.Lock()
+	if now.Sub(lastPruned) >= touchInterval {
+		for id, at := range lastTouched {
+			if now.Sub(at) >= touchInterval {
+				delete(lastTouched, id)
+			}
+		}
+		lastPruned = now
+	}
+	if now.Sub(lastTouched[keyID]) < touchInterval {
+		touchMu.Unlock()
+		return
+	}
+	lastTouched[keyID] = now
+	touchMu.Unlock()
+
+	db.Go(func() { db.TouchTenantKey(keyID) })
+}
+
 // GetSetting returns a tenant-specific setting, falling back to the global setting.
 func GetSetting(t *Tenant, key string) string {
 	if t != nil && t.Settings != nil {
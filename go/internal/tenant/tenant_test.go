@@ -1,7 +1,10 @@
 package tenant
 
 import (
+	"codegate-proxy/internal/dbtest"
+	"database/sql"
 	"testing"
+	"time"
 )
 
 func TestHashKey(t *testing.T) {
@@ -81,3 +84,114 @@ func TestResolve_NoDB(t *testing.T) {
 		t.Error("expected nil when DB is not open")
 	}
 }
+
+func setupTenantKeys(t *testing.T) *dbtest.DB {
+	t.Helper()
+	tdb := dbtest.Open(t)
+	InvalidateAll()
+	tdb.Exec("INSERT INTO tenants (id, name, api_key_hash, api_key_prefix) VALUES ('t-keys', 'Acme', ?, 'cgk_prim')", hashKey("cgk_primary_key"))
+	tdb.Exec("INSERT INTO tenant_keys (id, tenant_id, key_hash, key_prefix, label) VALUES ('k-ci', 't-keys', ?, 'cgk_ci_k', 'ci')", hashKey("cgk_ci_key"))
+	tdb.Exec("INSERT INTO tenant_keys (id, tenant_id, key_hash, key_prefix, label, expires_at) VALUES ('k-old', 't-keys', ?, 'cgk_old_', 'old', '2000-01-01 00:00:00')", hashKey("cgk_expired_key"))
+	return tdb
+}
+
+func TestResolve_SecondaryKey(t *testing.T) {
+	tdb := setupTenantKeys(t)
+
+	got := Resolve("cgk_ci_key")
+	if got == nil {
+		t.Fatal("secondary key should resolve")
+	}
+	if got.ID != "t-keys" || got.KeyID != "k-ci" || got.KeyLabel != "ci" {
+		t.Errorf("resolved %+v, want tenant t-keys via key k-ci (ci)", got)
+	}
+
+	primary := Resolve("cgk_primary_key")
+	if primary == nil || primary.ID != "t-keys" || primary.KeyLabel != "" {
+		t.Errorf("legacy key should resolve without a label, got %+v", primary)
+	}
+
+	// last_used_at is written asynchronously
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var lastUsed sql.NullString
+		tdb.QueryRow("SELECT last_used_at FROM tenant_keys WHERE id = 'k-ci'").Scan(&lastUsed)
+		if lastUsed.Valid {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("last_used_at was not updated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResolve_ExpiredKey(t *testing.T) {
+	setupTenantKeys(t)
+	if got := Resolve("cgk_expired_key"); got != nil {
+		t.Errorf("expired key should not resolve, got %+v", got)
+	}
+}
+
+func TestResolve_RevocationAfterInvalidate(t *testing.T) {
+	tdb := setupTenantKeys(t)
+	lastTouched["k-ci"] = time.Now() // skip the async last_used_at write
+
+	if Resolve("cgk_ci_key") == nil {
+		t.Fatal("key should resolve before revocation")
+	}
+	tdb.Exec("UPDATE tenant_keys SET enabled = 0 WHERE id = 'k-ci'")
+
+	if Resolve("cgk_ci_key") == nil {
+		t.Fatal("cached resolution should survive until invalidated")
+	}
+	InvalidateKey("cgk_ci_key")
+	if got := Resolve("cgk_ci_key"); got != nil {
+		t.Errorf("revoked key should not resolve after invalidation, got %+v", got)
+	}
+	if Resolve("cgk_primary_key") == nil {
+		t.Error("other keys of the tenant should keep working")
+	}
+}
+
+func TestResolve_RevocationAfterCacheExpiry(t *testing.T) {
+	tdb := setupTenantKeys(t)
+	lastTouched["k-ci"] = time.Now()
+
+	if Resolve("cgk_ci_key") == nil {
+		t.Fatal("key should resolve before revocation")
+	}
+	tdb.Exec("UPDATE tenant_keys SET enabled = 0 WHERE id = 'k-ci'")
+
+	cacheMu.Lock()
+	tenantCache[hashKey("cgk_ci_key")].expiresAt = time.Now().Add(-time.Second)
+	cacheMu.Unlock()
+
+	if got := Resolve("cgk_ci_key"); got != nil {
+		t.Errorf("revoked key should not resolve after cache expiry, got %+v", got)
+	}
+}
+
+func TestTouchKey_PrunesIdleKeys(t *testing.T) {
+	setupTenantKeys(t)
+	touchMu.Lock()
+	lastTouched["k-idle"] = time.Now().Add(-2 * touchInterval)
+	lastTouched["k-recent"] = time.Now()
+	lastPruned = time.Time{}
+	touchMu.Unlock()
+	t.Cleanup(func() {
+		touchMu.Lock()
+		delete(lastTouched, "k-recent")
+		touchMu.Unlock()
+	})
+
+	touchKey("k-recent")
+	touchMu.Lock()
+	defer touchMu.Unlock()
+	if _, ok := lastTouched["k-idle"]; ok {
+		t.Error("a key idle for over touchInterval was kept")
+	}
+	if _, ok := lastTouched["k-recent"]; !ok {
+		t.Error("a recently touched key was pruned")
+	}
+}
@@ -2,7 +2,7 @@ import React, { useState, useEffect } from "react";
 import { Eye, EyeOff, RefreshCw, Check, AlertCircle } from "lucide-react";
 import Modal from "./ui/Modal";
 import Button from "./ui/Button";
-import { Input, Select } from "./ui/Input";
+import { Input, Select, Textarea } from "./ui/Input";
 import { type Account } from "../lib/api";
 
 interface AccountFormProps {
@@ -22,7 +22,8 @@ const PROVIDERS = [
   { value: "gemini", label: "Google Gemini" },
   { value: "glm", label: "GLM / Zhipu AI" },
   { value: "minimax", label: "MiniMax" },
-  { value: "custom", label: "Custom (OpenAI-compatible)" },
+  { value: "custom", label: "Custom" },
+  { value: "simulator", label: "Simulator (drills, no network)" },
 ];
 
 const SUBSCRIPTION_TYPES = [
@@ -32,6 +33,11 @@ const SUBSCRIPTION_TYPES = [
   { value: "max_20x", label: "Max 20x" },
 ];
 
+const FAILOVER_MODES = [
+  { value: "", label: "Follow settings" },
+  { value: "off", label: "Never fail over from this account" },
+];
+
 /** Default base URLs for providers that have known endpoints. */
 const DEFAULT_BASE_URLS: Record<string, string> = {
   glm: "https://api.z.ai/api/coding/paas/v4",
@@ -41,6 +47,21 @@ const DEFAULT_BASE_URLS: Record<string, string> = {
   minimax: "https://api.minimax.chat",
 };
 
+const API_FLAVORS = [
+  { value: "", label: "OpenAI-compatible" },
+  { value: "anthropic", label: "Anthropic-compatible" },
+];
+
+/** Base URLs for providers' Anthropic-compatible endpoints. */
+const ANTHROPIC_FLAVOR_BASE_URLS: Record<string, string> = {
+  glm: "https://api.z.ai/api/anthropic",
+};
+
+/** Providers that can be switched to an Anthropic-compatible endpoint. */
+function supportsApiFlavor(provider: string): boolean {
+  return provider === "glm" || provider === "custom" || provider === "simulator";
+}
+
 /** Providers that should show the base URL field. */
 function shouldShowBaseUrl(provider: string, currentBaseUrl: string): boolean {
   return (
@@ -57,7 +78,7 @@ function shouldShowBaseUrl(provider: string, currentBaseUrl: string): boolean {
 
 /** Providers that support API key auth. */
 function supportsApiKey(provider: string): boolean {
-  return provider !== "openai_sub";
+  return provider !== "openai_sub" && provider !== "simulator";
 }
 
 /** Providers that support OAuth. */
@@ -79,9 +100,21 @@ export default function AccountForm({
   const [apiKey, setApiKey] = useState("");
   const [showKey, setShowKey] = useState(false);
   const [baseUrl, setBaseUrl] = useState("");
+  const [apiFlavor, setApiFlavor] = useState("");
+  const [allowedBetas, setAllowedBetas] = useState("");
+  const [anthropicVersion, setAnthropicVersion] = useState("");
+  const [openRouterPrefs, setOpenRouterPrefs] = useState("");
   const [priority, setPriority] = useState(0);
   const [rateLimit, setRateLimit] = useState(60);
   const [monthlyBudget, setMonthlyBudget] = useState("");
+  const [dailyBudget, setDailyBudget] = useState("");
+  const [failover, setFailover] = useState("");
+  const [maxFallbacks, setMaxFallbacks] = useState("");
+  const [systemPromptPrefix, setSystemPromptPrefix] = useState("");
+  const [connectTimeout, setConnectTimeout] = useState("");
+  const [headerTimeout, setHeaderTimeout] = useState("");
+  const [responseTimeout, setResponseTimeout] = useState("");
+  const [simulatorSettings, setSimulatorSettings] = useState("");
   const [subscriptionType, setSubscriptionType] = useState("");
   const [email, setEmail] = useState("");
   const [saving, setSaving] = useState(false);
@@ -103,11 +136,27 @@ export default function AccountForm({
         setApiKey("");
         setShowKey(false);
         setBaseUrl(account.base_url || "");
+        setApiFlavor(account.api_flavor || "");
+        setAllowedBetas(account.allowed_betas || "");
+        setAnthropicVersion(account.anthropic_version || "");
+        setOpenRouterPrefs(account.openrouter_prefs || "");
         setPriority(account.priority);
         setRateLimit(account.rate_limit);
         setMonthlyBudget(
           account.monthly_budget != null ? String(account.monthly_budget) : ""
         );
+        setDailyBudget(
+          account.daily_budget != null ? String(account.daily_budget) : ""
+        );
+        setFailover(account.failover_enabled === 0 ? "off" : "");
+        setMaxFallbacks(
+          account.max_failover_candidates != null ? String(account.max_failover_candidates) : ""
+        );
+        setSystemPromptPrefix(account.system_prompt_prefix || "");
+        setConnectTimeout(account.connect_timeout_ms != null ? String(account.connect_timeout_ms) : "");
+        setHeaderTimeout(account.header_timeout_ms != null ? String(account.header_timeout_ms) : "");
+        setResponseTimeout(account.response_timeout_ms != null ? String(account.response_timeout_ms) : "");
+        setSimulatorSettings(account.simulator_settings || "");
         setSubscriptionType(account.subscription_type || "");
         setEmail(account.account_email || "");
       } else {
@@ -117,9 +166,21 @@ export default function AccountForm({
         setApiKey("");
         setShowKey(false);
         setBaseUrl("");
+        setApiFlavor("");
+        setAllowedBetas("");
+        setAnthropicVersion("");
+        setOpenRouterPrefs("");
         setPriority(0);
         setRateLimit(60);
         setMonthlyBudget("");
+        setDailyBudget("");
+        setFailover("");
+        setMaxFallbacks("");
+        setSystemPromptPrefix("");
+        setConnectTimeout("");
+        setHeaderTimeout("");
+        setResponseTimeout("");
+        setSimulatorSettings("");
         setSubscriptionType("");
         setEmail("");
       }
@@ -150,6 +211,23 @@ export default function AccountForm({
     if (!supportsOAuth(newProvider)) {
       setAuthType("api_key");
     }
+
+    if (!supportsApiFlavor(newProvider)) {
+      setApiFlavor("");
+    }
+  }
+
+  function handleApiFlavorChange(newFlavor: string) {
+    setApiFlavor(newFlavor);
+
+    // Swap between the provider's OpenAI- and Anthropic-compatible defaults
+    const openaiDefault = DEFAULT_BASE_URLS[provider];
+    const anthropicDefault = ANTHROPIC_FLAVOR_BASE_URLS[provider];
+    if (newFlavor === "anthropic" && anthropicDefault && (!baseUrl || baseUrl === openaiDefault)) {
+      setBaseUrl(anthropicDefault);
+    } else if (newFlavor === "" && openaiDefault && (!baseUrl || baseUrl === anthropicDefault)) {
+      setBaseUrl(openaiDefault);
+    }
   }
 
   async function handleRefreshFromHost() {
@@ -173,8 +251,28 @@ export default function AccountForm({
       if (baseUrl) data.base_url = baseUrl;
       else data.base_url = undefined;
       if (monthlyBudget) data.monthly_budget = parseFloat(monthlyBudget);
+      data.daily_budget = dailyBudget ? parseFloat(dailyBudget) : null;
+      data.failover_enabled = failover === "off" ? 0 : null;
+      data.max_failover_candidates = maxFallbacks ? parseInt(maxFallbacks) : null;
+      data.system_prompt_prefix = systemPromptPrefix.trim() || null;
+      data.connect_timeout_ms = connectTimeout ? parseInt(connectTimeout) : null;
+      data.header_timeout_ms = headerTimeout ? parseInt(headerTimeout) : null;
+      data.response_timeout_ms = responseTimeout ? parseInt(responseTimeout) : null;
       if (subscriptionType) data.subscription_type = subscriptionType;
       if (email) data.account_email = email;
+      if (supportsApiFlavor(provider)) {
+        data.api_flavor = apiFlavor === "anthropic" ? "anthropic" : null;
+      }
+      if (speaksAnthropic) {
+        data.allowed_betas = allowedBetas.trim() || null;
+        data.anthropic_version = anthropicVersion.trim() || null;
+      }
+      if (provider === "openrouter") {
+        data.openrouter_prefs = openRouterPrefs.trim() || null;
+      }
+      if (provider === "simulator") {
+        data.simulator_settings = simulatorSettings.trim() || null;
+      }
       await onSave(data);
       onClose();
     } catch (err: any) {
@@ -188,6 +286,7 @@ export default function AccountForm({
   const showOAuthOption = supportsOAuth(provider);
   const showSubscriptionType = provider === "anthropic";
   const isOAuthEdit = isEdit && account?.auth_type === "oauth";
+  const speaksAnthropic = provider === "anthropic" || apiFlavor === "anthropic";
 
   return (
     <Modal
@@ -346,12 +445,22 @@ export default function AccountForm({
           </div>
         )}
 
+        {supportsApiFlavor(provider) && (
+          <Select
+            label="API Format"
+            value={apiFlavor}
+            onChange={(e) => handleApiFlavorChange(e.target.value)}
+            options={API_FLAVORS}
+          />
+        )}
+
         {shouldShowBaseUrl(provider, baseUrl) && (
           <Input
             label={`Base URL${DEFAULT_BASE_URLS[provider] ? "" : " (required for custom)"}`}
             value={baseUrl}
             onChange={(e) => setBaseUrl(e.target.value)}
             placeholder={
+              (apiFlavor === "anthropic" && ANTHROPIC_FLAVOR_BASE_URLS[provider]) ||
               DEFAULT_BASE_URLS[provider] ||
               (provider === "openrouter"
                 ? "https://openrouter.ai/api/v1"
@@ -361,6 +470,44 @@ export default function AccountForm({
           />
         )}
 
+        {speaksAnthropic && (
+          <Input
+            label="Allowed Betas"
+            value={allowedBetas}
+            onChange={(e) => setAllowedBetas(e.target.value)}
+            placeholder="All betas (comma-separated to restrict)"
+          />
+        )}
+
+        {speaksAnthropic && (
+          <Input
+            label="Anthropic Version"
+            value={anthropicVersion}
+            onChange={(e) => setAnthropicVersion(e.target.value)}
+            placeholder="Client's version (set to pin one, e.g. 2023-06-01)"
+          />
+        )}
+
+        {provider === "openrouter" && (
+          <Textarea
+            label="OpenRouter Preferences (JSON)"
+            value={openRouterPrefs}
+            onChange={(e) => setOpenRouterPrefs(e.target.value)}
+            placeholder='{"provider": {"order": ["anthropic"], "allow_fallbacks": false}}'
+            rows={3}
+          />
+        )}
+
+        {provider === "simulator" && (
+          <Textarea
+            label="Simulator Settings (JSON)"
+            value={simulatorSettings}
+            onChange={(e) => setSimulatorSettings(e.target.value)}
+            placeholder='{"latency_ms": 500, "error_rate": 0.5, "error_statuses": [500, 529], "chunks": 10}'
+            rows={3}
+          />
+        )}
+
         <div className="grid grid-cols-2 gap-4">
           <Input
             label="Priority"
@@ -378,14 +525,78 @@ export default function AccountForm({
           />
         </div>
 
-        <Input
-          label="Monthly Budget (USD)"
-          type="number"
-          value={monthlyBudget}
-          onChange={(e) => setMonthlyBudget(e.target.value)}
-          placeholder="100.00"
-          min="0"
-          step="0.01"
+        <div className="grid grid-cols-2 gap-4">
+          <Input
+            label="Monthly Budget (USD)"
+            type="number"
+            value={monthlyBudget}
+            onChange={(e) => setMonthlyBudget(e.target.value)}
+            placeholder="100.00"
+            min="0"
+            step="0.01"
+          />
+          <Input
+            label="Daily Budget (USD)"
+            type="number"
+            value={dailyBudget}
+            onChange={(e) => setDailyBudget(e.target.value)}
+            placeholder="No daily cap"
+            min="0"
+            step="0.01"
+          />
+        </div>
+
+        <div className="grid grid-cols-2 gap-4">
+          <Select
+            label="Failover"
+            value={failover}
+            onChange={(e) => setFailover(e.target.value)}
+            options={FAILOVER_MODES}
+          />
+          <Input
+            label="Max Fallbacks"
+            type="number"
+            value={maxFallbacks}
+            onChange={(e) => setMaxFallbacks(e.target.value)}
+            placeholder="Settings decide"
+            min="0"
+            disabled={failover === "off"}
+          />
+        </div>
+
+        <div className="grid grid-cols-3 gap-4">
+          <Input
+            label="Connect Timeout (ms)"
+            type="number"
+            value={connectTimeout}
+            onChange={(e) => setConnectTimeout(e.target.value)}
+            placeholder="Settings decide"
+            min="1"
+          />
+          <Input
+            label="Header Timeout (ms)"
+            type="number"
+            value={headerTimeout}
+            onChange={(e) => setHeaderTimeout(e.target.value)}
+            placeholder="Settings decide"
+            min="1"
+          />
+          <Input
+            label="Response Timeout (ms)"
+            type="number"
+            value={responseTimeout}
+            onChange={(e) => setResponseTimeout(e.target.value)}
+            placeholder="Settings decide"
+            min="1"
+          />
+        </div>
+
+        <Textarea
+          label="System Prompt Prefix"
+          value={systemPromptPrefix}
+          onChange={(e) => setSystemPromptPrefix(e.target.value)}
+          placeholder="Added ahead of the system prompt of requests sent to this account"
+          rows={3}
         />
 
         {showSubscriptionType && (
@@ -3,7 +3,7 @@ import { Plus, Trash2, RefreshCw, Search } from "lucide-react";
 import Button from "./ui/Button";
 import { Select } from "./ui/Input";
 import Badge from "./ui/Badge";
-import type { Account, ConfigTier, Config, ModelInfo, ModelLimitsInfo } from "../lib/api";
+import type { Account, ConfigTier, Config, ModelInfo, ModelLimitsInfo, TierCondition } from "../lib/api";
 import { getModelCatalog, refreshModelCatalog, getModelLimits } from "../lib/api";
 
 interface TierRow {
@@ -11,6 +11,8 @@ interface TierRow {
   account_id: string;
   target_model: string;
   priority: number;
+  condition: TierCondition | "";
+  fallback_models: string; // comma-separated
 }
 
 interface ConfigEditorProps {
@@ -36,6 +38,16 @@ const TIER_NAMES: ("opus" | "sonnet" | "haiku")[] = [
   "haiku",
 ];
 
+const CONDITIONS: { value: TierCondition | ""; label: string }[] = [
+  { value: "", label: "All requests" },
+  { value: "thinking", label: "With thinking" },
+  { value: "no_thinking", label: "Without thinking" },
+  { value: "tools", label: "With tools" },
+  { value: "no_tools", label: "Without tools" },
+  { value: "vision", label: "With images" },
+  { value: "no_vision", label: "Without images" },
+];
+
 const ROUTING_STRATEGIES = [
   { value: "priority", label: "Priority" },
   { value: "round-robin", label: "Round Robin" },
@@ -45,6 +57,13 @@ const ROUTING_STRATEGIES = [
 
 let nextKey = 0;
 
+// fallbackModelsJSON converts the comma-separated input to the stored JSON
+// array, or null when empty.
+function fallbackModelsJSON(input: string): string | null {
+  const models = input.split(",").map((m) => m.trim()).filter(Boolean);
+  return models.length > 0 ? JSON.stringify(models) : null;
+}
+
 export default function ConfigEditor({
   config,
   accounts,
@@ -97,6 +116,8 @@ export default function ConfigEditor({
           account_id: t.account_id,
           target_model: t.target_model || "",
           priority: t.priority,
+          condition: t.condition || "",
+          fallback_models: t.fallback_models ? (JSON.parse(t.fallback_models) as string[]).join(", ") : "",
         });
       }
     }
@@ -108,6 +129,8 @@ export default function ConfigEditor({
           account_id: accounts[0].id,
           target_model: "",
           priority: 0,
+          condition: "",
+          fallback_models: "",
         });
       }
     }
@@ -124,6 +147,8 @@ export default function ConfigEditor({
           account_id: accounts[0]?.id || "",
           target_model: "",
           priority: prev[tier].length,
+          condition: "",
+          fallback_models: "",
         },
       ],
     }));
@@ -163,6 +188,8 @@ export default function ConfigEditor({
             account_id: row.account_id,
             target_model: row.target_model || undefined,
             priority: row.priority,
+            condition: row.condition || null,
+            fallback_models: fallbackModelsJSON(row.fallback_models),
           });
         }
       }
@@ -419,6 +446,40 @@ export default function ConfigEditor({
                       )}
                     </div>
 
+                    <div className="w-40">
+                      <label className="block text-xs text-gray-400 mb-1">
+                        Applies to
+                      </label>
+                      <select
+                        value={row.condition}
+                        onChange={(e) =>
+                          updateRow(tierName, idx, "condition", e.target.value)
+                        }
+                        className="block w-full rounded-lg border border-gray-700 bg-gray-800 px-3 py-2 text-sm text-gray-100 focus:border-brand-500 focus:ring-1 focus:ring-brand-500 focus:outline-none"
+                      >
+                        {CONDITIONS.map((c) => (
+                          <option key={c.value} value={c.value}>
+                            {c.label}
+                          </option>
+                        ))}
+                      </select>
+                    </div>
+
+                    <div className="w-48">
+                      <label className="block text-xs text-gray-400 mb-1">
+                        Fallback models
+                      </label>
+                      <input
+                        type="text"
+                        value={row.fallback_models}
+                        onChange={(e) =>
+                          updateRow(tierName, idx, "fallback_models", e.target.value)
+                        }
+                        placeholder="Tried on this account if overloaded"
+                        className="block w-full rounded-lg border border-gray-700 bg-gray-800 px-3 py-2 text-sm text-gray-100 placeholder-gray-500 focus:border-brand-500 focus:ring-1 focus:ring-brand-500 focus:outline-none"
+                      />
+                    </div>
+
                     <div className="w-20">
                       <label className="block text-xs text-gray-400 mb-1">
                         Priority
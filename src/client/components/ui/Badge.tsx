@@ -73,6 +73,7 @@ export function getStatusVariant(
     case "rate_limited":
       return "warning";
     case "error":
+    case "misconfigured":
       return "danger";
     default:
       return "default";
@@ -90,6 +91,8 @@ export function getStatusLabel(status?: string): string {
       return "Rate Limited";
     case "error":
       return "Error";
+    case "misconfigured":
+      return "Misconfigured";
     case "unknown":
     default:
       return "Unknown";
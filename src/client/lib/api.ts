@@ -13,22 +13,35 @@ export interface Account {
     | "deepseek"
     | "gemini"
     | "minimax"
-    | "custom";
+    | "custom"
+    | "simulator";
   auth_type: "api_key" | "oauth";
   api_key_enc?: string; // masked in responses
   base_url?: string;
   priority: number;
   rate_limit: number;
   monthly_budget?: number;
+  daily_budget?: number | null; // USD per UTC day; null = no daily cap
   enabled: boolean;
   subscription_type?: string;
   account_email?: string;
+  api_flavor?: "openai" | "anthropic" | null; // wire format; null = provider default
+  allowed_betas?: string | null; // comma-separated anthropic-beta values; null = any
+  anthropic_version?: string | null; // sent instead of the client's; null = client's
+  openrouter_prefs?: string | null; // JSON merged into OpenRouter requests; null = none
+  failover_enabled?: number | null; // 0 = never fail over from this account; null = settings decide
+  max_failover_candidates?: number | null; // fallbacks tried after this account; null = settings decide
+  system_prompt_prefix?: string | null; // injected ahead of the system prompt; null = none
+  connect_timeout_ms?: number | null; // upstream timeouts; null = settings decide
+  header_timeout_ms?: number | null;
+  response_timeout_ms?: number | null;
+  simulator_settings?: string | null; // JSON behaviour of a simulator account; null = defaults
   token_expires_at?: number | null;
   last_used_at?: string | null;
   last_error?: string | null;
   last_error_at?: string | null;
   error_count?: number;
-  status?: string; // unknown | active | expired | error | rate_limited
+  status?: string; // unknown | active | expired | error | rate_limited | misconfigured
   decrypt_error?: boolean;
   created_at: string;
   updated_at: string;
@@ -51,9 +64,13 @@ export interface ConfigTier {
   account_id: string;
   priority: number;
   target_model?: string;
+  condition?: TierCondition | null; // null = all requests
+  fallback_models?: string | null; // JSON array of models tried on the same account when target_model is overloaded
   account_name?: string; // joined from accounts
 }
 
+export type TierCondition = "thinking" | "no_thinking" | "tools" | "no_tools" | "vision" | "no_vision";
+
 export interface Session {
   id: string;
   container_id: string | null;
@@ -411,6 +428,7 @@ export interface RequestLog {
   provider: string | null;
   original_model: string | null;
   routed_model: string | null;
+  routed_model_actual?: string | null;
   status_code: number;
   input_tokens: number | null;
   output_tokens: number | null;
@@ -418,6 +436,15 @@ export interface RequestLog {
   is_stream: boolean;
   is_failover: boolean;
   error_message: string | null;
+  upstream_request_id?: string | null;
+  request_id?: string | null;
+  client_request_id?: string | null;
+  failover_attempts?: string | null;
+  anthropic_version?: string | null;
+  guardrails_bypassed?: boolean;
+  end_user?: string | null;
+  tags?: string | null;
+  retries?: number;
   request_body?: string | null;
   response_body?: string | null;
 }
@@ -500,6 +527,8 @@ export interface ModelLimitsInfo {
   maxOutputTokens: number;
   supportsToolCalling: boolean;
   supportsReasoning: boolean;
+  maxStopSequences: number;
+  maxStopSequenceLength: number;
 }
 
 export async function getModelLimits(): Promise<
@@ -536,6 +565,7 @@ export interface Tenant {
   api_key_raw?: string | null;
   config_id: string | null;
   rate_limit: number;
+  rate_limit_background: number;
   enabled: number;
   created_at: string;
   updated_at: string;
@@ -559,6 +589,7 @@ export async function createTenant(data: {
   name: string;
   config_id?: string;
   rate_limit?: number;
+  rate_limit_background?: number;
 }): Promise<TenantCreateResponse> {
   return request<TenantCreateResponse>("/tenants", {
     method: "POST",
@@ -572,7 +603,7 @@ export async function getTenantDetail(id: string): Promise<TenantWithSettings> {
 
 export async function updateTenant(
   id: string,
-  data: Partial<{ name: string; config_id: string | null; rate_limit: number; enabled: number }>
+  data: Partial<{ name: string; config_id: string | null; rate_limit: number; rate_limit_background: number; enabled: number }>
 ): Promise<Tenant> {
   return request<Tenant>(`/tenants/${id}`, {
     method: "PUT",
@@ -533,6 +533,15 @@ export default function Logs() {
                   {selectedLog.routed_model || "-"}
                 </span>
               </div>
+              {selectedLog.routed_model_actual &&
+                selectedLog.routed_model_actual !== selectedLog.routed_model && (
+                  <div>
+                    <span className="text-gray-500">Upstream Model:</span>{" "}
+                    <span className="text-yellow-400 font-mono text-xs">
+                      {selectedLog.routed_model_actual}
+                    </span>
+                  </div>
+                )}
               <div>
                 <span className="text-gray-500">Provider:</span>{" "}
                 <span className="text-gray-200">
@@ -582,6 +591,97 @@ export default function Logs() {
               </div>
             )}
 
+            {selectedLog.request_id && (
+              <div>
+                <h4 className="text-xs font-medium text-gray-400 uppercase tracking-wider mb-1">
+                  Request ID
+                </h4>
+                <span className="text-xs text-gray-200 font-mono">
+                  {selectedLog.request_id}
+                </span>
+              </div>
+            )}
+
+            {selectedLog.client_request_id && (
+              <div>
+                <h4 className="text-xs font-medium text-gray-400 uppercase tracking-wider mb-1">
+                  Client Request ID
+                </h4>
+                <span className="text-xs text-gray-200 font-mono">
+                  {selectedLog.client_request_id}
+                </span>
+              </div>
+            )}
+
+            {selectedLog.upstream_request_id && (
+              <div>
+                <h4 className="text-xs font-medium text-gray-400 uppercase tracking-wider mb-1">
+                  Upstream Request ID
+                </h4>
+                <span className="text-xs text-gray-200 font-mono">
+                  {selectedLog.upstream_request_id}
+                </span>
+              </div>
+            )}
+
+            {selectedLog.anthropic_version && (
+              <div>
+                <h4 className="text-xs font-medium text-gray-400 uppercase tracking-wider mb-1">
+                  Anthropic Version
+                </h4>
+                <span className="text-xs text-gray-200 font-mono">
+                  {selectedLog.anthropic_version}
+                </span>
+              </div>
+            )}
+
+            {selectedLog.end_user && (
+              <div>
+                <h4 className="text-xs font-medium text-gray-400 uppercase tracking-wider mb-1">
+                  End User
+                </h4>
+                <span className="text-xs text-gray-200 font-mono break-all">
+                  {selectedLog.end_user}
+                </span>
+              </div>
+            )}
+
+            {selectedLog.tags && (
+              <div>
+                <h4 className="text-xs font-medium text-gray-400 uppercase tracking-wider mb-1">
+                  Tags
+                </h4>
+                <span className="text-xs text-gray-200 font-mono">
+                  {Object.entries(JSON.parse(selectedLog.tags) as Record<string, string>)
+                    .map(([k, v]) => `${k}=${v}`)
+                    .join(", ")}
+                </span>
+              </div>
+            )}
+
+            {selectedLog.guardrails_bypassed ? (
+              <div>
+                <h4 className="text-xs font-medium text-gray-400 uppercase tracking-wider mb-1">
+                  Guardrails
+                </h4>
+                <span className="text-xs text-yellow-400">
+                  Bypassed by the caller (X-CodeGate-Guardrails: off)
+                </span>
+              </div>
+            ) : null}
+
+            {selectedLog.failover_attempts && (
+              <div>
+                <h4 className="text-xs font-medium text-gray-400 uppercase tracking-wider mb-1">
+                  Failed Attempts
+                  {selectedLog.retries ? ` (${selectedLog.retries} retried on the same account)` : ""}
+                </h4>
+                <pre className="text-xs text-gray-300 bg-gray-800 rounded-lg p-3 overflow-x-auto whitespace-pre-wrap">
+                  {selectedLog.failover_attempts}
+                </pre>
+              </div>
+            )}
+
             {selectedLog.request_body && (
               <div>
                 <h4 className="text-xs font-medium text-gray-400 uppercase tracking-wider mb-1">
@@ -42,6 +42,8 @@ export default function Settings() {
   const [newMaxTokens, setNewMaxTokens] = useState("");
   const [newToolCalling, setNewToolCalling] = useState<string>("unset");
   const [newReasoning, setNewReasoning] = useState<string>("unset");
+  const [newMaxStops, setNewMaxStops] = useState("");
+  const [newMaxStopLength, setNewMaxStopLength] = useState("");
 
   // Encryption keys
   const [encryptionInfo, setEncryptionInfo] = useState<EncryptionInfo | null>(null);
@@ -243,12 +245,17 @@ export default function Settings() {
         limits.supportsToolCalling = newToolCalling === "true";
       if (newReasoning !== "unset")
         limits.supportsReasoning = newReasoning === "true";
+      if (newMaxStops) limits.maxStopSequences = parseInt(newMaxStops, 10);
+      if (newMaxStopLength)
+        limits.maxStopSequenceLength = parseInt(newMaxStopLength, 10);
       const updated = await setModelLimit(newModelId.trim(), limits);
       setModelLimits(updated);
       setNewModelId("");
       setNewMaxTokens("");
       setNewToolCalling("unset");
       setNewReasoning("unset");
+      setNewMaxStops("");
+      setNewMaxStopLength("");
     } catch (err: any) {
       setSaveMsg({ ok: false, text: err.message || "Failed to add limit" });
     }
@@ -680,6 +687,9 @@ export default function Settings() {
                     <th className="px-3 py-2 text-right font-medium">
                       Max Output
                     </th>
+                    <th className="px-3 py-2 text-right font-medium">
+                      Stop Seqs
+                    </th>
                     <th className="px-3 py-2 text-center font-medium">
                       Capabilities
                     </th>
@@ -697,6 +707,11 @@ export default function Settings() {
                           ? lim.maxOutputTokens.toLocaleString()
                           : "-"}
                       </td>
+                      <td className="px-3 py-2 text-right text-xs text-gray-300">
+                        {lim.maxStopSequences != null ? lim.maxStopSequences : "-"}
+                        {lim.maxStopSequenceLength != null &&
+                          ` (≤${lim.maxStopSequenceLength} chars)`}
+                      </td>
                       <td className="px-3 py-2 text-center">
                         <div className="flex items-center justify-center gap-1">
                           {lim.supportsToolCalling === true && (
@@ -756,6 +771,24 @@ export default function Settings() {
                   onChange={(e) => setNewMaxTokens(e.target.value)}
                 />
               </div>
+              <div className="w-28">
+                <Input
+                  label="Stop Seqs"
+                  type="number"
+                  placeholder="4"
+                  value={newMaxStops}
+                  onChange={(e) => setNewMaxStops(e.target.value)}
+                />
+              </div>
+              <div className="w-28">
+                <Input
+                  label="Stop Length"
+                  type="number"
+                  placeholder="none"
+                  value={newMaxStopLength}
+                  onChange={(e) => setNewMaxStopLength(e.target.value)}
+                />
+              </div>
               <div className="w-28">
                 <Select
                   label="Tools"
@@ -4,6 +4,7 @@ import {
   getConfigTiers,
   getEnabledAccounts,
   getMonthlySpend,
+  getDailySpend,
   type AccountDecrypted,
   type Config,
   type ConfigTier,
@@ -113,6 +114,9 @@ function resolveRouteWithConfig(model: string, configId: string | undefined): Re
       const monthlySpend = getMonthlySpend(account.id);
       if (monthlySpend >= account.monthly_budget) continue;
     }
+    if (account.daily_budget != null && account.daily_budget > 0) {
+      if (getDailySpend(account.id) >= account.daily_budget) continue;
+    }
 
     candidates.push({
       account,
@@ -49,10 +49,22 @@ export interface Account {
   priority: number;
   rate_limit: number;
   monthly_budget: number | null;
+  daily_budget: number | null; // USD per UTC day; null = no daily cap
   enabled: number;
   subscription_type: string | null;
   account_email: string | null;
   external_account_id: string | null;
+  api_flavor: string | null;
+  allowed_betas: string | null; // comma-separated anthropic-beta values; null = any
+  anthropic_version: string | null; // sent instead of the client's anthropic-version; null = client's
+  openrouter_prefs: string | null; // JSON merged into OpenRouter requests (provider, models, transforms, route)
+  failover_enabled: number | null; // 0 keeps requests on this account; null = follow the failover_enabled setting
+  max_failover_candidates: number | null; // fallbacks tried after this account; null = the setting's cap
+  system_prompt_prefix: string | null; // text injected ahead of the system prompt of requests sent here
+  connect_timeout_ms: number | null; // upstream timeouts; null = the provider_*_timeout_ms settings
+  header_timeout_ms: number | null;
+  response_timeout_ms: number | null;
+  simulator_settings: string | null; // JSON behaviour of a simulator account (latency, errors, canned reply)
   last_used_at: string | null;
   last_error: string | null;
   last_error_at: string | null;
@@ -69,7 +81,7 @@ export interface AccountDecrypted extends Omit<Account, "api_key_enc" | "refresh
   decrypt_error?: boolean;
 }
 
-export type AccountStatus = "unknown" | "active" | "expired" | "error" | "rate_limited";
+export type AccountStatus = "unknown" | "active" | "expired" | "error" | "rate_limited" | "misconfigured";
 
 export interface Config {
   id: string;
@@ -87,6 +99,8 @@ export interface ConfigTier {
   account_id: string;
   priority: number;
   target_model: string | null;
+  condition: string | null; // request trait the row applies to; null = all requests
+  fallback_models: string | null; // JSON array of models tried on the same account when target_model is overloaded
 }
 
 export interface PrivacyMapping {
@@ -109,7 +123,11 @@ export interface UsageRecord {
   output_tokens: number;
   cache_read_tokens: number;
   cache_write_tokens: number;
+  reasoning_tokens: number;
+  server_tool_requests: number;
   cost_usd: number;
+  end_user: string | null;
+  tags: string | null;
   created_at: string;
 }
 
@@ -123,6 +141,7 @@ export interface UsageInput {
   output_tokens?: number;
   cache_read_tokens?: number;
   cache_write_tokens?: number;
+  server_tool_requests?: number;
   cost_usd?: number;
   tenant_id?: string;
 }
@@ -152,11 +171,23 @@ export interface Tenant {
   api_key_prefix: string;
   config_id: string | null;
   rate_limit: number;
+  rate_limit_background: number;
   enabled: number;
   created_at: string;
   updated_at: string;
 }
 
+export interface TenantKey {
+  id: string;
+  tenant_id: string;
+  key_prefix: string;
+  label: string | null;
+  enabled: number;
+  last_used_at: string | null;
+  expires_at: string | null;
+  created_at: string;
+}
+
 export interface TenantWithSettings extends Omit<Tenant, "api_key_hash"> {
   settings: Record<string, string>;
 }
@@ -260,6 +291,7 @@ export function initDB(): Database.Database {
     CREATE INDEX IF NOT EXISTS idx_usage_account_id ON usage(account_id);
     CREATE INDEX IF NOT EXISTS idx_usage_created_at ON usage(created_at);
     CREATE INDEX IF NOT EXISTS idx_usage_config_id ON usage(config_id);
+    CREATE INDEX IF NOT EXISTS idx_usage_account_created ON usage(account_id, created_at);
     CREATE INDEX IF NOT EXISTS idx_config_tiers_config_id ON config_tiers(config_id);
     CREATE INDEX IF NOT EXISTS idx_config_tiers_tier ON config_tiers(tier);
     CREATE TABLE IF NOT EXISTS request_logs (
@@ -305,6 +337,21 @@ export function initDB(): Database.Database {
 
     CREATE INDEX IF NOT EXISTS idx_tenants_hash ON tenants(api_key_hash);
 
+    CREATE TABLE IF NOT EXISTS tenant_keys (
+        id TEXT PRIMARY KEY,
+        tenant_id TEXT NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+        key_hash TEXT NOT NULL UNIQUE,
+        key_prefix TEXT NOT NULL,
+        label TEXT,
+        enabled INTEGER DEFAULT 1,
+        last_used_at TEXT,
+        expires_at TEXT,
+        created_at TEXT DEFAULT (datetime('now'))
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_tenant_keys_hash ON tenant_keys(key_hash);
+    CREATE INDEX IF NOT EXISTS idx_tenant_keys_tenant ON tenant_keys(tenant_id);
+
     CREATE INDEX IF NOT EXISTS idx_privacy_hash ON privacy_mappings(original_hash);
     CREATE INDEX IF NOT EXISTS idx_privacy_replacement ON privacy_mappings(replacement);
     CREATE INDEX IF NOT EXISTS idx_request_logs_timestamp ON request_logs(timestamp);
@@ -320,6 +367,23 @@ export function initDB(): Database.Database {
   if (!colNames.has("error_count")) db.exec("ALTER TABLE accounts ADD COLUMN error_count INTEGER DEFAULT 0");
   if (!colNames.has("status")) db.exec("ALTER TABLE accounts ADD COLUMN status TEXT DEFAULT 'unknown'");
   if (!colNames.has("external_account_id")) db.exec("ALTER TABLE accounts ADD COLUMN external_account_id TEXT");
+  if (!colNames.has("api_flavor")) db.exec("ALTER TABLE accounts ADD COLUMN api_flavor TEXT");
+  if (!colNames.has("allowed_betas")) db.exec("ALTER TABLE accounts ADD COLUMN allowed_betas TEXT");
+  if (!colNames.has("daily_budget")) db.exec("ALTER TABLE accounts ADD COLUMN daily_budget REAL");
+  if (!colNames.has("anthropic_version")) db.exec("ALTER TABLE accounts ADD COLUMN anthropic_version TEXT");
+  if (!colNames.has("openrouter_prefs")) db.exec("ALTER TABLE accounts ADD COLUMN openrouter_prefs TEXT");
+  if (!colNames.has("failover_enabled")) db.exec("ALTER TABLE accounts ADD COLUMN failover_enabled INTEGER");
+  if (!colNames.has("max_failover_candidates")) db.exec("ALTER TABLE accounts ADD COLUMN max_failover_candidates INTEGER");
+  if (!colNames.has("system_prompt_prefix")) db.exec("ALTER TABLE accounts ADD COLUMN system_prompt_prefix TEXT");
+  if (!colNames.has("connect_timeout_ms")) db.exec("ALTER TABLE accounts ADD COLUMN connect_timeout_ms INTEGER");
+  if (!colNames.has("header_timeout_ms")) db.exec("ALTER TABLE accounts ADD COLUMN header_timeout_ms INTEGER");
+  if (!colNames.has("response_timeout_ms")) db.exec("ALTER TABLE accounts ADD COLUMN response_timeout_ms INTEGER");
+  if (!colNames.has("simulator_settings")) db.exec("ALTER TABLE accounts ADD COLUMN simulator_settings TEXT");
+
+  // Config tier migrations
+  const tierCols = db.prepare("PRAGMA table_info(config_tiers)").all() as Array<{ name: string }>;
+  if (!tierCols.some((c) => c.name === "condition")) db.exec("ALTER TABLE config_tiers ADD COLUMN condition TEXT");
+  if (!tierCols.some((c) => c.name === "fallback_models")) db.exec("ALTER TABLE config_tiers ADD COLUMN fallback_models TEXT");
 
   // Session table migrations
   const sessionCols = db.prepare("PRAGMA table_info(sessions)").all() as Array<{ name: string }>;
@@ -330,15 +394,32 @@ export function initDB(): Database.Database {
   const tenantCols = db.prepare("PRAGMA table_info(tenants)").all() as Array<{ name: string }>;
   const tenantColNames = new Set(tenantCols.map((c) => c.name));
   if (!tenantColNames.has("api_key_raw")) db.exec("ALTER TABLE tenants ADD COLUMN api_key_raw TEXT");
+  if (!tenantColNames.has("rate_limit_background")) db.exec("ALTER TABLE tenants ADD COLUMN rate_limit_background INTEGER DEFAULT 0");
 
   // Tenant column migrations for usage and request_logs
   const usageCols = db.prepare("PRAGMA table_info(usage)").all() as Array<{ name: string }>;
   const usageColNames = new Set(usageCols.map((c) => c.name));
   if (!usageColNames.has("tenant_id")) db.exec("ALTER TABLE usage ADD COLUMN tenant_id TEXT");
+  if (!usageColNames.has("server_tool_requests")) db.exec("ALTER TABLE usage ADD COLUMN server_tool_requests INTEGER DEFAULT 0");
+  if (!usageColNames.has("reasoning_tokens")) db.exec("ALTER TABLE usage ADD COLUMN reasoning_tokens INTEGER DEFAULT 0");
+  if (!usageColNames.has("end_user")) db.exec("ALTER TABLE usage ADD COLUMN end_user TEXT");
+  if (!usageColNames.has("tags")) db.exec("ALTER TABLE usage ADD COLUMN tags TEXT");
+  if (!usageColNames.has("request_id")) db.exec("ALTER TABLE usage ADD COLUMN request_id TEXT");
 
   const logCols = db.prepare("PRAGMA table_info(request_logs)").all() as Array<{ name: string }>;
   const logColNames = new Set(logCols.map((c) => c.name));
   if (!logColNames.has("tenant_id")) db.exec("ALTER TABLE request_logs ADD COLUMN tenant_id TEXT");
+  if (!logColNames.has("routed_model_actual")) db.exec("ALTER TABLE request_logs ADD COLUMN routed_model_actual TEXT");
+  if (!logColNames.has("tenant_key_label")) db.exec("ALTER TABLE request_logs ADD COLUMN tenant_key_label TEXT");
+  if (!logColNames.has("upstream_request_id")) db.exec("ALTER TABLE request_logs ADD COLUMN upstream_request_id TEXT");
+  if (!logColNames.has("failover_attempts")) db.exec("ALTER TABLE request_logs ADD COLUMN failover_attempts TEXT");
+  if (!logColNames.has("anthropic_version")) db.exec("ALTER TABLE request_logs ADD COLUMN anthropic_version TEXT");
+  if (!logColNames.has("guardrails_bypassed")) db.exec("ALTER TABLE request_logs ADD COLUMN guardrails_bypassed INTEGER DEFAULT 0");
+  if (!logColNames.has("end_user")) db.exec("ALTER TABLE request_logs ADD COLUMN end_user TEXT");
+  if (!logColNames.has("tags")) db.exec("ALTER TABLE request_logs ADD COLUMN tags TEXT");
+  if (!logColNames.has("retries")) db.exec("ALTER TABLE request_logs ADD COLUMN retries INTEGER DEFAULT 0");
+  if (!logColNames.has("request_id")) db.exec("ALTER TABLE request_logs ADD COLUMN request_id TEXT");
+  if (!logColNames.has("client_request_id")) db.exec("ALTER TABLE request_logs ADD COLUMN client_request_id TEXT");
 
   return db;
 }
@@ -400,10 +481,22 @@ export function createAccount(data: {
   priority?: number;
   rate_limit?: number;
   monthly_budget?: number;
+  daily_budget?: number | null;
   enabled?: number;
   subscription_type?: string;
   account_email?: string;
   external_account_id?: string;
+  api_flavor?: string;
+  allowed_betas?: string | null;
+  anthropic_version?: string | null;
+  openrouter_prefs?: string | null;
+  failover_enabled?: number | null;
+  max_failover_candidates?: number | null;
+  system_prompt_prefix?: string | null;
+  connect_timeout_ms?: number | null;
+  header_timeout_ms?: number | null;
+  response_timeout_ms?: number | null;
+  simulator_settings?: string | null;
 }): AccountDecrypted {
   const d = getDB();
   const id = uuidv4();
@@ -411,15 +504,20 @@ export function createAccount(data: {
   const refreshTokenEnc = data.refresh_token ? encrypt(data.refresh_token) : null;
 
   d.prepare(
-    `INSERT INTO accounts (id, name, provider, auth_type, api_key_enc, refresh_token_enc, token_expires_at, base_url, priority, rate_limit, monthly_budget, enabled, subscription_type, account_email, external_account_id)
-     VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+    `INSERT INTO accounts (id, name, provider, auth_type, api_key_enc, refresh_token_enc, token_expires_at, base_url, priority, rate_limit, monthly_budget, daily_budget, enabled, subscription_type, account_email, external_account_id, api_flavor, allowed_betas, anthropic_version, openrouter_prefs, failover_enabled, max_failover_candidates, system_prompt_prefix, connect_timeout_ms, header_timeout_ms, response_timeout_ms, simulator_settings)
+     VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
   ).run(
     id, data.name, data.provider, data.auth_type || "api_key",
     apiKeyEnc, refreshTokenEnc, data.token_expires_at ?? null,
     data.base_url ?? null, data.priority ?? 0, data.rate_limit ?? 60,
-    data.monthly_budget ?? null, data.enabled ?? 1,
+    data.monthly_budget ?? null, data.daily_budget ?? null, data.enabled ?? 1,
     data.subscription_type ?? null, data.account_email ?? null,
-    data.external_account_id ?? null
+    data.external_account_id ?? null, data.api_flavor ?? null, data.allowed_betas ?? null,
+    data.anthropic_version ?? null, data.openrouter_prefs ?? null,
+    data.failover_enabled ?? null, data.max_failover_candidates ?? null,
+    data.system_prompt_prefix ?? null, data.connect_timeout_ms ?? null,
+    data.header_timeout_ms ?? null, data.response_timeout_ms ?? null,
+    data.simulator_settings ?? null
   );
 
   return getAccount(id)!;
@@ -431,9 +529,20 @@ export function updateAccount(
     name: string; provider: string; auth_type: string;
     api_key: string; refresh_token: string; token_expires_at: number | null;
     base_url: string | null; priority: number; rate_limit: number;
-    monthly_budget: number | null; enabled: number;
+    monthly_budget: number | null; daily_budget: number | null; enabled: number;
     subscription_type: string | null; account_email: string | null;
     external_account_id: string | null;
+    api_flavor: string | null;
+    allowed_betas: string | null;
+    anthropic_version: string | null;
+    openrouter_prefs: string | null;
+    failover_enabled: number | null;
+    max_failover_candidates: number | null;
+    system_prompt_prefix: string | null;
+    connect_timeout_ms: number | null;
+    header_timeout_ms: number | null;
+    response_timeout_ms: number | null;
+    simulator_settings: string | null;
   }>
 ): AccountDecrypted | undefined {
   const d = getDB();
@@ -453,13 +562,32 @@ export function updateAccount(
   if (updates.priority !== undefined) { sets.push("priority = ?"); values.push(updates.priority); }
   if (updates.rate_limit !== undefined) { sets.push("rate_limit = ?"); values.push(updates.rate_limit); }
   if (updates.monthly_budget !== undefined) { sets.push("monthly_budget = ?"); values.push(updates.monthly_budget); }
+  if (updates.daily_budget !== undefined) { sets.push("daily_budget = ?"); values.push(updates.daily_budget); }
   if (updates.enabled !== undefined) { sets.push("enabled = ?"); values.push(updates.enabled); }
   if (updates.subscription_type !== undefined) { sets.push("subscription_type = ?"); values.push(updates.subscription_type); }
   if (updates.account_email !== undefined) { sets.push("account_email = ?"); values.push(updates.account_email); }
   if (updates.external_account_id !== undefined) { sets.push("external_account_id = ?"); values.push(updates.external_account_id); }
+  if (updates.api_flavor !== undefined) { sets.push("api_flavor = ?"); values.push(updates.api_flavor); }
+  if (updates.allowed_betas !== undefined) { sets.push("allowed_betas = ?"); values.push(updates.allowed_betas); }
+  if (updates.anthropic_version !== undefined) { sets.push("anthropic_version = ?"); values.push(updates.anthropic_version); }
+  if (updates.openrouter_prefs !== undefined) { sets.push("openrouter_prefs = ?"); values.push(updates.openrouter_prefs); }
+  if (updates.failover_enabled !== undefined) { sets.push("failover_enabled = ?"); values.push(updates.failover_enabled); }
+  if (updates.max_failover_candidates !== undefined) { sets.push("max_failover_candidates = ?"); values.push(updates.max_failover_candidates); }
+  if (updates.system_prompt_prefix !== undefined) { sets.push("system_prompt_prefix = ?"); values.push(updates.system_prompt_prefix); }
+  if (updates.connect_timeout_ms !== undefined) { sets.push("connect_timeout_ms = ?"); values.push(updates.connect_timeout_ms); }
+  if (updates.header_timeout_ms !== undefined) { sets.push("header_timeout_ms = ?"); values.push(updates.header_timeout_ms); }
+  if (updates.response_timeout_ms !== undefined) { sets.push("response_timeout_ms = ?"); values.push(updates.response_timeout_ms); }
+  if (updates.simulator_settings !== undefined) { sets.push("simulator_settings = ?"); values.push(updates.simulator_settings); }
 
   if (sets.length === 0) return getAccount(id);
 
+  // The proxy keeps an expired account expired until a token refresh;
+  // re-enabling it or replacing its credentials is the manual way out.
+  const reEnabled = updates.enabled === 1 && !existing.enabled;
+  if (existing.status === "expired" && (reEnabled || updates.api_key !== undefined || updates.refresh_token !== undefined)) {
+    sets.push("status = 'unknown'");
+  }
+
   sets.push("updated_at = datetime('now')");
   values.push(id);
   d.prepare(`UPDATE accounts SET ${sets.join(", ")} WHERE id = ?`).run(...values);
@@ -488,7 +616,7 @@ export function updateAccountTokens(id: string, accessToken: string, refreshToke
 
 // ─── Account Status Tracking ────────────────────────────────────────────────
 
-export function updateAccountStatus(id: string, status: string, error?: string): void {
+export function updateAccountStatus(id: string, status: AccountStatus, error?: string): void {
   const d = getDB();
   if (error) {
     d.prepare(`UPDATE accounts SET status = ?, last_error = ?, last_error_at = datetime('now'), updated_at = datetime('now') WHERE id = ?`)
@@ -500,7 +628,7 @@ export function updateAccountStatus(id: string, status: string, error?: string):
 
 export function recordAccountSuccess(id: string): void {
   getDB().prepare(
-    `UPDATE accounts SET status = 'active', last_used_at = datetime('now'), error_count = 0, updated_at = datetime('now') WHERE id = ?`
+    `UPDATE accounts SET status = CASE WHEN status = 'expired' THEN status ELSE 'active' END, last_used_at = datetime('now'), error_count = 0, updated_at = datetime('now') WHERE id = ?`
   ).run(id);
 }
 
@@ -624,14 +752,14 @@ export function getConfigTiers(configId: string): ConfigTier[] {
     .all(configId) as ConfigTier[];
 }
 
-export function setConfigTiers(configId: string, tiers: Array<{ tier: string; account_id: string; priority?: number; target_model?: string | null }>): ConfigTier[] {
+export function setConfigTiers(configId: string, tiers: Array<{ tier: string; account_id: string; priority?: number; target_model?: string | null; condition?: string | null; fallback_models?: string | null }>): ConfigTier[] {
   const d = getDB();
   const deleteStmt = d.prepare("DELETE FROM config_tiers WHERE config_id = ?");
-  const insertStmt = d.prepare(`INSERT INTO config_tiers (id, config_id, tier, account_id, priority, target_model) VALUES (?, ?, ?, ?, ?, ?)`);
+  const insertStmt = d.prepare(`INSERT INTO config_tiers (id, config_id, tier, account_id, priority, target_model, condition, fallback_models) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`);
   d.transaction(() => {
     deleteStmt.run(configId);
     for (const tier of tiers) {
-      insertStmt.run(uuidv4(), configId, tier.tier, tier.account_id, tier.priority ?? 0, tier.target_model ?? null);
+      insertStmt.run(uuidv4(), configId, tier.tier, tier.account_id, tier.priority ?? 0, tier.target_model ?? null, tier.condition || null, tier.fallback_models || null);
     }
   })();
   return getConfigTiers(configId);
@@ -647,12 +775,12 @@ export function recordUsage(data: UsageInput): UsageRecord {
   const costUsd = data.cost_usd ?? estimateCost(data.routed_model || data.original_model || "default", inputTokens, outputTokens);
 
   d.prepare(
-    `INSERT INTO usage (id, account_id, config_id, tier, original_model, routed_model, input_tokens, output_tokens, cache_read_tokens, cache_write_tokens, cost_usd, tenant_id)
-     VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+    `INSERT INTO usage (id, account_id, config_id, tier, original_model, routed_model, input_tokens, output_tokens, cache_read_tokens, cache_write_tokens, server_tool_requests, cost_usd, tenant_id)
+     VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
   ).run(id, data.account_id ?? null, data.config_id ?? null, data.tier ?? null,
     data.original_model ?? null, data.routed_model ?? null,
-    inputTokens, outputTokens, data.cache_read_tokens ?? 0, data.cache_write_tokens ?? 0, costUsd,
-    data.tenant_id ?? null);
+    inputTokens, outputTokens, data.cache_read_tokens ?? 0, data.cache_write_tokens ?? 0,
+    data.server_tool_requests ?? 0, costUsd, data.tenant_id ?? null);
 
   return d.prepare("SELECT * FROM usage WHERE id = ?").get(id) as UsageRecord;
 }
@@ -704,6 +832,15 @@ export function getMonthlySpend(accountId: string): number {
   return row.total;
 }
 
+export function getDailySpend(accountId: string): number {
+  // usage.created_at is stamped with SQLite's datetime('now'), which is UTC
+  const today = new Date().toISOString().slice(0, 10);
+  const row = getDB().prepare(
+    `SELECT COALESCE(SUM(cost_usd), 0) AS total FROM usage WHERE account_id = ? AND created_at >= ?`
+  ).get(accountId, today) as { total: number };
+  return row.total;
+}
+
 // ─── Settings ───────────────────────────────────────────────────────────────
 
 export function getSetting(key: string): string | undefined {
@@ -836,6 +973,7 @@ export interface RequestLogRow {
   provider: string | null;
   original_model: string | null;
   routed_model: string | null;
+  routed_model_actual: string | null;
   status_code: number | null;
   input_tokens: number | null;
   output_tokens: number | null;
@@ -846,6 +984,16 @@ export interface RequestLogRow {
   request_body: string | null;
   response_body: string | null;
   tenant_id: string | null;
+  tenant_key_label: string | null;
+  upstream_request_id: string | null;
+  failover_attempts: string | null;
+  anthropic_version: string | null;
+  guardrails_bypassed: number;
+  end_user: string | null;
+  tags: string | null;
+  retries: number; // transient failures retried on the same account
+  request_id: string | null; // the proxy's ID, also in X-Proxy-Request-Id
+  client_request_id: string | null; // the client's X-Request-Id, not unique
 }
 
 export function insertRequestLog(data: RequestLogInput): void {
@@ -909,7 +1057,7 @@ export function getRequestLogs(opts: {
 
   const totalRow = d.prepare(`SELECT COUNT(*) AS cnt FROM request_logs ${where}`).get(...params) as { cnt: number };
   const logs = d.prepare(
-    `SELECT id, timestamp, method, path, inbound_format, account_id, account_name, provider, original_model, routed_model, status_code, input_tokens, output_tokens, latency_ms, is_stream, is_failover, error_message, tenant_id
+    `SELECT id, timestamp, method, path, inbound_format, account_id, account_name, provider, original_model, routed_model, routed_model_actual, status_code, input_tokens, output_tokens, latency_ms, is_stream, is_failover, error_message, tenant_id, tenant_key_label, upstream_request_id, failover_attempts, anthropic_version, guardrails_bypassed, end_user, tags, retries, request_id, client_request_id
      FROM request_logs ${where} ORDER BY timestamp DESC LIMIT ? OFFSET ?`
   ).all(...params, limit, offset) as RequestLogRow[];
 
@@ -954,6 +1102,7 @@ export function createTenant(data: {
   name: string;
   config_id?: string;
   rate_limit?: number;
+  rate_limit_background?: number;
 }): { tenant: Tenant; raw_api_key: string } {
   const d = getDB();
   const id = uuidv4();
@@ -962,9 +1111,9 @@ export function createTenant(data: {
   const prefix = rawKey.substring(0, 8);
 
   d.prepare(
-    `INSERT INTO tenants (id, name, api_key_hash, api_key_prefix, api_key_raw, config_id, rate_limit)
-     VALUES (?, ?, ?, ?, ?, ?, ?)`
-  ).run(id, data.name, keyHash, prefix, rawKey, data.config_id ?? null, data.rate_limit ?? 0);
+    `INSERT INTO tenants (id, name, api_key_hash, api_key_prefix, api_key_raw, config_id, rate_limit, rate_limit_background)
+     VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+  ).run(id, data.name, keyHash, prefix, rawKey, data.config_id ?? null, data.rate_limit ?? 0, data.rate_limit_background ?? 0);
 
   const tenant = d.prepare("SELECT * FROM tenants WHERE id = ?").get(id) as Tenant;
   return { tenant, raw_api_key: rawKey };
@@ -972,14 +1121,14 @@ export function createTenant(data: {
 
 export function getTenants(): Omit<Tenant, "api_key_hash">[] {
   return getDB().prepare(
-    "SELECT id, name, api_key_prefix, api_key_raw, config_id, rate_limit, enabled, created_at, updated_at FROM tenants ORDER BY name ASC"
+    "SELECT id, name, api_key_prefix, api_key_raw, config_id, rate_limit, rate_limit_background, enabled, created_at, updated_at FROM tenants ORDER BY name ASC"
   ).all() as Omit<Tenant, "api_key_hash">[];
 }
 
 export function getTenant(id: string): TenantWithSettings | undefined {
   const d = getDB();
   const tenant = d.prepare(
-    "SELECT id, name, api_key_prefix, api_key_raw, config_id, rate_limit, enabled, created_at, updated_at FROM tenants WHERE id = ?"
+    "SELECT id, name, api_key_prefix, api_key_raw, config_id, rate_limit, rate_limit_background, enabled, created_at, updated_at FROM tenants WHERE id = ?"
   ).get(id) as Omit<Tenant, "api_key_hash"> | undefined;
   if (!tenant) return undefined;
   const settings = getTenantSettings(id);
@@ -988,7 +1137,7 @@ export function getTenant(id: string): TenantWithSettings | undefined {
 
 export function updateTenant(
   id: string,
-  updates: Partial<{ name: string; config_id: string | null; rate_limit: number; enabled: number }>
+  updates: Partial<{ name: string; config_id: string | null; rate_limit: number; rate_limit_background: number; enabled: number }>
 ): Tenant | undefined {
   const d = getDB();
   const existing = d.prepare("SELECT * FROM tenants WHERE id = ?").get(id) as Tenant | undefined;
@@ -999,6 +1148,7 @@ export function updateTenant(
   if (updates.name !== undefined) { sets.push("name = ?"); values.push(updates.name); }
   if (updates.config_id !== undefined) { sets.push("config_id = ?"); values.push(updates.config_id); }
   if (updates.rate_limit !== undefined) { sets.push("rate_limit = ?"); values.push(updates.rate_limit); }
+  if (updates.rate_limit_background !== undefined) { sets.push("rate_limit_background = ?"); values.push(updates.rate_limit_background); }
   if (updates.enabled !== undefined) { sets.push("enabled = ?"); values.push(updates.enabled); }
   if (sets.length === 0) return existing;
 
@@ -1029,6 +1179,41 @@ export function rotateTenantKey(id: string): { tenant: Tenant; raw_api_key: stri
   return { tenant, raw_api_key: rawKey };
 }
 
+// ─── Tenant API keys (additional keys per tenant) ───────────────────────────
+
+export function createTenantKey(
+  tenantId: string,
+  data: { label?: string; expires_at?: string }
+): { key: TenantKey; raw_api_key: string } | undefined {
+  const d = getDB();
+  const tenant = d.prepare("SELECT id FROM tenants WHERE id = ?").get(tenantId);
+  if (!tenant) return undefined;
+
+  const id = uuidv4();
+  const rawKey = generateTenantApiKey();
+  d.prepare(
+    `INSERT INTO tenant_keys (id, tenant_id, key_hash, key_prefix, label, expires_at)
+     VALUES (?, ?, ?, ?, ?, ?)`
+  ).run(id, tenantId, hashApiKey(rawKey), rawKey.substring(0, 8), data.label ?? null, data.expires_at ?? null);
+
+  const key = d.prepare(
+    "SELECT id, tenant_id, key_prefix, label, enabled, last_used_at, expires_at, created_at FROM tenant_keys WHERE id = ?"
+  ).get(id) as TenantKey;
+  return { key, raw_api_key: rawKey };
+}
+
+export function getTenantKeys(tenantId: string): TenantKey[] {
+  return getDB().prepare(
+    "SELECT id, tenant_id, key_prefix, label, enabled, last_used_at, expires_at, created_at FROM tenant_keys WHERE tenant_id = ? ORDER BY created_at ASC"
+  ).all(tenantId) as TenantKey[];
+}
+
+export function revokeTenantKey(tenantId: string, keyId: string): boolean {
+  return getDB().prepare(
+    "UPDATE tenant_keys SET enabled = 0 WHERE id = ? AND tenant_id = ?"
+  ).run(keyId, tenantId).changes > 0;
+}
+
 export function getTenantSettings(tenantId: string): Record<string, string> {
   const rows = getDB().prepare("SELECT key, value FROM tenant_settings WHERE tenant_id = ?").all(tenantId) as Array<{ key: string; value: string }>;
   const result: Record<string, string> = {};
@@ -9,6 +9,8 @@ import { getSetting, setSetting } from "../db.js";
 import { registerBuiltinGuardrails } from "./builtin/index.js";
 import { getAllGuardrails, getAllConfigs, getGuardrail, setGuardrailEnabled } from "./registry.js";
 import {
+  KEY_CANARY_SETTING,
+  keyCanary,
   loadMappingsFromDB,
   deanonymize,
   createDeanonymizeStream,
@@ -28,6 +30,23 @@ export function initGuardrails(): void {
   registerBuiltinGuardrails();
   loadMappingsFromDB();
   syncConfigFromDB();
+  checkKeyCanary();
+}
+
+/**
+ * Compare the guardrail key against the stored canary, storing it when there
+ * is none. A mismatch means the proxy can't deanonymize tokens issued here.
+ */
+function checkKeyCanary(): void {
+  const stored = getSetting(KEY_CANARY_SETTING);
+  if (!stored) {
+    setSetting(KEY_CANARY_SETTING, keyCanary());
+  } else if (stored !== keyCanary()) {
+    console.error(
+      `[guardrails] Guardrail key doesn't match the key that wrote ${KEY_CANARY_SETTING}; ` +
+        "check that GUARDRAIL_KEY or .guardrail-key is the same for the dashboard and the proxy"
+    );
+  }
 }
 
 /**
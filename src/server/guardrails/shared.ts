@@ -103,6 +103,20 @@ export function decryptToken(token: string, domain: string): string | null {
   }
 }
 
+// ─── Key canary ──────────────────────────────────────────────────────────────
+
+/**
+ * A token of a fixed value, stored in settings by whichever of the dashboard
+ * and the proxy starts first. The other compares its own token against it, so
+ * a dashboard and proxy started with different guardrail keys notice.
+ * Must match internal/guardrails/keycheck.go.
+ */
+export const KEY_CANARY_SETTING = "guardrail_key_canary";
+
+export function keyCanary(): string {
+  return encryptForToken("codegate-guardrail-key-canary", "canary");
+}
+
 // ─── HMAC helper (for deterministic selection) ────────────────────────────────
 
 export function hmac(value: string): string {
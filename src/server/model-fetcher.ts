@@ -4,6 +4,14 @@
  */
 import { getEnabledAccounts, type AccountDecrypted } from "./db.js";
 
+/** Default anthropic-version; keep in step with provider.AnthropicVersion in the Go proxy. */
+export const ANTHROPIC_VERSION = "2023-06-01";
+
+/** The anthropic-version to send for an account: its override, or the default. */
+export function anthropicVersion(account: AccountDecrypted): string {
+  return account.anthropic_version || ANTHROPIC_VERSION;
+}
+
 export interface FetchedModel {
   id: string;
   name: string;
@@ -39,6 +47,11 @@ const BASE_URLS: Record<string, string> = {
 };
 
 function getBaseUrl(account: AccountDecrypted): string {
+  // GLM's Anthropic-compatible endpoint has no model list; the coding-plan
+  // OpenAI endpoint lists the same models
+  if (account.provider === "glm" && account.api_flavor === "anthropic") {
+    return BASE_URLS.glm;
+  }
   return account.base_url || BASE_URLS[account.provider] || "";
 }
 
@@ -51,14 +64,14 @@ function makeHeaders(account: AccountDecrypted): Record<string, string> {
     if (account.auth_type === "oauth") {
       return {
         Authorization: `Bearer ${key}`,
-        "anthropic-version": "2023-06-01",
+        "anthropic-version": anthropicVersion(account),
         "anthropic-beta": "oauth-2025-04-20,claude-code-20250219",
         "anthropic-dangerous-direct-browser-access": "true",
       };
     }
     return {
       "x-api-key": key,
-      "anthropic-version": "2023-06-01",
+      "anthropic-version": anthropicVersion(account),
     };
   }
 
@@ -10,6 +10,10 @@ export interface ModelLimits {
   maxOutputTokens: number | null;
   supportsToolCalling: boolean | null;
   supportsReasoning: boolean | null;
+  /** Stop sequences kept for the model; null means the proxy default of 4, 0 lifts the cap. */
+  maxStopSequences: number | null;
+  /** Longest stop sequence kept, in characters; null or 0 means no limit. */
+  maxStopSequenceLength: number | null;
 }
 
 // In-memory cache, loaded from DB
@@ -26,9 +30,17 @@ export function initModelLimitsTable(): void {
       model_id TEXT PRIMARY KEY,
       max_output_tokens INTEGER,
       supports_tool_calling INTEGER,
-      supports_reasoning INTEGER
+      supports_reasoning INTEGER,
+      max_stop_sequences INTEGER,
+      max_stop_sequence_length INTEGER
     )
   `);
+  const cols = db.prepare("SELECT name FROM pragma_table_info('model_limits')").all() as Array<{ name: string }>;
+  for (const col of ["max_stop_sequences", "max_stop_sequence_length"]) {
+    if (!cols.some((c) => c.name === col)) {
+      db.exec(`ALTER TABLE model_limits ADD COLUMN ${col} INTEGER`);
+    }
+  }
   reloadCache();
 }
 
@@ -39,6 +51,8 @@ function reloadCache(): void {
     max_output_tokens: number | null;
     supports_tool_calling: number | null;
     supports_reasoning: number | null;
+    max_stop_sequences: number | null;
+    max_stop_sequence_length: number | null;
   }>;
   cache = {};
   for (const row of rows) {
@@ -46,6 +60,8 @@ function reloadCache(): void {
       maxOutputTokens: row.max_output_tokens,
       supportsToolCalling: row.supports_tool_calling === null ? null : row.supports_tool_calling === 1,
       supportsReasoning: row.supports_reasoning === null ? null : row.supports_reasoning === 1,
+      maxStopSequences: row.max_stop_sequences,
+      maxStopSequenceLength: row.max_stop_sequence_length,
     };
   }
 }
@@ -90,21 +106,32 @@ export function getAllModelLimits(): Record<string, ModelLimits> {
  */
 export function setModelLimit(
   modelId: string,
-  limits: { maxOutputTokens?: number | null; supportsToolCalling?: boolean | null; supportsReasoning?: boolean | null }
+  limits: {
+    maxOutputTokens?: number | null;
+    supportsToolCalling?: boolean | null;
+    supportsReasoning?: boolean | null;
+    maxStopSequences?: number | null;
+    maxStopSequenceLength?: number | null;
+  }
 ): void {
   const db = getDb();
   db.prepare(
-    `INSERT INTO model_limits (model_id, max_output_tokens, supports_tool_calling, supports_reasoning)
-     VALUES (?, ?, ?, ?)
+    `INSERT INTO model_limits (model_id, max_output_tokens, supports_tool_calling, supports_reasoning,
+       max_stop_sequences, max_stop_sequence_length)
+     VALUES (?, ?, ?, ?, ?, ?)
      ON CONFLICT(model_id) DO UPDATE SET
        max_output_tokens = excluded.max_output_tokens,
        supports_tool_calling = excluded.supports_tool_calling,
-       supports_reasoning = excluded.supports_reasoning`
+       supports_reasoning = excluded.supports_reasoning,
+       max_stop_sequences = excluded.max_stop_sequences,
+       max_stop_sequence_length = excluded.max_stop_sequence_length`
   ).run(
     modelId,
     limits.maxOutputTokens ?? null,
     limits.supportsToolCalling === null || limits.supportsToolCalling === undefined ? null : limits.supportsToolCalling ? 1 : 0,
     limits.supportsReasoning === null || limits.supportsReasoning === undefined ? null : limits.supportsReasoning ? 1 : 0,
+    limits.maxStopSequences ?? null,
+    limits.maxStopSequenceLength ?? null,
   );
   reloadCache();
 }
@@ -7,9 +7,68 @@ import {
   deleteAccount,
   type AccountDecrypted,
 } from "../db.js";
+import { anthropicVersion } from "../model-fetcher.js";
 
 const accounts = new Hono();
 
+const validApiFlavors = ["openai", "anthropic"];
+
+/** Returns an error message if base_url isn't an absolute http(s) URL. */
+function baseUrlError(baseUrl: unknown): string | null {
+  if (baseUrl == null || baseUrl === "") return null;
+  try {
+    const u = new URL(String(baseUrl));
+    if (u.protocol !== "http:" && u.protocol !== "https:") {
+      return "base_url must use http or https";
+    }
+    return null;
+  } catch {
+    return "base_url must be an absolute URL, e.g. https://api.example.com/v1";
+  }
+}
+
+const openRouterPrefFields = ["provider", "models", "transforms", "route"];
+
+/**
+ * Returns an error message if openrouter_prefs isn't a JSON object of
+ * OpenRouter routing fields. The proxy checks the values themselves.
+ */
+function openRouterPrefsError(prefs: unknown): string | null {
+  if (prefs == null || prefs === "") return null;
+  let parsed: unknown;
+  try {
+    parsed = JSON.parse(String(prefs));
+  } catch {
+    return "openrouter_prefs must be valid JSON";
+  }
+  if (typeof parsed !== "object" || parsed === null || Array.isArray(parsed)) {
+    return "openrouter_prefs must be a JSON object";
+  }
+  const unknown = Object.keys(parsed).filter((k) => !openRouterPrefFields.includes(k));
+  if (unknown.length > 0) {
+    return `openrouter_prefs may only set: ${openRouterPrefFields.join(", ")} (got ${unknown.join(", ")})`;
+  }
+  return null;
+}
+
+/**
+ * Returns an error message if simulator_settings isn't a JSON object. The
+ * proxy checks the values themselves.
+ */
+function simulatorSettingsError(settings: unknown): string | null {
+  if (settings == null || settings === "") return null;
+  let parsed: unknown;
+  try {
+    parsed = JSON.parse(String(settings));
+  } catch {
+    return "simulator_settings must be valid JSON";
+  }
+  if (typeof parsed !== "object" || parsed === null || Array.isArray(parsed)) {
+    return "simulator_settings must be a JSON object";
+  }
+  return null;
+}
+
 /**
  * Mask an API key for safe display: first 8 chars + "..." + last 4 chars.
  * Returns null for null/undefined keys.
@@ -52,7 +111,7 @@ accounts.post("/", async (c) => {
 
     const validProviders = [
       "anthropic", "openai", "openai_sub", "openrouter",
-      "glm", "cerebras", "deepseek", "gemini", "minimax", "custom",
+      "glm", "cerebras", "deepseek", "gemini", "minimax", "custom", "simulator",
     ];
     if (!validProviders.includes(body.provider)) {
       return c.json(
@@ -60,6 +119,21 @@ accounts.post("/", async (c) => {
         400
       );
     }
+    if (body.api_flavor != null && !validApiFlavors.includes(body.api_flavor)) {
+      return c.json({ error: `api_flavor must be one of: ${validApiFlavors.join(", ")}` }, 400);
+    }
+    const urlErr = baseUrlError(body.base_url);
+    if (urlErr) {
+      return c.json({ error: urlErr }, 400);
+    }
+    const prefsErr = openRouterPrefsError(body.openrouter_prefs);
+    if (prefsErr) {
+      return c.json({ error: prefsErr }, 400);
+    }
+    const simErr = simulatorSettingsError(body.simulator_settings);
+    if (simErr) {
+      return c.json({ error: simErr }, 400);
+    }
 
     const account = createAccount({
       name: body.name,
@@ -72,9 +146,21 @@ accounts.post("/", async (c) => {
       priority: body.priority,
       rate_limit: body.rate_limit,
       monthly_budget: body.monthly_budget,
+      daily_budget: body.daily_budget ?? null,
       enabled: body.enabled,
       subscription_type: body.subscription_type,
       account_email: body.account_email,
+      api_flavor: body.api_flavor ?? undefined,
+      allowed_betas: body.allowed_betas ?? null,
+      anthropic_version: body.anthropic_version ?? null,
+      openrouter_prefs: body.openrouter_prefs ?? null,
+      failover_enabled: body.failover_enabled ?? null,
+      max_failover_candidates: body.max_failover_candidates ?? null,
+      system_prompt_prefix: body.system_prompt_prefix ?? null,
+      connect_timeout_ms: body.connect_timeout_ms ?? null,
+      header_timeout_ms: body.header_timeout_ms ?? null,
+      response_timeout_ms: body.response_timeout_ms ?? null,
+      simulator_settings: body.simulator_settings ?? null,
     });
 
     return c.json(maskAccount(account), 201);
@@ -102,6 +188,21 @@ accounts.put("/:id", async (c) => {
   try {
     const id = c.req.param("id");
     const body = await c.req.json();
+    if (body.api_flavor != null && !validApiFlavors.includes(body.api_flavor)) {
+      return c.json({ error: `api_flavor must be one of: ${validApiFlavors.join(", ")}` }, 400);
+    }
+    const urlErr = baseUrlError(body.base_url);
+    if (urlErr) {
+      return c.json({ error: urlErr }, 400);
+    }
+    const prefsErr = openRouterPrefsError(body.openrouter_prefs);
+    if (prefsErr) {
+      return c.json({ error: prefsErr }, 400);
+    }
+    const simErr = simulatorSettingsError(body.simulator_settings);
+    if (simErr) {
+      return c.json({ error: simErr }, 400);
+    }
 
     const account = updateAccount(id, body);
     if (!account) {
@@ -161,12 +262,16 @@ accounts.post("/:id/test", async (c) => {
     // Try a lightweight request to verify credentials work
     const apiKey = account.api_key || "";
 
-    if (account.provider === "anthropic") {
+    const speaksAnthropic = account.api_flavor
+      ? account.api_flavor === "anthropic"
+      : account.provider === "anthropic";
+
+    if (speaksAnthropic) {
       // Use Anthropic messages endpoint with a tiny request
       // OAuth accounts need Bearer token + beta headers, API key accounts use x-api-key
       const headers: Record<string, string> = {
         "content-type": "application/json",
-        "anthropic-version": "2023-06-01",
+        "anthropic-version": anthropicVersion(account),
       };
 
       if (account.auth_type === "oauth") {
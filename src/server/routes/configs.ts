@@ -160,6 +160,7 @@ configs.put("/:id/tiers", async (c) => {
 
     // Validate each tier assignment
     const validTiers = ["opus", "sonnet", "haiku"];
+    const validConditions = ["thinking", "no_thinking", "tools", "no_tools", "vision", "no_vision"];
     for (const tier of body) {
       if (!tier.tier || !tier.account_id) {
         return c.json({ error: "Each tier assignment must have tier and account_id" }, 400);
@@ -170,6 +171,15 @@ configs.put("/:id/tiers", async (c) => {
           400
         );
       }
+      if (tier.fallback_models != null && tier.fallback_models !== "" && !isModelList(tier.fallback_models)) {
+        return c.json({ error: "fallback_models must be a JSON array of model names" }, 400);
+      }
+      if (tier.condition != null && tier.condition !== "" && !validConditions.includes(tier.condition)) {
+        return c.json(
+          { error: `condition must be one of: ${validConditions.join(", ")}` },
+          400
+        );
+      }
     }
 
     const tiers = setConfigTiers(
@@ -179,6 +189,8 @@ configs.put("/:id/tiers", async (c) => {
         account_id: t.account_id,
         priority: t.priority,
         target_model: t.target_model,
+        condition: t.condition,
+        fallback_models: t.fallback_models,
       }))
     );
 
@@ -188,4 +200,15 @@ configs.put("/:id/tiers", async (c) => {
   }
 });
 
+// isModelList reports whether value is a JSON array of model names.
+function isModelList(value: unknown): boolean {
+  if (typeof value !== "string") return false;
+  try {
+    const parsed = JSON.parse(value);
+    return Array.isArray(parsed) && parsed.every((m) => typeof m === "string" && m !== "");
+  } catch {
+    return false;
+  }
+}
+
 export default configs;
@@ -14,6 +14,7 @@ import {
   rotateAccountKey as rotateAccountKeyFn,
   rotateGuardrailKey as rotateGuardrailKeyFn,
 } from "../encryption.js";
+import { KEY_CANARY_SETTING, keyCanary } from "../guardrails/shared.js";
 
 const settings = new Hono();
 
@@ -117,6 +118,8 @@ settings.put("/model-limits/:modelId", async (c) => {
       maxOutputTokens: body.maxOutputTokens ?? null,
       supportsToolCalling: body.supportsToolCalling ?? null,
       supportsReasoning: body.supportsReasoning ?? null,
+      maxStopSequences: body.maxStopSequences ?? null,
+      maxStopSequenceLength: body.maxStopSequenceLength ?? null,
     });
     return c.json(getAllModelLimits());
   } catch (err: any) {
@@ -176,6 +179,8 @@ settings.post("/encryption/rotate-account-key", (c) => {
 settings.post("/encryption/rotate-guardrail-key", (c) => {
   try {
     const newKey = rotateGuardrailKeyFn();
+    // The proxy reports a mismatch on /ready until it restarts with the new key
+    setSetting(KEY_CANARY_SETTING, keyCanary());
     return c.json({
       fingerprint: getKeyFingerprint(newKey),
     });
@@ -6,6 +6,9 @@ import {
   updateTenant,
   deleteTenant,
   rotateTenantKey,
+  createTenantKey,
+  getTenantKeys,
+  revokeTenantKey,
   getTenantSettings,
   setTenantSetting,
   deleteTenantSetting,
@@ -25,7 +28,7 @@ router.get("/", (c) => {
 router.post("/", async (c) => {
   try {
     const body = await c.req.json();
-    const { name, config_id, rate_limit } = body;
+    const { name, config_id, rate_limit, rate_limit_background } = body;
     if (!name || typeof name !== "string" || name.trim().length === 0) {
       return c.json({ error: "name is required" }, 400);
     }
@@ -36,6 +39,7 @@ router.post("/", async (c) => {
       name: name.trim(),
       config_id: config_id || undefined,
       rate_limit: typeof rate_limit === "number" ? rate_limit : undefined,
+      rate_limit_background: typeof rate_limit_background === "number" ? rate_limit_background : undefined,
     });
     return c.json({
       tenant: result.tenant,
@@ -62,7 +66,7 @@ router.get("/:id", (c) => {
 router.put("/:id", async (c) => {
   try {
     const body = await c.req.json();
-    const { name, config_id, rate_limit, enabled } = body;
+    const { name, config_id, rate_limit, rate_limit_background, enabled } = body;
     if (config_id) {
       if (!getConfig(config_id)) return c.json({ error: "Config not found" }, 404);
     }
@@ -70,6 +74,7 @@ router.put("/:id", async (c) => {
       ...(name !== undefined && { name }),
       ...(config_id !== undefined && { config_id }),
       ...(rate_limit !== undefined && { rate_limit }),
+      ...(rate_limit_background !== undefined && { rate_limit_background }),
       ...(enabled !== undefined && { enabled }),
     });
     if (!tenant) return c.json({ error: "Tenant not found" }, 404);
@@ -140,4 +145,50 @@ router.post("/:id/rotate-key", (c) => {
   }
 });
 
+router.get("/:id/keys", (c) => {
+  try {
+    const id = c.req.param("id");
+    if (!getTenant(id)) return c.json({ error: "Tenant not found" }, 404);
+    return c.json(getTenantKeys(id));
+  } catch (err: any) {
+    return c.json({ error: err.message }, 500);
+  }
+});
+
+router.post("/:id/keys", async (c) => {
+  try {
+    const body = await c.req.json().catch(() => ({}));
+    const { label, expires_at } = body;
+    if (label !== undefined && typeof label !== "string") {
+      return c.json({ error: "label must be a string" }, 400);
+    }
+    if (expires_at !== undefined && (typeof expires_at !== "string" || isNaN(Date.parse(expires_at)))) {
+      return c.json({ error: "expires_at must be a date string" }, 400);
+    }
+    const result = createTenantKey(c.req.param("id"), {
+      label: label?.trim() || undefined,
+      // Stored in SQLite datetime format so it compares against datetime('now')
+      expires_at: expires_at ? new Date(expires_at).toISOString().replace("T", " ").substring(0, 19) : undefined,
+    });
+    if (!result) return c.json({ error: "Tenant not found" }, 404);
+    return c.json({
+      key: result.key,
+      api_key: result.raw_api_key,
+    }, 201);
+  } catch (err: any) {
+    return c.json({ error: err.message }, 500);
+  }
+});
+
+router.delete("/:id/keys/:keyId", (c) => {
+  try {
+    if (!revokeTenantKey(c.req.param("id"), c.req.param("keyId"))) {
+      return c.json({ error: "Key not found" }, 404);
+    }
+    return c.json({ ok: true });
+  } catch (err: any) {
+    return c.json({ error: err.message }, 500);
+  }
+});
+
 export default router;